@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// addressesAnnotationKey limits a capture to the traffic to and from IPs and
+// CIDRs, comma separated, for peers that are not Pods: an external
+// dependency or a LoadBalancer VIP. On a Node capture without an interface
+// annotation the agent also picks the interfaces the node routes them
+// through.
+const addressesAnnotationKey = "addresses." + annotationKey
+
+// parseAddresses parses the addresses annotation. Single IPs become
+// host-length prefixes.
+func parseAddresses(v string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, s := range strings.Split(v, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		var p netip.Prefix
+		if strings.Contains(s, "/") {
+			var err error
+			if p, err = netip.ParsePrefix(s); err != nil {
+				return nil, fmt.Errorf("invalid CIDR %q", s)
+			}
+			p = p.Masked()
+		} else {
+			ip, err := netip.ParseAddr(s)
+			if err != nil {
+				return nil, fmt.Errorf("invalid IP %q", s)
+			}
+			ip = ip.Unmap()
+			p = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		prefixes = append(prefixes, p)
+	}
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no address given")
+	}
+	return prefixes, nil
+}
+
+// addressFilter returns a BPF expression that matches packets from or to
+// one of prefixes.
+func addressFilter(prefixes []netip.Prefix) string {
+	terms := make([]string, len(prefixes))
+	for i, p := range prefixes {
+		if p.IsSingleIP() {
+			terms[i] = "host " + p.Addr().String()
+		} else {
+			terms[i] = "net " + p.String()
+		}
+	}
+	return anyOf(terms)
+}
+
+// routeInterfaces returns the interfaces the node routes prefixes through,
+// each once, in the order of prefixes. It returns nil where routes cannot
+// be read, which keeps the default interface.
+func routeInterfaces(prefixes []netip.Prefix) ([]string, error) {
+	routes, err := nodeRoutes()
+	if err != nil || routes == nil {
+		return nil, err
+	}
+	var ifaces []string
+	for _, p := range prefixes {
+		best := -1
+		for i, r := range routes {
+			if !r.dst.Contains(p.Addr()) || r.dst.Bits() > p.Bits() {
+				continue
+			}
+			if best < 0 || r.dst.Bits() > routes[best].dst.Bits() ||
+				r.dst.Bits() == routes[best].dst.Bits() && r.metric < routes[best].metric {
+				best = i
+			}
+		}
+		if best < 0 {
+			return nil, fmt.Errorf("the node has no route to %s", p)
+		}
+		if iface := routes[best].iface; !slices.Contains(ifaces, iface) {
+			ifaces = append(ifaces, iface)
+		}
+	}
+	return ifaces, nil
+}
+
+// route is an entry of the node's routing table.
+type route struct {
+	dst    netip.Prefix
+	iface  string
+	metric int
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultAdminSocket is where the agent listens for node operators. The
+// DaemonSet mounts its directory from the host, so it is reachable from a
+// node shell as well as through kubectl exec.
+const defaultAdminSocket = "/var/run/packet-capture/admin.sock"
+
+// errAdminStop completes a capture a node operator stopped through the admin
+// socket. Like an autostop condition it keeps the capture from starting
+// again until its annotation is removed.
+const errAdminStop autostopCondition = "stopped through the admin socket"
+
+// adminSession is a running capture as the admin socket lists it.
+type adminSession struct {
+	Key string `json:"key"`
+	captureStatus
+}
+
+// adminStats is the answer of GET /stats.
+type adminStats struct {
+	Node     string `json:"node"`
+	Captures int    `json:"captures"`
+	Pending  int    `json:"pending"`
+	// Packets adds up the packet counts of the running captures.
+	Packets captureStats `json:"packets"`
+	// UsageBytes is what the capture directory is committed to, FreeBytes
+	// what its filesystem has left.
+	UsageBytes int64               `json:"usageBytes"`
+	FreeBytes  int64               `json:"freeBytes"`
+	Sessions   []adminSessionStats `json:"sessions"`
+}
+
+// adminSessionStats are the counters of one running capture.
+type adminSessionStats struct {
+	Key       string        `json:"key"`
+	SessionID string        `json:"sessionID"`
+	Packets   *captureStats `json:"packets,omitempty"`
+	Cost      *captureCost  `json:"cost,omitempty"`
+	Files     int           `json:"files"`
+	Bytes     int64         `json:"bytes"`
+}
+
+// adminGCResult is the answer of POST /gc.
+type adminGCResult struct {
+	Orphaned int `json:"orphaned"`
+	Expired  int `json:"expired"`
+	Kept     int `json:"kept"`
+}
+
+// serveAdmin serves the admin API on the Unix socket at path until ctx is
+// cancelled. It has no authentication of its own: the socket is only
+// accessible to root on the node, who could as well kill tcpdump and
+// delete the files by hand.
+func (m *CaptureManager) serveAdmin(ctx context.Context, path string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		slog.Error("Admin socket failed", "err", err)
+		return
+	}
+	// A socket left by a previous agent instance would fail the listen.
+	os.Remove(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		slog.Error("Admin socket failed", "err", err)
+		return
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		ln.Close()
+		slog.Error("Admin socket failed", "err", err)
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/sessions", m.handleAdminSessions)
+	mux.HandleFunc("/sessions/", m.handleAdminStop)
+	mux.HandleFunc("/stats", m.handleAdminStats)
+	mux.HandleFunc("/gc", m.handleAdminGC)
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("Admin socket listening", "path", path)
+	if err := srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("Admin socket failed", "err", err)
+	}
+}
+
+// handleAdminSessions lists the running captures of the agent, the node
+// capture included, with their status.
+func (m *CaptureManager) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	m.mu.Lock()
+	sessions := make([]adminSession, 0, len(m.captures))
+	for key, cap := range m.captures {
+		st := m.status(cap)
+		switch {
+		case cap.completed.Load():
+			st.State, st.PID = stateCompleted, 0
+		case cap.exited.Load():
+			st.State, st.PID = stateFailed, 0
+		}
+		sessions = append(sessions, adminSession{Key: key, captureStatus: st})
+	}
+	m.mu.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Key < sessions[j].Key })
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+// handleAdminStop serves POST /sessions/<id>/stop. The capture completes as
+// if it had met an autostop condition, so the files are finished like
+// those of any other session and the workqueue does not start it again.
+func (m *CaptureManager) handleAdminStop(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/sessions/"), "/")
+	if id == "" || action != "stop" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var key string
+	var cap *CaptureProcess
+	m.mu.Lock()
+	for k, c := range m.captures {
+		if c.sessionID == id {
+			key, cap = k, c
+		}
+	}
+	m.mu.Unlock()
+	if cap == nil {
+		http.Error(w, "capture not found", http.StatusNotFound)
+		return
+	}
+	if !m.completeCapture(key, cap, errAdminStop) {
+		http.Error(w, "capture already completed", http.StatusConflict)
+		return
+	}
+	cap.log.Info("Stopped capture on the admin socket's request")
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// handleAdminStats returns the packet counters and cost of the running
+// captures and the disk usage of the agent.
+func (m *CaptureManager) handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	stats := adminStats{Node: m.nodeName, Sessions: []adminSessionStats{}}
+	m.mu.Lock()
+	for key, cap := range m.captures {
+		files, total := captureFiles(cap)
+		s := adminSessionStats{Key: key, SessionID: cap.sessionID, Files: len(files), Bytes: total}
+		if cap.proc != nil && !cap.completed.Load() && !cap.exited.Load() {
+			packets, cost := cap.proc.Stats(), cap.proc.Cost()
+			s.Packets, s.Cost = &packets, &cost
+			stats.Captures++
+			stats.Packets.Captured += packets.Captured
+			stats.Packets.Received += packets.Received
+			stats.Packets.Dropped += packets.Dropped
+			stats.Packets.RateLimited += packets.RateLimited
+		}
+		stats.Sessions = append(stats.Sessions, s)
+	}
+	stats.Pending = len(m.pending)
+	stats.UsageBytes = m.nodeUsage()
+	m.mu.Unlock()
+	stats.FreeBytes, _ = diskFree(m.cfg.CaptureDir)
+	sort.Slice(stats.Sessions, func(i, j int) bool { return stats.Sessions[i].Key < stats.Sessions[j].Key })
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// handleAdminGC runs orphan collection and, in the ttl retention mode, the
+// janitor right away instead of waiting for the next agent start or tick.
+func (m *CaptureManager) handleAdminGC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var res adminGCResult
+	var err error
+	if res.Orphaned, res.Kept, err = m.removeOrphans(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.cfg.Retention.Mode == RetentionTTL {
+		res.Expired = m.expireFiles(time.Now().Add(-m.cfg.Retention.TTL))
+	}
+	slog.Info("Collected capture files on the admin socket's request", "orphaned", res.Orphaned, "expired", res.Expired, "kept", res.Kept)
+	writeJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// anonymization selects how packets are scrubbed before they are written.
+type anonymization struct {
+	// Payload truncates packets after their transport header.
+	Payload bool
+	// IPs replaces IP addresses with keyed pseudonyms.
+	IPs bool
+}
+
+func (a anonymization) enabled() bool { return a.Payload || a.IPs }
+
+func (a anonymization) String() string {
+	var modes []string
+	if a.Payload {
+		modes = append(modes, "payload")
+	}
+	if a.IPs {
+		modes = append(modes, "ips")
+	}
+	return strings.Join(modes, ",")
+}
+
+// parseAnonymization parses a comma separated list of payload and ips.
+func parseAnonymization(v string) (anonymization, error) {
+	var a anonymization
+	for _, mode := range strings.Split(v, ",") {
+		switch strings.TrimSpace(mode) {
+		case "payload":
+			a.Payload = true
+		case "ips":
+			a.IPs = true
+		case "":
+		default:
+			return a, fmt.Errorf("unknown anonymization %q", mode)
+		}
+	}
+	return a, nil
+}
+
+// anonymizer scrubs packets in place. IP pseudonyms are an HMAC of the
+// address under a key drawn for each capture, so they are consistent within
+// a capture but cannot be reversed or correlated across captures. IPv4
+// pseudonyms fall in the reserved 240.0.0.0/4 and IPv6 ones in fd00::/8, so
+// they are never mistaken for real addresses.
+type anonymizer struct {
+	mode     anonymization
+	linkType layers.LinkType
+	key      []byte
+}
+
+func newAnonymizer(mode anonymization, linkType layers.LinkType) *anonymizer {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return &anonymizer{mode: mode, linkType: linkType, key: key}
+}
+
+// apply returns data scrubbed according to the mode. Every IP header is
+// pseudonymized, those inside tunnels too, as are ARP and Neighbor
+// Discovery addresses and the headers quoted in ICMP errors. IPv4 header
+// checksums are recomputed; transport checksums are left stale.
+func (a *anonymizer) apply(data []byte) []byte {
+	packet := gopacket.NewPacket(data, a.linkType, gopacket.DecodeOptions{NoCopy: true})
+	if a.mode.IPs {
+		for _, l := range packet.Layers() {
+			switch l := l.(type) {
+			case *layers.IPv4:
+				a.pseudonymize(l.SrcIP, 0xf0)
+				a.pseudonymize(l.DstIP, 0xf0)
+				ipv4Checksum(l.Contents)
+			case *layers.IPv6:
+				a.pseudonymize(l.SrcIP, 0xfd)
+				a.pseudonymize(l.DstIP, 0xfd)
+			case *layers.ARP:
+				a.pseudonymizeAddr(l.SourceProtAddress)
+				a.pseudonymizeAddr(l.DstProtAddress)
+			case *layers.ICMPv4:
+				switch l.TypeCode.Type() {
+				case layers.ICMPv4TypeRedirect:
+					// The gateway is in the second word of the header.
+					a.pseudonymizeAt(l.Contents, 4, net.IPv4len, 0xf0)
+					a.quotedHeader(l.Payload)
+				case layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4TypeSourceQuench,
+					layers.ICMPv4TypeTimeExceeded, layers.ICMPv4TypeParameterProblem:
+					a.quotedHeader(l.Payload)
+				}
+			case *layers.ICMPv6:
+				switch l.TypeCode.Type() {
+				case layers.ICMPv6TypeDestinationUnreachable, layers.ICMPv6TypePacketTooBig,
+					layers.ICMPv6TypeTimeExceeded, layers.ICMPv6TypeParameterProblem:
+					// The quoted packet follows a word of MTU or pointer.
+					if len(l.Payload) > 4 {
+						a.quotedHeader(l.Payload[4:])
+					}
+				}
+			// Neighbor Discovery names the address it resolves in its
+			// body.
+			case *layers.ICMPv6NeighborSolicitation:
+				a.pseudonymize(l.TargetAddress, 0xfd)
+			case *layers.ICMPv6NeighborAdvertisement:
+				a.pseudonymize(l.TargetAddress, 0xfd)
+			case *layers.ICMPv6Redirect:
+				a.pseudonymize(l.TargetAddress, 0xfd)
+				a.pseudonymize(l.DestinationAddress, 0xfd)
+			}
+		}
+	}
+	if a.mode.Payload {
+		if end := headersEnd(packet, data); end > 0 {
+			data = data[:end]
+		}
+	}
+	return data
+}
+
+// headersEnd returns the offset in data just past the innermost transport
+// or ICMP header, falling back to the network header, or 0 if packet has
+// neither.
+func headersEnd(packet gopacket.Packet, data []byte) int {
+	var last gopacket.Layer
+	for _, l := range packet.Layers() {
+		switch l.(type) {
+		case gopacket.TransportLayer, gopacket.NetworkLayer, *layers.ICMPv4, *layers.ICMPv6:
+			last = l
+		}
+	}
+	if last == nil {
+		return 0
+	}
+	// With NoCopy the layer contents alias data, so their offset follows
+	// from the remaining capacity.
+	contents := last.LayerContents()
+	return cap(data) - cap(contents) + len(contents)
+}
+
+// pseudonymize overwrites ip in place with its pseudonym, whose first byte
+// is prefix.
+func (a *anonymizer) pseudonymize(ip net.IP, prefix byte) {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(ip)
+	sum := mac.Sum(nil)
+	copy(ip, sum)
+	if prefix == 0xf0 {
+		ip[0] = prefix | ip[0]&0x0f
+	} else {
+		ip[0] = prefix
+	}
+}
+
+// pseudonymizeAddr pseudonymizes an IPv4 or IPv6 address of another
+// protocol, such as ARP, and clears addresses of other sizes.
+func (a *anonymizer) pseudonymizeAddr(addr []byte) {
+	switch len(addr) {
+	case net.IPv4len:
+		a.pseudonymize(addr, 0xf0)
+	case net.IPv6len:
+		a.pseudonymize(addr, 0xfd)
+	default:
+		clear(addr)
+	}
+}
+
+// pseudonymizeAt pseudonymizes the address of size bytes at off in b. An
+// address cut short by the snaplen is cleared instead, so no part of it is
+// written.
+func (a *anonymizer) pseudonymizeAt(b []byte, off, size int, prefix byte) {
+	switch {
+	case len(b) >= off+size:
+		a.pseudonymize(b[off:off+size], prefix)
+	case len(b) > off:
+		clear(b[off:])
+	}
+}
+
+// quotedHeader pseudonymizes the IP header an ICMP error quotes in b, the
+// header of the packet the error is about.
+func (a *anonymizer) quotedHeader(b []byte) {
+	if len(b) == 0 {
+		return
+	}
+	switch b[0] >> 4 {
+	case 4:
+		a.pseudonymizeAt(b, 12, net.IPv4len, 0xf0)
+		a.pseudonymizeAt(b, 16, net.IPv4len, 0xf0)
+		if ihl := int(b[0]&0x0f) * 4; ihl >= 20 && len(b) >= ihl {
+			ipv4Checksum(b[:ihl])
+		}
+	case 6:
+		a.pseudonymizeAt(b, 8, net.IPv6len, 0xfd)
+		a.pseudonymizeAt(b, 24, net.IPv6len, 0xfd)
+	}
+}
+
+// scrubText replaces the IP addresses in text, such as a filter
+// expression, with the pseudonyms they have in the packets. Networks keep
+// their prefix length.
+func (a *anonymizer) scrubText(text string) string {
+	isAddr := func(r rune) bool {
+		return r == '.' || r == ':' || r == '/' || r >= '0' && r <= '9' || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F'
+	}
+	var b strings.Builder
+	for len(text) > 0 {
+		i := strings.IndexFunc(text, isAddr)
+		if i < 0 {
+			b.WriteString(text)
+			break
+		}
+		b.WriteString(text[:i])
+		text = text[i:]
+		end := strings.IndexFunc(text, func(r rune) bool { return !isAddr(r) })
+		if end < 0 {
+			end = len(text)
+		}
+		token := text[:end]
+		text = text[end:]
+		addr, bits, hasBits := strings.Cut(token, "/")
+		ip, err := netip.ParseAddr(addr)
+		if err != nil || ip.Zone() != "" {
+			b.WriteString(token)
+			continue
+		}
+		raw := ip.AsSlice()
+		if ip.Is4() {
+			a.pseudonymize(raw, 0xf0)
+		} else {
+			a.pseudonymize(raw, 0xfd)
+		}
+		pseudonym, _ := netip.AddrFromSlice(raw)
+		b.WriteString(pseudonym.String())
+		if hasBits {
+			b.WriteString("/" + bits)
+		}
+	}
+	return b.String()
+}
+
+// ipv4Checksum recomputes the checksum of the IPv4 header h in place.
+func ipv4Checksum(h []byte) {
+	if len(h) < 20 {
+		return
+	}
+	h[10], h[11] = 0, 0
+	var sum uint32
+	for i := 0; i+1 < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(h[10:], ^uint16(sum))
+}
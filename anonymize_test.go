@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+var (
+	testMACs = [2]net.HardwareAddr{{0x02, 0, 0, 0, 0, 1}, {0x02, 0, 0, 0, 0, 2}}
+	// The addresses of the test packets, none of which may be written.
+	clientIP  = net.IP{10, 201, 33, 17}
+	serverIP  = net.IP{10, 202, 44, 28}
+	routerIP  = net.IP{10, 203, 55, 39}
+	nodeIPs   = [2]net.IP{{192, 168, 77, 11}, {192, 168, 77, 12}}
+	client6IP = net.ParseIP("fd12:3456:789a::11")
+	server6IP = net.ParseIP("fd12:3456:789a::22")
+)
+
+// serialize encodes ls into a packet, computing lengths and checksums.
+func serialize(t *testing.T, ls ...gopacket.SerializableLayer) []byte {
+	t.Helper()
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatalf("serialize: %v", err)
+	}
+	return append([]byte(nil), buf.Bytes()...)
+}
+
+// anonymizationPackets returns packets carrying the test addresses in every
+// place the anonymizer scrubs.
+func anonymizationPackets(t *testing.T) [][]byte {
+	eth := func(typ layers.EthernetType) *layers.Ethernet {
+		return &layers.Ethernet{SrcMAC: testMACs[0], DstMAC: testMACs[1], EthernetType: typ}
+	}
+	ip4 := func(src, dst net.IP, proto layers.IPProtocol) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: proto, SrcIP: src, DstIP: dst}
+	}
+	ip6 := func(src, dst net.IP, next layers.IPProtocol) *layers.IPv6 {
+		return &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: next, SrcIP: src, DstIP: dst}
+	}
+	tcp := &layers.TCP{SrcPort: 40000, DstPort: 443, SYN: true, Window: 1024}
+	udpIP := ip4(clientIP, serverIP, layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp.SetNetworkLayerForChecksum(udpIP)
+	quoted4 := serialize(t, udpIP, udp, gopacket.Payload("query"))
+	udp6IP := ip6(client6IP, server6IP, layers.IPProtocolUDP)
+	udp6 := &layers.UDP{SrcPort: 40000, DstPort: 53}
+	udp6.SetNetworkLayerForChecksum(udp6IP)
+	quoted6 := serialize(t, udp6IP, udp6, gopacket.Payload("query"))
+
+	tcpIP := ip4(clientIP, serverIP, layers.IPProtocolTCP)
+	tcp.SetNetworkLayerForChecksum(tcpIP)
+	redirect := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeRedirect, 1)}
+	gateway := routerIP.To4()
+	redirect.Id, redirect.Seq = uint16(gateway[0])<<8|uint16(gateway[1]), uint16(gateway[2])<<8|uint16(gateway[3])
+	icmp6IP := ip6(server6IP, client6IP, layers.IPProtocolICMPv6)
+	unreachable6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeDestinationUnreachable, 3)}
+	unreachable6.SetNetworkLayerForChecksum(icmp6IP)
+	tunnelIP := ip4(nodeIPs[0], nodeIPs[1], layers.IPProtocolUDP)
+	tunnelUDP := &layers.UDP{SrcPort: 50000, DstPort: 4789}
+	tunnelUDP.SetNetworkLayerForChecksum(tunnelIP)
+
+	return [][]byte{
+		serialize(t, eth(layers.EthernetTypeIPv4), tcpIP, tcp),
+		serialize(t, eth(layers.EthernetTypeARP), &layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			Operation: layers.ARPRequest, SourceHwAddress: testMACs[0], SourceProtAddress: clientIP.To4(),
+			DstHwAddress: make([]byte, 6), DstProtAddress: serverIP.To4(),
+		}),
+		serialize(t, eth(layers.EthernetTypeIPv4), ip4(routerIP, clientIP, layers.IPProtocolICMPv4),
+			&layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, 3)}, gopacket.Payload(quoted4)),
+		serialize(t, eth(layers.EthernetTypeIPv4), ip4(routerIP, clientIP, layers.IPProtocolICMPv4), redirect, gopacket.Payload(quoted4)),
+		serialize(t, eth(layers.EthernetTypeIPv6), icmp6IP, unreachable6, gopacket.Payload(append(make([]byte, 4), quoted6...))),
+		serialize(t, eth(layers.EthernetTypeIPv4), tunnelIP, tunnelUDP, &layers.VXLAN{ValidIDFlag: true, VNI: 7},
+			eth(layers.EthernetTypeIPv4), ip4(clientIP, serverIP, layers.IPProtocolTCP), tcp),
+	}
+}
+
+func TestAnonymizedFileHidesAddresses(t *testing.T) {
+	dir := t.TempDir()
+	spec := captureSpec{
+		Path:      filepath.Join(dir, "capture-web.pcap"),
+		MaxFiles:  1,
+		RotateMB:  100,
+		Namespace: "default",
+		PodName:   "web",
+		SessionID: "s1",
+		Peer:      "shop/payments",
+		Filter:    "(host " + clientIP.String() + " or host " + client6IP.String() + ") and net " + serverIP.String() + "/16",
+		Anonymize: anonymization{IPs: true},
+	}
+	ring := newRingWriter(spec, "eth0", layers.LinkTypeEthernet, 262144)
+	for _, data := range anonymizationPackets(t) {
+		if err := ring.WritePacket(gopacket.CaptureInfo{Timestamp: time.Now(), CaptureLength: len(data), Length: len(data)}, data); err != nil {
+			t.Fatalf("WritePacket: %v", err)
+		}
+	}
+	if err := ring.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*"))
+	if len(files) < 2 {
+		t.Fatalf("wrote %v, want the capture file and its manifest", files)
+	}
+	originals := []net.IP{clientIP, serverIP, routerIP, nodeIPs[0], nodeIPs[1], client6IP, server6IP}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ip := range originals {
+			raw := ip.To4()
+			if raw == nil {
+				raw = ip.To16()
+			}
+			if bytes.Contains(data, raw) || bytes.Contains(data, []byte(ip.String())) {
+				t.Errorf("%s contains %s", filepath.Base(file), ip)
+			}
+		}
+		if bytes.Contains(data, []byte("shop/payments")) {
+			t.Errorf("%s names the peer", filepath.Base(file))
+		}
+	}
+
+	f, err := os.Open(spec.Path + "0")
+	if os.IsNotExist(err) {
+		f, err = os.Open(spec.Path)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		t.Fatalf("NewNgReader: %v", err)
+	}
+	intf, err := r.Interface(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The filter keeps its expression with the pseudonyms in place of the
+	// addresses.
+	if !strings.HasPrefix(intf.Filter, "(host ") || !strings.HasSuffix(intf.Filter, "/16") {
+		t.Errorf("filter %q does not show the pseudonyms", intf.Filter)
+	}
+	var packets int
+	for {
+		data, _, err := r.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadPacketData: %v", err)
+		}
+		packets++
+		for _, l := range gopacket.NewPacket(data, layers.LinkTypeEthernet, gopacket.Default).Layers() {
+			switch l := l.(type) {
+			case *layers.IPv4:
+				if l.SrcIP[0]&0xf0 != 0xf0 || l.DstIP[0]&0xf0 != 0xf0 {
+					t.Errorf("packet %d has IPv4 %s > %s, want pseudonyms in 240.0.0.0/4", packets, l.SrcIP, l.DstIP)
+				}
+			case *layers.IPv6:
+				if l.SrcIP[0] != 0xfd || l.DstIP[0] != 0xfd {
+					t.Errorf("packet %d has IPv6 %s > %s, want pseudonyms in fd00::/8", packets, l.SrcIP, l.DstIP)
+				}
+			}
+		}
+	}
+	if packets != len(anonymizationPackets(t)) {
+		t.Errorf("read %d packets, want %d", packets, len(anonymizationPackets(t)))
+	}
+}
+
+func TestScrubTextKeepsPseudonymsConsistent(t *testing.T) {
+	a := newAnonymizer(anonymization{IPs: true}, layers.LinkTypeEthernet)
+	data := serialize(t, &layers.Ethernet{SrcMAC: testMACs[0], DstMAC: testMACs[1], EthernetType: layers.EthernetTypeIPv4},
+		&layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: clientIP, DstIP: serverIP})
+	packet := gopacket.NewPacket(a.apply(data), layers.LinkTypeEthernet, gopacket.Default)
+	ip := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+
+	got := a.scrubText("host " + clientIP.String() + " and (port 53 or dst net " + serverIP.String() + "/16) and ip6")
+	want := "host " + ip.SrcIP.String() + " and (port 53 or dst net " + ip.DstIP.String() + "/16) and ip6"
+	if got != want {
+		t.Errorf("scrubText = %q, want %q", got, want)
+	}
+}
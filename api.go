@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// apiStartTimeout is how long POST /v1/captures waits for the capture
+	// to start before giving up.
+	apiStartTimeout = 15 * time.Second
+	apiStartPoll    = 200 * time.Millisecond
+)
+
+// podOptions maps the option names accepted by the API to their Pod
+// annotations.
+var podOptions = map[string]string{
+	"backend":       backendAnnotationKey,
+	"compress":      compressAnnotationKey,
+	"anonymize":     anonymizeAnnotationKey,
+	"mode":          modeAnnotationKey,
+	"sample":        sampleAnnotationKey,
+	"count":         countAnnotationKey,
+	"ring-buffer":   ringBufferAnnotationKey,
+	"autostop":      autostopAnnotationKey,
+	"stop-on":       stopOnAnnotationKey,
+	"budget":        budgetAnnotationKey,
+	"drops":         dropsAnnotationKey,
+	"direction":     directionAnnotationKey,
+	"output":        outputAnnotationKey,
+	"peer":          peerAnnotationKey,
+	"interface":     interfaceAnnotationKey,
+	"tunnel":        tunnelAnnotationKey,
+	"schedule":      scheduleAnnotationKey,
+	"container":     containerAnnotationKey,
+	"filter":        filterAnnotationKey,
+	"decode":        decodeAnnotationKey,
+	"metadata":      metadataAnnotationKey,
+	"priority":      priorityAnnotationKey,
+	"write-rate":    writeRateAnnotationKey,
+	"mirror":        mirrorAnnotationKey,
+	"bundle":        bundleAnnotationKey,
+	"storage":       storageAnnotationKey,
+	"traceparent":   traceparentAnnotationKey,
+	"dry-run":       dryRunAnnotationKey,
+	"nodes":         nodesAnnotationKey,
+	"addresses":     addressesAnnotationKey,
+	"node-selector": nodeSelectorAnnotationKey,
+}
+
+// captureRequest is the body of POST /v1/captures.
+type captureRequest struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	MaxFiles  int    `json:"maxFiles"`
+	// Session names a session to start next to the Pod's capture.
+	Session string `json:"session,omitempty"`
+	// Options holds per-capture options by name, e.g. "compress": "zstd".
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// captureResource is a capture session as returned by the API. Its ID is
+// the session ID.
+type captureResource struct {
+	ID        string        `json:"id"`
+	Namespace string        `json:"namespace"`
+	Pod       string        `json:"pod"`
+	Session   string        `json:"session,omitempty"`
+	Status    captureStatus `json:"status"`
+}
+
+// handleCaptures serves GET and POST /v1/captures.
+func (m *CaptureManager) handleCaptures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, m.captureResources(""))
+	case http.MethodPost:
+		m.createCapture(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleCapture serves GET and DELETE /v1/captures/<id>, and the actions
+// under it.
+func (m *CaptureManager) handleCapture(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/captures/"), "/")
+	if action == "snapshot" {
+		m.snapshotCapture(w, r, id)
+		return
+	}
+	if action != "" {
+		http.NotFound(w, r)
+		return
+	}
+	found := m.captureResources(id)
+	if id == "" || len(found) == 0 {
+		http.Error(w, "capture not found", http.StatusNotFound)
+		return
+	}
+	c := found[0]
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, c)
+	case http.MethodDelete:
+		pod, err := m.podLister.Pods(c.Namespace).Get(c.Pod)
+		if err != nil {
+			http.Error(w, "capture not found", http.StatusNotFound)
+			return
+		}
+		annotations := map[string]interface{}{
+			sessionAnnotationKey(annotationKey, c.Session):                nil,
+			sessionAnnotationKey(requesterAnnotationKey, c.Session):       nil,
+			sessionAnnotationKey(requesterGroupsAnnotationKey, c.Session): nil,
+		}
+		for _, key := range podOptions {
+			annotations[sessionAnnotationKey(key, c.Session)] = nil
+		}
+		if err := m.patchAnnotations(pod, annotations); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createCapture annotates the requested Pod and waits for its capture to
+// start, so callers get the session ID or the reason it failed.
+func (m *CaptureManager) createCapture(w http.ResponseWriter, r *http.Request) {
+	var req captureRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Namespace == "" || req.Pod == "" || req.MaxFiles <= 0 {
+		http.Error(w, "namespace, pod and a positive maxFiles are required", http.StatusBadRequest)
+		return
+	}
+	if req.Session != "" {
+		if err := validSessionName(req.Session); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	annotations := map[string]interface{}{sessionAnnotationKey(annotationKey, req.Session): strconv.Itoa(req.MaxFiles)}
+	// Options that are not requested are cleared, so leftovers from an
+	// earlier capture do not apply.
+	for _, key := range podOptions {
+		annotations[sessionAnnotationKey(key, req.Session)] = nil
+	}
+	for name, val := range req.Options {
+		key, ok := podOptions[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown option %q", name), http.StatusBadRequest)
+			return
+		}
+		annotations[sessionAnnotationKey(key, req.Session)] = val
+	}
+
+	settings := m.settings()
+	if !settings.namespaceAllowed(req.Namespace) {
+		http.Error(w, fmt.Sprintf("captures are not allowed in namespace %s", req.Namespace), http.StatusForbidden)
+		return
+	}
+	// The agent's own writes bypass the admission webhook, so it records
+	// the requester itself, and checks its groups like the webhook would.
+	user := apiUserInfo(r)
+	if len(settings.CaptureGroups) > 0 && !settings.groupsAllowed(user.Groups, req.Namespace) {
+		http.Error(w, fmt.Sprintf("user %s is not in a group allowed to capture in namespace %s", user.Username, req.Namespace), http.StatusForbidden)
+		return
+	}
+	groups, err := json.Marshal(append([]string{}, user.Groups...))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	annotations[sessionAnnotationKey(requesterAnnotationKey, req.Session)] = user.Username
+	annotations[sessionAnnotationKey(requesterGroupsAnnotationKey, req.Session)] = string(groups)
+	pod, err := m.podLister.Pods(req.Namespace).Get(req.Pod)
+	if apierrors.IsNotFound(err) {
+		// Each agent only manages the Pods on its own node.
+		http.Error(w, "pod not found on this node", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, exists := m.captureAnnotations(pod)[annotationKey]
+	if req.Session != "" {
+		_, exists = pod.Annotations[sessionAnnotationKey(annotationKey, req.Session)]
+	}
+	if exists {
+		http.Error(w, "a capture is already requested for this pod and session", http.StatusConflict)
+		return
+	}
+	requested := time.Now()
+	if err := m.patchAnnotations(pod, annotations); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	key := sessionKey(req.Namespace+"/"+req.Pod, req.Session)
+	for deadline := time.Now().Add(apiStartTimeout); time.Now().Before(deadline); time.Sleep(apiStartPoll) {
+		m.mu.Lock()
+		cap, ok := m.captures[key]
+		_, pending := m.pending[key]
+		var c captureResource
+		if ok {
+			c = captureResource{ID: cap.sessionID, Namespace: req.Namespace, Pod: req.Pod, Session: req.Session, Status: m.status(cap)}
+		}
+		m.mu.Unlock()
+		if ok {
+			w.Header().Set("Location", "/v1/captures/"+c.ID)
+			writeJSON(w, http.StatusCreated, c)
+			return
+		}
+		if pending {
+			// The capture gets its ID once it has a slot.
+			writeJSON(w, http.StatusAccepted, captureResource{Namespace: req.Namespace, Pod: req.Pod, Session: req.Session,
+				Status: captureStatus{State: statePending, Node: m.nodeName, Session: req.Session}})
+			return
+		}
+		if st, done := m.startResult(req.Namespace, req.Pod, req.Session, requested); done {
+			if st.State == stateValidated {
+				// A dry run ends with its outcome; there is no session
+				// to stop later, so the request is withdrawn now.
+				for key := range annotations {
+					annotations[key] = nil
+				}
+				if err := m.patchAnnotations(pod, annotations); err != nil {
+					slog.Warn("Failed to remove the annotations of a dry run", "namespace", req.Namespace, "pod", req.Pod, "err", err)
+				}
+				writeJSON(w, http.StatusOK, captureResource{Namespace: req.Namespace, Pod: req.Pod, Session: req.Session, Status: st})
+				return
+			}
+			http.Error(w, st.Message, http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	http.Error(w, "capture did not start in time", http.StatusGatewayTimeout)
+}
+
+// startResult returns the failed or validated status the agent wrote on the
+// Pod, or for its named session, after since, if any.
+func (m *CaptureManager) startResult(namespace, name, session string, since time.Time) (captureStatus, bool) {
+	var st captureStatus
+	pod, err := m.podLister.Pods(namespace).Get(name)
+	if err != nil || json.Unmarshal([]byte(pod.Annotations[sessionAnnotationKey(statusAnnotationKey, session)]), &st) != nil {
+		return st, false
+	}
+	return st, (st.State == stateFailed || st.State == stateValidated) && st.UpdatedAt.After(since)
+}
+
+// captureResources returns the captures on this node, or only the one with
+// the given session ID.
+func (m *CaptureManager) captureResources(id string) []captureResource {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]captureResource, 0, len(m.captures))
+	for key, cap := range m.captures {
+		if id != "" && cap.sessionID != id {
+			continue
+		}
+		ns, name, session, ok := splitCaptureKey(key)
+		if !ok {
+			// Node captures are managed through the Node annotation only.
+			continue
+		}
+		st := m.status(cap)
+		st.UpdatedAt = time.Now().UTC()
+		switch {
+		case cap.completed.Load():
+			st.State, st.PID = stateCompleted, 0
+		case cap.exited.Load():
+			st.State, st.PID = stateFailed, 0
+		}
+		out = append(out, captureResource{ID: cap.sessionID, Namespace: ns, Pod: name, Session: session, Status: st})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return sessionKey(out[i].Namespace+"/"+out[i].Pod, out[i].Session) < sessionKey(out[j].Namespace+"/"+out[j].Pod, out[j].Session)
+	})
+	return out
+}
+
+// patchAnnotations sets the given annotations on pod; nil values remove
+// them.
+func (m *CaptureManager) patchAnnotations(pod *corev1.Pod, annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": annotations},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = m.clientset.CoreV1().Pods(pod.Namespace).Patch(ctx, pod.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
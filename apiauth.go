@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// API authorization modes, the values of --api-authorization.
+const (
+	// apiAuthToken only admits the API token.
+	apiAuthToken = "token"
+	// apiAuthKubernetes also admits Kubernetes tokens and client
+	// certificates of users allowed by a SubjectAccessReview.
+	apiAuthKubernetes = "kubernetes"
+)
+
+const (
+	// apiReviewTimeout bounds token and access reviews of API requests.
+	apiReviewTimeout = 10 * time.Second
+	// apiReviewCacheTTL is how long their results are reused.
+	apiReviewCacheTTL = time.Minute
+)
+
+// apiAuth authenticates and authorizes requests to the capture endpoints
+// of the agent API. The API token may do anything. In kubernetes mode, a
+// client is also admitted as the user of its Kubernetes token or, without
+// one, of its client certificate, whose common name is the user and
+// organizations the groups like for the API server. The user then needs the
+// verb of the request on the capture subresource of the agent's Node.
+type apiAuth struct {
+	m          *CaptureManager
+	token      string
+	kubernetes bool
+
+	mu      sync.Mutex
+	reviews map[string]apiReview
+}
+
+type apiReview struct {
+	user    *authenticationv1.UserInfo
+	allowed bool
+	err     string
+	expires time.Time
+}
+
+// newAPIAuth returns the authentication of the agent API, or nil if it has
+// no way to admit anyone, which disables the capture endpoints.
+func newAPIAuth(m *CaptureManager) *apiAuth {
+	if m.cfg.APIToken == "" && m.cfg.APIAuthorization != apiAuthKubernetes {
+		return nil
+	}
+	return &apiAuth{
+		m:          m,
+		token:      m.cfg.APIToken,
+		kubernetes: m.cfg.APIAuthorization == apiAuthKubernetes,
+		reviews:    make(map[string]apiReview),
+	}
+}
+
+// wrap admits requests to next.
+func (a *apiAuth) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if a.token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(a.token)) == 1 {
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiUserKey{}, &authenticationv1.UserInfo{Username: apiTokenUser})))
+			return
+		}
+		if !a.kubernetes {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		user, status, err := a.authorize(r, bearer)
+		if err != nil {
+			slog.Info("API request denied", "path", r.URL.Path, "method", r.Method, "user", user.Username, "err", err)
+			if status == http.StatusUnauthorized {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), apiUserKey{}, user)))
+	})
+}
+
+// apiTokenUser is the user of requests made with the API token, which
+// names no one.
+const apiTokenUser = "api-token"
+
+type apiUserKey struct{}
+
+// apiUser returns the name of the user apiAuth admitted r as.
+func apiUser(r *http.Request) string {
+	return apiUserInfo(r).Username
+}
+
+// apiUserInfo returns the user apiAuth admitted r as, with its groups if
+// it authenticated with Kubernetes.
+func apiUserInfo(r *http.Request) authenticationv1.UserInfo {
+	user, _ := r.Context().Value(apiUserKey{}).(*authenticationv1.UserInfo)
+	if user == nil {
+		return authenticationv1.UserInfo{}
+	}
+	return *user
+}
+
+// requireClientCert rejects requests to next without a verified client
+// certificate, whatever else they authenticate with.
+func requireClientCert(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := verifiedClient(r.TLS); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorize identifies the user of r, by bearer or its client certificate,
+// and reviews its access. It returns the user, empty if it is unknown,
+// and, if it is not admitted, the status to answer with.
+func (a *apiAuth) authorize(r *http.Request, bearer string) (*authenticationv1.UserInfo, int, error) {
+	var user *authenticationv1.UserInfo
+	if bearer != "" {
+		review, err := a.cached(fmt.Sprintf("token/%x", sha256.Sum256([]byte(bearer))), func(ctx context.Context) (apiReview, error) {
+			u, err := a.m.reviewToken(ctx, bearer)
+			if err != nil {
+				return apiReview{}, err
+			}
+			return apiReview{user: u}, nil
+		})
+		if err != nil {
+			return &authenticationv1.UserInfo{}, http.StatusUnauthorized, err
+		}
+		user = review.user
+	} else if cert, err := verifiedClient(r.TLS); err == nil {
+		user = &authenticationv1.UserInfo{Username: cert.Subject.CommonName, Groups: cert.Subject.Organization}
+	} else {
+		return &authenticationv1.UserInfo{}, http.StatusUnauthorized, errors.New("no token or client certificate")
+	}
+	attrs := &authorizationv1.ResourceAttributes{
+		Verb:        apiVerb(r.Method),
+		Resource:    "nodes",
+		Subresource: captureSubresource,
+		Name:        a.m.nodeName,
+	}
+	// The review depends on all of the user, including its extra
+	// attributes, which JSON encodes with sorted keys.
+	encoded, err := json.Marshal(user)
+	if err != nil {
+		return user, http.StatusInternalServerError, err
+	}
+	key := "access/" + attrs.Verb + "/" + string(encoded)
+	review, err := a.cached(key, func(ctx context.Context) (apiReview, error) {
+		allowed, err := a.m.reviewAccess(ctx, user, attrs)
+		return apiReview{allowed: allowed}, err
+	})
+	if err != nil {
+		return user, http.StatusInternalServerError, err
+	}
+	if !review.allowed {
+		return user, http.StatusForbidden, fmt.Errorf("%s on nodes/%s %s not allowed", attrs.Verb, captureSubresource, attrs.Name)
+	}
+	return user, 0, nil
+}
+
+// cached returns the review of key, running it if there is none or it has
+// expired. Failed token reviews are cached too; errors talking to the API
+// server are not.
+func (a *apiAuth) cached(key string, run func(ctx context.Context) (apiReview, error)) (apiReview, error) {
+	a.mu.Lock()
+	review, ok := a.reviews[key]
+	a.mu.Unlock()
+	if ok && time.Now().Before(review.expires) {
+		if review.err != "" {
+			return review, errors.New(review.err)
+		}
+		return review, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), apiReviewTimeout)
+	defer cancel()
+	review, err := run(ctx)
+	if err != nil {
+		var rejected *tokenRejectedError
+		if !errors.As(err, &rejected) {
+			return review, err
+		}
+		review.err = err.Error()
+	}
+	review.expires = time.Now().Add(apiReviewCacheTTL)
+	a.mu.Lock()
+	for k, r := range a.reviews {
+		if time.Now().After(r.expires) {
+			delete(a.reviews, k)
+		}
+	}
+	a.reviews[key] = review
+	a.mu.Unlock()
+	return review, err
+}
+
+// apiVerb is the verb of a request with method in access reviews.
+func apiVerb(method string) string {
+	switch method {
+	case http.MethodPost:
+		return "create"
+	case http.MethodPut, http.MethodPatch:
+		return "update"
+	case http.MethodDelete:
+		return "delete"
+	}
+	return "get"
+}
+
+// tokenRejectedError is a token the API server did not authenticate.
+type tokenRejectedError struct{ reason string }
+
+func (e *tokenRejectedError) Error() string {
+	return "token not authenticated: " + e.reason
+}
+
+// reviewToken returns the user the Kubernetes token belongs to.
+func (m *CaptureManager) reviewToken(ctx context.Context, token string) (*authenticationv1.UserInfo, error) {
+	review, err := m.clientset.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot review token: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return nil, &tokenRejectedError{review.Status.Error}
+	}
+	return &review.Status.User, nil
+}
+
+// reviewAccess reports whether user may do what attrs describe.
+func (m *CaptureManager) reviewAccess(ctx context.Context, user *authenticationv1.UserInfo, attrs *authorizationv1.ResourceAttributes) (bool, error) {
+	extra := make(map[string]authorizationv1.ExtraValue, len(user.Extra))
+	for k, v := range user.Extra {
+		extra[k] = authorizationv1.ExtraValue(v)
+	}
+	review, err := m.clientset.AuthorizationV1().SubjectAccessReviews().Create(ctx, &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:               user.Username,
+			UID:                user.UID,
+			Groups:             user.Groups,
+			Extra:              extra,
+			ResourceAttributes: attrs,
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
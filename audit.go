@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+)
+
+// Audited actions.
+const (
+	auditStart    = "start"
+	auditStop     = "stop"
+	auditDownload = "download"
+	auditDelete   = "delete"
+	auditTamper   = "tamper"
+)
+
+// auditReasons are the reasons of the audit Events, by action.
+var auditReasons = map[string]string{
+	auditStart:    "AuditCaptureStarted",
+	auditStop:     "AuditCaptureStopped",
+	auditDownload: "AuditFileDownloaded",
+	auditDelete:   "AuditFileDeleted",
+	auditTamper:   "AuditFileTampered",
+}
+
+const (
+	// auditQueue is the number of audit Events waiting to be recorded;
+	// more are dropped.
+	auditQueue = 256
+	// auditEventTimeout bounds recording one audit Event.
+	auditEventTimeout = 10 * time.Second
+)
+
+// auditEntry is one line of the audit log, and the message of its Event.
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Node   string    `json:"node"`
+	// User requested the capture, or downloaded or deleted the files
+	// through the API; empty for what the agent did on its own.
+	User      string `json:"user,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+	Session   string `json:"session,omitempty"`
+	SessionID string `json:"sessionID,omitempty"`
+	Backend   string `json:"backend,omitempty"`
+	Filter    string `json:"filter,omitempty"`
+	// State is how a capture ended, and Reason why, or why files were
+	// deleted.
+	State  string      `json:"state,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+	Files  []auditFile `json:"files,omitempty"`
+}
+
+type auditFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// auditLog records every capture start and stop, file download and file
+// deletion, for security teams that treat captures as privileged. Entries
+// are appended as JSON lines to --audit-log and recorded as Events in
+// --audit-namespace, either or both.
+type auditLog struct {
+	node string
+	mu   sync.Mutex
+	f    *os.File
+	// namespace holds the audit Events, recorded by run from queue.
+	namespace string
+	events    typedcorev1.EventInterface
+	queue     chan auditEntry
+}
+
+// newAuditLog opens the audit log of cfg, or returns nil if auditing is
+// not configured.
+func newAuditLog(cfg *Config, clientset kubernetes.Interface, nodeName string) (*auditLog, error) {
+	if cfg.AuditLog == "" && cfg.AuditNamespace == "" {
+		return nil, nil
+	}
+	a := &auditLog{node: nodeName, namespace: cfg.AuditNamespace}
+	if cfg.AuditLog != "" {
+		if err := os.MkdirAll(filepath.Dir(cfg.AuditLog), 0o700); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(cfg.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		a.f = f
+	}
+	if a.namespace != "" {
+		a.events = clientset.CoreV1().Events(a.namespace)
+		a.queue = make(chan auditEntry, auditQueue)
+		go a.run()
+	}
+	return a, nil
+}
+
+// record appends e to the audit log and queues its Event. The log is
+// synced before record returns, so an entry is on disk before what it
+// records is done with.
+func (a *auditLog) record(e auditEntry) {
+	if a == nil {
+		return
+	}
+	e.Time, e.Node = time.Now().UTC(), a.node
+	if a.f != nil {
+		line, err := json.Marshal(e)
+		if err == nil {
+			a.mu.Lock()
+			if _, err = a.f.Write(append(line, '\n')); err == nil {
+				err = a.f.Sync()
+			}
+			a.mu.Unlock()
+		}
+		if err != nil {
+			auditFailures.Inc()
+			slog.Error("Cannot write audit log", "action", e.Action, "err", err)
+		}
+	}
+	if a.queue == nil {
+		return
+	}
+	select {
+	case a.queue <- e:
+	default:
+		auditFailures.Inc()
+		slog.Warn("Audit Event queue full, dropping Event", "action", e.Action, "namespace", e.Namespace, "pod", e.Pod)
+	}
+}
+
+// run records the queued audit Events. They are created directly rather
+// than through the Event recorder, which would fold similar ones together.
+func (a *auditLog) run() {
+	ref := corev1.ObjectReference{Kind: "Namespace", APIVersion: "v1", Name: a.namespace, Namespace: a.namespace}
+	for e := range a.queue {
+		msg, err := json.Marshal(e)
+		if err != nil {
+			continue
+		}
+		t := metav1.NewTime(e.Time)
+		ev := &corev1.Event{
+			// Named like the recorder names Events, per node.
+			ObjectMeta:     metav1.ObjectMeta{Name: fmt.Sprintf("%s-audit.%x", a.node, e.Time.UnixNano()), Namespace: a.namespace},
+			InvolvedObject: ref,
+			Reason:         auditReasons[e.Action],
+			Message:        string(msg),
+			Type:           corev1.EventTypeNormal,
+			Source:         corev1.EventSource{Component: eventComponent, Host: a.node},
+			FirstTimestamp: t,
+			LastTimestamp:  t,
+			Count:          1,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), auditEventTimeout)
+		_, err = a.events.Create(ctx, ev, metav1.CreateOptions{})
+		cancel()
+		if err != nil {
+			auditFailures.Inc()
+			slog.Warn("Cannot record audit Event", "action", e.Action, "namespace", a.namespace, "err", err)
+		}
+	}
+}
+
+// auditCapture records the action on cap, with the files it has written
+// so far when it stopped.
+func (m *CaptureManager) auditCapture(cap *CaptureProcess, action, state, reason string) {
+	if m.audit == nil {
+		return
+	}
+	e := auditEntry{
+		Action:    action,
+		User:      cap.spec.Requester,
+		Namespace: cap.spec.Namespace,
+		Pod:       cap.spec.PodName,
+		Session:   cap.spec.Session,
+		SessionID: cap.sessionID,
+		Backend:   cap.backend.Name(),
+		Filter:    cap.spec.Filter,
+		State:     state,
+		Reason:    reason,
+	}
+	if action == auditStop {
+		var paths []string
+		for _, pattern := range cap.files {
+			matches, _ := filepath.Glob(pattern + "*")
+			for _, f := range matches {
+				if !strings.HasSuffix(f, manifestSuffix) && !strings.HasSuffix(f, ".tmp") {
+					paths = append(paths, f)
+				}
+			}
+		}
+		e.Files = auditFiles(paths)
+	}
+	m.audit.record(e)
+}
+
+// auditFiles records the action on the files at paths by user, from the
+// address remote for API requests.
+func (m *CaptureManager) auditFiles(action, user, remote, reason string, paths ...string) {
+	if m.audit == nil || len(paths) == 0 {
+		return
+	}
+	e := auditEntry{Action: action, User: user, Remote: remote, Reason: reason, Files: auditFiles(paths)}
+	if cf, ok := parseCaptureFile(filepath.Base(paths[0])); ok {
+		e.Namespace, e.Pod, e.SessionID = cf.Namespace, cf.Pod, cf.SessionID
+	}
+	m.audit.record(e)
+}
+
+// auditFiles describes the files at paths with their checksums, which are
+// taken from the manifest when it has the file as it is and computed
+// otherwise.
+func auditFiles(paths []string) []auditFile {
+	var files []auditFile
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+		f := auditFile{Name: filepath.Base(path), Size: info.Size(), SHA256: manifestSHA256(path, info.Size())}
+		if f.SHA256 == "" {
+			f.SHA256, _, err = fileSHA256(path)
+			if err != nil {
+				slog.Warn("Cannot checksum audited file", "file", path, "err", err)
+			}
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// manifestSHA256 returns the checksum a manifest next to path records for
+// the file, or "" if none records it at size. A ring file being rewritten
+// still has the entry of its previous contents.
+func manifestSHA256(path string, size int64) string {
+	manifests, _ := filepath.Glob(filepath.Join(filepath.Dir(path), "*"+manifestSuffix))
+	name := filepath.Base(path)
+	for _, mf := range manifests {
+		data, err := os.ReadFile(mf)
+		if err != nil {
+			continue
+		}
+		var sm sessionManifest
+		if json.Unmarshal(data, &sm) != nil {
+			continue
+		}
+		for _, e := range sm.Files {
+			if e.Name == name && e.Size == size {
+				return e.SHA256
+			}
+		}
+	}
+	return ""
+}
+
+// String describes the audit log for the startup log.
+func (a *auditLog) String() string {
+	var dest []string
+	if a.f != nil {
+		dest = append(dest, a.f.Name())
+	}
+	if a.namespace != "" {
+		dest = append(dest, fmt.Sprintf("Events in %s", a.namespace))
+	}
+	return strings.Join(dest, " and ")
+}
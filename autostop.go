@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ring buffer and autostop conditions, set next to tcpdump.antrea.io on the
+// Pod or its Namespace. They follow dumpcap's -b and -a options, which
+// tcpdump has no equivalent of: files rotate on whichever of their size and
+// age is reached first, and the capture ends on the first of its conditions.
+const (
+	ringBufferAnnotationKey = "ring-buffer." + annotationKey
+	autostopAnnotationKey   = "autostop." + annotationKey
+)
+
+// minRotateEvery keeps a duration condition from rotating the ring faster
+// than anyone could use its files.
+const minRotateEvery = time.Second
+
+// autostopCondition is a condition of autostopAnnotationKey a capture met.
+// It is errCaptureComplete, so it completes the capture like a packet count.
+type autostopCondition string
+
+func (c autostopCondition) Error() string { return string(c) }
+
+func (c autostopCondition) Is(target error) bool { return target == errCaptureComplete }
+
+const (
+	errFilesComplete    autostopCondition = "file count reached"
+	errDurationComplete autostopCondition = "duration reached"
+)
+
+// parseRingBuffer parses the ring buffer conditions, e.g.
+// "filesize=10,duration=5m", into the file size in MB and the file age; 0 if
+// not given.
+func parseRingBuffer(v string) (int, time.Duration, error) {
+	var mb int
+	var every time.Duration
+	for _, part := range strings.Split(v, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || val == "" {
+			return 0, 0, fmt.Errorf("expected key=value pairs, got %q", part)
+		}
+		switch key {
+		case "filesize":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return 0, 0, fmt.Errorf("filesize must be a positive size in MB, got %q", val)
+			}
+			mb = n
+		case "duration":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < minRotateEvery {
+				return 0, 0, fmt.Errorf("duration must be at least %s, got %q", minRotateEvery, val)
+			}
+			every = d
+		default:
+			return 0, 0, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return mb, every, nil
+}
+
+// parseAutostop parses the autostop conditions, e.g. "duration=1h,files=20",
+// into the session duration and the file count; 0 if not given.
+func parseAutostop(v string) (time.Duration, int, error) {
+	var after time.Duration
+	var files int
+	for _, part := range strings.Split(v, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || val == "" {
+			return 0, 0, fmt.Errorf("expected key=value pairs, got %q", part)
+		}
+		switch key {
+		case "duration":
+			d, err := time.ParseDuration(val)
+			if err != nil || d <= 0 {
+				return 0, 0, fmt.Errorf("duration must be a positive duration, got %q", val)
+			}
+			after = d
+		case "files":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return 0, 0, fmt.Errorf("files must be a positive file count, got %q", val)
+			}
+			files = n
+		default:
+			return 0, 0, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	return after, files, nil
+}
+
+// completion says what ended the capture of s, for the errCaptureComplete
+// err its Wait returned.
+func (s captureSpec) completion(err error) string {
+	switch {
+	case errors.Is(err, errFilesComplete):
+		return fmt.Sprintf("after %d files", s.StopFiles)
+	case errors.Is(err, errDurationComplete):
+		return fmt.Sprintf("after %s", s.StopAfter)
+	case errors.Is(err, errBudgetComplete):
+		return fmt.Sprintf("after its files reached %d MB", s.Budget.MB)
+	case errors.Is(err, errMatchComplete):
+		return s.StopOn.String()
+	case errors.Is(err, errAdminStop):
+		return "through the admin socket"
+	}
+	return fmt.Sprintf("after %d packets", s.PacketCount)
+}
+
+// autostop completes cap once its session has run for StopAfter, unless
+// the capture stops or completes before. The duration counts from the start
+// of the session, so restarts do not extend it.
+func (m *CaptureManager) autostop(ctx context.Context, key string, cap *CaptureProcess) {
+	timer := time.NewTimer(time.Until(cap.spec.Started.Add(cap.spec.StopAfter)))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	m.mu.Lock()
+	current := m.captures[key] == cap && !cap.completed.Load()
+	m.mu.Unlock()
+	if current {
+		m.completeCapture(key, cap, errDurationComplete)
+	}
+}
@@ -0,0 +1,536 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/netip"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+// Capture backends selectable with --backend, or per capture with the
+// backend annotation.
+const (
+	backendTcpdump = "exec-tcpdump"
+	backendNative  = "native"
+	backendEBPF    = "ebpf"
+	backendOVS     = "ovs-mirror"
+	backendDumpcap = "dumpcap"
+	backendPktmon  = "pktmon"
+)
+
+// defaultSnaplen matches the tcpdump default.
+const defaultSnaplen = 262144
+
+// backendAnnotationKey selects the backend for a single capture.
+const backendAnnotationKey = "backend." + annotationKey
+
+// tcpdumpStopTimeout is how long tcpdump gets to flush after SIGTERM before
+// it is killed.
+const tcpdumpStopTimeout = 5 * time.Second
+
+// filterCheckTimeout bounds compiling a filter expression.
+const filterCheckTimeout = 10 * time.Second
+
+// captureSpec describes a capture independently of the backend running it.
+type captureSpec struct {
+	// Path is the base file name; rotated files get a numeric suffix the
+	// same way tcpdump -W names them.
+	Path      string
+	Interface string
+	// Interfaces lists the interfaces of a capture of several; each runs
+	// as its own instance with one of them as Interface.
+	Interfaces []string
+	Filter     string
+	// Addresses are the IPs and CIDRs the capture is limited to; Node
+	// captures pick their interfaces by them.
+	Addresses []netip.Prefix
+	RotateMB  int
+	MaxFiles  int
+	// RotateEvery also moves on to the next file once the current one is
+	// that old, like dumpcap -b duration; 0 rotates by size only.
+	RotateEvery time.Duration
+	// StopAfter and StopFiles end the capture once its session has run
+	// that long or it has filled that many files, like dumpcap -a duration
+	// and -a files; 0 does not stop.
+	StopAfter time.Duration
+	StopFiles int
+	// Compress compresses each file once the ring moves past it.
+	Compress compression
+	// Decode decodes each file with tshark once the ring moves past it.
+	Decode *decoder
+	// Encrypt encrypts each file, and its decode, once the ring moves past
+	// it, if an encryption key is configured.
+	Encrypt *fileKey
+	// Bundle packs the files into one archive of this format when the
+	// session ends; empty leaves them loose.
+	Bundle string
+	// Storage is the storage target the files are written to; empty
+	// writes them to the capture directory.
+	Storage string
+	// Anonymize scrubs packets before they are written.
+	Anonymize anonymization
+	// Mode is the capture mode and Snaplen the bytes kept of each packet;
+	// 0 keeps the backend default.
+	Mode    string
+	Snaplen int
+	// Direction limits the capture to directionIngress or directionEgress
+	// traffic; empty captures both. PodPort is set for an instance
+	// capturing on the host side of the Pod's veth, which sees the Pod's
+	// ingress going out.
+	Direction string
+	PodPort   bool
+	// SampleRate keeps one in SampleRate packets; 0 or 1 keeps all.
+	SampleRate int
+	// Budget caps the bytes the files of the session hold together.
+	Budget *byteBudget
+	// StopOn ends the capture once it has seen the packets it waits for.
+	StopOn *stopCondition
+	// Drops is what the agent does once the kernel drops too many of the
+	// capture's packets: dropsAlert, the default, or dropsTighten.
+	Drops string
+	// PacketCount ends the capture after that many packets are written,
+	// like tcpdump -c; 0 captures until stopped.
+	PacketCount int
+	// Output selects files, the collector stream or both; Collector is
+	// set whenever the capture streams.
+	Output    string
+	Collector *collectorClient
+	// Flows exports flow records instead of packets for the ipfix
+	// output.
+	Flows *ipfixExporter
+	// Metadata exports the metadata of every packet or flow to
+	// MetadataSink, in addition to the output.
+	Metadata     string
+	MetadataSink *metadataExporter
+	// Mirror tunnels the packets to a remote analyzer for the mirror
+	// output.
+	Mirror *mirrorSpec
+	// Export receives every finished file, if exports are configured.
+	Export *fileExporter
+	// Trace records the steps of the capture, if tracing is configured.
+	Trace *captureTrace
+	// Live receives every written packet for live viewers.
+	Live *liveFeed
+	// Rotate asks the capture to start its next file.
+	Rotate *rotateRequest
+	// Guard notices files of the capture tampered with.
+	Guard *fileGuard
+	// WriteRateMB caps the MB per second written to the files, through
+	// WriteLimit; 0 is no limit.
+	WriteRateMB float64
+	WriteLimit  *writeLimiter
+	// Peer is the other Pod of a pair capture, as <namespace>/<pod>.
+	Peer string
+	// Service is the annotated Service a capture was requested through.
+	Service string
+	// Traceflow is the Antrea Traceflow a capture was started for.
+	Traceflow string
+	// PacketCapture is the Antrea PacketCapture a capture fulfills.
+	PacketCapture string
+	// Target is the CaptureTarget a capture was requested through, as
+	// <namespace>/<name>; the capture holds its finalizer.
+	Target string
+	// Ring is set for the always-on ring buffer of a Pod.
+	Ring bool
+	// Run is the window start of a scheduled capture.
+	Run time.Time
+	// Trigger describes what started a capture the agent started on its
+	// own.
+	Trigger string
+	// DryRun only checks the request; nothing is captured.
+	DryRun bool
+	// Requester is who requested the capture, see captureRequester.
+	Requester string
+	// Options holds the file count and per-capture options the capture
+	// was requested with, by annotation, to tell when the request changes.
+	Options map[string]string
+	// Priority is the priority class of the capture; empty is normal.
+	Priority string
+	// Container is the container whose ports the capture is narrowed to;
+	// PodLoopback captures on the loopback of the Pod's network namespace
+	// instead of a node interface.
+	Container   string
+	PodLoopback bool
+	// HostNetwork is set for Pods sharing the node's network namespace,
+	// whose captures are narrowed to the Pod's ports.
+	HostNetwork bool
+	// Tunnel is the overlay encapsulation whose inner packets are matched
+	// as well.
+	Tunnel string
+	// Session names a named session of the Pod; empty for its own
+	// capture.
+	Session string
+	// PodUID identifies the captured Pod for backends that attach to the
+	// Pod's own interface.
+	PodUID string
+
+	// Namespace, PodName, Node and SessionID are recorded in every file.
+	Namespace string
+	PodName   string
+	Node      string
+	SessionID string
+	// Started is when the session started; restarts within the session
+	// keep it, and with it the session's file names.
+	Started time.Time
+}
+
+// CaptureBackend runs packet captures on the node.
+type CaptureBackend interface {
+	Name() string
+	// Check reports whether the backend can capture on this node.
+	Check() error
+	// Start begins a capture that runs until ctx is cancelled or it fails.
+	Start(ctx context.Context, spec captureSpec) (runningCapture, error)
+}
+
+// filterChecker is implemented by backends that can tell whether they
+// accept a filter expression without starting a capture.
+type filterChecker interface {
+	// CheckFilter reports why the backend cannot apply the filter of
+	// spec on its interface.
+	CheckFilter(spec captureSpec) error
+}
+
+// checkFilter checks the filter of spec with the backend, so a filter the
+// capture program rejects fails the capture before it starts instead of
+// the program exiting right after and the capture crash looping. An
+// interface that cannot be resolved is left for the start to report.
+func checkFilter(backend CaptureBackend, spec captureSpec) error {
+	c, ok := backend.(filterChecker)
+	if !ok || spec.Filter == "" {
+		return nil
+	}
+	if len(spec.Interfaces) > 0 {
+		spec.Interface = spec.Interfaces[0]
+	}
+	ifName, err := resolveInterface(spec.Interface, spec)
+	if err != nil {
+		return nil
+	}
+	spec.Interface = ifName
+	if err := c.CheckFilter(spec); err != nil {
+		return fmt.Errorf("invalid filter %q: %w", spec.Filter, err)
+	}
+	return nil
+}
+
+// specChecks is what checkFilter and checkStopOn found for a spec. They
+// compile the expressions with the capture program, which can take up to
+// filterCheckTimeout each, so they run before m.mu is taken and the start
+// only uses their results for the spec they were run on.
+type specChecks struct {
+	backend    string
+	interfaces string
+	filter     string
+	match      string
+	filterErr  error
+	stopOnErr  error
+}
+
+// runSpecChecks checks the filter and stop-on match of spec with the
+// backend.
+func runSpecChecks(backend CaptureBackend, spec captureSpec) *specChecks {
+	return &specChecks{
+		backend:    backend.Name(),
+		interfaces: checkedInterfaces(spec),
+		filter:     spec.Filter,
+		match:      stopOnMatch(spec),
+		filterErr:  checkFilter(backend, spec),
+		stopOnErr:  checkStopOn(backend, spec),
+	}
+}
+
+// checked reports whether c holds the checks of spec with the backend. A
+// spec that changed since, e.g. with the settings, needs checking again.
+func (c *specChecks) checked(backend CaptureBackend, spec captureSpec) bool {
+	return c != nil && c.backend == backend.Name() && c.interfaces == checkedInterfaces(spec) &&
+		c.filter == spec.Filter && c.match == stopOnMatch(spec)
+}
+
+// checkedInterfaces names the interfaces the checks of spec compile for.
+func checkedInterfaces(spec captureSpec) string {
+	return spec.Interface + "," + strings.Join(spec.Interfaces, ",")
+}
+
+// stopOnMatch is the stop-on match of spec, or "" without a condition.
+func stopOnMatch(spec captureSpec) string {
+	if spec.StopOn == nil {
+		return ""
+	}
+	return spec.StopOn.Match
+}
+
+// compileFilter runs a capture program that only compiles a filter, such
+// as tcpdump -d, and returns the last line it printed as the error if it
+// rejects it, which is where tcpdump and dumpcap explain what is wrong. A
+// program that cannot run is left for the start to report.
+func compileFilter(path string, args ...string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), filterCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, args...).CombinedOutput()
+	var exit *exec.ExitError
+	if err == nil || ctx.Err() != nil || !errors.As(err, &exit) {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if msg := strings.TrimSpace(lines[len(lines)-1]); msg != "" {
+		return errors.New(msg)
+	}
+	return err
+}
+
+// errCaptureComplete is returned by Wait when a capture ended because it
+// met an autostop condition: it wrote its packet count, or met one of the
+// conditions of autostopAnnotationKey, whose errors are it as well.
+var errCaptureComplete = errors.New("packet count reached")
+
+// runningCapture is a capture started by a CaptureBackend.
+type runningCapture interface {
+	// PID is the capture process, or 0 for in-process captures.
+	PID() int
+	// Args are persisted so a leaked process can be recognized after a
+	// restart; nil for in-process captures.
+	Args() []string
+	// Wait blocks until the capture ends. It returns errCaptureComplete,
+	// or an error wrapping it, once an autostop condition is met.
+	Wait() error
+	// Stats returns the packet counters so far.
+	Stats() captureStats
+	// Cost returns the resources the capture used so far.
+	Cost() captureCost
+}
+
+// snaplen returns the bytes to keep of each packet.
+func (s captureSpec) snaplen() int {
+	if s.Snaplen > 0 {
+		return s.Snaplen
+	}
+	return defaultSnaplen
+}
+
+// addFilter narrows the filter expression to packets that also match expr.
+func (s *captureSpec) addFilter(expr string) {
+	switch {
+	case expr == "":
+	case s.Filter == "":
+		s.Filter = expr
+	default:
+		s.Filter = "(" + s.Filter + ") and " + expr
+	}
+}
+
+// podPortBackend reports whether a backend always captures the Pod's own
+// port, whatever the interface, so it cannot capture a node or several
+// interfaces.
+func podPortBackend(b CaptureBackend) bool {
+	return b.Name() == backendEBPF || b.Name() == backendOVS
+}
+
+// podBackend returns the backend requested by the backend annotation among
+// a capture's annotations, or the default one.
+func (m *CaptureManager) podBackend(annotations map[string]string) (CaptureBackend, error) {
+	name, ok := annotations[backendAnnotationKey]
+	if !ok {
+		return m.backends[m.cfg.Backend], nil
+	}
+	b, ok := m.backends[strings.TrimSpace(name)]
+	if !ok {
+		return nil, fmt.Errorf("unknown capture backend %q in %s annotation", name, backendAnnotationKey)
+	}
+	return b, nil
+}
+
+// tcpdumpBackend runs one tcpdump process per capture. tcpdump writes pcap
+// to a pipe and the agent rewrites it as rotated pcapng files, like the
+// in-process backends.
+type tcpdumpBackend struct {
+	path   string
+	limits *processLimits
+}
+
+func (b *tcpdumpBackend) Name() string { return backendTcpdump }
+
+func (b *tcpdumpBackend) Check() error {
+	_, err := exec.LookPath(b.path)
+	return err
+}
+
+// CheckFilter compiles the filter with tcpdump -d, which prints the BPF
+// program instead of capturing.
+func (b *tcpdumpBackend) CheckFilter(spec captureSpec) error {
+	return compileFilter(b.path, "-d", "-i", spec.Interface, spec.Filter)
+}
+
+func (b *tcpdumpBackend) Start(ctx context.Context, spec captureSpec) (runningCapture, error) {
+	// -U flushes every packet to the pipe instead of whole buffers.
+	args := []string{"-U", "-w", "-", "-i", spec.Interface}
+	if spec.Snaplen > 0 {
+		args = append(args, "-s", strconv.Itoa(spec.Snaplen))
+	}
+	if d := spec.interfaceDirection(spec.PodPort); d != "" {
+		args = append(args, "-Q", d)
+	}
+	if spec.Filter != "" {
+		args = append(args, spec.Filter)
+	}
+	p, err := startPipeCapture(ctx, b.path, args, spec, b.limits)
+	if err != nil {
+		return nil, err
+	}
+	go p.requestStats()
+	return p, nil
+}
+
+// startPipeCapture runs a capture program that writes pcap to its standard
+// output, such as tcpdump or dumpcap, and copies the packets into the
+// capture's ring, under limits.
+func startPipeCapture(ctx context.Context, path string, args []string, spec captureSpec, limits *processLimits) (*tcpdumpProcess, error) {
+	name := filepath.Base(path)
+	cmd := exec.CommandContext(ctx, path, args...)
+	// CommandContext would SIGKILL the program and lose the packets it
+	// still buffers. SIGTERM lets it flush them to the pipe first.
+	cmd.Cancel = func() error { return cmd.Process.Signal(syscall.SIGTERM) }
+	cmd.WaitDelay = tcpdumpStopTimeout
+	p := &tcpdumpProcess{cmd: cmd, done: make(chan struct{})}
+	cmd.Stderr = &tcpdumpStderr{
+		stats: &p.stats,
+		log:   slog.With("namespace", spec.Namespace, "pod", spec.PodName, "session", spec.SessionID),
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cgroup, release, err := limits.prepare(cmd, spec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create cgroup for %s: %w", name, err)
+	}
+	if spec.PodLoopback {
+		// The Pod's process is looked up on every start, so restarts
+		// follow a recreated Pod sandbox.
+		var pid int
+		if pid, err = podProcess(spec.PodUID); err == nil {
+			err = startInNetns(cmd, pid)
+		}
+	} else {
+		err = cmd.Start()
+	}
+	release()
+	if err != nil {
+		if cgroup != "" {
+			os.Remove(cgroup)
+		}
+		return nil, fmt.Errorf("failed to start %s: %w", name, err)
+	}
+	limits.started(cmd.Process.Pid, cgroup)
+	p.cgroup = cgroup
+	go func() {
+		defer close(p.done)
+		defer p.stats.meter.track()()
+		if p.err = copyToRing(out, spec, &p.stats); p.err != nil {
+			// Without a reader the program would block on the pipe.
+			cmd.Process.Kill()
+		}
+	}()
+	return p, nil
+}
+
+// copyToRing rewrites the pcap stream r into the capture's ring of pcapng
+// files until r ends or the packet count is reached. Written packets are
+// counted in stats.
+func copyToRing(r io.Reader, spec captureSpec, stats *packetStats) error {
+	pr, err := pcapgo.NewReader(r)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read tcpdump output: %w", err)
+	}
+	ring := newRingWriter(spec, spec.Interface, pr.LinkType(), int(pr.Snaplen()))
+	ring.stats = stats
+	defer ring.Close()
+	for n := 0; ; n++ {
+		data, ci, err := pr.ReadPacketData()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return ring.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("cannot read tcpdump output: %w", err)
+		}
+		// tcpdump cannot sample, so every n-th packet is kept here.
+		if spec.SampleRate > 1 && n%spec.SampleRate != 0 {
+			continue
+		}
+		err = ring.WritePacket(ci, data)
+		if errors.Is(err, errCaptureComplete) {
+			if cerr := ring.Close(); cerr != nil {
+				return cerr
+			}
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write packet: %w", err)
+		}
+	}
+}
+
+type tcpdumpProcess struct {
+	cmd   *exec.Cmd
+	done  chan struct{}
+	stats packetStats
+	// cgroup is the process's own cgroup, if it is limited by one.
+	cgroup string
+	// err is written before done is closed.
+	err error
+
+	// exited is set once the process exited, before it is reaped: from
+	// then on its PID may be reused, so its cost is no longer read from
+	// it.
+	mu     sync.Mutex
+	exited bool
+}
+
+func (p *tcpdumpProcess) PID() int            { return p.cmd.Process.Pid }
+func (p *tcpdumpProcess) Args() []string      { return p.cmd.Args }
+func (p *tcpdumpProcess) Stats() captureStats { return p.stats.snapshot() }
+
+// Cost reads the usage of the process while it runs, and returns the usage
+// it exited with afterwards.
+func (p *tcpdumpProcess) Cost() captureCost {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.exited {
+		return p.stats.cost(0)
+	}
+	return p.stats.cost(p.cmd.Process.Pid)
+}
+
+// Wait waits for the output to be copied before reaping tcpdump, as
+// StdoutPipe requires. tcpdump is killed once the packet count is reached,
+// so its exit status is ignored then.
+func (p *tcpdumpProcess) Wait() error {
+	<-p.done
+	waitExited(p.cmd.Process.Pid)
+	p.mu.Lock()
+	p.exited = true
+	p.mu.Unlock()
+	err := p.cmd.Wait()
+	if p.cmd.ProcessState != nil {
+		p.stats.meter.exited(p.cmd.ProcessState.UserTime() + p.cmd.ProcessState.SystemTime())
+	}
+	if err != nil && !errors.Is(p.err, errCaptureComplete) {
+		return err
+	}
+	return p.err
+}
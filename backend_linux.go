@@ -0,0 +1,45 @@
+package main
+
+import (
+	"syscall"
+	"time"
+)
+
+// defaultBackend is the backend of captures that do not pick one, unless
+// --backend says otherwise.
+const defaultBackend = backendTcpdump
+
+// supportedBackends lists the backends of this platform.
+var supportedBackends = []string{backendTcpdump, backendNative, backendEBPF, backendOVS, backendDumpcap}
+
+// newBackends returns every backend by name.
+func newBackends(cfg *Config, limits *processLimits) map[string]CaptureBackend {
+	return map[string]CaptureBackend{
+		backendTcpdump: &tcpdumpBackend{path: cfg.TcpdumpPath, limits: limits},
+		backendNative:  &nativeBackend{workers: cfg.CaptureWorkers, tcpdump: cfg.TcpdumpPath},
+		backendEBPF:    &ebpfBackend{workers: cfg.CaptureWorkers, tcpdump: cfg.TcpdumpPath},
+		backendOVS: &ovsBackend{
+			vsctl:   cfg.OVSVsctlPath,
+			db:      cfg.OVSDB,
+			bridge:  cfg.OVSBridge,
+			tcpdump: &tcpdumpBackend{path: cfg.TcpdumpPath, limits: limits},
+		},
+		backendDumpcap: &dumpcapBackend{path: cfg.DumpcapPath, limits: limits},
+	}
+}
+
+// requestStats makes tcpdump print its counters every statsInterval until
+// the capture ends. The first signal is only sent after tcpdump has had
+// time to install its handler, since SIGUSR1 would otherwise kill it.
+func (p *tcpdumpProcess) requestStats() {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.cmd.Process.Signal(syscall.SIGUSR1)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+// defaultBackend is the backend of captures that do not pick one, unless
+// --backend says otherwise. Windows ships pktmon, while tcpdump and the
+// Linux packet sockets the other backends need are missing.
+const defaultBackend = backendPktmon
+
+// supportedBackends lists the backends of this platform.
+var supportedBackends = []string{backendPktmon, backendDumpcap}
+
+// newBackends returns every backend by name.
+func newBackends(cfg *Config, limits *processLimits) map[string]CaptureBackend {
+	return map[string]CaptureBackend{
+		backendPktmon:  &pktmonBackend{path: cfg.PktmonPath},
+		backendDumpcap: &dumpcapBackend{path: cfg.DumpcapPath, limits: limits},
+	}
+}
+
+// requestStats does nothing on Windows, which has no signal to make a
+// capture program print its counters.
+func (p *tcpdumpProcess) requestStats() {}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// budgetAnnotationKey caps the bytes a session's files hold together,
+// across rotations and interfaces, e.g. "size=500,action=overwrite".
+const budgetAnnotationKey = "budget." + annotationKey
+
+// Budget actions: stop completes the capture once its files would exceed
+// the budget, overwrite drops its oldest files early to stay within it.
+const (
+	budgetStop      = "stop"
+	budgetOverwrite = "overwrite"
+)
+
+// errBudgetComplete completes a capture whose files reached the budget.
+const errBudgetComplete autostopCondition = "byte budget reached"
+
+// byteBudget is the byte budget of a session. The writers of all its
+// interfaces and runs share it, and the files count by name, so a file a
+// restart overwrites is not counted twice.
+type byteBudget struct {
+	// MB is the budget and Action what happens once it is reached.
+	MB     int
+	Action string
+
+	mu    sync.Mutex
+	files map[string]int64
+	total int64
+	// overwrites counts the files dropped early to stay within the
+	// budget; overwriting is closed on the first.
+	overwrites  int
+	overwriting chan struct{}
+}
+
+// budgetStatus is the byte budget in the status annotation.
+type budgetStatus struct {
+	MB     int    `json:"mb"`
+	Action string `json:"action"`
+	// Overwrites is the number of files overwritten before the ring
+	// reached them otherwise.
+	Overwrites int `json:"overwrites,omitempty"`
+}
+
+// parseBudget parses the byte budget, e.g. "size=500,action=overwrite".
+// The action defaults to stop.
+func parseBudget(v string) (*byteBudget, error) {
+	b := &byteBudget{Action: budgetStop, files: make(map[string]int64), overwriting: make(chan struct{})}
+	for _, part := range strings.Split(v, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("expected key=value pairs, got %q", part)
+		}
+		switch key {
+		case "size":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("size must be a positive size in MB, got %q", val)
+			}
+			b.MB = n
+		case "action":
+			if val != budgetStop && val != budgetOverwrite {
+				return nil, fmt.Errorf("unknown action %q, want %s or %s", val, budgetStop, budgetOverwrite)
+			}
+			b.Action = val
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if b.MB == 0 {
+		return nil, fmt.Errorf("no size given")
+	}
+	return b, nil
+}
+
+// exceeds reports whether the file name growing to size would take the
+// files past the budget.
+func (b *byteBudget) exceeds(name string, size int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.total-b.files[name]+size > int64(b.MB)*bytesPerMB
+}
+
+// set records that the file name holds size bytes.
+func (b *byteBudget) set(name string, size int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.total += size - b.files[name]
+	b.files[name] = size
+}
+
+// held returns the bytes the file name holds.
+func (b *byteBudget) held(name string) int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.files[name]
+}
+
+// overwrote counts a file dropped early.
+func (b *byteBudget) overwrote() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.overwrites++
+	if b.overwrites == 1 {
+		close(b.overwriting)
+	}
+}
+
+// status returns the budget for the status annotation, or nil without one.
+func (b *byteBudget) status() *budgetStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return &budgetStatus{MB: b.MB, Action: b.Action, Overwrites: b.overwrites}
+}
+
+// String describes the budget for the section comment.
+func (b *byteBudget) String() string {
+	return fmt.Sprintf("%d MB, then %s", b.MB, b.Action)
+}
+
+// makeRoom gets the files of r within the budget before a packet of n
+// bytes is written. With the overwrite action it removes the oldest files
+// of the ring, the ones it would overwrite next, until the packet fits. A
+// file that outgrows the budget on its own is rotated, and removed as well
+// once the new file needs its room. With stop it returns errBudgetComplete.
+func (r *ringWriter) makeRoom(n int) error {
+	b := r.spec.Budget
+	for b.exceeds(r.f.Name(), int64(r.written.n)+int64(n)) {
+		if b.Action != budgetOverwrite {
+			return errBudgetComplete
+		}
+		if oldest := r.oldestFile(); oldest != "" {
+			r.spec.Guard.release(oldest)
+			removeCompressed(oldest)
+			os.Remove(oldest)
+			b.set(oldest, 0)
+			b.overwrote()
+			continue
+		}
+		if r.written.n == 0 {
+			// The packet does not fit even into an empty file.
+			return nil
+		}
+		if r.spec.StopFiles > 0 && r.files >= r.spec.StopFiles {
+			return errFilesComplete
+		}
+		if err := r.rotate(); err != nil {
+			return err
+		}
+		if r.spec.MaxFiles <= 1 {
+			// A single file is truncated by the rotation.
+			b.overwrote()
+		}
+	}
+	return nil
+}
+
+// oldestFile returns the oldest file of the ring holding bytes other than
+// the current one, or "". The ring writes its files in order, so the oldest
+// is the first one holding bytes from the file it writes next.
+func (r *ringWriter) oldestFile() string {
+	for i := 0; i < r.spec.MaxFiles-1; i++ {
+		name := ringFileName(r.spec.Path, (r.next+i)%r.spec.MaxFiles, r.spec.MaxFiles)
+		if r.spec.Budget.held(name) > 0 {
+			return name
+		}
+	}
+	return ""
+}
+
+// watchBudget writes the status of cap once its files first exceed the
+// budget and it starts overwriting them, so the status shows it.
+func (m *CaptureManager) watchBudget(ctx context.Context, cap *CaptureProcess) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-cap.spec.Budget.overwriting:
+	}
+	cap.log.Info("Capture reached its byte budget, overwriting its oldest files", "budgetMB", cap.spec.Budget.MB)
+	m.patchStatus(cap.ref, m.status(cap))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// bundleAnnotationKey asks for the files of a session to be packed into one
+// archive when the session ends.
+const bundleAnnotationKey = "bundle." + annotationKey
+
+// Bundle archive formats, the values of the bundle annotation.
+const (
+	bundleTar = "tar"
+	bundleZip = "zip"
+)
+
+// parseBundle parses the bundle annotation value v.
+func parseBundle(v string) (string, error) {
+	switch format := strings.TrimSpace(v); format {
+	case bundleTar, bundleZip:
+		return format, nil
+	}
+	return "", fmt.Errorf("unknown bundle format %q, expected %s or %s", v, bundleTar, bundleZip)
+}
+
+// finishSession analyzes the files of cap, which ended in state, packs them
+// into a bundle if one was requested, and writes the result.
+func (m *CaptureManager) finishSession(key string, cap *CaptureProcess, st captureStatus, state string) {
+	if m.postProcessing() {
+		st = m.postProcess(key, cap, st)
+	}
+	if cap.spec.Bundle != "" {
+		m.bundleSession(key, cap, st)
+	}
+	m.patchResult(cap, state)
+	if cap.spec.PacketCapture != "" {
+		m.finishPacketCapture(cap, st, state)
+	}
+	if m.exporter != nil && cap.ref.Kind == "Pod" {
+		m.reportExported(cap)
+	}
+}
+
+// bundleSession packs every file of the ended capture cap, its manifest and
+// analysis report included, into a timestamped archive next to them and
+// deletes the loose files. The archive takes their place in the status.
+func (m *CaptureManager) bundleSession(key string, cap *CaptureProcess, st captureStatus) {
+	files, _ := captureFiles(cap)
+	var names []string
+	for _, f := range files {
+		// Files still being compressed are left out.
+		if !strings.HasSuffix(f.Name, compressSuffix) && !strings.HasSuffix(f.Name, ".tmp") {
+			names = append(names, f.Name)
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	dir := filepath.Dir(cap.files[0])
+	name := fmt.Sprintf("%s.%s.%s", strings.TrimSuffix(filepath.Base(cap.files[0]), "."), time.Now().UTC().Format(sessionStartLayout), cap.spec.Bundle)
+	path := filepath.Join(dir, name)
+	if err := writeBundle(path, cap.spec.Bundle, dir, names); err != nil {
+		cap.log.Error("Failed to bundle capture files", "bundle", name, "err", err)
+		m.recorder.Eventf(cap.ref, corev1.EventTypeWarning, reasonCaptureFailed, "Failed to bundle capture files: %v", err)
+		return
+	}
+	for _, n := range names {
+		os.Remove(filepath.Join(dir, n))
+	}
+	m.exporter.add(path)
+	cap.log.Info("Capture files bundled", "bundle", name, "files", len(names))
+	m.recorder.Event(cap.ref, corev1.EventTypeNormal, reasonCaptureBundled, sessionEvent(cap.spec, fmt.Sprintf("Bundled %d files into %s", len(names), name)))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.captures[key]; ok && c != cap {
+		return
+	}
+	bundled, total := captureFiles(cap)
+	st.Files, st.Bytes = nil, total
+	for _, f := range bundled {
+		st.Files = append(st.Files, f.Name)
+	}
+	m.patchStatus(cap.ref, st)
+}
+
+// writeBundle writes the files names in dir to the archive path in format,
+// through a temporary file so a partial archive is never left behind.
+func writeBundle(path, format, dir string, names []string) error {
+	tmp := path + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if format == bundleZip {
+		err = writeZip(out, dir, names)
+	} else {
+		err = writeTar(out, dir, names)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+func writeTar(out io.Writer, dir string, names []string) error {
+	tw := tar.NewWriter(out)
+	for _, n := range names {
+		f, err := os.Open(filepath.Join(dir, n))
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			var hdr *tar.Header
+			if hdr, err = tar.FileInfoHeader(info, ""); err == nil {
+				if err = tw.WriteHeader(hdr); err == nil {
+					_, err = io.Copy(tw, f)
+				}
+			}
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", n, err)
+		}
+	}
+	return tw.Close()
+}
+
+func writeZip(out io.Writer, dir string, names []string) error {
+	zw := zip.NewWriter(out)
+	for _, n := range names {
+		f, err := os.Open(filepath.Join(dir, n))
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			var hdr *zip.FileHeader
+			if hdr, err = zip.FileInfoHeader(info); err == nil {
+				hdr.Method = zip.Deflate
+				var w io.Writer
+				if w, err = zw.CreateHeader(hdr); err == nil {
+					_, err = io.Copy(w, f)
+				}
+			}
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", n, err)
+		}
+	}
+	return zw.Close()
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// capabilitiesAnnotationKey holds the nodeCapabilities the agent found on
+// its Node.
+const capabilitiesAnnotationKey = "capabilities." + annotationKey
+
+const (
+	// versionTimeout bounds asking a capture program for its version.
+	versionTimeout = 5 * time.Second
+	// capabilitiesProbeInterval is how often the capabilities are probed
+	// again, so a backend whose program or OVS bridge shows up after the
+	// agent started becomes available.
+	capabilitiesProbeInterval = time.Minute
+)
+
+// nodeCapabilities is what the agent can capture with on its node, probed
+// at startup and every capabilitiesProbeInterval. Captures needing something the node lacks fail right
+// away with the reason, rather than once the capture program runs into it.
+type nodeCapabilities struct {
+	// Tcpdump and Dumpcap are the first line of the programs' version
+	// output; empty if they do not run.
+	Tcpdump string `json:"tcpdump,omitempty"`
+	Dumpcap string `json:"dumpcap,omitempty"`
+	// OVS is set if the ovs-mirror backend reaches the bridge.
+	OVS bool `json:"ovs"`
+	// Privileges is what the agent process may do; nil where the platform
+	// has no such notion.
+	Privileges *privileges `json:"privileges,omitempty"`
+	// Backends are the backends that can capture, and Unavailable why the
+	// others cannot.
+	Backends    []string          `json:"backends"`
+	Unavailable map[string]string `json:"unavailable,omitempty"`
+	ProbedAt    time.Time         `json:"probedAt"`
+}
+
+// privileges are the capabilities and namespaces of the agent process that
+// captures depend on.
+type privileges struct {
+	// NetRaw opens packet sockets, NetAdmin sets up OVS ports and
+	// promiscuous mode, and SysAdmin enters the network namespaces of
+	// Pods.
+	NetRaw   bool `json:"netRaw"`
+	NetAdmin bool `json:"netAdmin"`
+	SysAdmin bool `json:"sysAdmin"`
+	// HostPID is set if the agent shares the host's PID namespace, which
+	// it finds Pod processes and their network namespaces through.
+	HostPID bool `json:"hostPID"`
+}
+
+// probeCapabilities checks every backend and the programs and privileges
+// they need.
+func probeCapabilities(cfg *Config, backends map[string]CaptureBackend) *nodeCapabilities {
+	c := &nodeCapabilities{
+		Tcpdump:     programVersion(cfg.TcpdumpPath, "--version"),
+		Dumpcap:     programVersion(cfg.DumpcapPath, "--version"),
+		Privileges:  probePrivileges(),
+		Unavailable: make(map[string]string),
+		ProbedAt:    time.Now().UTC(),
+	}
+	for name, b := range backends {
+		err := b.Check()
+		if err == nil {
+			err = c.Privileges.backendMissing(name)
+		}
+		if err != nil {
+			c.Unavailable[name] = err.Error()
+			continue
+		}
+		c.Backends = append(c.Backends, name)
+	}
+	slices.Sort(c.Backends)
+	_, unavailable := c.Unavailable[backendOVS]
+	c.OVS = backends[backendOVS] != nil && !unavailable
+	return c
+}
+
+// programVersion returns the first line path prints when run with args, or
+// "" if it does not run.
+func programVersion(path string, args ...string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, args...).CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := bytes.Cut(bytes.TrimSpace(out), []byte("\n"))
+	return strings.TrimSpace(string(line))
+}
+
+// unavailable returns why backend cannot capture on this node, or nil. A
+// nil c, before probing, allows every backend.
+func (c *nodeCapabilities) unavailable(name string) error {
+	if c == nil {
+		return nil
+	}
+	if reason, ok := c.Unavailable[name]; ok {
+		return fmt.Errorf("the %s backend is not available on this node: %s", name, reason)
+	}
+	return nil
+}
+
+// captureMissing returns what the node lacks for the capture of spec with
+// backend, or nil.
+func (c *nodeCapabilities) captureMissing(backend CaptureBackend, spec captureSpec) error {
+	if c == nil {
+		return nil
+	}
+	if err := c.unavailable(backend.Name()); err != nil {
+		return err
+	}
+	return c.Privileges.captureMissing(spec)
+}
+
+// LogValue logs the privileges as a group, or nothing where the platform
+// has none.
+func (p *privileges) LogValue() slog.Value {
+	if p == nil {
+		return slog.Value{}
+	}
+	return slog.GroupValue(slog.Bool("netRaw", p.NetRaw), slog.Bool("netAdmin", p.NetAdmin),
+		slog.Bool("sysAdmin", p.SysAdmin), slog.Bool("hostPID", p.HostPID))
+}
+
+// podNetnsMissing returns what the agent lacks to reach the network
+// namespace of a Pod, or nil.
+func (p *privileges) podNetnsMissing() error {
+	switch {
+	case p == nil:
+		return nil
+	case !p.HostPID:
+		return errors.New("the agent does not share the host's PID namespace (hostPID), which it finds Pods' network namespaces through")
+	case !p.SysAdmin:
+		return errors.New("the agent lacks CAP_SYS_ADMIN to enter Pods' network namespaces")
+	}
+	return nil
+}
+
+// backendMissing returns what the agent lacks to run backend, beyond what
+// the backend checks itself, or nil.
+func (p *privileges) backendMissing(backend string) error {
+	if p == nil {
+		return nil
+	}
+	switch backend {
+	case backendTcpdump, backendDumpcap, backendOVS:
+		// The capture programs inherit the agent's capabilities.
+		if !p.NetRaw {
+			return errors.New("the agent lacks CAP_NET_RAW to capture packets")
+		}
+	}
+	switch backend {
+	case backendEBPF, backendOVS:
+		// Both attach to the Pod's own veth.
+		return p.podNetnsMissing()
+	}
+	return nil
+}
+
+// captureMissing returns what the agent lacks for the interfaces of spec,
+// or nil.
+func (p *privileges) captureMissing(spec captureSpec) error {
+	if spec.PodLoopback || spec.Interface == podInterface || slices.Contains(spec.Interfaces, podInterface) {
+		return p.podNetnsMissing()
+	}
+	return nil
+}
+
+// watchCapabilities writes the capabilities to the agent's Node and probes
+// them again every capabilitiesProbeInterval, writing them again when they
+// change or the last write failed.
+func (m *CaptureManager) watchCapabilities(ctx context.Context) {
+	ref := &corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: m.nodeName}
+	ticker := time.NewTicker(capabilitiesProbeInterval)
+	defer ticker.Stop()
+	published := false
+	for {
+		if !published {
+			published = m.patchAnnotation(ref, capabilitiesAnnotationKey, m.capabilities.Load()) == nil
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		c := probeCapabilities(m.cfg, m.backends)
+		if prev := m.capabilities.Load(); prev != nil && prev.same(c) {
+			continue
+		}
+		c.log()
+		m.capabilities.Store(c)
+		published = false
+	}
+}
+
+// same reports whether c and o found the same, whenever they probed.
+func (c *nodeCapabilities) same(o *nodeCapabilities) bool {
+	a, b := *c, *o
+	a.ProbedAt, b.ProbedAt = time.Time{}, time.Time{}
+	return reflect.DeepEqual(a, b)
+}
+
+// log logs the capabilities and why each unavailable backend cannot
+// capture, and exports which backends can.
+func (c *nodeCapabilities) log() {
+	slog.Info("Probed node capabilities", "backends", c.Backends, "tcpdump", c.Tcpdump, "dumpcap", c.Dumpcap, "ovs", c.OVS, "privileges", c.Privileges)
+	for _, name := range c.Backends {
+		backendAvailable.WithLabelValues(name).Set(1)
+	}
+	for name, reason := range c.Unavailable {
+		backendAvailable.WithLabelValues(name).Set(0)
+		slog.Warn("Capture backend not available", "backend", name, "reason", reason)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Capability bits of the CapEff mask in /proc/self/status.
+const (
+	capNetAdmin = 12
+	capNetRaw   = 13
+	capSysAdmin = 21
+)
+
+// probePrivileges reads the effective capabilities of the agent process and
+// whether it shares the host's PID namespace. With hostPID, PID 1 is the
+// host's init, which runs in another mount namespace than the agent's
+// container.
+func probePrivileges() *privileges {
+	p := &privileges{}
+	if caps, ok := effectiveCaps(); ok {
+		p.NetRaw = caps&(1<<capNetRaw) != 0
+		p.NetAdmin = caps&(1<<capNetAdmin) != 0
+		p.SysAdmin = caps&(1<<capSysAdmin) != 0
+	}
+	self, err := os.Readlink("/proc/self/ns/mnt")
+	if err != nil {
+		return p
+	}
+	init, err := os.Readlink("/proc/1/ns/mnt")
+	p.HostPID = err == nil && init != self
+	return p
+}
+
+// effectiveCaps returns the effective capability mask of the agent.
+func effectiveCaps() (uint64, bool) {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			return caps, err == nil
+		}
+	}
+	return 0, false
+}
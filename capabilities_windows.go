@@ -0,0 +1,6 @@
+package main
+
+// probePrivileges returns nil: Windows has no capabilities or PID
+// namespaces, and the agent runs as a HostProcess container with the
+// privileges of the host.
+func probePrivileges() *privileges { return nil }
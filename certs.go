@@ -0,0 +1,132 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// certReloadInterval is how often serving certificates and client CAs are
+// checked for changes on disk.
+const certReloadInterval = 30 * time.Second
+
+// servingCerts serves the certificate at certFile and keyFile and verifies
+// client certificates against the CA bundle at caFile, if set. cert-manager
+// and the kubelet renew certificates by replacing the files of their
+// volumes, so they are reloaded whenever they change; a renewal that fails
+// to load keeps the previous certificate.
+type servingCerts struct {
+	endpoint                  string
+	certFile, keyFile, caFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  [3]time.Time
+}
+
+// newServingCerts loads the certificate of endpoint, "api" or "rpcap", and
+// keeps it up to date.
+func newServingCerts(endpoint, certFile, keyFile, caFile string) (*servingCerts, error) {
+	c := &servingCerts{endpoint: endpoint, certFile: certFile, keyFile: keyFile, caFile: caFile}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go c.watch()
+	return c, nil
+}
+
+// load reads the files if they changed since they were last read.
+func (c *servingCerts) load() error {
+	var modTimes [3]time.Time
+	for i, f := range []string{c.certFile, c.keyFile, c.caFile} {
+		if f == "" {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			return err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	c.mu.RLock()
+	unchanged := c.cert != nil && modTimes == c.modTimes
+	c.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load the %s certificate: %w", c.endpoint, err)
+	}
+	var pool *x509.CertPool
+	if c.caFile != "" {
+		pem, err := os.ReadFile(c.caFile)
+		if err != nil {
+			return fmt.Errorf("cannot read the %s client CA: %w", c.endpoint, err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in the %s client CA %s", c.endpoint, c.caFile)
+		}
+	}
+	c.mu.Lock()
+	c.cert, c.clientCAs, c.modTimes = &cert, pool, modTimes
+	c.mu.Unlock()
+	certExpiry.WithLabelValues(c.endpoint).Set(float64(cert.Leaf.NotAfter.Unix()))
+	slog.Info("Loaded serving certificate", "endpoint", c.endpoint, "subject", cert.Leaf.Subject.String(), "notAfter", cert.Leaf.NotAfter)
+	return nil
+}
+
+func (c *servingCerts) watch() {
+	for range time.Tick(certReloadInterval) {
+		if err := c.load(); err != nil {
+			slog.Warn("Cannot reload serving certificate, keeping the previous one", "endpoint", c.endpoint, "err", err)
+		}
+	}
+}
+
+// tlsConfig returns the server configuration of the endpoint. With a client
+// CA, clients may present a certificate signed by it; which requests need
+// one is up to the endpoint, so health probes work without.
+func (c *servingCerts) tlsConfig() *tls.Config {
+	cfg := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+			return c.cert, nil
+		},
+	}
+	if c.caFile == "" {
+		return cfg
+	}
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	cfg.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		conf := cfg.Clone()
+		conf.GetConfigForClient = nil
+		c.mu.RLock()
+		conf.ClientCAs = c.clientCAs
+		c.mu.RUnlock()
+		return conf, nil
+	}
+	return cfg
+}
+
+// errNoClientCert rejects requests without a verified client certificate.
+var errNoClientCert = errors.New("a client certificate is required")
+
+// verifiedClient returns the verified client certificate of state, or
+// errNoClientCert.
+func verifiedClient(state *tls.ConnectionState) (*x509.Certificate, error) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, errNoClientCert
+	}
+	return state.VerifiedChains[0][0], nil
+}
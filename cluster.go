@@ -0,0 +1,672 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/workqueue"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Roles of the binary, selected with --role.
+const (
+	// roleStandalone agents resolve every capture of their node on their
+	// own, watching Namespaces, workloads, Services, CaptureTargets and
+	// Traceflows cluster-wide.
+	roleStandalone = "standalone"
+	// roleController is the cluster controller of the two-tier
+	// deployment. It resolves what to capture for the whole cluster and
+	// assigns the captures to Pods, for their agents to run.
+	roleController = "controller"
+	// roleAgent agents only watch the Pods and the Node they run on and
+	// run the captures assigned to them.
+	roleAgent = "agent"
+)
+
+// assignmentAnnotationKey holds the capture the cluster controller assigned
+// to a Pod, as a captureAssignment. The controller is its only writer.
+const assignmentAnnotationKey = "assignment." + annotationKey
+
+// The controller replicas elect a leader through a Lease in the agent
+// namespace; only the leader assigns captures.
+const (
+	leaseName          = "packet-capture-controller"
+	leaseDuration      = 15 * time.Second
+	leaseRenewDeadline = 10 * time.Second
+	leaseRetryPeriod   = 2 * time.Second
+)
+
+// Indexes of the cluster controller's Pod informer: the Pods assigned a
+// capture, and the assigned Pods by the peer of their pair capture.
+const (
+	assignedPodsIndex = "assigned"
+	pairPeerIndex     = "peer"
+)
+
+// assignmentIndexers returns the indexers of assignedPodsIndex and pairPeerIndex.
+func assignmentIndexers() cache.Indexers {
+	return cache.Indexers{
+		assignedPodsIndex: func(obj interface{}) ([]string, error) {
+			if pod, ok := obj.(*corev1.Pod); ok && pod.Annotations[assignmentAnnotationKey] != "" {
+				return []string{"true"}, nil
+			}
+			return nil, nil
+		},
+		pairPeerIndex: func(obj interface{}) ([]string, error) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				return nil, nil
+			}
+			if a := podAssignment(pod); a != nil && a.PeerOf == "" && a.peer() != "" {
+				return []string{a.peer()}, nil
+			}
+			return nil, nil
+		},
+	}
+}
+
+// captureAssignment is a capture the cluster controller resolved for a Pod:
+// the capture and option annotations of the object it was requested
+// through, and what the agent could not work out from the Pod alone.
+type captureAssignment struct {
+	// ObjectMeta carries the requester annotations, so captureRequester
+	// and authorizeRequest read an assignment like any other source.
+	metav1.ObjectMeta `json:"-"`
+
+	// Source names the object the capture was requested through, e.g.
+	// CaptureTarget shop/payments.
+	Source      string            `json:"source"`
+	Annotations map[string]string `json:"annotations"`
+	Requester   string            `json:"requester,omitempty"`
+	// RequesterGroups are the groups of Requester as recorded by the
+	// webhook, a JSON list.
+	RequesterGroups string `json:"requesterGroups,omitempty"`
+	// Attributed is set when the capture was requested through an object
+	// the webhook attributes, so the captureGroups setting applies to it.
+	Attributed bool `json:"attributed,omitempty"`
+	// Service and Filter narrow a Service capture to the ports the Pod
+	// serves for it.
+	Service   string `json:"service,omitempty"`
+	Filter    string `json:"filter,omitempty"`
+	Traceflow string `json:"traceflow,omitempty"`
+	// PacketCapture is the Antrea PacketCapture the capture fulfills; the
+	// agent reads its filter from it.
+	PacketCapture string `json:"packetCapture,omitempty"`
+	// PeerOf is the Pod, as <namespace>/<pod>, whose pair capture this
+	// is the other end of.
+	PeerOf string `json:"peerOf,omitempty"`
+}
+
+// podAssignment returns the capture assigned to pod, or nil.
+func podAssignment(pod *corev1.Pod) *captureAssignment {
+	v, ok := pod.Annotations[assignmentAnnotationKey]
+	if !ok {
+		return nil
+	}
+	var a captureAssignment
+	if err := json.Unmarshal([]byte(v), &a); err != nil || a.Annotations[annotationKey] == "" {
+		slog.Warn("Ignoring invalid capture assignment", "namespace", pod.Namespace, "pod", pod.Name, "err", err)
+		return nil
+	}
+	a.ObjectMeta = metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name}
+	if a.Requester != "" {
+		a.ObjectMeta.Annotations = map[string]string{requesterAnnotationKey: a.Requester}
+		if a.RequesterGroups != "" {
+			a.ObjectMeta.Annotations[requesterGroupsAnnotationKey] = a.RequesterGroups
+		}
+	}
+	return &a
+}
+
+// peer returns the other Pod of a pair capture, or an empty string.
+func (a *captureAssignment) peer() string {
+	return strings.TrimSpace(a.Annotations[peerAnnotationKey])
+}
+
+// assignedSource is captureSource for agents of the two-tier deployment.
+// The cluster controller resolves Pod, CaptureTarget, Traceflow, Service,
+// workload and Namespace annotations into assignments; triggered captures
+// and ring buffers are the node's own business.
+func (m *CaptureManager) assignedSource(pod *corev1.Pod) (map[string]string, metav1.Object) {
+	if a := podAssignment(pod); a != nil {
+		return a.Annotations, a
+	}
+	if t := m.triggers.get(pod); t != nil {
+		return t.annotations(), t
+	}
+	if r := m.podRingBuffer(pod); r != nil {
+		return m.ringAnnotations(), r
+	}
+	return nil, pod
+}
+
+// clusterQueued reports whether the cluster controller, rather than the
+// agent, withdraws session of a Pod waiting for a slot: the Pod's own
+// capture waits for a cluster slot without an assignment.
+func (m *CaptureManager) clusterQueued(session string) bool {
+	return m.cfg.Role == roleAgent && session == ""
+}
+
+// runClusterController runs the cluster controller until it is stopped or
+// loses its leadership.
+func runClusterController(cfg *Config, clientset kubernetes.Interface, dynamicClient dynamic.Interface) {
+	id, err := os.Hostname()
+	if err != nil {
+		fatal("Failed to determine the controller identity", "err", err)
+	}
+	slog.SetDefault(slog.Default().With("controller", id))
+	slog.Info("Starting packet-capture cluster controller")
+
+	m := &CaptureManager{
+		cfg:       cfg,
+		clientset: clientset,
+		dynamic:   dynamicClient,
+		recorder:  newEventRecorder(clientset, id),
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		triggers:  newTriggerSet(),
+		captures:  make(map[string]*CaptureProcess),
+		pending:   make(map[string]pendingCapture),
+	}
+	m.statuses = newStatusWriter(m.writeStatus)
+
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
+	registerControllerMetrics()
+	go m.serveControllerHTTP(ctx, cfg.HTTPAddr)
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Namespace: cfg.Namespace, Name: leaseName},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: id},
+	}
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   leaseRenewDeadline,
+		RetryPeriod:     leaseRetryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: m.runAssigner,
+			OnStoppedLeading: func() {
+				if ctx.Err() == nil {
+					// Informers and the queue of a former leader are
+					// stale, so start over.
+					fatal("Lost leadership")
+				}
+				slog.Info("Shutting down")
+			},
+			OnNewLeader: func(leader string) {
+				if leader != id {
+					slog.Info("Following the cluster controller leader", "leader", leader)
+				}
+			},
+		},
+	})
+}
+
+// serveControllerHTTP serves the metrics and health probes of the cluster
+// controller.
+func (m *CaptureManager) serveControllerHTTP(ctx context.Context, addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(func() []healthCheck { return nil }))
+	mux.Handle("/readyz", healthHandler(func() []healthCheck {
+		return []healthCheck{{"apiserver", m.checkAPIServer}}
+	}))
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+	slog.Info("HTTP server listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", "err", err)
+	}
+}
+
+// runAssigner watches every Pod and every object captures can be requested
+// through, and keeps the assignments of the Pods up to date while the
+// controller leads.
+func (m *CaptureManager) runAssigner(ctx context.Context) {
+	slog.Info("Leading, assigning captures")
+	m.watchSettings(ctx)
+
+	factory := informers.NewSharedInformerFactory(m.clientset, m.cfg.ResyncInterval)
+	podInformer := factory.Core().V1().Pods()
+	m.podLister = podInformer.Lister()
+	if err := podInformer.Informer().AddIndexers(assignmentIndexers()); err != nil {
+		fatal("Failed to index pods", "err", err)
+	}
+	m.podIndexer = podInformer.Informer().GetIndexer()
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.enqueueAssigned,
+		UpdateFunc: func(old, obj interface{}) { m.enqueueAssigned(old); m.enqueueAssigned(obj) },
+		DeleteFunc: m.enqueueAssigned,
+	})
+	nsInformer := factory.Core().V1().Namespaces()
+	m.nsLister = nsInformer.Lister()
+	nsInformer.Informer().AddEventHandler(m.annotationHandler(metav1.Object.GetName))
+	// Nodes are watched for the node scope of captures.
+	nodeInformer := factory.Core().V1().Nodes()
+	m.nodeLister = nodeInformer.Lister()
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{UpdateFunc: m.enqueueNodePods})
+	synced := []cache.InformerSynced{podInformer.Informer().HasSynced, nsInformer.Informer().HasSynced, nodeInformer.Informer().HasSynced}
+	synced = append(synced, m.watchWorkloads(factory)...)
+	synced = append(synced, m.watchServices(factory)...)
+	factory.Start(ctx.Done())
+	synced = append(synced, m.watchCaptureTargets(ctx)...)
+	synced = append(synced, m.watchTraceflows(ctx)...)
+	synced = append(synced, m.watchPacketCaptures(ctx)...)
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		fatal("Failed to sync informer cache")
+	}
+	m.synced.Store(true)
+	slog.Info("Watching for capture requests")
+
+	defer m.queue.ShutDown()
+	go m.statuses.run(numWorkers, ctx.Done())
+	for i := 0; i < numWorkers; i++ {
+		go wait.UntilWithContext(ctx, m.runWorker, time.Second)
+	}
+	if m.targetLister != nil {
+		go m.runTargetReporter(ctx.Done())
+	}
+	<-ctx.Done()
+}
+
+// enqueueAssigned enqueues a Pod and the peer of its pair capture, which
+// follows it.
+func (m *CaptureManager) enqueueAssigned(obj interface{}) {
+	m.enqueuePod(obj)
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	if pod, ok := obj.(*corev1.Pod); ok {
+		if a := podAssignment(pod); a != nil && a.peer() != "" {
+			m.queue.Add(a.peer())
+		}
+	}
+}
+
+// syncAssignment assigns the capture requested for a Pod, or removes its
+// assignment once nothing requests one. Assignments wait for a slot while
+// the cluster runs maxClusterCaptures captures.
+func (m *CaptureManager) syncAssignment(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil || namespace == "" {
+		return nil
+	}
+	pod, err := m.podLister.Pods(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		m.mu.Lock()
+		m.leaveQueue(key)
+		m.mu.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	current := podAssignment(pod)
+	var want *captureAssignment
+	if pod.Spec.NodeName != "" && pod.Status.Phase == corev1.PodRunning {
+		if want = m.assignment(pod); want == nil {
+			want = m.peerAssignment(pod, current)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if want == nil {
+		m.leaveQueue(key)
+		if current == nil {
+			if statusState(pod, "") == statePending {
+				// The request was withdrawn while it waited.
+				m.patchStatus(podRef(pod), captureStatus{State: stateStopped, Node: pod.Spec.NodeName})
+				return nil
+			}
+			return nil
+		}
+	} else if current == nil {
+		if pos, wait := m.waitForClusterSlot(key, want); wait {
+			return m.reportClusterPending(pod, want, pos)
+		}
+	}
+	if sameAssignment(current, want) {
+		return nil
+	}
+
+	var val interface{}
+	if want != nil {
+		data, err := json.Marshal(want)
+		if err != nil {
+			return err
+		}
+		val = string(data)
+		slog.Info("Assigning capture", "namespace", pod.Namespace, "pod", pod.Name, "node", pod.Spec.NodeName, "source", want.Source)
+	} else {
+		slog.Info("Removing capture assignment", "namespace", pod.Namespace, "pod", pod.Name, "node", pod.Spec.NodeName)
+	}
+	if err := m.patchAnnotations(pod, map[string]interface{}{assignmentAnnotationKey: val}); err != nil {
+		return err
+	}
+	// The other end of a pair capture follows this one.
+	for _, a := range []*captureAssignment{current, want} {
+		if a != nil && a.peer() != "" {
+			m.queue.Add(a.peer())
+		}
+	}
+	if want == nil {
+		m.requeuePending()
+	}
+	m.updateAssignedCaptures()
+	return nil
+}
+
+// assignment resolves the capture requested for pod, or returns nil if
+// there is none.
+func (m *CaptureManager) assignment(pod *corev1.Pod) *captureAssignment {
+	annotations, source := m.captureSource(pod)
+	if _, ok := annotations[annotationKey]; !ok {
+		return nil
+	}
+	if in, err := m.inNodeScope(pod, annotations); err == nil && !in {
+		return nil
+	}
+	a := &captureAssignment{
+		Source:      sourceName(source),
+		Annotations: map[string]string{annotationKey: annotations[annotationKey]},
+		Requester:   captureRequester(source, ""),
+		Attributed:  attributedSource(source),
+	}
+	if r := requesterAnnotations(source, ""); r != nil {
+		a.RequesterGroups = r[requesterGroupsAnnotationKey]
+	}
+	for _, key := range podOptions {
+		if val, ok := annotations[key]; ok {
+			a.Annotations[key] = val
+		}
+	}
+	if _, ok := a.Annotations[traceparentAnnotationKey]; !ok {
+		if tp := sourceTraceparent(source); tp != "" {
+			// Every agent capturing a Pod of the source joins its trace.
+			a.Annotations[traceparentAnnotationKey] = tp
+		}
+	}
+	switch s := source.(type) {
+	case *corev1.Service:
+		if _, ports := m.podService(pod); len(ports) > 0 {
+			a.Service, a.Filter = s.Name, servicePortFilter(ports)
+		}
+	case *traceflow:
+		a.Traceflow = s.Name
+	case *packetCapture:
+		a.PacketCapture = s.Name
+	}
+	return a
+}
+
+// peerAssignment returns the other end of the pair capture pod was assigned
+// as a peer, as long as the capture of the Pod it pairs with still asks for
+// it. Peers with a capture of their own keep that one.
+func (m *CaptureManager) peerAssignment(pod *corev1.Pod, current *captureAssignment) *captureAssignment {
+	if current == nil || current.PeerOf == "" {
+		return m.peerRequest(pod)
+	}
+	ns, name, _ := strings.Cut(current.PeerOf, "/")
+	other, err := m.podLister.Pods(ns).Get(name)
+	if err != nil {
+		return nil
+	}
+	a := m.assignment(other)
+	if a == nil || a.peer() != pod.Namespace+"/"+pod.Name {
+		return nil
+	}
+	return mirrorAssignment(other, a)
+}
+
+// peerRequest returns the pair capture another Pod's assignment asks pod
+// to be the other end of, if any.
+func (m *CaptureManager) peerRequest(pod *corev1.Pod) *captureAssignment {
+	objs, err := m.podIndexer.ByIndex(pairPeerIndex, pod.Namespace+"/"+pod.Name)
+	if err != nil {
+		return nil
+	}
+	for _, obj := range objs {
+		other := obj.(*corev1.Pod)
+		if a := podAssignment(other); a != nil {
+			return mirrorAssignment(other, a)
+		}
+	}
+	return nil
+}
+
+// mirrorAssignment returns the assignment of the other end of the pair
+// capture a of pod, pointing back at pod. The container option names a
+// container of pod, so it is not passed on.
+func mirrorAssignment(pod *corev1.Pod, a *captureAssignment) *captureAssignment {
+	mirror := &captureAssignment{
+		Source:      a.Source,
+		Annotations: maps.Clone(a.Annotations),
+		Requester:   a.Requester,
+		PeerOf:      pod.Namespace + "/" + pod.Name,
+	}
+	mirror.RequesterGroups, mirror.Attributed = a.RequesterGroups, a.Attributed
+	mirror.Annotations[peerAnnotationKey] = mirror.PeerOf
+	delete(mirror.Annotations, containerAnnotationKey)
+	delete(mirror.Annotations, nodesAnnotationKey)
+	delete(mirror.Annotations, nodeSelectorAnnotationKey)
+	return mirror
+}
+
+// sameAssignment reports whether two assignments, either of them nil, are
+// the same.
+func sameAssignment(a, b *captureAssignment) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Source == b.Source && maps.Equal(a.Annotations, b.Annotations) && a.Requester == b.Requester &&
+		a.RequesterGroups == b.RequesterGroups && a.Attributed == b.Attributed &&
+		a.Service == b.Service && a.Filter == b.Filter && a.Traceflow == b.Traceflow && a.PacketCapture == b.PacketCapture &&
+		a.PeerOf == b.PeerOf
+}
+
+// sourceName names the object a capture was requested through.
+func sourceName(obj metav1.Object) string {
+	var kind string
+	switch obj.(type) {
+	case *corev1.Pod:
+		kind = "Pod"
+	case *corev1.Namespace:
+		return "Namespace " + obj.GetName()
+	case *corev1.Service:
+		kind = "Service"
+	case *captureTarget:
+		kind = "CaptureTarget"
+	case *traceflow:
+		return "Traceflow " + obj.GetName()
+	case *packetCapture:
+		return "PacketCapture " + obj.GetName()
+	case *appsv1.Deployment:
+		kind = "Deployment"
+	case *appsv1.StatefulSet:
+		kind = "StatefulSet"
+	case *appsv1.DaemonSet:
+		kind = "DaemonSet"
+	default:
+		kind = fmt.Sprintf("%T", obj)
+	}
+	return kind + " " + obj.GetNamespace() + "/" + obj.GetName()
+}
+
+// assignedCaptures counts the Pods holding a cluster slot: those with an
+// assignment whose capture has not completed. Callers must hold m.mu.
+func (m *CaptureManager) assignedCaptures() int {
+	objs, err := m.podIndexer.ByIndex(assignedPodsIndex, "true")
+	if err != nil {
+		return 0
+	}
+	n := 0
+	for _, obj := range objs {
+		if statusState(obj.(*corev1.Pod), "") != stateCompleted {
+			n++
+		}
+	}
+	return n
+}
+
+// updateAssignedCaptures refreshes the assigned captures gauge. Callers
+// must hold m.mu.
+func (m *CaptureManager) updateAssignedCaptures() {
+	assignedCaptures.Set(float64(m.assignedCaptures()))
+}
+
+// waitForClusterSlot reports whether the capture a of the Pod with key has
+// to wait for a cluster slot, and its position in the queue if so. Like
+// node slots, higher priority classes go first, then the oldest requests.
+// Callers must hold m.mu.
+func (m *CaptureManager) waitForClusterSlot(key string, a *captureAssignment) (int, bool) {
+	limit := m.settings().MaxClusterCaptures
+	if limit <= 0 {
+		m.leaveQueue(key)
+		return 0, false
+	}
+	priority, _ := parsePriority(a.Annotations[priorityAnnotationKey])
+	m.enterQueue(key, priority)
+	if pos := slices.Index(m.pendingQueue(), key); pos >= limit-m.assignedCaptures() {
+		return pos + 1, true
+	}
+	m.leaveQueue(key)
+	return 0, false
+}
+
+// reportClusterPending records that the capture a of pod waits for a
+// cluster slot, as reportPending does for node slots. Callers must hold
+// m.mu.
+func (m *CaptureManager) reportClusterPending(pod *corev1.Pod, a *captureAssignment, pos int) error {
+	limit := m.settings().MaxClusterCaptures
+	msg := fmt.Sprintf("waiting for a cluster capture slot, position %d in the queue; %d captures run in the cluster at a time", pos, limit)
+	current := annotatedStatus(pod, "")
+	if current.State == statePending && current.Message == msg {
+		return nil
+	}
+	if current.State != statePending {
+		slog.Info("Capture waiting for a cluster slot", "namespace", pod.Namespace, "pod", pod.Name, "position", pos)
+		m.recorder.Event(podRef(pod), corev1.EventTypeNormal, reasonCapturePending,
+			fmt.Sprintf("Waiting for one of the %d cluster capture slots", limit))
+	}
+	priority, _ := parsePriority(a.Annotations[priorityAnnotationKey])
+	m.patchStatus(podRef(pod), captureStatus{State: statePending, Node: pod.Spec.NodeName, Requester: a.Requester,
+		Priority: priority, Message: msg})
+	return nil
+}
+
+// captureTargetStatus sums up the captures of the Pods a CaptureTarget
+// selects, by the state in their status annotations.
+type captureTargetStatus struct {
+	Pods      int `json:"pods"`
+	Running   int `json:"running"`
+	Pending   int `json:"pending"`
+	Completed int `json:"completed"`
+	Failed    int `json:"failed"`
+	// Nodes has the progress of the captures on each node.
+	Nodes []targetNodeStatus `json:"nodes,omitempty"`
+}
+
+// runTargetReporter writes the status of every CaptureTarget every
+// statusReportInterval.
+func (m *CaptureManager) runTargetReporter(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(statusReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			objs, err := m.targetLister.List(labels.Everything())
+			if err != nil {
+				continue
+			}
+			for _, obj := range objs {
+				if err := m.reportTarget(obj); err != nil {
+					slog.Warn("Failed to update CaptureTarget status", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// reportTarget writes the status of the CaptureTarget obj if it changed.
+func (m *CaptureManager) reportTarget(obj runtime.Object) error {
+	t, err := toCaptureTarget(obj)
+	if err != nil {
+		return err
+	}
+	var st captureTargetStatus
+	pods, err := m.podLister.Pods(t.Namespace).List(labels.Everything())
+	if err != nil {
+		return err
+	}
+	// Pods stay in the status once the CaptureTarget expired, so it shows
+	// how their captures ended.
+	pods = slices.DeleteFunc(pods, func(pod *corev1.Pod) bool {
+		in, err := m.inNodeScope(pod, t.annotations())
+		return !t.selects(pod) || err == nil && !in
+	})
+	for _, pod := range pods {
+		st.Pods++
+		switch statusState(pod, "") {
+		case stateRunning:
+			st.Running++
+		case statePending:
+			st.Pending++
+		case stateCompleted:
+			st.Completed++
+		case stateFailed:
+			st.Failed++
+		}
+	}
+	st.Nodes = targetNodes(pods, t.Generation, t.Status.Nodes)
+	if equality.Semantic.DeepEqual(st, t.Status) {
+		return nil
+	}
+	u := obj.(*unstructured.Unstructured).DeepCopy()
+	status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&st)
+	if err != nil {
+		return err
+	}
+	u.Object["status"] = status
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = m.dynamic.Resource(captureTargetResource).Namespace(t.Namespace).UpdateStatus(ctx, u, metav1.UpdateOptions{})
+	return err
+}
@@ -0,0 +1,764 @@
+// Command capture-webhook is an optional admission webhook for packet
+// capture requests. It rejects capture annotations and CaptureTargets the
+// agents would refuse, such as bad file counts, unknown options or filter
+// presets, excessive durations and captures in namespaces the runtime
+// settings do not allow, when they are written rather than when an agent
+// tries to start the capture. It also records who requested each capture
+// and restricts which groups may capture in which namespaces.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	annotationKey          = "tcpdump.antrea.io"
+	scheduleAnnotationKey  = "schedule." + annotationKey
+	peerAnnotationKey      = "peer." + annotationKey
+	requesterAnnotationKey = "requester." + annotationKey
+	// requesterGroupsAnnotationKey holds the groups of the requester as a
+	// JSON list, for the agents to check the captureGroups setting.
+	requesterGroupsAnnotationKey = "requester-groups." + annotationKey
+
+	// ConfigMap keys of the agent settings the webhook enforces.
+	settingMaxFiles          = "maxFiles"
+	settingAllowedNamespaces = "allowedNamespaces"
+	settingDeniedNamespaces  = "deniedNamespaces"
+	settingCaptureGroups     = "captureGroups"
+)
+
+// sessionNamePattern matches the names of named sessions, as the agent does.
+var sessionNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,30}[a-z0-9])?$`)
+
+// traceparentPattern matches W3C traceparent values of version 00.
+var traceparentPattern = regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-[0-9a-f]{2}$`)
+
+// filterPresets are the names the filter option accepts.
+var filterPresets = []string{"bgp", "dns", "http", "icmp", "sctp", "tls-handshake"}
+
+// optionValues are the values of the options with a fixed set of them.
+// Options not listed here, or in validateOption, are left to the agent,
+// since checking them needs the Pod or the node.
+var optionValues = map[string][]string{
+	"backend":   {"exec-tcpdump", "native", "ebpf", "ovs-mirror", "dumpcap", "pktmon"},
+	"compress":  {"", "gzip", "zstd"},
+	"mode":      {"full", "headers"},
+	"output":    {"file", "stream", "both", "ipfix", "mirror"},
+	"tunnel":    {"geneve", "vxlan"},
+	"metadata":  {"packets", "flows"},
+	"priority":  {"low", "normal", "high"},
+	"bundle":    {"tar", "zip"},
+	"dry-run":   {"true", "false"},
+	"drops":     {"alert", "tighten"},
+	"direction": {"ingress", "egress", "both"},
+}
+
+type config struct {
+	listen      string
+	tlsCert     string
+	tlsKey      string
+	kubeconfig  string
+	namespace   string
+	configMap   string
+	maxDuration time.Duration
+	// controllerUser is the only user that may assign captures.
+	controllerUser string
+}
+
+func main() {
+	var cfg config
+	flag.StringVar(&cfg.listen, "listen", ":8443", "HTTPS listen address")
+	flag.StringVar(&cfg.tlsCert, "tls-cert", "/etc/webhook/tls/tls.crt", "serving certificate")
+	flag.StringVar(&cfg.tlsKey, "tls-key", "/etc/webhook/tls/tls.key", "serving certificate key")
+	flag.StringVar(&cfg.kubeconfig, "kubeconfig", "", "path to a kubeconfig file; in-cluster config if unset")
+	flag.StringVar(&cfg.namespace, "namespace", envOr("POD_NAMESPACE", "kube-system"), "namespace of the agent ConfigMap (env POD_NAMESPACE)")
+	flag.StringVar(&cfg.configMap, "configmap", "packet-capture-config", "agent ConfigMap holding the runtime settings; empty to enforce none")
+	flag.DurationVar(&cfg.maxDuration, "max-duration", 24*time.Hour, "longest CaptureTarget duration or schedule window; 0 for no limit")
+	flag.StringVar(&cfg.controllerUser, "controller-user", "system:serviceaccount:kube-system:packet-capture-cluster-controller", "user of the cluster controller, the only one that may set the assignment annotation")
+	flag.Parse()
+
+	v, err := newValidator(cfg)
+	if err != nil {
+		slog.Error("Failed to set up the webhook", "err", err)
+		os.Exit(1)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", v.handleReview)
+	mux.HandleFunc("/mutate", v.handleMutate)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusOK) })
+	slog.Info("Serving admission reviews", "listen", cfg.listen, "maxDuration", cfg.maxDuration)
+	srv := &http.Server{Addr: cfg.listen, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if err := srv.ListenAndServeTLS(cfg.tlsCert, cfg.tlsKey); err != nil {
+		slog.Error("Webhook server failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// validator checks admission requests against the agent settings.
+type validator struct {
+	cfg        config
+	configMaps corelisters.ConfigMapNamespaceLister
+}
+
+func newValidator(cfg config) (*validator, error) {
+	v := &validator{cfg: cfg}
+	if cfg.configMap == "" {
+		return v, nil
+	}
+	var restCfg *rest.Config
+	var err error
+	if cfg.kubeconfig != "" {
+		restCfg, err = clientcmd.BuildConfigFromFlags("", cfg.kubeconfig)
+	} else {
+		restCfg, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load Kubernetes client config: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, err
+	}
+	factory := informers.NewSharedInformerFactoryWithOptions(clientset, 0,
+		informers.WithNamespace(cfg.namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", cfg.configMap).String()
+		}),
+	)
+	inf := factory.Core().V1().ConfigMaps()
+	v.configMaps = inf.Lister().ConfigMaps(cfg.namespace)
+	stop := make(chan struct{})
+	factory.Start(stop)
+	if !cache.WaitForCacheSync(stop, inf.Informer().HasSynced) {
+		return nil, fmt.Errorf("failed to sync ConfigMap %s/%s", cfg.namespace, cfg.configMap)
+	}
+	return v, nil
+}
+
+// settings are the parts of the agent ConfigMap the webhook enforces.
+type settings struct {
+	maxFiles int
+	allowed  []string
+	denied   []string
+	// groups maps each group allowed to request captures to the
+	// namespace patterns it may capture in; empty lets everyone capture.
+	groups map[string][]string
+}
+
+// settings returns the settings currently in the agent ConfigMap. A missing
+// ConfigMap enforces none, like on the agents; failing to read it is an
+// error, so requests are not admitted unchecked.
+func (v *validator) settings() (settings, error) {
+	var s settings
+	if v.configMaps == nil {
+		return s, nil
+	}
+	cm, err := v.configMaps.Get(v.cfg.configMap)
+	if apierrors.IsNotFound(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, fmt.Errorf("cannot read the capture settings: %w", err)
+	}
+	s.maxFiles, _ = strconv.Atoi(strings.TrimSpace(cm.Data[settingMaxFiles]))
+	s.allowed = splitList(cm.Data[settingAllowedNamespaces])
+	s.denied = splitList(cm.Data[settingDeniedNamespaces])
+	s.groups = parseGroups(cm.Data[settingCaptureGroups])
+	return s, nil
+}
+
+// parseGroups parses the captureGroups setting, one group per line
+// followed by a colon and its namespace patterns:
+//
+//	sre: *
+//	team-a-oncall: team-a-*, shared
+//
+// Group names may contain colons themselves, namespaces cannot.
+func parseGroups(v string) map[string][]string {
+	groups := make(map[string][]string)
+	for _, line := range strings.Split(v, "\n") {
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			continue
+		}
+		if group := strings.TrimSpace(line[:i]); group != "" {
+			groups[group] = append(groups[group], splitList(line[i+1:])...)
+		}
+	}
+	return groups
+}
+
+// authorized checks that user is in a group allowed to capture in ns. Node
+// captures, with an empty ns, need a group allowed every namespace.
+func (s settings) authorized(user authenticationv1.UserInfo, ns string) error {
+	if len(s.groups) == 0 {
+		return nil
+	}
+	for _, g := range user.Groups {
+		if matchNamespace(s.groups[g], ns) {
+			return nil
+		}
+	}
+	if ns == "" {
+		return fmt.Errorf("user %s is not in a group allowed to capture nodes", user.Username)
+	}
+	return fmt.Errorf("user %s is not in a group allowed to capture in namespace %s", user.Username, ns)
+}
+
+// namespaceAllowed reports whether captures may run in ns.
+func (s settings) namespaceAllowed(ns string) bool {
+	if matchNamespace(s.denied, ns) {
+		return false
+	}
+	return len(s.allowed) == 0 || matchNamespace(s.allowed, ns)
+}
+
+func matchNamespace(patterns []string, ns string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, ns); ok || p == ns {
+			return true
+		}
+	}
+	return false
+}
+
+func splitList(v string) []string {
+	var out []string
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// handleReview answers an AdmissionReview. Requests that cannot be decoded
+// are answered with an error, which the API server treats according to
+// the webhook's failure policy.
+func (v *validator) handleReview(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+	req := review.Request
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if errs := v.review(req); len(errs) > 0 {
+		resp.Allowed = false
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+			Message: "invalid packet capture request: " + strings.Join(errs, "; "),
+		}
+		slog.Info("Rejected capture request", "kind", req.Kind.Kind, "namespace", req.Namespace, "name", req.Name,
+			"user", req.UserInfo.Username, "reason", resp.Result.Message)
+	}
+	review.Response = resp
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// review returns what is wrong with the capture request in req, if
+// anything.
+func (v *validator) review(req *admissionv1.AdmissionRequest) []string {
+	if req.Operation != admissionv1.Create && req.Operation != admissionv1.Update {
+		return nil
+	}
+	s, err := v.settings()
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if req.Kind.Kind == "CaptureTarget" {
+		return v.reviewTarget(req, s)
+	}
+
+	var obj, old metav1.PartialObjectMetadata
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		return []string{fmt.Sprintf("cannot decode object: %v", err)}
+	}
+	if len(req.OldObject.Raw) > 0 {
+		json.Unmarshal(req.OldObject.Raw, &old)
+	}
+	ns := captureNamespace(req, obj.Name)
+
+	// Only annotations being set or changed are checked, so objects with
+	// annotations written before the webhook can still be updated.
+	var errs []string
+	for key, val := range obj.Annotations {
+		if prev, ok := old.Annotations[key]; ok && prev == val {
+			continue
+		}
+		opt, session, ok := parseAnnotationKey(key)
+		if !ok {
+			continue
+		}
+		if session != "" && !sessionNamePattern.MatchString(session) {
+			errs = append(errs, fmt.Sprintf("%s: invalid session name %q", key, session))
+			continue
+		}
+		var err error
+		if opt == "assignment" {
+			if req.UserInfo.Username != v.cfg.controllerUser {
+				errs = append(errs, fmt.Sprintf("%s: only the cluster controller may assign captures", key))
+			}
+			continue
+		}
+		if opt == "" {
+			err = v.validateCount(val, s)
+			if err == nil && req.Kind.Kind != "Node" && !s.namespaceAllowed(ns) {
+				err = fmt.Errorf("captures are not allowed in namespace %s", ns)
+			}
+			if err == nil {
+				err = s.authorized(req.UserInfo, ns)
+			}
+		} else {
+			err = v.validateOption(opt, val, s, req.UserInfo)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	slices.Sort(errs)
+	return errs
+}
+
+// captureNamespace returns the namespace captures requested through the
+// object of req run in, empty for Nodes.
+func captureNamespace(req *admissionv1.AdmissionRequest, name string) string {
+	if req.Kind.Kind == "Namespace" {
+		return name
+	}
+	return req.Namespace
+}
+
+// parseAnnotationKey returns the option an annotation key sets, empty for
+// the capture annotation itself, and the session it names, if any. It
+// returns false for keys that are not capture requests, such as the status
+// written by the agents.
+func parseAnnotationKey(key string) (opt, session string, ok bool) {
+	base, session, _ := strings.Cut(key, "/")
+	if base == annotationKey {
+		return "", session, true
+	}
+	opt, ok = strings.CutSuffix(base, "."+annotationKey)
+	if !ok || strings.Contains(opt, ".") {
+		return "", "", false
+	}
+	return opt, session, true
+}
+
+// validateCount checks the file count of a capture annotation.
+func (v *validator) validateCount(val string, s settings) error {
+	n, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || n <= 0 {
+		return fmt.Errorf("value %q must be a positive file count", val)
+	}
+	if s.maxFiles > 0 && n > s.maxFiles {
+		return fmt.Errorf("requested %d files exceeds the maximum of %d", n, s.maxFiles)
+	}
+	return nil
+}
+
+// validateOption checks the value of the option named opt, set by user.
+func (v *validator) validateOption(opt, val string, s settings, user authenticationv1.UserInfo) error {
+	val = strings.TrimSpace(val)
+	if values, ok := optionValues[opt]; ok {
+		if !slices.Contains(values, val) {
+			return fmt.Errorf("unknown %s %q", opt, val)
+		}
+		return nil
+	}
+	switch opt {
+	case "sample", "count":
+		if n, err := strconv.Atoi(val); err != nil || n <= 0 {
+			return fmt.Errorf("value %q must be a positive integer", val)
+		}
+	case "write-rate":
+		if mb, err := strconv.ParseFloat(val, 64); err != nil || mb <= 0 {
+			return fmt.Errorf("value %q must be a positive number of MB per second", val)
+		}
+	case "mirror":
+		var destination bool
+		for _, part := range strings.Split(val, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok || value == "" {
+				return fmt.Errorf("value %q must be key=value pairs", val)
+			}
+			switch key {
+			case "destination":
+				if net.ParseIP(value) == nil {
+					return fmt.Errorf("destination must be an IP address, got %q", value)
+				}
+				destination = true
+			case "protocol":
+				if value != "erspan" && value != "gre" {
+					return fmt.Errorf("protocol must be erspan or gre, got %q", value)
+				}
+			case "session", "key":
+				if _, err := strconv.ParseUint(value, 10, 32); err != nil {
+					return fmt.Errorf("%s must be a number, got %q", key, value)
+				}
+			default:
+				return fmt.Errorf("unknown mirror key %q", key)
+			}
+		}
+		if !destination {
+			return fmt.Errorf("value %q names no destination", val)
+		}
+	case "ring-buffer", "autostop":
+		for _, part := range strings.Split(val, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok || value == "" {
+				return fmt.Errorf("value %q must be key=value pairs", val)
+			}
+			switch {
+			case key == "duration":
+				d, err := time.ParseDuration(value)
+				switch {
+				case err != nil || d <= 0:
+					return fmt.Errorf("duration must be a positive duration, got %q", value)
+				case opt == "ring-buffer" && d < time.Second:
+					return fmt.Errorf("duration must be at least 1s, got %q", value)
+				}
+			case key == "filesize" && opt == "ring-buffer", key == "files" && opt == "autostop":
+				if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+					return fmt.Errorf("%s must be a positive integer, got %q", key, value)
+				}
+			default:
+				return fmt.Errorf("unknown %s key %q", opt, key)
+			}
+		}
+	case "budget":
+		var size bool
+		for _, part := range strings.Split(val, ",") {
+			key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok || value == "" {
+				return fmt.Errorf("value %q must be key=value pairs", val)
+			}
+			switch key {
+			case "size":
+				if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+					return fmt.Errorf("size must be a positive integer, got %q", value)
+				}
+				size = true
+			case "action":
+				if value != "stop" && value != "overwrite" {
+					return fmt.Errorf("action must be stop or overwrite, got %q", value)
+				}
+			default:
+				return fmt.Errorf("unknown budget key %q", key)
+			}
+		}
+		if !size {
+			return fmt.Errorf("value %q must give a size", val)
+		}
+	case "stop-on":
+		// match takes the rest of the value, so it comes last.
+		rest := strings.TrimSpace(val)
+		var match bool
+		for rest != "" && !match {
+			if expr, ok := strings.CutPrefix(rest, "match="); ok {
+				match = strings.TrimSpace(expr) != ""
+				break
+			}
+			var part string
+			part, rest, _ = strings.Cut(rest, ",")
+			rest = strings.TrimSpace(rest)
+			key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok || value == "" {
+				return fmt.Errorf("value %q must be key=value pairs", val)
+			}
+			switch key {
+			case "packets":
+				if n, err := strconv.Atoi(value); err != nil || n <= 0 {
+					return fmt.Errorf("packets must be a positive integer, got %q", value)
+				}
+			case "after":
+				if d, err := time.ParseDuration(value); err != nil || d < 0 {
+					return fmt.Errorf("after must be a duration, got %q", value)
+				}
+			default:
+				return fmt.Errorf("unknown stop-on key %q", key)
+			}
+		}
+		if !match {
+			return fmt.Errorf("value %q must end with match=<expression>", val)
+		}
+	case "filter":
+		var named bool
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if !slices.Contains(filterPresets, name) {
+				return fmt.Errorf("unknown filter preset %q, want one of %s", name, strings.Join(filterPresets, ", "))
+			}
+			named = true
+		}
+		if !named {
+			return fmt.Errorf("no filter preset given")
+		}
+	case "schedule":
+		fields := strings.Fields(val)
+		if len(fields) != 6 {
+			return fmt.Errorf("value %q must be a cron expression and a duration", val)
+		}
+		d, err := time.ParseDuration(fields[5])
+		if err != nil || d < time.Minute {
+			return fmt.Errorf("value must end with a duration of at least 1m, got %q", fields[5])
+		}
+		return v.validateDuration(d)
+	case "nodes":
+		var named bool
+		for _, name := range strings.Split(val, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if _, err := path.Match(name, ""); err != nil {
+				return fmt.Errorf("invalid node pattern %q", name)
+			}
+			named = true
+		}
+		if !named {
+			return fmt.Errorf("no node given")
+		}
+	case "addresses":
+		var given bool
+		for _, addr := range strings.Split(val, ",") {
+			if addr = strings.TrimSpace(addr); addr == "" {
+				continue
+			}
+			if _, err := netip.ParsePrefix(addr); err != nil {
+				if _, err := netip.ParseAddr(addr); err != nil {
+					return fmt.Errorf("invalid IP or CIDR %q", addr)
+				}
+			}
+			given = true
+		}
+		if !given {
+			return fmt.Errorf("no address given")
+		}
+	case "node-selector":
+		if _, err := labels.Parse(val); err != nil {
+			return fmt.Errorf("value %q must be a label selector: %v", val, err)
+		}
+	case "traceparent":
+		if !traceparentPattern.MatchString(val) {
+			return fmt.Errorf("value %q must be a W3C traceparent", val)
+		}
+	case "peer":
+		ns, pod, ok := strings.Cut(val, "/")
+		if !ok || ns == "" || pod == "" {
+			return fmt.Errorf("value %q must be <namespace>/<pod>", val)
+		}
+		if !s.namespaceAllowed(ns) {
+			return fmt.Errorf("captures are not allowed in namespace %s", ns)
+		}
+		return s.authorized(user, ns)
+	}
+	return nil
+}
+
+// validateDuration checks a capture duration against --max-duration.
+func (v *validator) validateDuration(d time.Duration) error {
+	if v.cfg.maxDuration > 0 && d > v.cfg.maxDuration {
+		return fmt.Errorf("duration %s exceeds the maximum of %s", d, v.cfg.maxDuration)
+	}
+	return nil
+}
+
+// targetSpec is the part of a CaptureTarget the webhook checks.
+type targetSpec struct {
+	MaxFiles int               `json:"maxFiles"`
+	Duration string            `json:"duration,omitempty"`
+	Options  map[string]string `json:"options,omitempty"`
+}
+
+type target struct {
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              targetSpec `json:"spec"`
+}
+
+// reviewTarget checks a CaptureTarget when its spec is created or changed.
+func (v *validator) reviewTarget(req *admissionv1.AdmissionRequest, s settings) []string {
+	var obj, old target
+	if err := json.Unmarshal(req.Object.Raw, &obj); err != nil {
+		return []string{fmt.Sprintf("cannot decode CaptureTarget: %v", err)}
+	}
+	if len(req.OldObject.Raw) > 0 && json.Unmarshal(req.OldObject.Raw, &old) == nil && reflect.DeepEqual(obj.Spec, old.Spec) {
+		return nil
+	}
+
+	var errs []string
+	if !s.namespaceAllowed(req.Namespace) {
+		errs = append(errs, fmt.Sprintf("captures are not allowed in namespace %s", req.Namespace))
+	} else if err := s.authorized(req.UserInfo, req.Namespace); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := v.validateCount(strconv.Itoa(obj.Spec.MaxFiles), s); err != nil {
+		errs = append(errs, fmt.Sprintf("spec.maxFiles: %v", err))
+	}
+	if obj.Spec.Duration != "" {
+		d, err := time.ParseDuration(obj.Spec.Duration)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		if err == nil {
+			err = v.validateDuration(d)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("spec.duration: %v", err))
+		}
+	}
+	for opt, val := range obj.Spec.Options {
+		if err := v.validateOption(opt, val, s, req.UserInfo); err != nil {
+			errs = append(errs, fmt.Sprintf("spec.options.%s: %v", opt, err))
+		}
+	}
+	slices.Sort(errs)
+	return errs
+}
+
+// jsonPatchOp is an operation of the JSON patch a mutating webhook returns.
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value any    `json:"value,omitempty"`
+}
+
+// handleMutate answers an AdmissionReview with a patch recording the
+// requesting user and its groups in the requester annotations of every
+// capture the request creates or changes. Requester annotations of captures
+// the request leaves alone are restored, so nobody can claim another
+// user's capture or groups.
+func (v *validator) handleMutate(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 4<<20))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+	req := review.Request
+	resp := &admissionv1.AdmissionResponse{UID: req.UID, Allowed: true}
+	if req.Operation == admissionv1.Create || req.Operation == admissionv1.Update {
+		if ops := requesterPatch(req); len(ops) > 0 {
+			patch, _ := json.Marshal(ops)
+			pt := admissionv1.PatchTypeJSONPatch
+			resp.Patch, resp.PatchType = patch, &pt
+		}
+	}
+	review.Response = resp
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(review)
+}
+
+// requesterPatch returns the patch setting the requester annotations of
+// the object in req.
+func requesterPatch(req *admissionv1.AdmissionRequest) []jsonPatchOp {
+	var obj, old target
+	if json.Unmarshal(req.Object.Raw, &obj) != nil {
+		return nil
+	}
+	if len(req.OldObject.Raw) > 0 {
+		json.Unmarshal(req.OldObject.Raw, &old)
+	}
+
+	// changed holds the sessions the request creates or changes; a
+	// CaptureTarget has a single one, its spec.
+	changed := make(map[string]bool)
+	if req.Kind.Kind == "CaptureTarget" {
+		if len(req.OldObject.Raw) == 0 || !reflect.DeepEqual(obj.Spec, old.Spec) {
+			changed[""] = true
+		}
+	} else {
+		for key, val := range obj.Annotations {
+			opt, session, ok := parseAnnotationKey(key)
+			if prev, found := old.Annotations[key]; ok && opt == "" && (!found || prev != val) {
+				changed[session] = true
+			}
+		}
+	}
+
+	var ops []jsonPatchOp
+	if obj.Annotations == nil && len(changed) > 0 {
+		ops = append(ops, jsonPatchOp{Op: "add", Path: "/metadata/annotations", Value: map[string]string{}})
+	}
+	groups, _ := json.Marshal(append([]string{}, req.UserInfo.Groups...))
+	for session := range changed {
+		ops = append(ops,
+			jsonPatchOp{Op: "add", Path: annotationPath(sessionKey(requesterAnnotationKey, session)), Value: req.UserInfo.Username},
+			jsonPatchOp{Op: "add", Path: annotationPath(sessionKey(requesterGroupsAnnotationKey, session)), Value: string(groups)})
+	}
+	for key, val := range obj.Annotations {
+		opt, session, ok := parseAnnotationKey(key)
+		if !ok || (opt != "requester" && opt != "requester-groups") || changed[session] {
+			continue
+		}
+		if prev, found := old.Annotations[key]; !found {
+			ops = append(ops, jsonPatchOp{Op: "remove", Path: annotationPath(key)})
+		} else if prev != val {
+			ops = append(ops, jsonPatchOp{Op: "add", Path: annotationPath(key), Value: prev})
+		}
+	}
+	return ops
+}
+
+// sessionKey returns the annotation key of session for key.
+func sessionKey(key, session string) string {
+	if session == "" {
+		return key
+	}
+	return key + "/" + session
+}
+
+// annotationPath returns the JSON pointer to the annotation key.
+func annotationPath(key string) string {
+	return "/metadata/annotations/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestParseGroups(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want map[string][]string
+	}{
+		{"empty", "", map[string][]string{}},
+		{"one group", "sre: *", map[string][]string{"sre": {"*"}}},
+		{
+			"several groups and patterns",
+			"sre: *\nteam-a-oncall: team-a-*, shared\n",
+			map[string][]string{"sre": {"*"}, "team-a-oncall": {"team-a-*", "shared"}},
+		},
+		{"repeated group", "sre: a\nsre: b", map[string][]string{"sre": {"a", "b"}}},
+		{
+			"colons in group names",
+			"system:serviceaccounts:kube-system: *",
+			map[string][]string{"system:serviceaccounts:kube-system": {"*"}},
+		},
+		{"lines without a colon are skipped", "sre\nops: x", map[string][]string{"ops": {"x"}}},
+		{"lines without a group are skipped", ": x", map[string][]string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseGroups(tt.in); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseGroups(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	s := settings{groups: parseGroups("sre: *\nteam-a: team-a-*, shared")}
+	tests := []struct {
+		name   string
+		s      settings
+		groups []string
+		ns     string
+		want   string
+	}{
+		{"no policy", settings{}, nil, "default", ""},
+		{"wildcard group", s, []string{"sre"}, "default", ""},
+		{"pattern", s, []string{"team-a"}, "team-a-web", ""},
+		{"name", s, []string{"system:authenticated", "team-a"}, "shared", ""},
+		{"other namespace", s, []string{"team-a"}, "team-b", "not in a group allowed to capture in namespace team-b"},
+		{"no group", s, nil, "default", "not in a group allowed to capture in namespace default"},
+		{"node by wildcard group", s, []string{"sre"}, "", ""},
+		{"node by namespaced group", s, []string{"team-a"}, "", "not in a group allowed to capture nodes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.s.authorized(authenticationv1.UserInfo{Username: "alice", Groups: tt.groups}, tt.ns)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("authorized: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("authorized: %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequesterPatchRecordsUserAndGroups(t *testing.T) {
+	pod := func(annotations map[string]string) runtime.RawExtension {
+		raw, _ := json.Marshal(metav1.PartialObjectMetadata{ObjectMeta: metav1.ObjectMeta{Name: "web", Annotations: annotations}})
+		return runtime.RawExtension{Raw: raw}
+	}
+	req := &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Operation: admissionv1.Update,
+		UserInfo:  authenticationv1.UserInfo{Username: "alice", Groups: []string{"sre"}},
+		OldObject: pod(map[string]string{
+			annotationKey + "/debug":                "2",
+			requesterAnnotationKey + "/debug":       "bob",
+			requesterGroupsAnnotationKey + "/debug": `["team-a"]`,
+		}),
+		Object: pod(map[string]string{
+			annotationKey: "3",
+			// Forged by the request, and overwritten.
+			requesterGroupsAnnotationKey: `["admins"]`,
+			// The debug session is unchanged, so its requester is
+			// restored.
+			annotationKey + "/debug":                "2",
+			requesterAnnotationKey + "/debug":       "alice",
+			requesterGroupsAnnotationKey + "/debug": `["sre"]`,
+		}),
+	}
+
+	got := make(map[string]any)
+	for _, op := range requesterPatch(req) {
+		got[op.Op+" "+op.Path] = op.Value
+	}
+	want := map[string]any{
+		"add /metadata/annotations/requester.tcpdump.antrea.io":               "alice",
+		"add /metadata/annotations/requester-groups.tcpdump.antrea.io":        `["sre"]`,
+		"add /metadata/annotations/requester.tcpdump.antrea.io~1debug":        "bob",
+		"add /metadata/annotations/requester-groups.tcpdump.antrea.io~1debug": `["team-a"]`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("patch is %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	statusAnnotationKey   = "status." + annotationKey
+	backendAnnotationKey  = "backend." + annotationKey
+	autostopAnnotationKey = "autostop." + annotationKey
+	// benchSessionPrefix names the session each backend is measured in.
+	benchSessionPrefix = "bench-"
+	// benchStartTimeout is how long a bench run waits for the agent to
+	// start the capture, and benchStopTimeout how long past its duration
+	// for it to complete.
+	benchStartTimeout = time.Minute
+	benchStopTimeout  = time.Minute
+)
+
+// benchStatus mirrors the fields of the agent's status annotation that the
+// bench reads.
+type benchStatus struct {
+	State     string       `json:"state"`
+	SessionID string       `json:"sessionID"`
+	Backend   string       `json:"backend"`
+	Packets   *benchCounts `json:"packets"`
+	Cost      *benchCost   `json:"cost"`
+	StartTime *time.Time   `json:"startTime"`
+	Message   string       `json:"message"`
+	UpdatedAt time.Time    `json:"updatedAt"`
+}
+
+type benchCounts struct {
+	Captured uint64 `json:"captured"`
+	Received uint64 `json:"received"`
+	Dropped  uint64 `json:"dropped"`
+}
+
+type benchCost struct {
+	CPUSeconds   float64 `json:"cpuSeconds"`
+	MemoryBytes  int64   `json:"memoryBytes"`
+	WrittenBytes uint64  `json:"writtenBytes"`
+}
+
+// benchResult is one backend's run, as -json prints it.
+type benchResult struct {
+	Backend  string        `json:"backend"`
+	Duration time.Duration `json:"duration"`
+	Captured uint64        `json:"captured"`
+	Received uint64        `json:"received"`
+	Dropped  uint64        `json:"dropped"`
+	// CPUCores is the CPU time over the duration of the run, and
+	// CPUPerPacket the CPU time of each captured packet.
+	CPUCores     float64       `json:"cpuCores"`
+	CPUPerPacket time.Duration `json:"cpuPerPacket"`
+	MemoryBytes  int64         `json:"memoryBytes"`
+	WrittenBytes uint64        `json:"writtenBytes"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// runBench captures a Pod's traffic with each backend in turn, for the same
+// duration, and compares what the captures cost the node. Replaying a
+// stored capture file during every run gives each backend the same traffic.
+func runBench(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	o.register(fs)
+	backends := fs.String("backends", "exec-tcpdump,native,ebpf", "comma-separated backends to compare")
+	duration := fs.Duration("duration", 30*time.Second, "how long each backend captures")
+	files := fs.Int("files", 2, "maximum number of rotated 1MB pcap files of each run")
+	replay := fs.String("replay", "", "capture file to replay out of the Pod during every run, as pcapctl replay --file takes it")
+	loop := fs.Int("loop", 0, "how many times each run sends the replayed file")
+	asJSON := fs.Bool("json", false, "print the results as JSON")
+	podName, err := parsePodArg(fs, args)
+	if err != nil {
+		return err
+	}
+	if *duration < time.Second {
+		return fmt.Errorf("--duration must be at least 1s")
+	}
+	if *files <= 0 {
+		return fmt.Errorf("--files must be positive")
+	}
+
+	client, ns, err := o.client()
+	if err != nil {
+		return err
+	}
+	var results []benchResult
+	for _, backend := range strings.Split(*backends, ",") {
+		backend = strings.TrimSpace(backend)
+		if backend == "" {
+			continue
+		}
+		if !*asJSON {
+			fmt.Fprintf(os.Stderr, "capturing %s/%s with %s for %s\n", ns, podName, backend, *duration)
+		}
+		r, err := benchBackend(client, ns, podName, backend, *duration, *files, *replay, *loop)
+		if err != nil {
+			r = benchResult{Backend: backend, Error: err.Error()}
+		}
+		results = append(results, r)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "BACKEND\tPACKETS\tDROPPED\tCPU\tCPU/PACKET\tMEMORY\tWRITTEN\tWRITE RATE")
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(w, "%s\t-\t-\t-\t-\t-\t-\t%s\n", r.Backend, r.Error)
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.3f cores\t%s\t%s\t%s\t%s/s\n", r.Backend, r.Captured, r.Dropped, r.CPUCores, r.CPUPerPacket.Round(100*time.Nanosecond),
+			formatBytes(float64(r.MemoryBytes)), formatBytes(float64(r.WrittenBytes)), formatBytes(float64(r.WrittenBytes)/r.Duration.Seconds()))
+	}
+	return w.Flush()
+}
+
+// benchBackend runs one capture of the Pod with backend in a session of its
+// own, which autostop completes after duration, and reads its cost from the
+// final status. The session's annotations are removed afterwards.
+func benchBackend(client *kubernetes.Clientset, ns, pod, backend string, duration time.Duration, files int, replay string, loop int) (benchResult, error) {
+	session := benchSessionPrefix + backend
+	prev, err := benchSessionStatus(client, ns, pod, session)
+	if err != nil {
+		return benchResult{}, err
+	}
+	annotations := map[string]interface{}{
+		sessionKey(session):                   strconv.Itoa(files),
+		backendAnnotationKey + "/" + session:  backend,
+		autostopAnnotationKey + "/" + session: "duration=" + duration.String(),
+	}
+	if err := patchAnnotations(client, ns, pod, annotations); err != nil {
+		return benchResult{}, err
+	}
+	defer func() {
+		for k := range annotations {
+			annotations[k] = nil
+		}
+		patchAnnotations(client, ns, pod, annotations)
+	}()
+
+	// The status of an earlier run of the session is not this one's.
+	st, err := waitBenchStatus(client, ns, pod, session, benchStartTimeout, func(st *benchStatus) bool {
+		return st.SessionID != prev.SessionID && st.State != ""
+	})
+	if err != nil {
+		return benchResult{}, fmt.Errorf("capture did not start: %w", err)
+	}
+	if st.State == "failed" {
+		return benchResult{}, fmt.Errorf("capture failed: %s", st.Message)
+	}
+	if replay != "" {
+		val := "file=" + replay + ",speed=max"
+		if loop > 0 {
+			val += ",loop=" + strconv.Itoa(loop)
+		}
+		if err := patchAnnotation(client, ns, pod, replayAnnotationKey, val); err != nil {
+			return benchResult{}, err
+		}
+		defer patchAnnotation(client, ns, pod, replayAnnotationKey, "stop")
+	}
+
+	id := st.SessionID
+	st, err = waitBenchStatus(client, ns, pod, session, duration+benchStopTimeout, func(st *benchStatus) bool {
+		return st.SessionID != id || st.State != "running"
+	})
+	if err != nil {
+		return benchResult{}, fmt.Errorf("capture did not complete: %w", err)
+	}
+	if st.State != "completed" {
+		return benchResult{}, fmt.Errorf("capture %s: %s", st.State, st.Message)
+	}
+	if st.Packets == nil || st.Cost == nil || st.StartTime == nil {
+		return benchResult{}, fmt.Errorf("the agent does not report the cost of captures")
+	}
+
+	r := benchResult{
+		Backend:      backend,
+		Duration:     st.UpdatedAt.Sub(*st.StartTime),
+		Captured:     st.Packets.Captured,
+		Received:     st.Packets.Received,
+		Dropped:      st.Packets.Dropped,
+		MemoryBytes:  st.Cost.MemoryBytes,
+		WrittenBytes: st.Cost.WrittenBytes,
+	}
+	if r.Duration <= 0 {
+		r.Duration = duration
+	}
+	cpu := time.Duration(st.Cost.CPUSeconds * float64(time.Second))
+	r.CPUCores = cpu.Seconds() / r.Duration.Seconds()
+	if r.Captured > 0 {
+		r.CPUPerPacket = cpu / time.Duration(r.Captured)
+	}
+	return r, nil
+}
+
+// benchSessionStatus reads the status of session from the Pod, which is
+// empty before the session first ran.
+func benchSessionStatus(client *kubernetes.Clientset, ns, pod, session string) (*benchStatus, error) {
+	p, err := client.CoreV1().Pods(ns).Get(context.TODO(), pod, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	var st benchStatus
+	if v, ok := p.Annotations[statusAnnotationKey+"/"+session]; ok {
+		if err := json.Unmarshal([]byte(v), &st); err != nil {
+			return nil, fmt.Errorf("invalid status of session %s: %w", session, err)
+		}
+	}
+	return &st, nil
+}
+
+// waitBenchStatus polls the status of session until done accepts it.
+func waitBenchStatus(client *kubernetes.Clientset, ns, pod, session string, timeout time.Duration, done func(*benchStatus) bool) (*benchStatus, error) {
+	for deadline := time.Now().Add(timeout); ; {
+		st, err := benchSessionStatus(client, ns, pod, session)
+		if err != nil {
+			return nil, err
+		}
+		if done(st) {
+			return st, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("no status within %s; see the Pod's events", timeout)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// formatBytes formats n bytes with a binary unit.
+func formatBytes(n float64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	exp := 0
+	for n >= unit*unit && exp < 3 {
+		n /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", n/unit, "KMGT"[exp])
+}
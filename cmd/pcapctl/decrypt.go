@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// The format of encrypted capture files, as the agent writes them: a header
+// of the magic, the key ID and a nonce prefix, then AES-256-GCM sealed
+// chunks whose nonce is the prefix, the chunk number and a last-chunk flag.
+const (
+	encryptSuffix     = ".enc"
+	encryptMagic      = "PCAPENC1"
+	encryptKeyIDSize  = 8
+	encryptPrefixSize = 7
+	encryptHeaderSize = len(encryptMagic) + encryptKeyIDSize + encryptPrefixSize
+	encryptChunk      = 64 << 10
+	encryptOverhead   = 16
+)
+
+// runDecrypt writes each encrypted file decrypted next to it, without the
+// encryption suffix.
+func runDecrypt(args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := fs.String("key", os.Getenv("PCAPCTL_ENCRYPTION_KEY"), "file holding the base64 encryption key of the agents (env PCAPCTL_ENCRYPTION_KEY)")
+	fs.Parse(args)
+	if *keyFile == "" {
+		return fmt.Errorf("--key or PCAPCTL_ENCRYPTION_KEY is required")
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("decrypt requires at least one file")
+	}
+	aead, id, err := loadKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	for _, src := range fs.Args() {
+		dst, ok := strings.CutSuffix(src, encryptSuffix)
+		if !ok {
+			return fmt.Errorf("%s does not end in %s", src, encryptSuffix)
+		}
+		if err := decryptFile(aead, id, src, dst); err != nil {
+			return fmt.Errorf("%s: %w", src, err)
+		}
+		fmt.Println(dst)
+	}
+	return nil
+}
+
+// loadKey reads the base64 key at path and returns its cipher and key ID.
+func loadKey(path string) (cipher.AEAD, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, nil, errors.New("encryption key must be 32 bytes in base64")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, nil, err
+	}
+	sum := sha256.Sum256(key)
+	return aead, sum[:encryptKeyIDSize], nil
+}
+
+// decryptFile writes src decrypted to dst through a temporary file, so a
+// file that fails to decrypt leaves nothing behind.
+func decryptFile(aead cipher.AEAD, id []byte, src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	header := make([]byte, encryptHeaderSize)
+	if _, err := io.ReadFull(in, header); err != nil || string(header[:len(encryptMagic)]) != encryptMagic {
+		return errors.New("not an encrypted capture file")
+	}
+	if fileID := header[len(encryptMagic) : len(encryptMagic)+encryptKeyIDSize]; !bytes.Equal(fileID, id) {
+		return fmt.Errorf("file was encrypted with key %x, not with key %x", fileID, id)
+	}
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	r := bufio.NewReaderSize(in, encryptChunk+encryptOverhead+1)
+	chunk := make([]byte, encryptChunk+encryptOverhead)
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[encryptHeaderSize-encryptPrefixSize:])
+	for n := uint32(0); ; n++ {
+		size, err := io.ReadFull(r, chunk)
+		if errors.Is(err, io.EOF) {
+			return errors.New("file is truncated")
+		}
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		last := size < len(chunk)
+		if !last {
+			_, err := r.Peek(1)
+			last = errors.Is(err, io.EOF)
+		}
+		binary.BigEndian.PutUint32(nonce[encryptPrefixSize:], n)
+		nonce[len(nonce)-1] = 0
+		if last {
+			nonce[len(nonce)-1] = 1
+		}
+		plain, err := aead.Open(chunk[:0], nonce, chunk[:size], header)
+		if err != nil {
+			return fmt.Errorf("cannot decrypt chunk %d: file is corrupt or truncated", n)
+		}
+		if _, err := out.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
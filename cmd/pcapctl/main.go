@@ -0,0 +1,612 @@
+// Command pcapctl starts, stops, inspects and downloads packet captures run
+// by the packet-capture DaemonSet. Installed as kubectl-pcap it also works as
+// a kubectl plugin ("kubectl pcap start my-pod").
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	annotationKey         = "tcpdump.antrea.io"
+	snapshotAnnotationKey = "snapshot." + annotationKey
+	replayAnnotationKey   = "replay." + annotationKey
+	defaultAgentPort      = 8090
+	// snapshotTimeout is how long snapshot -o waits for the agent to save
+	// the snapshot.
+	snapshotTimeout = 30 * time.Second
+)
+
+const usage = `Usage: pcapctl <command> [flags] [pod]
+
+Commands:
+  start     annotate a Pod to start a capture
+  stop      remove the annotation to stop a capture
+  status    list annotated Pods and their capture files
+  download  fetch a Pod's capture files from its node agent
+  snapshot  preserve the last minutes of a running capture
+  replay    send a stored capture file out of a Pod's interface
+  bench     compare what capturing a Pod costs with each backend
+  decrypt   decrypt capture files the agents encrypted at rest
+
+Run "pcapctl <command> -h" for command flags.
+`
+
+// options are the flags shared by every subcommand.
+type options struct {
+	kubeconfig string
+	namespace  string
+	token      string
+	agentURL   string
+	agentPort  int
+	// caFile, certFile and keyFile are set for agents that serve HTTPS,
+	// the latter two when they ask for a client certificate.
+	caFile   string
+	certFile string
+	keyFile  string
+}
+
+func (o *options) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "path to a kubeconfig file (defaults to KUBECONFIG or ~/.kube/config)")
+	fs.StringVar(&o.namespace, "n", "", "namespace of the target Pod (defaults to the kubeconfig context namespace)")
+	fs.StringVar(&o.token, "token", os.Getenv("PCAPCTL_TOKEN"), "bearer token for the agent API (env PCAPCTL_TOKEN)")
+	fs.StringVar(&o.agentURL, "agent-url", "", "agent base URL, overriding the node InternalIP lookup")
+	fs.IntVar(&o.agentPort, "agent-port", defaultAgentPort, "agent HTTP port on the node")
+	fs.StringVar(&o.caFile, "tls-ca", os.Getenv("PCAPCTL_CA"), "CA bundle the agent's serving certificate is verified with; connects over HTTPS (env PCAPCTL_CA)")
+	fs.StringVar(&o.certFile, "tls-cert", os.Getenv("PCAPCTL_CERT"), "client certificate for agents that require one (env PCAPCTL_CERT)")
+	fs.StringVar(&o.keyFile, "tls-key", os.Getenv("PCAPCTL_KEY"), "key of the client certificate (env PCAPCTL_KEY)")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	cmd, args := os.Args[1], os.Args[2:]
+	switch cmd {
+	case "start":
+		err = runStart(args)
+	case "stop":
+		err = runStop(args)
+	case "status":
+		err = runStatus(args)
+	case "download":
+		err = runDownload(args)
+	case "snapshot":
+		err = runSnapshot(args)
+	case "replay":
+		err = runReplay(args)
+	case "decrypt":
+		err = runDecrypt(args)
+	case "bench":
+		err = runBench(args)
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", cmd, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runStart(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("start", flag.ExitOnError)
+	o.register(fs)
+	files := fs.Int("files", 5, "maximum number of rotated 1MB pcap files")
+	session := fs.String("session", "", "start a named session next to the Pod's capture")
+	pod, err := parsePodArg(fs, args)
+	if err != nil {
+		return err
+	}
+	if *files <= 0 {
+		return fmt.Errorf("--files must be positive")
+	}
+
+	client, ns, err := o.client()
+	if err != nil {
+		return err
+	}
+	if err := patchAnnotation(client, ns, pod, sessionKey(*session), strconv.Itoa(*files)); err != nil {
+		return err
+	}
+	fmt.Printf("capture requested for %s/%s%s (max %d files)\n", ns, pod, sessionSuffix(*session), *files)
+	return nil
+}
+
+func runStop(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("stop", flag.ExitOnError)
+	o.register(fs)
+	session := fs.String("session", "", "stop a named session instead of the Pod's capture")
+	pod, err := parsePodArg(fs, args)
+	if err != nil {
+		return err
+	}
+
+	client, ns, err := o.client()
+	if err != nil {
+		return err
+	}
+	if err := patchAnnotation(client, ns, pod, sessionKey(*session), nil); err != nil {
+		return err
+	}
+	fmt.Printf("capture stopped for %s/%s%s\n", ns, pod, sessionSuffix(*session))
+	return nil
+}
+
+// sessionKey returns the annotation requesting the named session, or the
+// Pod's capture for an empty name.
+func sessionKey(session string) string {
+	if session == "" {
+		return annotationKey
+	}
+	return annotationKey + "/" + session
+}
+
+func sessionSuffix(session string) string {
+	if session == "" {
+		return ""
+	}
+	return " session " + session
+}
+
+func runStatus(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	o.register(fs)
+	all := fs.Bool("A", false, "list annotated Pods in all namespaces")
+	fs.Parse(args)
+
+	client, ns, err := o.client()
+	if err != nil {
+		return err
+	}
+	if *all {
+		ns = metav1.NamespaceAll
+	}
+	pods, err := client.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tPOD\tNODE\tMAX FILES\tFILES\tBYTES")
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		val, ok := pod.Annotations[annotationKey]
+		if !ok || (fs.NArg() > 0 && pod.Name != fs.Arg(0)) {
+			continue
+		}
+		files, size := "-", "-"
+		if o.token != "" {
+			if s, err := o.agentSession(client, pod); err == nil && s != nil {
+				var total int64
+				for _, f := range s.Files {
+					total += f.Size
+				}
+				files, size = strconv.Itoa(len(s.Files)), strconv.FormatInt(total, 10)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", pod.Namespace, pod.Name, pod.Spec.NodeName, val, files, size)
+	}
+	return w.Flush()
+}
+
+func runDownload(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	o.register(fs)
+	out := fs.String("o", ".", "directory to write the pcap files to")
+	podName, err := parsePodArg(fs, args)
+	if err != nil {
+		return err
+	}
+	if o.token == "" && o.certFile == "" {
+		return fmt.Errorf("--token, PCAPCTL_TOKEN or a client certificate is required to download captures")
+	}
+
+	client, ns, err := o.client()
+	if err != nil {
+		return err
+	}
+	pod, err := client.CoreV1().Pods(ns).Get(context.TODO(), podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	s, err := o.agentSession(client, pod)
+	if err != nil {
+		return err
+	}
+	if s == nil || len(s.Files) == 0 {
+		return fmt.Errorf("no capture files found for %s/%s", ns, podName)
+	}
+
+	base, err := o.baseURL(client, pod)
+	if err != nil {
+		return err
+	}
+	for _, f := range s.Files {
+		dst := filepath.Join(*out, f.Name)
+		if err := o.fetch(base+"/captures/"+pod.Name+"/"+f.Name, dst); err != nil {
+			return err
+		}
+		fmt.Printf("%s (%d bytes)\n", dst, f.Size)
+	}
+	return nil
+}
+
+func runSnapshot(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	o.register(fs)
+	last := fs.Duration("last", time.Minute, "how much of the recent traffic to preserve")
+	out := fs.String("o", "", "wait for the snapshot and download it into this directory")
+	podName, err := parsePodArg(fs, args)
+	if err != nil {
+		return err
+	}
+	if *last <= 0 {
+		return fmt.Errorf("--last must be positive")
+	}
+	if *out != "" && o.token == "" && o.certFile == "" {
+		return fmt.Errorf("--token, PCAPCTL_TOKEN or a client certificate is required to download snapshots")
+	}
+
+	client, ns, err := o.client()
+	if err != nil {
+		return err
+	}
+	if *out == "" {
+		if err := patchAnnotation(client, ns, podName, snapshotAnnotationKey, last.String()); err != nil {
+			return err
+		}
+		fmt.Printf("snapshot of the last %s requested for %s/%s\n", *last, ns, podName)
+		return nil
+	}
+
+	pod, err := client.CoreV1().Pods(ns).Get(context.TODO(), podName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	base, err := o.baseURL(client, pod)
+	if err != nil {
+		return err
+	}
+	// Snapshots that exist before the request are not the one asked for.
+	before, err := o.snapshots(base)
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool, len(before))
+	for _, s := range before {
+		seen[s.Name] = true
+	}
+	if err := patchAnnotation(client, ns, podName, snapshotAnnotationKey, last.String()); err != nil {
+		return err
+	}
+
+	var snap *agentSnapshot
+	for deadline := time.Now().Add(snapshotTimeout); snap == nil; {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no snapshot of %s/%s appeared within %s; see the Pod's events", ns, podName, snapshotTimeout)
+		}
+		time.Sleep(time.Second)
+		snaps, err := o.snapshots(base)
+		if err != nil {
+			return err
+		}
+		for i := range snaps {
+			if s := &snaps[i]; !seen[s.Name] && s.Namespace == ns && s.Pod == podName {
+				snap = s
+			}
+		}
+	}
+
+	dir := filepath.Join(*out, snap.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, f := range append(snap.Files, agentFile{Name: "manifest.json"}) {
+		dst := filepath.Join(dir, f.Name)
+		if err := o.fetch(base+"/snapshots/"+snap.Name+"/"+f.Name, dst); err != nil {
+			return err
+		}
+		fmt.Println(dst)
+	}
+	return nil
+}
+
+func parsePodArg(fs *flag.FlagSet, args []string) (string, error) {
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s requires exactly one Pod name", fs.Name())
+	}
+	return fs.Arg(0), nil
+}
+
+// client builds a clientset from the kubeconfig and resolves the namespace.
+func (o *options) client() (*kubernetes.Clientset, string, error) {
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = o.kubeconfig
+	cc := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	config, err := cc.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	ns := o.namespace
+	if ns == "" {
+		if ns, _, err = cc.Namespace(); err != nil {
+			return nil, "", err
+		}
+	}
+	client, err := kubernetes.NewForConfig(config)
+	return client, ns, err
+}
+
+// patchAnnotation sets the annotation key to val, or removes it when val is
+// nil.
+// runReplay asks the agent on the Pod's node to replay a stored capture
+// file out of an interface of the Pod.
+func runReplay(args []string) error {
+	var o options
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	o.register(fs)
+	file := fs.String("file", "", "capture file to replay, by name or relative to the agent's capture directory")
+	iface := fs.String("interface", "", "interface in the Pod to send from (default eth0)")
+	speed := fs.String("speed", "", `multiplier of the recorded timing, or "max"`)
+	pps := fs.Int("pps", 0, "send at a fixed packets per second instead")
+	mbps := fs.Float64("mbps", 0, "send at a fixed rate in megabits per second instead")
+	loop := fs.Int("loop", 0, "how many times to send the file")
+	dmac := fs.String("dmac", "", "destination MAC for packets recorded without an Ethernet header")
+	stop := fs.Bool("stop", false, "stop the running replay instead")
+	podName, err := parsePodArg(fs, args)
+	if err != nil {
+		return err
+	}
+	val := "stop"
+	if !*stop {
+		if *file == "" {
+			return fmt.Errorf("--file is required")
+		}
+		parts := []string{"file=" + *file}
+		for _, kv := range []struct{ key, val string }{
+			{"interface", *iface},
+			{"speed", *speed},
+			{"pps", intFlag(*pps)},
+			{"mbps", floatFlag(*mbps)},
+			{"loop", intFlag(*loop)},
+			{"dmac", *dmac},
+		} {
+			if kv.val != "" {
+				parts = append(parts, kv.key+"="+kv.val)
+			}
+		}
+		val = strings.Join(parts, ",")
+	}
+
+	client, ns, err := o.client()
+	if err != nil {
+		return err
+	}
+	if err := patchAnnotation(client, ns, podName, replayAnnotationKey, val); err != nil {
+		return err
+	}
+	if *stop {
+		fmt.Printf("replay stop requested for %s/%s\n", ns, podName)
+	} else {
+		fmt.Printf("replay of %s requested for %s/%s; see the Pod's Events for progress\n", *file, ns, podName)
+	}
+	return nil
+}
+
+func intFlag(v int) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.Itoa(v)
+}
+
+func floatFlag(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func patchAnnotation(client *kubernetes.Clientset, ns, pod, key string, val interface{}) error {
+	return patchAnnotations(client, ns, pod, map[string]interface{}{key: val})
+}
+
+// patchAnnotations sets several annotations at once, removing those whose
+// value is nil.
+func patchAnnotations(client *kubernetes.Clientset, ns, pod string, annotations map[string]interface{}) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": annotations,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = client.CoreV1().Pods(ns).Patch(context.TODO(), pod, types.MergePatchType, patch, metav1.PatchOptions{})
+	return err
+}
+
+// agentSession mirrors the agent's /captures response entries.
+type agentSession struct {
+	Pod       string      `json:"pod"`
+	Namespace string      `json:"namespace"`
+	Active    bool        `json:"active"`
+	Files     []agentFile `json:"files"`
+}
+
+type agentFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// agentSnapshot mirrors the agent's /snapshots response entries.
+type agentSnapshot struct {
+	Name      string      `json:"name"`
+	Namespace string      `json:"namespace"`
+	Pod       string      `json:"pod"`
+	Files     []agentFile `json:"files"`
+}
+
+// snapshots lists the snapshots on the agent at base.
+func (o *options) snapshots(base string) ([]agentSnapshot, error) {
+	resp, err := o.get(base + "/snapshots")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var snaps []agentSnapshot
+	err = json.NewDecoder(resp.Body).Decode(&snaps)
+	return snaps, err
+}
+
+// agentSession asks the agent on the Pod's node for the Pod's session.
+func (o *options) agentSession(client *kubernetes.Clientset, pod *corev1.Pod) (*agentSession, error) {
+	base, err := o.baseURL(client, pod)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.get(base + "/captures")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var sessions []agentSession
+	if err := json.NewDecoder(resp.Body).Decode(&sessions); err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		if sessions[i].Pod == pod.Name && (sessions[i].Namespace == "" || sessions[i].Namespace == pod.Namespace) {
+			return &sessions[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// baseURL returns the agent URL for the node the Pod runs on. The agent uses
+// hostNetwork, so it listens on the node's InternalIP.
+func (o *options) baseURL(client *kubernetes.Clientset, pod *corev1.Pod) (string, error) {
+	if o.agentURL != "" {
+		return o.agentURL, nil
+	}
+	if pod.Spec.NodeName == "" {
+		return "", fmt.Errorf("pod %s/%s is not scheduled", pod.Namespace, pod.Name)
+	}
+	node, err := client.CoreV1().Nodes().Get(context.TODO(), pod.Spec.NodeName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			scheme := "http://"
+			if o.caFile != "" {
+				scheme = "https://"
+			}
+			return scheme + net.JoinHostPort(addr.Address, strconv.Itoa(o.agentPort)), nil
+		}
+	}
+	return "", fmt.Errorf("node %s has no InternalIP", node.Name)
+}
+
+func (o *options) get(url string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if o.token != "" {
+		req.Header.Set("Authorization", "Bearer "+o.token)
+	}
+	transport, err := o.transport()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: 5 * time.Minute, Transport: transport}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// transport returns the transport to the agent, with the CA and client
+// certificate given.
+func (o *options) transport() (http.RoundTripper, error) {
+	if o.caFile == "" && o.certFile == "" {
+		return http.DefaultTransport, nil
+	}
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if o.caFile != "" {
+		pem, err := os.ReadFile(o.caFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", o.caFile)
+		}
+	}
+	if o.certFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.certFile, o.keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = cfg
+	return t, nil
+}
+
+func (o *options) fetch(url, dst string) error {
+	resp, err := o.get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+
+	capturev1 "github.com/antrea-capture/controller/proto/capturev1"
+)
+
+//go:generate protoc -I proto --go_out=. --go_opt=module=github.com/antrea-capture/controller --go-grpc_out=. --go-grpc_opt=module=github.com/antrea-capture/controller collector.proto
+
+// streamBuffer is the number of packets queued for the collector. Packets
+// are dropped rather than stalling the capture when it is full.
+const streamBuffer = 4096
+
+// collectorClient is the agent's connection to the central collector.
+type collectorClient struct {
+	client capturev1.CollectorClient
+}
+
+// newCollectorClient dials the collector with mutual TLS. It returns nil if
+// no collector is configured.
+func newCollectorClient(cfg *Config) (*collectorClient, error) {
+	if cfg.CollectorAddr == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.CollectorCert, cfg.CollectorKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load collector client certificate: %w", err)
+	}
+	ca, err := os.ReadFile(cfg.CollectorCA)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read collector CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates found in %s", cfg.CollectorCA)
+	}
+	creds := credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	})
+	conn, err := grpc.Dial(cfg.CollectorAddr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to collector: %w", err)
+	}
+	return &collectorClient{client: capturev1.NewCollectorClient(conn)}, nil
+}
+
+// packetStream sends the packets of one capture run to the collector.
+// Packets are handed to a goroutine so a slow collector never blocks the
+// capture.
+type packetStream struct {
+	stream  capturev1.Collector_StreamPacketsClient
+	cancel  context.CancelFunc
+	packets chan *capturev1.StreamPacketsRequest
+	done    chan struct{}
+	log     *slog.Logger
+
+	mu sync.Mutex
+	// err is the first send error; set before done is closed.
+	err     error
+	dropped uint64
+}
+
+// open starts a stream and sends the capture header.
+func (c *collectorClient) open(spec captureSpec, ifName string, linkType layers.LinkType, snaplen int) (*packetStream, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := c.client.StreamPackets(ctx)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to open collector stream: %w", err)
+	}
+	header := &capturev1.CaptureHeader{
+		Namespace: spec.Namespace,
+		Pod:       spec.PodName,
+		PodUid:    spec.PodUID,
+		Node:      spec.Node,
+		SessionId: spec.SessionID,
+		Interface: ifName,
+		LinkType:  uint32(linkType),
+		Snaplen:   uint32(snaplen),
+	}
+	if err := stream.Send(&capturev1.StreamPacketsRequest{Msg: &capturev1.StreamPacketsRequest_Header{Header: header}}); err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to open collector stream: %w", err)
+	}
+	s := &packetStream{
+		stream:  stream,
+		cancel:  cancel,
+		packets: make(chan *capturev1.StreamPacketsRequest, streamBuffer),
+		done:    make(chan struct{}),
+		log:     slog.With("namespace", spec.Namespace, "pod", spec.PodName, "session", spec.SessionID),
+	}
+	go s.run()
+	return s, nil
+}
+
+func (s *packetStream) run() {
+	defer close(s.done)
+	for msg := range s.packets {
+		if err := s.stream.Send(msg); err != nil {
+			s.setErr(err)
+			// Drain so send never blocks.
+			for range s.packets {
+			}
+			return
+		}
+	}
+	if _, err := s.stream.CloseAndRecv(); err != nil {
+		s.setErr(err)
+	}
+}
+
+func (s *packetStream) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err == nil {
+		s.err = fmt.Errorf("collector stream failed: %w", err)
+	}
+}
+
+// send queues a packet. It returns the stream's error once sending failed.
+// data is copied, so the caller may reuse it.
+func (s *packetStream) send(ci gopacket.CaptureInfo, data []byte) error {
+	s.mu.Lock()
+	err := s.err
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	packet := &capturev1.Packet{
+		TimestampUnixNano: ci.Timestamp.UnixNano(),
+		Length:            uint32(ci.Length),
+		Data:              append([]byte(nil), data...),
+	}
+	select {
+	case s.packets <- &capturev1.StreamPacketsRequest{Msg: &capturev1.StreamPacketsRequest_Packet{Packet: packet}}:
+	default:
+		streamDropped.Inc()
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Close flushes the queued packets and ends the stream.
+func (s *packetStream) Close() error {
+	close(s.packets)
+	<-s.done
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.dropped > 0 {
+		s.log.Warn("Collector stream fell behind", "dropped", s.dropped)
+	}
+	return s.err
+}
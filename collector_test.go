@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+
+	capturev1 "github.com/antrea-capture/controller/proto/capturev1"
+)
+
+// collectorServer is a Collector that keeps the requests of the streams
+// sent to it.
+type collectorServer struct {
+	capturev1.UnimplementedCollectorServer
+	requests chan []*capturev1.StreamPacketsRequest
+}
+
+func (c *collectorServer) StreamPackets(stream capturev1.Collector_StreamPacketsServer) error {
+	var reqs []*capturev1.StreamPacketsRequest
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			c.requests <- reqs
+			return stream.SendAndClose(&capturev1.StreamPacketsResponse{})
+		}
+		if err != nil {
+			return err
+		}
+		reqs = append(reqs, req)
+	}
+}
+
+func newTestCollector(t *testing.T) (*collectorClient, *collectorServer) {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	srv := grpc.NewServer()
+	c := &collectorServer{requests: make(chan []*capturev1.StreamPacketsRequest, 1)}
+	capturev1.RegisterCollectorServer(srv, c)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return lis.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial collector: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &collectorClient{client: capturev1.NewCollectorClient(conn)}, c
+}
+
+func TestPacketStreamSendsHeaderAndPackets(t *testing.T) {
+	client, srv := newTestCollector(t)
+	spec := captureSpec{Namespace: "default", PodName: "web", PodUID: "uid-web", Node: testNode, SessionID: "s1"}
+
+	stream, err := client.open(spec, "eth0", layers.LinkTypeEthernet, 262144)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ts := time.Unix(1700000000, 42)
+	data := []byte{1, 2, 3}
+	if err := stream.send(gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 3, Length: 60}, data); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	// The stream keeps its own copy of the packet.
+	data[0] = 9
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	var reqs []*capturev1.StreamPacketsRequest
+	select {
+	case reqs = <-srv.requests:
+	case <-time.After(10 * time.Second):
+		t.Fatal("collector did not receive the stream")
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("collector received %d messages, want the header and a packet", len(reqs))
+	}
+	h := reqs[0].GetHeader()
+	if h.GetPod() != "web" || h.GetPodUid() != "uid-web" || h.GetSessionId() != "s1" || h.GetInterface() != "eth0" ||
+		h.GetLinkType() != uint32(layers.LinkTypeEthernet) || h.GetSnaplen() != 262144 {
+		t.Errorf("header is %v, want the capture's", h)
+	}
+	p := reqs[1].GetPacket()
+	if p.GetTimestampUnixNano() != ts.UnixNano() || p.GetLength() != 60 || string(p.GetData()) != "\x01\x02\x03" {
+		t.Errorf("packet is %v, want the one sent", p)
+	}
+}
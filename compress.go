@@ -0,0 +1,179 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compression is the algorithm rotated files are compressed with.
+type compression string
+
+const (
+	compressNone compression = ""
+	compressGzip compression = "gzip"
+	compressZstd compression = "zstd"
+)
+
+// compressSuffix marks a file that was renamed out of the ring and is being
+// compressed.
+const compressSuffix = ".raw"
+
+func (c compression) extension() string {
+	switch c {
+	case compressGzip:
+		return ".gz"
+	case compressZstd:
+		return ".zst"
+	}
+	return ""
+}
+
+// compressRaw compresses raw, a finished file renamed out of the ring, to
+// name plus the compression extension, and encrypts it if key is set. It
+// returns the resulting file with its checksum and size. If compression or
+// encryption fails the raw file is kept.
+func compressRaw(c compression, key *fileKey, raw, name string) (string, string, int64) {
+	dst := name + c.extension() + key.extension()
+	sum, size, err := compressFile(c, key, raw, dst)
+	if err != nil {
+		slog.Error("Failed to compress or encrypt capture file", "file", raw, "err", err)
+		sum, size, _ = fileSHA256(raw)
+		return raw, sum, size
+	}
+	os.Remove(raw)
+	return dst, sum, size
+}
+
+// compressFile writes src compressed, and then encrypted with key if set,
+// to dst through a temporary file, so a partial dst is never visible, and
+// returns the SHA-256 and size of dst.
+func compressFile(c compression, key *fileKey, src, dst string) (string, int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp)
+	defer out.Close()
+
+	counted := newHashingWriter(out)
+	var sink io.Writer = counted
+	var sealed *encryptWriter
+	if key != nil {
+		if sealed, err = key.newWriter(counted); err != nil {
+			return "", 0, err
+		}
+		sink = sealed
+	}
+	var w io.WriteCloser
+	switch c {
+	case compressGzip:
+		w = gzip.NewWriter(sink)
+	case compressZstd:
+		if w, err = zstd.NewWriter(sink); err != nil {
+			return "", 0, err
+		}
+	default:
+		w = nopWriteCloser{sink}
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		w.Close()
+		return "", 0, err
+	}
+	if err := w.Close(); err != nil {
+		return "", 0, err
+	}
+	if sealed != nil {
+		if err := sealed.Close(); err != nil {
+			return "", 0, err
+		}
+	}
+	if err := out.Close(); err != nil {
+		return "", 0, err
+	}
+	return counted.sum(), int64(counted.n), os.Rename(tmp, dst)
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// compressedFile reads a compressed capture file.
+type compressedFile struct {
+	io.Reader
+	f     *os.File
+	close func()
+}
+
+func (c *compressedFile) Close() error {
+	c.close()
+	return c.f.Close()
+}
+
+// openCaptureFile opens the capture file f for reading, decrypting it with
+// key and decompressing it if its extensions say so.
+func openCaptureFile(f string, key *fileKey) (io.ReadCloser, error) {
+	in, err := os.Open(f)
+	if err != nil {
+		return nil, err
+	}
+	var r io.Reader = in
+	if name, ok := strings.CutSuffix(f, encryptSuffix); ok {
+		if key == nil {
+			in.Close()
+			return nil, fmt.Errorf("%s is encrypted and no encryption key is configured", filepath.Base(f))
+		}
+		d, err := key.newReader(in)
+		if err != nil {
+			in.Close()
+			return nil, fmt.Errorf("%s: %w", filepath.Base(f), err)
+		}
+		f, r = name, d
+	}
+	switch {
+	case strings.HasSuffix(f, compressGzip.extension()):
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		return &compressedFile{Reader: gz, f: in, close: func() { gz.Close() }}, nil
+	case strings.HasSuffix(f, compressZstd.extension()):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			in.Close()
+			return nil, err
+		}
+		return &compressedFile{Reader: zr, f: in, close: zr.Close}, nil
+	}
+	if r != in {
+		return &compressedFile{Reader: r, f: in, close: func() {}}, nil
+	}
+	return in, nil
+}
+
+// removeCompressed removes compressed and encrypted copies and decodes of
+// name left by an earlier turn of the ring, so the ring keeps at most
+// MaxFiles files.
+func removeCompressed(name string) {
+	for _, c := range []compression{compressNone, compressGzip, compressZstd} {
+		if c != compressNone {
+			os.Remove(name + c.extension())
+		}
+		os.Remove(name + c.extension() + encryptSuffix)
+	}
+	os.Remove(name + decodeSuffix)
+	os.Remove(name + decodeSuffix + encryptSuffix)
+}
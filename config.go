@@ -0,0 +1,560 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Config holds the agent settings. Every flag can also be set through the
+// environment variable named in its help text, so the DaemonSet can be tuned
+// with either args or env without recompiling; flags win over env.
+type Config struct {
+	Kubeconfig string
+	LogFormat  string
+	LogLevel   string
+	// Role selects what the binary runs: a standalone agent, the cluster
+	// controller or an agent of the two-tier deployment.
+	Role string
+
+	Backend string
+	// CaptureWorkers is the number of socket readers of in-process
+	// backends.
+	CaptureWorkers int
+	CaptureDir     string
+	// Storage maps the names of the storage targets captures can select
+	// to the directories their volumes are mounted at.
+	Storage     map[string]string
+	Interface   string
+	TcpdumpPath string
+	// DumpcapPath runs the dumpcap backend, TsharkPath decodes finished
+	// files for the decode option.
+	DumpcapPath string
+	TsharkPath  string
+	// PktmonPath runs the pktmon backend of Windows nodes.
+	PktmonPath string
+	// OVSVsctlPath, OVSDB and OVSBridge locate the Antrea OVS bridge for
+	// the ovs-mirror backend.
+	OVSVsctlPath string
+	OVSDB        string
+	OVSBridge    string
+	RotateSizeMB int
+	NodeQuotaMB  int
+	// DiskPressurePercent is the utilization that triggers eviction.
+	DiskPressurePercent int
+	// DropAlertPercent is the share of a capture's packets the kernel may
+	// drop before the capture raises its drop alert; 0 disables alerts.
+	DropAlertPercent float64
+	// MaxCaptures caps the captures running at a time; 0 means no limit.
+	MaxCaptures int
+	// CaptureCPU, CaptureMemoryMB and CaptureNice limit every tcpdump and
+	// dumpcap process; zero values leave them unlimited.
+	CaptureCPU      float64
+	CaptureMemoryMB int
+	CaptureNice     int
+	ResyncInterval  time.Duration
+
+	Retention RetentionPolicy
+
+	// Namespace and ConfigMap locate the runtime settings ConfigMap.
+	Namespace string
+	ConfigMap string
+
+	// CollectorAddr is the gRPC collector captures can stream to, reached
+	// with the client certificate and CA below.
+	CollectorAddr string
+	CollectorCert string
+	CollectorKey  string
+	CollectorCA   string
+	// IPFIXCollector is the UDP host:port flow records of captures with
+	// the ipfix output are exported to. Flows are exported after
+	// IPFIXIdleTimeout without packets and at least every
+	// IPFIXActiveTimeout while they last.
+	IPFIXCollector     string
+	IPFIXActiveTimeout time.Duration
+	IPFIXIdleTimeout   time.Duration
+	// MetadataURL is the ClickHouse HTTP interface or Elasticsearch
+	// captures with the metadata option export to, as MetadataSink says.
+	// Rows go to MetadataTable with a _packets or _flows suffix. The
+	// credentials are only read from the environment.
+	MetadataURL      string
+	MetadataSink     string
+	MetadataTable    string
+	MetadataUser     string
+	MetadataPassword string
+
+	// ExportURL is the sftp:// or scp:// server finished capture files
+	// are exported to, verified with ExportKnownHosts and logged in to
+	// with the key at ExportKey or ExportPassword, which is only read from
+	// the environment. Empty disables exports.
+	ExportURL        string
+	ExportKnownHosts string
+	ExportKey        string
+	ExportPassword   string
+
+	// EncryptionKey is the file holding the key capture files are
+	// encrypted with at rest. Empty disables encryption.
+	EncryptionKey string
+	// EncryptionKeyOptional lets the agent start without encryption when
+	// the EncryptionKey file does not exist, as with an optional Secret.
+	// Otherwise a missing key file is an error.
+	EncryptionKeyOptional bool
+
+	// NotifyURL is the webhook a JSON notification is posted to when a
+	// capture stops, completes or fails, signed with NotifySecret, which
+	// is only read from the environment. Empty disables notifications.
+	NotifyURL    string
+	NotifySecret string
+	// AuditLog is the file every capture start and stop, file download
+	// and file deletion is appended to, and AuditNamespace the namespace
+	// they are recorded as Events in. Empty disables either.
+	AuditLog       string
+	AuditNamespace string
+	// SlackWebhookURL and PagerDutyRoutingKey are the on-call channels
+	// told about capture starts, crash loops and disk pressure. Both are
+	// secrets, only read from the environment.
+	SlackWebhookURL     string
+	PagerDutyRoutingKey string
+	// OTelEndpoint is the OTLP/HTTP endpoint of the OpenTelemetry
+	// collector the capture lifecycle is traced to; empty disables
+	// tracing. OTelHeaders, which may hold credentials, is only read from
+	// the environment.
+	OTelEndpoint    string
+	OTelHeaders     string
+	OTelServiceName string
+
+	HTTPAddr string
+	// TLSCert and TLSKey switch the HTTP server to HTTPS. With TLSClientCA
+	// every request but health probes needs a client certificate signed
+	// by it. All three are reloaded when they change on disk.
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	// APIAuthorization is token, which only admits APIToken to the capture
+	// endpoints, or kubernetes, which also admits Kubernetes tokens and
+	// client certificates of users a SubjectAccessReview allows.
+	APIAuthorization string
+	// RPCAPAddr is the listen address of the rpcap endpoint Wireshark
+	// connects to for remote captures; empty disables it. RPCAPCert and
+	// RPCAPKey switch it to TLS, which Wireshark calls rpcaps.
+	RPCAPAddr string
+	RPCAPCert string
+	RPCAPKey  string
+	// RPCAPInsecure lets the rpcap endpoint serve without TLS, which sends
+	// the tokens clients log in with in the clear.
+	RPCAPInsecure bool
+	// AdminSocket is the Unix socket node operators list, stop and
+	// collect captures through; empty disables it.
+	AdminSocket string
+	// WebUI serves the dashboard under /ui/.
+	WebUI bool
+	// Profiling serves pprof profiles under /debug/pprof/ and runtime
+	// statistics under /debug/runtime, behind the API authentication.
+	Profiling bool
+	// NPLogPath is Antrea's NetworkPolicy audit log; policy drops of a
+	// Pod's traffic reaching DropThreshold within DropWindow start a
+	// capture of the Pod for DropCaptureDuration.
+	NPLogPath           string
+	DropThreshold       int
+	DropWindow          time.Duration
+	DropCaptureDuration time.Duration
+	// HealthSelector picks the Pods captured for HealthCaptureDuration
+	// when they crash loop or fail readiness probes; empty disables it.
+	HealthSelector        string
+	HealthCaptureDuration time.Duration
+	// RingSelector picks the Pods that are always captured into a ring of
+	// RingFiles files of RingSizeMB each; empty disables it.
+	RingSelector string
+	RingFiles    int
+	RingSizeMB   int
+	// TraceflowCaptures captures the Pods of every Antrea Traceflow, not
+	// only of the annotated ones.
+	TraceflowCaptures bool
+	// PacketCaptures fulfills Antrea's PacketCaptures in place of the
+	// Antrea agent.
+	PacketCaptures bool
+	// AnalysisReports summarizes the files of every stopped capture into
+	// a JSON and HTML report next to them.
+	AnalysisReports bool
+	// Analyzer runs every stopped capture through Suricata or Zeek at
+	// AnalyzerPath, with the rules file or scripts in AnalyzerRules;
+	// empty disables it.
+	Analyzer      string
+	AnalyzerPath  string
+	AnalyzerRules string
+	// APIToken guards the capture download endpoints. It is only read from
+	// the environment so it never shows up in the process arguments.
+	APIToken string
+}
+
+// loadConfig parses args on top of environment defaults and validates the
+// result.
+func loadConfig(args []string) (*Config, error) {
+	c := &Config{}
+	fs := flag.NewFlagSet("packet-capture-controller", flag.ContinueOnError)
+
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", "", "path to a kubeconfig file; defaults to in-cluster config, then KUBECONFIG")
+	fs.StringVar(&c.LogFormat, "log-format", envOr("LOG_FORMAT", "text"), "log output format: text or json (env LOG_FORMAT)")
+	fs.StringVar(&c.LogLevel, "log-level", envOr("LOG_LEVEL", "info"), "minimum log level: debug, info, warn or error (env LOG_LEVEL)")
+
+	fs.StringVar(&c.Role, "role", envOr("ROLE", roleStandalone), "standalone, controller or agent; see the README on the two-tier deployment (env ROLE)")
+	fs.StringVar(&c.Backend, "backend", envOr("CAPTURE_BACKEND", defaultBackend), "default capture backend: "+strings.Join(supportedBackends, ", ")+" (env CAPTURE_BACKEND)")
+	workers, err := envInt("CAPTURE_WORKERS", 1)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.CaptureWorkers, "capture-workers", workers, "packet socket readers per capture for the native and ebpf backends, above 1 in packet fanout mode (env CAPTURE_WORKERS)")
+	fs.StringVar(&c.CaptureDir, "capture-dir", envOr("CAPTURE_DIR", "/captures"), "directory pcap files are written to (env CAPTURE_DIR)")
+	storage := envOr("CAPTURE_STORAGE", "")
+	fs.StringVar(&storage, "storage", storage, "storage targets captures can select, as comma separated name=directory pairs of mounted volumes (env CAPTURE_STORAGE)")
+	fs.StringVar(&c.Interface, "interface", envOr("CAPTURE_INTERFACE", "any"), "interface tcpdump captures on (env CAPTURE_INTERFACE)")
+	fs.StringVar(&c.TcpdumpPath, "tcpdump-path", envOr("TCPDUMP_PATH", "tcpdump"), "tcpdump binary name or path (env TCPDUMP_PATH)")
+	fs.StringVar(&c.DumpcapPath, "dumpcap-path", envOr("DUMPCAP_PATH", "dumpcap"), "dumpcap binary name or path for the dumpcap backend (env DUMPCAP_PATH)")
+	fs.StringVar(&c.PktmonPath, "pktmon-path", envOr("PKTMON_PATH", "pktmon"), "pktmon binary name or path for the pktmon backend on Windows (env PKTMON_PATH)")
+	fs.StringVar(&c.TsharkPath, "tshark-path", envOr("TSHARK_PATH", "tshark"), "tshark binary name or path for decoding captures (env TSHARK_PATH)")
+	fs.StringVar(&c.OVSVsctlPath, "ovs-vsctl-path", envOr("OVS_VSCTL_PATH", "ovs-vsctl"), "ovs-vsctl binary name or path for the ovs-mirror backend (env OVS_VSCTL_PATH)")
+	fs.StringVar(&c.OVSDB, "ovs-db", envOr("OVS_DB", "unix:/var/run/openvswitch/db.sock"), "OVS database the ovs-mirror backend connects to (env OVS_DB)")
+	fs.StringVar(&c.OVSBridge, "ovs-bridge", envOr("OVS_BRIDGE", "br-int"), "OVS bridge of the Antrea datapath (env OVS_BRIDGE)")
+	rotate, err := envInt("CAPTURE_ROTATE_SIZE_MB", 1)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.RotateSizeMB, "rotate-size-mb", rotate, "file size in millions of bytes before tcpdump rotates (env CAPTURE_ROTATE_SIZE_MB)")
+	quota, err := envInt("NODE_QUOTA_MB", 0)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.NodeQuotaMB, "node-quota-mb", quota, "disk budget in MB for all captures on the node, 0 for none (env NODE_QUOTA_MB)")
+	pressure, err := envInt("DISK_PRESSURE_PERCENT", 90)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.DiskPressurePercent, "disk-pressure-percent", pressure, "capture disk utilization that triggers eviction of completed captures, 0 to disable (env DISK_PRESSURE_PERCENT)")
+	dropAlert, err := envFloat("DROP_ALERT_PERCENT", 1)
+	if err != nil {
+		return nil, err
+	}
+	fs.Float64Var(&c.DropAlertPercent, "drop-alert-percent", dropAlert, "percentage of a capture's packets the kernel may drop before a Warning Event is raised, 0 to disable (env DROP_ALERT_PERCENT)")
+	maxCaptures, err := envInt("MAX_CAPTURES", 0)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.MaxCaptures, "max-captures", maxCaptures, "captures running on the node at a time, further ones wait for a slot; 0 for no limit (env MAX_CAPTURES)")
+	captureCPU, err := envFloat("CAPTURE_CPU", 0)
+	if err != nil {
+		return nil, err
+	}
+	fs.Float64Var(&c.CaptureCPU, "capture-cpu", captureCPU, "CPU cores each tcpdump or dumpcap process may use, 0 for no limit (env CAPTURE_CPU)")
+	captureMemory, err := envInt("CAPTURE_MEMORY_MB", 0)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.CaptureMemoryMB, "capture-memory-mb", captureMemory, "memory in MB each tcpdump or dumpcap process may use, 0 for no limit (env CAPTURE_MEMORY_MB)")
+	captureNice, err := envInt("CAPTURE_NICE", 0)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.CaptureNice, "capture-nice", captureNice, "nice value of tcpdump and dumpcap processes (env CAPTURE_NICE)")
+	resync, err := envDuration("RESYNC_INTERVAL", 30*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	fs.DurationVar(&c.ResyncInterval, "resync-interval", resync, "Pod informer resync interval (env RESYNC_INTERVAL)")
+
+	retention := envOr("CAPTURE_RETENTION", string(defaultRetentionMode))
+	fs.StringVar(&retention, "retention", retention, "what happens to files after a capture stops: delete, keep, ttl or pod-delete (env CAPTURE_RETENTION)")
+	ttl, err := envDuration("CAPTURE_RETENTION_TTL", defaultRetentionTTL)
+	if err != nil {
+		return nil, err
+	}
+	fs.DurationVar(&c.Retention.TTL, "retention-ttl", ttl, "maximum file age in ttl retention mode (env CAPTURE_RETENTION_TTL)")
+
+	fs.StringVar(&c.Namespace, "namespace", envOr("POD_NAMESPACE", "kube-system"), "namespace of the agent and its ConfigMap (env POD_NAMESPACE)")
+	fs.StringVar(&c.ConfigMap, "config-map", envOr("CONFIG_MAP", "packet-capture-config"), "ConfigMap with runtime settings, empty to disable (env CONFIG_MAP)")
+	fs.StringVar(&c.CollectorAddr, "collector-addr", envOr("COLLECTOR_ADDR", ""), "host:port of the gRPC collector captures may stream to, empty to disable (env COLLECTOR_ADDR)")
+	fs.StringVar(&c.CollectorCert, "collector-cert", envOr("COLLECTOR_CERT", ""), "client certificate for the collector (env COLLECTOR_CERT)")
+	fs.StringVar(&c.CollectorKey, "collector-key", envOr("COLLECTOR_KEY", ""), "client key for the collector (env COLLECTOR_KEY)")
+	fs.StringVar(&c.CollectorCA, "collector-ca", envOr("COLLECTOR_CA", ""), "CA bundle that signed the collector's certificate (env COLLECTOR_CA)")
+	fs.StringVar(&c.IPFIXCollector, "ipfix-collector", envOr("IPFIX_COLLECTOR", ""), "UDP host:port of the IPFIX collector flows are exported to, empty to disable (env IPFIX_COLLECTOR)")
+	ipfixActive, err := envDuration("IPFIX_ACTIVE_TIMEOUT", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	fs.DurationVar(&c.IPFIXActiveTimeout, "ipfix-active-timeout", ipfixActive, "interval at which long-lived flows are exported (env IPFIX_ACTIVE_TIMEOUT)")
+	ipfixIdle, err := envDuration("IPFIX_IDLE_TIMEOUT", 15*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	fs.DurationVar(&c.IPFIXIdleTimeout, "ipfix-idle-timeout", ipfixIdle, "time without packets after which a flow is exported (env IPFIX_IDLE_TIMEOUT)")
+	fs.StringVar(&c.MetadataURL, "metadata-url", envOr("METADATA_URL", ""), "URL of the ClickHouse HTTP interface or Elasticsearch capture metadata is exported to, empty to disable (env METADATA_URL)")
+	fs.StringVar(&c.MetadataSink, "metadata-sink", envOr("METADATA_SINK", sinkClickHouse), "what --metadata-url points to: clickhouse or elasticsearch (env METADATA_SINK)")
+	fs.StringVar(&c.MetadataTable, "metadata-table", envOr("METADATA_TABLE", "packet_capture"), "ClickHouse table or Elasticsearch index prefix of exported metadata (env METADATA_TABLE)")
+	c.MetadataUser = os.Getenv("METADATA_USER")
+	c.MetadataPassword = os.Getenv("METADATA_PASSWORD")
+	fs.StringVar(&c.ExportURL, "export-url", envOr("EXPORT_URL", ""), "sftp:// or scp:// URL of the server and directory finished capture files are exported to, empty to disable (env EXPORT_URL)")
+	fs.StringVar(&c.ExportKnownHosts, "export-known-hosts", envOr("EXPORT_KNOWN_HOSTS", ""), "known_hosts file the export server's host key is verified with (env EXPORT_KNOWN_HOSTS)")
+	fs.StringVar(&c.ExportKey, "export-key", envOr("EXPORT_KEY", ""), "private key file exports log in with (env EXPORT_KEY)")
+	c.ExportPassword = os.Getenv("EXPORT_PASSWORD")
+	fs.StringVar(&c.EncryptionKey, "encryption-key", envOr("ENCRYPTION_KEY", ""), "file holding the base64 AES-256 key capture files are encrypted with at rest, empty to disable (env ENCRYPTION_KEY)")
+	encryptionOptional, err := envBool("ENCRYPTION_KEY_OPTIONAL", false)
+	if err != nil {
+		return nil, err
+	}
+	fs.BoolVar(&c.EncryptionKeyOptional, "encryption-key-optional", encryptionOptional, "start without encryption when the --encryption-key file does not exist instead of failing (env ENCRYPTION_KEY_OPTIONAL)")
+	fs.StringVar(&c.NotifyURL, "notify-url", envOr("NOTIFY_URL", ""), "URL notifications are posted to when a capture stops, completes or fails, empty to disable (env NOTIFY_URL)")
+	c.NotifySecret = os.Getenv("NOTIFY_SECRET")
+	fs.StringVar(&c.AuditLog, "audit-log", envOr("AUDIT_LOG", ""), "file capture starts, stops, downloads and deletions are appended to as JSON lines, empty to disable (env AUDIT_LOG)")
+	fs.StringVar(&c.AuditNamespace, "audit-namespace", envOr("AUDIT_NAMESPACE", ""), "namespace capture starts, stops, downloads and deletions are recorded as Events in, empty to disable (env AUDIT_NAMESPACE)")
+	c.SlackWebhookURL = os.Getenv("SLACK_WEBHOOK_URL")
+	c.PagerDutyRoutingKey = os.Getenv("PAGERDUTY_ROUTING_KEY")
+	fs.StringVar(&c.OTelEndpoint, "otel-endpoint", envOr("OTEL_EXPORTER_OTLP_ENDPOINT", ""), "OTLP/HTTP endpoint of the OpenTelemetry collector capture traces are exported to, e.g. http://otel-collector:4318, empty to disable (env OTEL_EXPORTER_OTLP_ENDPOINT)")
+	fs.StringVar(&c.OTelServiceName, "otel-service-name", envOr("OTEL_SERVICE_NAME", "packet-capture-agent"), "service name of the exported traces (env OTEL_SERVICE_NAME)")
+	c.OTelHeaders = os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")
+	fs.StringVar(&c.HTTPAddr, "http-addr", envOr("HTTP_ADDR", defaultHTTPAddr), "listen address of the HTTP server (env HTTP_ADDR)")
+	fs.StringVar(&c.TLSCert, "tls-cert", envOr("TLS_CERT", ""), "serving certificate of the HTTP server, empty to serve plain HTTP (env TLS_CERT)")
+	fs.StringVar(&c.TLSKey, "tls-key", envOr("TLS_KEY", ""), "key of the serving certificate (env TLS_KEY)")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", envOr("TLS_CLIENT_CA", ""), "CA bundle client certificates are verified with; set to require them on every endpoint but the health probes (env TLS_CLIENT_CA)")
+	fs.StringVar(&c.APIAuthorization, "api-authorization", envOr("API_AUTHORIZATION", apiAuthToken), "who the capture endpoints admit: token for the API token only, kubernetes to also admit Kubernetes tokens and client certificates allowed by a SubjectAccessReview (env API_AUTHORIZATION)")
+	fs.StringVar(&c.RPCAPAddr, "rpcap-addr", envOr("RPCAP_ADDR", ""), "listen address of the rpcap remote capture endpoint, empty to disable (env RPCAP_ADDR)")
+	fs.StringVar(&c.RPCAPCert, "rpcap-cert", envOr("RPCAP_CERT", ""), "TLS certificate of the rpcap endpoint (env RPCAP_CERT)")
+	fs.StringVar(&c.RPCAPKey, "rpcap-key", envOr("RPCAP_KEY", ""), "TLS key of the rpcap endpoint (env RPCAP_KEY)")
+	rpcapInsecure, err := envBool("RPCAP_INSECURE", false)
+	if err != nil {
+		return nil, err
+	}
+	fs.BoolVar(&c.RPCAPInsecure, "rpcap-insecure", rpcapInsecure, "serve the rpcap endpoint without TLS, which sends the tokens of clients in the clear (env RPCAP_INSECURE)")
+	fs.StringVar(&c.AdminSocket, "admin-socket", envOr("ADMIN_SOCKET", defaultAdminSocket), "Unix socket of the local admin API for node operators, empty to disable (env ADMIN_SOCKET)")
+	webUI, err := envBool("WEB_UI", false)
+	if err != nil {
+		return nil, err
+	}
+	fs.BoolVar(&c.WebUI, "web-ui", webUI, "serve the web dashboard under /ui/ (env WEB_UI)")
+	profiling, err := envBool("PROFILING", false)
+	if err != nil {
+		return nil, err
+	}
+	fs.BoolVar(&c.Profiling, "profiling", profiling, "serve pprof profiles under /debug/pprof/ and runtime statistics under /debug/runtime (env PROFILING)")
+	traceflows, err := envBool("TRACEFLOW_CAPTURES", false)
+	if err != nil {
+		return nil, err
+	}
+	fs.BoolVar(&c.TraceflowCaptures, "traceflow-captures", traceflows, "capture the Pods of every Antrea Traceflow until it times out (env TRACEFLOW_CAPTURES)")
+	packetCaptures, err := envBool("ANTREA_PACKETCAPTURES", false)
+	if err != nil {
+		return nil, err
+	}
+	fs.BoolVar(&c.PacketCaptures, "antrea-packetcaptures", packetCaptures, "fulfill Antrea PacketCaptures, so antctl packetcapture runs on this agent (env ANTREA_PACKETCAPTURES)")
+	reports, err := envBool("ANALYSIS_REPORTS", true)
+	if err != nil {
+		return nil, err
+	}
+	fs.BoolVar(&c.AnalysisReports, "analysis-reports", reports, "write an analysis report next to the files of every stopped capture (env ANALYSIS_REPORTS)")
+	fs.StringVar(&c.Analyzer, "analyzer", envOr("ANALYZER", ""), "IDS the files of every stopped capture are run through: suricata or zeek, empty to disable (env ANALYZER)")
+	fs.StringVar(&c.AnalyzerPath, "analyzer-path", envOr("ANALYZER_PATH", ""), "analyzer binary name or path, defaults to the analyzer's name (env ANALYZER_PATH)")
+	fs.StringVar(&c.AnalyzerRules, "analyzer-rules", envOr("ANALYZER_RULES", ""), "Suricata rules file or Zeek script the analyzer loads, empty for its defaults (env ANALYZER_RULES)")
+	fs.StringVar(&c.NPLogPath, "np-log-path", envOr("NP_LOG_PATH", ""), "Antrea NetworkPolicy audit log whose drops trigger captures, empty to disable (env NP_LOG_PATH)")
+	dropThreshold, err := envInt("DROP_THRESHOLD", 10)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.DropThreshold, "drop-threshold", dropThreshold, "policy drops of a Pod's traffic within the drop window that start a capture (env DROP_THRESHOLD)")
+	dropWindow, err := envDuration("DROP_WINDOW", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	fs.DurationVar(&c.DropWindow, "drop-window", dropWindow, "window policy drops are counted over (env DROP_WINDOW)")
+	dropDuration, err := envDuration("DROP_CAPTURE_DURATION", 2*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	fs.DurationVar(&c.DropCaptureDuration, "drop-capture-duration", dropDuration, "how long a capture started by policy drops runs (env DROP_CAPTURE_DURATION)")
+	fs.StringVar(&c.HealthSelector, "health-selector", envOr("HEALTH_SELECTOR", ""), "label selector of Pods captured when they crash loop or fail readiness probes, empty to disable (env HEALTH_SELECTOR)")
+	healthDuration, err := envDuration("HEALTH_CAPTURE_DURATION", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	fs.DurationVar(&c.HealthCaptureDuration, "health-capture-duration", healthDuration, "how long a capture started by a health incident runs (env HEALTH_CAPTURE_DURATION)")
+	fs.StringVar(&c.RingSelector, "ring-selector", envOr("RING_SELECTOR", ""), "label selector of Pods always captured into a ring buffer for snapshots, empty to disable (env RING_SELECTOR)")
+	ringFiles, err := envInt("RING_FILES", 4)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.RingFiles, "ring-files", ringFiles, "files in the ring buffer of each always-on capture (env RING_FILES)")
+	ringSize, err := envInt("RING_SIZE_MB", 1)
+	if err != nil {
+		return nil, err
+	}
+	fs.IntVar(&c.RingSizeMB, "ring-size-mb", ringSize, "size in millions of bytes of each ring buffer file (env RING_SIZE_MB)")
+	c.APIToken = os.Getenv("CAPTURE_API_TOKEN")
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	switch c.Role {
+	case roleStandalone, roleController, roleAgent:
+	default:
+		return nil, fmt.Errorf("unknown role %q", c.Role)
+	}
+	if !slices.Contains(supportedBackends, c.Backend) {
+		return nil, fmt.Errorf("unknown capture backend %q", c.Backend)
+	}
+	if c.CollectorAddr != "" && (c.CollectorCert == "" || c.CollectorKey == "" || c.CollectorCA == "") {
+		return nil, fmt.Errorf("the collector needs a client certificate, key and CA")
+	}
+	if c.ExportURL != "" && c.ExportKnownHosts == "" {
+		return nil, fmt.Errorf("exports need a known_hosts file to verify the server")
+	}
+	if c.ExportURL != "" && c.ExportKey == "" && c.ExportPassword == "" {
+		return nil, fmt.Errorf("exports need a private key or a password")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return nil, fmt.Errorf("the HTTP server needs both a TLS certificate and key")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return nil, fmt.Errorf("client certificates need a serving certificate")
+	}
+	switch c.APIAuthorization {
+	case apiAuthToken, apiAuthKubernetes:
+	default:
+		return nil, fmt.Errorf("unknown API authorization %q, expected %s or %s", c.APIAuthorization, apiAuthToken, apiAuthKubernetes)
+	}
+	if (c.RPCAPCert == "") != (c.RPCAPKey == "") {
+		return nil, fmt.Errorf("the rpcap endpoint needs both a TLS certificate and key")
+	}
+	if c.RPCAPAddr != "" && c.RPCAPCert == "" && c.TLSCert == "" && !c.RPCAPInsecure {
+		return nil, fmt.Errorf("the rpcap endpoint needs a TLS certificate, or --rpcap-insecure to accept tokens in the clear")
+	}
+	switch c.Analyzer {
+	case "", analyzerSuricata, analyzerZeek:
+	default:
+		return nil, fmt.Errorf("unknown analyzer %q", c.Analyzer)
+	}
+	if c.AnalyzerPath == "" {
+		c.AnalyzerPath = c.Analyzer
+	}
+	switch c.MetadataSink {
+	case sinkClickHouse, sinkElasticsearch:
+	default:
+		return nil, fmt.Errorf("unknown metadata sink %q", c.MetadataSink)
+	}
+	if c.IPFIXActiveTimeout <= 0 || c.IPFIXIdleTimeout <= 0 {
+		return nil, fmt.Errorf("the IPFIX timeouts must be positive")
+	}
+	if c.DropThreshold < 1 || c.DropWindow <= 0 || c.DropCaptureDuration <= 0 {
+		return nil, fmt.Errorf("the drop threshold, window and capture duration must be positive")
+	}
+	if _, err := labels.Parse(c.HealthSelector); err != nil {
+		return nil, fmt.Errorf("invalid health selector: %w", err)
+	}
+	if _, err := labels.Parse(c.RingSelector); err != nil {
+		return nil, fmt.Errorf("invalid ring selector: %w", err)
+	}
+	if c.RingFiles < 1 || c.RingSizeMB < 1 {
+		return nil, fmt.Errorf("the ring files and size must be positive")
+	}
+	if c.HealthCaptureDuration <= 0 {
+		return nil, fmt.Errorf("the health capture duration must be positive")
+	}
+	if c.CaptureWorkers < 1 {
+		return nil, fmt.Errorf("capture workers must be at least 1")
+	}
+	if c.Storage, err = parseStorage(storage); err != nil {
+		return nil, fmt.Errorf("invalid storage: %w", err)
+	}
+	c.Retention.Mode = RetentionMode(retention)
+	switch c.Retention.Mode {
+	case RetentionDelete, RetentionKeep, RetentionTTL, RetentionPodDelete:
+	default:
+		return nil, fmt.Errorf("unknown retention mode %q", retention)
+	}
+	if c.Retention.TTL <= 0 {
+		return nil, fmt.Errorf("retention TTL must be positive")
+	}
+	if c.RotateSizeMB <= 0 {
+		return nil, fmt.Errorf("rotate size must be positive")
+	}
+	if c.NodeQuotaMB < 0 {
+		return nil, fmt.Errorf("node quota must not be negative")
+	}
+	if c.MaxCaptures < 0 {
+		return nil, fmt.Errorf("max captures must not be negative")
+	}
+	if c.CaptureCPU < 0 || c.CaptureMemoryMB < 0 {
+		return nil, fmt.Errorf("capture process limits must not be negative")
+	}
+	if c.CaptureNice < -20 || c.CaptureNice > 19 {
+		return nil, fmt.Errorf("capture nice value must be between -20 and 19")
+	}
+	if c.DiskPressurePercent < 0 || c.DiskPressurePercent > 100 {
+		return nil, fmt.Errorf("disk pressure threshold must be a percentage")
+	}
+	if c.DropAlertPercent < 0 || c.DropAlertPercent > 100 {
+		return nil, fmt.Errorf("drop alert threshold must be a percentage")
+	}
+	if c.ResyncInterval < 0 {
+		return nil, fmt.Errorf("resync interval must not be negative")
+	}
+	return c, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(key string, def int) (int, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return n, nil
+}
+
+func envFloat(key string, def float64) (float64, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return f, nil
+}
+
+func envBool(key string, def bool) (bool, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return b, nil
+}
+
+func envDuration(key string, def time.Duration) (time.Duration, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %w", key, v, err)
+	}
+	return d, nil
+}
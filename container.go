@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// containerAnnotationKey narrows a Pod capture to the ports of one of its
+// containers, e.g. the application next to a sidecar proxy. "<name>"
+// captures where the Pod's traffic leaves the node side of its interface,
+// before a proxy intercepts it; "<name>:lo" captures on the Pod's loopback,
+// where a proxy hands traffic on to the application.
+const containerAnnotationKey = "container." + annotationKey
+
+// loopbackInterface is the Pod interface a "<name>:lo" capture runs on.
+const loopbackInterface = "lo"
+
+// applyContainer narrows spec to the container named by the container
+// annotation value v of pod.
+func applyContainer(pod *corev1.Pod, v string, backend CaptureBackend, spec *captureSpec) error {
+	name, loopback, err := parseContainerOption(v)
+	if err != nil {
+		return err
+	}
+	ports, err := containerPorts(pod, name)
+	if err != nil {
+		return err
+	}
+	filter, err := containerPortFilter(ports)
+	if err != nil {
+		return fmt.Errorf("container %q: %w", name, err)
+	}
+	if loopback {
+		if backend.Name() != backendTcpdump {
+			return fmt.Errorf("loopback captures need the %s backend", backendTcpdump)
+		}
+		if len(spec.Interfaces) > 0 || spec.Tunnel != "" || spec.Peer != "" {
+			return errors.New("loopback captures cannot be combined with several interfaces, a tunnel or a peer")
+		}
+		spec.Interface, spec.PodLoopback = loopbackInterface, true
+	}
+	spec.Container = name
+	spec.addFilter(filter)
+	return nil
+}
+
+// parseContainerOption splits the container annotation into the container
+// name and whether to capture on the Pod's loopback.
+func parseContainerOption(v string) (string, bool, error) {
+	name, side, hasSide := strings.Cut(strings.TrimSpace(v), ":")
+	if name == "" || (hasSide && side != loopbackInterface) {
+		return "", false, fmt.Errorf(`%s annotation must be "<container>" or "<container>:lo", got %q`, containerAnnotationKey, v)
+	}
+	return name, hasSide, nil
+}
+
+// containerPorts returns the ports of the named container of pod: the ones
+// it declares and the ones its processes listen on. The processes are
+// found through the container ID the runtime reported in the Pod status,
+// which needs hostPID like the pod interface does; without it the declared
+// ports are used alone.
+func containerPorts(pod *corev1.Pod, name string) ([]corev1.ContainerPort, error) {
+	var ports []corev1.ContainerPort
+	found := false
+	// Sidecars may be init containers that keep running.
+	for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if c.Name == name {
+			found = true
+			ports = append(ports, c.Ports...)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("pod has no container %q", name)
+	}
+	id := ""
+	for _, cs := range append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...) {
+		if cs.Name == name && cs.State.Running != nil {
+			// The ID is given as <runtime>://<id>.
+			_, id, _ = strings.Cut(cs.ContainerID, "://")
+		}
+	}
+	if id == "" {
+		return nil, fmt.Errorf("container %q is not running", name)
+	}
+	listening, err := containerListeners(id)
+	if err != nil && len(ports) == 0 {
+		return nil, err
+	}
+	return append(ports, listening...), nil
+}
+
+// podPorts returns the ports of every running container of pod.
+func podPorts(pod *corev1.Pod) []corev1.ContainerPort {
+	var ports []corev1.ContainerPort
+	for _, c := range append(append([]corev1.Container{}, pod.Spec.InitContainers...), pod.Spec.Containers...) {
+		if p, err := containerPorts(pod, c.Name); err == nil {
+			ports = append(ports, p...)
+		}
+	}
+	return ports
+}
+
+// containerListeners returns the TCP and UDP ports the processes of the
+// container id listen on. Containers of a Pod share its network namespace,
+// so its socket tables are read once and matched against the sockets the
+// container's processes hold open.
+func containerListeners(id string) ([]corev1.ContainerPort, error) {
+	pids := containerProcesses(id)
+	if len(pids) == 0 {
+		return nil, fmt.Errorf("no process found for container %s; the agent needs hostPID", id)
+	}
+	inodes := make(map[string]bool)
+	for _, pid := range pids {
+		fds, _ := filepath.Glob(filepath.Join("/proc", pid, "fd", "*"))
+		for _, fd := range fds {
+			if link, err := os.Readlink(fd); err == nil && strings.HasPrefix(link, "socket:[") {
+				inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] = true
+			}
+		}
+	}
+	var ports []corev1.ContainerPort
+	for _, table := range []struct {
+		file     string
+		protocol corev1.Protocol
+	}{
+		{"tcp", corev1.ProtocolTCP},
+		{"tcp6", corev1.ProtocolTCP},
+		{"udp", corev1.ProtocolUDP},
+		{"udp6", corev1.ProtocolUDP},
+	} {
+		f, err := os.Open(filepath.Join("/proc", pids[0], "net", table.file))
+		if err != nil {
+			continue
+		}
+		for _, port := range listeningPorts(f, table.protocol == corev1.ProtocolTCP, inodes) {
+			ports = append(ports, corev1.ContainerPort{ContainerPort: port, Protocol: table.protocol})
+		}
+		f.Close()
+	}
+	return ports, nil
+}
+
+// containerProcesses returns the PIDs whose cgroup names the container id.
+func containerProcesses(id string) []string {
+	var pids []string
+	procs, _ := filepath.Glob("/proc/[0-9]*/cgroup")
+	for _, f := range procs {
+		if data, err := os.ReadFile(f); err == nil && bytes.Contains(data, []byte(id)) {
+			pids = append(pids, filepath.Base(filepath.Dir(f)))
+		}
+	}
+	return pids
+}
+
+// tcpListen and udpUnconnected are the socket states of a listening socket
+// in /proc/net/tcp and /proc/net/udp.
+const (
+	tcpListen      = "0A"
+	udpUnconnected = "07"
+)
+
+// listeningPorts returns the local ports of the listening sockets in a
+// /proc/net socket table whose inode is in inodes.
+func listeningPorts(f *os.File, tcp bool, inodes map[string]bool) []int32 {
+	var ports []int32
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		// sl local_address rem_address st tx:rx tr:when retrnsmt uid timeout inode
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 10 || !inodes[fields[9]] {
+			continue
+		}
+		if tcp && fields[3] != tcpListen || !tcp && (fields[3] != udpUnconnected || !strings.HasSuffix(fields[2], ":0000")) {
+			continue
+		}
+		_, hex, _ := strings.Cut(fields[1], ":")
+		if port, err := strconv.ParseUint(hex, 16, 16); err == nil {
+			ports = append(ports, int32(port))
+		}
+	}
+	return ports
+}
+
+// containerPortFilter returns a BPF expression matching any of ports and
+// the ICMP messages about them.
+func containerPortFilter(ports []corev1.ContainerPort) (string, error) {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, p := range ports {
+		proto := p.Protocol
+		if proto == "" {
+			proto = corev1.ProtocolTCP
+		}
+		term := fmt.Sprintf("%s port %d", strings.ToLower(string(proto)), p.ContainerPort)
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	if len(terms) == 0 {
+		return "", errors.New("no ports are declared or listened on")
+	}
+	sort.Strings(terms)
+	return portsFilter(terms), nil
+}
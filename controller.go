@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+const (
+	numWorkers = 2
+	// maxRetries bounds how often a failing key is requeued before it is
+	// dropped; the next informer resync enqueues it again.
+	maxRetries = 10
+)
+
+// watchPods sets up a Pod informer filtered to this node via a field selector.
+// This ensures each DaemonSet instance only processes Pods on its own node.
+// Events only enqueue Pod keys; the actual work happens in syncPod.
+func (m *CaptureManager) watchPods(ctx context.Context) {
+	selector := fields.OneTermEqualSelector("spec.nodeName", m.nodeName).String()
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		m.clientset, m.cfg.ResyncInterval,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = selector
+		}),
+	)
+
+	podInformer := factory.Core().V1().Pods()
+	m.podLister = podInformer.Lister()
+	podInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: m.enqueuePod,
+		UpdateFunc: func(old, obj interface{}) {
+			m.checkIncident(old, obj)
+			m.enqueuePod(obj)
+		},
+		DeleteFunc: m.enqueuePod,
+	})
+
+	factory.Start(ctx.Done())
+	synced := []cache.InformerSynced{podInformer.Informer().HasSynced}
+	if m.cfg.Role != roleAgent {
+		// Namespaces, workloads and Services are not bound to a node, so
+		// they cannot share the node filter. Agents of the two-tier
+		// deployment leave them to the cluster controller.
+		clusterFactory := informers.NewSharedInformerFactory(m.clientset, m.cfg.ResyncInterval)
+		nsInformer := clusterFactory.Core().V1().Namespaces()
+		m.nsLister = nsInformer.Lister()
+		nsInformer.Informer().AddEventHandler(m.annotationHandler(metav1.Object.GetName))
+		synced = append(synced, nsInformer.Informer().HasSynced)
+		synced = append(synced, m.watchWorkloads(clusterFactory)...)
+		synced = append(synced, m.watchServices(clusterFactory)...)
+		clusterFactory.Start(ctx.Done())
+		synced = append(synced, m.watchCaptureTargets(ctx)...)
+		synced = append(synced, m.watchTraceflows(ctx)...)
+		synced = append(synced, m.watchPacketCaptures(ctx)...)
+	}
+	synced = append(synced, m.watchNode(ctx)...)
+	if !cache.WaitForCacheSync(ctx.Done(), synced...) {
+		fatal("Failed to sync informer cache")
+	}
+	m.collectOrphans()
+	m.synced.Store(true)
+	slog.Info("Watching for pod annotation changes")
+
+	defer m.queue.ShutDown()
+	go m.statuses.run(numWorkers, ctx.Done())
+	for i := 0; i < numWorkers; i++ {
+		go wait.UntilWithContext(ctx, m.runWorker, time.Second)
+	}
+	go m.resyncCaptures(ctx)
+	<-ctx.Done()
+}
+
+func (m *CaptureManager) enqueuePod(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		slog.Error("Failed to get key for object", "err", err)
+		return
+	}
+	m.queue.Add(key)
+}
+
+// annotationHandler returns event handlers for Namespaces and workloads,
+// whose capture annotations apply to Pods. When an object's annotations
+// change, every Pod on this node in the namespace returned by namespaceOf
+// is enqueued.
+func (m *CaptureManager) annotationHandler(namespaceOf func(metav1.Object) string) cache.ResourceEventHandler {
+	enqueue := func(obj interface{}) {
+		if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+			obj = tombstone.Obj
+		}
+		o, ok := obj.(metav1.Object)
+		if !ok {
+			return
+		}
+		ns := namespaceOf(o)
+		pods, err := m.podLister.Pods(ns).List(labels.Everything())
+		if err != nil {
+			slog.Error("Failed to list pods of namespace", "namespace", ns, "err", err)
+			return
+		}
+		for _, pod := range pods {
+			m.enqueuePod(pod)
+		}
+	}
+	return cache.ResourceEventHandlerFuncs{
+		AddFunc: enqueue,
+		UpdateFunc: func(old, obj interface{}) {
+			if !maps.Equal(old.(metav1.Object).GetAnnotations(), obj.(metav1.Object).GetAnnotations()) {
+				enqueue(obj)
+			}
+		},
+		DeleteFunc: enqueue,
+	}
+}
+
+func (m *CaptureManager) runWorker(ctx context.Context) {
+	for m.processNextItem() {
+	}
+}
+
+// processNextItem handles one key, requeueing it with exponential backoff
+// when syncPod reports a transient failure.
+func (m *CaptureManager) processNextItem() bool {
+	item, quit := m.queue.Get()
+	if quit {
+		return false
+	}
+	defer m.queue.Done(item)
+
+	key := item.(string)
+	sync := m.syncPod
+	if m.cfg.Role == roleController {
+		sync = m.syncAssignment
+	}
+	err := sync(key)
+	switch {
+	case err == nil:
+		m.queue.Forget(key)
+	case m.queue.NumRequeues(key) < maxRetries:
+		slog.Warn("Failed to sync pod, retrying", "key", key, "err", err)
+		m.queue.AddRateLimited(key)
+	default:
+		slog.Error("Dropping pod out of the queue", "key", key, "err", err)
+		m.queue.Forget(key)
+	}
+	return true
+}
+
+// syncPod converges the captures of a Pod to what its annotations request.
+// It only looks at the current Pod and the running captures, never at the
+// event that queued the key, so resyncs, replayed and duplicate events
+// leave a converged Pod alone. Keys without a namespace are the agent's own
+// Node.
+func (m *CaptureManager) syncPod(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return nil
+	}
+	if namespace == "" {
+		return m.syncNode(name)
+	}
+	pod, err := m.podLister.Pods(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		m.podDeleted(key, namespace, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pod.Status.Phase != corev1.PodRunning {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.leavePodQueue(key)
+		if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+			// The Pod's traffic ended with its containers, though the
+			// Pod may stay around for long.
+			m.stopPodCaptures(key, pod.Status.Phase)
+		}
+		// Captures of a Pod that is briefly Unknown, e.g. while its
+		// node is unreachable, keep running; new ones wait for it.
+		return nil
+	}
+
+	annotations, source := m.captureSource(pod)
+	val, annotated := annotations[annotationKey]
+	allowed := m.settings().namespaceAllowed(pod.Namespace)
+	if annotated {
+		// Outside its node scope a capture is treated as not requested.
+		if annotated, err = m.inNodeScope(pod, annotations); err != nil {
+			return err
+		}
+	}
+
+	if v, ok := pod.Annotations[snapshotAnnotationKey]; ok {
+		m.requestSnapshot(podRef(pod), key, v)
+	}
+	if v, ok := pod.Annotations[replayAnnotationKey]; ok {
+		if allowed {
+			m.requestReplay(podRef(pod), key, v, podInterfaceName, func() (int, error) { return podProcess(string(pod.UID)) })
+		} else {
+			m.recorder.Eventf(podRef(pod), corev1.EventTypeWarning, reasonCaptureDenied, "Replays are not allowed in namespace %s", pod.Namespace)
+		}
+	}
+	var reads *startReads
+	if allowed {
+		if reads, err = m.readStarts(pod, annotations, source, annotated); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cap := m.captures[key]
+	if sched, ok := annotations[scheduleAnnotationKey]; ok && annotated && allowed {
+		// Outside its windows a scheduled capture is treated as not
+		// requested.
+		annotated = m.inSchedule(pod, key, sched, cap)
+	}
+
+	return errors.Join(m.syncSession(pod, "", val, annotated, allowed, reads), m.syncSessions(pod, allowed, reads))
+}
+
+// startReads is what starting the captures of a Pod reads from the API
+// server. syncPod reads it before it takes m.mu, so the lock is never held
+// across API calls.
+type startReads struct {
+	// sessions holds the reads of every requested capture that was not
+	// running, by session.
+	sessions map[string]sessionReads
+	// remote is what the captures of the Pod's namespace use on the other
+	// nodes, read if its quota limits them.
+	remote namespaceUsage
+}
+
+// sessionReads is what starting one capture of a Pod reads.
+type sessionReads struct {
+	// peer is the Pod named by the peer annotation, or peerErr why it
+	// cannot be captured.
+	peer    *corev1.Pod
+	peerErr error
+	// pc is the PacketCapture the capture is requested through, with its
+	// filter, or pcErr why it cannot be read.
+	pc       *packetCapture
+	pcFilter string
+	pcErr    error
+	// checks holds the filter and stop-on checks of the capture, which
+	// compile with the capture program.
+	checks *specChecks
+}
+
+// readStarts reads what starting the requested captures of pod needs that
+// are not running yet. annotations and source are those of the Pod's own
+// capture, which is requested if annotated is set. The agent's finalizer
+// is added to the CaptureTarget the capture is requested through here, so
+// startCapture only has to count the hold.
+func (m *CaptureManager) readStarts(pod *corev1.Pod, annotations map[string]string, source metav1.Object, annotated bool) (*startReads, error) {
+	requested := make(map[string]map[string]string)
+	if annotated {
+		requested[""] = annotations
+	}
+	for _, session := range sessionNames(pod.Annotations) {
+		if _, ok := pod.Annotations[sessionAnnotationKey(annotationKey, session)]; !ok {
+			continue
+		}
+		// Invalid sessions are reported by startCapture.
+		if a, err := sessionAnnotations(pod.Annotations, session); err == nil {
+			requested[session] = a
+		}
+	}
+	podKey := pod.Namespace + "/" + pod.Name
+	m.mu.Lock()
+	for session := range requested {
+		if _, ok := m.captures[sessionKey(podKey, session)]; ok || statusState(pod, session) == stateCompleted {
+			delete(requested, session)
+		}
+	}
+	m.mu.Unlock()
+
+	reads := &startReads{sessions: make(map[string]sessionReads)}
+	if len(requested) == 0 {
+		return reads, nil
+	}
+	for session, a := range requested {
+		var r sessionReads
+		if v, ok := a[peerAnnotationKey]; ok {
+			peerSource := source
+			if session != "" {
+				peerSource = pod
+			}
+			r.peer, r.peerErr = m.resolvePeer(pod, peerSource, session, v)
+		}
+		if session == "" {
+			if r.pc, r.pcErr = m.sourcePacketCapture(source); r.pc != nil {
+				r.pcFilter, r.pcErr = m.packetCaptureFilter(r.pc)
+			}
+			if target := sourceTarget(source); target != "" {
+				// Deleting the CaptureTarget waits for the capture to
+				// stop and its files to be exported.
+				if err := m.ensureTarget(target); err != nil {
+					return nil, fmt.Errorf("failed to add finalizer to CaptureTarget %s: %w", target, err)
+				}
+			}
+		}
+		r.checks = m.checkStart(pod, session, a, source, r)
+		reads.sessions[session] = r
+	}
+	if q := m.settings().namespaceQuota(pod.Namespace); q != nil && q.limited() {
+		usage, err := m.remoteUsage(pod.Namespace)
+		if err != nil {
+			return nil, fmt.Errorf("failed to determine the capture usage of namespace %s: %w", pod.Namespace, err)
+		}
+		reads.remote = usage
+	}
+	return reads, nil
+}
+
+// checkStart checks the filter and stop-on match of the capture of pod
+// for session with its backend, scoping its spec like startCapture does.
+// It returns nil if the capture cannot start anyway, which startCapture
+// reports.
+func (m *CaptureManager) checkStart(pod *corev1.Pod, session string, annotations map[string]string, source metav1.Object, read sessionReads) *specChecks {
+	if session != "" {
+		source = pod
+	}
+	backend, err := m.podBackend(annotations)
+	if err != nil {
+		return nil
+	}
+	spec := captureSpec{
+		Interface: m.cfg.Interface,
+		Filter:    m.settings().DefaultFilter,
+		PodUID:    string(pod.UID),
+		Namespace: pod.Namespace,
+		PodName:   pod.Name,
+		Node:      m.nodeName,
+		Session:   session,
+	}
+	if err := applyPodOptions(annotations, &spec); err != nil {
+		return nil
+	}
+	if msg := m.scopeSpec(pod, annotations, source, backend, read, &spec); msg != "" {
+		return nil
+	}
+	return runSpecChecks(backend, spec)
+}
+
+// syncSession starts or stops the Pod's own capture, for an empty session,
+// or one of its named sessions. reads is what readStarts read for them, nil
+// if the namespace is not allowed. Callers must hold m.mu.
+func (m *CaptureManager) syncSession(pod *corev1.Pod, session, val string, annotated, allowed bool, reads *startReads) error {
+	key := sessionKey(pod.Namespace+"/"+pod.Name, session)
+	cap, capturing := m.captures[key]
+	if capturing && cap.spec.PodUID != string(pod.UID) {
+		// The Pod was recreated under its name and the informer only
+		// saw an update. The old Pod's capture ends as if it had been
+		// deleted, and the new Pod gets its own.
+		cap.log.Info("Pod was recreated, stopping the capture of the previous pod")
+		m.stopCapture(key, false, false)
+		cap, capturing = nil, false
+	}
+	var requested map[string]string
+	var changed []string
+	if annotated && capturing {
+		requested, changed = m.requestChanged(pod, val, cap)
+	}
+	switch {
+	case annotated && !allowed:
+		m.leaveQueue(key)
+		if capturing {
+			cap.log.Info("Namespace no longer allowed, stopping capture")
+			m.stopCapture(key, m.cfg.Retention.Mode == RetentionDelete, true)
+		}
+		m.reportFailure(pod, session, reasonCaptureDenied, fmt.Sprintf("Captures are not allowed in namespace %s", pod.Namespace))
+	case !annotated && !capturing && statusState(pod, session) == statePending && !m.clusterQueued(session):
+		// The request was withdrawn while it waited for a slot.
+		m.leaveQueue(key)
+		m.patchStatus(podRef(pod), captureStatus{State: stateStopped, Node: m.nodeName, Session: session})
+		return nil
+	case annotated && !capturing && statusState(pod, session) == stateCompleted:
+		// The capture completed under a previous agent instance.
+	case !annotated && !capturing && statusState(pod, session) == stateCompleted:
+		// Let the capture run again if the annotation comes back.
+		m.patchStatus(podRef(pod), captureStatus{State: stateStopped, Node: m.nodeName, Session: session})
+		return nil
+	case !annotated && !capturing && statusState(pod, session) == stateValidated:
+		// The dry run was withdrawn.
+		m.patchStatus(podRef(pod), captureStatus{State: stateStopped, Node: m.nodeName, Session: session})
+		return nil
+	case annotated && !capturing:
+		slog.Info("Starting capture", "namespace", pod.Namespace, "pod", pod.Name, "name", session, "maxFiles", val)
+		return m.startCapture(pod, session, val, reads)
+	case !annotated && capturing:
+		slog.Info("Stopping capture", "namespace", pod.Namespace, "pod", pod.Name, "name", session)
+		m.releasePeer(cap)
+		m.stopCapture(key, m.cfg.Retention.Mode == RetentionDelete, true)
+	case annotated && len(changed) > 0:
+		return m.updateCapture(pod, key, val, cap, requested, changed)
+	case annotated && cap.completed.Load():
+		// Nothing to do until the annotation is removed.
+	case annotated && m.sandboxChanged(pod, cap):
+		return m.restartInSandbox(pod, key, val, cap)
+	case annotated && cap.exited.Load():
+		return m.restartCapture(key, cap)
+	case annotated && !statusCurrent(pod, cap):
+		// A previous status patch failed; write it again.
+		m.patchStatus(cap.ref, m.status(cap))
+		return nil
+	}
+	return nil
+}
+
+// stopPodCaptures stops the captures of the terminated Pod with key and its
+// named sessions. Callers must hold m.mu.
+func (m *CaptureManager) stopPodCaptures(key string, phase corev1.PodPhase) {
+	purge := m.cfg.Retention.Mode == RetentionDelete
+	if cap, ok := m.captures[key]; ok {
+		cap.log.Info("Pod terminated, stopping capture", "phase", phase)
+		m.releasePeer(cap)
+		m.stopCapture(key, purge, true)
+	}
+	m.stopSessions(key, purge, true)
+}
+
+// resyncCaptures queues the Pod or Node of every running and waiting capture
+// once per resync interval. Informer resyncs only revisit the objects still
+// in the cache, so a capture whose Pod went away without a delete event
+// would otherwise never converge.
+func (m *CaptureManager) resyncCaptures(ctx context.Context) {
+	if m.cfg.ResyncInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(m.cfg.ResyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		keys := sets.New[string]()
+		add := func(key string) {
+			if ns, name, _, ok := splitCaptureKey(key); ok {
+				key = ns + "/" + name
+			}
+			keys.Insert(key)
+		}
+		m.mu.Lock()
+		for key := range m.captures {
+			add(key)
+		}
+		for key := range m.pending {
+			add(key)
+		}
+		m.mu.Unlock()
+		for key := range keys {
+			m.queue.Add(key)
+		}
+	}
+}
+
+// podDeleted stops any capture for the deleted Pod and, unless files are
+// retained independently of the Pod, removes everything it wrote.
+func (m *CaptureManager) podDeleted(key, namespace, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cap, ok := m.captures[key]; ok {
+		cap.log.Info("Pod deleted, stopping capture")
+		m.releasePeer(cap)
+		m.stopCapture(key, false, false)
+	}
+	m.stopSessions(key, false, false)
+	m.leavePodQueue(key)
+	delete(m.scheduleRuns, key)
+	switch m.cfg.Retention.Mode {
+	case RetentionDelete, RetentionPodDelete:
+		// The files are deleted once the captures closed them.
+		var stopped []chan struct{}
+		for k, cap := range m.stopping {
+			if ns, pod, _, ok := splitCaptureKey(k); ok && ns+"/"+pod == key {
+				stopped = append(stopped, cap.stopped)
+			}
+		}
+		go func() {
+			for _, ch := range stopped {
+				<-ch
+			}
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.deletePodFiles(namespace, name)
+			m.pruneSessionDirs()
+		}()
+	}
+}
+
+// reportFailure records a Warning Event and a failed status for a capture
+// that cannot run. Failures already reported in the status annotation are
+// skipped so informer resyncs don't repeat them. session names the failed
+// named session, if any. Callers must hold m.mu.
+func (m *CaptureManager) reportFailure(pod *corev1.Pod, session, reason, msg string) {
+	m.leaveQueue(sessionKey(pod.Namespace+"/"+pod.Name, session))
+	var st captureStatus
+	if json.Unmarshal([]byte(pod.Annotations[sessionAnnotationKey(statusAnnotationKey, session)]), &st) == nil &&
+		st.State == stateFailed && st.Message == msg {
+		return
+	}
+	slog.Warn("Capture failed", "namespace", pod.Namespace, "pod", pod.Name, "name", session, "reason", msg)
+	captureStartFailures.Inc()
+	m.recorder.Event(pod, corev1.EventTypeWarning, reason, sessionEvent(captureSpec{Session: session}, msg))
+	m.patchStatus(podRef(pod), captureStatus{State: stateFailed, Node: m.nodeName, Session: session, Reason: reason, Message: msg})
+	m.notifyFailure(pod, session, msg)
+}
+
+// captureAnnotations returns the annotations that request a capture of pod
+// and its options.
+func (m *CaptureManager) captureAnnotations(pod *corev1.Pod) map[string]string {
+	annotations, _ := m.captureSource(pod)
+	return annotations
+}
+
+// captureSource returns the capture annotations of pod and the object they
+// come from. The first object with the capture annotation wins: the Pod,
+// then the oldest CaptureTarget selecting it, then the Service it backs,
+// then the workload controlling it, then its Namespace. Options are never
+// mixed between them.
+func (m *CaptureManager) captureSource(pod *corev1.Pod) (map[string]string, metav1.Object) {
+	if m.cfg.Role == roleAgent {
+		return m.assignedSource(pod)
+	}
+	if _, ok := pod.Annotations[annotationKey]; ok || m.nsLister == nil {
+		return pod.Annotations, pod
+	}
+	if t := m.podCaptureTarget(pod); t != nil {
+		return t.annotations(), t
+	}
+	if tf := m.podTraceflow(pod); tf != nil {
+		return tf.annotations(), tf
+	}
+	if pc := m.podPacketCapture(pod); pc != nil {
+		return pc.annotations(), pc
+	}
+	if svc, _ := m.podService(pod); svc != nil {
+		return svc.Annotations, svc
+	}
+	if w := m.podWorkload(pod); w != nil {
+		if _, ok := w.GetAnnotations()[annotationKey]; ok {
+			return w.GetAnnotations(), w
+		}
+	}
+	ns, err := m.nsLister.Get(pod.Namespace)
+	if err != nil {
+		return pod.Annotations, pod
+	}
+	if _, ok := ns.Annotations[annotationKey]; ok {
+		return ns.Annotations, ns
+	}
+	if t := m.triggers.get(pod); t != nil {
+		return t.annotations(), t
+	}
+	if r := m.podRingBuffer(pod); r != nil {
+		return m.ringAnnotations(), r
+	}
+	return pod.Annotations, pod
+}
+
+// statusState returns the state in the status annotation of a Pod or Node,
+// or of a named session of a Pod.
+func statusState(obj metav1.Object, session string) string {
+	return annotatedStatus(obj, session).State
+}
+
+// annotatedStatus returns the status annotation of a Pod or Node, or of a
+// named session of a Pod.
+func annotatedStatus(obj metav1.Object, session string) captureStatus {
+	var st captureStatus
+	json.Unmarshal([]byte(obj.GetAnnotations()[sessionAnnotationKey(statusAnnotationKey, session)]), &st)
+	return st
+}
+
+// statusCurrent reports whether the status annotation of a Pod or Node
+// already describes the running session.
+func statusCurrent(obj metav1.Object, cap *CaptureProcess) bool {
+	var st captureStatus
+	if err := json.Unmarshal([]byte(obj.GetAnnotations()[sessionAnnotationKey(statusAnnotationKey, cap.spec.Session)]), &st); err != nil {
+		return false
+	}
+	return st.SessionID == cap.sessionID && st.State == stateRunning
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const testNode = "node-1"
+
+// testManager is a CaptureManager of an agent on testNode, with a fake
+// clientset, a Pod cache the test fills and the fake backend.
+type testManager struct {
+	*CaptureManager
+	t         *testing.T
+	clientset *fake.Clientset
+	pods      cache.Indexer
+	backend   *fakeBackend
+	events    *record.FakeRecorder
+}
+
+func newTestManager(t *testing.T) *testManager {
+	t.Helper()
+	cfg, err := loadConfig([]string{"--capture-dir", t.TempDir(), "--resync-interval", "0"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	cfg.Backend = backendFake
+	tm := &testManager{
+		t:         t,
+		clientset: fake.NewSimpleClientset(),
+		pods:      cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		backend:   &fakeBackend{},
+		events:    record.NewFakeRecorder(100),
+	}
+	tm.CaptureManager = &CaptureManager{
+		cfg:       cfg,
+		backends:  map[string]CaptureBackend{backendFake: tm.backend},
+		triggers:  newTriggerSet(),
+		clientset: tm.clientset,
+		recorder:  tm.events,
+		nodeName:  testNode,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		podLister: corelisters.NewPodLister(tm.pods),
+		captures:  make(map[string]*CaptureProcess),
+		replays:   make(map[string]context.CancelFunc),
+
+		resumedSessions: make(map[string]resumedSession),
+		scheduleRuns:    make(map[string]time.Time),
+		pending:         make(map[string]pendingCapture),
+		usageChanged:    make(chan struct{}, 1),
+		targetRefs:      make(map[string]int),
+		targetHeld:      make(map[string]bool),
+		stopping:        make(map[string]*CaptureProcess),
+	}
+	tm.statuses = newStatusWriter(tm.writeStatus)
+	tm.currentSettings.Store(cfg.defaultSettings())
+	stopCh := make(chan struct{})
+	go tm.statuses.run(1, stopCh)
+	t.Cleanup(func() {
+		tm.cleanupAll()
+		close(stopCh)
+	})
+	return tm
+}
+
+// addPod adds a running Pod on testNode with annotations to the clientset
+// and the Pod cache.
+func (tm *testManager) addPod(name string, annotations map[string]string) *corev1.Pod {
+	tm.t.Helper()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        name,
+			UID:         types.UID("uid-" + name),
+			Annotations: annotations,
+		},
+		Spec: corev1.PodSpec{NodeName: testNode},
+		Status: corev1.PodStatus{
+			Phase: corev1.PodRunning,
+			PodIP: "10.0.0.10",
+		},
+	}
+	if _, err := tm.clientset.CoreV1().Pods(pod.Namespace).Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		tm.t.Fatalf("create pod: %v", err)
+	}
+	tm.pods.Add(pod)
+	return pod
+}
+
+// setAnnotations replaces the annotations of the Pod in the cache with
+// those the clientset has, which include the statuses written so far,
+// changed by set; an empty value removes an annotation.
+func (tm *testManager) setAnnotations(pod *corev1.Pod, set map[string]string) {
+	tm.t.Helper()
+	current := tm.apiPod(pod)
+	for k, v := range set {
+		if v == "" {
+			delete(current.Annotations, k)
+		} else {
+			current.Annotations[k] = v
+		}
+	}
+	if _, err := tm.clientset.CoreV1().Pods(pod.Namespace).Update(context.Background(), current, metav1.UpdateOptions{}); err != nil {
+		tm.t.Fatalf("update pod: %v", err)
+	}
+	tm.pods.Update(current)
+}
+
+// apiPod returns the Pod as the clientset has it.
+func (tm *testManager) apiPod(pod *corev1.Pod) *corev1.Pod {
+	tm.t.Helper()
+	p, err := tm.clientset.CoreV1().Pods(pod.Namespace).Get(context.Background(), pod.Name, metav1.GetOptions{})
+	if err != nil {
+		tm.t.Fatalf("get pod: %v", err)
+	}
+	if p.Annotations == nil {
+		p.Annotations = make(map[string]string)
+	}
+	return p
+}
+
+// sync syncs the Pod's key and fails the test on an error.
+func (tm *testManager) sync(pod *corev1.Pod) {
+	tm.t.Helper()
+	if err := tm.syncPod(pod.Namespace + "/" + pod.Name); err != nil {
+		tm.t.Fatalf("syncPod: %v", err)
+	}
+}
+
+// status returns the status the agent wrote to the Pod, once the status
+// writer has caught up.
+func (tm *testManager) status(pod *corev1.Pod) captureStatus {
+	tm.t.Helper()
+	tm.statuses.flush(5 * time.Second)
+	return annotatedStatus(tm.apiPod(pod), "")
+}
+
+// waitStatus waits for the Pod's status to reach state.
+func (tm *testManager) waitStatus(pod *corev1.Pod, state string) captureStatus {
+	tm.t.Helper()
+	var st captureStatus
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if st = tm.status(pod); st.State == state {
+			return st
+		}
+	}
+	tm.t.Fatalf("status is %q (%s), want %q", st.State, st.Message, state)
+	return st
+}
+
+// expectEvent fails the test unless an Event with reason was recorded,
+// skipping the Events before it.
+func (tm *testManager) expectEvent(eventType, reason string) string {
+	tm.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-tm.events.Events:
+			if strings.HasPrefix(e, eventType+" "+reason+" ") {
+				return e
+			}
+		case <-timeout:
+			tm.t.Fatalf("no %s %s Event was recorded", eventType, reason)
+			return ""
+		}
+	}
+}
+
+// capture returns the registered capture with key, or nil.
+func (tm *testManager) capture(key string) *CaptureProcess {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	return tm.captures[key]
+}
+
+// waitStopped waits for the stopped captures to close their files.
+func (tm *testManager) waitStopped() {
+	tm.stops.Wait()
+}
+
+func TestSyncPodStartsAnnotatedCapture(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+
+	tm.sync(pod)
+
+	started := tm.backend.Started()
+	if len(started) != 1 {
+		t.Fatalf("started %d captures, want 1", len(started))
+	}
+	if started[0].MaxFiles != 3 || started[0].PodName != "web" {
+		t.Errorf("started capture of %s with %d files, want web with 3", started[0].PodName, started[0].MaxFiles)
+	}
+	if tm.capture("default/web") == nil {
+		t.Fatal("capture is not registered")
+	}
+	if st := tm.status(pod); st.State != stateRunning || st.Node != testNode {
+		t.Errorf("status is %q on %q, want %q on %q", st.State, st.Node, stateRunning, testNode)
+	}
+	tm.expectEvent(corev1.EventTypeNormal, reasonCaptureStarted)
+}
+
+func TestSyncPodIsIdempotent(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+
+	tm.sync(pod)
+	tm.waitStatus(pod, stateRunning)
+	tm.setAnnotations(pod, nil)
+	tm.sync(pod)
+
+	if n := len(tm.backend.Started()); n != 1 {
+		t.Errorf("started %d captures, want 1", n)
+	}
+}
+
+func TestSyncPodStopsWithdrawnCapture(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+	tm.sync(pod)
+	tm.waitStatus(pod, stateRunning)
+
+	tm.setAnnotations(pod, map[string]string{annotationKey: ""})
+	tm.sync(pod)
+	tm.waitStopped()
+
+	if tm.capture("default/web") != nil {
+		t.Error("capture is still registered")
+	}
+	if n := tm.backend.Running(); n != 0 {
+		t.Errorf("%d captures still run", n)
+	}
+	tm.waitStatus(pod, stateStopped)
+	tm.expectEvent(corev1.EventTypeNormal, reasonCaptureStopped)
+}
+
+func TestSyncPodReportsInvalidFileCount(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "many"})
+
+	tm.sync(pod)
+
+	if n := len(tm.backend.Started()); n != 0 {
+		t.Errorf("started %d captures, want none", n)
+	}
+	if st := tm.status(pod); st.State != stateFailed || st.Reason != reasonCaptureFailed {
+		t.Errorf("status is %q with reason %q, want %q with %q", st.State, st.Reason, stateFailed, reasonCaptureFailed)
+	}
+	tm.expectEvent(corev1.EventTypeWarning, reasonCaptureFailed)
+}
+
+func TestSyncPodIgnoresPodsNotRunning(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+	pod.Status.Phase = corev1.PodPending
+	tm.pods.Update(pod)
+
+	tm.sync(pod)
+
+	if n := len(tm.backend.Started()); n != 0 {
+		t.Errorf("started %d captures, want none", n)
+	}
+}
+
+func TestSyncPodStopsCapturesOfTerminatedPods(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+	tm.sync(pod)
+	tm.waitStatus(pod, stateRunning)
+
+	pod = tm.apiPod(pod)
+	pod.Status.Phase = corev1.PodSucceeded
+	tm.pods.Update(pod)
+	tm.sync(pod)
+	tm.waitStopped()
+
+	if tm.capture("default/web") != nil {
+		t.Error("capture is still registered")
+	}
+	tm.waitStatus(pod, stateStopped)
+}
+
+func TestSyncPodStopsCapturesOfDeletedPods(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+	tm.sync(pod)
+	tm.waitStatus(pod, stateRunning)
+
+	tm.pods.Delete(pod)
+	tm.sync(pod)
+	tm.waitStopped()
+
+	if tm.capture("default/web") != nil {
+		t.Error("capture is still registered")
+	}
+	if n := tm.backend.Running(); n != 0 {
+		t.Errorf("%d captures still run", n)
+	}
+}
+
+// checkingBackend is a fake backend that checks filters like the tcpdump
+// backend does, and notes whether m.mu was held while it did.
+type checkingBackend struct {
+	*fakeBackend
+	m *CaptureManager
+
+	mu      sync.Mutex
+	checked []string
+	locked  bool
+}
+
+func (b *checkingBackend) CheckFilter(spec captureSpec) error {
+	// m.mu is held if it cannot be taken while the check runs.
+	free := make(chan struct{})
+	go func() {
+		b.m.mu.Lock()
+		b.m.mu.Unlock()
+		close(free)
+	}()
+	select {
+	case <-free:
+	case <-time.After(time.Second):
+		b.mu.Lock()
+		b.locked = true
+		b.mu.Unlock()
+	}
+	b.mu.Lock()
+	b.checked = append(b.checked, spec.Filter)
+	b.mu.Unlock()
+	if strings.Contains(spec.Filter, "bogus") {
+		return errors.New("syntax error")
+	}
+	return nil
+}
+
+func TestSyncPodChecksFilterOutsideLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  string
+		wantErr string
+	}{
+		{"valid", "tcp port 80", ""},
+		{"invalid", "bogus", `invalid filter "bogus": syntax error`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManager(t)
+			s, err := parseSettings(map[string]string{settingDefaultFilter: tt.filter}, tm.cfg.defaultSettings())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tm.currentSettings.Store(s)
+			b := &checkingBackend{fakeBackend: tm.backend, m: tm.CaptureManager}
+			tm.backends[backendFake] = b
+			pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+
+			tm.sync(pod)
+
+			started := len(tm.backend.Started())
+			if st := tm.status(pod); tt.wantErr != "" && (started != 0 || st.State != stateFailed || !strings.Contains(st.Message, tt.wantErr)) {
+				t.Errorf("started %d captures with status %q (%s), want none and %q with %q", started, st.State, st.Message, stateFailed, tt.wantErr)
+			}
+			if tt.wantErr == "" && started != 1 {
+				t.Errorf("started %d captures, want one", started)
+			}
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if len(b.checked) != 1 || b.checked[0] != tt.filter {
+				t.Errorf("checked filters %q, want %q once", b.checked, tt.filter)
+			}
+			if b.locked {
+				t.Error("the filter was checked under m.mu")
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// captureCost is what a capture run cost the node so far: the CPU time and
+// memory of its capture process and of the agent threads copying its
+// packets, and the bytes it wrote to its files. It is reported in the
+// status annotation and the metrics, so the backends can be compared on the
+// same traffic before captures are enabled broadly.
+type captureCost struct {
+	CPUSeconds float64 `json:"cpuSeconds"`
+	// MemoryBytes is the resident memory of the capture process and the
+	// receive buffers of the packet sockets the agent reads.
+	MemoryBytes  int64  `json:"memoryBytes"`
+	WrittenBytes uint64 `json:"writtenBytes"`
+}
+
+// add adds the cost of another capture of the same run, such as another
+// interface.
+func (c *captureCost) add(o captureCost) {
+	c.CPUSeconds += o.CPUSeconds
+	c.MemoryBytes += o.MemoryBytes
+	c.WrittenBytes += o.WrittenBytes
+}
+
+// processUsage is the CPU time and resident memory of a process.
+type processUsage struct {
+	cpu time.Duration
+	rss int64
+}
+
+// costMeter accounts the agent threads that work for a capture and the
+// capture process. The agent runs the loops of a capture each on a thread
+// of its own, whose CPU time is then the capture's alone; the Go scheduler
+// would otherwise spread them over threads shared with everything else.
+type costMeter struct {
+	mu sync.Mutex
+	// threads maps the threads of running loops to their CPU time when
+	// the loop started, and ended adds up the time of finished loops.
+	threads map[int]time.Duration
+	ended   time.Duration
+	// process is the last usage read of the capture process, with the CPU
+	// time it exited with once it did.
+	process processUsage
+	// buffers are the socket buffers the capture reads from.
+	buffers atomic.Int64
+}
+
+// track runs the calling goroutine's capture loop on a thread of its own
+// and accounts its CPU time until the returned function is called, when the
+// loop ends. The thread exits with the goroutine, so the time it spends on
+// anything else later is not counted.
+func (c *costMeter) track() func() {
+	if !threadAccounting {
+		return func() {}
+	}
+	runtime.LockOSThread()
+	tid := threadID()
+	c.mu.Lock()
+	if c.threads == nil {
+		c.threads = make(map[int]time.Duration)
+	}
+	c.threads[tid] = threadCPU(tid)
+	c.mu.Unlock()
+	return func() {
+		used := threadCPU(tid)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.ended += max(used-c.threads[tid], 0)
+		delete(c.threads, tid)
+	}
+}
+
+// cost reads the usage of the tracked threads and of the capture process
+// pid, if it has one.
+func (c *costMeter) cost(pid int) captureCost {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cpu := c.ended
+	for tid, start := range c.threads {
+		cpu += max(threadCPU(tid)-start, 0)
+	}
+	if pid > 0 {
+		if u, ok := readProcessUsage(pid); ok {
+			c.process = u
+		}
+	}
+	return captureCost{
+		CPUSeconds:  (cpu + c.process.cpu).Seconds(),
+		MemoryBytes: c.process.rss + c.buffers.Load(),
+	}
+}
+
+// exited records the CPU time the capture process exited with. Its memory
+// stays as last read: the peak the kernel reports for a child includes what
+// it shared with the agent before it ran the capture program.
+func (c *costMeter) exited(cpu time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.process.cpu = cpu
+}
+
+// cost returns the cost of the capture whose packets s counts, with the
+// capture process pid, or 0 for in-process captures.
+func (s *packetStats) cost(pid int) captureCost {
+	c := s.meter.cost(pid)
+	c.WrittenBytes = s.written.Load()
+	return c
+}
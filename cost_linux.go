@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// threadAccounting is set where the CPU time of single threads can be read.
+const threadAccounting = true
+
+// clockTick is the unit of the CPU times in /proc, USER_HZ, which is 100 on
+// every architecture.
+const clockTick = 10 * time.Millisecond
+
+func threadID() int { return unix.Gettid() }
+
+// threadCPU returns the CPU time of thread tid of the agent, or 0 once it
+// exited.
+func threadCPU(tid int) time.Duration {
+	u, _ := readStat(fmt.Sprintf("/proc/self/task/%d/stat", tid))
+	return u.cpu
+}
+
+// readProcessUsage reads the usage of process pid, reporting false once it
+// exited, even before it is reaped.
+func readProcessUsage(pid int) (processUsage, bool) {
+	return readStat(fmt.Sprintf("/proc/%d/stat", pid))
+}
+
+// readStat reads the CPU time and resident memory from a /proc stat file.
+func readStat(path string) (processUsage, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return processUsage{}, false
+	}
+	// The command name in parentheses may contain spaces.
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return processUsage{}, false
+	}
+	// Fields are numbered from the state, the third in proc(5).
+	fields := bytes.Fields(data[i+1:])
+	if len(fields) < 22 || string(fields[0]) == "Z" {
+		// A zombie has given up its memory.
+		return processUsage{}, false
+	}
+	utime, _ := strconv.ParseInt(string(fields[11]), 10, 64)
+	stime, _ := strconv.ParseInt(string(fields[12]), 10, 64)
+	rss, _ := strconv.ParseInt(string(fields[21]), 10, 64)
+	return processUsage{
+		cpu: time.Duration(utime+stime) * clockTick,
+		rss: rss * int64(os.Getpagesize()),
+	}, true
+}
+
+// waitExited blocks until process pid exited, leaving it to be reaped.
+func waitExited(pid int) {
+	var info unix.Siginfo
+	for {
+		err := unix.Waitid(unix.P_PID, pid, &info, unix.WEXITED|unix.WNOWAIT, nil)
+		if !errors.Is(err, unix.EINTR) {
+			return
+		}
+	}
+}
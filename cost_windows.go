@@ -0,0 +1,47 @@
+package main
+
+import (
+	"time"
+
+	"golang.org/x/sys/windows"
+)
+
+// threadAccounting is unset: the CPU time of the agent threads copying
+// packets is not read on Windows, leaving the capture process's.
+const threadAccounting = false
+
+func threadID() int { return 0 }
+
+func threadCPU(tid int) time.Duration { return 0 }
+
+// readProcessUsage reads the CPU time of process pid, reporting false once
+// its handle cannot be opened. Its memory is not read.
+func readProcessUsage(pid int) (processUsage, bool) {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return processUsage{}, false
+	}
+	defer windows.CloseHandle(h)
+	var creation, exit, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &creation, &exit, &kernel, &user); err != nil {
+		return processUsage{}, false
+	}
+	return processUsage{cpu: filetimeDuration(kernel) + filetimeDuration(user)}, true
+}
+
+// filetimeDuration converts a Filetime holding a duration, which counts
+// 100ns intervals, unlike Nanoseconds, which expects a point in time.
+func filetimeDuration(ft windows.Filetime) time.Duration {
+	return time.Duration(int64(ft.HighDateTime)<<32|int64(ft.LowDateTime)) * 100
+}
+
+// waitExited blocks until process pid exited. The handle exec keeps open
+// until the process is reaped keeps its PID from being reused meanwhile.
+func waitExited(pid int) {
+	h, err := windows.OpenProcess(windows.SYNCHRONIZE, false, uint32(pid))
+	if err != nil {
+		return
+	}
+	defer windows.CloseHandle(h)
+	windows.WaitForSingleObject(h, windows.INFINITE)
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// encryptSuffix is appended to the name of an encrypted file, after the
+// compression extension.
+const encryptSuffix = ".enc"
+
+// Encrypted files start with a header of encryptMagic, the key ID and a
+// random nonce prefix. The data follows in chunks of up to encryptChunk
+// bytes, each sealed with AES-256-GCM under a nonce of the prefix, the
+// chunk number and a flag marking the last chunk, so chunks cannot be
+// reordered and a truncated file does not decrypt. The header is the
+// additional data of every chunk.
+const (
+	encryptMagic       = "PCAPENC1"
+	encryptKeyIDSize   = 8
+	encryptPrefixSize  = 7
+	encryptHeaderSize  = len(encryptMagic) + encryptKeyIDSize + encryptPrefixSize
+	encryptChunk       = 64 << 10
+	encryptOverhead    = 16
+	encryptKeySize     = 32
+	encryptNonceLength = 12
+)
+
+// fileKey is the AES-256 key capture files are encrypted with at rest.
+type fileKey struct {
+	aead cipher.AEAD
+	// id names the key in file headers, so a file encrypted with another
+	// key is told apart from a corrupt one.
+	id [encryptKeyIDSize]byte
+}
+
+// loadFileKey reads the key at path, 32 bytes in base64 as `openssl rand
+// -base64 32` writes them. It returns nil if path is empty, or if the file
+// does not exist and optional is set because the key comes from an
+// optional Secret. A missing file is an error otherwise, so an agent told
+// to encrypt does not silently write captures in the clear.
+func loadFileKey(path string, optional bool) (*fileKey, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) && optional {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read encryption key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != encryptKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes in base64", encryptKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	k := &fileKey{aead: aead}
+	sum := sha256.Sum256(key)
+	copy(k.id[:], sum[:])
+	return k, nil
+}
+
+// extension is the suffix files encrypted with k get, "" without a key.
+func (k *fileKey) extension() string {
+	if k == nil {
+		return ""
+	}
+	return encryptSuffix
+}
+
+// ID returns the key ID recorded in file headers.
+func (k *fileKey) ID() string {
+	return hex.EncodeToString(k.id[:])
+}
+
+// encryptWriter encrypts what is written to it in chunks. Close seals the
+// last chunk; without it the file does not decrypt.
+type encryptWriter struct {
+	key    *fileKey
+	w      io.Writer
+	header []byte
+	buf    []byte
+	n      uint32
+}
+
+// newWriter writes the header to w and returns a writer encrypting to it.
+func (k *fileKey) newWriter(w io.Writer) (*encryptWriter, error) {
+	header := make([]byte, 0, encryptHeaderSize)
+	header = append(header, encryptMagic...)
+	header = append(header, k.id[:]...)
+	prefix := make([]byte, encryptPrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{key: k, w: w, header: header, buf: make([]byte, 0, encryptChunk)}, nil
+}
+
+func (e *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data follows, so the
+		// last one is known when it is sealed.
+		if len(e.buf) == encryptChunk {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptChunk], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (e *encryptWriter) Close() error {
+	return e.seal(true)
+}
+
+func (e *encryptWriter) seal(last bool) error {
+	sealed := e.key.aead.Seal(nil, chunkNonce(e.header, e.n, last), e.buf, e.header)
+	e.n++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(sealed)
+	return err
+}
+
+// chunkNonce is the nonce of chunk n of the file with header.
+func chunkNonce(header []byte, n uint32, last bool) []byte {
+	nonce := make([]byte, encryptNonceLength)
+	copy(nonce, header[encryptHeaderSize-encryptPrefixSize:])
+	binary.BigEndian.PutUint32(nonce[encryptPrefixSize:], n)
+	if last {
+		nonce[encryptNonceLength-1] = 1
+	}
+	return nonce
+}
+
+// decryptReader reads the plain data of an encrypted file.
+type decryptReader struct {
+	key    *fileKey
+	r      *bufio.Reader
+	header []byte
+	chunk  []byte
+	buf    []byte
+	n      uint32
+	done   bool
+}
+
+// newReader reads the header from r and returns a reader decrypting it.
+func (k *fileKey) newReader(r io.Reader) (*decryptReader, error) {
+	header := make([]byte, encryptHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("not an encrypted capture file: %w", err)
+	}
+	if string(header[:len(encryptMagic)]) != encryptMagic {
+		return nil, errors.New("not an encrypted capture file")
+	}
+	if id := header[len(encryptMagic) : len(encryptMagic)+encryptKeyIDSize]; !bytes.Equal(id, k.id[:]) {
+		return nil, fmt.Errorf("file was encrypted with key %x, not with key %s", id, k.ID())
+	}
+	return &decryptReader{key: k, r: bufio.NewReaderSize(r, encryptChunk+encryptOverhead+1), header: header, chunk: make([]byte, encryptChunk+encryptOverhead)}, nil
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if err := d.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk. It is the last one if nothing follows.
+func (d *decryptReader) open() error {
+	n, err := io.ReadFull(d.r, d.chunk)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+		if errors.Is(err, io.EOF) {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	last := n < len(d.chunk)
+	if !last {
+		if _, err := d.r.Peek(1); errors.Is(err, io.EOF) {
+			last = true
+		}
+	}
+	plain, err := d.key.aead.Open(d.chunk[:0], chunkNonce(d.header, d.n, last), d.chunk[:n], d.header)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt chunk %d: file is corrupt or truncated", d.n)
+	}
+	d.n++
+	d.buf, d.done = plain, last
+	return nil
+}
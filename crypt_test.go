@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeKey writes a random key to a file and loads it.
+func writeKey(t *testing.T) (*fileKey, string) {
+	t.Helper()
+	raw := make([]byte, encryptKeySize)
+	rand.Read(raw)
+	path := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(raw)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := loadFileKey(path, false)
+	if err != nil {
+		t.Fatalf("loadFileKey: %v", err)
+	}
+	return key, path
+}
+
+// encrypt returns plain encrypted with key.
+func encrypt(t *testing.T, key *fileKey, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := key.newWriter(&buf)
+	if err != nil {
+		t.Fatalf("newWriter: %v", err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// decrypt returns what decrypting data with key reads.
+func decrypt(key *fileKey, data []byte) ([]byte, error) {
+	r, err := key.newReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+func TestLoadFileKey(t *testing.T) {
+	_, valid := writeKey(t)
+	dir := t.TempDir()
+	missing := filepath.Join(dir, "missing")
+	short := filepath.Join(dir, "short")
+	os.WriteFile(short, []byte(base64.StdEncoding.EncodeToString([]byte("too short"))), 0o600)
+	tests := []struct {
+		name     string
+		path     string
+		optional bool
+		wantKey  bool
+		wantErr  string
+	}{
+		{name: "disabled", path: ""},
+		{name: "valid", path: valid, wantKey: true},
+		{name: "missing", path: missing, wantErr: "cannot read encryption key"},
+		{name: "missing optional", path: missing, optional: true},
+		{name: "invalid optional", path: short, optional: true, wantErr: "must be 32 bytes"},
+		{name: "invalid", path: short, wantErr: "must be 32 bytes"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := loadFileKey(tt.path, tt.optional)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("loadFileKey: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("loadFileKey: %v, want %q", err, tt.wantErr)
+			}
+			if (key != nil) != tt.wantKey {
+				t.Errorf("loadFileKey returned key %v, want one: %v", key, tt.wantKey)
+			}
+		})
+	}
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	key, _ := writeKey(t)
+	for _, size := range []int{0, 1, encryptChunk - 1, encryptChunk, encryptChunk + 1, 3*encryptChunk + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		got, err := decrypt(key, encrypt(t, key, plain))
+		if err != nil {
+			t.Fatalf("%d bytes: decrypt: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: decrypted %d bytes that differ from the plain data", size, len(got))
+		}
+	}
+}
+
+func TestDecryptRejectsTampering(t *testing.T) {
+	key, _ := writeKey(t)
+	other, _ := writeKey(t)
+	plain := make([]byte, 3*encryptChunk+17)
+	rand.Read(plain)
+	data := encrypt(t, key, plain)
+	sealed := encryptChunk + encryptOverhead
+	chunk := func(n int) []byte {
+		return data[encryptHeaderSize+n*sealed : min(encryptHeaderSize+(n+1)*sealed, len(data))]
+	}
+	join := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+	header := data[:encryptHeaderSize]
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)/2] ^= 1
+	otherHeader := bytes.Clone(data)
+	otherHeader[encryptHeaderSize-1] ^= 1
+
+	tests := []struct {
+		name    string
+		key     *fileKey
+		data    []byte
+		wantErr string
+	}{
+		{"truncated at a chunk boundary", key, join(header, chunk(0), chunk(1)), "corrupt or truncated"},
+		{"truncated inside a chunk", key, data[:len(data)-5], "corrupt or truncated"},
+		{"last chunk dropped", key, join(header, chunk(0), chunk(1), chunk(2)), "corrupt or truncated"},
+		{"chunks reordered", key, join(header, chunk(1), chunk(0), chunk(2), chunk(3)), "corrupt or truncated"},
+		{"chunk repeated", key, join(header, chunk(0), chunk(0), chunk(2), chunk(3)), "corrupt or truncated"},
+		{"bit flipped", key, flipped, "corrupt or truncated"},
+		{"nonce prefix changed", key, otherHeader, "corrupt or truncated"},
+		{"header only", key, header, "unexpected EOF"},
+		{"not encrypted", key, plain, "not an encrypted capture file"},
+		{"other key", other, data, "encrypted with key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decrypt(tt.key, tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("decrypt: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
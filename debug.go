@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+const (
+	// blockProfileRate samples one blocking event per this many
+	// nanoseconds spent blocked, mutexProfileFraction one in this many
+	// contended mutexes, so the block and mutex profiles have data.
+	blockProfileRate     = int(time.Millisecond)
+	mutexProfileFraction = 100
+)
+
+// profilingHandler serves the pprof profiles under /debug/pprof/. It turns
+// on block and mutex profiling, which cost a little on every capture, so it
+// is only set up with --profiling.
+func profilingHandler() http.Handler {
+	runtime.SetBlockProfileRate(blockProfileRate)
+	runtime.SetMutexProfileFraction(mutexProfileFraction)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// runtimeInfo is the answer of /debug/runtime.
+type runtimeInfo struct {
+	GoVersion  string `json:"goVersion"`
+	GOMAXPROCS int    `json:"gomaxprocs"`
+	Goroutines int    `json:"goroutines"`
+	// HeapAlloc and HeapInuse are bytes of live objects and of the spans
+	// holding them, Sys all memory obtained from the OS.
+	HeapAlloc uint64 `json:"heapAlloc"`
+	HeapInuse uint64 `json:"heapInuse"`
+	Sys       uint64 `json:"sys"`
+	NumGC     uint32 `json:"numGC"`
+	// GCPauseTotal is the time the garbage collector stopped the agent.
+	GCPauseTotal time.Duration `json:"gcPauseTotalNs"`
+	Captures     int           `json:"captures"`
+}
+
+// handleRuntime returns the goroutine count and memory statistics of the
+// agent next to the number of captures it runs, for a first look before
+// taking profiles.
+func (m *CaptureManager) handleRuntime(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	m.mu.Lock()
+	captures := len(m.captures)
+	m.mu.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(runtimeInfo{
+		GoVersion:    runtime.Version(),
+		GOMAXPROCS:   runtime.GOMAXPROCS(0),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    ms.HeapAlloc,
+		HeapInuse:    ms.HeapInuse,
+		Sys:          ms.Sys,
+		NumGC:        ms.NumGC,
+		GCPauseTotal: time.Duration(ms.PauseTotalNs),
+		Captures:     captures,
+	})
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// decodeAnnotationKey asks for every finished file to be decoded with
+// tshark into JSON next to it: "all" decodes every protocol, a comma
+// separated list such as "dns,http" only the packets and layers of those.
+const decodeAnnotationKey = "decode." + annotationKey
+
+const (
+	decodeAll    = "all"
+	decodeSuffix = ".json"
+	// decodeTimeout bounds tshark's run on a single file.
+	decodeTimeout = 2 * time.Minute
+)
+
+// protocolName matches Wireshark protocol filter names.
+var protocolName = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// decoder decodes finished files of a capture with tshark.
+type decoder struct {
+	// protocols limits the decode; nil decodes everything.
+	protocols []string
+	// tshark is set from --tshark-path when the capture starts.
+	tshark string
+}
+
+func parseDecode(v string) (*decoder, error) {
+	if strings.TrimSpace(v) == decodeAll {
+		return &decoder{}, nil
+	}
+	d := &decoder{}
+	for _, p := range strings.Split(v, ",") {
+		p = strings.ToLower(strings.TrimSpace(p))
+		if p == "" {
+			continue
+		}
+		if !protocolName.MatchString(p) {
+			return nil, fmt.Errorf("invalid protocol %q", p)
+		}
+		d.protocols = append(d.protocols, p)
+	}
+	if len(d.protocols) == 0 {
+		return nil, fmt.Errorf("no protocol given")
+	}
+	return d, nil
+}
+
+// decode writes the packets of src decoded as JSON to dst, through a
+// temporary file so a partial dst is never visible. Names are not
+// resolved, so decoding does not wait on DNS.
+func (d *decoder) decode(src, dst string) error {
+	args := []string{"-n", "-r", src, "-T", "json"}
+	if len(d.protocols) > 0 {
+		args = append(args, "-Y", strings.Join(d.protocols, " or "), "-J", strings.Join(d.protocols, " "))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), decodeTimeout)
+	defer cancel()
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	cmd := exec.CommandContext(ctx, d.tshark, args...)
+	cmd.Stdout = out
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("tshark: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return os.Rename(tmp, dst)
+}
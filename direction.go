@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// directionAnnotationKey limits a capture to the traffic in one direction.
+const directionAnnotationKey = "direction." + annotationKey
+
+// Capture directions. Both, the default, is stored as "".
+const (
+	directionIngress = "ingress"
+	directionEgress  = "egress"
+	directionBoth    = "both"
+)
+
+// parseDirection parses the direction annotation.
+func parseDirection(v string) (string, error) {
+	switch d := strings.TrimSpace(v); d {
+	case directionIngress, directionEgress:
+		return d, nil
+	case directionBoth:
+		return "", nil
+	}
+	return "", fmt.Errorf("unknown direction %q, want %s, %s or %s", v, directionIngress, directionEgress, directionBoth)
+}
+
+// interfaceDirection returns the packets of spec's direction as the
+// interface sees them, in tcpdump -Q terms: "in" for the packets it
+// receives, "out" for those it sends, "" for both. Ingress is the traffic
+// into what is captured, so on the host side of the Pod's veth, podPort,
+// the Pod's ingress is what the interface sends.
+func (s captureSpec) interfaceDirection(podPort bool) string {
+	if s.Direction == "" {
+		return ""
+	}
+	if (s.Direction == directionIngress) != podPort {
+		return "in"
+	}
+	return "out"
+}
+
+// checkDirection returns why backend cannot capture spec in a single
+// direction, or nil.
+func checkDirection(backend CaptureBackend, spec captureSpec) error {
+	switch {
+	case spec.Direction == "":
+		return nil
+	case spec.PodLoopback:
+		return errors.New("a direction does not apply to loopback captures, where the Pod only talks to itself")
+	case backend.Name() == backendPktmon:
+		return errors.New("the pktmon backend cannot capture a single direction")
+	}
+	return nil
+}
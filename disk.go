@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const bytesPerMB = 1000 * 1000
+
+// Event reasons for captures refused by the disk checks.
+const (
+	reasonInsufficientDisk  = "InsufficientDiskSpace"
+	reasonDiskQuotaExceeded = "DiskQuotaExceeded"
+)
+
+// captureBudget is the most disk a capture can use: tcpdump keeps at most
+// maxFiles files of rotateMB each.
+func captureBudget(maxFiles, rotateMB int) int64 {
+	return int64(maxFiles) * int64(rotateMB) * bytesPerMB
+}
+
+// budget is the capture budget of spec, which a capture of several
+// interfaces needs once per interface.
+func (s captureSpec) budget() int64 {
+	return captureBudget(s.MaxFiles, s.RotateMB) * int64(max(len(s.Interfaces), 1))
+}
+
+// diskFree returns the bytes available to unprivileged writers on the
+// filesystem holding dir.
+func diskFree(dir string) (int64, error) {
+	_, free, err := diskStats(dir)
+	return free, err
+}
+
+// nodeUsage returns the bytes the capture directory is committed to: the
+// full budget of every running or stopping capture, the node capture
+// included, plus the size of retained files that none of them owns and of
+// snapshots.
+// Callers must hold m.mu.
+func (m *CaptureManager) nodeUsage() int64 {
+	used := m.snapshotUsage()
+	for _, cap := range m.fileOwners() {
+		used += cap.spec.budget()
+	}
+	matches, _ := m.listCaptureFiles()
+	nodeFiles, _ := filepath.Glob(m.nodePcapPath() + "*")
+	for _, f := range append(matches, nodeFiles...) {
+		if m.isActiveFile(f) {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			used += info.Size()
+		}
+	}
+	return used
+}
+
+// checkDisk verifies that a capture needing budget bytes fits both on the
+// filesystem holding dir and within the node quota. It returns the Event
+// reason and a message when the capture must be refused. Callers must hold
+// m.mu.
+func (m *CaptureManager) checkDisk(dir string, budget int64, quotaMB int) (string, string) {
+	free, err := diskFree(dir)
+	if err != nil {
+		return reasonInsufficientDisk, fmt.Sprintf("Cannot determine free space in %s: %v", dir, err)
+	}
+	if budget > free {
+		return reasonInsufficientDisk, fmt.Sprintf("Capture needs up to %d MB but only %d MB are free in %s",
+			budget/bytesPerMB, free/bytesPerMB, dir)
+	}
+	if quotaMB > 0 {
+		quota := int64(quotaMB) * bytesPerMB
+		if used := m.nodeUsage(); used+budget > quota {
+			return reasonDiskQuotaExceeded, fmt.Sprintf("Capture needs up to %d MB but only %d MB of the %d MB node quota remain",
+				budget/bytesPerMB, max(quota-used, 0)/bytesPerMB, quotaMB)
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// diskStats returns the size of the filesystem holding dir and the bytes
+// available to unprivileged writers.
+func diskStats(dir string) (total, free int64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, 0, err
+	}
+	return int64(st.Blocks) * int64(st.Bsize), int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// isMountPoint reports whether a filesystem is mounted at dir: it lives on
+// another device than its parent, or is the root.
+func isMountPoint(dir string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(dir, &st); err != nil {
+		return false, err
+	}
+	if err := syscall.Stat(filepath.Dir(dir), &parent); err != nil {
+		return false, err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return false, &os.PathError{Op: "stat", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino, nil
+}
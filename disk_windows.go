@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// diskStats returns the size of the volume holding dir and the bytes
+// available to the agent's user.
+func diskStats(dir string) (total, free int64, err error) {
+	path, err := windows.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	var avail, size, totalFree uint64
+	if err := windows.GetDiskFreeSpaceEx(path, &avail, &size, &totalFree); err != nil {
+		return 0, 0, err
+	}
+	return int64(size), int64(avail), nil
+}
+
+// isMountPoint reports whether dir exists as a directory. Windows
+// containers see their volumes as plain directories, so whether one is
+// mounted there cannot be told apart.
+func isMountPoint(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return false, err
+	}
+	return info.IsDir(), nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dropsAnnotationKey chooses what the agent does once the kernel drops more
+// of a capture's packets than --drop-alert-percent: alert, or tighten the
+// capture as well.
+const dropsAnnotationKey = "drops." + annotationKey
+
+// Drop actions.
+const (
+	dropsAlert   = "alert"
+	dropsTighten = "tighten"
+)
+
+const reasonCaptureDropping = "CaptureDropping"
+
+// dropAlertMinPackets keeps the drops of the first moments of a capture,
+// while the rates are still settling, from raising the alert.
+const dropAlertMinPackets = 1000
+
+// parseDrops parses the drop action.
+func parseDrops(v string) (string, error) {
+	switch action := strings.TrimSpace(v); action {
+	case dropsAlert, dropsTighten:
+		return action, nil
+	}
+	return "", fmt.Errorf("unknown drop action %q, want %s or %s", v, dropsAlert, dropsTighten)
+}
+
+// dropPercent returns the share of the packets the kernel had for the
+// capture that it dropped. Received counts the dropped packets as well, on
+// the backends that report drops.
+func (s captureStats) dropPercent() float64 {
+	received := max(s.Received, s.Dropped)
+	if received == 0 {
+		return 0
+	}
+	return float64(s.Dropped) * 100 / float64(received)
+}
+
+// tightened returns spec keeping only the headers of each packet, which the
+// capture copies and writes far faster, and false if it keeps no more
+// already. The filter is left alone: the agent cannot tell which of the
+// traffic it matches the capture is for.
+func (s captureSpec) tightened() (captureSpec, bool) {
+	if s.Snaplen > 0 && s.Snaplen <= headersSnaplen {
+		return s, false
+	}
+	s.Mode, s.Snaplen = captureModeHeaders, headersSnaplen
+	return s, true
+}
+
+// watchDropRate raises the drop alert of cap once the kernel dropped more
+// than --drop-alert-percent of its packets since it started. The alert is
+// raised once per run of the capture.
+func (m *CaptureManager) watchDropRate(ctx context.Context, key string, cap *CaptureProcess) {
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stats := cap.proc.Stats()
+		if stats.Received < dropAlertMinPackets || stats.dropPercent() <= m.cfg.DropAlertPercent {
+			continue
+		}
+		m.dropAlert(key, cap, stats)
+		return
+	}
+}
+
+// dropAlert records that cap is missing the packets of stats, and restarts
+// it with a tightened spec if its drop action says so.
+func (m *CaptureManager) dropAlert(key string, cap *CaptureProcess, stats captureStats) {
+	percent := stats.dropPercent()
+	cap.log.Warn("Capture dropping packets", "dropped", stats.Dropped, "received", stats.Received, "percent", percent, "threshold", m.cfg.DropAlertPercent)
+	dropAlerts.Inc()
+	msg := fmt.Sprintf("The kernel dropped %d of %d packets (%.1f%%), more than %g%%, so the files are missing packets",
+		stats.Dropped, stats.Received, percent, m.cfg.DropAlertPercent)
+	if cap.spec.Drops != dropsTighten {
+		m.recorder.Event(cap.ref, corev1.EventTypeWarning, reasonCaptureDropping, sessionEvent(cap.spec, msg))
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.captures[key] != cap || cap.completed.Load() {
+		return
+	}
+	spec, ok := cap.spec.tightened()
+	if !ok {
+		m.recorder.Event(cap.ref, corev1.EventTypeWarning, reasonCaptureDropping, sessionEvent(cap.spec,
+			fmt.Sprintf("%s; it keeps only %d bytes of each packet already, so there is nothing left to tighten", msg, cap.spec.Snaplen)))
+		return
+	}
+	m.recorder.Event(cap.ref, corev1.EventTypeWarning, reasonCaptureDropping, sessionEvent(cap.spec,
+		fmt.Sprintf("%s; restarting it keeping only the first %d bytes of each packet", msg, spec.Snaplen)))
+	if err := m.tightenCapture(key, cap, spec); err != nil {
+		cap.log.Error("Cannot restart the tightened capture", "err", err)
+	}
+}
+
+// tightenCapture replaces cap with a capture of spec in the same session,
+// the way restartCapture replaces one that exited. Should the new capture
+// fail to start, cap is restarted as it was. Callers must hold m.mu.
+func (m *CaptureManager) tightenCapture(key string, cap *CaptureProcess, spec captureSpec) error {
+	cap.cancel()
+	select {
+	case <-cap.done:
+	case <-time.After(captureStopTimeout):
+		cap.log.Warn("Capture did not stop in time", "timeout", captureStopTimeout)
+	}
+	next := &CaptureProcess{
+		backend:   cap.backend,
+		spec:      spec,
+		files:     cap.files,
+		ref:       cap.ref,
+		sessionID: cap.sessionID,
+		log:       cap.log,
+		restarts:  cap.restarts,
+		retention: cap.retention,
+	}
+	next.log.Info("Restarting capture with a tightened spec", "snaplen", spec.Snaplen)
+	if err := m.launch(key, next); err != nil {
+		cap.exitTime = time.Now()
+		cap.exited.Store(true)
+		m.queue.Add(key)
+		return err
+	}
+	m.patchStatus(next.ref, m.status(next))
+	return nil
+}
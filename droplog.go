@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// dropLogPollInterval is how often the audit log is checked for new lines.
+const dropLogPollInterval = time.Second
+
+// dropWatcher counts the policy drops of each Pod on the node over a
+// sliding window, so a short capture starts when they reach the threshold.
+type dropWatcher struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	mu   sync.Mutex
+	seen map[string][]time.Time
+}
+
+func newDropWatcher(cfg *Config) *dropWatcher {
+	if cfg.NPLogPath == "" {
+		return nil
+	}
+	return &dropWatcher{
+		threshold: cfg.DropThreshold,
+		window:    cfg.DropWindow,
+		duration:  cfg.DropCaptureDuration,
+		seen:      make(map[string][]time.Time),
+	}
+}
+
+// record counts a drop of pod's traffic at now. It returns the number of
+// drops within the window once they reach the threshold, and starts
+// counting over.
+func (w *dropWatcher) record(pod *corev1.Pod, now time.Time) int {
+	key := pod.Namespace + "/" + pod.Name
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	times := w.seen[key]
+	for len(times) > 0 && now.Sub(times[0]) >= w.window {
+		times = times[1:]
+	}
+	times = append(times, now)
+	if len(times) < w.threshold {
+		w.seen[key] = times
+		return 0
+	}
+	delete(w.seen, key)
+	return len(times)
+}
+
+// watchDrops follows Antrea's NetworkPolicy audit log and counts the drops
+// and rejects of traffic from or to Pods on this node. It returns when ctx
+// is done.
+func (m *CaptureManager) watchDrops(ctx context.Context) {
+	slog.Info("Watching NetworkPolicy audit log", "path", m.cfg.NPLogPath,
+		"threshold", m.drops.threshold, "window", m.drops.window, "duration", m.drops.duration)
+	err := tailFile(ctx, m.cfg.NPLogPath, func(line string) {
+		policy, ips, ok := parseDropLine(line)
+		if !ok {
+			return
+		}
+		for _, pod := range m.podsWithIPs(ips) {
+			if n := m.drops.record(pod, time.Now()); n > 0 {
+				slog.Info("NetworkPolicy drops reached the threshold", "namespace", pod.Namespace, "pod", pod.Name,
+					"policy", policy, "drops", n, "window", m.drops.window)
+				m.triggerCapture(pod, reasonPolicyDrops, fmt.Sprintf("%d packets dropped by %s within %s", n, policy, m.drops.window), m.drops.duration)
+			}
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		slog.Error("Stopped watching NetworkPolicy audit log", "path", m.cfg.NPLogPath, "err", err)
+	}
+}
+
+// podsWithIPs returns the Pods on this node that have one of ips.
+func (m *CaptureManager) podsWithIPs(ips []string) []*corev1.Pod {
+	pods, err := m.podLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	var found []*corev1.Pod
+	for _, pod := range pods {
+		if pod.Spec.HostNetwork {
+			continue
+		}
+	match:
+		for _, podIP := range podIPs(pod) {
+			for _, ip := range ips {
+				if ip == podIP {
+					found = append(found, pod)
+					break match
+				}
+			}
+		}
+	}
+	return found
+}
+
+// parseDropLine parses a line of Antrea's NetworkPolicy audit log, such as
+//
+//	2024/05/02 10:41:07.522196 IngressDefaultRule K8sNetworkPolicy:shop/db Drop -1 <nil> 10.10.1.7 47204 10.10.1.6 5432 TCP 60
+//
+// and returns the policy and the source and destination IPs of drops and
+// rejects. The fields between the disposition and the addresses differ
+// between Antrea versions, so the first two addresses after it are used.
+func parseDropLine(line string) (policy string, ips []string, ok bool) {
+	fields := strings.Fields(line)
+	for i, f := range fields {
+		if f != "Drop" && f != "Reject" {
+			continue
+		}
+		if i > 0 {
+			policy = fields[i-1]
+		}
+		for _, g := range fields[i+1:] {
+			// IPv6 addresses are compared with the Pod IPs in their
+			// canonical form.
+			if ip := net.ParseIP(g); ip != nil {
+				ips = append(ips, ip.String())
+				if len(ips) == 2 {
+					return policy, ips, true
+				}
+			}
+		}
+		return "", nil, false
+	}
+	return "", nil, false
+}
+
+// tailFile calls fn for every line appended to path, starting at its
+// current end, until ctx is done. It follows the file when it is rotated
+// or truncated, and waits for it to appear.
+func tailFile(ctx context.Context, path string, fn func(string)) error {
+	var (
+		f      *os.File
+		r      *bufio.Reader
+		offset int64
+	)
+	defer func() {
+		if f != nil {
+			f.Close()
+		}
+	}()
+	open := func(atEnd bool) error {
+		nf, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		if f != nil {
+			f.Close()
+		}
+		f, offset = nf, 0
+		if atEnd {
+			if offset, err = f.Seek(0, io.SeekEnd); err != nil {
+				return err
+			}
+		}
+		r = bufio.NewReader(f)
+		return nil
+	}
+	if err := open(true); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	ticker := time.NewTicker(dropLogPollInterval)
+	defer ticker.Stop()
+	var partial string
+	for {
+		if f != nil {
+			for {
+				line, err := r.ReadString('\n')
+				offset += int64(len(line))
+				if err != nil {
+					partial += line
+					break
+				}
+				fn(strings.TrimSuffix(partial+line, "\n"))
+				partial = ""
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+		if f == nil || rotated(f, path, offset) {
+			partial = ""
+			if err := open(false); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("cannot reopen %s: %w", path, err)
+			}
+		}
+	}
+}
+
+// rotated reports whether path no longer is the open file f, or f was
+// truncated below offset.
+func rotated(f *os.File, path string, offset int64) bool {
+	cur, err := f.Stat()
+	if err != nil {
+		return true
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	if !os.SameFile(cur, fi) {
+		return true
+	}
+	return fi.Size() < offset
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// dryRunAnnotationKey set to "true" checks a capture request the way
+// starting it would, and reports the outcome without capturing.
+const dryRunAnnotationKey = "dry-run." + annotationKey
+
+// stateValidated is reported for a dry run that found nothing in the way of
+// the capture.
+const stateValidated = "validated"
+
+const reasonCaptureValidated = "CaptureValidated"
+
+// validateCapture runs the checks that only starting the capture of spec
+// would otherwise run: that the backend can capture at all, which needs its
+// program and privileges, and that the interfaces exist. The checks
+// startCapture runs itself, on the options, the peer, the disk and the node
+// quota, have passed by the time it is called. It returns the Event reason
+// and a message when the capture would fail, and otherwise a summary of
+// what it would do. Callers must hold m.mu.
+func (m *CaptureManager) validateCapture(backend CaptureBackend, spec captureSpec) (string, string) {
+	if err := backend.Check(); err != nil {
+		return reasonCaptureFailed, fmt.Sprintf("Cannot start capture: the %s backend cannot capture on this node: %v", backend.Name(), err)
+	}
+	ifaces := append([]string(nil), spec.Interfaces...)
+	if len(ifaces) == 0 {
+		ifaces = []string{spec.Interface}
+	}
+	if !podPortBackend(backend) && !spec.PodLoopback {
+		// Pod port backends attach to the Pod's port, and loopback
+		// captures to the Pod's own lo, whatever the interface.
+		for i, name := range ifaces {
+			ifName, err := resolveInterface(name, spec)
+			if err == nil && ifName != "any" {
+				_, err = net.InterfaceByName(ifName)
+			}
+			if err != nil {
+				return reasonCaptureFailed, fmt.Sprintf("Cannot start capture: interface %s: %v", name, err)
+			}
+			ifaces[i] = ifName
+		}
+	}
+	msg := fmt.Sprintf("the %s backend can capture on %s", backend.Name(), strings.Join(ifaces, ", "))
+	if spec.Filter != "" {
+		msg += fmt.Sprintf(" with filter %q", spec.Filter)
+	}
+	if spec.writesFiles() {
+		msg += fmt.Sprintf(", writing up to %d MB", spec.budget()/bytesPerMB)
+	}
+	if limit := m.settings().MaxCaptures; limit > 0 && m.runningCaptures()+len(m.pending) >= limit {
+		msg += fmt.Sprintf("; all %d capture slots are taken, so it would wait for one", limit)
+	}
+	return "", msg
+}
+
+// reportValidated records the passed dry run of spec on the Pod. A dry run is
+// repeated on every sync of the Pod, so only a changed outcome is recorded.
+func (m *CaptureManager) reportValidated(pod *corev1.Pod, spec captureSpec, summary string) error {
+	m.leaveQueue(sessionKey(pod.Namespace+"/"+pod.Name, spec.Session))
+	msg := "dry run passed: " + summary
+	current := annotatedStatus(pod, spec.Session)
+	if current.State == stateValidated && current.Message == msg {
+		return nil
+	}
+	slog.Info("Capture request validated", "namespace", pod.Namespace, "pod", pod.Name, "name", spec.Session, "result", msg)
+	m.recorder.Event(pod, corev1.EventTypeNormal, reasonCaptureValidated, sessionEvent(spec, "Dry run passed: "+summary))
+	m.patchStatus(podRef(pod), captureStatus{State: stateValidated, Node: m.nodeName, Session: spec.Session,
+		Priority: spec.Priority, Requester: spec.Requester, Message: msg})
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// ndFilter matches IPv6 Neighbor Discovery, ICMPv6 types 133 to 137. ND
+// runs between link-local and solicited-node multicast addresses rather
+// than the Pod's IPs, so IP filters would drop it along with address
+// resolution failures. ND messages carry no extension headers, so the type
+// is at a fixed offset behind the IPv6 header.
+const ndFilter = "(icmp6 and ip6[40] >= 133 and ip6[40] <= 137)"
+
+// icmpFilter matches the ICMP and ICMPv6 messages of a flow, such as
+// unreachables and packet too big, which port filters would drop since
+// they have no ports of their own.
+const icmpFilter = "icmp or icmp6"
+
+// podScopeFilter matches the traffic of a Pod with the given IPs. With an
+// IPv6 address, Neighbor Discovery is kept as well.
+func podScopeFilter(ips []string) string {
+	filter := hostsFilter([][]string{ips})
+	if hasIPv6(ips) {
+		return "(" + filter + " or " + ndFilter + ")"
+	}
+	return filter
+}
+
+// portsFilter matches any of the sorted port terms, such as "tcp port 80",
+// and the ICMP messages about them. It returns "" without terms.
+func portsFilter(terms []string) string {
+	if len(terms) == 0 {
+		return ""
+	}
+	return "(" + strings.Join(terms, " or ") + " or " + icmpFilter + ")"
+}
+
+func hasIPv6(ips []string) bool {
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() == nil {
+			return true
+		}
+	}
+	return false
+}
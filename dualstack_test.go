@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket/layers"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestPodScopeFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		want string
+	}{
+		{name: "ipv4", ips: []string{"10.0.0.10"}, want: "host 10.0.0.10"},
+		{name: "ipv6 only", ips: []string{"fd00:10::a"}, want: "(host fd00:10::a or " + ndFilter + ")"},
+		{name: "dual stack", ips: []string{"10.0.0.10", "fd00:10::a"}, want: "((host 10.0.0.10 or host fd00:10::a) or " + ndFilter + ")"},
+		{name: "ipv6 first", ips: []string{"fd00:10::a", "10.0.0.10"}, want: "((host fd00:10::a or host 10.0.0.10) or " + ndFilter + ")"},
+		{name: "ipv4-mapped", ips: []string{"::ffff:10.0.0.10"}, want: "host ::ffff:10.0.0.10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := podScopeFilter(tt.ips); got != tt.want {
+				t.Errorf("podScopeFilter(%v) = %q, want %q", tt.ips, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContainerPortFilterKeepsICMPv6(t *testing.T) {
+	got, err := containerPortFilter([]corev1.ContainerPort{
+		{ContainerPort: 8080},
+		{ContainerPort: 53, Protocol: corev1.ProtocolUDP},
+		{ContainerPort: 8080, Protocol: corev1.ProtocolTCP},
+	})
+	if err != nil {
+		t.Fatalf("containerPortFilter: %v", err)
+	}
+	if want := "(tcp port 8080 or udp port 53 or icmp or icmp6)"; got != want {
+		t.Errorf("containerPortFilter = %q, want %q", got, want)
+	}
+	if got := portsFilter(nil); got != "" {
+		t.Errorf("portsFilter without terms = %q, want none", got)
+	}
+}
+
+// TestNDFilterOffset checks that ndFilter finds the type of every Neighbor
+// Discovery message, and of no other ICMPv6 message, at ip6[40].
+func TestNDFilterOffset(t *testing.T) {
+	src, dst := net.ParseIP("fe80::1"), net.ParseIP("ff02::1:ff00:a")
+	tests := []struct {
+		typ uint8
+		nd  bool
+	}{
+		{typ: layers.ICMPv6TypeRouterSolicitation, nd: true},
+		{typ: layers.ICMPv6TypeRouterAdvertisement, nd: true},
+		{typ: layers.ICMPv6TypeNeighborSolicitation, nd: true},
+		{typ: layers.ICMPv6TypeNeighborAdvertisement, nd: true},
+		{typ: layers.ICMPv6TypeRedirect, nd: true},
+		{typ: layers.ICMPv6TypeEchoRequest},
+		{typ: layers.ICMPv6TypeEchoReply},
+		{typ: layers.ICMPv6TypePacketTooBig},
+		{typ: layers.ICMPv6TypeDestinationUnreachable},
+		{typ: layers.ICMPv6TypeMLDv2MulticastListenerReportMessageV2},
+	}
+	for _, tt := range tests {
+		ip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: src, DstIP: dst}
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(tt.typ, 0)}
+		icmp.SetNetworkLayerForChecksum(ip)
+		data := serialize(t, &layers.Ethernet{SrcMAC: testMACs[0], DstMAC: testMACs[1], EthernetType: layers.EthernetTypeIPv6},
+			ip, icmp, &layers.ICMPv6Echo{})
+		// tcpdump's ip6[] loads from the IPv6 header behind Ethernet.
+		got := data[14+40]
+		if got != tt.typ {
+			t.Fatalf("ip6[40] of %s = %d", icmp.TypeCode, got)
+		}
+		if nd := got >= 133 && got <= 137; nd != tt.nd {
+			t.Errorf("ndFilter matches %s: %v, want %v", icmp.TypeCode, nd, tt.nd)
+		}
+	}
+	if !strings.Contains(ndFilter, "ip6[40] >= 133 and ip6[40] <= 137") {
+		t.Errorf("ndFilter %q does not test types 133 to 137", ndFilter)
+	}
+}
+
+func TestRingBufferFilterCoversPodIPs(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		want string
+	}{
+		{name: "ipv4", ips: []string{"10.0.0.10"}, want: "host 10.0.0.10"},
+		{name: "ipv6 only", ips: []string{"fd00:10::a"}, want: "(host fd00:10::a or " + ndFilter + ")"},
+		{name: "dual stack", ips: []string{"10.0.0.10", "fd00:10::a"}, want: "((host 10.0.0.10 or host fd00:10::a) or " + ndFilter + ")"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManager(t)
+			// Ring buffers are picked after the Namespace's annotations.
+			namespaces := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			namespaces.Add(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
+			tm.nsLister = corelisters.NewNamespaceLister(namespaces)
+			tm.ringSelector = labels.Everything()
+			pod := tm.addPod("web", nil)
+			pod.Status.PodIP, pod.Status.PodIPs = tt.ips[0], nil
+			for _, ip := range tt.ips {
+				pod.Status.PodIPs = append(pod.Status.PodIPs, corev1.PodIP{IP: ip})
+			}
+			tm.pods.Update(pod)
+			tm.sync(pod)
+			started := tm.backend.Started()
+			if len(started) != 1 {
+				t.Fatalf("started %d captures, want the ring buffer", len(started))
+			}
+			if got := started[0].Filter; !strings.Contains(got, tt.want) {
+				t.Errorf("filter = %q, want it to contain %q", got, tt.want)
+			}
+		})
+	}
+}
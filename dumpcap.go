@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+	"strconv"
+)
+
+// dumpcapBackend runs Wireshark's dumpcap, one process per capture. Like
+// tcpdump it writes pcap to a pipe and the agent rewrites it as rotated
+// pcapng files. dumpcap has no signal to print its counters, so received
+// and dropped packets are only known once it exits.
+type dumpcapBackend struct {
+	path   string
+	limits *processLimits
+}
+
+func (b *dumpcapBackend) Name() string { return backendDumpcap }
+
+func (b *dumpcapBackend) Check() error {
+	_, err := exec.LookPath(b.path)
+	return err
+}
+
+// CheckFilter compiles the filter with dumpcap -d, which prints the BPF
+// program instead of capturing.
+func (b *dumpcapBackend) CheckFilter(spec captureSpec) error {
+	return compileFilter(b.path, "-d", "-i", spec.Interface, "-f", dumpcapFilter(spec))
+}
+
+// dumpcapFilter returns the filter of spec, limited to its direction with
+// libpcap's inbound and outbound, since dumpcap has no -Q.
+func dumpcapFilter(spec captureSpec) string {
+	var dir string
+	switch spec.interfaceDirection(spec.PodPort) {
+	case "in":
+		dir = "inbound"
+	case "out":
+		dir = "outbound"
+	default:
+		return spec.Filter
+	}
+	if spec.Filter == "" {
+		return dir
+	}
+	return "(" + spec.Filter + ") and " + dir
+}
+
+func (b *dumpcapBackend) Start(ctx context.Context, spec captureSpec) (runningCapture, error) {
+	// -P writes pcap rather than pcapng, which the agent reads as it does
+	// tcpdump's output; -q leaves the packet count off standard error.
+	args := []string{"-q", "-P", "-w", "-", "-i", spec.Interface}
+	if spec.Snaplen > 0 {
+		args = append(args, "-s", strconv.Itoa(spec.Snaplen))
+	}
+	if filter := dumpcapFilter(spec); filter != "" {
+		args = append(args, "-f", filter)
+	}
+	return startPipeCapture(ctx, b.path, args, spec, b.limits)
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/cilium/ebpf"
+	"github.com/cilium/ebpf/asm"
+	"golang.org/x/net/bpf"
+	"golang.org/x/sys/unix"
+)
+
+// ebpfBackend attaches an eBPF socket filter to a packet socket bound to the
+// host side of the Pod's veth. The filter runs in the
+// kernel before packets are copied to the agent, which makes it the place for
+// filtering beyond classic BPF; today it applies the filter expression,
+// truncates packets to the snaplen, samples them and keeps a single
+// direction. Filter expressions are compiled to classic BPF with tcpdump
+// and translated into the program; without them it needs neither tcpdump
+// nor libpcap. It ignores --interface.
+type ebpfBackend struct {
+	// workers is the number of sockets reading in parallel.
+	workers int
+	// tcpdump compiles filter expressions.
+	tcpdump string
+}
+
+func (b *ebpfBackend) Name() string { return backendEBPF }
+
+// Check loads the filter program, which fails without CAP_BPF or on kernels
+// without eBPF socket filters.
+func (b *ebpfBackend) Check() error {
+	prog, err := loadSocketFilter(defaultSnaplen, 1, "", nil)
+	if err != nil {
+		return err
+	}
+	return prog.Close()
+}
+
+// CheckFilter compiles the filter for the Pod's interface and loads the
+// socket filter it becomes, so a filter the kernel would refuse fails the
+// capture as well. An interface that cannot be found is left for the start
+// to report.
+func (b *ebpfBackend) CheckFilter(spec captureSpec) error {
+	ifi, err := podHostInterface(spec.PodUID)
+	if err != nil {
+		return nil
+	}
+	filter, err := compileBPF(b.tcpdump, ifi.Name, spec.Filter)
+	if err != nil {
+		return err
+	}
+	prog, err := loadSocketFilter(spec.snaplen(), spec.SampleRate, spec.interfaceDirection(true), filter)
+	if err != nil {
+		return err
+	}
+	return prog.Close()
+}
+
+func (b *ebpfBackend) Start(ctx context.Context, spec captureSpec) (runningCapture, error) {
+	ifi, err := podHostInterface(spec.PodUID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the pod's interface: %w", err)
+	}
+	var filter []bpf.Instruction
+	if spec.Filter != "" {
+		if filter, err = compileBPF(b.tcpdump, ifi.Name, spec.Filter); err != nil {
+			return nil, fmt.Errorf("cannot compile filter: %w", err)
+		}
+	}
+	fds, err := openPacketSockets(ifi.Index, b.workers)
+	if err != nil {
+		return nil, err
+	}
+	for _, fd := range fds {
+		if err := attachSocketFilter(fd, spec.snaplen(), spec.SampleRate, spec.interfaceDirection(true), filter); err != nil {
+			closeSockets(fds)
+			return nil, err
+		}
+	}
+	return startSocketCapture(ctx, fds, newRingWriter(spec, ifi.Name, linkTypeOf(ifi), spec.snaplen()))
+}
+
+// loadSocketFilter loads a socket filter that accepts packets truncated to
+// snaplen bytes. With dir "in" or "out" it only accepts the packets the
+// interface receives or sends, and with a filter the packets the classic
+// BPF program accepts, truncated to what it returns if that is shorter.
+// With sample above 1 it accepts a random one in sample of those packets.
+// The rest are dropped in the kernel.
+func loadSocketFilter(snaplen, sample int, dir string, filter []bpf.Instruction) (*ebpf.Program, error) {
+	// R6 holds the __sk_buff, which packet loads read from, and R9 the
+	// length to keep of an accepted packet.
+	insns := asm.Instructions{asm.Mov.Reg(asm.R6, asm.R1)}
+	drops := false
+	if dir != "" {
+		// pkt_type follows len in the __sk_buff.
+		insns = append(insns, asm.LoadMem(asm.R2, asm.R6, 4, asm.Word))
+		if dir == "out" {
+			insns = append(insns, asm.JNE.Imm(asm.R2, unix.PACKET_OUTGOING, "drop"))
+		} else {
+			insns = append(insns, asm.JEq.Imm(asm.R2, unix.PACKET_OUTGOING, "drop"))
+		}
+		drops = true
+	}
+	accepts := true
+	if filter != nil {
+		translated, t, err := translateFilter(filter, snaplen)
+		if err != nil {
+			return nil, err
+		}
+		insns = append(insns, translated...)
+		accepts, drops = t.accepts, drops || t.drops
+	} else {
+		insns = append(insns, asm.Mov.Imm32(asm.R9, int32(snaplen)))
+	}
+	// The verifier refuses code that cannot be reached, so the tails are
+	// only added where a filter that accepts or drops nothing jumps.
+	if accepts {
+		accept := len(insns)
+		if sample > 1 {
+			insns = append(insns,
+				asm.FnGetPrandomU32.Call(),
+				asm.Mod.Imm(asm.R0, int32(sample)),
+				asm.JNE.Imm(asm.R0, 0, "drop"),
+			)
+			drops = true
+		}
+		insns = append(insns,
+			asm.Mov.Reg(asm.R0, asm.R9),
+			asm.Return(),
+		)
+		insns[accept] = insns[accept].WithSymbol("accept")
+	}
+	if drops {
+		insns = append(insns,
+			asm.Mov.Imm(asm.R0, 0).WithSymbol("drop"),
+			asm.Return(),
+		)
+	}
+	prog, err := ebpf.NewProgram(&ebpf.ProgramSpec{
+		Type:         ebpf.SocketFilter,
+		License:      "Apache-2.0",
+		Instructions: insns,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot load eBPF socket filter: %w", err)
+	}
+	return prog, nil
+}
+
+// attachSocketFilter attaches the filter to fd. The socket keeps the
+// program loaded, so it is closed right away.
+func attachSocketFilter(fd, snaplen, sample int, dir string, filter []bpf.Instruction) error {
+	prog, err := loadSocketFilter(snaplen, sample, dir, filter)
+	if err != nil {
+		return err
+	}
+	defer prog.Close()
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ATTACH_BPF, prog.FD()); err != nil {
+		return fmt.Errorf("cannot attach eBPF socket filter: %w", err)
+	}
+	return nil
+}
+
+// filterTails tells which tails of the socket filter a translated classic
+// BPF program jumps to.
+type filterTails struct {
+	accepts, drops bool
+}
+
+// translateFilter translates a classic BPF program, as tcpdump compiles
+// filters, into the eBPF of the socket filter, the way the kernel runs
+// classic socket filters. A is R0, X is R7 and the scratch memory is on the
+// stack; packet loads read from the __sk_buff in R6 and drop packets too
+// short for them. Returns jump to the accept tail with the length to keep
+// in R9, or to the drop tail for 0. Comparisons use 32-bit jumps, which
+// need Linux 5.1.
+func translateFilter(filter []bpf.Instruction, snaplen int) (asm.Instructions, filterTails, error) {
+	var (
+		insns asm.Instructions
+		tails filterTails
+	)
+	label := func(i int) string { return fmt.Sprintf("filter%d", i) }
+	target := func(i int, skip uint32) (string, error) {
+		if next := i + 1 + int(skip); next < len(filter) {
+			return label(next), nil
+		}
+		return "", fmt.Errorf("instruction %d of the filter jumps past its end", i)
+	}
+	reg := func(r bpf.Register) asm.Register {
+		if r == bpf.RegX {
+			return asm.R7
+		}
+		return asm.R0
+	}
+	scratch := func(n int) int16 { return int16(-4 * (n + 1)) }
+	for n := range 16 {
+		// The verifier refuses reads of the stack before writes, while
+		// classic scratch memory starts zeroed.
+		insns = append(insns, asm.StoreImm(asm.RFP, scratch(n), 0, asm.Word))
+	}
+	for i, ins := range filter {
+		first := len(insns)
+		switch ins := ins.(type) {
+		case bpf.LoadConstant:
+			insns = append(insns, asm.Mov.Imm32(reg(ins.Dst), int32(ins.Val)))
+		case bpf.LoadScratch:
+			insns = append(insns, asm.LoadMem(reg(ins.Dst), asm.RFP, scratch(ins.N), asm.Word))
+		case bpf.StoreScratch:
+			insns = append(insns, asm.StoreMem(asm.RFP, scratch(ins.N), reg(ins.Src), asm.Word))
+		case bpf.LoadAbsolute:
+			size, err := loadSize(ins.Size)
+			if err != nil {
+				return nil, tails, err
+			}
+			insns = append(insns, asm.LoadAbs(int32(ins.Off), size))
+		case bpf.LoadIndirect:
+			size, err := loadSize(ins.Size)
+			if err != nil {
+				return nil, tails, err
+			}
+			insns = append(insns, asm.LoadInd(asm.R0, asm.R7, int32(ins.Off), size))
+		case bpf.LoadMemShift:
+			// X = 4*(P[k]&0xf), which only has A to load the byte into.
+			insns = append(insns,
+				asm.Mov.Reg(asm.R8, asm.R0),
+				asm.LoadAbs(int32(ins.Off), asm.Byte),
+				asm.And.Imm32(asm.R0, 0xf),
+				asm.LSh.Imm32(asm.R0, 2),
+				asm.Mov.Reg32(asm.R7, asm.R0),
+				asm.Mov.Reg(asm.R0, asm.R8),
+			)
+		case bpf.LoadExtension:
+			ext, err := loadExtension(ins.Num)
+			if err != nil {
+				return nil, tails, err
+			}
+			insns = append(insns, ext...)
+		case bpf.ALUOpConstant:
+			op, err := aluOp(ins.Op)
+			if err != nil {
+				return nil, tails, err
+			}
+			insns = append(insns, op.Imm32(asm.R0, int32(ins.Val)))
+		case bpf.ALUOpX:
+			op, err := aluOp(ins.Op)
+			if err != nil {
+				return nil, tails, err
+			}
+			if ins.Op == bpf.ALUOpDiv || ins.Op == bpf.ALUOpMod {
+				// Classic BPF drops the packet on a division by 0.
+				insns = append(insns, asm.JEq.Imm32(asm.R7, 0, "drop"))
+				tails.drops = true
+			}
+			insns = append(insns, op.Reg32(asm.R0, asm.R7))
+		case bpf.NegateA:
+			insns = append(insns, asm.Neg.Imm32(asm.R0, 0))
+		case bpf.TAX:
+			insns = append(insns, asm.Mov.Reg32(asm.R7, asm.R0))
+		case bpf.TXA:
+			insns = append(insns, asm.Mov.Reg32(asm.R0, asm.R7))
+		case bpf.Jump:
+			to, err := target(i, ins.Skip)
+			if err != nil {
+				return nil, tails, err
+			}
+			insns = append(insns, asm.Ja.Label(to))
+		case bpf.JumpIf, bpf.JumpIfX:
+			var (
+				cond                jumpTest
+				skipTrue, skipFalse uint8
+			)
+			if j, ok := ins.(bpf.JumpIf); ok {
+				cond, skipTrue, skipFalse = jumpTest{j.Cond, j.Val, false}, j.SkipTrue, j.SkipFalse
+			} else {
+				j := ins.(bpf.JumpIfX)
+				cond, skipTrue, skipFalse = jumpTest{j.Cond, 0, true}, j.SkipTrue, j.SkipFalse
+			}
+			op, negate, err := jumpOp(cond.test)
+			if err != nil {
+				return nil, tails, err
+			}
+			onTrue, err := target(i, uint32(skipTrue))
+			if err != nil {
+				return nil, tails, err
+			}
+			onFalse, err := target(i, uint32(skipFalse))
+			if err != nil {
+				return nil, tails, err
+			}
+			if negate {
+				onTrue, onFalse = onFalse, onTrue
+			}
+			if cond.x {
+				insns = append(insns, op.Reg32(asm.R0, asm.R7, onTrue))
+			} else {
+				insns = append(insns, op.Imm32(asm.R0, int32(cond.val), onTrue))
+			}
+			insns = append(insns, asm.Ja.Label(onFalse))
+		case bpf.RetConstant:
+			if ins.Val == 0 {
+				insns = append(insns, asm.Ja.Label("drop"))
+				tails.drops = true
+				break
+			}
+			insns = append(insns,
+				asm.Mov.Imm32(asm.R9, int32(min(int(ins.Val), snaplen))),
+				asm.Ja.Label("accept"),
+			)
+			tails.accepts = true
+		case bpf.RetA:
+			insns = append(insns,
+				asm.Mov.Reg32(asm.R9, asm.R0),
+				asm.JEq.Imm32(asm.R9, 0, "drop"),
+				asm.JLE.Imm32(asm.R9, int32(snaplen), "accept"),
+				asm.Mov.Imm32(asm.R9, int32(snaplen)),
+				asm.Ja.Label("accept"),
+			)
+			tails.accepts, tails.drops = true, true
+		default:
+			return nil, tails, fmt.Errorf("the ebpf backend cannot translate filter instruction %v", ins)
+		}
+		insns[first] = insns[first].WithSymbol(label(i))
+	}
+	return insns, tails, nil
+}
+
+// jumpTest is the comparison of a classic conditional jump, with the
+// constant val or with X.
+type jumpTest struct {
+	test bpf.JumpTest
+	val  uint32
+	x    bool
+}
+
+// jumpOp returns the eBPF jump of a classic comparison, and whether it
+// jumps when the comparison is false instead.
+func jumpOp(test bpf.JumpTest) (asm.JumpOp, bool, error) {
+	switch test {
+	case bpf.JumpEqual:
+		return asm.JEq, false, nil
+	case bpf.JumpNotEqual:
+		return asm.JNE, false, nil
+	case bpf.JumpGreaterThan:
+		return asm.JGT, false, nil
+	case bpf.JumpLessThan:
+		return asm.JLT, false, nil
+	case bpf.JumpGreaterOrEqual:
+		return asm.JGE, false, nil
+	case bpf.JumpLessOrEqual:
+		return asm.JLE, false, nil
+	case bpf.JumpBitsSet:
+		return asm.JSet, false, nil
+	case bpf.JumpBitsNotSet:
+		return asm.JSet, true, nil
+	}
+	return 0, false, fmt.Errorf("the ebpf backend cannot translate filter jump %d", test)
+}
+
+// aluOp returns the eBPF operation of a classic one.
+func aluOp(op bpf.ALUOp) (asm.ALUOp, error) {
+	switch op {
+	case bpf.ALUOpAdd:
+		return asm.Add, nil
+	case bpf.ALUOpSub:
+		return asm.Sub, nil
+	case bpf.ALUOpMul:
+		return asm.Mul, nil
+	case bpf.ALUOpDiv:
+		return asm.Div, nil
+	case bpf.ALUOpOr:
+		return asm.Or, nil
+	case bpf.ALUOpAnd:
+		return asm.And, nil
+	case bpf.ALUOpShiftLeft:
+		return asm.LSh, nil
+	case bpf.ALUOpShiftRight:
+		return asm.RSh, nil
+	case bpf.ALUOpMod:
+		return asm.Mod, nil
+	case bpf.ALUOpXor:
+		return asm.Xor, nil
+	}
+	return 0, fmt.Errorf("the ebpf backend cannot translate filter operation %d", op)
+}
+
+// loadSize returns the eBPF size of a classic packet load.
+func loadSize(size int) (asm.Size, error) {
+	switch size {
+	case 1:
+		return asm.Byte, nil
+	case 2:
+		return asm.Half, nil
+	case 4:
+		return asm.Word, nil
+	}
+	return 0, fmt.Errorf("the ebpf backend cannot translate a filter load of %d bytes", size)
+}
+
+// loadExtension loads what a classic ancillary load reads into A, from the
+// __sk_buff in R6 where the kernel exposes it.
+func loadExtension(ext bpf.Extension) (asm.Instructions, error) {
+	field := func(off int16) asm.Instructions {
+		return asm.Instructions{asm.LoadMem(asm.R0, asm.R6, off, asm.Word)}
+	}
+	// The protocols are kept in network byte order.
+	be16 := func(off int16) asm.Instructions {
+		return append(field(off), asm.HostTo(asm.BE, asm.R0, asm.Half))
+	}
+	switch ext {
+	case bpf.ExtLen:
+		return field(0), nil
+	case bpf.ExtType:
+		return field(4), nil
+	case bpf.ExtMark:
+		return field(8), nil
+	case bpf.ExtQueue:
+		return field(12), nil
+	case bpf.ExtProto:
+		return be16(16), nil
+	case bpf.ExtVLANTagPresent:
+		return field(20), nil
+	case bpf.ExtVLANTag:
+		return field(24), nil
+	case bpf.ExtVLANProto:
+		return be16(28), nil
+	case bpf.ExtInterfaceIndex:
+		return field(40), nil
+	case bpf.ExtRXHash:
+		return field(68), nil
+	case bpf.ExtRand:
+		return asm.Instructions{asm.FnGetPrandomU32.Call()}, nil
+	}
+	return nil, fmt.Errorf("the ebpf backend cannot translate filter extension %d", ext)
+}
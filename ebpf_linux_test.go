@@ -0,0 +1,191 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/bpf"
+)
+
+// translationPackets returns Ethernet frames for the translation tests.
+func translationPackets(t *testing.T) [][]byte {
+	eth := &layers.Ethernet{SrcMAC: testMACs[0], DstMAC: testMACs[1], EthernetType: layers.EthernetTypeIPv4}
+	ip4 := func(proto layers.IPProtocol, options ...layers.IPv4Option) *layers.IPv4 {
+		return &layers.IPv4{Version: 4, TTL: 64, Protocol: proto, SrcIP: clientIP, DstIP: serverIP, Options: options}
+	}
+	tcp := func(ip *layers.IPv4, port layers.TCPPort) []byte {
+		l := &layers.TCP{SrcPort: 40000, DstPort: port, SYN: true, Window: 1024}
+		l.SetNetworkLayerForChecksum(ip)
+		return serialize(t, eth, ip, l, gopacket.Payload(make([]byte, 100)))
+	}
+	udpIP := ip4(layers.IPProtocolUDP)
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 80}
+	udp.SetNetworkLayerForChecksum(udpIP)
+	return [][]byte{
+		tcp(ip4(layers.IPProtocolTCP), 80),
+		tcp(ip4(layers.IPProtocolTCP), 443),
+		// The options move the TCP header, which indirect loads follow.
+		tcp(ip4(layers.IPProtocolTCP, layers.IPv4Option{OptionType: 1}, layers.IPv4Option{OptionType: 1},
+			layers.IPv4Option{OptionType: 1}, layers.IPv4Option{OptionType: 0}), 80),
+		serialize(t, eth, udpIP, udp, gopacket.Payload("query")),
+		serialize(t, eth, &layers.ARP{
+			AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+			Operation: layers.ARPRequest, SourceHwAddress: testMACs[0], SourceProtAddress: clientIP.To4(),
+			DstHwAddress: make(net.HardwareAddr, 6), DstProtAddress: serverIP.To4(),
+		}),
+	}
+}
+
+func TestTranslateFilterMatchesClassicBPF(t *testing.T) {
+	const snaplen = 96
+	// The kernel runs socket filters from the network header, so the
+	// programs load from there.
+	tests := []struct {
+		name   string
+		filter []bpf.Instruction
+	}{
+		{
+			name: "tcp dst port 80",
+			filter: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 9, Size: 1},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 6, SkipFalse: 6},
+				bpf.LoadAbsolute{Off: 6, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpBitsSet, Val: 0x1fff, SkipTrue: 4},
+				bpf.LoadMemShift{Off: 0},
+				bpf.LoadIndirect{Off: 2, Size: 2},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 80, SkipFalse: 1},
+				bpf.RetConstant{Val: 262144},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			name: "not udp",
+			filter: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 9, Size: 1},
+				bpf.JumpIf{Cond: bpf.JumpNotEqual, Val: 17, SkipTrue: 1},
+				bpf.RetConstant{Val: 0},
+				bpf.RetConstant{Val: 40},
+			},
+		},
+		{
+			name: "length arithmetic",
+			filter: []bpf.Instruction{
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 20},
+				bpf.ALUOpConstant{Op: bpf.ALUOpAnd, Val: 0xfff0},
+				bpf.TAX{},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 3},
+				bpf.ALUOpX{Op: bpf.ALUOpMul},
+				bpf.ALUOpConstant{Op: bpf.ALUOpShiftRight, Val: 2},
+				bpf.RetA{},
+			},
+		},
+		{
+			name: "scratch memory",
+			filter: []bpf.Instruction{
+				bpf.LoadScratch{Dst: bpf.RegX, N: 5},
+				bpf.LoadAbsolute{Off: 0, Size: 1},
+				bpf.StoreScratch{Src: bpf.RegA, N: 3},
+				bpf.TXA{},
+				bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipFalse: 3},
+				bpf.LoadScratch{Dst: bpf.RegA, N: 3},
+				bpf.JumpIf{Cond: bpf.JumpGreaterThan, Val: 0x44, SkipTrue: 1},
+				bpf.RetConstant{Val: 1000},
+				bpf.RetConstant{Val: 0},
+			},
+		},
+		{
+			name: "compare with X",
+			filter: []bpf.Instruction{
+				bpf.LoadConstant{Dst: bpf.RegX, Val: 100},
+				bpf.LoadExtension{Num: bpf.ExtLen},
+				bpf.JumpIfX{Cond: bpf.JumpGreaterOrEqual, SkipFalse: 1},
+				bpf.RetA{},
+				bpf.RetConstant{Val: 8},
+			},
+		},
+		{
+			name: "division by zero",
+			filter: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 9, Size: 1},
+				bpf.ALUOpConstant{Op: bpf.ALUOpSub, Val: 6},
+				bpf.TAX{},
+				bpf.LoadConstant{Dst: bpf.RegA, Val: 600},
+				bpf.ALUOpX{Op: bpf.ALUOpDiv},
+				bpf.RetA{},
+			},
+		},
+		{
+			name: "load past the end",
+			filter: []bpf.Instruction{
+				bpf.LoadAbsolute{Off: 1000, Size: 4},
+				bpf.RetConstant{Val: 64},
+			},
+		},
+	}
+	packets := translationPackets(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, err := bpf.NewVM(tt.filter)
+			if err != nil {
+				t.Fatalf("NewVM: %v", err)
+			}
+			prog, err := loadSocketFilter(snaplen, 1, "", tt.filter)
+			if err != nil {
+				if strings.Contains(err.Error(), "operation not permitted") {
+					t.Skipf("cannot load socket filters: %v", err)
+				}
+				t.Fatalf("loadSocketFilter: %v", err)
+			}
+			defer prog.Close()
+			for i, frame := range packets {
+				want, err := vm.Run(frame[14:])
+				if err != nil {
+					t.Fatalf("packet %d: Run: %v", i, err)
+				}
+				got, _, err := prog.Test(frame)
+				if err != nil {
+					t.Fatalf("packet %d: Test: %v", i, err)
+				}
+				if int(got) != min(want, snaplen) {
+					t.Errorf("packet %d: socket filter returned %d, want %d", i, got, min(want, snaplen))
+				}
+			}
+		})
+	}
+}
+
+func TestTranslateFilterRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  []bpf.Instruction
+		wantErr string
+	}{
+		{
+			name:    "jump past the end",
+			filter:  []bpf.Instruction{bpf.Jump{Skip: 1}, bpf.RetConstant{Val: 0}},
+			wantErr: "jumps past its end",
+		},
+		{
+			name:    "unknown extension",
+			filter:  []bpf.Instruction{bpf.LoadExtension{Num: bpf.ExtPayloadOffset}, bpf.RetA{}},
+			wantErr: "cannot translate filter extension",
+		},
+		{
+			name:    "bad load size",
+			filter:  []bpf.Instruction{bpf.LoadAbsolute{Off: 0, Size: 3}, bpf.RetA{}},
+			wantErr: "load of 3 bytes",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := translateFilter(tt.filter, defaultSnaplen)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("translateFilter: %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
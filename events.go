@@ -0,0 +1,48 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const eventComponent = "packet-capture"
+
+// Event reasons recorded on the captured Pod.
+const (
+	reasonCaptureStarted   = "CaptureStarted"
+	reasonCaptureStopped   = "CaptureStopped"
+	reasonCaptureFailed    = "CaptureFailed"
+	reasonCaptureDenied    = "CaptureDenied"
+	reasonCaptureCompleted = "CaptureCompleted"
+	reasonFileRotated      = "FileRotated"
+	reasonFileTampered     = "FileTampered"
+	reasonPolicyDrops      = "PolicyDrops"
+	reasonHealthIncident   = "HealthIncident"
+	reasonSnapshotSaved    = "SnapshotSaved"
+	reasonSnapshotFailed   = "SnapshotFailed"
+	reasonReportReady      = "ReportReady"
+	reasonCaptureBundled   = "CaptureBundled"
+)
+
+// newEventRecorder returns a recorder that writes Events through the API
+// server, attributed to this node's agent.
+func newEventRecorder(clientset kubernetes.Interface, nodeName string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent, Host: nodeName})
+}
+
+// podRef returns the reference Events are recorded against.
+func podRef(pod *corev1.Pod) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:            "Pod",
+		APIVersion:      "v1",
+		Namespace:       pod.Namespace,
+		Name:            pod.Name,
+		UID:             pod.UID,
+		ResourceVersion: pod.ResourceVersion,
+	}
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Export protocols, the schemes of --export-url.
+const (
+	exportSFTP = "sftp"
+	exportSCP  = "scp"
+)
+
+const (
+	// exportSpool is the directory in the capture directory that holds
+	// the files waiting to be exported.
+	exportSpool = ".export"
+	// exportTimeout bounds connecting to the export server.
+	exportTimeout = 30 * time.Second
+	// exportBackoff and maxExportBackoff bound the wait before an export
+	// that failed is tried again.
+	exportBackoff    = 5 * time.Second
+	maxExportBackoff = 5 * time.Minute
+	// exportStallTimeout fails an export whose connection has not moved
+	// for that long, so it is retried over a new one instead of hanging.
+	exportStallTimeout = time.Minute
+	// exportChunk is how much of a file is uploaded over SFTP between two
+	// checkpoints of its progress.
+	exportChunk = 8 << 20
+	// exportUploads is the directory in the spool that holds the progress
+	// of SFTP uploads, by file name.
+	exportUploads = ".uploads"
+)
+
+// fileExporter pushes finished capture files to an SFTP or SCP server. A
+// file is hard linked, or copied from storage targets, into the spool
+// directory as soon as it is finished,
+// so it is exported even if retention deletes it first, and exports
+// continue after a restart. Failed exports are tried again until they
+// succeed; SFTP uploads resume where they stopped. It is shared by every
+// capture.
+type fileExporter struct {
+	protocol string
+	addr     string
+	dir      string
+	node     string
+	tracer   *tracer
+	config   *ssh.ClientConfig
+	spool    string
+	wake     chan struct{}
+}
+
+// newFileExporter returns the exporter of --export-url, or nil if none is
+// configured.
+func newFileExporter(cfg *Config, node string, tracer *tracer) (*fileExporter, error) {
+	if cfg.ExportURL == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.ExportURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid export URL: %w", err)
+	}
+	if u.Scheme != exportSFTP && u.Scheme != exportSCP {
+		return nil, fmt.Errorf("export URL must start with %s:// or %s://, got %q", exportSFTP, exportSCP, u.Scheme)
+	}
+	if u.User == nil || u.User.Username() == "" || u.Hostname() == "" {
+		return nil, errors.New("export URL needs a user and a host")
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, errors.New("export URL must not hold a password, set EXPORT_PASSWORD instead")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	hostKeys, err := knownhosts.New(cfg.ExportKnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot load export known hosts: %w", err)
+	}
+	var auth []ssh.AuthMethod
+	if cfg.ExportKey != "" {
+		pem, err := os.ReadFile(cfg.ExportKey)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && cfg.ExportPassword != "":
+			// The DaemonSet points at the key of the Secret, which
+			// need not have one.
+		case err != nil:
+			return nil, fmt.Errorf("cannot read export key: %w", err)
+		default:
+			signer, err := ssh.ParsePrivateKey(pem)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse export key: %w", err)
+			}
+			auth = append(auth, ssh.PublicKeys(signer))
+		}
+	}
+	if cfg.ExportPassword != "" {
+		auth = append(auth, ssh.Password(cfg.ExportPassword))
+	}
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+	e := &fileExporter{
+		protocol: u.Scheme,
+		addr:     addr,
+		dir:      dir,
+		node:     node,
+		tracer:   tracer,
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            auth,
+			HostKeyCallback: hostKeys,
+			Timeout:         exportTimeout,
+		},
+		spool: filepath.Join(cfg.CaptureDir, exportSpool),
+		wake:  make(chan struct{}, 1),
+	}
+	go e.run()
+	return e, nil
+}
+
+// add queues the finished file f for export. A file queued again under
+// the same name, like a rewritten manifest or the next file of a ring
+// slot, replaces the one waiting.
+func (e *fileExporter) add(f string) {
+	if e == nil {
+		return
+	}
+	if err := os.MkdirAll(e.spool, 0o755); err != nil {
+		slog.Error("Cannot queue file for export", "file", f, "err", err)
+		return
+	}
+	name := filepath.Base(f)
+	tmp := filepath.Join(e.spool, name+".tmp")
+	os.Remove(tmp)
+	if err := os.Link(f, tmp); err != nil {
+		// Files on a storage target live on another filesystem.
+		if err = copyFile(f, tmp); err != nil {
+			os.Remove(tmp)
+			slog.Error("Cannot queue file for export", "file", f, "err", err)
+			return
+		}
+	}
+	if err := os.Rename(tmp, filepath.Join(e.spool, name)); err != nil {
+		os.Remove(tmp)
+		slog.Error("Cannot queue file for export", "file", f, "err", err)
+		return
+	}
+	select {
+	case e.wake <- struct{}{}:
+	default:
+	}
+}
+
+// copyFile copies the file src to dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// run exports the spooled files whenever there are any, backing off while
+// exports fail without getting anywhere.
+func (e *fileExporter) run() {
+	backoff := exportBackoff
+	for {
+		pending := e.pending()
+		exportPending.Set(float64(len(pending)))
+		if len(pending) == 0 {
+			<-e.wake
+			continue
+		}
+		progressed, err := e.export(pending)
+		if err != nil {
+			exportFailures.Inc()
+			if progressed {
+				// The link is flaky rather than down.
+				backoff = exportBackoff
+			}
+			slog.Warn("Export failed, retrying", "server", e.addr, "in", backoff, "err", err)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, maxExportBackoff)
+			continue
+		}
+		backoff = exportBackoff
+	}
+}
+
+// pending lists the spooled files by name.
+func (e *fileExporter) pending() []string {
+	entries, _ := os.ReadDir(e.spool)
+	var files []string
+	for _, entry := range entries {
+		if entry.Type().IsRegular() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			files = append(files, entry.Name())
+		}
+	}
+	return files
+}
+
+// waiting reports whether files of the session with sessionID of a Pod in
+// namespace, or of any of its sessions if sessionID is empty, are waiting
+// to be exported.
+func (e *fileExporter) waiting(namespace, sessionID string) bool {
+	if e == nil {
+		return false
+	}
+	for _, name := range e.pending() {
+		if f, ok := parseCaptureFile(name); ok && f.Namespace == namespace && (sessionID == "" || f.SessionID == sessionID) {
+			return true
+		}
+	}
+	return false
+}
+
+// export uploads files over one connection, removing each from the spool
+// once it is on the server. It reports whether any upload got further.
+func (e *fileExporter) export(files []string) (progressed bool, err error) {
+	client, err := e.dial()
+	if err != nil {
+		return false, err
+	}
+	defer client.Close()
+	var sc *sftp.Client
+	if e.protocol == exportSFTP {
+		if sc, err = sftp.NewClient(client); err != nil {
+			return false, fmt.Errorf("cannot start SFTP: %w", err)
+		}
+		defer sc.Close()
+	}
+	for _, name := range files {
+		spooled := filepath.Join(e.spool, name)
+		f, err := os.Open(spooled)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return progressed, err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			cf, _ := parseCaptureFile(name)
+			upload := e.tracer.span("upload", cf.SessionID, attr("file.name", name), attr("file.size", info.Size()), attr("server.address", e.addr))
+			dir := e.remoteDir(name)
+			if sc != nil {
+				var uploaded bool
+				uploaded, err = e.resumeUpload(sc, dir, name, f, info)
+				progressed = progressed || uploaded
+			} else {
+				err = scpUpload(client, dir, name, f, info.Size())
+			}
+			upload.end(err)
+		}
+		f.Close()
+		if err != nil {
+			return progressed, fmt.Errorf("cannot export %s: %w", name, err)
+		}
+		progressed = true
+		// Keep the file if it was queued again during the upload.
+		if now, err := os.Stat(spooled); err == nil && os.SameFile(info, now) {
+			os.Remove(spooled)
+		}
+		exportedFiles.Inc()
+		slog.Info("Exported file", "file", name, "server", e.addr)
+	}
+	return progressed, nil
+}
+
+// dial connects to the export server. Reads and writes that stall for
+// exportStallTimeout fail, since a link that silently dropped would
+// otherwise block exports until the kernel gives up on it.
+func (e *fileExporter) dial() (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", e.addr, exportTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c, chans, reqs, err := ssh.NewClientConn(stallConn{conn}, e.addr, e.config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// stallConn fails reads and writes that make no progress for
+// exportStallTimeout.
+type stallConn struct {
+	net.Conn
+}
+
+func (c stallConn) Read(p []byte) (int, error) {
+	c.SetReadDeadline(time.Now().Add(exportStallTimeout))
+	return c.Conn.Read(p)
+}
+
+func (c stallConn) Write(p []byte) (int, error) {
+	c.SetWriteDeadline(time.Now().Add(exportStallTimeout))
+	return c.Conn.Write(p)
+}
+
+// uploadProgress is the persisted progress of the SFTP upload of a spooled
+// file, so an upload cut off by a broken connection or a restart of the
+// agent continues from its last checkpoint instead of starting over.
+type uploadProgress struct {
+	// Size and ModTime tell the spooled file from one queued again under
+	// its name, whose upload starts over.
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Remote is the temporary file on the server, which holds the first
+	// Offset bytes of the file.
+	Remote string `json:"remote"`
+	Offset int64  `json:"offset"`
+}
+
+func (e *fileExporter) progressPath(name string) string {
+	return filepath.Join(e.spool, exportUploads, name+".json")
+}
+
+// resumeOffset returns where the upload of the spooled file name with info
+// to remote continues: the last checkpoint, if it is of the same file and
+// the server still has its bytes, or the start.
+func (e *fileExporter) resumeOffset(c *sftp.Client, name string, info os.FileInfo, remote string) int64 {
+	var p uploadProgress
+	data, err := os.ReadFile(e.progressPath(name))
+	if err != nil || json.Unmarshal(data, &p) != nil {
+		return 0
+	}
+	if p.Size != info.Size() || !p.ModTime.Equal(info.ModTime()) || p.Remote != remote || p.Offset > p.Size {
+		return 0
+	}
+	if rinfo, err := c.Stat(remote); err != nil || rinfo.Size() < p.Offset {
+		return 0
+	}
+	return p.Offset
+}
+
+// resumeUpload writes the spooled file f with info to dir/name like
+// sftpUpload, in chunks of exportChunk whose progress is checkpointed in
+// the spool. It reports whether any bytes made it to the server.
+func (e *fileExporter) resumeUpload(c *sftp.Client, dir, name string, f *os.File, info os.FileInfo) (bool, error) {
+	if err := c.MkdirAll(dir); err != nil {
+		return false, err
+	}
+	dst := path.Join(dir, name)
+	tmp := dst + ".tmp"
+	offset := e.resumeOffset(c, name, info, tmp)
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	} else {
+		slog.Info("Resuming export", "file", name, "offset", offset, "size", info.Size(), "server", e.addr)
+	}
+	w, err := c.OpenFile(tmp, flags)
+	if err != nil {
+		return false, err
+	}
+	if _, err := w.Seek(offset, io.SeekStart); err != nil {
+		w.Close()
+		return false, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		w.Close()
+		return false, err
+	}
+	if err := os.MkdirAll(filepath.Dir(e.progressPath(name)), 0o755); err != nil {
+		w.Close()
+		return false, err
+	}
+	progressed := false
+	for offset < info.Size() {
+		n, err := io.CopyN(w, f, min(exportChunk, info.Size()-offset))
+		offset += n
+		progressed = progressed || n > 0
+		if err != nil {
+			w.Close()
+			return progressed, err
+		}
+		p := uploadProgress{Size: info.Size(), ModTime: info.ModTime(), Remote: tmp, Offset: offset}
+		if err := writeFileAtomic(e.progressPath(name), p); err != nil {
+			slog.Warn("Cannot checkpoint export", "file", name, "err", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		return progressed, err
+	}
+	if err := sftpReplace(c, tmp, dst); err != nil {
+		return progressed, err
+	}
+	os.Remove(e.progressPath(name))
+	return true, nil
+}
+
+// remoteDir is where a file goes on the server: the directory of its
+// session, like on the node, or one per node for the node capture.
+func (e *fileExporter) remoteDir(name string) string {
+	if f, ok := parseCaptureFile(name); ok && !f.legacy() {
+		return path.Join(e.dir, f.Namespace, f.Pod, f.SessionID)
+	}
+	return path.Join(e.dir, e.node)
+}
+
+// location returns the URL the file name is exported to, or "" if exports
+// are not configured.
+func (e *fileExporter) location(name string) string {
+	if e == nil {
+		return ""
+	}
+	return e.url(path.Join(e.remoteDir(name), name))
+}
+
+// dirLocation returns the URL of the directory the file name is exported
+// to, or "" if exports are not configured.
+func (e *fileExporter) dirLocation(name string) string {
+	if e == nil {
+		return ""
+	}
+	return e.url(e.remoteDir(name))
+}
+
+func (e *fileExporter) url(p string) string {
+	u := url.URL{Scheme: e.protocol, User: url.User(e.config.User), Host: e.addr, Path: p}
+	return u.String()
+}
+
+// sftpUpload writes f to dir/name through a temporary file, so a partial
+// file is never visible on the server.
+func sftpUpload(c *sftp.Client, dir, name string, f io.Reader) error {
+	if err := c.MkdirAll(dir); err != nil {
+		return err
+	}
+	dst := path.Join(dir, name)
+	tmp := dst + ".tmp"
+	w, err := c.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = w.ReadFrom(f)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.Remove(tmp)
+		return err
+	}
+	return sftpReplace(c, tmp, dst)
+}
+
+// sftpReplace renames the uploaded tmp to dst, replacing dst.
+func sftpReplace(c *sftp.Client, tmp, dst string) error {
+	if err := c.PosixRename(tmp, dst); err != nil {
+		// Servers without the rename extension do not replace files.
+		c.Remove(dst)
+		return c.Rename(tmp, dst)
+	}
+	return nil
+}
+
+// scpUpload writes f of size bytes to dir/name with the sink side of scp,
+// which the server runs after creating dir.
+func scpUpload(client *ssh.Client, dir, name string, f io.Reader, size int64) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	in, err := session.StdinPipe()
+	if err != nil {
+		return err
+	}
+	out, err := session.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := session.Start("mkdir -p " + shellQuote(dir) + " && scp -t " + shellQuote(dir)); err != nil {
+		return err
+	}
+	// The sink acknowledges with a zero byte, or reports an error on a
+	// line of its own.
+	ack := func() error {
+		var b [1]byte
+		if _, err := io.ReadFull(out, b[:]); err != nil {
+			return fmt.Errorf("scp: %w", err)
+		}
+		if b[0] == 0 {
+			return nil
+		}
+		msg, _ := io.ReadAll(io.LimitReader(out, 1024))
+		return fmt.Errorf("scp: %s", strings.TrimSpace(strings.SplitN(string(msg), "\n", 2)[0]))
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(in, "C0644 %d %s\n", size, name); err != nil {
+		return err
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(in, f, size); err != nil {
+		return err
+	}
+	if _, err := in.Write([]byte{0}); err != nil {
+		return err
+	}
+	if err := ack(); err != nil {
+		return err
+	}
+	in.Close()
+	return session.Wait()
+}
+
+// shellQuote quotes s for the POSIX shell of the server.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
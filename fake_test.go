@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// backendFake names the fake backend in tests.
+const backendFake = "fake"
+
+// fakePacketInterval is how often the fake backend writes a packet.
+const fakePacketInterval = 100 * time.Millisecond
+
+// fakeBackend captures nothing: it writes a synthetic UDP packet every
+// fakePacketInterval into the capture's ring. It needs no privileges and no
+// capture program, so tests exercise the agent's capture lifecycle, from
+// the annotation to the result, with it. It remembers the captures it
+// started, StartErr makes them fail, and Exit makes the running ones exit.
+type fakeBackend struct {
+	mu sync.Mutex
+	// StartErr is returned by Start when set.
+	StartErr error
+	started  []captureSpec
+	running  int
+	exits    []chan error
+}
+
+func (b *fakeBackend) Name() string { return backendFake }
+
+func (b *fakeBackend) Check() error { return nil }
+
+func (b *fakeBackend) Start(ctx context.Context, spec captureSpec) (runningCapture, error) {
+	b.mu.Lock()
+	err := b.StartErr
+	if err == nil {
+		b.started = append(b.started, spec)
+		b.running++
+	}
+	b.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	ring := newRingWriter(spec, spec.Interface, layers.LinkTypeEthernet, spec.snaplen())
+	if err := ring.open(); err != nil {
+		b.stopped()
+		return nil, err
+	}
+	c := &fakeCapture{stats: ring.stats, done: make(chan struct{}), exit: make(chan error, 1)}
+	b.mu.Lock()
+	b.exits = append(b.exits, c.exit)
+	b.mu.Unlock()
+	go func() {
+		defer close(c.done)
+		defer b.stopped()
+		defer c.stats.meter.track()()
+		c.err = c.run(ctx, ring)
+		if cerr := ring.Close(); c.err == nil {
+			c.err = cerr
+		}
+	}()
+	return c, nil
+}
+
+func (b *fakeBackend) stopped() {
+	b.mu.Lock()
+	b.running--
+	b.mu.Unlock()
+}
+
+// Started returns the specs of the captures started so far, oldest first.
+func (b *fakeBackend) Started() []captureSpec {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]captureSpec(nil), b.started...)
+}
+
+// Exit makes the captures started so far exit with err, as if the capture
+// program had died.
+func (b *fakeBackend) Exit(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, exit := range b.exits {
+		select {
+		case exit <- err:
+		default:
+		}
+	}
+	b.exits = nil
+}
+
+// Running returns how many captures have not ended yet.
+func (b *fakeBackend) Running() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.running
+}
+
+// fakeCapture is a capture of the fake backend.
+type fakeCapture struct {
+	stats *packetStats
+	done  chan struct{}
+	exit  chan error
+	err   error
+}
+
+func (c *fakeCapture) PID() int            { return 0 }
+func (c *fakeCapture) Args() []string      { return nil }
+func (c *fakeCapture) Stats() captureStats { return c.stats.snapshot() }
+func (c *fakeCapture) Cost() captureCost   { return c.stats.cost(0) }
+
+func (c *fakeCapture) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// run writes packets until ctx is cancelled, the packet count is reached
+// or the capture is made to exit.
+func (c *fakeCapture) run(ctx context.Context, ring *ringWriter) error {
+	ticker := time.NewTicker(fakePacketInterval)
+	defer ticker.Stop()
+	for n := 0; ; n++ {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-c.exit:
+			return err
+		case now := <-ticker.C:
+			data, err := fakePacket(n)
+			if err != nil {
+				return err
+			}
+			c.stats.received.Add(1)
+			ci := gopacket.CaptureInfo{Timestamp: now, CaptureLength: len(data), Length: len(data)}
+			if err := ring.WritePacket(ci, data); errors.Is(err, errCaptureComplete) {
+				return err
+			} else if err != nil {
+				return fmt.Errorf("failed to write packet: %w", err)
+			}
+		}
+	}
+}
+
+// fakePacket returns the n-th packet of the fake backend, a UDP datagram
+// between documentation addresses to the discard port.
+func fakePacket(n int) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{0x02, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    net.IPv4(192, 0, 2, 1),
+		DstIP:    net.IPv4(192, 0, 2, 2),
+	}
+	udp := &layers.UDP{SrcPort: 40000, DstPort: 9}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	payload := gopacket.Payload(fmt.Sprintf("fake packet %d", n))
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, udp, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// collectOrphans runs once after the Pod cache has synced and before any
+// capture is started. It matches the files left in the capture directory by
+// a previous agent instance against the Pods on this node and removes the
+// ones the retention policy no longer wants:
+//
+//   - files of Pods that no longer exist are deleted in the delete and
+//     pod-delete modes
+//   - files of Pods that exist but are no longer annotated are deleted in the
+//     delete mode
+//
+// Everything else is kept; the ttl janitor expires old files on its own and
+// captures of still-annotated Pods are resumed by the workqueue.
+func (m *CaptureManager) collectOrphans() {
+	// Scratch directories of analyzer runs the previous instance did not
+	// finish.
+	scratch, _ := filepath.Glob(filepath.Join(m.cfg.CaptureDir, analyzerScratch+"*"))
+	for _, dir := range scratch {
+		os.RemoveAll(dir)
+	}
+	if removed, kept, err := m.removeOrphans(); err != nil {
+		slog.Error("Failed to collect orphaned capture files", "err", err)
+	} else if removed+kept > 0 {
+		slog.Info("Collected orphaned capture files", "removed", removed, "kept", kept, "retention", m.cfg.Retention.Mode)
+	}
+}
+
+// removeOrphans removes the capture files collectOrphans describes and
+// returns how many it removed and kept. Files of running captures are
+// always kept, so it is safe to run while captures are.
+func (m *CaptureManager) removeOrphans() (removed, kept int, err error) {
+	matches, err := m.listCaptureFiles()
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot list capture files in %s: %w", m.cfg.CaptureDir, err)
+	}
+	if len(matches) == 0 {
+		return 0, 0, nil
+	}
+
+	pods, err := m.podLister.List(labels.Everything())
+	if err != nil {
+		return 0, 0, fmt.Errorf("cannot list pods: %w", err)
+	}
+	// Files are matched to Pods by UID, so those of an earlier Pod of the
+	// same name count as orphaned; files of earlier versions only carry
+	// the Pod name.
+	byUID := make(map[string]bool, len(pods))
+	byName := make(map[string]bool, len(pods))
+	for _, pod := range pods {
+		_, ok := m.captureAnnotations(pod)[annotationKey]
+		for _, session := range sessionNames(pod.Annotations) {
+			_, named := pod.Annotations[sessionAnnotationKey(annotationKey, session)]
+			ok = ok || named
+		}
+		byUID[fileUID(pod.UID)] = ok
+		byName[pod.Name] = byName[pod.Name] || ok
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, f := range matches {
+		if m.isActiveFile(f) {
+			kept++
+			continue
+		}
+		cf, _ := parseCaptureFile(filepath.Base(f))
+		podAnnotated, podExists := byUID[cf.UID]
+		if cf.legacy() {
+			podAnnotated, podExists = byName[cf.Pod]
+		}
+		remove := false
+		switch {
+		case podAnnotated:
+		case !podExists:
+			remove = m.cfg.Retention.Mode == RetentionDelete || m.cfg.Retention.Mode == RetentionPodDelete
+		default:
+			remove = m.cfg.Retention.Mode == RetentionDelete
+		}
+		if remove {
+			m.removeFile(f, "orphaned")
+			removed++
+		} else {
+			kept++
+		}
+	}
+	m.pruneSessionDirs()
+	return removed, kept, nil
+}
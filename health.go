@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const apiServerCheckTimeout = 3 * time.Second
+
+// healthCheck is a named probe; a nil error means healthy.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// livenessChecks only include conditions a restart can fix or that make the
+// agent useless. API server outages must not restart every agent.
+func (m *CaptureManager) livenessChecks() []healthCheck {
+	return []healthCheck{
+		{"backend", m.checkBackend},
+	}
+}
+
+// readinessChecks gate the agent on everything it needs to serve captures.
+func (m *CaptureManager) readinessChecks() []healthCheck {
+	return []healthCheck{
+		{"informer-sync", m.checkInformerSync},
+		{"apiserver", m.checkAPIServer},
+		{"backend", m.checkBackend},
+	}
+}
+
+func (m *CaptureManager) checkBackend(context.Context) error {
+	return m.backends[m.cfg.Backend].Check()
+}
+
+func (m *CaptureManager) checkInformerSync(context.Context) error {
+	if !m.synced.Load() {
+		return errors.New("pod informer cache not synced")
+	}
+	return nil
+}
+
+func (m *CaptureManager) checkAPIServer(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, apiServerCheckTimeout)
+	defer cancel()
+	return m.clientset.Discovery().RESTClient().Get().AbsPath("/readyz").Do(ctx).Error()
+}
+
+// healthHandler runs the checks and reports each result in the body, in the
+// same "[+]name ok" style as the Kubernetes components.
+func healthHandler(checks func() []healthCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var b strings.Builder
+		failed := false
+		for _, c := range checks() {
+			if err := c.check(r.Context()); err != nil {
+				failed = true
+				fmt.Fprintf(&b, "[-]%s failed: %v\n", c.name, err)
+			} else {
+				fmt.Fprintf(&b, "[+]%s ok\n", c.name)
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if failed {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			b.WriteString("check failed\n")
+		} else {
+			b.WriteString("ok\n")
+		}
+		w.Write([]byte(b.String()))
+	})
+}
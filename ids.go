@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// IDS analyzers stopped captures can be run through.
+const (
+	analyzerSuricata = "suricata"
+	analyzerZeek     = "zeek"
+)
+
+const (
+	// alertsSuffix names the alerts of a stopped capture after its base
+	// file name.
+	alertsSuffix = ".alerts.json"
+	// analyzerTimeout bounds the analyzer's run on a single file.
+	analyzerTimeout = 10 * time.Minute
+	// analyzerScratch prefixes the scratch directories of analyzer runs in
+	// the capture directory.
+	analyzerScratch = ".analyze-"
+	// statusAlerts is how many alert kinds the status annotation lists;
+	// the alerts file has them all.
+	statusAlerts = 5
+)
+
+// reasonIDSAlerts is recorded when the analyzer raised alerts for a
+// capture.
+const reasonIDSAlerts = "IDSAlerts"
+
+// idsAlert is an alert or notice raised by the analyzer.
+type idsAlert struct {
+	Time      string `json:"time,omitempty"`
+	Signature string `json:"signature"`
+	Category  string `json:"category,omitempty"`
+	Severity  int    `json:"severity,omitempty"`
+	Src       string `json:"src,omitempty"`
+	Dst       string `json:"dst,omitempty"`
+	File      string `json:"file"`
+}
+
+// alertCount counts the alerts of one signature.
+type alertCount struct {
+	Signature string `json:"signature"`
+	Severity  int    `json:"severity,omitempty"`
+	Count     int    `json:"count"`
+}
+
+// alertSummary is what the status annotation shows of the alerts.
+type alertSummary struct {
+	Analyzer string       `json:"analyzer"`
+	Count    int          `json:"count"`
+	File     string       `json:"file"`
+	Top      []alertCount `json:"top,omitempty"`
+	Errors   []string     `json:"errors,omitempty"`
+}
+
+// analyze runs the configured analyzer over files of the stopped capture
+// cap, one file at a time, and writes every alert next to them. It returns
+// nil if the alerts could not be written.
+func (m *CaptureManager) analyze(cap *CaptureProcess, files []string) *alertSummary {
+	summary := &alertSummary{Analyzer: m.cfg.Analyzer}
+	var alerts []idsAlert
+	for _, f := range files {
+		found, err := m.analyzeFile(f)
+		if err != nil {
+			cap.log.Warn("Analyzer failed", "analyzer", m.cfg.Analyzer, "file", filepath.Base(f), "err", err)
+			summary.Errors = append(summary.Errors, fmt.Sprintf("%s: %v", filepath.Base(f), err))
+			continue
+		}
+		alerts = append(alerts, found...)
+	}
+	path := cap.files[0] + alertsSuffix
+	if alerts == nil {
+		alerts = []idsAlert{}
+	}
+	if err := writeFileAtomic(path, alerts); err != nil {
+		cap.log.Error("Failed to write analyzer alerts", "err", err)
+		return nil
+	}
+	summary.Count, summary.File = len(alerts), filepath.Base(path)
+	counts := make(map[string]*alertCount)
+	for _, a := range alerts {
+		c := counts[a.Signature]
+		if c == nil {
+			c = &alertCount{Signature: a.Signature, Severity: a.Severity}
+			counts[a.Signature] = c
+		}
+		c.Count++
+	}
+	for _, c := range counts {
+		summary.Top = append(summary.Top, *c)
+	}
+	// Suricata's severity 1 is the highest.
+	sort.Slice(summary.Top, func(i, j int) bool {
+		a, b := summary.Top[i], summary.Top[j]
+		if a.Severity != b.Severity {
+			return a.Severity != 0 && (b.Severity == 0 || a.Severity < b.Severity)
+		}
+		return a.Count > b.Count || a.Count == b.Count && a.Signature < b.Signature
+	})
+	summary.Top = summary.Top[:min(len(summary.Top), statusAlerts)]
+	cap.log.Info("Analyzer finished", "analyzer", m.cfg.Analyzer, "alerts", summary.Count)
+	return summary
+}
+
+// analyzeFile runs the analyzer over the pcapng file f in a scratch
+// directory and returns its alerts. Neither Suricata nor Zeek reads
+// compressed files, so f is copied there decompressed first; the copy
+// also keeps the ring from replacing the file during the run.
+func (m *CaptureManager) analyzeFile(f string) ([]idsAlert, error) {
+	dir, err := os.MkdirTemp(m.cfg.CaptureDir, analyzerScratch)
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	input := filepath.Join(dir, "input.pcapng")
+	if err := copyCaptureFile(f, input, m.fileKey); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), analyzerTimeout)
+	defer cancel()
+	var cmd *exec.Cmd
+	var log string
+	switch m.cfg.Analyzer {
+	case analyzerSuricata:
+		args := []string{"-r", input, "-l", dir, "-k", "none", "--runmode", "single"}
+		if m.cfg.AnalyzerRules != "" {
+			args = append(args, "-S", m.cfg.AnalyzerRules)
+		}
+		cmd, log = exec.CommandContext(ctx, m.cfg.AnalyzerPath, args...), "eve.json"
+	case analyzerZeek:
+		args := []string{"-C", "-r", input, "LogAscii::use_json=T"}
+		if m.cfg.AnalyzerRules != "" {
+			args = append(args, m.cfg.AnalyzerRules)
+		}
+		cmd, log = exec.CommandContext(ctx, m.cfg.AnalyzerPath, args...), "notice.log"
+	}
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", m.cfg.Analyzer, err, bytes.TrimSpace(out[max(0, len(out)-512):]))
+	}
+	return readAlerts(m.cfg.Analyzer, filepath.Join(dir, log), filepath.Base(f))
+}
+
+// copyCaptureFile copies the capture file src to dst, decrypted with key
+// and decompressed.
+func copyCaptureFile(src, dst string, key *fileKey) error {
+	in, err := openCaptureFile(src, key)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// readAlerts parses the alerts of the analyzer's JSON log: Suricata's
+// alert events in eve.json or Zeek's notices. A missing log means no
+// alerts.
+func readAlerts(analyzer, log, file string) ([]idsAlert, error) {
+	in, err := os.Open(log)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	var alerts []idsAlert
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var a idsAlert
+		switch analyzer {
+		case analyzerSuricata:
+			var e struct {
+				Timestamp string `json:"timestamp"`
+				EventType string `json:"event_type"`
+				SrcIP     string `json:"src_ip"`
+				DestIP    string `json:"dest_ip"`
+				Alert     struct {
+					Signature string `json:"signature"`
+					Category  string `json:"category"`
+					Severity  int    `json:"severity"`
+				} `json:"alert"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &e) != nil || e.EventType != "alert" {
+				continue
+			}
+			a = idsAlert{Time: e.Timestamp, Signature: e.Alert.Signature, Category: e.Alert.Category,
+				Severity: e.Alert.Severity, Src: e.SrcIP, Dst: e.DestIP}
+		case analyzerZeek:
+			var n struct {
+				TS   float64 `json:"ts"`
+				Note string  `json:"note"`
+				Msg  string  `json:"msg"`
+				Src  string  `json:"src"`
+				Dst  string  `json:"dst"`
+			}
+			if json.Unmarshal(scanner.Bytes(), &n) != nil {
+				continue
+			}
+			sec := int64(n.TS)
+			a = idsAlert{Time: time.Unix(sec, int64((n.TS-float64(sec))*1e9)).UTC().Format(time.RFC3339Nano),
+				Signature: n.Note, Category: n.Msg, Src: n.Src, Dst: n.Dst}
+		}
+		a.File = file
+		alerts = append(alerts, a)
+	}
+	return alerts, scanner.Err()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// checkIncident starts a triggered capture when a Pod matching the health
+// selector enters CrashLoopBackOff or stops being ready while its
+// containers keep running, which the kubelet only does after the readiness
+// probe failed its failureThreshold times in a row. The Pod's network
+// namespace outlives container restarts, so the capture spans them.
+func (m *CaptureManager) checkIncident(oldObj, obj interface{}) {
+	if m.healthSelector == nil {
+		return
+	}
+	old, ok := oldObj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.HostNetwork || !m.healthSelector.Matches(labels.Set(pod.Labels)) {
+		return
+	}
+	reason := podIncident(old, pod)
+	if reason == "" {
+		return
+	}
+	slog.Info("Pod health incident", "namespace", pod.Namespace, "pod", pod.Name, "incident", reason)
+	m.triggerCapture(pod, reasonHealthIncident, reason, m.cfg.HealthCaptureDuration)
+}
+
+// podIncident describes the first container of pod that entered
+// CrashLoopBackOff or became unready while running since old, or returns
+// "".
+func podIncident(old, pod *corev1.Pod) string {
+	before := make(map[string]corev1.ContainerStatus, len(old.Status.ContainerStatuses))
+	for _, cs := range old.Status.ContainerStatuses {
+		before[cs.Name] = cs
+	}
+	for _, cs := range pod.Status.ContainerStatuses {
+		prev, ok := before[cs.Name]
+		if !ok {
+			continue
+		}
+		if crashLooping(cs) && !crashLooping(prev) {
+			return fmt.Sprintf("Container %s is in CrashLoopBackOff after %d restarts", cs.Name, cs.RestartCount)
+		}
+		if prev.Ready && !cs.Ready && cs.State.Running != nil && cs.RestartCount == prev.RestartCount {
+			return fmt.Sprintf("Container %s failed its readiness probe", cs.Name)
+		}
+	}
+	return ""
+}
+
+func crashLooping(cs corev1.ContainerStatus) bool {
+	return cs.State.Waiting != nil && cs.State.Waiting.Reason == "CrashLoopBackOff"
+}
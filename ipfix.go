@@ -0,0 +1,428 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// outputIPFIX aggregates the captured packets into flows and exports them
+// to the IPFIX collector instead of writing them.
+const outputIPFIX = "ipfix"
+
+const (
+	ipfixVersion = 10
+	// ipfixTemplateSet is the set ID of template sets.
+	ipfixTemplateSet = 2
+	// ipfixTemplateIPv4 and ipfixTemplateIPv6 are the templates of the
+	// data records the agent exports.
+	ipfixTemplateIPv4 = 256
+	ipfixTemplateIPv6 = 257
+	// ipfixMaxMessage keeps messages within one unfragmented UDP datagram.
+	ipfixMaxMessage = 1400
+	// ipfixMaxFlows bounds the flows a capture tracks; when full, every flow
+	// is exported for lack of resources and tracking starts over.
+	ipfixMaxFlows = 65536
+)
+
+// IANA flowEndReason values.
+const (
+	flowEndIdle      = 1
+	flowEndActive    = 2
+	flowEndDetected  = 3
+	flowEndForced    = 4
+	flowEndResources = 5
+)
+
+// ipfixField is an information element of a template, by IANA ID and
+// encoded length.
+type ipfixField struct {
+	id, length uint16
+}
+
+func ipfixTemplate(v6 bool) []ipfixField {
+	src, dst := ipfixField{8, 4}, ipfixField{12, 4} // sourceIPv4Address, destinationIPv4Address
+	if v6 {
+		src, dst = ipfixField{27, 16}, ipfixField{28, 16} // sourceIPv6Address, destinationIPv6Address
+	}
+	return []ipfixField{
+		src, dst,
+		{7, 2},   // sourceTransportPort
+		{11, 2},  // destinationTransportPort
+		{4, 1},   // protocolIdentifier
+		{6, 2},   // tcpControlBits
+		{1, 8},   // octetDeltaCount
+		{2, 8},   // packetDeltaCount
+		{152, 8}, // flowStartMilliseconds
+		{153, 8}, // flowEndMilliseconds
+		{136, 1}, // flowEndReason
+	}
+}
+
+// ipfixExporter sends IPFIX messages over UDP to the configured collector.
+// It is shared by every capture; each capture exports in its own
+// observation domain, derived from its session ID.
+type ipfixExporter struct {
+	conn           net.Conn
+	activeTimeout  time.Duration
+	idleTimeout    time.Duration
+	mu             sync.Mutex
+	sequences      map[uint32]uint32
+	templateRecord []byte
+}
+
+// newIPFIXExporter connects to the IPFIX collector. It returns nil if no
+// collector is configured.
+func newIPFIXExporter(cfg *Config) (*ipfixExporter, error) {
+	if cfg.IPFIXCollector == "" {
+		return nil, nil
+	}
+	conn, err := net.Dial("udp", cfg.IPFIXCollector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to IPFIX collector: %w", err)
+	}
+	e := &ipfixExporter{
+		conn:          conn,
+		activeTimeout: cfg.IPFIXActiveTimeout,
+		idleTimeout:   cfg.IPFIXIdleTimeout,
+		sequences:     make(map[uint32]uint32),
+	}
+	e.templateRecord = appendTemplateSet(nil)
+	return e, nil
+}
+
+// appendTemplateSet appends the template set of both record types.
+func appendTemplateSet(b []byte) []byte {
+	start := len(b)
+	b = binary.BigEndian.AppendUint16(b, ipfixTemplateSet)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	for _, t := range []struct {
+		id uint16
+		v6 bool
+	}{{ipfixTemplateIPv4, false}, {ipfixTemplateIPv6, true}} {
+		fields := ipfixTemplate(t.v6)
+		b = binary.BigEndian.AppendUint16(b, t.id)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = binary.BigEndian.AppendUint16(b, f.id)
+			b = binary.BigEndian.AppendUint16(b, f.length)
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// export sends records in as few messages as fit a datagram. UDP
+// collectors may start or restart at any time, so every message carries
+// the templates.
+func (e *ipfixExporter) export(domain uint32, records []*flowRecord) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for len(records) > 0 {
+		msg := make([]byte, 16, ipfixMaxMessage)
+		msg = append(msg, e.templateRecord...)
+		n := 0
+		for _, v6 := range []bool{false, true} {
+			setStart := -1
+			for _, r := range records {
+				if r.v6 != v6 {
+					continue
+				}
+				if len(msg)+r.size() > ipfixMaxMessage {
+					break
+				}
+				if setStart < 0 {
+					setStart = len(msg)
+					id := uint16(ipfixTemplateIPv4)
+					if v6 {
+						id = ipfixTemplateIPv6
+					}
+					msg = binary.BigEndian.AppendUint16(msg, id)
+					msg = binary.BigEndian.AppendUint16(msg, 0)
+				}
+				msg = r.append(msg)
+				r.sent = true
+				n++
+			}
+			if setStart >= 0 {
+				binary.BigEndian.PutUint16(msg[setStart+2:], uint16(len(msg)-setStart))
+			}
+		}
+		binary.BigEndian.PutUint16(msg[0:], ipfixVersion)
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+		binary.BigEndian.PutUint32(msg[4:], uint32(time.Now().Unix()))
+		// The sequence number counts the data records sent before.
+		binary.BigEndian.PutUint32(msg[8:], e.sequences[domain])
+		binary.BigEndian.PutUint32(msg[12:], domain)
+		e.sequences[domain] += uint32(n)
+		if _, err := e.conn.Write(msg); err != nil {
+			return err
+		}
+		remaining := records[:0]
+		for _, r := range records {
+			if !r.sent {
+				remaining = append(remaining, r)
+			}
+		}
+		records = remaining
+	}
+	return nil
+}
+
+// flowSink receives the flows a flowTable expires.
+type flowSink interface {
+	exportFlows(spec captureSpec, records []*flowRecord) error
+	// flowTimeouts returns the idle and active timeouts of the flows.
+	flowTimeouts() (idle, active time.Duration)
+}
+
+// exportFlows exports the flows of the capture spec in its own observation
+// domain.
+func (e *ipfixExporter) exportFlows(spec captureSpec, records []*flowRecord) error {
+	if err := e.export(crc32.ChecksumIEEE([]byte(spec.SessionID)), records); err != nil {
+		ipfixExportFailures.Inc()
+		return err
+	}
+	flowsExported.Add(float64(len(records)))
+	return nil
+}
+
+func (e *ipfixExporter) flowTimeouts() (time.Duration, time.Duration) {
+	return e.idleTimeout, e.activeTimeout
+}
+
+// flowTuple identifies a unidirectional flow.
+type flowTuple struct {
+	src, dst     [16]byte
+	sport, dport uint16
+	proto        uint8
+	v6           bool
+}
+
+// flowRecord accumulates the packets of one flow until it is exported.
+type flowRecord struct {
+	flowTuple
+	packets, bytes uint64
+	tcpFlags       uint16
+	start, end     time.Time
+	// reason is set once the flow ended.
+	reason uint8
+	sent   bool
+}
+
+func (r *flowRecord) size() int {
+	if r.v6 {
+		return 72
+	}
+	return 48
+}
+
+func (r *flowRecord) append(b []byte) []byte {
+	if r.v6 {
+		b = append(b, r.src[:]...)
+		b = append(b, r.dst[:]...)
+	} else {
+		b = append(b, r.src[:4]...)
+		b = append(b, r.dst[:4]...)
+	}
+	b = binary.BigEndian.AppendUint16(b, r.sport)
+	b = binary.BigEndian.AppendUint16(b, r.dport)
+	b = append(b, r.proto)
+	b = binary.BigEndian.AppendUint16(b, r.tcpFlags)
+	b = binary.BigEndian.AppendUint64(b, r.bytes)
+	b = binary.BigEndian.AppendUint64(b, r.packets)
+	b = binary.BigEndian.AppendUint64(b, uint64(r.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(r.end.UnixMilli()))
+	return append(b, r.reason)
+}
+
+// flowTable aggregates the packets of one capture run into flows and
+// exports them when they go idle, when they have been active for the
+// active timeout, when TCP ends them and when the capture stops.
+type flowTable struct {
+	sink     flowSink
+	spec     captureSpec
+	linkType layers.LinkType
+	log      *slog.Logger
+
+	mu    sync.Mutex
+	flows map[flowTuple]*flowRecord
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newFlowTable(sink flowSink, spec captureSpec, linkType layers.LinkType) *flowTable {
+	t := &flowTable{
+		sink:     sink,
+		spec:     spec,
+		linkType: linkType,
+		log:      slog.With("namespace", spec.Namespace, "pod", spec.PodName, "session", spec.SessionID),
+		flows:    make(map[flowTuple]*flowRecord),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// add accounts one packet to its flow. Packets without an IP header are
+// not flows and are skipped.
+func (t *flowTable) add(ci gopacket.CaptureInfo, data []byte) {
+	k, flags, ok := packetTuple(gopacket.NewPacket(data, t.linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true}))
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r := t.flows[k]
+	if r == nil {
+		if len(t.flows) >= ipfixMaxFlows {
+			t.expireLocked(func(*flowRecord) uint8 { return flowEndResources })
+		}
+		r = &flowRecord{flowTuple: k, start: ci.Timestamp}
+		t.flows[k] = r
+	}
+	r.packets++
+	r.bytes += uint64(ci.Length)
+	r.tcpFlags |= flags
+	r.end = ci.Timestamp
+	if flags&(tcpFIN|tcpRST) != 0 {
+		r.reason = flowEndDetected
+	}
+}
+
+// packetTuple returns the flow and TCP flags of pkt, or false if it has
+// no IP header.
+func packetTuple(pkt gopacket.Packet) (flowTuple, uint16, bool) {
+	var k flowTuple
+	switch ip := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		copy(k.src[:], ip.SrcIP.To4())
+		copy(k.dst[:], ip.DstIP.To4())
+		k.proto = uint8(ip.Protocol)
+	case *layers.IPv6:
+		copy(k.src[:], ip.SrcIP)
+		copy(k.dst[:], ip.DstIP)
+		k.proto, k.v6 = uint8(ip.NextHeader), true
+	default:
+		return k, 0, false
+	}
+	var flags uint16
+	switch l := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		k.sport, k.dport = uint16(l.SrcPort), uint16(l.DstPort)
+		flags = ipfixTCPFlags(l)
+	case *layers.UDP:
+		k.sport, k.dport = uint16(l.SrcPort), uint16(l.DstPort)
+	case *layers.SCTP:
+		k.sport, k.dport = uint16(l.SrcPort), uint16(l.DstPort)
+	}
+	return k, flags, true
+}
+
+// TCP control bits as encoded in tcpControlBits.
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpRST = 0x04
+	tcpPSH = 0x08
+	tcpACK = 0x10
+	tcpURG = 0x20
+	tcpECE = 0x40
+	tcpCWR = 0x80
+)
+
+func ipfixTCPFlags(l *layers.TCP) uint16 {
+	var f uint16
+	for _, b := range []struct {
+		set  bool
+		flag uint16
+	}{{l.FIN, tcpFIN}, {l.SYN, tcpSYN}, {l.RST, tcpRST}, {l.PSH, tcpPSH}, {l.ACK, tcpACK}, {l.URG, tcpURG}, {l.ECE, tcpECE}, {l.CWR, tcpCWR}} {
+		if b.set {
+			f |= b.flag
+		}
+	}
+	return f
+}
+
+// run expires flows every second until the table is closed.
+func (t *flowTable) run() {
+	defer close(t.done)
+	idle, active := t.sink.flowTimeouts()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case now := <-ticker.C:
+			t.mu.Lock()
+			t.expireLocked(func(r *flowRecord) uint8 {
+				switch {
+				case r.reason != 0:
+					return r.reason
+				case now.Sub(r.end) >= idle:
+					return flowEndIdle
+				case now.Sub(r.start) >= active:
+					return flowEndActive
+				}
+				return 0
+			})
+			t.mu.Unlock()
+		}
+	}
+}
+
+// expireLocked exports the flows reason returns a flowEndReason for.
+// Flows cut by the active timeout keep being tracked with fresh counters.
+// Callers must hold t.mu.
+func (t *flowTable) expireLocked(reason func(*flowRecord) uint8) {
+	var records []*flowRecord
+	for k, r := range t.flows {
+		end := reason(r)
+		if end == 0 {
+			continue
+		}
+		if r.packets == 0 {
+			// Nothing arrived since the active timeout exported it.
+			delete(t.flows, k)
+			continue
+		}
+		out := *r
+		out.reason = end
+		records = append(records, &out)
+		if end == flowEndActive {
+			r.packets, r.bytes, r.tcpFlags, r.start = 0, 0, 0, r.end
+			continue
+		}
+		delete(t.flows, k)
+	}
+	if len(records) == 0 {
+		return
+	}
+	if err := t.sink.exportFlows(t.spec, records); err != nil {
+		t.log.Warn("Failed to export flows", "flows", len(records), "err", err)
+	}
+}
+
+// Close exports the flows still tracked and stops the table.
+func (t *flowTable) Close() {
+	close(t.stop)
+	<-t.done
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expireLocked(func(r *flowRecord) uint8 {
+		if r.reason != 0 {
+			return r.reason
+		}
+		return flowEndForced
+	})
+}
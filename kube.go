@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// restConfig returns the in-cluster config unless a kubeconfig is given via
+// --kubeconfig or KUBECONFIG, which makes it possible to run the agent
+// against a cluster from a development machine.
+func restConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		kubeconfig = os.Getenv(clientcmd.RecommendedConfigPathEnvVar)
+	}
+	if kubeconfig == "" {
+		config, err := rest.InClusterConfig()
+		if err == nil {
+			return config, nil
+		}
+		if err != rest.ErrNotInCluster {
+			return nil, err
+		}
+		slog.Info("Not running in a cluster, falling back to the default kubeconfig")
+	}
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = kubeconfig
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{}).ClientConfig()
+}
+
+// detectNodeName returns the node this agent runs on. NODE_NAME, set from
+// the downward API in the DaemonSet, wins; otherwise the host name is
+// matched against Node names and the kubernetes.io/hostname label.
+func detectNodeName(clientset kubernetes.Interface) (string, error) {
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name, nil
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("NODE_NAME is not set and the host name is unknown: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err = clientset.CoreV1().Nodes().Get(ctx, hostname, metav1.GetOptions{})
+	if err == nil {
+		return hostname, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return "", fmt.Errorf("failed to look up node %q: %w", hostname, err)
+	}
+
+	nodes, err := clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{corev1.LabelHostname: hostname}.String(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to look up node by hostname label: %w", err)
+	}
+	if len(nodes.Items) != 1 {
+		return "", fmt.Errorf("NODE_NAME is not set and %d nodes match host name %q", len(nodes.Items), hostname)
+	}
+	return nodes.Items[0].Name, nil
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Pod captures write into a directory per session,
+// <capture-dir>/<namespace>/<pod>/<sessionID>/, and name their files after
+// everything that tells them apart:
+//
+//	capture-<namespace>_<pod>[_<name>]-<uid>-<start>-<sessionID>.pcap
+//
+// Pods of the same name in different namespaces, a recreated Pod and the
+// next session of the same Pod never share a file, and a file name alone
+// says where the file lives. Namespace, Pod and session names cannot
+// contain underscores, and the last three fields no dashes. Each session
+// directory also holds the session's metadata.json.
+
+const (
+	// sessionStartLayout formats the start of a session in file names.
+	sessionStartLayout = "20060102T150405Z"
+	// fileUIDLength is how much of the Pod UID file names keep.
+	fileUIDLength = 8
+	// sessionMetadataFile names the sessionMetadata in a session
+	// directory.
+	sessionMetadataFile = "metadata.json"
+)
+
+// sessionMetadata records whom a session directory belongs to and when the
+// session ran, so the directory can be accounted for without the agent.
+type sessionMetadata struct {
+	Namespace string     `json:"namespace"`
+	Pod       string     `json:"pod"`
+	PodUID    string     `json:"podUID"`
+	Session   string     `json:"session,omitempty"`
+	SessionID string     `json:"sessionID"`
+	Node      string     `json:"node"`
+	Requester string     `json:"requester,omitempty"`
+	Filter    string     `json:"filter,omitempty"`
+	Backend   string     `json:"backend"`
+	State     string     `json:"state"`
+	StartTime time.Time  `json:"startTime"`
+	EndTime   *time.Time `json:"endTime,omitempty"`
+}
+
+// writeSessionMetadata writes the metadata of the Pod capture cap, which is
+// in state, to its session directory. Sessions that are no longer running
+// get their end time.
+func writeSessionMetadata(cap *CaptureProcess, state string) {
+	if cap.spec.PodName == "" {
+		// The node capture has no session directory.
+		return
+	}
+	md := sessionMetadata{
+		Namespace: cap.spec.Namespace,
+		Pod:       cap.spec.PodName,
+		PodUID:    cap.spec.PodUID,
+		Session:   cap.spec.Session,
+		SessionID: cap.sessionID,
+		Node:      cap.spec.Node,
+		Requester: cap.spec.Requester,
+		Filter:    cap.spec.Filter,
+		Backend:   cap.backend.Name(),
+		State:     state,
+		StartTime: cap.spec.Started,
+	}
+	if cap.spec.Anonymize.IPs {
+		// The filter may name real IPs.
+		md.Filter = ""
+	}
+	if state != stateRunning {
+		end := time.Now().UTC()
+		md.EndTime = &end
+	}
+	path := filepath.Join(filepath.Dir(cap.files[0]), sessionMetadataFile)
+	if err := writeFileAtomic(path, md); err != nil {
+		cap.log.Error("Failed to write session metadata", "file", path, "err", err)
+	}
+}
+
+// captureFile is what the name of a Pod capture file says about it. Files
+// written before sessions had directories, capture-<pod>.pcap, only name
+// the Pod.
+type captureFile struct {
+	Namespace string
+	Pod       string
+	Session   string
+	UID       string
+	SessionID string
+}
+
+// legacy reports whether the file predates session directories.
+func (f captureFile) legacy() bool {
+	return f.SessionID == ""
+}
+
+// fileUID shortens a Pod UID for file names.
+func fileUID(uid types.UID) string {
+	return string(uid)[:min(len(uid), fileUIDLength)]
+}
+
+// podDir returns the directory holding the session directories of a Pod.
+func (m *CaptureManager) podDir(namespace, pod string) string {
+	return filepath.Join(m.cfg.CaptureDir, namespace, pod)
+}
+
+// capturePath returns the base file name of a session of pod started at
+// start; session names a named session, if any.
+func (m *CaptureManager) capturePath(pod *corev1.Pod, session, sessionID string, start time.Time) string {
+	name := pod.Namespace + "_" + pod.Name
+	if session != "" {
+		name += "_" + session
+	}
+	return filepath.Join(m.podDir(pod.Namespace, pod.Name), sessionID,
+		fmt.Sprintf("capture-%s-%s-%s-%s.pcap", name, fileUID(pod.UID), start.UTC().Format(sessionStartLayout), sessionID))
+}
+
+// parseCaptureFile parses the base name of a file written by a Pod capture,
+// rotated, compressed and derived files included.
+func parseCaptureFile(name string) (captureFile, bool) {
+	rest, ok := strings.CutPrefix(name, "capture-")
+	if !ok {
+		return captureFile{}, false
+	}
+	i := strings.LastIndex(rest, ".pcap")
+	if i < 0 {
+		return captureFile{}, false
+	}
+	rest = rest[:i]
+	fields := strings.Split(rest, "-")
+	n := len(fields)
+	if !strings.Contains(rest, "_") || n < 4 {
+		return captureFile{Pod: rest}, true
+	}
+	f := captureFile{UID: fields[n-3], SessionID: fields[n-1]}
+	ns, pod, _ := strings.Cut(strings.Join(fields[:n-3], "-"), "_")
+	f.Namespace = ns
+	f.Pod, f.Session, _ = strings.Cut(pod, "_")
+	return f, f.Namespace != "" && f.Pod != "" && f.SessionID != ""
+}
+
+// captureFilePath returns the path of the Pod capture file with the base
+// name name, and what its name says.
+func (m *CaptureManager) captureFilePath(name string) (string, captureFile, bool) {
+	f, ok := parseCaptureFile(name)
+	if !ok || filepath.Base(name) != name {
+		return "", f, false
+	}
+	if f.legacy() {
+		return filepath.Join(m.cfg.CaptureDir, name), f, true
+	}
+	// Names come from requests, so none of their parts may leave the
+	// capture directory.
+	rel := filepath.Join(f.Namespace, f.Pod, f.SessionID, name)
+	if !filepath.IsLocal(rel) || strings.Count(rel, string(filepath.Separator)) != 3 {
+		return "", f, false
+	}
+	return filepath.Join(m.cfg.CaptureDir, rel), f, true
+}
+
+// listCaptureFiles returns the paths of every Pod capture file, those of
+// earlier versions in the capture directory itself included.
+func (m *CaptureManager) listCaptureFiles() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(m.cfg.CaptureDir, "*", "*", "*", "capture-*.pcap*"))
+	if err != nil {
+		return nil, err
+	}
+	legacy, _ := filepath.Glob(filepath.Join(m.cfg.CaptureDir, "capture-*.pcap*"))
+	return append(matches, legacy...), nil
+}
+
+// deletePodFiles removes the files of every session of a Pod, except those
+// of captures running again for a new Pod of the same name. Callers must
+// hold m.mu.
+func (m *CaptureManager) deletePodFiles(namespace, pod string) {
+	matches, _ := filepath.Glob(filepath.Join(m.podDir(namespace, pod), "*", "*"))
+	for _, f := range matches {
+		if !m.isActiveFile(f) {
+			m.removeFile(f, "pod deleted")
+		}
+	}
+}
+
+// pruneSessionDirs removes empty session directories, those only holding
+// their metadata included, and the Pod and namespace directories they leave
+// empty. Directories of running captures are kept even before their first
+// file, as are those of captures still stopping. Callers must hold m.mu.
+func (m *CaptureManager) pruneSessionDirs() {
+	active := make(map[string]bool)
+	for _, cap := range m.fileOwners() {
+		for _, pattern := range cap.files {
+			active[filepath.Dir(pattern)] = true
+		}
+	}
+	for _, ns := range subdirs(m.cfg.CaptureDir) {
+		for _, pod := range subdirs(ns) {
+			for _, session := range subdirs(pod) {
+				if active[session] {
+					continue
+				}
+				if entries, _ := os.ReadDir(session); len(entries) == 1 && entries[0].Name() == sessionMetadataFile {
+					os.Remove(filepath.Join(session, sessionMetadataFile))
+				}
+				os.Remove(session)
+			}
+			for _, link := range sessionLinks(pod) {
+				if !active[link] {
+					removeStorageSession(link)
+				}
+			}
+			os.Remove(pod)
+		}
+		os.Remove(ns)
+	}
+}
+
+// subdirs lists the directories in dir. os.Remove only removes empty
+// directories, so callers can try every one of them.
+func subdirs(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var out []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			out = append(out, filepath.Join(dir, e.Name()))
+		}
+	}
+	return out
+}
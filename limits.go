@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const reasonCaptureLimited = "CaptureResourceLimit"
+
+// limitsInterval is how often the cgroups of capture processes are checked
+// for limit breaches.
+const limitsInterval = 10 * time.Second
+
+// processLimits constrains the capture programs the agent runs, tcpdump and
+// dumpcap, so a busy capture cannot starve the node or the Antrea agent.
+// With cgroup v2, each process runs in its own cgroup below the agent's,
+// with cpu.max and memory.max set. Without it, memory is bounded with
+// RLIMIT_AS and CPU only through the nice value.
+type processLimits struct {
+	// CPU is the CPU time a process may use, in cores; 0 is unlimited.
+	CPU float64
+	// MemoryMB is the memory a process may use; 0 is unlimited.
+	MemoryMB int
+	// Nice is the scheduling niceness of every process.
+	Nice int
+
+	// cgroups is the cgroup capture processes get their own cgroup
+	// in, empty without cgroup v2 delegation.
+	cgroups string
+	seq     atomic.Uint64
+}
+
+// watchLimits reports breaches of the limits of the capture processes in
+// cgroups as Events until the capture ends, then removes the cgroups. A
+// process killed at its memory limit is reported as such; throttling at
+// the CPU limit is reported once per process, since it means the process
+// may fall behind and drop packets.
+func (m *CaptureManager) watchLimits(cap *CaptureProcess, cgroups []string) {
+	limits := m.limits
+	throttled := make(map[string]bool)
+	ooms := make(map[string]int)
+	check := func() {
+		for _, dir := range cgroups {
+			if n := cgroupCounter(filepath.Join(dir, "memory.events"), "oom_kill"); n > ooms[dir] {
+				ooms[dir] = n
+				cap.log.Warn("Capture process killed at its memory limit", "memoryMB", limits.MemoryMB)
+				m.recorder.Event(cap.ref, corev1.EventTypeWarning, reasonCaptureLimited, sessionEvent(cap.spec,
+					fmt.Sprintf("The capture process was killed at its memory limit of %d MB", limits.MemoryMB)))
+			}
+			if !throttled[dir] && limits.CPU > 0 && cgroupCounter(filepath.Join(dir, "cpu.stat"), "nr_throttled") > 0 {
+				throttled[dir] = true
+				cap.log.Warn("Capture process throttled at its CPU limit", "cpu", limits.CPU)
+				m.recorder.Event(cap.ref, corev1.EventTypeWarning, reasonCaptureLimited, sessionEvent(cap.spec,
+					fmt.Sprintf("The capture process is throttled at its CPU limit of %g cores and may drop packets", limits.CPU)))
+			}
+		}
+	}
+	ticker := time.NewTicker(limitsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			check()
+		case <-cap.done:
+			check()
+			for _, dir := range cgroups {
+				os.Remove(dir)
+			}
+			return
+		}
+	}
+}
+
+// cgroupCounter returns the counter named key in a flat-keyed cgroup file.
+func cgroupCounter(path, key string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if k, v, ok := strings.Cut(s.Text(), " "); ok && k == key {
+			n, _ := strconv.Atoi(v)
+			return n
+		}
+	}
+	return 0
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// newProcessLimits returns the limits of cfg, or nil if there are none. It
+// prepares a cgroup for capture processes, moving the agent's own processes
+// into a leaf cgroup, since cgroup v2 only hands controllers down to
+// cgroups without processes of their own.
+func newProcessLimits(cfg *Config) *processLimits {
+	l := &processLimits{CPU: cfg.CaptureCPU, MemoryMB: cfg.CaptureMemoryMB, Nice: cfg.CaptureNice}
+	if l.CPU == 0 && l.MemoryMB == 0 && l.Nice == 0 {
+		return nil
+	}
+	if l.CPU > 0 || l.MemoryMB > 0 {
+		dir, err := delegateCgroup()
+		if err != nil {
+			slog.Warn("Cannot run capture processes in cgroups, limiting memory with rlimits only", "err", err)
+		} else {
+			l.cgroups = dir
+		}
+	}
+	slog.Info("Capture process limits", "cpu", l.CPU, "memoryMB", l.MemoryMB, "nice", l.Nice, "cgroup", l.cgroups)
+	return l
+}
+
+// delegateCgroup sets up <own cgroup>/captures with the cpu and memory
+// controllers, after moving the processes of the agent's cgroup into
+// <own cgroup>/agent.
+func delegateCgroup() (string, error) {
+	data, err := os.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	var own string
+	for _, line := range strings.Split(string(data), "\n") {
+		if path, ok := strings.CutPrefix(line, "0::"); ok {
+			own = filepath.Join(cgroupRoot, path)
+		}
+	}
+	if own == "" {
+		return "", errors.New("cgroup v2 is not in use")
+	}
+	controllers, err := os.ReadFile(filepath.Join(own, "cgroup.controllers"))
+	if err != nil {
+		return "", err
+	}
+	for _, c := range []string{"cpu", "memory"} {
+		if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " "+c+" ") {
+			return "", fmt.Errorf("the %s controller is not available in %s", c, own)
+		}
+	}
+	agent := filepath.Join(own, "agent")
+	if err := os.MkdirAll(agent, 0o755); err != nil {
+		return "", err
+	}
+	procs, err := os.ReadFile(filepath.Join(own, "cgroup.procs"))
+	if err != nil {
+		return "", err
+	}
+	for _, pid := range strings.Fields(string(procs)) {
+		// Processes may exit meanwhile.
+		os.WriteFile(filepath.Join(agent, "cgroup.procs"), []byte(pid), 0o644)
+	}
+	if err := os.WriteFile(filepath.Join(own, "cgroup.subtree_control"), []byte("+cpu +memory"), 0o644); err != nil {
+		return "", fmt.Errorf("cannot enable controllers in %s: %w", own, err)
+	}
+	captures := filepath.Join(own, "captures")
+	if err := os.MkdirAll(captures, 0o755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(filepath.Join(captures, "cgroup.subtree_control"), []byte("+cpu +memory"), 0o644); err != nil {
+		return "", fmt.Errorf("cannot enable controllers in %s: %w", captures, err)
+	}
+	return captures, nil
+}
+
+// prepare sets up the cgroup cmd will start in, if any. It returns the
+// cgroup and a function to call once cmd has started or failed to.
+func (l *processLimits) prepare(cmd *exec.Cmd, spec captureSpec) (string, func(), error) {
+	if l == nil || l.cgroups == "" {
+		return "", func() {}, nil
+	}
+	dir := filepath.Join(l.cgroups, fmt.Sprintf("%s-%d", spec.SessionID, l.seq.Add(1)))
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return "", nil, err
+	}
+	fail := func(err error) (string, func(), error) {
+		os.Remove(dir)
+		return "", nil, err
+	}
+	if l.CPU > 0 {
+		const period = 100000
+		quota := fmt.Sprintf("%d %d", int(l.CPU*period), period)
+		if err := os.WriteFile(filepath.Join(dir, "cpu.max"), []byte(quota), 0o644); err != nil {
+			return fail(err)
+		}
+	}
+	if l.MemoryMB > 0 {
+		if err := os.WriteFile(filepath.Join(dir, "memory.max"), []byte(strconv.Itoa(l.MemoryMB*bytesPerMB)), 0o644); err != nil {
+			return fail(err)
+		}
+	}
+	fd, err := unix.Open(dir, unix.O_PATH|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fail(err)
+	}
+	// The process is cloned straight into the cgroup, so it never runs
+	// unconstrained.
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = fd
+	return dir, func() { unix.Close(fd) }, nil
+}
+
+// started applies the limits that can only be set on a running process.
+func (l *processLimits) started(pid int, cgroup string) {
+	if l == nil {
+		return
+	}
+	if l.Nice != 0 {
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, pid, l.Nice); err != nil {
+			slog.Warn("Cannot set the nice value of a capture process", "pid", pid, "err", err)
+		}
+	}
+	if l.MemoryMB > 0 && cgroup == "" {
+		lim := unix.Rlimit{Cur: uint64(l.MemoryMB) * bytesPerMB, Max: uint64(l.MemoryMB) * bytesPerMB}
+		if err := unix.Prlimit(pid, unix.RLIMIT_AS, &lim, nil); err != nil {
+			slog.Warn("Cannot limit the memory of a capture process", "pid", pid, "err", err)
+		}
+	}
+}
+
+// captureCgroups returns the cgroups of the processes of a capture.
+func captureCgroups(rc runningCapture) []string {
+	switch c := rc.(type) {
+	case *tcpdumpProcess:
+		if c.cgroup != "" {
+			return []string{c.cgroup}
+		}
+	case *ovsCapture:
+		return captureCgroups(c.runningCapture)
+	case *multiCapture:
+		var out []string
+		for _, p := range c.procs {
+			out = append(out, captureCgroups(p)...)
+		}
+		return out
+	}
+	return nil
+}
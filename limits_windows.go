@@ -0,0 +1,27 @@
+package main
+
+import (
+	"log/slog"
+	"os/exec"
+)
+
+// newProcessLimits returns nil: Windows nodes do not limit capture
+// processes. pktmon captures in the kernel, leaving only dumpcap, which
+// shares the limits of the agent's job object.
+func newProcessLimits(cfg *Config) *processLimits {
+	if cfg.CaptureCPU != 0 || cfg.CaptureMemoryMB != 0 || cfg.CaptureNice != 0 {
+		slog.Warn("Capture process limits are not supported on Windows and are ignored")
+	}
+	return nil
+}
+
+// prepare does nothing; there are no limits to apply.
+func (l *processLimits) prepare(cmd *exec.Cmd, spec captureSpec) (string, func(), error) {
+	return "", func() {}, nil
+}
+
+// started does nothing; there are no limits to apply.
+func (l *processLimits) started(pid int, cgroup string) {}
+
+// captureCgroups returns nil, since no capture runs in a cgroup.
+func captureCgroups(rc runningCapture) []string { return nil }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// liveHeaderBytes is the part of each packet copied for live viewers;
+	// summaries never look past the transport header.
+	liveHeaderBytes = 256
+	// liveQueue is the number of packets queued per viewer. A viewer that
+	// falls behind misses packets instead of slowing down the capture.
+	liveQueue = 1024
+)
+
+// livePacket is the start of a packet handed to live viewers, or all of it
+// while a viewer wants whole packets.
+type livePacket struct {
+	ci       gopacket.CaptureInfo
+	linkType layers.LinkType
+	data     []byte
+}
+
+// liveFeed fans the packets of a capture out to its live viewers. It lives
+// as long as the capture session, across restarts.
+type liveFeed struct {
+	viewers atomic.Int32
+	// whole counts the viewers that want whole packets rather than their
+	// first liveHeaderBytes, like remote captures.
+	whole atomic.Int32
+
+	mu sync.Mutex
+	// subs maps each viewer to whether it wants whole packets.
+	subs   map[chan livePacket]bool
+	closed bool
+}
+
+func newLiveFeed() *liveFeed {
+	return &liveFeed{subs: make(map[chan livePacket]bool)}
+}
+
+// publish hands a packet to every viewer. It costs an atomic load when
+// nobody is watching.
+func (f *liveFeed) publish(ci gopacket.CaptureInfo, linkType layers.LinkType, data []byte) {
+	if f == nil || f.viewers.Load() == 0 {
+		return
+	}
+	n := len(data)
+	if f.whole.Load() == 0 {
+		n = min(n, liveHeaderBytes)
+	}
+	p := livePacket{ci: ci, linkType: linkType, data: append([]byte(nil), data[:n]...)}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- p:
+		default:
+		}
+	}
+}
+
+// subscribe registers a viewer, which gets whole packets if whole is set.
+// The channel is closed when the capture stops; ok is false if it already
+// has.
+func (f *liveFeed) subscribe(whole bool) (ch chan livePacket, ok bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return nil, false
+	}
+	ch = make(chan livePacket, liveQueue)
+	f.subs[ch] = whole
+	f.viewers.Add(1)
+	if whole {
+		f.whole.Add(1)
+	}
+	return ch, true
+}
+
+func (f *liveFeed) unsubscribe(ch chan livePacket) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	whole, ok := f.subs[ch]
+	if !ok {
+		return
+	}
+	delete(f.subs, ch)
+	close(ch)
+	f.viewers.Add(-1)
+	if whole {
+		f.whole.Add(-1)
+	}
+}
+
+// close disconnects every viewer.
+func (f *liveFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.closed = true
+	for ch := range f.subs {
+		delete(f.subs, ch)
+		close(ch)
+	}
+	f.viewers.Store(0)
+	f.whole.Store(0)
+}
+
+// handleLive serves /live/<namespace>/<pod> as a WebSocket that sends one
+// text message per packet of the Pod's running capture, or of the named
+// session in the session query parameter.
+func (m *CaptureManager) handleLive(w http.ResponseWriter, r *http.Request) {
+	ns, pod, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/live/"), "/")
+	if !ok || ns == "" || pod == "" || strings.Contains(pod, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	m.mu.Lock()
+	cap, running := m.captures[sessionKey(ns+"/"+pod, r.URL.Query().Get("session"))]
+	var feed *liveFeed
+	if running {
+		feed = cap.spec.Live
+	}
+	m.mu.Unlock()
+	if feed == nil {
+		http.Error(w, "no running capture for this Pod", http.StatusNotFound)
+		return
+	}
+	ch, ok := feed.subscribe(false)
+	if !ok {
+		http.Error(w, "no running capture for this Pod", http.StatusNotFound)
+		return
+	}
+	defer feed.unsubscribe(ch)
+
+	// Requests are authenticated by token, so any origin may connect.
+	srv := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			slog.Debug("Live viewer connected", "namespace", ns, "pod", pod, "remote", r.RemoteAddr)
+			// Viewers only listen; a read returns once they disconnect.
+			gone := make(chan struct{})
+			go func() {
+				defer close(gone)
+				var discard string
+				for websocket.Message.Receive(ws, &discard) == nil {
+				}
+			}()
+			for {
+				select {
+				case <-gone:
+					return
+				case p, ok := <-ch:
+					if !ok {
+						websocket.Message.Send(ws, "capture stopped")
+						return
+					}
+					if err := websocket.Message.Send(ws, packetSummary(p)); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// packetSummary formats a packet as one line, like tcpdump without -v.
+func packetSummary(p livePacket) string {
+	var b strings.Builder
+	b.WriteString(p.ci.Timestamp.UTC().Format("15:04:05.000000"))
+	pkt := gopacket.NewPacket(p.data, p.linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+
+	var src, dst string
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		b.WriteString(" IP")
+		src, dst = l.SrcIP.String(), l.DstIP.String()
+	case *layers.IPv6:
+		b.WriteString(" IP6")
+		src, dst = "["+l.SrcIP.String()+"]", "["+l.DstIP.String()+"]"
+	default:
+		if arp, ok := pkt.Layer(layers.LayerTypeARP).(*layers.ARP); ok {
+			fmt.Fprintf(&b, " ARP %s", arpSummary(arp))
+		} else {
+			b.WriteString(" unknown")
+		}
+		fmt.Fprintf(&b, " length %d", p.ci.Length)
+		return b.String()
+	}
+
+	switch l := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		fmt.Fprintf(&b, " %s:%d > %s:%d TCP [%s]", src, l.SrcPort, dst, l.DstPort, tcpFlags(l))
+	case *layers.UDP:
+		fmt.Fprintf(&b, " %s:%d > %s:%d UDP", src, l.SrcPort, dst, l.DstPort)
+	default:
+		fmt.Fprintf(&b, " %s > %s", src, dst)
+		if icmp, ok := pkt.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4); ok {
+			fmt.Fprintf(&b, " ICMP %s", icmp.TypeCode)
+		} else if icmp, ok := pkt.Layer(layers.LayerTypeICMPv6).(*layers.ICMPv6); ok {
+			fmt.Fprintf(&b, " ICMP6 %s", icmp.TypeCode)
+		}
+	}
+	fmt.Fprintf(&b, " length %d", p.ci.Length)
+	return b.String()
+}
+
+// tcpFlags abbreviates the flags set on a segment like tcpdump does.
+func tcpFlags(t *layers.TCP) string {
+	var f []byte
+	for _, flag := range []struct {
+		set bool
+		c   byte
+	}{{t.SYN, 'S'}, {t.FIN, 'F'}, {t.RST, 'R'}, {t.PSH, 'P'}, {t.ACK, '.'}, {t.URG, 'U'}, {t.ECE, 'E'}, {t.CWR, 'W'}} {
+		if flag.set {
+			f = append(f, flag.c)
+		}
+	}
+	if len(f) == 0 {
+		return "none"
+	}
+	return string(f)
+}
+
+func arpSummary(a *layers.ARP) string {
+	if a.Operation == layers.ARPRequest {
+		return fmt.Sprintf("who-has %s tell %s", net.IP(a.DstProtAddress), net.IP(a.SourceProtAddress))
+	}
+	return fmt.Sprintf("%s is-at %s", net.IP(a.SourceProtAddress), net.HardwareAddr(a.SourceHwAddress))
+}
@@ -2,8 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -11,58 +12,287 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/client-go/informers"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
 )
 
-const (
-	annotationKey = "tcpdump.antrea.io"
-	captureDir    = "/captures"
-)
+const annotationKey = "tcpdump.antrea.io"
+
+// captureStopTimeout bounds how long stopCapture waits for a capture to
+// close its files. tcpdump is killed well before that.
+const captureStopTimeout = 2 * tcpdumpStopTimeout
 
-// CaptureManager watches Pods on its node and manages tcpdump processes
-// based on the presence of the tcpdump.antrea.io annotation.
+// CaptureManager watches Pods on its node and manages captures based on the
+// presence of the tcpdump.antrea.io annotation.
 type CaptureManager struct {
-	clientset *kubernetes.Clientset
-	nodeName  string
-	mu        sync.Mutex
-	captures  map[string]*CaptureProcess
+	cfg       *Config
+	backends  map[string]CaptureBackend
+	limits    *processLimits
+	collector *collectorClient
+	ipfix     *ipfixExporter
+	metadata  *metadataExporter
+	exporter  *fileExporter
+	fileKey   *fileKey
+	notifier  *notifier
+	audit     *auditLog
+	oncall    *oncallNotifier
+	tracer    *tracer
+	// fileWatcher watches the directories of the running captures for
+	// tampering with their files; nil if it could not be set up.
+	fileWatcher *fsnotify.Watcher
+	// capabilities is what the node allows to capture with.
+	capabilities atomic.Pointer[nodeCapabilities]
+	clientset    kubernetes.Interface
+	dynamic      dynamic.Interface
+	recorder     record.EventRecorder
+	nodeName     string
+	queue        workqueue.RateLimitingInterface
+	podLister    corelisters.PodLister
+	nsLister     corelisters.NamespaceLister
+	nodeLister   corelisters.NodeLister
+	workloads    *workloadListers
+	services     *serviceListers
+	triggers     *triggerSet
+	drops        *dropWatcher
+	mu           sync.Mutex
+	captures     map[string]*CaptureProcess
+	// replays cancels the running replays by Pod key or Node name.
+	replays map[string]context.CancelFunc
+
+	// postProcessMu serializes the analyses of stopped captures, which
+	// read every file of a capture.
+	postProcessMu sync.Mutex
+
+	// healthSelector picks the Pods captured on health incidents; nil
+	// disables incident captures.
+	healthSelector labels.Selector
+	// ringSelector picks the Pods that are always captured into a ring
+	// buffer; nil disables it.
+	ringSelector labels.Selector
+
+	// podIndexer indexes the Pods of the cluster controller by their
+	// assignments; nil on agents.
+	podIndexer cache.Indexer
+
+	// targetLister lists CaptureTargets; nil if the CRD is not installed.
+	targetLister cache.GenericLister
+	// traceflowLister lists Antrea Traceflows; nil if Antrea's CRD is not
+	// installed.
+	traceflowLister cache.GenericLister
+	// packetCaptureLister lists Antrea PacketCaptures; nil unless
+	// --antrea-packetcaptures is set and Antrea's CRD is installed.
+	packetCaptureLister cache.GenericLister
+
+	// scheduleRuns maps Pod keys to the window start of their last
+	// scheduled run, so windows overlapping it are skipped.
+	scheduleRuns map[string]time.Time
+
+	// resumedSessions maps Pod keys to the sessions recovered from the
+	// state file, so restarted captures keep their session and files.
+	resumedSessions map[string]resumedSession
+
+	// pending maps the keys of captures waiting for a slot to when they
+	// started waiting.
+	pending map[string]pendingCapture
+
+	// usageChanged wakes runUsageReporter when captures start or end.
+	usageChanged chan struct{}
+	// retainedSizes caches the bytes of retained files by namespace, as
+	// retainedUsage summed them at retainedAt; nil once stopped captures
+	// leave files to retention.
+	retainedSizes map[string]int64
+	retainedAt    time.Time
+
+	// targetRefs counts the captures holding the agent's finalizer on
+	// each CaptureTarget, until their files are exported. targetHeld has
+	// the CaptureTargets the finalizer is on. targetMu serializes the
+	// finalizer updates; it is taken before m.mu, never while holding it.
+	targetRefs map[string]int
+	targetHeld map[string]bool
+	targetMu   sync.Mutex
+
+	// statuses writes the status annotations of captures.
+	statuses *statusWriter
+
+	// stopping holds the stopped captures that have not closed their files
+	// yet, by key, and stops waits for them.
+	stopping map[string]*CaptureProcess
+	stops    sync.WaitGroup
+
+	// synced is set once the Pod informer cache has synced.
+	synced atomic.Bool
+	// currentSettings holds the settings from the agent ConfigMap.
+	currentSettings atomic.Pointer[Settings]
 }
 
 type CaptureProcess struct {
-	cmd    *exec.Cmd
-	cancel context.CancelFunc
-	files  []string
+	proc      runningCapture
+	cancel    context.CancelFunc
+	backend   CaptureBackend
+	spec      captureSpec
+	files     []string
+	ref       *corev1.ObjectReference
+	sessionID string
+	log       *slog.Logger
+	startTime time.Time
+	// done is closed once the capture has ended and its files are closed.
+	done chan struct{}
+
+	// restarts counts consecutive restarts after unexpected exits, and
+	// exitTime is when the capture last exited. Both are written under
+	// m.mu once the capture runs.
+	restarts int
+	exitTime time.Time
+	// exited is set when the capture ends without being stopped.
+	exited atomic.Bool
+	// completed is set when the capture wrote its packet count. The files
+	// are kept until the annotation is removed.
+	completed atomic.Bool
+	// stopped is closed once a stopped capture closed its files, or did not
+	// in time, and its final status is written. preemptedBy names the
+	// capture it was stopped for, if any.
+	stopped     chan struct{}
+	preemptedBy string
+
+	// retention is the retention mode of a node capture, taken from the
+	// Node when it starts; Pod captures leave it empty and follow the
+	// agent's retention policy.
+	retention RetentionMode
+
+	// netns is the network namespace a capture bound to the Pod's own
+	// interfaces started in, and containers the container IDs of the Pod
+	// it was last checked against.
+	netns      string
+	containers string
 }
 
 func main() {
-	nodeName := os.Getenv("NODE_NAME")
-	if nodeName == "" {
-		log.Fatal("NODE_NAME environment variable is required")
+	cfg, err := loadConfig(os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if err := setupLogging(cfg.LogFormat, cfg.LogLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
-	log.Printf("Starting packet-capture controller on node %s", nodeName)
 
-	config, err := rest.InClusterConfig()
+	config, err := restConfig(cfg.Kubeconfig)
 	if err != nil {
-		log.Fatalf("Failed to create in-cluster config: %v", err)
+		fatal("Failed to load Kubernetes client config", "err", err)
 	}
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
-		log.Fatalf("Failed to create clientset: %v", err)
+		fatal("Failed to create clientset", "err", err)
 	}
 
+	dynamicClient, err := dynamic.NewForConfig(config)
+	if err != nil {
+		fatal("Failed to create dynamic client", "err", err)
+	}
+	if cfg.Role == roleController {
+		runClusterController(cfg, clientset, dynamicClient)
+		return
+	}
+
+	nodeName, err := detectNodeName(clientset)
+	if err != nil {
+		fatal("Failed to determine node name", "err", err)
+	}
+	slog.SetDefault(slog.Default().With("node", nodeName))
+	slog.Info("Starting packet-capture controller")
+
+	slog.Info("Configuration loaded", "backend", cfg.Backend, "captureDir", cfg.CaptureDir, "interface", cfg.Interface,
+		"rotateSizeMB", cfg.RotateSizeMB, "retention", cfg.Retention.Mode, "retentionTTL", cfg.Retention.TTL)
+
+	collector, err := newCollectorClient(cfg)
+	if err != nil {
+		fatal("Failed to set up collector", "err", err)
+	}
+	ipfix, err := newIPFIXExporter(cfg)
+	if err != nil {
+		fatal("Failed to set up IPFIX export", "err", err)
+	}
+
+	tracer, err := newTracer(cfg, nodeName)
+	if err != nil {
+		fatal("Failed to set up tracing", "err", err)
+	}
+	exporter, err := newFileExporter(cfg, nodeName, tracer)
+	if err != nil {
+		fatal("Failed to set up exports", "err", err)
+	}
+	fileKey, err := loadFileKey(cfg.EncryptionKey, cfg.EncryptionKeyOptional)
+	if err != nil {
+		fatal("Failed to load encryption key", "err", err)
+	}
+	if fileKey != nil {
+		slog.Info("Encrypting capture files at rest", "key", fileKey.ID())
+	}
+	audit, err := newAuditLog(cfg, clientset, nodeName)
+	if err != nil {
+		fatal("Failed to open the audit log", "err", err)
+	}
+	if audit != nil {
+		slog.Info("Auditing captures", "to", audit.String())
+	}
+
+	limits := newProcessLimits(cfg)
 	mgr := &CaptureManager{
+		cfg:       cfg,
+		backends:  newBackends(cfg, limits),
+		limits:    limits,
+		collector: collector,
+		ipfix:     ipfix,
+		metadata:  newMetadataExporter(cfg),
+		exporter:  exporter,
+		fileKey:   fileKey,
+		notifier:  newNotifier(cfg),
+		audit:     audit,
+		oncall:    newOncallNotifier(cfg, nodeName),
+		tracer:    tracer,
+		triggers:  newTriggerSet(),
+		drops:     newDropWatcher(cfg),
 		clientset: clientset,
+		dynamic:   dynamicClient,
+		recorder:  newEventRecorder(clientset, nodeName),
 		nodeName:  nodeName,
+		queue:     workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
 		captures:  make(map[string]*CaptureProcess),
+		replays:   make(map[string]context.CancelFunc),
+
+		resumedSessions: make(map[string]resumedSession),
+		scheduleRuns:    make(map[string]time.Time),
+		pending:         make(map[string]pendingCapture),
+		usageChanged:    make(chan struct{}, 1),
+		targetRefs:      make(map[string]int),
+		targetHeld:      make(map[string]bool),
+		stopping:        make(map[string]*CaptureProcess),
+	}
+	mgr.statuses = newStatusWriter(mgr.writeStatus)
+
+	caps := probeCapabilities(cfg, mgr.backends)
+	caps.log()
+	mgr.capabilities.Store(caps)
+
+	if cfg.HealthSelector != "" {
+		// The selectors were validated with the flags.
+		mgr.healthSelector, _ = labels.Parse(cfg.HealthSelector)
+	}
+	if cfg.RingSelector != "" {
+		mgr.ringSelector, _ = labels.Parse(cfg.RingSelector)
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
@@ -73,138 +303,675 @@ func main() {
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigCh
-		log.Println("Shutting down...")
+		slog.Info("Shutting down")
 		mgr.cleanupAll()
 		cancel()
 	}()
 
+	registerMetrics(mgr)
+	go mgr.watchCapabilities(ctx)
+	go mgr.serveHTTP(ctx, cfg.HTTPAddr)
+	if cfg.RPCAPAddr != "" {
+		go mgr.serveRPCAP(ctx)
+	}
+	if cfg.AdminSocket != "" {
+		go mgr.serveAdmin(ctx, cfg.AdminSocket)
+	}
+	go mgr.runJanitor(ctx.Done())
+	go mgr.runStatusReporter(ctx.Done())
+	go mgr.runUsageReporter(ctx.Done())
+	go mgr.runPressureMonitor(ctx.Done())
+	go mgr.runTargetSweeper(ctx.Done())
+	if mgr.drops != nil {
+		go mgr.watchDrops(ctx)
+	}
+	mgr.watchFiles(ctx)
+	mgr.recoverState()
+	mgr.watchSettings(ctx)
 	mgr.watchPods(ctx)
 }
 
-// watchPods sets up a Pod informer filtered to this node via a field selector.
-// This ensures each DaemonSet instance only processes Pods on its own node.
-func (m *CaptureManager) watchPods(ctx context.Context) {
-	selector := fields.OneTermEqualSelector("spec.nodeName", m.nodeName).String()
-	factory := informers.NewSharedInformerFactoryWithOptions(
-		m.clientset, 30*time.Second,
-		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
-			opts.FieldSelector = selector
-		}),
-	)
-
-	inf := factory.Core().V1().Pods().Informer()
-	inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
-		AddFunc:    func(obj interface{}) { m.handlePod(obj.(*corev1.Pod)) },
-		UpdateFunc: func(_, obj interface{}) { m.handlePod(obj.(*corev1.Pod)) },
-		DeleteFunc: func(obj interface{}) { m.handleDelete(obj.(*corev1.Pod)) },
-	})
-
-	factory.Start(ctx.Done())
-	if !cache.WaitForCacheSync(ctx.Done(), inf.HasSynced) {
-		log.Fatal("Failed to sync informer cache")
-	}
-	log.Println("Watching for pod annotation changes...")
-	<-ctx.Done()
-}
-
-// handlePod starts or stops a capture based on annotation presence.
-func (m *CaptureManager) handlePod(pod *corev1.Pod) {
-	if pod.Status.Phase != corev1.PodRunning {
-		return
+// startCapture spawns a tcpdump process with file rotation:
+//
+//	-C S   rotate after S million bytes (rotateSizeMB setting, default 1)
+//	-W N   keep at most N rotated files
+//	-i I   capture on the configured interface (--interface, default any)
+//
+// followed by the defaultFilter setting, if any, as the BPF expression.
+//
+// session names a named session of the Pod, set up from its own
+// annotations only; it is empty for the Pod's capture. Invalid annotation
+// values are reported on the Pod and not retried; an error is only returned
+// for failures worth requeueing. What the capture reads from the API server
+// comes from reads, so m.mu, which callers must hold, is not held across
+// API calls.
+func (m *CaptureManager) startCapture(pod *corev1.Pod, session, val string, reads *startReads) (err error) {
+	settings := m.settings()
+	maxFiles, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || maxFiles <= 0 {
+		m.reportFailure(pod, session, reasonCaptureFailed, fmt.Sprintf("Invalid %s annotation value %q: must be a positive file count", sessionAnnotationKey(annotationKey, session), val))
+		return nil
+	}
+	if settings.MaxFiles > 0 && maxFiles > settings.MaxFiles {
+		m.reportFailure(pod, session, reasonCaptureFailed, fmt.Sprintf("Requested %d files exceeds the maximum of %d", maxFiles, settings.MaxFiles))
+		return nil
+	}
+	key := sessionKey(fmt.Sprintf("%s/%s", pod.Namespace, pod.Name), session)
+	if _, ok := m.stopping[key]; ok {
+		// The previous capture is still closing its files; the key is
+		// synced again once it has.
+		return nil
+	}
+	annotations, source := m.captureSource(pod)
+	if session != "" {
+		if err := validSessionName(session); err != nil {
+			m.reportFailure(pod, session, reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+			return nil
+		}
+		if annotations, err = sessionAnnotations(pod.Annotations, session); err != nil {
+			m.reportFailure(pod, session, reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+			return nil
+		}
+		source = pod
+	}
+	read, ok := reads.sessions[session]
+	if !ok {
+		// The capture was running when syncPod read what it needs.
+		m.queue.Add(pod.Namespace + "/" + pod.Name)
+		return nil
+	}
+	trace := m.traceCapture(pod, session, key, annotations, source)
+	reconcile := trace.start("reconcile")
+	launched := false
+	defer func() {
+		reconcile.end(err)
+		if !launched {
+			trace.end(err)
+		}
+	}()
+	fail := func(reason, msg string) error {
+		reconcile.fail(msg)
+		trace.fail(msg)
+		m.reportFailure(pod, session, reason, msg)
+		m.failPacketCapture(source, msg)
+		return nil
+	}
+	if err := settings.authorizeRequest(source, session, pod.Namespace); err != nil {
+		return fail(reasonCaptureDenied, fmt.Sprintf("Cannot start capture: %v", err))
+	}
+	backend, err := m.podBackend(annotations)
+	if err != nil {
+		return fail(reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+	}
+	resumed, ok := m.resumedSessions[key]
+	if !ok {
+		resumed.ID = newSessionID()
+	}
+	trace.setSession(resumed.ID)
+	if resumed.Start.IsZero() {
+		// State files of earlier versions do not record it.
+		resumed.Start = time.Now().UTC()
+	}
+	spec := captureSpec{
+		Path:      m.capturePath(pod, session, resumed.ID, resumed.Start),
+		Interface: m.cfg.Interface,
+		Filter:    settings.DefaultFilter,
+		RotateMB:  settings.RotateSizeMB,
+		MaxFiles:  maxFiles,
+		PodUID:    string(pod.UID),
+		Namespace: pod.Namespace,
+		PodName:   pod.Name,
+		Node:      m.nodeName,
+		Session:   session,
+		SessionID: resumed.ID,
+		Started:   resumed.Start,
+		Requester: captureRequester(source, session),
+	}
+	if err := applyPodOptions(annotations, &spec); err != nil {
+		return fail(reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+	}
+	spec.limitWriteRate(settings.MaxWriteRateMB)
+	spec.Options = requestedOptions(val, annotations)
+	trace.set(attr("capture.backend", backend.Name()), attr("capture.requester", spec.Requester))
+	files := spec.Path
+	if _, ok := annotations[scheduleAnnotationKey]; ok {
+		// Each run writes its own files, named after its window.
+		spec.Run = m.scheduleRuns[key]
+		files += "." + spec.Run.Format(runNameLayout)
+		spec.Path = files
+		if len(spec.Interfaces) <= 1 && spec.MaxFiles > 1 {
+			spec.Path += "."
+		}
+	}
+	if msg := m.scopeSpec(pod, annotations, source, backend, read, &spec); msg != "" {
+		return fail(reasonCaptureFailed, msg)
+	}
+	if err := m.capabilities.Load().captureMissing(backend, spec); err != nil {
+		return fail(reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+	}
+	var peer *corev1.Pod
+	if spec.Peer != "" {
+		peer = read.peer
+	}
+	if spec.Output == outputStream || spec.Output == outputBoth {
+		if m.collector == nil {
+			return fail(reasonCaptureFailed, "Cannot start capture: no collector is configured for streaming")
+		}
+		spec.Collector = m.collector
+	}
+	if spec.Output == outputIPFIX {
+		if m.ipfix == nil {
+			return fail(reasonCaptureFailed, "Cannot start capture: no IPFIX collector is configured")
+		}
+		spec.Flows = m.ipfix
+	}
+	if spec.Mirror != nil && !settings.mirrorAllowed(spec.Mirror.Destination) {
+		return fail(reasonCaptureDenied, fmt.Sprintf("Cannot start capture: mirror destination %s is not in the %s setting", spec.Mirror.Destination, settingMirrorDestinations))
+	}
+	if spec.Metadata != "" {
+		if m.metadata == nil {
+			return fail(reasonCaptureFailed, "Cannot start capture: no metadata sink is configured")
+		}
+		spec.MetadataSink = m.metadata
+	}
+	if spec.Storage != "" {
+		if _, err := m.storageDir(spec.Storage); err != nil {
+			return fail(reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+		}
+	}
+	// Stream-only and flow captures write nothing to disk.
+	if spec.writesFiles() {
+		if reason, msg := m.checkCaptureDisk(spec, settings.NodeQuotaMB); reason != "" {
+			return fail(reason, msg)
+		}
+	}
+	quota := settings.namespaceQuota(spec.Namespace)
+	if quota != nil {
+		quota.limitDuration(&spec)
+		reason, msg, wait := m.checkNamespaceQuota(quota, spec, reads.remote)
+		if reason != "" {
+			return fail(reason, msg)
+		}
+		if wait && !spec.DryRun {
+			reconcile.set(attr("capture.pending", true))
+			return m.reportQuotaPending(pod, spec, quota)
+		}
 	}
 
-	key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
-	val, annotated := pod.Annotations[annotationKey]
-
-	m.mu.Lock()
-	defer m.mu.Unlock()
-
-	_, capturing := m.captures[key]
+	if !read.checks.checked(backend, spec) {
+		// What the capture asks for changed since readStarts checked
+		// it, e.g. with the settings; the filter is compiled again
+		// outside m.mu.
+		m.queue.Add(pod.Namespace + "/" + pod.Name)
+		return nil
+	}
+	if err := read.checks.filterErr; err != nil {
+		return fail(reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+	}
+	if err := checkDirection(backend, spec); err != nil {
+		return fail(reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+	}
+	if err := read.checks.stopOnErr; err != nil {
+		return fail(reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+	}
+	if spec.DryRun {
+		reason, msg := m.validateCapture(backend, spec)
+		if reason != "" {
+			return fail(reason, msg)
+		}
+		reconcile.set(attr("capture.dry_run", true))
+		return m.reportValidated(pod, spec, msg)
+	}
 
-	switch {
-	case annotated && !capturing:
-		log.Printf("Starting capture for %s (max files: %s)", key, val)
-		m.startCapture(pod, val)
-	case !annotated && capturing:
-		log.Printf("Stopping capture for %s", key)
-		m.stopCapture(key)
+	if pos, wait := m.waitForSlot(key, spec); wait {
+		reconcile.set(attr("capture.pending", true), attr("capture.queue_position", pos))
+		return m.reportPending(podRef(pod), annotatedStatus(pod, session), spec, pos)
 	}
-}
 
-func (m *CaptureManager) handleDelete(pod *corev1.Pod) {
-	key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	if _, ok := m.captures[key]; ok {
-		log.Printf("Pod %s deleted, stopping capture", key)
-		m.stopCapture(key)
+	if err := m.makeSessionDir(filepath.Dir(files), spec.Storage); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+	if spec.Target != "" {
+		if err := m.holdTarget(spec.Target); err != nil {
+			return err
+		}
+	}
+	delete(m.resumedSessions, key)
+	sessionID := spec.SessionID
+	spec.Live = newLiveFeed()
+	spec.Export = m.exporter
+	spec.Encrypt = m.fileKey
+	spec.Trace = trace
+	spec.Rotate = &rotateRequest{}
+	spec.Guard = newFileGuard()
+	spec.WriteLimit = newWriteLimiter(spec.WriteRateMB)
+	cap := &CaptureProcess{
+		backend:   backend,
+		spec:      spec,
+		files:     []string{files},
+		ref:       podRef(pod),
+		sessionID: sessionID,
+		log:       slog.With("namespace", pod.Namespace, "pod", pod.Name, "name", session, "session", sessionID),
+	}
+	if err := m.launch(key, cap); err != nil {
+		if spec.Target != "" {
+			go m.releaseTarget(spec.Target, "")
+		}
+		return err
+	}
+	launched = true
+	if peer != nil {
+		go func() {
+			err := m.mirrorPeer(pod, peer, source, session, annotations, trace)
+			if errors.Is(err, errPeerRequester) {
+				m.recorder.Eventf(cap.ref, corev1.EventTypeWarning, reasonCaptureDenied, "Not capturing peer pod %s: %v", spec.Peer, err)
+			} else if err != nil {
+				cap.log.Warn("Failed to request the capture of the peer pod", "peer", spec.Peer, "err", err)
+			}
+		}()
 	}
+	m.patchStatus(cap.ref, m.status(cap))
+	return nil
 }
 
-// startCapture spawns a tcpdump process with file rotation:
-//   -C 1   rotate after 1 million bytes (~1MB)
-//   -W N   keep at most N rotated files
-//   -i any capture on all interfaces
-func (m *CaptureManager) startCapture(pod *corev1.Pod, val string) {
-	maxFiles, err := strconv.Atoi(strings.TrimSpace(val))
-	if err != nil || maxFiles <= 0 {
-		log.Printf("Invalid annotation value %q for %s/%s", val, pod.Namespace, pod.Name)
-		return
+// scopeSpec narrows spec to what the capture of pod requested through
+// source and annotations sees: the peer, container, hostNetwork ports,
+// Service, PacketCapture, tunnel and the scope of the agent's own captures.
+// It returns why the capture cannot start, or "". readStarts scopes the
+// spec as well to check its filter before m.mu is taken, so scopeSpec only
+// reads what read holds and does not touch the state m.mu guards.
+func (m *CaptureManager) scopeSpec(pod *corev1.Pod, annotations map[string]string, source metav1.Object, backend CaptureBackend, read sessionReads, spec *captureSpec) string {
+	var peer *corev1.Pod
+	hosts := [][]string{podIPs(pod)}
+	if _, ok := annotations[peerAnnotationKey]; ok {
+		if read.peerErr != nil {
+			return fmt.Sprintf("Cannot start capture: %v", read.peerErr)
+		}
+		peer = read.peer
+		spec.Peer = peer.Namespace + "/" + peer.Name
+		hosts = append(hosts, podIPs(peer))
+		spec.addFilter(hostsFilter(hosts))
+	}
+	if v, ok := annotations[containerAnnotationKey]; ok {
+		if err := applyContainer(pod, v, backend, spec); err != nil {
+			return fmt.Sprintf("Cannot start capture: %v", err)
+		}
+	}
+	if pod.Spec.HostNetwork {
+		// A hostNetwork Pod shares the node's interfaces, so only its
+		// ports tell its traffic apart from the node's.
+		spec.HostNetwork = true
+		if spec.Container == "" {
+			filter, err := containerPortFilter(podPorts(pod))
+			if err != nil {
+				return fmt.Sprintf("Cannot start capture of hostNetwork pod: %v", err)
+			}
+			spec.addFilter(filter)
+		}
+	}
+	if svc, ok := source.(*corev1.Service); ok {
+		// Service captures only see the traffic to and from its ports.
+		if _, ports := m.podService(pod); len(ports) > 0 {
+			spec.Service = svc.Name
+			spec.addFilter(servicePortFilter(ports))
+		}
 	}
+	if tf, ok := source.(*traceflow); ok {
+		spec.Traceflow = tf.Name
+	}
+	if t, ok := source.(*captureTarget); ok {
+		spec.Target = t.Namespace + "/" + t.Name
+	}
+	if a, ok := source.(*captureAssignment); ok {
+		// The cluster controller resolved the Service and Traceflow.
+		spec.Service, spec.Traceflow = a.Service, a.Traceflow
+		if target, ok := strings.CutPrefix(a.Source, "CaptureTarget "); ok {
+			spec.Target = target
+		}
+		spec.addFilter(a.Filter)
+	}
+	if pc := read.pc; pc != nil {
+		// The PacketCapture's packet spec is the whole filter.
+		spec.PacketCapture = pc.Name
+		if read.pcErr != nil {
+			return fmt.Sprintf("Cannot start capture of PacketCapture %s: %v", pc.Name, read.pcErr)
+		}
+		spec.Filter = read.pcFilter
+	} else if read.pcErr != nil {
+		return fmt.Sprintf("Cannot start capture: cannot read PacketCapture: %v", read.pcErr)
+	}
+	if t, ok := source.(*triggeredCapture); ok {
+		// Triggered captures only see the Pod's own traffic.
+		spec.Trigger = t.Reason
+		if spec.Priority == "" {
+			// Incidents are what slots and quota are kept for.
+			spec.Priority = priorityHigh
+		}
+		if len(hosts[0]) > 0 {
+			spec.addFilter(podScopeFilter(hosts[0]))
+		}
+	}
+	if _, ok := source.(*ringBuffer); ok {
+		// So do ring buffers, in small files.
+		spec.Ring, spec.RotateMB = true, m.cfg.RingSizeMB
+		if spec.Priority == "" {
+			spec.Priority = priorityLow
+		}
+		if len(hosts[0]) > 0 {
+			spec.addFilter(podScopeFilter(hosts[0]))
+		}
+	}
+	if spec.Tunnel != "" {
+		if len(hosts[0]) == 0 {
+			return "Cannot start capture: the pod has no IP to match inside the tunnel"
+		}
+		if peer == nil {
+			spec.addFilter(podScopeFilter(hosts[0]))
+		}
+		filter, err := overlayFilter(spec.Tunnel, spec.Filter, hosts)
+		if err != nil {
+			return fmt.Sprintf("Cannot start capture: %v", err)
+		}
+		spec.Filter = filter
+	}
+	return ""
+}
 
-	key := fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
-	pcapPath := filepath.Join(captureDir, fmt.Sprintf("capture-%s.pcap", pod.Name))
+// launch starts tcpdump for cap and registers it under key. It is used both
+// for new captures and for restarts, which reuse the session of the capture
+// they replace.
+func (m *CaptureManager) launch(key string, cap *CaptureProcess) error {
+	pcapPath := cap.spec.Path
+	ref := cap.ref
+	logger := cap.log
 
+	if netnsScoped(cap) {
+		cap.netns, _ = podNetns(cap.spec.PodUID)
+	}
+	if d := cap.spec.Decode; d != nil {
+		d.tshark = m.cfg.TsharkPath
+		if _, err := exec.LookPath(d.tshark); err != nil {
+			// The capture itself works without tshark.
+			logger.Warn("Cannot decode capture files", "err", err)
+			m.recorder.Eventf(ref, corev1.EventTypeWarning, reasonCaptureFailed, "Cannot decode capture files: %v", err)
+		}
+	}
 	ctx, cancel := context.WithCancel(context.Background())
-	cmd := exec.CommandContext(ctx, "tcpdump",
-		"-C", "1", "-W", strconv.Itoa(maxFiles),
-		"-w", pcapPath, "-i", "any",
-	)
-
-	if err := cmd.Start(); err != nil {
-		log.Printf("Failed to start tcpdump for %s: %v", key, err)
+	start := cap.spec.Trace.start("process.start", attr("capture.backend", cap.backend.Name()), attr("capture.restarts", cap.restarts))
+	proc, err := startBackend(ctx, cap.backend, cap.spec)
+	start.end(err)
+	if err != nil {
+		cap.spec.Trace.end(err)
+		logger.Error("Failed to start capture", "backend", cap.backend.Name(), "err", err)
+		captureStartFailures.Inc()
+		m.recorder.Event(ref, corev1.EventTypeWarning, reasonCaptureFailed, sessionEvent(cap.spec, fmt.Sprintf("Failed to start capture: %v", err)))
+		m.patchStatus(ref, captureStatus{State: stateFailed, Node: m.nodeName, Session: cap.spec.Session, Reason: reasonCaptureFailed, Message: err.Error()})
+		m.notifyCapture(cap, stateFailed, err.Error())
 		cancel()
-		return
+		return fmt.Errorf("failed to start capture: %w", err)
+	}
+	start.set(attr("process.pid", proc.PID()))
+	logger.Info("Capture started", "backend", cap.backend.Name(), "pid", proc.PID(), "file", pcapPath, "requester", cap.spec.Requester)
+	if pid := proc.PID(); pid != 0 {
+		m.recorder.Event(ref, corev1.EventTypeNormal, reasonCaptureStarted, sessionEvent(cap.spec,
+			fmt.Sprintf("Started tcpdump (PID %d) on node %s, max %d files", pid, m.nodeName, cap.spec.MaxFiles)))
+	} else {
+		m.recorder.Event(ref, corev1.EventTypeNormal, reasonCaptureStarted, sessionEvent(cap.spec,
+			fmt.Sprintf("Started %s capture on node %s, max %d files", cap.backend.Name(), m.nodeName, cap.spec.MaxFiles)))
 	}
-	log.Printf("tcpdump started (PID %d) for %s", cmd.Process.Pid, key)
+	if cap.restarts == 0 {
+		m.oncall.captureStarted(cap.spec, cap.backend.Name())
+		m.auditCapture(cap, auditStart, "", "")
+		if cap.spec.PacketCapture != "" {
+			go m.updatePacketCapture(cap.spec.PacketCapture, setPacketCaptureCondition(packetCaptureStarted, true, "Started",
+				"capturing on node "+m.nodeName))
+		}
+		writeSessionMetadata(cap, stateRunning)
+	}
+
+	cap.proc = proc
+	cap.cancel = cancel
+	cap.done = make(chan struct{})
+	cap.startTime = time.Now().UTC()
+	m.captures[key] = cap
+	m.updateActiveCaptures()
+	m.saveState()
 
-	m.captures[key] = &CaptureProcess{cmd: cmd, cancel: cancel, files: []string{pcapPath}}
+	go m.watchRotation(ctx, ref, pcapPath)
+	m.guardFiles(cap)
+	if cap.spec.StopAfter > 0 {
+		go m.autostop(ctx, key, cap)
+	}
+	if cap.spec.StopOn != nil {
+		go m.stopOnMatch(ctx, key, cap)
+	}
+	if cap.spec.Budget != nil && cap.spec.Budget.Action == budgetOverwrite {
+		go m.watchBudget(ctx, cap)
+	}
+	if m.cfg.DropAlertPercent > 0 {
+		go m.watchDropRate(ctx, key, cap)
+	}
+	if cgroups := captureCgroups(proc); len(cgroups) > 0 {
+		go m.watchLimits(cap, cgroups)
+	}
 
-	// Wait for process exit in background to reap the zombie
+	// Wait for process exit in background to reap the zombie. Unexpected
+	// exits are handed back to the workqueue, which restarts the capture
+	// after a backoff while the annotation is still present.
 	go func() {
-		if err := cmd.Wait(); err != nil && ctx.Err() == nil {
-			log.Printf("tcpdump for %s exited: %v", key, err)
+		err := proc.Wait()
+		close(cap.done)
+		if ctx.Err() != nil {
+			return
 		}
+		if errors.Is(err, errCaptureComplete) {
+			m.completeCapture(key, cap, err)
+			return
+		}
+		logger.Warn("Capture exited unexpectedly", "err", err)
+		cap.spec.Trace.event("process.exit", attr("error", fmt.Sprint(err)), attr("capture.restarts", cap.restarts))
+		processExits.Inc()
+		m.recorder.Event(ref, corev1.EventTypeWarning, reasonCaptureFailed, sessionEvent(cap.spec, fmt.Sprintf("Capture exited unexpectedly: %v", err)))
+		st := m.status(cap)
+		st.State, st.Message = stateFailed, fmt.Sprintf("capture exited: %v", err)
+		m.patchStatus(ref, st)
+		m.notifyCapture(cap, stateFailed, st.Message)
+
+		m.mu.Lock()
+		cap.exitTime = time.Now()
+		if cap.exitTime.Sub(cap.startTime) >= restartResetAfter {
+			cap.restarts = 0
+		}
+		cap.exited.Store(true)
+		backoff := cap.restartBackoff()
+		m.mu.Unlock()
+		m.queue.AddAfter(key, backoff)
 	}()
+	return nil
 }
 
-// stopCapture terminates the tcpdump process and deletes all associated
-// pcap files (including rotated ones like capture-pod.pcap0, .pcap1, etc).
-func (m *CaptureManager) stopCapture(key string) {
+// completeCapture records that cap met the autostop condition err, such as
+// its packet count. It stays registered so syncPod does not start it again,
+// and stops once the annotation is removed. Conditions can be met at the
+// same time, so only the first completes the capture; completeCapture
+// reports whether it was this one.
+func (m *CaptureManager) completeCapture(key string, cap *CaptureProcess, err error) bool {
+	if !cap.completed.CompareAndSwap(false, true) {
+		return false
+	}
+	cap.cancel()
+	completion := cap.spec.completion(err)
+	cap.log.Info("Capture complete", "condition", err)
+	m.recorder.Eventf(cap.ref, corev1.EventTypeNormal, reasonCaptureCompleted, "Capture finished %s", completion)
+	st := m.status(cap)
+	st.State, st.PID = stateCompleted, 0
+	m.patchStatus(cap.ref, st)
+	m.notifyCapture(cap, stateCompleted, "capture finished "+completion)
+	m.auditCapture(cap, auditStop, stateCompleted, "capture finished "+completion)
+	writeSessionMetadata(cap, stateCompleted)
+	cap.spec.Trace.end(nil)
+	go m.finishSession(key, cap, st, stateCompleted)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.updateActiveCaptures()
+	m.requeuePending()
+	m.saveState()
+	return true
+}
+
+// updateActiveCaptures sets the active captures gauge. Callers must hold
+// m.mu.
+func (m *CaptureManager) updateActiveCaptures() {
+	n := 0
+	for _, cap := range m.captures {
+		if !cap.completed.Load() {
+			n++
+		}
+	}
+	activeCaptures.Set(float64(n))
+	m.usageChange()
+}
+
+// stopCapture stops the capture with key. It waits for the capture to close
+// its files in the background, outside m.mu, and then deletes them if purge
+// is set; otherwise the files are left to the retention policy. The final
+// status is only written back when the Pod still exists. Until the capture
+// has stopped, it stays in m.stopping and the key cannot start another one.
+// Callers must hold m.mu.
+func (m *CaptureManager) stopCapture(key string, purge, podExists bool) {
 	cap, ok := m.captures[key]
 	if !ok {
 		return
 	}
 	cap.cancel()
-	time.Sleep(500 * time.Millisecond)
+	cap.spec.Live.close()
+	cap.stopped = make(chan struct{})
+	delete(m.captures, key)
+	m.stopping[key] = cap
+	m.stops.Add(1)
+	go m.finishStop(key, cap, purge, podExists)
+	m.updateActiveCaptures()
+	m.requeuePending()
+	m.saveState()
+}
 
-	for _, pattern := range cap.files {
-		matches, _ := filepath.Glob(pattern + "*")
-		for _, f := range matches {
-			if err := os.Remove(f); err != nil {
-				log.Printf("Failed to delete %s: %v", f, err)
-			} else {
-				log.Printf("Deleted %s", f)
-			}
+// finishStop waits for the stopped capture cap to close its files and
+// records that it stopped. Files of a capture that does not stop in time
+// are only purged once it does.
+func (m *CaptureManager) finishStop(key string, cap *CaptureProcess, purge, podExists bool) {
+	defer m.stops.Done()
+	stop := cap.spec.Trace.start("process.stop", attr("capture.purge", purge))
+	stopped := true
+	select {
+	case <-cap.done:
+	case <-time.After(captureStopTimeout):
+		cap.log.Warn("Capture did not stop in time", "timeout", captureStopTimeout)
+		stop.fail("capture did not stop in time")
+		stopped = false
+	}
+	stop.end(nil)
+	cap.log.Info("tcpdump stopped")
+	m.recorder.Event(cap.ref, corev1.EventTypeNormal, reasonCaptureStopped, sessionEvent(cap.spec, "Stopped tcpdump"))
+	if podExists {
+		m.mu.Lock()
+		st := m.status(cap)
+		m.mu.Unlock()
+		st.State, st.PID = stateStopped, 0
+		if cap.preemptedBy != "" {
+			st.State, st.PreemptedBy = statePreempted, cap.preemptedBy
+		}
+		if purge {
+			st.Files, st.Bytes = nil, 0
+		}
+		m.patchStatus(cap.ref, st)
+		// Completed captures were finished when they completed.
+		if !purge && !cap.completed.Load() {
+			go m.finishSession(key, cap, st, stateStopped)
 		}
 	}
-	delete(m.captures, key)
+
+	if !cap.completed.Load() {
+		m.auditCapture(cap, auditStop, stateStopped, "")
+	}
+	if !purge && !cap.completed.Load() {
+		writeSessionMetadata(cap, stateStopped)
+	}
+	m.notifyCapture(cap, stateStopped, "")
+	cap.spec.Trace.end(nil)
+	if cap.spec.Target != "" {
+		go m.releaseTarget(cap.spec.Target, cap.sessionID)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.stopping, key)
+	close(cap.stopped)
+	m.retainedSizes = nil
+	switch {
+	case purge && stopped:
+		m.purgeFiles(cap)
+	case purge:
+		cap.log.Warn("Deleting the files of the capture once it stops")
+		go func() {
+			<-cap.done
+			m.mu.Lock()
+			defer m.mu.Unlock()
+			m.purgeFiles(cap)
+		}()
+	}
+	// Its budget is free now, and its key may have been requested again
+	// while it stopped.
+	m.requeuePending()
+	if ns, name, _, ok := splitCaptureKey(key); ok {
+		key = ns + "/" + name
+	}
+	m.queue.Add(key)
+}
+
+// fileOwners returns the running captures and the stopped ones that have
+// not closed their files yet, which both still own their files. Callers
+// must hold m.mu.
+func (m *CaptureManager) fileOwners() []*CaptureProcess {
+	owners := make([]*CaptureProcess, 0, len(m.captures)+len(m.stopping))
+	for _, cap := range m.captures {
+		owners = append(owners, cap)
+	}
+	for _, cap := range m.stopping {
+		owners = append(owners, cap)
+	}
+	return owners
+}
+
+// purgeFiles deletes the files of the stopped capture cap. Callers must
+// hold m.mu.
+func (m *CaptureManager) purgeFiles(cap *CaptureProcess) {
+	for _, pattern := range cap.files {
+		m.deleteFiles(pattern, "retention delete")
+	}
+	m.pruneSessionDirs()
 }
 
+// cleanupAll stops every capture on shutdown, all at once, and waits for
+// them to stop. Files are only removed when the retention mode deletes them
+// on stop.
 func (m *CaptureManager) cleanupAll() {
+	// Stopped captures requeue their key, which must not start them again.
+	m.queue.ShutDown()
 	m.mu.Lock()
-	defer m.mu.Unlock()
-	for key := range m.captures {
-		m.stopCapture(key)
+	m.stopReplays()
+	for key, cap := range m.captures {
+		mode := m.cfg.Retention.Mode
+		if cap.retention != "" {
+			mode = cap.retention
+		}
+		m.stopCapture(key, mode == RetentionDelete, true)
 	}
+	m.mu.Unlock()
+	m.stops.Wait()
+	m.statuses.flush(captureStopTimeout)
+	// The stopped captures ended their traces.
+	ctx, cancel := context.WithTimeout(context.Background(), traceTimeout)
+	defer cancel()
+	m.tracer.shutdown(ctx)
 }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// waitFor polls cond until it holds, and fails the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestStartCaptureReportsBackendFailure(t *testing.T) {
+	tm := newTestManager(t)
+	tm.backend.StartErr = errors.New("no packet socket")
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+
+	if err := tm.syncPod("default/web"); err == nil {
+		t.Fatal("syncPod succeeded, want the start error to requeue the Pod")
+	}
+
+	if tm.capture("default/web") != nil {
+		t.Error("failed capture is registered")
+	}
+	if st := tm.status(pod); st.State != stateFailed || st.Message != "no packet socket" {
+		t.Errorf("status is %q (%s), want %q with the backend error", st.State, st.Message, stateFailed)
+	}
+	tm.expectEvent(corev1.EventTypeWarning, reasonCaptureFailed)
+}
+
+func TestStartCaptureAppliesOptions(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "2", countAnnotationKey: "50"})
+
+	tm.sync(pod)
+
+	started := tm.backend.Started()
+	if len(started) != 1 {
+		t.Fatalf("started %d captures, want 1", len(started))
+	}
+	if spec := started[0]; spec.PacketCount != 50 || spec.Namespace != "default" || spec.Node != testNode {
+		t.Errorf("started %+v, want 50 packets of default/web on %s", spec, testNode)
+	}
+}
+
+func TestStopCaptureWaitsOutsideTheLock(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+	tm.sync(pod)
+
+	tm.mu.Lock()
+	tm.stopCapture("default/web", false, true)
+	_, stopping := tm.stopping["default/web"]
+	tm.mu.Unlock()
+	if !stopping {
+		t.Fatal("stopped capture is not tracked until it closed its files")
+	}
+	// A sync while the capture closes its files does not start another.
+	tm.sync(pod)
+	tm.waitStopped()
+
+	if n := len(tm.backend.Started()); n != 1 {
+		t.Errorf("started %d captures, want 1", n)
+	}
+	tm.mu.Lock()
+	_, stopping = tm.stopping["default/web"]
+	tm.mu.Unlock()
+	if stopping {
+		t.Error("capture is still stopping")
+	}
+	tm.waitStatus(pod, stateStopped)
+}
+
+func TestRestartAfterUnexpectedExit(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+	tm.sync(pod)
+	tm.waitStatus(pod, stateRunning)
+
+	tm.backend.Exit(errors.New("killed"))
+	cap := tm.capture("default/web")
+	waitFor(t, "the capture to exit", cap.exited.Load)
+	tm.waitStatus(pod, stateFailed)
+	tm.expectEvent(corev1.EventTypeWarning, reasonCaptureFailed)
+
+	// The first restart waits for restartInitialBackoff.
+	tm.setAnnotations(pod, nil)
+	tm.sync(pod)
+	if n := len(tm.backend.Started()); n != 1 {
+		t.Fatalf("restarted during the backoff: started %d captures, want 1", n)
+	}
+
+	tm.mu.Lock()
+	cap.exitTime = time.Now().Add(-restartInitialBackoff)
+	tm.mu.Unlock()
+	tm.sync(pod)
+
+	if n := len(tm.backend.Started()); n != 2 {
+		t.Fatalf("started %d captures, want the restart", n)
+	}
+	restarted := tm.capture("default/web")
+	if restarted == cap || restarted.restarts != 1 || restarted.sessionID != cap.sessionID {
+		t.Errorf("restart %d in session %s, want restart 1 in session %s", restarted.restarts, restarted.sessionID, cap.sessionID)
+	}
+	tm.expectEvent(corev1.EventTypeNormal, reasonCaptureRestarted)
+	tm.waitStatus(pod, stateRunning)
+}
+
+func TestRestartBackoffDoubles(t *testing.T) {
+	cap := &CaptureProcess{}
+	for restarts, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		cap.restarts = restarts
+		if got := cap.restartBackoff(); got != want {
+			t.Errorf("backoff after %d restarts is %v, want %v", restarts, got, want)
+		}
+	}
+	cap.restarts = 20
+	if got := cap.restartBackoff(); got != restartMaxBackoff {
+		t.Errorf("backoff after 20 restarts is %v, want %v", got, restartMaxBackoff)
+	}
+}
+
+func TestCompleteCaptureAtPacketCount(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3", countAnnotationKey: "3"})
+	tm.sync(pod)
+
+	cap := tm.capture("default/web")
+	waitFor(t, "the capture to complete", cap.completed.Load)
+	st := tm.waitStatus(pod, stateCompleted)
+	if st.PID != 0 {
+		t.Errorf("completed status has PID %d", st.PID)
+	}
+	tm.expectEvent(corev1.EventTypeNormal, reasonCaptureCompleted)
+
+	// A completed capture stays registered, so it is not started again
+	// while the annotation is there.
+	tm.setAnnotations(pod, nil)
+	tm.sync(pod)
+	if n := len(tm.backend.Started()); n != 1 {
+		t.Errorf("started %d captures, want 1", n)
+	}
+	if tm.capture("default/web") != cap {
+		t.Error("completed capture is no longer registered")
+	}
+}
+
+func TestCompleteCaptureOnlyOnce(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", map[string]string{annotationKey: "3"})
+	tm.sync(pod)
+	cap := tm.capture("default/web")
+
+	if !tm.completeCapture("default/web", cap, errCaptureComplete) {
+		t.Fatal("first completion was not taken")
+	}
+	if tm.completeCapture("default/web", cap, errCaptureComplete) {
+		t.Error("second completion was taken")
+	}
+	tm.waitStatus(pod, stateCompleted)
+}
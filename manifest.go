@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manifestSuffix is appended to a capture's base path to name its manifest.
+const manifestSuffix = ".manifest.json"
+
+// sessionManifest lists the files of a capture session with their checksums
+// for chain of custody. It is written next to the files and rewritten each
+// time a file is finished.
+type sessionManifest struct {
+	Namespace string          `json:"namespace"`
+	Pod       string          `json:"pod"`
+	PodUID    string          `json:"podUID"`
+	Node      string          `json:"node"`
+	SessionID string          `json:"sessionID"`
+	Filter    string          `json:"filter,omitempty"`
+	Requester string          `json:"requester,omitempty"`
+	Files     []manifestEntry `json:"files"`
+	UpdatedAt time.Time       `json:"updatedAt"`
+}
+
+type manifestEntry struct {
+	Name    string `json:"name"`
+	SHA256  string `json:"sha256"`
+	Size    int64  `json:"size"`
+	Packets int    `json:"packets"`
+	// FirstPacket and LastPacket bound the capture window of the file.
+	FirstPacket time.Time `json:"firstPacket"`
+	LastPacket  time.Time `json:"lastPacket"`
+}
+
+// manifestWriter maintains the manifest of one capture. Files are finished
+// in the background, so record may be called concurrently.
+type manifestWriter struct {
+	mu       sync.Mutex
+	path     string
+	manifest sessionManifest
+	// export receives the finished files and the manifest, if exports
+	// are configured.
+	export *fileExporter
+	// guard is told about the finished files.
+	guard *fileGuard
+}
+
+// newManifestWriter continues the manifest at spec's path if it belongs to
+// the same session, e.g. after the capture was restarted.
+func newManifestWriter(spec captureSpec) *manifestWriter {
+	w := &manifestWriter{
+		path:   strings.TrimSuffix(spec.Path, ".") + manifestSuffix,
+		export: spec.Export,
+		guard:  spec.Guard,
+		manifest: sessionManifest{
+			Namespace: spec.Namespace,
+			Pod:       spec.PodName,
+			PodUID:    spec.PodUID,
+			Node:      spec.Node,
+			SessionID: spec.SessionID,
+			Filter:    spec.Filter,
+			Requester: spec.Requester,
+		},
+	}
+	if spec.Anonymize.IPs {
+		// The filter may name real IPs, and every run pseudonymizes
+		// them under its own key.
+		w.manifest.Filter = ""
+	}
+	var prev sessionManifest
+	if data, err := os.ReadFile(w.path); err == nil && json.Unmarshal(data, &prev) == nil && prev.SessionID == spec.SessionID {
+		w.manifest.Files = prev.Files
+	}
+	return w
+}
+
+// record adds the finished file to the manifest, replacing the entry of the
+// file that previously had its place in the ring and dropping entries of
+// files that no longer exist.
+func (w *manifestWriter) record(name string, entry manifestEntry) {
+	entry.Name = filepath.Base(name)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	files := w.manifest.Files[:0]
+	for _, e := range w.manifest.Files {
+		if ringSlot(e.Name) == ringSlot(entry.Name) {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(filepath.Dir(name), e.Name)); err != nil {
+			continue
+		}
+		files = append(files, e)
+	}
+	w.manifest.Files = append(files, entry)
+	w.manifest.UpdatedAt = time.Now().UTC()
+	w.guard.finish(name, entry.Size)
+	w.export.add(name)
+	if err := writeFileAtomic(w.path, w.manifest); err != nil {
+		slog.Error("Failed to write capture manifest", "file", w.path, "err", err)
+		return
+	}
+	w.export.add(w.path)
+}
+
+// ringSlot strips the compression and encryption suffixes, so a file and
+// its compressed or encrypted copy share a slot.
+func ringSlot(name string) string {
+	name = strings.TrimSuffix(name, encryptSuffix)
+	for _, c := range []compression{compressGzip, compressZstd} {
+		name = strings.TrimSuffix(name, c.extension())
+	}
+	// Raw files that failed to compress are named <file>.<n>.raw.
+	if raw, ok := strings.CutSuffix(name, compressSuffix); ok {
+		if i := strings.LastIndex(raw, "."); i >= 0 {
+			name = raw[:i]
+		}
+	}
+	return name
+}
+
+func fileSHA256(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// writeFileAtomic writes v as JSON through a temporary file, so readers
+// never see a partial file.
+func writeFileAtomic(path string, v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// metadataAnnotationKey exports the metadata of a capture's packets or
+// flows to the configured ClickHouse or Elasticsearch, next to its output.
+const metadataAnnotationKey = "metadata." + annotationKey
+
+// Metadata granularities.
+const (
+	metadataPackets = "packets"
+	metadataFlows   = "flows"
+)
+
+// Metadata sinks.
+const (
+	sinkClickHouse    = "clickhouse"
+	sinkElasticsearch = "elasticsearch"
+)
+
+const (
+	// metadataBuffer is the number of rows queued for the sink. Rows are
+	// dropped rather than stalling the capture when it is full.
+	metadataBuffer = 16384
+	// metadataBatch and metadataFlushInterval bound how many rows are
+	// sent at once and how long a row waits.
+	metadataBatch         = 1000
+	metadataFlushInterval = 5 * time.Second
+	metadataTimeout       = 30 * time.Second
+)
+
+// packetRow is the metadata of one packet.
+type packetRow struct {
+	Time      time.Time `json:"time"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Node      string    `json:"node"`
+	Session   string    `json:"session"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	SrcPort   uint16    `json:"src_port"`
+	DstPort   uint16    `json:"dst_port"`
+	Protocol  uint8     `json:"protocol"`
+	Length    int       `json:"length"`
+	TCPFlags  uint16    `json:"tcp_flags"`
+}
+
+// flowRow is the metadata of one exported flow, with the counts since the
+// flow was last exported.
+type flowRow struct {
+	Start     time.Time `json:"start"`
+	End       time.Time `json:"end"`
+	Namespace string    `json:"namespace"`
+	Pod       string    `json:"pod"`
+	Node      string    `json:"node"`
+	Session   string    `json:"session"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	SrcPort   uint16    `json:"src_port"`
+	DstPort   uint16    `json:"dst_port"`
+	Protocol  uint8     `json:"protocol"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	TCPFlags  uint16    `json:"tcp_flags"`
+	EndReason uint8     `json:"end_reason"`
+}
+
+// metadataRow is a row queued for the table or index of its kind.
+type metadataRow struct {
+	kind string
+	data []byte
+}
+
+// metadataExporter writes packet and flow metadata of captures to
+// ClickHouse or Elasticsearch over HTTP, in batches. Packets go to
+// <table>_packets and flows to <table>_flows. It is shared by every
+// capture.
+type metadataExporter struct {
+	sink     string
+	url      string
+	table    string
+	user     string
+	password string
+	client   *http.Client
+
+	idleTimeout   time.Duration
+	activeTimeout time.Duration
+
+	rows chan metadataRow
+}
+
+// newMetadataExporter returns the exporter of the configured sink, or nil if
+// none is configured.
+func newMetadataExporter(cfg *Config) *metadataExporter {
+	if cfg.MetadataURL == "" {
+		return nil
+	}
+	e := &metadataExporter{
+		sink:          cfg.MetadataSink,
+		url:           strings.TrimSuffix(cfg.MetadataURL, "/"),
+		table:         cfg.MetadataTable,
+		user:          cfg.MetadataUser,
+		password:      cfg.MetadataPassword,
+		client:        &http.Client{Timeout: metadataTimeout},
+		idleTimeout:   cfg.IPFIXIdleTimeout,
+		activeTimeout: cfg.IPFIXActiveTimeout,
+		rows:          make(chan metadataRow, metadataBuffer),
+	}
+	go e.run()
+	return e
+}
+
+// parseMetadata validates the metadata annotation value.
+func parseMetadata(v string) (string, error) {
+	switch kind := strings.TrimSpace(v); kind {
+	case metadataPackets, metadataFlows:
+		return kind, nil
+	}
+	return "", fmt.Errorf("unknown metadata %q, expected %s or %s", v, metadataPackets, metadataFlows)
+}
+
+// queue hands a row to the sender, dropping it when the queue is full.
+func (e *metadataExporter) queue(kind string, row any) {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return
+	}
+	select {
+	case e.rows <- metadataRow{kind: kind, data: data}:
+	default:
+		metadataDropped.Inc()
+	}
+}
+
+// packet queues the metadata of one packet of the capture spec. Packets
+// without an IP header are skipped.
+func (e *metadataExporter) packet(spec captureSpec, linkType layers.LinkType, ci gopacket.CaptureInfo, data []byte) {
+	k, flags, ok := packetTuple(gopacket.NewPacket(data, linkType, gopacket.DecodeOptions{Lazy: true, NoCopy: true}))
+	if !ok {
+		return
+	}
+	src, dst := k.addrs()
+	e.queue(metadataPackets, packetRow{
+		Time: ci.Timestamp.UTC(), Namespace: spec.Namespace, Pod: spec.PodName, Node: spec.Node, Session: spec.SessionID,
+		Src: src, Dst: dst, SrcPort: k.sport, DstPort: k.dport, Protocol: k.proto,
+		Length: ci.Length, TCPFlags: flags,
+	})
+}
+
+// exportFlows implements flowSink for the flows granularity.
+func (e *metadataExporter) exportFlows(spec captureSpec, records []*flowRecord) error {
+	for _, r := range records {
+		src, dst := r.addrs()
+		e.queue(metadataFlows, flowRow{
+			Start: r.start.UTC(), End: r.end.UTC(), Namespace: spec.Namespace, Pod: spec.PodName, Node: spec.Node, Session: spec.SessionID,
+			Src: src, Dst: dst, SrcPort: r.sport, DstPort: r.dport, Protocol: r.proto,
+			Packets: r.packets, Bytes: r.bytes, TCPFlags: r.tcpFlags, EndReason: r.reason,
+		})
+	}
+	return nil
+}
+
+func (e *metadataExporter) flowTimeouts() (time.Duration, time.Duration) {
+	return e.idleTimeout, e.activeTimeout
+}
+
+// run sends the queued rows in batches per kind, once a batch is full or
+// metadataFlushInterval has passed.
+func (e *metadataExporter) run() {
+	batches := make(map[string][][]byte)
+	ticker := time.NewTicker(metadataFlushInterval)
+	defer ticker.Stop()
+	flush := func(kind string) {
+		rows := batches[kind]
+		if len(rows) == 0 {
+			return
+		}
+		delete(batches, kind)
+		if err := e.send(kind, rows); err != nil {
+			metadataFailures.Inc()
+			slog.Warn("Failed to export capture metadata", "sink", e.sink, "rows", len(rows), "err", err)
+			return
+		}
+		metadataExported.Add(float64(len(rows)))
+	}
+	for {
+		select {
+		case row := <-e.rows:
+			batches[row.kind] = append(batches[row.kind], row.data)
+			if len(batches[row.kind]) >= metadataBatch {
+				flush(row.kind)
+			}
+		case <-ticker.C:
+			flush(metadataPackets)
+			flush(metadataFlows)
+		}
+	}
+}
+
+// send writes rows to the table or index of kind.
+func (e *metadataExporter) send(kind string, rows [][]byte) error {
+	table := e.table + "_" + kind
+	var body bytes.Buffer
+	var target, contentType string
+	switch e.sink {
+	case sinkClickHouse:
+		q := url.Values{}
+		q.Set("query", fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", table))
+		q.Set("date_time_input_format", "best_effort")
+		target, contentType = e.url+"/?"+q.Encode(), "application/json"
+		for _, row := range rows {
+			body.Write(row)
+			body.WriteByte('\n')
+		}
+	case sinkElasticsearch:
+		target, contentType = e.url+"/_bulk", "application/x-ndjson"
+		action := fmt.Sprintf(`{"create":{"_index":%q}}`, table)
+		for _, row := range rows {
+			body.WriteString(action)
+			body.WriteByte('\n')
+			body.Write(row)
+			body.WriteByte('\n')
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), metadataTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if e.user != "" {
+		req.SetBasicAuth(e.user, e.password)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	if e.sink == sinkElasticsearch {
+		// Bulk requests succeed as a whole and report failed items.
+		var result struct {
+			Errors bool `json:"errors"`
+		}
+		if json.Unmarshal(data, &result) == nil && result.Errors {
+			return fmt.Errorf("some of %d documents were rejected", len(rows))
+		}
+	}
+	return nil
+}
+
+// addrs returns the addresses of k as strings.
+func (k flowTuple) addrs() (string, string) {
+	if k.v6 {
+		return net.IP(k.src[:]).String(), net.IP(k.dst[:]).String()
+	}
+	return net.IP(k.src[:4]).String(), net.IP(k.dst[:4]).String()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "packet_capture"
+
+var (
+	activeCaptures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_captures",
+		Help:      "Number of tcpdump processes currently running on this node.",
+	})
+	pendingCaptures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pending_captures",
+		Help:      "Number of captures waiting for a slot under the limit on concurrent captures.",
+	})
+	assignedCaptures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "assigned_captures",
+		Help:      "Number of Pods the cluster controller assigned a capture that has not completed.",
+	})
+	captureStartFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "capture_start_failures_total",
+		Help:      "Number of captures that could not be started.",
+	})
+	processExits = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "process_unexpected_exits_total",
+		Help:      "Number of tcpdump processes that exited without being stopped.",
+	})
+	captureRestarts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "process_restarts_total",
+		Help:      "Number of times tcpdump was restarted after an unexpected exit.",
+	})
+	filesEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_evicted_total",
+		Help:      "Number of completed capture files evicted under disk pressure.",
+	})
+	bytesEvicted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_evicted_total",
+		Help:      "Bytes of completed capture files evicted under disk pressure.",
+	})
+	streamDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "stream_packets_dropped_total",
+		Help:      "Number of packets not streamed because the collector fell behind.",
+	})
+	remoteCaptures = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "remote_captures",
+		Help:      "Number of captures streamed to rpcap clients.",
+	})
+	exportedFiles = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "exported_files_total",
+		Help:      "Number of finished capture files exported to the SFTP or SCP server.",
+	})
+	exportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "export_failures_total",
+		Help:      "Number of export attempts that failed and are retried.",
+	})
+	exportPending = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "export_pending_files",
+		Help:      "Number of finished capture files waiting to be exported.",
+	})
+	notificationsSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notifications_sent_total",
+		Help:      "Number of capture notifications posted to the webhook.",
+	})
+	notificationFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notification_failures_total",
+		Help:      "Number of capture notifications dropped after failing to post or because the queue was full.",
+	})
+	auditFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "audit_failures_total",
+		Help:      "Number of audit entries that could not be written to the audit log or recorded as Events.",
+	})
+	spansExported = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trace_spans_exported_total",
+		Help:      "Number of capture trace spans posted to the OpenTelemetry collector.",
+	})
+	spansDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "trace_spans_dropped_total",
+		Help:      "Number of capture trace spans dropped after the exporter failed to post them.",
+	})
+	certExpiry = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "serving_certificate_expiry_timestamp_seconds",
+		Help:      "When the loaded serving certificate of an endpoint expires.",
+	}, []string{"endpoint"})
+	dropAlerts = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "drop_alerts_total",
+		Help:      "Number of captures whose kernel drops exceeded --drop-alert-percent.",
+	})
+	backendAvailable = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backend_available",
+		Help:      "Whether a capture backend could capture on the node when the agent started.",
+	}, []string{"backend"})
+	oncallFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "oncall_failures_total",
+		Help:      "Number of Slack messages and PagerDuty events dropped after failing to post or because the queue was full.",
+	})
+	mirrorSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_packets_sent_total",
+		Help:      "Number of packets sent to the remote end of mirror captures.",
+	})
+	mirrorDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mirror_packets_dropped_total",
+		Help:      "Number of packets mirror captures could not send.",
+	})
+	filesDeleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_deleted_total",
+		Help:      "Number of pcap files removed by the controller.",
+	})
+	filesTampered = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "files_tampered_total",
+		Help:      "Number of pcap files of running captures deleted, truncated or replaced by something other than the controller.",
+	})
+	flowsExported = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ipfix_flows_exported_total",
+		Help:      "Number of flow records exported to the IPFIX collector.",
+	})
+	ipfixExportFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "ipfix_export_failures_total",
+		Help:      "Number of IPFIX messages that could not be sent to the collector.",
+	})
+	metadataExported = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "metadata_rows_exported_total",
+		Help:      "Number of packet and flow metadata rows written to ClickHouse or Elasticsearch.",
+	})
+	metadataDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "metadata_rows_dropped_total",
+		Help:      "Number of metadata rows dropped because the export fell behind.",
+	})
+	metadataFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "metadata_export_failures_total",
+		Help:      "Number of metadata batches that could not be written.",
+	})
+	replayedPackets = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "replayed_packets_total",
+		Help:      "Number of packets sent by replays of stored captures.",
+	})
+
+	bytesWrittenDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "bytes_written"),
+		"Bytes currently on disk for a running capture, across all rotated files.",
+		[]string{"namespace", "pod", "session"}, nil,
+	)
+	packetsCapturedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "packets_captured_total"),
+		"Packets written to the files of a capture since it last started.",
+		[]string{"namespace", "pod", "session"}, nil,
+	)
+	packetsReceivedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "packets_received_total"),
+		"Packets the kernel handed to a capture since it last started.",
+		[]string{"namespace", "pod", "session"}, nil,
+	)
+	packetsDroppedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "packets_dropped_total"),
+		"Packets the kernel dropped because a capture did not read them in time.",
+		[]string{"namespace", "pod", "session"}, nil,
+	)
+	packetsRateLimitedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "packets_rate_limited_total"),
+		"Packets left out of a capture's files because it was over its write rate.",
+		[]string{"namespace", "pod", "session"}, nil,
+	)
+	costCPUDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cost_cpu_seconds_total"),
+		"CPU time of a capture's process and the agent threads copying its packets since it last started.",
+		[]string{"namespace", "pod", "session", "backend"}, nil,
+	)
+	costMemoryDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cost_memory_bytes"),
+		"Resident memory of a capture's process and the socket buffers the agent reads its packets from.",
+		[]string{"namespace", "pod", "session", "backend"}, nil,
+	)
+	costWrittenDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "cost_written_bytes_total"),
+		"Bytes a capture wrote to its files since it last started, including the files the ring overwrote.",
+		[]string{"namespace", "pod", "session", "backend"}, nil,
+	)
+)
+
+// registerMetrics registers the controller metrics on the default registry,
+// labelling every series with the node name.
+func registerMetrics(m *CaptureManager) {
+	reg := prometheus.WrapRegistererWith(prometheus.Labels{"node": m.nodeName}, prometheus.DefaultRegisterer)
+	reg.MustRegister(activeCaptures, pendingCaptures, captureStartFailures, processExits, captureRestarts, filesDeleted, filesTampered, filesEvicted, bytesEvicted, streamDropped, remoteCaptures, exportedFiles, exportFailures, exportPending, notificationsSent, notificationFailures, auditFailures, oncallFailures, spansExported, spansDropped, certExpiry, backendAvailable, dropAlerts, mirrorSent, mirrorDropped, flowsExported, ipfixExportFailures,
+		metadataExported, metadataDropped, metadataFailures, replayedPackets, m)
+}
+
+// registerControllerMetrics registers the cluster controller metrics on the
+// default registry.
+func registerControllerMetrics() {
+	prometheus.MustRegister(assignedCaptures, pendingCaptures)
+}
+
+// Describe implements prometheus.Collector.
+func (m *CaptureManager) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bytesWrittenDesc
+	ch <- packetsCapturedDesc
+	ch <- packetsReceivedDesc
+	ch <- packetsDroppedDesc
+	ch <- packetsRateLimitedDesc
+	ch <- costCPUDesc
+	ch <- costMemoryDesc
+	ch <- costWrittenDesc
+}
+
+// Collect implements prometheus.Collector by summing the size of each
+// running capture's files at scrape time and reading its packet counters
+// and cost.
+func (m *CaptureManager) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for key, cap := range m.captures {
+		ns, name, session, ok := splitCaptureKey(key)
+		if !ok {
+			// The node capture has no Pod to label it with.
+			continue
+		}
+		_, total := captureFiles(cap)
+		ch <- prometheus.MustNewConstMetric(bytesWrittenDesc, prometheus.GaugeValue, float64(total), ns, name, session)
+		if cap.proc == nil {
+			continue
+		}
+		stats := cap.proc.Stats()
+		ch <- prometheus.MustNewConstMetric(packetsCapturedDesc, prometheus.CounterValue, float64(stats.Captured), ns, name, session)
+		ch <- prometheus.MustNewConstMetric(packetsReceivedDesc, prometheus.CounterValue, float64(stats.Received), ns, name, session)
+		ch <- prometheus.MustNewConstMetric(packetsDroppedDesc, prometheus.CounterValue, float64(stats.Dropped), ns, name, session)
+		ch <- prometheus.MustNewConstMetric(packetsRateLimitedDesc, prometheus.CounterValue, float64(stats.RateLimited), ns, name, session)
+		cost, backend := cap.proc.Cost(), cap.backend.Name()
+		ch <- prometheus.MustNewConstMetric(costCPUDesc, prometheus.CounterValue, cost.CPUSeconds, ns, name, session, backend)
+		ch <- prometheus.MustNewConstMetric(costMemoryDesc, prometheus.GaugeValue, float64(cost.MemoryBytes), ns, name, session, backend)
+		ch <- prometheus.MustNewConstMetric(costWrittenDesc, prometheus.CounterValue, float64(cost.WrittenBytes), ns, name, session, backend)
+	}
+}
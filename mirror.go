@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// outputMirror tunnels the captured packets to a remote analyzer over
+// ERSPAN or GRE instead of writing them.
+const outputMirror = "mirror"
+
+// mirrorAnnotationKey says where a mirror capture sends its packets, as
+// comma separated key=value pairs, e.g.
+// "destination=10.0.0.5,protocol=erspan,session=7".
+const mirrorAnnotationKey = "mirror." + annotationKey
+
+// Mirror tunnel protocols.
+const (
+	mirrorERSPAN = "erspan"
+	mirrorGRE    = "gre"
+)
+
+const (
+	// ipProtocolGRE is the IP protocol number of GRE.
+	ipProtocolGRE = 47
+	// greProtocolERSPAN marks ERSPAN type II, greProtocolTEB Ethernet
+	// frames in plain GRE.
+	greProtocolERSPAN = 0x88be
+	greProtocolTEB    = 0x6558
+	// maxERSPANSession is the largest ERSPAN session ID, a 10-bit field.
+	maxERSPANSession = 1023
+)
+
+// mirrorSpec is a parsed mirror annotation.
+type mirrorSpec struct {
+	Protocol    string
+	Destination net.IP
+	// Session is the ERSPAN session ID the remote end tells mirrors apart
+	// by.
+	Session int
+	// Key is the GRE key, if HasKey.
+	Key    uint32
+	HasKey bool
+}
+
+// String describes the mirror for the status annotation.
+func (s *mirrorSpec) String() string {
+	switch {
+	case s.Protocol == mirrorERSPAN:
+		return fmt.Sprintf("erspan to %s, session %d", s.Destination, s.Session)
+	case s.HasKey:
+		return fmt.Sprintf("gre to %s, key %d", s.Destination, s.Key)
+	}
+	return "gre to " + s.Destination.String()
+}
+
+// parseMirror parses the mirror annotation value v.
+func parseMirror(v string) (*mirrorSpec, error) {
+	s := &mirrorSpec{Protocol: mirrorERSPAN}
+	for _, part := range strings.Split(v, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("expected key=value pairs, got %q", part)
+		}
+		switch key {
+		case "destination":
+			if s.Destination = net.ParseIP(val); s.Destination == nil {
+				return nil, fmt.Errorf("destination must be an IP address, got %q", val)
+			}
+		case "protocol":
+			if val != mirrorERSPAN && val != mirrorGRE {
+				return nil, fmt.Errorf("protocol must be %s or %s, got %q", mirrorERSPAN, mirrorGRE, val)
+			}
+			s.Protocol = val
+		case "session":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 || n > maxERSPANSession {
+				return nil, fmt.Errorf("session must be an ERSPAN session ID from 0 to %d, got %q", maxERSPANSession, val)
+			}
+			s.Session = n
+		case "key":
+			n, err := strconv.ParseUint(val, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("key must be a 32-bit GRE key, got %q", val)
+			}
+			s.Key, s.HasKey = uint32(n), true
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	switch {
+	case s.Destination == nil:
+		return nil, errors.New("no destination given")
+	case s.Protocol == mirrorERSPAN && s.HasKey:
+		return nil, errors.New("key only applies to the gre protocol")
+	}
+	return s, nil
+}
+
+// mirrorAllowed reports whether captures may mirror to ip, which has to be
+// in one of the mirrorDestinations networks. Without any, mirroring is off.
+func (s *Settings) mirrorAllowed(ip net.IP) bool {
+	for _, n := range s.MirrorDestinations {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// mirrorTunnel sends the packets of one capture interface to the remote
+// end of its mirror, each in an IP packet of its own. Packets that cannot
+// be sent are dropped and counted rather than failing the capture, as a
+// packet broker on the other end does not acknowledge anything either.
+type mirrorTunnel struct {
+	conn     *net.IPConn
+	spec     *mirrorSpec
+	linkType layers.LinkType
+	seq      uint32
+	buf      []byte
+	log      *slog.Logger
+	// failing is set while sends fail, so a failure is logged once.
+	failing bool
+}
+
+// openMirror opens the tunnel of a capture interface with linkType.
+func openMirror(spec captureSpec, linkType layers.LinkType) (*mirrorTunnel, error) {
+	network := "ip4:" + strconv.Itoa(ipProtocolGRE)
+	if spec.Mirror.Destination.To4() == nil {
+		network = "ip6:" + strconv.Itoa(ipProtocolGRE)
+	}
+	conn, err := net.DialIP(network, nil, &net.IPAddr{IP: spec.Mirror.Destination})
+	if err != nil {
+		return nil, fmt.Errorf("cannot open mirror tunnel to %s: %w", spec.Mirror.Destination, err)
+	}
+	return &mirrorTunnel{
+		conn:     conn,
+		spec:     spec.Mirror,
+		linkType: linkType,
+		log:      slog.With("namespace", spec.Namespace, "pod", spec.PodName, "session", spec.SessionID, "mirror", spec.Mirror.String()),
+	}, nil
+}
+
+// send encapsulates one packet and sends it.
+func (t *mirrorTunnel) send(ci gopacket.CaptureInfo, data []byte) {
+	frame := ethernetFrame(t.linkType, data)
+	if frame == nil {
+		mirrorDropped.Inc()
+		return
+	}
+	b := t.buf[:0]
+	if t.spec.Protocol == mirrorERSPAN {
+		// GRE with a sequence number, then the ERSPAN type II header:
+		// version 1, no VLAN, the truncated bit and the session ID.
+		t.seq++
+		b = binary.BigEndian.AppendUint16(b, 0x1000)
+		b = binary.BigEndian.AppendUint16(b, greProtocolERSPAN)
+		b = binary.BigEndian.AppendUint32(b, t.seq)
+		word := uint32(1)<<28 | uint32(t.spec.Session)
+		if ci.CaptureLength < ci.Length {
+			word |= 1 << 10
+		}
+		b = binary.BigEndian.AppendUint32(b, word)
+		b = binary.BigEndian.AppendUint32(b, 0)
+	} else {
+		flags := uint16(0)
+		if t.spec.HasKey {
+			flags = 0x2000
+		}
+		b = binary.BigEndian.AppendUint16(b, flags)
+		b = binary.BigEndian.AppendUint16(b, greProtocolTEB)
+		if t.spec.HasKey {
+			b = binary.BigEndian.AppendUint32(b, t.spec.Key)
+		}
+	}
+	b = append(b, frame...)
+	t.buf = b
+	if _, err := t.conn.Write(b); err != nil {
+		mirrorDropped.Inc()
+		if !t.failing {
+			t.failing = true
+			t.log.Warn("Cannot send mirrored packets", "err", err)
+		}
+		return
+	}
+	t.failing = false
+	mirrorSent.Inc()
+}
+
+func (t *mirrorTunnel) Close() error {
+	return t.conn.Close()
+}
+
+// ethernetFrame returns data as an Ethernet frame, which ERSPAN and GRE
+// bridging carry. Packets captured without an Ethernet header get one with
+// the addresses the capture has, zero otherwise. It returns nil for link
+// types without an IP packet to wrap.
+func ethernetFrame(linkType layers.LinkType, data []byte) []byte {
+	zero := make(net.HardwareAddr, 6)
+	switch linkType {
+	case layers.LinkTypeEthernet:
+		return data
+	case layers.LinkTypeLinuxSLL:
+		// The cooked header holds the link address of the sender.
+		src := zero
+		if len(data) >= 14 && binary.BigEndian.Uint16(data[4:6]) == 6 {
+			src = net.HardwareAddr(data[6:12])
+		}
+		return toEthernet(linkType, data, src, zero)
+	case layers.LinkTypeRaw, layers.LinkTypeIPv4, layers.LinkTypeIPv6:
+		if len(data) == 0 {
+			return nil
+		}
+		etherType := uint16(layers.EthernetTypeIPv4)
+		if data[0]>>4 == 6 {
+			etherType = uint16(layers.EthernetTypeIPv6)
+		}
+		frame := make([]byte, 0, 14+len(data))
+		frame = append(append(frame, zero...), zero...)
+		frame = binary.BigEndian.AppendUint16(frame, etherType)
+		return append(frame, data...)
+	}
+	return nil
+}
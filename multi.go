@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// podInterface names the host side of the captured Pod's veth in the
+// interface annotation.
+const podInterface = "pod"
+
+// parseInterfaces parses the comma separated interface annotation.
+func parseInterfaces(v string) ([]string, error) {
+	var ifaces []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, "/ ") {
+			return nil, fmt.Errorf("invalid interface name %q", name)
+		}
+		if !seen[name] {
+			seen[name] = true
+			ifaces = append(ifaces, name)
+		}
+	}
+	if len(ifaces) == 0 {
+		return nil, errors.New("no interface given")
+	}
+	return ifaces, nil
+}
+
+// startBackend starts the capture described by spec on backend. A capture
+// of several interfaces runs one instance per interface in the same
+// session, each writing its own files, so a packet can be followed before
+// and after encapsulation.
+func startBackend(ctx context.Context, backend CaptureBackend, spec captureSpec) (runningCapture, error) {
+	if len(spec.Interfaces) <= 1 {
+		var err error
+		spec.PodPort = spec.Interface == podInterface
+		if spec.Interface, err = resolveInterface(spec.Interface, spec); err != nil {
+			return nil, err
+		}
+		return backend.Start(ctx, spec)
+	}
+	if podPortBackend(backend) {
+		return nil, fmt.Errorf("the %s backend always captures the Pod's interface and cannot capture several", backend.Name())
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	mc := &multiCapture{cancel: cancel}
+	for _, name := range spec.Interfaces {
+		s := spec
+		s.Interfaces = nil
+		s.Path = interfacePath(spec.Path, name, spec.MaxFiles)
+		s.PodPort = name == podInterface
+		ifName, err := resolveInterface(name, spec)
+		if err == nil {
+			s.Interface = ifName
+			var p runningCapture
+			if p, err = backend.Start(ctx, s); err == nil {
+				mc.procs = append(mc.procs, p)
+				continue
+			}
+		}
+		cancel()
+		mc.Wait()
+		return nil, fmt.Errorf("interface %s: %w", name, err)
+	}
+	return mc, nil
+}
+
+// resolveInterface returns the node interface name for an entry of the
+// interface annotation. The Pod's veth is looked up on every start, so
+// restarts follow a recreated Pod sandbox.
+func resolveInterface(name string, spec captureSpec) (string, error) {
+	if name != podInterface {
+		return name, nil
+	}
+	if spec.PodUID == "" {
+		return "", fmt.Errorf("interface %q only applies to Pod captures", podInterface)
+	}
+	ifi, err := podHostInterface(spec.PodUID)
+	if err != nil {
+		return "", fmt.Errorf("cannot find the pod's interface: %w", err)
+	}
+	return ifi.Name, nil
+}
+
+// interfacePath returns the base file name of one interface of a capture,
+// e.g. capture-web.pcap.genev_sys_6081, whose rotated files are numbered
+// after another dot so the number does not run into the interface name. It
+// keeps the capture's base path as prefix, so the files are listed,
+// downloaded and expired with the session.
+func interfacePath(path, name string, maxFiles int) string {
+	if maxFiles > 1 {
+		return path + "." + name + "."
+	}
+	return path + "." + name
+}
+
+// multiCapture is a capture of several interfaces. The instances run and
+// stop together: when one ends, the others are stopped as well.
+type multiCapture struct {
+	procs  []runningCapture
+	cancel context.CancelFunc
+}
+
+// PID returns the process of the first interface, if it has one.
+func (c *multiCapture) PID() int { return c.procs[0].PID() }
+
+func (c *multiCapture) Args() []string { return c.procs[0].Args() }
+
+// Processes returns the PID and arguments of every instance for the state
+// file.
+func (c *multiCapture) Processes() []persistedProcess {
+	var out []persistedProcess
+	for _, p := range c.procs {
+		if p.PID() != 0 {
+			out = append(out, persistedProcess{PID: p.PID(), Args: p.Args()})
+		}
+	}
+	return out
+}
+
+// Wait returns the error of the first instance to end, after all of them
+// have ended.
+func (c *multiCapture) Wait() error {
+	var (
+		once  sync.Once
+		first error
+		wg    sync.WaitGroup
+	)
+	for _, p := range c.procs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := p.Wait()
+			once.Do(func() { first = err })
+			c.cancel()
+		}()
+	}
+	wg.Wait()
+	return first
+}
+
+// Cost sums the cost of every interface.
+func (c *multiCapture) Cost() captureCost {
+	var total captureCost
+	for _, p := range c.procs {
+		total.add(p.Cost())
+	}
+	return total
+}
+
+// Stats sums the counters of every interface.
+func (c *multiCapture) Stats() captureStats {
+	var total captureStats
+	for _, p := range c.procs {
+		s := p.Stats()
+		total.Captured += s.Captured
+		total.Received += s.Received
+		total.Dropped += s.Dropped
+		total.RateLimited += s.RateLimited
+	}
+	return total
+}
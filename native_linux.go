@@ -0,0 +1,474 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// nativeReadTimeout bounds how long a stopped capture keeps reading
+	// and how long the kernel fills a block before it hands it over.
+	nativeReadTimeout = 500 * time.Millisecond
+	// packetRingBlockSize is the size of the blocks of a packet socket's
+	// ring, which the kernel hands over whole, and packetRingBlocks their
+	// number. A block holds at least one packet of the largest snaplen.
+	packetRingBlockSize = 1 << 20
+	packetRingBlocks    = 8
+	// packetRingFrameSize only sizes the ring; TPACKET_V3 packs packets
+	// of any length into the blocks.
+	packetRingFrameSize = 1 << 11
+	// packetMergeWindow is how long the packets of several sockets are
+	// held to be written in timestamp order. Each socket hands over its
+	// block within nativeReadTimeout of its first packet, so a packet that
+	// old has been seen by every socket that got an earlier one.
+	packetMergeWindow = 2 * nativeReadTimeout
+)
+
+// nativeBackend captures in-process from an AF_PACKET socket, so the image does not need tcpdump. It does not compile
+// BPF expressions, which needs libpcap, and only captures on named
+// interfaces. It inspects the packets it writes for the stop-on condition,
+// whose expression tcpdump compiles when the image has it.
+type nativeBackend struct {
+	// workers is the number of sockets reading in parallel.
+	workers int
+	// tcpdump compiles stop-on expressions.
+	tcpdump string
+}
+
+func (b *nativeBackend) Name() string { return backendNative }
+
+// Check opens a packet socket, which fails without CAP_NET_RAW.
+func (b *nativeBackend) Check() error {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return fmt.Errorf("cannot open packet socket: %w", err)
+	}
+	return unix.Close(fd)
+}
+
+// errNativeFilter is returned for filter expressions, which the native
+// backend cannot apply.
+var errNativeFilter = errors.New("the native backend does not support filter expressions")
+
+func (b *nativeBackend) CheckFilter(captureSpec) error { return errNativeFilter }
+
+// CheckMatch compiles the stop-on expression for the interface.
+func (b *nativeBackend) CheckMatch(spec captureSpec) error {
+	_, err := compileMatch(b.tcpdump, spec.Interface, spec.StopOn.Match)
+	return err
+}
+
+func (b *nativeBackend) Start(ctx context.Context, spec captureSpec) (runningCapture, error) {
+	if spec.Filter != "" {
+		return nil, errNativeFilter
+	}
+	if spec.Interface == "any" {
+		return nil, errors.New(`the native backend needs a named interface, not "any"`)
+	}
+	ifi, err := net.InterfaceByName(spec.Interface)
+	if err != nil {
+		return nil, err
+	}
+	ring := newRingWriter(spec, ifi.Name, linkTypeOf(ifi), spec.snaplen())
+	if spec.StopOn != nil {
+		if ring.match, err = compileMatch(b.tcpdump, ifi.Name, spec.StopOn.Match); err != nil {
+			return nil, fmt.Errorf("cannot compile stop-on match: %w", err)
+		}
+	}
+	fds, err := openPacketSockets(ifi.Index, b.workers)
+	if err != nil {
+		return nil, err
+	}
+	if dir := spec.interfaceDirection(spec.PodPort); spec.SampleRate > 1 || dir != "" {
+		// Sampling and directions need the eBPF socket filter; without
+		// them no filter is attached.
+		for _, fd := range fds {
+			if err := attachSocketFilter(fd, spec.snaplen(), spec.SampleRate, dir, nil); err != nil {
+				closeSockets(fds)
+				return nil, err
+			}
+		}
+	}
+	return startSocketCapture(ctx, fds, ring)
+}
+
+// linkTypeOf returns the link type packet sockets deliver for ifi.
+func linkTypeOf(ifi *net.Interface) layers.LinkType {
+	if len(ifi.HardwareAddr) == 0 && ifi.Flags&net.FlagLoopback == 0 {
+		return layers.LinkTypeRaw
+	}
+	return layers.LinkTypeEthernet
+}
+
+// startSocketCapture copies packets from the packet sockets fds into ring
+// until ctx is cancelled. Every socket is read by its own worker through a
+// memory-mapped ring, and hands the packets of each block to the single
+// file writer, which merges the batches of the workers by timestamp. It
+// takes ownership of fds.
+func startSocketCapture(ctx context.Context, fds []int, ring *ringWriter) (*nativeCapture, error) {
+	var rings []*packetRing
+	for _, fd := range fds {
+		r, err := mapPacketRing(fd)
+		if err != nil {
+			for _, r := range rings {
+				r.unmap()
+			}
+			closeSockets(fds)
+			return nil, err
+		}
+		rings = append(rings, r)
+		ring.stats.meter.buffers.Add(int64(len(r.mem)))
+	}
+	if err := ring.open(); err != nil {
+		for _, r := range rings {
+			r.unmap()
+		}
+		closeSockets(fds)
+		return nil, err
+	}
+	readCtx, stop := context.WithCancel(ctx)
+	c := &nativeCapture{done: make(chan struct{}), stats: ring.stats}
+	batches := make(chan packetBatch, len(fds)*4)
+	readErrs := make(chan error, len(fds))
+	var wg sync.WaitGroup
+	for i, r := range rings {
+		wg.Add(1)
+		go func(worker int, r *packetRing) {
+			defer wg.Done()
+			defer unix.Close(r.fd)
+			defer r.unmap()
+			defer ring.stats.meter.track()()
+			if err := r.read(readCtx, worker, ring.spec.snaplen(), batches, ring.stats); err != nil {
+				readErrs <- err
+				stop()
+			}
+		}(i, r)
+	}
+	go func() {
+		wg.Wait()
+		close(batches)
+	}()
+	go func() {
+		defer close(c.done)
+		defer ring.stats.meter.track()()
+		var err error
+		write := func(packets []packet) {
+			for _, p := range packets {
+				if err != nil {
+					return
+				}
+				err = ring.WritePacket(p.ci, p.data)
+				if err != nil && !errors.Is(err, errCaptureComplete) {
+					err = fmt.Errorf("failed to write packet: %w", err)
+				}
+				if err != nil {
+					stop()
+				}
+			}
+		}
+		merge := newPacketMerger(len(fds), packetMergeWindow)
+		tick := time.NewTicker(nativeReadTimeout / 2)
+		defer tick.Stop()
+		for open := true; open; {
+			select {
+			case b, ok := <-batches:
+				if !ok {
+					write(merge.rest())
+					open = false
+					break
+				}
+				merge.add(b)
+				write(merge.ready(time.Now()))
+			case <-tick.C:
+				write(merge.ready(time.Now()))
+			}
+		}
+		stop()
+		if cerr := ring.Close(); err == nil {
+			err = cerr
+		}
+		select {
+		case rerr := <-readErrs:
+			err = rerr
+		default:
+		}
+		c.err = err
+	}()
+	return c, nil
+}
+
+// packet is a packet copied out of the socket buffer.
+type packet struct {
+	ci   gopacket.CaptureInfo
+	data []byte
+}
+
+// packetBatch is the packets of one block of the socket of worker.
+type packetBatch struct {
+	worker  int
+	packets []packet
+}
+
+// packetMerger orders the packets of several sockets by their kernel
+// timestamps. Fanout spreads the packets of an interface over the sockets
+// and each hands over whole blocks, so the batches arrive interleaved. A
+// packet is ready once every worker has handed over a later one, as the
+// packets of each socket come in order, or once it is older than the
+// window, as a worker without traffic hands over nothing.
+type packetMerger struct {
+	window  time.Duration
+	pending packetHeap
+	// seen is the timestamp of the last packet of every worker.
+	seen []time.Time
+	n    uint64
+}
+
+func newPacketMerger(workers int, window time.Duration) *packetMerger {
+	return &packetMerger{window: window, seen: make([]time.Time, workers)}
+}
+
+// add holds the packets of b until they are ready.
+func (m *packetMerger) add(b packetBatch) {
+	for _, p := range b.packets {
+		// n keeps the order of packets with the same timestamp.
+		heap.Push(&m.pending, mergedPacket{p, m.n})
+		m.n++
+	}
+	if len(b.packets) > 0 {
+		m.seen[b.worker] = b.packets[len(b.packets)-1].ci.Timestamp
+	}
+}
+
+// ready returns the packets that no packet still to come precedes at now,
+// oldest first.
+func (m *packetMerger) ready(now time.Time) []packet {
+	until := now.Add(-m.window)
+	if seen := slices.MinFunc(m.seen, time.Time.Compare); seen.After(until) {
+		until = seen
+	}
+	var packets []packet
+	for len(m.pending) > 0 && !m.pending[0].ci.Timestamp.After(until) {
+		packets = append(packets, heap.Pop(&m.pending).(mergedPacket).packet)
+	}
+	return packets
+}
+
+// rest returns the packets still held, oldest first.
+func (m *packetMerger) rest() []packet {
+	packets := make([]packet, 0, len(m.pending))
+	for len(m.pending) > 0 {
+		packets = append(packets, heap.Pop(&m.pending).(mergedPacket).packet)
+	}
+	return packets
+}
+
+// mergedPacket is a packet held by packetMerger, n-th to arrive.
+type mergedPacket struct {
+	packet
+	n uint64
+}
+
+// packetHeap is a min-heap of packets by timestamp and arrival.
+type packetHeap []mergedPacket
+
+func (h packetHeap) Len() int { return len(h) }
+func (h packetHeap) Less(i, j int) bool {
+	if c := h[i].ci.Timestamp.Compare(h[j].ci.Timestamp); c != 0 {
+		return c < 0
+	}
+	return h[i].n < h[j].n
+}
+func (h packetHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *packetHeap) Push(x any)   { *h = append(*h, x.(mergedPacket)) }
+func (h *packetHeap) Pop() any {
+	old := *h
+	p := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return p
+}
+
+// packetRing is the TPACKET_V3 receive ring of a packet socket, mapped into
+// the agent. The kernel fills its blocks with packets and their kernel
+// timestamps and hands them over one at a time, so a busy interface costs
+// one wakeup per block rather than a read per packet.
+type packetRing struct {
+	fd  int
+	mem []byte
+}
+
+// mapPacketRing sets up the receive ring of the packet socket fd.
+func mapPacketRing(fd int) (*packetRing, error) {
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return nil, fmt.Errorf("cannot use TPACKET_V3 packet socket: %w", err)
+	}
+	req := unix.TpacketReq3{
+		Block_size:     packetRingBlockSize,
+		Block_nr:       packetRingBlocks,
+		Frame_size:     packetRingFrameSize,
+		Frame_nr:       packetRingBlocks * packetRingBlockSize / packetRingFrameSize,
+		Retire_blk_tov: uint32(nativeReadTimeout.Milliseconds()),
+	}
+	if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, &req); err != nil {
+		return nil, fmt.Errorf("cannot set up packet ring: %w", err)
+	}
+	mem, err := unix.Mmap(fd, 0, packetRingBlocks*packetRingBlockSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, fmt.Errorf("cannot map packet ring: %w", err)
+	}
+	return &packetRing{fd: fd, mem: mem}, nil
+}
+
+func (r *packetRing) unmap() {
+	unix.Munmap(r.mem)
+}
+
+// blockHeader returns the header of block i, whose status tells whether
+// the kernel or the agent owns the block.
+func (r *packetRing) blockHeader(i int) *unix.TpacketHdrV1 {
+	off := i*packetRingBlockSize + int(unsafe.Offsetof(unix.TpacketBlockDesc{}.Hdr))
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&r.mem[off]))
+}
+
+// read reads the blocks the kernel hands over until ctx is cancelled, and
+// sends the packets of each as a batch of worker, truncated to snaplen. The
+// socket counters are added to stats every statsInterval and when it
+// returns.
+func (r *packetRing) read(ctx context.Context, worker, snaplen int, batches chan<- packetBatch, stats *packetStats) error {
+	defer stats.addSocketStats(r.fd)
+	lastStats := time.Now()
+	fds := []unix.PollFd{{Fd: int32(r.fd), Events: unix.POLLIN}}
+	for i := 0; ctx.Err() == nil; {
+		if time.Since(lastStats) >= statsInterval {
+			stats.addSocketStats(r.fd)
+			lastStats = time.Now()
+		}
+		hdr := r.blockHeader(i)
+		if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			_, err := unix.Poll(fds, int(nativeReadTimeout.Milliseconds()))
+			if err != nil && !errors.Is(err, unix.EINTR) {
+				return fmt.Errorf("failed to wait for packets: %w", err)
+			}
+			continue
+		}
+		if batch := r.packets(i, hdr, snaplen); len(batch) > 0 {
+			batches <- packetBatch{worker, batch}
+		}
+		// The packets were copied, so the block goes back to the kernel.
+		atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+		i = (i + 1) % packetRingBlocks
+	}
+	return nil
+}
+
+// packets copies the packets out of block i with header hdr.
+func (r *packetRing) packets(i int, hdr *unix.TpacketHdrV1, snaplen int) []packet {
+	block := r.mem[i*packetRingBlockSize : (i+1)*packetRingBlockSize]
+	batch := make([]packet, 0, hdr.Num_pkts)
+	off := int(hdr.Offset_to_first_pkt)
+	for n := 0; n < int(hdr.Num_pkts) && off < len(block); n++ {
+		h := (*unix.Tpacket3Hdr)(unsafe.Pointer(&block[off]))
+		data := block[off+int(h.Mac):][:h.Snaplen]
+		ci := gopacket.CaptureInfo{
+			// The kernel stamped the packet when it received it.
+			Timestamp:     time.Unix(int64(h.Sec), int64(h.Nsec)),
+			Length:        int(h.Len),
+			CaptureLength: min(len(data), snaplen),
+		}
+		batch = append(batch, packet{ci, append([]byte(nil), data[:ci.CaptureLength]...)})
+		off += int(h.Next_offset)
+	}
+	return batch
+}
+
+// openPacketSockets opens workers packet sockets bound to ifindex. Several
+// sockets join a fanout group that spreads packets by flow hash, so the
+// packets of a connection stay on one socket and in order, whatever NIC
+// queue they arrive on. Defragmenting first hashes all fragments of a
+// packet alike.
+func openPacketSockets(ifindex, workers int) ([]int, error) {
+	var fds []int
+	group := int(fanoutGroup.Add(1) & 0xffff)
+	for i := 0; i < max(workers, 1); i++ {
+		fd, err := openPacketSocket(ifindex)
+		if err != nil {
+			closeSockets(fds)
+			return nil, err
+		}
+		fds = append(fds, fd)
+		if workers <= 1 {
+			break
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, group|(unix.PACKET_FANOUT_HASH|unix.PACKET_FANOUT_FLAG_DEFRAG)<<16); err != nil {
+			closeSockets(fds)
+			return nil, fmt.Errorf("cannot join packet fanout group: %w", err)
+		}
+	}
+	return fds, nil
+}
+
+// fanoutGroup hands out fanout group IDs, which are shared per network
+// namespace.
+var fanoutGroup atomic.Uint32
+
+func closeSockets(fds []int) {
+	for _, fd := range fds {
+		unix.Close(fd)
+	}
+}
+
+// openPacketSocket opens an AF_PACKET socket bound to ifindex.
+func openPacketSocket(ifindex int) (int, error) {
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return -1, fmt.Errorf("cannot open packet socket: %w", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifindex}); err != nil {
+		unix.Close(fd)
+		return -1, fmt.Errorf("cannot bind packet socket: %w", err)
+	}
+	return fd, nil
+}
+
+// nativeCapture is an in-process capture.
+type nativeCapture struct {
+	done  chan struct{}
+	stats *packetStats
+	// err is written before done is closed.
+	err error
+}
+
+func (c *nativeCapture) PID() int            { return 0 }
+func (c *nativeCapture) Args() []string      { return nil }
+func (c *nativeCapture) Stats() captureStats { return c.stats.snapshot() }
+func (c *nativeCapture) Cost() captureCost   { return c.stats.cost(0) }
+
+func (c *nativeCapture) Wait() error {
+	<-c.done
+	return c.err
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }
+
+// addSocketStats adds the counters of packet socket fd to s. The kernel
+// resets them on every read.
+func (s *packetStats) addSocketStats(fd int) {
+	st, err := unix.GetsockoptTpacketStatsV3(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	if err != nil {
+		return
+	}
+	// Packets counts the dropped ones as well.
+	s.received.Add(uint64(st.Packets))
+	s.dropped.Add(uint64(st.Drops))
+}
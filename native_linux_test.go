@@ -0,0 +1,73 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+func TestPacketMergerOrdersWorkers(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	batch := func(worker int, offsets ...int) packetBatch {
+		b := packetBatch{worker: worker}
+		for _, off := range offsets {
+			ts := start.Add(time.Duration(off) * time.Millisecond)
+			b.packets = append(b.packets, packet{ci: gopacket.CaptureInfo{Timestamp: ts}, data: []byte{byte(worker), byte(off)}})
+		}
+		return b
+	}
+	offsets := func(packets []packet) []int {
+		var out []int
+		for _, p := range packets {
+			out = append(out, int(p.ci.Timestamp.Sub(start)/time.Millisecond))
+		}
+		return out
+	}
+
+	m := newPacketMerger(2, time.Second)
+	now := start.Add(100 * time.Millisecond)
+	m.add(batch(0, 10, 30, 50))
+	if got := offsets(m.ready(now)); len(got) != 0 {
+		t.Fatalf("ready before worker 1 handed anything over = %v, want none", got)
+	}
+	m.add(batch(1, 20, 40))
+	if got, want := offsets(m.ready(now)), []int{10, 20, 30, 40}; !slices.Equal(got, want) {
+		t.Fatalf("ready = %v, want %v up to the last packet of worker 1", got, want)
+	}
+	m.add(batch(0, 60))
+	if got := offsets(m.ready(now)); len(got) != 0 {
+		t.Fatalf("ready = %v, want none until worker 1 catches up", got)
+	}
+	// Worker 1 has no traffic, so the window releases the packets.
+	if got, want := offsets(m.ready(start.Add(1055*time.Millisecond))), []int{50}; !slices.Equal(got, want) {
+		t.Fatalf("ready after the window = %v, want %v", got, want)
+	}
+	m.add(batch(1, 60, 70))
+	if got, want := offsets(m.rest()), []int{60, 60, 70}; !slices.Equal(got, want) {
+		t.Fatalf("rest = %v, want %v", got, want)
+	}
+	if got := m.rest(); len(got) != 0 {
+		t.Errorf("rest after rest = %v, want none", got)
+	}
+}
+
+func TestPacketMergerKeepsArrivalOrderOfEqualTimestamps(t *testing.T) {
+	ts := time.Unix(1700000000, 0)
+	m := newPacketMerger(1, time.Second)
+	var b packetBatch
+	for i := range 5 {
+		b.packets = append(b.packets, packet{ci: gopacket.CaptureInfo{Timestamp: ts}, data: []byte{byte(i)}})
+	}
+	m.add(b)
+	packets := m.ready(ts)
+	if len(packets) != len(b.packets) {
+		t.Fatalf("ready = %d packets, want %d", len(packets), len(b.packets))
+	}
+	for i, p := range packets {
+		if p.data[0] != byte(i) {
+			t.Fatalf("packet %d is the %d-th to arrive", i, p.data[0])
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// podInterfaceName is the Pod side of the CNI veth pair.
+const podInterfaceName = "eth0"
+
+// podHostInterface returns the host side of the Pod's veth pair. It finds
+// a process of the Pod through its cgroup, which needs hostPID, and asks
+// the Pod's network namespace for the peer index of eth0.
+func podHostInterface(podUID string) (*net.Interface, error) {
+	pid, err := podProcess(podUID)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := peerIndex(pid, podInterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	return net.InterfaceByIndex(peer)
+}
+
+// podProcess returns a process running in the Pod's cgroup. Depending on the
+// cgroup driver the UID appears with dashes or underscores.
+func podProcess(podUID string) (int, error) {
+	if podUID == "" {
+		return 0, errors.New("pod UID unknown")
+	}
+	ids := [][]byte{[]byte(podUID), []byte(strings.ReplaceAll(podUID, "-", "_"))}
+	procs, _ := filepath.Glob("/proc/[0-9]*/cgroup")
+	for _, f := range procs {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		for _, id := range ids {
+			if bytes.Contains(data, id) {
+				return strconv.Atoi(filepath.Base(filepath.Dir(f)))
+			}
+		}
+	}
+	return 0, fmt.Errorf("no process found for pod %s; the agent needs hostPID", podUID)
+}
+
+// startInNetns starts cmd in the network namespace of pid. A child process
+// inherits the namespaces of the thread that forks it, which is never
+// unlocked and exits with the goroutine.
+func startInNetns(cmd *exec.Cmd, pid int) error {
+	ch := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+		ns, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"))
+		if err != nil {
+			ch <- err
+			return
+		}
+		defer ns.Close()
+		if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+			ch <- fmt.Errorf("cannot enter network namespace of pid %d: %w", pid, err)
+			return
+		}
+		ch <- cmd.Start()
+	}()
+	return <-ch
+}
+
+// peerIndex returns the IFLA_LINK index of ifName in the network namespace
+// of pid, which for a veth is the peer's index on the host.
+func peerIndex(pid int, ifName string) (int, error) {
+	type result struct {
+		index int
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		// The thread is never unlocked, so it exits with the goroutine
+		// instead of going back to the scheduler in the Pod's namespace.
+		runtime.LockOSThread()
+		index, err := linkPeerInNetns(pid, ifName)
+		ch <- result{index, err}
+	}()
+	r := <-ch
+	return r.index, r.err
+}
+
+func linkPeerInNetns(pid int, ifName string) (int, error) {
+	ns, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"))
+	if err != nil {
+		return 0, err
+	}
+	defer ns.Close()
+	if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+		return 0, fmt.Errorf("cannot enter network namespace of pid %d: %w", pid, err)
+	}
+
+	rib, err := syscall.NetlinkRIB(syscall.RTM_GETLINK, syscall.AF_UNSPEC)
+	if err != nil {
+		return 0, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(rib)
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Type != syscall.RTM_NEWLINK {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&msg)
+		if err != nil {
+			continue
+		}
+		var name string
+		link := -1
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.IFLA_IFNAME:
+				name = string(bytes.TrimRight(a.Value, "\x00"))
+			case syscall.IFLA_LINK:
+				link = int(binary.LittleEndian.Uint32(a.Value))
+			}
+		}
+		if name == ifName && link > 0 {
+			return link, nil
+		}
+	}
+	return 0, fmt.Errorf("interface %s of pid %d has no peer", ifName, pid)
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+)
+
+// podInterfaceName is the Pod's interface, as replays name it by default.
+const podInterfaceName = "eth0"
+
+// errNoPodNetns is returned for what needs a Pod's network namespace,
+// which Windows Pods do not have: their endpoints live in HNS.
+var errNoPodNetns = errors.New("pod network namespaces are not supported on Windows nodes")
+
+func podHostInterface(podUID string) (*net.Interface, error) { return nil, errNoPodNetns }
+
+func podProcess(podUID string) (int, error) { return 0, errNoPodNetns }
+
+func startInNetns(cmd *exec.Cmd, pid int) error { return errNoPodNetns }
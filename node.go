@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Node capture annotations, set next to tcpdump.antrea.io on the Node. The
+// option annotations of Pod captures apply as well.
+const (
+	rotateAnnotationKey    = "rotate." + annotationKey
+	retentionAnnotationKey = "retention." + annotationKey
+)
+
+// watchNode sets up an informer for this agent's own Node, whose capture
+// annotation starts a node-wide capture, and returns its sync function.
+// The Node's queue key has no namespace, so it never collides with a Pod.
+func (m *CaptureManager) watchNode(ctx context.Context) []cache.InformerSynced {
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		m.clientset, m.cfg.ResyncInterval,
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", m.nodeName).String()
+		}),
+	)
+	nodeInformer := factory.Core().V1().Nodes()
+	m.nodeLister = nodeInformer.Lister()
+	nodeInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: m.enqueuePod,
+		UpdateFunc: func(old, obj interface{}) {
+			m.enqueuePod(obj)
+			m.enqueueNodePods(old, obj)
+		},
+		DeleteFunc: m.enqueuePod,
+	})
+	factory.Start(ctx.Done())
+	return []cache.InformerSynced{nodeInformer.Informer().HasSynced}
+}
+
+// syncNode starts or stops the node-wide capture based on the Node's
+// capture annotation. It mirrors syncPod for the cases that apply to Nodes.
+func (m *CaptureManager) syncNode(key string) error {
+	node, err := m.nodeLister.Get(key)
+	if apierrors.IsNotFound(err) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.stopCapture(key, false, false)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	val, annotated := node.Annotations[annotationKey]
+	if v, ok := node.Annotations[snapshotAnnotationKey]; ok {
+		m.requestSnapshot(nodeRef(node), key, v)
+	}
+	if v, ok := node.Annotations[replayAnnotationKey]; ok {
+		m.requestReplay(nodeRef(node), key, v, "", func() (int, error) { return 0, nil })
+	}
+
+	var checks *specChecks
+	if annotated {
+		checks = m.checkNodeStart(node, val)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cap, capturing := m.captures[key]
+
+	switch {
+	case annotated && !capturing && statusState(node, "") == stateCompleted:
+	case !annotated && !capturing && statusState(node, "") == statePending:
+		m.leaveQueue(key)
+		m.patchStatus(nodeRef(node), captureStatus{State: stateStopped, Node: m.nodeName})
+		return nil
+	case !annotated && !capturing && statusState(node, "") == stateCompleted:
+		m.patchStatus(nodeRef(node), captureStatus{State: stateStopped, Node: m.nodeName})
+		return nil
+	case annotated && !capturing:
+		slog.Info("Starting node capture", "maxFiles", val)
+		return m.startNodeCapture(node, val, checks)
+	case !annotated && capturing:
+		slog.Info("Stopping node capture")
+		m.stopCapture(key, cap.retention == RetentionDelete, true)
+	case annotated && cap.completed.Load():
+	case annotated && cap.exited.Load():
+		return m.restartCapture(key, cap)
+	case annotated && !statusCurrent(node, cap):
+		m.patchStatus(cap.ref, m.status(cap))
+		return nil
+	}
+	return nil
+}
+
+// checkNodeStart checks the filter and stop-on match of the capture of
+// node with its backend, unless it is running or cannot start anyway.
+func (m *CaptureManager) checkNodeStart(node *corev1.Node, val string) *specChecks {
+	m.mu.Lock()
+	_, capturing := m.captures[node.Name]
+	m.mu.Unlock()
+	maxFiles, err := strconv.Atoi(strings.TrimSpace(val))
+	if capturing || err != nil || maxFiles <= 0 {
+		return nil
+	}
+	spec, backend, _, err := m.nodeSpec(node, maxFiles)
+	if err != nil {
+		return nil
+	}
+	return runSpecChecks(backend, spec)
+}
+
+// startNodeCapture starts a capture of the node's own interfaces. It uses
+// the rotation and retention given on the Node rather than the agent
+// settings, and writes node-<node>.pcap files that the Pod retention
+// policy, janitor and garbage collection leave alone. checks is what
+// syncNode found checking the filter before it took m.mu, which callers
+// must hold.
+func (m *CaptureManager) startNodeCapture(node *corev1.Node, val string, checks *specChecks) error {
+	if _, ok := m.stopping[node.Name]; ok {
+		// The previous capture is still closing its files.
+		return nil
+	}
+	maxFiles, err := strconv.Atoi(strings.TrimSpace(val))
+	if err != nil || maxFiles <= 0 {
+		m.reportNodeFailure(node, reasonCaptureFailed, fmt.Sprintf("Invalid %s annotation value %q: must be a positive file count", annotationKey, val))
+		return nil
+	}
+	if err := m.settings().authorizeRequest(node, "", ""); err != nil {
+		m.reportNodeFailure(node, reasonCaptureDenied, fmt.Sprintf("Cannot start capture: %v", err))
+		return nil
+	}
+	spec, backend, retention, err := m.nodeSpec(node, maxFiles)
+	if err != nil {
+		m.reportNodeFailure(node, reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+		return nil
+	}
+	if !checks.checked(backend, spec) {
+		// The request changed since syncNode checked it.
+		m.queue.Add(node.Name)
+		return nil
+	}
+	if err := checks.filterErr; err != nil {
+		m.reportNodeFailure(node, reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+		return nil
+	}
+	if err := checkDirection(backend, spec); err != nil {
+		m.reportNodeFailure(node, reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+		return nil
+	}
+	if err := checks.stopOnErr; err != nil {
+		m.reportNodeFailure(node, reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+		return nil
+	}
+	spec.limitWriteRate(m.settings().MaxWriteRateMB)
+	if spec.Output == outputStream || spec.Output == outputBoth {
+		if m.collector == nil {
+			m.reportNodeFailure(node, reasonCaptureFailed, "Cannot start capture: no collector is configured for streaming")
+			return nil
+		}
+		spec.Collector = m.collector
+	}
+	if spec.Output == outputIPFIX {
+		if m.ipfix == nil {
+			m.reportNodeFailure(node, reasonCaptureFailed, "Cannot start capture: no IPFIX collector is configured")
+			return nil
+		}
+		spec.Flows = m.ipfix
+	}
+	if spec.Mirror != nil && !m.settings().mirrorAllowed(spec.Mirror.Destination) {
+		m.reportNodeFailure(node, reasonCaptureDenied, fmt.Sprintf("Cannot start capture: mirror destination %s is not in the %s setting", spec.Mirror.Destination, settingMirrorDestinations))
+		return nil
+	}
+	if spec.Metadata != "" {
+		if m.metadata == nil {
+			m.reportNodeFailure(node, reasonCaptureFailed, "Cannot start capture: no metadata sink is configured")
+			return nil
+		}
+		spec.MetadataSink = m.metadata
+	}
+	if spec.writesFiles() {
+		if reason, msg := m.checkCaptureDisk(spec, m.settings().NodeQuotaMB); reason != "" {
+			m.reportNodeFailure(node, reason, msg)
+			return nil
+		}
+	}
+
+	key := node.Name
+	if pos, wait := m.waitForSlot(key, spec); wait {
+		return m.reportPending(nodeRef(node), annotatedStatus(node, ""), spec, pos)
+	}
+	sessionID := newSessionID()
+	resumed, ok := m.resumedSessions[key]
+	if ok {
+		sessionID = resumed.ID
+		delete(m.resumedSessions, key)
+	}
+	spec.SessionID = sessionID
+	spec.Trace = m.tracer.startCapture(traceStart(captureRequestTime(node, ""), ok), node.Annotations[traceparentAnnotationKey],
+		attr("capture.source", "Node "+node.Name), attr("capture.backend", backend.Name()))
+	spec.Trace.setSession(sessionID)
+	spec.Live = newLiveFeed()
+	spec.Export = m.exporter
+	spec.Encrypt = m.fileKey
+	spec.Rotate = &rotateRequest{}
+	spec.Guard = newFileGuard()
+	spec.WriteLimit = newWriteLimiter(spec.WriteRateMB)
+	cap := &CaptureProcess{
+		backend:   backend,
+		spec:      spec,
+		files:     []string{spec.Path},
+		ref:       nodeRef(node),
+		sessionID: sessionID,
+		log:       slog.With("session", sessionID, "interface", spec.Interface),
+		retention: retention,
+	}
+	if err := m.launch(key, cap); err != nil {
+		return err
+	}
+	m.patchStatus(cap.ref, m.status(cap))
+	return nil
+}
+
+// nodeSpec builds the spec of the capture of node from its annotations,
+// with the backend and retention it asks for. It does not touch the state
+// m.mu guards, so syncNode builds the spec before taking the lock to check
+// its filter.
+func (m *CaptureManager) nodeSpec(node *corev1.Node, maxFiles int) (captureSpec, CaptureBackend, RetentionMode, error) {
+	spec := captureSpec{
+		Path:      m.nodePcapPath(),
+		Interface: m.cfg.Interface,
+		RotateMB:  m.settings().RotateSizeMB,
+		MaxFiles:  maxFiles,
+		Node:      m.nodeName,
+		Requester: captureRequester(node, ""),
+	}
+	retention := RetentionKeep
+	if err := applyNodeOptions(node.Annotations, &spec, &retention); err != nil {
+		return spec, nil, retention, err
+	}
+	backend, err := m.podBackend(node.Annotations)
+	if err == nil && podPortBackend(backend) {
+		err = fmt.Errorf("the %s backend captures on a Pod's interface and cannot capture the node", backend.Name())
+	}
+	if err == nil {
+		err = applyPodOptions(node.Annotations, &spec)
+	}
+	if err == nil && spec.Storage != "" {
+		err = fmt.Errorf("the %s annotation only applies to Pod captures", storageAnnotationKey)
+	}
+	if _, ok := node.Annotations[interfaceAnnotationKey]; err == nil && len(spec.Addresses) > 0 && !ok {
+		// Capture where the node sends the traffic to the addresses.
+		var ifaces []string
+		if ifaces, err = routeInterfaces(spec.Addresses); len(ifaces) == 1 {
+			spec.Interface = ifaces[0]
+		} else if len(ifaces) > 1 {
+			spec.Interfaces = ifaces
+		}
+	}
+	if err == nil {
+		err = m.capabilities.Load().captureMissing(backend, spec)
+	}
+	if err == nil && spec.DryRun {
+		err = fmt.Errorf("the %s annotation only applies to Pod captures", dryRunAnnotationKey)
+	}
+	return spec, backend, retention, err
+}
+
+// applyNodeOptions applies the Node-only annotations to spec and retention.
+func applyNodeOptions(annotations map[string]string, spec *captureSpec, retention *RetentionMode) error {
+	if v, ok := annotations[rotateAnnotationKey]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s annotation must be a positive size in MB, got %q", rotateAnnotationKey, v)
+		}
+		spec.RotateMB = n
+	}
+	if v, ok := annotations[retentionAnnotationKey]; ok {
+		switch mode := RetentionMode(strings.TrimSpace(v)); mode {
+		case RetentionKeep, RetentionDelete:
+			*retention = mode
+		default:
+			return fmt.Errorf("%s annotation must be keep or delete, got %q", retentionAnnotationKey, v)
+		}
+	}
+	return nil
+}
+
+// reportNodeFailure records a Warning Event and a failed status on the
+// Node, unless the status already reports the same failure. Callers must
+// hold m.mu.
+func (m *CaptureManager) reportNodeFailure(node *corev1.Node, reason, msg string) {
+	var st captureStatus
+	if json.Unmarshal([]byte(node.Annotations[statusAnnotationKey]), &st) == nil &&
+		st.State == stateFailed && st.Message == msg {
+		return
+	}
+	m.leaveQueue(node.Name)
+	slog.Warn("Node capture failed", "reason", msg)
+	captureStartFailures.Inc()
+	m.recorder.Event(nodeRef(node), corev1.EventTypeWarning, reason, msg)
+	m.patchStatus(nodeRef(node), captureStatus{State: stateFailed, Node: m.nodeName, Message: msg})
+	m.notifyFailure(nil, "", msg)
+}
+
+// nodePcapPath returns the base file name of the node capture.
+func (m *CaptureManager) nodePcapPath() string {
+	return filepath.Join(m.cfg.CaptureDir, fmt.Sprintf("node-%s.pcap", m.nodeName))
+}
+
+// nodeRef returns the reference Events and status patches of the node
+// capture use.
+func nodeRef(node *corev1.Node) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		Kind:            "Node",
+		APIVersion:      "v1",
+		Name:            node.Name,
+		UID:             node.UID,
+		ResourceVersion: node.ResourceVersion,
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// nodesAnnotationKey limits a capture to the Pods on the named nodes, a
+// comma-separated list of node names or patterns, so captures of a
+// Namespace, workload or CaptureTarget do not fan out onto every node.
+const nodesAnnotationKey = "nodes." + annotationKey
+
+// nodeSelectorAnnotationKey limits a capture to the Pods on the nodes whose
+// labels match a label selector, e.g. topology.kubernetes.io/zone=eu-west-1a.
+const nodeSelectorAnnotationKey = "node-selector." + annotationKey
+
+// nodeScope is the set of nodes a capture applies to. A node must match
+// both the names and the selector of those given.
+type nodeScope struct {
+	names    []string
+	selector labels.Selector
+}
+
+// parseNodeScope parses the node scope of the capture annotations. It
+// returns nil if they do not limit the nodes.
+func parseNodeScope(annotations map[string]string) (*nodeScope, error) {
+	var scope nodeScope
+	if v, ok := annotations[nodesAnnotationKey]; ok {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name == "" {
+				continue
+			}
+			if _, err := path.Match(name, ""); err != nil {
+				return nil, fmt.Errorf("%s annotation has an invalid pattern %q", nodesAnnotationKey, name)
+			}
+			scope.names = append(scope.names, name)
+		}
+		if len(scope.names) == 0 {
+			return nil, fmt.Errorf("%s annotation names no node", nodesAnnotationKey)
+		}
+	}
+	if v, ok := annotations[nodeSelectorAnnotationKey]; ok {
+		sel, err := labels.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s annotation must be a label selector: %v", nodeSelectorAnnotationKey, err)
+		}
+		scope.selector = sel
+	}
+	if scope.names == nil && scope.selector == nil {
+		return nil, nil
+	}
+	return &scope, nil
+}
+
+// includes reports whether the node of the given name and labels is in the
+// scope.
+func (s *nodeScope) includes(name string, nodeLabels map[string]string) bool {
+	if s.names != nil && !matchNodeName(s.names, name) {
+		return false
+	}
+	return s.selector == nil || s.selector.Matches(labels.Set(nodeLabels))
+}
+
+func matchNodeName(patterns []string, name string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// inNodeScope reports whether the capture annotations of pod apply to the
+// node it runs on. Invalid scopes are left to startCapture to report, so
+// they count as in scope.
+func (m *CaptureManager) inNodeScope(pod *corev1.Pod, annotations map[string]string) (bool, error) {
+	scope, err := parseNodeScope(annotations)
+	if err != nil || scope == nil {
+		return true, nil
+	}
+	if pod.Spec.NodeName == "" {
+		return false, nil
+	}
+	if scope.selector == nil {
+		return scope.includes(pod.Spec.NodeName, nil), nil
+	}
+	node, err := m.nodeLister.Get(pod.Spec.NodeName)
+	if err != nil {
+		return false, fmt.Errorf("cannot look up node %s for the node scope of the capture: %w", pod.Spec.NodeName, err)
+	}
+	return scope.includes(node.Name, node.Labels), nil
+}
+
+// enqueueNodePods enqueues the Pods on a node whose labels changed, since
+// node selectors of their captures may now pick the node or leave it.
+func (m *CaptureManager) enqueueNodePods(old, obj interface{}) {
+	oldNode, ok := old.(*corev1.Node)
+	node, ok2 := obj.(*corev1.Node)
+	if !ok || !ok2 || maps.Equal(oldNode.Labels, node.Labels) {
+		return
+	}
+	pods, err := m.podLister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, pod := range pods {
+		if pod.Spec.NodeName == node.Name {
+			m.enqueuePod(pod)
+		}
+	}
+}
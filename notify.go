@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// notifyQueue is the number of notifications waiting to be sent;
+	// more are dropped.
+	notifyQueue = 256
+	// notifyAttempts is how often a notification is sent before it is
+	// dropped, notifyTimeout how long each attempt may take.
+	notifyAttempts = 5
+	notifyTimeout  = 10 * time.Second
+	// notifySignatureHeader carries the HMAC-SHA256 of the body with the
+	// notification secret, if one is set.
+	notifySignatureHeader = "X-Capture-Signature"
+)
+
+// captureNotification is the JSON body posted when a capture stops,
+// completes or fails. Captures that failed to start have no session ID
+// and no files; the node capture has no Namespace and Pod.
+type captureNotification struct {
+	Event     string         `json:"event"`
+	Namespace string         `json:"namespace,omitempty"`
+	Pod       string         `json:"pod,omitempty"`
+	Node      string         `json:"node"`
+	Session   string         `json:"session,omitempty"`
+	SessionID string         `json:"sessionID,omitempty"`
+	Requester string         `json:"requester,omitempty"`
+	Message   string         `json:"message,omitempty"`
+	StartTime *time.Time     `json:"startTime,omitempty"`
+	Time      time.Time      `json:"time"`
+	Files     []notifiedFile `json:"files,omitempty"`
+}
+
+type notifiedFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	// URL downloads the file from the agent with the API token; it is
+	// only set when the download endpoints are enabled.
+	URL string `json:"url,omitempty"`
+	// Export is where the file is exported to, if exports are configured.
+	Export string `json:"export,omitempty"`
+}
+
+// notifier posts capture notifications to the configured webhook, retrying
+// failed posts with a backoff. It is shared by every capture and never
+// holds up the capture that is notified about.
+type notifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	queue  chan captureNotification
+}
+
+// newNotifier returns the notifier of --notify-url, or nil if none is
+// configured.
+func newNotifier(cfg *Config) *notifier {
+	if cfg.NotifyURL == "" {
+		return nil
+	}
+	n := &notifier{
+		url:    cfg.NotifyURL,
+		secret: []byte(cfg.NotifySecret),
+		client: &http.Client{Timeout: notifyTimeout},
+		queue:  make(chan captureNotification, notifyQueue),
+	}
+	go n.run()
+	return n
+}
+
+// send queues a notification, dropping it when the queue is full.
+func (n *notifier) send(msg captureNotification) {
+	if n == nil {
+		return
+	}
+	select {
+	case n.queue <- msg:
+	default:
+		notificationFailures.Inc()
+		slog.Warn("Notification queue full, dropping notification", "event", msg.Event, "namespace", msg.Namespace, "pod", msg.Pod)
+	}
+}
+
+func (n *notifier) run() {
+	for msg := range n.queue {
+		body, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		backoff := time.Second
+		for attempt := 1; ; attempt++ {
+			err = n.post(msg.Event, body)
+			if err == nil {
+				notificationsSent.Inc()
+				break
+			}
+			if attempt == notifyAttempts {
+				notificationFailures.Inc()
+				slog.Warn("Cannot send notification", "event", msg.Event, "namespace", msg.Namespace, "pod", msg.Pod, "err", err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+func (n *notifier) post(event string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Capture-Event", event)
+	if len(n.secret) > 0 {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set(notifySignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyCapture notifies about cap with the event, one of the capture
+// states, listing the files it has written so far.
+func (m *CaptureManager) notifyCapture(cap *CaptureProcess, event, message string) {
+	if m.notifier == nil {
+		return
+	}
+	msg := captureNotification{
+		Event:     event,
+		Namespace: cap.spec.Namespace,
+		Pod:       cap.spec.PodName,
+		Node:      m.nodeName,
+		Session:   cap.spec.Session,
+		SessionID: cap.spec.SessionID,
+		Requester: cap.spec.Requester,
+		Message:   message,
+		Time:      time.Now().UTC(),
+	}
+	if !cap.startTime.IsZero() {
+		msg.StartTime = &cap.startTime
+	}
+	owner := cap.spec.PodName
+	if owner == "" {
+		owner = m.nodeName
+	}
+	base := m.agentURL()
+	files, _ := captureFiles(cap)
+	for _, f := range files {
+		nf := notifiedFile{Name: f.Name, Size: f.Size, Export: m.exporter.location(f.Name)}
+		if base != "" {
+			nf.URL = base + "/captures/" + url.PathEscape(owner) + "/" + url.PathEscape(f.Name)
+		}
+		msg.Files = append(msg.Files, nf)
+	}
+	m.notifier.send(msg)
+}
+
+// notifyFailure notifies that the capture of pod, or of the node if pod
+// is nil, failed to start.
+func (m *CaptureManager) notifyFailure(pod *corev1.Pod, session, message string) {
+	msg := captureNotification{Event: stateFailed, Node: m.nodeName, Session: session, Message: message, Time: time.Now().UTC()}
+	if pod != nil {
+		msg.Namespace, msg.Pod = pod.Namespace, pod.Name
+	}
+	m.notifier.send(msg)
+}
+
+// agentURL returns the base URL of the agent's download endpoints on the
+// node's InternalIP, or "" if they are disabled or the node has no
+// InternalIP.
+func (m *CaptureManager) agentURL() string {
+	if m.cfg.APIToken == "" && m.cfg.APIAuthorization != apiAuthKubernetes || m.nodeLister == nil {
+		return ""
+	}
+	_, port, err := net.SplitHostPort(m.cfg.HTTPAddr)
+	if err != nil {
+		return ""
+	}
+	node, err := m.nodeLister.Get(m.nodeName)
+	if err != nil {
+		return ""
+	}
+	for _, addr := range node.Status.Addresses {
+		if addr.Type == corev1.NodeInternalIP {
+			scheme := "http://"
+			if m.cfg.TLSCert != "" {
+				scheme = "https://"
+			}
+			return scheme + net.JoinHostPort(addr.Address, port)
+		}
+	}
+	return ""
+}
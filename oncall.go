@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	neturl "net/url"
+	"sync/atomic"
+	"time"
+)
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint alerts are
+// sent to.
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDuty event actions and severities.
+const (
+	pagerDutyTrigger  = "trigger"
+	pagerDutyResolve  = "resolve"
+	pagerDutyWarning  = "warning"
+	pagerDutyCritical = "critical"
+)
+
+// oncallMessage is a message for the on-call channels. Messages without a
+// dedupKey only go to Slack; the others also open or, with resolve set,
+// close the PagerDuty alert of that key.
+type oncallMessage struct {
+	text     string
+	dedupKey string
+	severity string
+	resolve  bool
+}
+
+// oncallNotifier posts messages about captures to a Slack incoming webhook
+// and raises PagerDuty alerts, whichever of the two is configured. Both
+// are configured from the packet-capture-oncall Secret through the
+// environment. It never holds up the captures it reports on.
+type oncallNotifier struct {
+	slackURL     string
+	pagerDutyKey string
+	node         string
+	client       *http.Client
+	queue        chan oncallMessage
+	// pressure is set while the disk pressure alert is open.
+	pressure atomic.Bool
+}
+
+// newOncallNotifier returns the notifier of the configured channels, or nil
+// if there are none.
+func newOncallNotifier(cfg *Config, node string) *oncallNotifier {
+	if cfg.SlackWebhookURL == "" && cfg.PagerDutyRoutingKey == "" {
+		return nil
+	}
+	n := &oncallNotifier{
+		slackURL:     cfg.SlackWebhookURL,
+		pagerDutyKey: cfg.PagerDutyRoutingKey,
+		node:         node,
+		client:       &http.Client{Timeout: notifyTimeout},
+		queue:        make(chan oncallMessage, notifyQueue),
+	}
+	go n.run()
+	return n
+}
+
+// captureStarted posts that a capture started.
+func (n *oncallNotifier) captureStarted(spec captureSpec, backend string) {
+	if n == nil {
+		return
+	}
+	text := fmt.Sprintf("%s started with %s", n.describe(spec), backend)
+	if spec.Requester != "" {
+		text += ", requested by " + spec.Requester
+	}
+	n.send(oncallMessage{text: text})
+}
+
+// captureCrashLooping alerts that a capture exited restarts times in a row.
+func (n *oncallNotifier) captureCrashLooping(spec captureSpec, restarts int) {
+	if n == nil {
+		return
+	}
+	n.send(oncallMessage{
+		text:     fmt.Sprintf("%s has exited %d times in a row and keeps being restarted", n.describe(spec), restarts),
+		dedupKey: "packet-capture/" + n.node + "/crash-loop/" + spec.SessionID,
+		severity: pagerDutyWarning,
+	})
+}
+
+// diskPressure alerts once when the capture disk crosses the pressure
+// threshold and resolves the alert once it is back below.
+func (n *oncallNotifier) diskPressure(util float64, threshold int) {
+	if n == nil {
+		return
+	}
+	above := util >= float64(threshold)
+	if n.pressure.Swap(above) == above {
+		return
+	}
+	msg := oncallMessage{dedupKey: "packet-capture/" + n.node + "/disk-pressure", severity: pagerDutyCritical, resolve: !above}
+	if above {
+		msg.text = fmt.Sprintf("Capture disk on node %s is %d%% full, above the pressure threshold of %d%%; completed captures are being evicted", n.node, int(util), threshold)
+	} else {
+		msg.text = fmt.Sprintf("Capture disk on node %s is back below the pressure threshold of %d%% at %d%%", n.node, threshold, int(util))
+	}
+	n.send(msg)
+}
+
+// describe names the capture of spec in messages.
+func (n *oncallNotifier) describe(spec captureSpec) string {
+	s := fmt.Sprintf("Capture of Pod %s/%s on node %s", spec.Namespace, spec.PodName, n.node)
+	if spec.PodName == "" {
+		s = "Node capture on " + n.node
+	}
+	if spec.Session != "" {
+		s += ", session " + spec.Session
+	}
+	return s
+}
+
+func (n *oncallNotifier) send(msg oncallMessage) {
+	select {
+	case n.queue <- msg:
+	default:
+		oncallFailures.Inc()
+		slog.Warn("On-call queue full, dropping message", "message", msg.text)
+	}
+}
+
+func (n *oncallNotifier) run() {
+	for msg := range n.queue {
+		if n.slackURL != "" {
+			n.deliver("Slack", n.slackURL, map[string]string{"text": msg.text})
+		}
+		if n.pagerDutyKey != "" && msg.dedupKey != "" {
+			event := map[string]any{
+				"routing_key":  n.pagerDutyKey,
+				"event_action": pagerDutyTrigger,
+				"dedup_key":    msg.dedupKey,
+			}
+			if msg.resolve {
+				event["event_action"] = pagerDutyResolve
+			} else {
+				event["payload"] = map[string]any{
+					"summary":   msg.text,
+					"source":    n.node,
+					"severity":  msg.severity,
+					"component": "packet-capture",
+				}
+			}
+			n.deliver("PagerDuty", pagerDutyEventsURL, event)
+		}
+	}
+}
+
+// deliver posts body as JSON to url, retrying like capture notifications.
+func (n *oncallNotifier) deliver(channel, url string, body any) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return
+	}
+	backoff := time.Second
+	for attempt := 1; ; attempt++ {
+		if err = n.post(url, data); err == nil {
+			return
+		}
+		if attempt == notifyAttempts {
+			oncallFailures.Inc()
+			slog.Warn("Cannot post on-call message", "channel", channel, "err", err)
+			return
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (n *oncallNotifier) post(url string, data []byte) error {
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		// The Slack webhook URL is a secret, keep it out of the logs.
+		var uerr *neturl.Error
+		if errors.As(err, &uerr) {
+			return uerr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("got %s", resp.Status)
+	}
+	return nil
+}
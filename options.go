@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Per-capture option annotations, set next to tcpdump.antrea.io on the Pod or
+// its Namespace.
+const (
+	compressAnnotationKey  = "compress." + annotationKey
+	anonymizeAnnotationKey = "anonymize." + annotationKey
+	modeAnnotationKey      = "mode." + annotationKey
+	sampleAnnotationKey    = "sample." + annotationKey
+	countAnnotationKey     = "count." + annotationKey
+	outputAnnotationKey    = "output." + annotationKey
+	interfaceAnnotationKey = "interface." + annotationKey
+)
+
+// Capture modes.
+const (
+	captureModeFull    = "full"
+	captureModeHeaders = "headers"
+)
+
+// Capture outputs.
+const (
+	outputFile   = "file"
+	outputStream = "stream"
+	outputBoth   = "both"
+)
+
+// writesFiles reports whether the capture writes packets to disk, as
+// opposed to only streaming, exporting or mirroring them.
+func (s captureSpec) writesFiles() bool {
+	return s.Output != outputStream && s.Output != outputIPFIX && s.Output != outputMirror
+}
+
+// headersSnaplen keeps Ethernet, IP options and TCP options in headers mode
+// while dropping the payload of almost every packet.
+const headersSnaplen = 96
+
+// applyPodOptions sets the per-capture options requested through the option
+// annotations of the Pod, or of its Namespace for Namespace-wide captures,
+// on spec.
+func applyPodOptions(annotations map[string]string, spec *captureSpec) error {
+	if v, ok := annotations[compressAnnotationKey]; ok {
+		c := compression(strings.TrimSpace(v))
+		switch c {
+		case compressNone, compressGzip, compressZstd:
+			spec.Compress = c
+		default:
+			return fmt.Errorf("unknown compression %q in %s annotation", v, compressAnnotationKey)
+		}
+	}
+	if v, ok := annotations[modeAnnotationKey]; ok {
+		switch mode := strings.TrimSpace(v); mode {
+		case captureModeFull:
+			spec.Mode, spec.Snaplen = mode, 0
+		case captureModeHeaders:
+			spec.Mode, spec.Snaplen = mode, headersSnaplen
+		default:
+			return fmt.Errorf("unknown capture mode %q in %s annotation", v, modeAnnotationKey)
+		}
+	}
+	if v, ok := annotations[sampleAnnotationKey]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s annotation must be a positive integer, got %q", sampleAnnotationKey, v)
+		}
+		spec.SampleRate = n
+	}
+	if v, ok := annotations[countAnnotationKey]; ok {
+		n, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%s annotation must be a positive packet count, got %q", countAnnotationKey, v)
+		}
+		spec.PacketCount = n
+	}
+	if v, ok := annotations[dropsAnnotationKey]; ok {
+		action, err := parseDrops(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, dropsAnnotationKey)
+		}
+		spec.Drops = action
+	}
+	if v, ok := annotations[directionAnnotationKey]; ok {
+		dir, err := parseDirection(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, directionAnnotationKey)
+		}
+		spec.Direction = dir
+	}
+	// The node scope decides whether the capture is requested at all;
+	// it is only checked here.
+	if _, err := parseNodeScope(annotations); err != nil {
+		return err
+	}
+	if v, ok := annotations[budgetAnnotationKey]; ok {
+		b, err := parseBudget(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, budgetAnnotationKey)
+		}
+		spec.Budget = b
+	}
+	if v, ok := annotations[stopOnAnnotationKey]; ok {
+		c, err := parseStopOn(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, stopOnAnnotationKey)
+		}
+		spec.StopOn = c
+	}
+	if v, ok := annotations[ringBufferAnnotationKey]; ok {
+		mb, every, err := parseRingBuffer(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, ringBufferAnnotationKey)
+		}
+		if mb > 0 {
+			spec.RotateMB = mb
+		}
+		spec.RotateEvery = every
+	}
+	if v, ok := annotations[autostopAnnotationKey]; ok {
+		after, files, err := parseAutostop(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, autostopAnnotationKey)
+		}
+		spec.StopAfter, spec.StopFiles = after, files
+	}
+	if v, ok := annotations[outputAnnotationKey]; ok {
+		switch output := strings.TrimSpace(v); output {
+		case outputFile, outputStream, outputBoth, outputIPFIX, outputMirror:
+			spec.Output = output
+		default:
+			return fmt.Errorf("unknown output %q in %s annotation", v, outputAnnotationKey)
+		}
+	}
+	if v, ok := annotations[mirrorAnnotationKey]; ok {
+		mirror, err := parseMirror(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, mirrorAnnotationKey)
+		}
+		spec.Mirror = mirror
+	}
+	switch {
+	case spec.Output == outputMirror && spec.Mirror == nil:
+		return fmt.Errorf("the %s output needs the %s annotation", outputMirror, mirrorAnnotationKey)
+	case spec.Output != outputMirror && spec.Mirror != nil:
+		return fmt.Errorf("the %s annotation needs the %s output", mirrorAnnotationKey, outputMirror)
+	}
+	if v, ok := annotations[metadataAnnotationKey]; ok {
+		kind, err := parseMetadata(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, metadataAnnotationKey)
+		}
+		spec.Metadata = kind
+	}
+	if v, ok := annotations[filterAnnotationKey]; ok {
+		filter, err := presetFilter(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, filterAnnotationKey)
+		}
+		spec.addFilter(filter)
+	}
+	if v, ok := annotations[addressesAnnotationKey]; ok {
+		prefixes, err := parseAddresses(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, addressesAnnotationKey)
+		}
+		spec.Addresses = prefixes
+		spec.addFilter(addressFilter(prefixes))
+	}
+	if v, ok := annotations[tunnelAnnotationKey]; ok {
+		switch tunnel := strings.TrimSpace(v); tunnel {
+		case tunnelGeneve, tunnelVXLAN:
+			spec.Tunnel = tunnel
+		default:
+			return fmt.Errorf("unknown tunnel %q in %s annotation", v, tunnelAnnotationKey)
+		}
+	}
+	if v, ok := annotations[interfaceAnnotationKey]; ok {
+		ifaces, err := parseInterfaces(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, interfaceAnnotationKey)
+		}
+		if len(ifaces) == 1 {
+			spec.Interface = ifaces[0]
+		} else {
+			spec.Interfaces = ifaces
+		}
+	}
+	if v, ok := annotations[decodeAnnotationKey]; ok {
+		d, err := parseDecode(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, decodeAnnotationKey)
+		}
+		spec.Decode = d
+	}
+	if v, ok := annotations[writeRateAnnotationKey]; ok {
+		mb, err := parseWriteRate(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, writeRateAnnotationKey)
+		}
+		spec.WriteRateMB = mb
+	}
+	if v, ok := annotations[priorityAnnotationKey]; ok {
+		p, err := parsePriority(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, priorityAnnotationKey)
+		}
+		spec.Priority = p
+	}
+	if v, ok := annotations[dryRunAnnotationKey]; ok {
+		dryRun, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return fmt.Errorf("dry run must be true or false, got %q in %s annotation", v, dryRunAnnotationKey)
+		}
+		spec.DryRun = dryRun
+	}
+	if v, ok := annotations[bundleAnnotationKey]; ok {
+		format, err := parseBundle(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, bundleAnnotationKey)
+		}
+		spec.Bundle = format
+	}
+	if v, ok := annotations[storageAnnotationKey]; ok {
+		spec.Storage = strings.TrimSpace(v)
+	}
+	if v, ok := annotations[anonymizeAnnotationKey]; ok {
+		a, err := parseAnonymization(v)
+		if err != nil {
+			return fmt.Errorf("%v in %s annotation", err, anonymizeAnnotationKey)
+		}
+		spec.Anonymize = a
+	}
+	return nil
+}
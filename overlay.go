@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// tunnelAnnotationKey names the encapsulation of the overlay, so captures
+// on the node's uplink can match the Pod inside tunnel packets.
+const tunnelAnnotationKey = "tunnel." + annotationKey
+
+// Overlay encapsulations.
+const (
+	tunnelGeneve = "geneve"
+	tunnelVXLAN  = "vxlan"
+)
+
+const vxlanPort = 4789
+
+// Offsets from the start of the UDP header of a VXLAN packet: the UDP and
+// VXLAN headers take 8 bytes each, followed by the inner Ethernet header.
+const (
+	vxlanInnerEtherType = 8 + 8 + 12
+	vxlanInnerIP        = 8 + 8 + 14
+)
+
+// overlayFilter extends filter, which already scopes the capture to the
+// Pod, to the same traffic encapsulated by the overlay. hosts are the IP
+// groups of the scope as for hostsFilter.
+//
+// libpcap's geneve primitive makes everything after it match the inner
+// packet, so the whole filter is repeated behind it. libpcap has no VXLAN
+// primitive; the inner IPs are matched by offset instead, and only them.
+// The encapsulated part must come last in the expression, since primitives
+// following geneve would otherwise match the inner packet as well.
+func overlayFilter(tunnel, filter string, hosts [][]string) (string, error) {
+	switch tunnel {
+	case tunnelGeneve:
+		return fmt.Sprintf("(%s) or (geneve and (%s))", filter, filter), nil
+	case tunnelVXLAN:
+		var groups []string
+		for _, ips := range hosts {
+			var terms []string
+			for _, ip := range ips {
+				term, err := vxlanHost(ip)
+				if err != nil {
+					return "", err
+				}
+				terms = append(terms, term)
+			}
+			groups = append(groups, "("+strings.Join(terms, " or ")+")")
+		}
+		return fmt.Sprintf("(%s) or (udp port %d and %s)", filter, vxlanPort, strings.Join(groups, " and ")), nil
+	}
+	return "", fmt.Errorf("unknown tunnel %q", tunnel)
+}
+
+// vxlanHost matches VXLAN packets whose inner packet is from or to ip.
+func vxlanHost(s string) (string, error) {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		addr := binary.BigEndian.Uint32(v4)
+		return fmt.Sprintf("(udp[%d:2] = 0x0800 and (udp[%d:4] = 0x%08x or udp[%d:4] = 0x%08x))",
+			vxlanInnerEtherType, vxlanInnerIP+12, addr, vxlanInnerIP+16, addr), nil
+	}
+	// An IPv6 address is compared as four words, at the source address
+	// (offset 8) and at the destination address (offset 24).
+	words := func(off int) string {
+		var w []string
+		for i := 0; i < 4; i++ {
+			w = append(w, fmt.Sprintf("udp[%d:4] = 0x%08x", vxlanInnerIP+off+4*i, binary.BigEndian.Uint32(ip[4*i:])))
+		}
+		return "(" + strings.Join(w, " and ") + ")"
+	}
+	return fmt.Sprintf("(udp[%d:2] = 0x86dd and (%s or %s))", vxlanInnerEtherType, words(8), words(24)), nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ovsTimeout bounds every ovs-vsctl call.
+const ovsTimeout = 10 * time.Second
+
+// ovsBackend captures what traverses the Antrea datapath for a Pod. It
+// mirrors the Pod's port on the OVS bridge to an internal port created for
+// the capture and runs tcpdump on that port, so traffic OVS forwards without
+// it ever reaching the host stack is captured as well. The mirror and port
+// are removed when the capture ends.
+type ovsBackend struct {
+	vsctl   string
+	db      string
+	bridge  string
+	tcpdump *tcpdumpBackend
+}
+
+func (b *ovsBackend) Name() string { return backendOVS }
+
+// Check verifies that ovs-vsctl and tcpdump are installed and that the
+// bridge exists in the OVS database.
+func (b *ovsBackend) Check() error {
+	if err := b.tcpdump.Check(); err != nil {
+		return err
+	}
+	return b.run("br-exists", b.bridge)
+}
+
+// CheckFilter compiles the filter with tcpdump. The capture port only
+// exists once the capture starts, so it is compiled for the loopback
+// interface, which is Ethernet like the port.
+func (b *ovsBackend) CheckFilter(spec captureSpec) error {
+	spec.Interface = "lo"
+	return b.tcpdump.CheckFilter(spec)
+}
+
+func (b *ovsBackend) Start(ctx context.Context, spec captureSpec) (runningCapture, error) {
+	if spec.PodUID == "" {
+		return nil, errors.New("the ovs-mirror backend needs a Pod to mirror")
+	}
+	ifi, err := podHostInterface(spec.PodUID)
+	if err != nil {
+		return nil, fmt.Errorf("cannot find the pod's interface: %w", err)
+	}
+	port, mirror := ovsMirrorNames(spec.PodUID)
+	// A mirror left by a crashed agent would make the commands below fail.
+	b.teardown(port, mirror)
+	if err := b.setup(ifi.Name, port, mirror, spec.Direction); err != nil {
+		b.teardown(port, mirror)
+		return nil, err
+	}
+	// The mirror only selects the direction; the capture port sees all of
+	// what it mirrors.
+	s := spec
+	s.Interface, s.Direction = port, ""
+	p, err := b.tcpdump.Start(ctx, s)
+	if err != nil {
+		b.teardown(port, mirror)
+		return nil, err
+	}
+	return &ovsCapture{runningCapture: p, teardown: func() { b.teardown(port, mirror) }}, nil
+}
+
+// setup creates the internal capture port and the mirror of the Pod's port
+// to it, and brings the capture port up. The mirror selects the packets the
+// Pod receives, sends or both, for direction.
+func (b *ovsBackend) setup(podPort, port, mirror, direction string) error {
+	if err := b.run("add-port", b.bridge, port, "--", "set", "interface", port, "type=internal"); err != nil {
+		return fmt.Errorf("cannot create OVS capture port: %w", err)
+	}
+	// Packets the Pod sends enter the bridge from its port, and the ones it
+	// receives leave the bridge to it.
+	var selects []string
+	switch direction {
+	case directionIngress:
+		selects = []string{"select-dst-port=@p"}
+	case directionEgress:
+		selects = []string{"select-src-port=@p"}
+	default:
+		selects = []string{"select-src-port=@p", "select-dst-port=@p"}
+	}
+	args := []string{
+		"--", "--id=@p", "get", "port", podPort,
+		"--", "--id=@out", "get", "port", port,
+		"--", "--id=@m", "create", "mirror", "name=" + mirror,
+	}
+	args = append(args, selects...)
+	args = append(args, "output-port=@out", "--", "add", "bridge", b.bridge, "mirrors", "@m")
+	err := b.run(args...)
+	if err != nil {
+		return fmt.Errorf("cannot mirror OVS port %s: %w", podPort, err)
+	}
+	if err := setLinkUp(port); err != nil {
+		return fmt.Errorf("cannot bring up %s: %w", port, err)
+	}
+	return nil
+}
+
+// teardown removes the mirror and the capture port, ignoring the ones that
+// do not exist.
+func (b *ovsBackend) teardown(port, mirror string) {
+	// "clear" cannot remove a single mirror, so the mirror is looked up by
+	// name and removed from the bridge, which deletes it.
+	if out, err := b.output("--bare", "--columns=_uuid", "find", "mirror", "name="+mirror); err == nil {
+		for _, uuid := range strings.Fields(out) {
+			if err := b.run("remove", "bridge", b.bridge, "mirrors", uuid); err != nil {
+				slog.Warn("Failed to remove OVS mirror", "mirror", mirror, "err", err)
+			}
+		}
+	}
+	if err := b.run("--if-exists", "del-port", b.bridge, port); err != nil {
+		slog.Warn("Failed to remove OVS capture port", "port", port, "err", err)
+	}
+}
+
+func (b *ovsBackend) run(args ...string) error {
+	_, err := b.output(args...)
+	return err
+}
+
+func (b *ovsBackend) output(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), ovsTimeout)
+	defer cancel()
+	args = append([]string{"--db=" + b.db, fmt.Sprintf("--timeout=%d", int(ovsTimeout.Seconds()))}, args...)
+	out, err := exec.CommandContext(ctx, b.vsctl, args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("ovs-vsctl: %s", strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("ovs-vsctl: %w", err)
+	}
+	return string(out), nil
+}
+
+// ovsMirrorNames derives the capture port and mirror names from the Pod
+// UID. Interface names are limited to 15 bytes, so the port gets a hash.
+func ovsMirrorNames(podUID string) (port, mirror string) {
+	sum := sha256.Sum256([]byte(podUID))
+	return "pcap" + hex.EncodeToString(sum[:4]), "pcap-" + podUID
+}
+
+// setLinkUp sets the IFF_UP flag of an interface.
+func setLinkUp(name string) error {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlIfreq(fd, unix.SIOCGIFFLAGS, ifr); err != nil {
+		return err
+	}
+	ifr.SetUint16(ifr.Uint16() | unix.IFF_UP)
+	return unix.IoctlIfreq(fd, unix.SIOCSIFFLAGS, ifr)
+}
+
+// ovsCapture removes the mirror once tcpdump has exited.
+type ovsCapture struct {
+	runningCapture
+	teardown func()
+}
+
+func (c *ovsCapture) Wait() error {
+	err := c.runningCapture.Wait()
+	c.teardown()
+	return err
+}
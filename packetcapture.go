@@ -0,0 +1,682 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// packetCaptureResource is Antrea's cluster-scoped PacketCapture resource,
+// which antctl packetcapture creates.
+var packetCaptureResource = schema.GroupVersionResource{Group: "crd.antrea.io", Version: "v1alpha1", Resource: "packetcaptures"}
+
+// defaultPacketCaptureTimeout is Antrea's timeout of PacketCaptures that set
+// none.
+const defaultPacketCaptureTimeout = 60 * time.Second
+
+// packetCaptureFileMB bounds the single file of a PacketCapture. Its file is
+// sized for firstN packets of packetCaptureMaxPacket bytes, and a capture
+// that fills it completes instead of rotating over its first packets.
+const (
+	packetCaptureFileMB    = 256
+	packetCaptureMaxPacket = 64 * 1024
+)
+
+// The Secret holding the username and password of the file servers of
+// PacketCaptures, as Antrea reads it.
+const (
+	packetCaptureAuthNamespace = "kube-system"
+	packetCaptureAuthSecret    = "antrea-packetcapture-fileserver-auth"
+)
+
+// Conditions of a PacketCapture, as Antrea sets them.
+const (
+	packetCaptureStarted      = "PacketCaptureStarted"
+	packetCaptureComplete     = "PacketCaptureComplete"
+	packetCaptureFileUploaded = "PacketCaptureFileUploaded"
+)
+
+// Directions of a PacketCapture.
+const (
+	pcSourceToDestination = "SourceToDestination"
+	pcDestinationToSource = "DestinationToSource"
+	pcBoth                = "Both"
+)
+
+// icmpTypeName matches the ICMP type names of BPF, like icmp-echo.
+var icmpTypeName = regexp.MustCompile(`^icmp-[a-z]+$`)
+
+// packetCapture holds the fields of an Antrea PacketCapture the agent uses.
+type packetCapture struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              packetCaptureSpec   `json:"spec"`
+	Status            packetCaptureStatus `json:"status,omitempty"`
+}
+
+type packetCaptureSpec struct {
+	// Timeout is in seconds.
+	Timeout       *int32                   `json:"timeout,omitempty"`
+	CaptureConfig packetCaptureConfig      `json:"captureConfig"`
+	Source        packetCaptureEndpoint    `json:"source"`
+	Destination   packetCaptureEndpoint    `json:"destination"`
+	Packet        *packetCapturePacket     `json:"packet,omitempty"`
+	Direction     string                   `json:"direction,omitempty"`
+	FileServer    *packetCaptureFileServer `json:"fileServer,omitempty"`
+}
+
+type packetCaptureConfig struct {
+	FirstN *struct {
+		Number int32 `json:"number"`
+	} `json:"firstN,omitempty"`
+}
+
+// packetCaptureEndpoint is a Pod or an IP.
+type packetCaptureEndpoint struct {
+	Pod *struct {
+		Namespace string `json:"namespace"`
+		Name      string `json:"name"`
+	} `json:"pod,omitempty"`
+	IP *string `json:"ip,omitempty"`
+}
+
+type packetCapturePacket struct {
+	IPFamily        string              `json:"ipFamily,omitempty"`
+	Protocol        *intstr.IntOrString `json:"protocol,omitempty"`
+	TransportHeader struct {
+		UDP *packetCapturePorts `json:"udp,omitempty"`
+		TCP *struct {
+			packetCapturePorts `json:",inline"`
+			Flags              []struct {
+				Value int32  `json:"value"`
+				Mask  *int32 `json:"mask,omitempty"`
+			} `json:"flags,omitempty"`
+		} `json:"tcp,omitempty"`
+		ICMP *struct {
+			Messages []struct {
+				Type intstr.IntOrString `json:"type"`
+				Code *int32             `json:"code,omitempty"`
+			} `json:"messages,omitempty"`
+		} `json:"icmp,omitempty"`
+	} `json:"transportHeader"`
+}
+
+type packetCapturePorts struct {
+	SrcPort *int32 `json:"srcPort,omitempty"`
+	DstPort *int32 `json:"dstPort,omitempty"`
+}
+
+type packetCaptureFileServer struct {
+	// URL is sftp://<host>[:<port>]/<directory>.
+	URL string `json:"url"`
+	// HostPublicKey is the server's host key in the SSH wire format.
+	HostPublicKey []byte `json:"hostPublicKey,omitempty"`
+}
+
+type packetCaptureStatus struct {
+	NumberCaptured int32              `json:"numberCaptured,omitempty"`
+	FilePath       string             `json:"filePath,omitempty"`
+	Conditions     []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// timeout returns how long the PacketCapture captures at most.
+func (p *packetCapture) timeout() time.Duration {
+	if p.Spec.Timeout != nil && *p.Spec.Timeout > 0 {
+		return time.Duration(*p.Spec.Timeout) * time.Second
+	}
+	return defaultPacketCaptureTimeout
+}
+
+// pod returns the key of the Pod the PacketCapture is captured on, like
+// Antrea does: its source Pod, or else its destination Pod.
+func (p *packetCapture) pod() string {
+	for _, ep := range []packetCaptureEndpoint{p.Spec.Source, p.Spec.Destination} {
+		if ep.Pod != nil && ep.Pod.Namespace != "" && ep.Pod.Name != "" {
+			return ep.Pod.Namespace + "/" + ep.Pod.Name
+		}
+	}
+	return ""
+}
+
+// done reports whether the PacketCapture completed or failed, which ends
+// its capture for good.
+func (p *packetCapture) done() bool {
+	return meta.FindStatusCondition(p.Status.Conditions, packetCaptureComplete) != nil
+}
+
+// annotations returns the capture and option annotations equivalent to the
+// PacketCapture: a single file of its first packets, for its timeout at
+// most. The file is never rotated, which would truncate it.
+func (p *packetCapture) annotations() map[string]string {
+	mb := packetCaptureFileMB
+	a := map[string]string{
+		annotationKey:         "1",
+		autostopAnnotationKey: "duration=" + p.timeout().String() + ",files=1",
+	}
+	if n := p.Spec.CaptureConfig.FirstN; n != nil && n.Number > 0 {
+		a[countAnnotationKey] = strconv.Itoa(int(n.Number))
+		mb = min(int((int64(n.Number)*packetCaptureMaxPacket+bytesPerMB-1)/bytesPerMB), mb)
+	}
+	a[ringBufferAnnotationKey] = "filesize=" + strconv.Itoa(mb)
+	return a
+}
+
+// filter returns the BPF filter of the PacketCapture, given the IPs of its
+// source and destination; either may be empty if the endpoint is not set.
+// Only the IPs of the PacketCapture's family are used.
+func (p *packetCapture) filter(src, dst []string) (string, error) {
+	packet := p.Spec.Packet
+	if packet == nil {
+		packet = &packetCapturePacket{}
+	}
+	var v6 bool
+	switch packet.IPFamily {
+	case "", "IPv4":
+	case "IPv6":
+		v6 = true
+	default:
+		return "", fmt.Errorf("unknown IP family %q", packet.IPFamily)
+	}
+	family := func(ips []string) []string {
+		return slices.DeleteFunc(slices.Clone(ips), func(ip string) bool {
+			parsed := net.ParseIP(ip)
+			return parsed == nil || (parsed.To4() == nil) != v6
+		})
+	}
+	srcIPs, dstIPs := family(src), family(dst)
+	if len(src) > 0 && len(srcIPs) == 0 || len(dst) > 0 && len(dstIPs) == 0 {
+		return "", fmt.Errorf("the source or destination has no %s address", byFamily(v6, "IPv6", "IPv4"))
+	}
+
+	var terms []string
+	if packet.Protocol != nil {
+		proto, err := protocolFilter(*packet.Protocol, v6)
+		if err != nil {
+			return "", err
+		}
+		terms = append(terms, proto)
+	}
+	var ports packetCapturePorts
+	if h := packet.TransportHeader.TCP; h != nil {
+		ports = h.packetCapturePorts
+	} else if h := packet.TransportHeader.UDP; h != nil {
+		ports = *h
+	}
+	switch p.Spec.Direction {
+	case "", pcSourceToDestination:
+		terms = append(terms, flowFilter(srcIPs, dstIPs, ports.SrcPort, ports.DstPort)...)
+	case pcDestinationToSource:
+		terms = append(terms, flowFilter(dstIPs, srcIPs, ports.DstPort, ports.SrcPort)...)
+	case pcBoth:
+		there := flowFilter(srcIPs, dstIPs, ports.SrcPort, ports.DstPort)
+		back := flowFilter(dstIPs, srcIPs, ports.DstPort, ports.SrcPort)
+		if len(there) > 0 {
+			terms = append(terms, "(("+strings.Join(there, " and ")+") or ("+strings.Join(back, " and ")+"))")
+		}
+	default:
+		return "", fmt.Errorf("unknown direction %q", p.Spec.Direction)
+	}
+
+	if h := packet.TransportHeader.TCP; h != nil && len(h.Flags) > 0 {
+		if v6 {
+			return "", errors.New("TCP flags are only matched in IPv4 packets")
+		}
+		var flags []string
+		for _, f := range h.Flags {
+			mask := f.Value
+			if f.Mask != nil {
+				mask = *f.Mask
+			}
+			flags = append(flags, fmt.Sprintf("tcp[tcpflags] & %d == %d", mask, f.Value))
+		}
+		terms = append(terms, anyOf(flags))
+	}
+	if h := packet.TransportHeader.ICMP; h != nil && len(h.Messages) > 0 {
+		if v6 {
+			return "", errors.New("ICMP messages are only matched in IPv4 packets")
+		}
+		var messages []string
+		for _, msg := range h.Messages {
+			typ := msg.Type.String()
+			if msg.Type.Type == intstr.String && !icmpTypeName.MatchString(typ) {
+				return "", fmt.Errorf("unknown ICMP type %q", typ)
+			}
+			m := "icmp[icmptype] == " + typ
+			if msg.Code != nil {
+				m = fmt.Sprintf("(%s and icmp[icmpcode] == %d)", m, *msg.Code)
+			}
+			messages = append(messages, m)
+		}
+		terms = append(terms, anyOf(messages))
+	}
+	return strings.Join(terms, " and "), nil
+}
+
+// protocolFilter returns the BPF primitive of a PacketCapture's protocol, a
+// name or a number.
+func protocolFilter(proto intstr.IntOrString, v6 bool) (string, error) {
+	if proto.Type == intstr.Int {
+		if proto.IntVal < 0 || proto.IntVal > 255 {
+			return "", fmt.Errorf("protocol %d is out of range", proto.IntVal)
+		}
+		return fmt.Sprintf("%s proto %d", byFamily(v6, "ip6", "ip"), proto.IntVal), nil
+	}
+	switch strings.ToUpper(proto.StrVal) {
+	case "TCP":
+		return "tcp", nil
+	case "UDP":
+		return "udp", nil
+	case "SCTP":
+		return "sctp", nil
+	case "ICMP":
+		return byFamily(v6, "icmp6", "icmp"), nil
+	}
+	return "", fmt.Errorf("unknown protocol %q", proto.StrVal)
+}
+
+// flowFilter returns the BPF terms of the packets from one of the IPs from
+// to one of to, with the given ports.
+func flowFilter(from, to []string, fromPort, toPort *int32) []string {
+	var terms []string
+	for _, end := range []struct {
+		dir  string
+		ips  []string
+		port *int32
+	}{{"src", from, fromPort}, {"dst", to, toPort}} {
+		var hosts []string
+		for _, ip := range end.ips {
+			hosts = append(hosts, end.dir+" host "+ip)
+		}
+		if len(hosts) > 0 {
+			terms = append(terms, anyOf(hosts))
+		}
+		if end.port != nil {
+			terms = append(terms, fmt.Sprintf("%s port %d", end.dir, *end.port))
+		}
+	}
+	return terms
+}
+
+// anyOf joins BPF terms with or.
+func anyOf(terms []string) string {
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// byFamily returns ifV6 for IPv6 and ifV4 for IPv4.
+func byFamily(v6 bool, ifV6, ifV4 string) string {
+	if v6 {
+		return ifV6
+	}
+	return ifV4
+}
+
+// watchPacketCaptures sets up the PacketCapture informer if
+// --antrea-packetcaptures is set and Antrea's CRD is installed, and returns
+// its sync function.
+func (m *CaptureManager) watchPacketCaptures(ctx context.Context) []cache.InformerSynced {
+	if !m.cfg.PacketCaptures {
+		return nil
+	}
+	_, err := m.clientset.Discovery().ServerResourcesForGroupVersion(packetCaptureResource.GroupVersion().String())
+	if err != nil {
+		slog.Info("PacketCapture CRD not installed, Antrea PacketCaptures are not fulfilled", "err", err)
+		return nil
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(m.dynamic, m.cfg.ResyncInterval)
+	informer := factory.ForResource(packetCaptureResource)
+	m.packetCaptureLister = informer.Lister()
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.enqueuePacketCapturePod,
+		UpdateFunc: func(_, obj interface{}) { m.enqueuePacketCapturePod(obj) },
+		DeleteFunc: m.enqueuePacketCapturePod,
+	})
+	factory.Start(ctx.Done())
+	return []cache.InformerSynced{informer.Informer().HasSynced}
+}
+
+// enqueuePacketCapturePod enqueues the Pod a PacketCapture is captured on if
+// it runs on this node.
+func (m *CaptureManager) enqueuePacketCapturePod(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	p, err := toPacketCapture(obj)
+	if err != nil {
+		slog.Error("Invalid PacketCapture", "err", err)
+		return
+	}
+	key := p.pod()
+	if key == "" {
+		return
+	}
+	ns, name, _ := cache.SplitMetaNamespaceKey(key)
+	if _, err := m.podLister.Pods(ns).Get(name); err == nil {
+		m.queue.Add(key)
+	}
+}
+
+// podPacketCapture returns the oldest PacketCapture captured on pod that
+// has not completed or failed.
+func (m *CaptureManager) podPacketCapture(pod *corev1.Pod) *packetCapture {
+	if m.packetCaptureLister == nil {
+		return nil
+	}
+	objs, err := m.packetCaptureLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	key := pod.Namespace + "/" + pod.Name
+	var found []*packetCapture
+	for _, obj := range objs {
+		p, err := toPacketCapture(obj)
+		if err != nil || p.done() || p.pod() != key {
+			continue
+		}
+		found = append(found, p)
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].CreationTimestamp.Equal(&found[j].CreationTimestamp) {
+			return found[i].CreationTimestamp.Before(&found[j].CreationTimestamp)
+		}
+		return found[i].Name < found[j].Name
+	})
+	return found[0]
+}
+
+// sourcePacketCapture returns the PacketCapture a capture is requested
+// through, or nil. Agents of the two-tier deployment do not watch
+// PacketCaptures, so they read the one they were assigned.
+func (m *CaptureManager) sourcePacketCapture(source metav1.Object) (*packetCapture, error) {
+	switch s := source.(type) {
+	case *packetCapture:
+		return s, nil
+	case *captureAssignment:
+		if s.PacketCapture != "" {
+			return m.getPacketCapture(s.PacketCapture)
+		}
+	}
+	return nil, nil
+}
+
+// packetCaptureName returns the name of the PacketCapture a capture is
+// requested through, or "".
+func packetCaptureName(source metav1.Object) string {
+	switch s := source.(type) {
+	case *packetCapture:
+		return s.Name
+	case *captureAssignment:
+		return s.PacketCapture
+	}
+	return ""
+}
+
+func (m *CaptureManager) getPacketCapture(name string) (*packetCapture, error) {
+	if m.packetCaptureLister != nil {
+		obj, err := m.packetCaptureLister.Get(name)
+		if err != nil {
+			return nil, err
+		}
+		return toPacketCapture(obj)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	u, err := m.dynamic.Resource(packetCaptureResource).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return toPacketCapture(u)
+}
+
+// packetCaptureFilter returns the BPF filter of p with the IPs of its
+// endpoints. Its Pods may run on any node, so they are read from the API
+// server.
+func (m *CaptureManager) packetCaptureFilter(p *packetCapture) (string, error) {
+	var ips [2][]string
+	for i, ep := range []packetCaptureEndpoint{p.Spec.Source, p.Spec.Destination} {
+		switch {
+		case ep.Pod != nil:
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			pod, err := m.clientset.CoreV1().Pods(ep.Pod.Namespace).Get(ctx, ep.Pod.Name, metav1.GetOptions{})
+			cancel()
+			if err != nil {
+				return "", fmt.Errorf("cannot look up pod %s/%s: %v", ep.Pod.Namespace, ep.Pod.Name, err)
+			}
+			if ips[i] = podIPs(pod); len(ips[i]) == 0 {
+				return "", fmt.Errorf("pod %s/%s has no IP", ep.Pod.Namespace, ep.Pod.Name)
+			}
+		case ep.IP != nil:
+			if net.ParseIP(*ep.IP) == nil {
+				return "", fmt.Errorf("invalid IP %q", *ep.IP)
+			}
+			ips[i] = []string{*ep.IP}
+		}
+	}
+	return p.filter(ips[0], ips[1])
+}
+
+// updatePacketCapture applies update to the status of the PacketCapture
+// name, and writes it if that changed it. A PacketCapture that was deleted
+// is left alone.
+func (m *CaptureManager) updatePacketCapture(name string, update func(*packetCaptureStatus)) {
+	client := m.dynamic.Resource(packetCaptureResource)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		u, err := client.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		p, err := toPacketCapture(u)
+		if err != nil {
+			return err
+		}
+		st := p.Status
+		st.Conditions = slices.Clone(st.Conditions)
+		update(&st)
+		if equality.Semantic.DeepEqual(st, p.Status) {
+			return nil
+		}
+		status, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&st)
+		if err != nil {
+			return err
+		}
+		u.Object["status"] = status
+		_, err = client.UpdateStatus(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+	if err != nil && !apierrors.IsNotFound(err) {
+		slog.Warn("Failed to update PacketCapture status", "packetcapture", name, "err", err)
+	}
+}
+
+// setPacketCaptureCondition returns an update of updatePacketCapture that
+// sets a condition.
+func setPacketCaptureCondition(typ string, ok bool, reason, msg string) func(*packetCaptureStatus) {
+	return func(st *packetCaptureStatus) {
+		status := metav1.ConditionFalse
+		if ok {
+			status = metav1.ConditionTrue
+		}
+		meta.SetStatusCondition(&st.Conditions, metav1.Condition{Type: typ, Status: status, Reason: reason, Message: msg})
+	}
+}
+
+// failPacketCapture records in the PacketCapture a capture is requested
+// through, if any, that the capture failed.
+func (m *CaptureManager) failPacketCapture(source metav1.Object, msg string) {
+	if name := packetCaptureName(source); name != "" {
+		go m.updatePacketCapture(name, setPacketCaptureCondition(packetCaptureComplete, false, "Failed", msg))
+	}
+}
+
+// finishPacketCapture records in the PacketCapture of the ended capture cap
+// how many packets it captured and where its file is, after uploading the
+// file to the PacketCapture's file server, if it has one. st is the final
+// status of the capture.
+func (m *CaptureManager) finishPacketCapture(cap *CaptureProcess, st captureStatus, state string) {
+	name := cap.spec.PacketCapture
+	var captured int32
+	if st.Packets != nil {
+		captured = int32(st.Packets.Captured)
+	}
+	reason, msg := "Succeed", fmt.Sprintf("captured %d packets on node %s", captured, m.nodeName)
+	switch {
+	case state == stateStopped:
+		reason = "Stopped"
+	case cap.spec.PacketCount == 0 || int(captured) < cap.spec.PacketCount:
+		reason = "Timeout"
+	}
+	file, err := packetCaptureFile(cap)
+	if err != nil {
+		m.updatePacketCapture(name, setPacketCaptureCondition(packetCaptureComplete, false, "Failed", err.Error()))
+		return
+	}
+	filePath := m.nodeName + ":" + file
+	var uploaded func(*packetCaptureStatus)
+	if p, err := m.getPacketCapture(name); err == nil && p.Spec.FileServer != nil {
+		if location, err := m.uploadPacketCapture(p, file); err != nil {
+			cap.log.Warn("Failed to upload PacketCapture file", "packetcapture", name, "err", err)
+			m.recorder.Eventf(cap.ref, corev1.EventTypeWarning, reasonCaptureFailed, "Failed to upload the file of PacketCapture %s: %v", name, err)
+			uploaded = setPacketCaptureCondition(packetCaptureFileUploaded, false, "Failed", err.Error())
+		} else {
+			cap.log.Info("Uploaded PacketCapture file", "packetcapture", name, "location", location)
+			filePath = location
+			uploaded = setPacketCaptureCondition(packetCaptureFileUploaded, true, "Succeed", "uploaded to the file server")
+		}
+	}
+	m.updatePacketCapture(name, func(s *packetCaptureStatus) {
+		s.NumberCaptured, s.FilePath = captured, filePath
+		if uploaded != nil {
+			uploaded(s)
+		}
+		setPacketCaptureCondition(packetCaptureComplete, true, reason, msg)(s)
+	})
+}
+
+// packetCaptureFile returns the path of the first file holding the packets
+// of cap.
+func packetCaptureFile(cap *CaptureProcess) (string, error) {
+	files, _ := captureFiles(cap)
+	for _, f := range files {
+		// Manifests, reports and alerts end in .json too.
+		if packetFiles([]string{f.Name}) == 0 || strings.HasSuffix(f.Name, compressSuffix) {
+			continue
+		}
+		if strings.HasSuffix(f.Name, encryptSuffix) {
+			return "", errors.New("the capture file is encrypted at rest")
+		}
+		return filepath.Join(filepath.Dir(cap.files[0]), f.Name), nil
+	}
+	return "", errors.New("the capture wrote no file")
+}
+
+// uploadPacketCapture uploads file to the file server of p over SFTP, as
+// <name>.pcapng like Antrea, and returns its URL. The server's host key is
+// the PacketCapture's hostPublicKey, or else verified with
+// --export-known-hosts.
+func (m *CaptureManager) uploadPacketCapture(p *packetCapture, file string) (string, error) {
+	u, err := url.Parse(p.Spec.FileServer.URL)
+	if err != nil || u.Scheme != exportSFTP || u.Hostname() == "" {
+		return "", fmt.Errorf("file server URL must be %s://<host>[:<port>]/<path>, got %q", exportSFTP, p.Spec.FileServer.URL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	var hostKey ssh.HostKeyCallback
+	switch {
+	case len(p.Spec.FileServer.HostPublicKey) > 0:
+		key, err := ssh.ParsePublicKey(p.Spec.FileServer.HostPublicKey)
+		if err != nil {
+			return "", fmt.Errorf("invalid host public key: %w", err)
+		}
+		hostKey = ssh.FixedHostKey(key)
+	case m.cfg.ExportKnownHosts != "":
+		if hostKey, err = knownhosts.New(m.cfg.ExportKnownHosts); err != nil {
+			return "", fmt.Errorf("cannot load export known hosts: %w", err)
+		}
+	default:
+		return "", errors.New("the file server has no hostPublicKey and --export-known-hosts is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	secret, err := m.clientset.CoreV1().Secrets(packetCaptureAuthNamespace).Get(ctx, packetCaptureAuthSecret, metav1.GetOptions{})
+	if err != nil {
+		return "", fmt.Errorf("cannot read the file server credentials: %w", err)
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            string(secret.Data["username"]),
+		Auth:            []ssh.AuthMethod{ssh.Password(string(secret.Data["password"]))},
+		HostKeyCallback: hostKey,
+		Timeout:         exportTimeout,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	sc, err := sftp.NewClient(client)
+	if err != nil {
+		return "", fmt.Errorf("cannot start SFTP: %w", err)
+	}
+	defer sc.Close()
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	dir := u.Path
+	if dir == "" {
+		dir = "."
+	}
+	name := p.Name + ".pcapng"
+	if err := sftpUpload(sc, dir, name, f); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(p.Spec.FileServer.URL, "/") + "/" + name, nil
+}
+
+func toPacketCapture(obj interface{}) (*packetCapture, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	var p packetCapture
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// peerAnnotationKey names a second Pod, as <namespace>/<pod>, and limits the
+// capture to the traffic between the two. The agent annotates the peer the
+// same way, so both ends of the conversation are captured on their own nodes.
+const peerAnnotationKey = "peer." + annotationKey
+
+// errPeerRequester refuses to mirror a capture whose requester the
+// admission webhook did not record: the agent patches the peer with its
+// own ServiceAccount, so the capture would be attributed to the agent.
+var errPeerRequester = errors.New("the capture has no requester recorded by the admission webhook to carry over to the peer")
+
+// resolvePeer looks up the peer Pod named by the peer annotation of the
+// capture of session requested through source. The peer may run on any
+// node, so it is read from the API server rather than from the node's Pod
+// cache. The agent requests the peer's end itself, so the peer's namespace
+// must be allowed, for the requester too, like the webhook checks for
+// captures requested directly.
+func (m *CaptureManager) resolvePeer(pod *corev1.Pod, source metav1.Object, session, peer string) (*corev1.Pod, error) {
+	ns, name, ok := strings.Cut(strings.TrimSpace(peer), "/")
+	if !ok || ns == "" || name == "" {
+		return nil, fmt.Errorf("%s annotation must be <namespace>/<pod>, got %q", peerAnnotationKey, peer)
+	}
+	if ns == pod.Namespace && name == pod.Name {
+		return nil, fmt.Errorf("%s annotation names the captured pod itself", peerAnnotationKey)
+	}
+	settings := m.settings()
+	if !settings.namespaceAllowed(ns) {
+		return nil, fmt.Errorf("captures are not allowed in namespace %s of peer pod %s", ns, name)
+	}
+	if err := settings.authorizeRequest(source, session, ns); err != nil {
+		return nil, fmt.Errorf("cannot capture peer pod %s/%s: %w", ns, name, err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p, err := m.clientset.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("cannot look up peer pod %s/%s: %v", ns, name, err)
+	}
+	if p.Status.Phase != corev1.PodRunning || len(podIPs(p)) == 0 {
+		return nil, fmt.Errorf("peer pod %s/%s is not running", ns, name)
+	}
+	return p, nil
+}
+
+// hostsFilter returns a BPF expression that matches packets from or to one
+// of the IPs of every group, e.g. the traffic between two Pods in both
+// directions for one group per Pod.
+func hostsFilter(hosts [][]string) string {
+	var groups []string
+	for _, ips := range hosts {
+		terms := make([]string, len(ips))
+		for i, ip := range ips {
+			terms[i] = "host " + ip
+		}
+		if len(terms) == 1 {
+			groups = append(groups, terms[0])
+		} else {
+			groups = append(groups, "("+strings.Join(terms, " or ")+")")
+		}
+	}
+	return strings.Join(groups, " and ")
+}
+
+func podIPs(pod *corev1.Pod) []string {
+	var ips []string
+	for _, ip := range pod.Status.PodIPs {
+		ips = append(ips, ip.IP)
+	}
+	if len(ips) == 0 && pod.Status.PodIP != "" {
+		ips = append(ips, pod.Status.PodIP)
+	}
+	return ips
+}
+
+// mirrorPeer requests the same capture on the peer, pointing back at pod, so
+// the agent on the peer's node captures the other end. A peer that already
+// has its own capture annotation is left alone. The container option names
+// a container of pod, and the node scope its node, so they are not passed
+// on. The peer's capture joins the trace of pod's, and carries the
+// requester the webhook recorded for the capture of session requested
+// through source; without one the peer is not captured.
+func (m *CaptureManager) mirrorPeer(pod, peer *corev1.Pod, source metav1.Object, session string, annotations map[string]string, trace *captureTrace) error {
+	if m.cfg.Role == roleAgent {
+		// The cluster controller assigns the peer its end.
+		return nil
+	}
+	if _, ok := peer.Annotations[annotationKey]; ok {
+		return nil
+	}
+	requester := requesterAnnotations(source, session)
+	if requester == nil {
+		return errPeerRequester
+	}
+	patch := map[string]interface{}{
+		annotationKey:                annotations[annotationKey],
+		peerAnnotationKey:            pod.Namespace + "/" + pod.Name,
+		requesterAnnotationKey:       requester[requesterAnnotationKey],
+		requesterGroupsAnnotationKey: requester[requesterGroupsAnnotationKey],
+	}
+	for _, key := range podOptions {
+		if val, ok := annotations[key]; ok && key != peerAnnotationKey && key != containerAnnotationKey &&
+			key != nodesAnnotationKey && key != nodeSelectorAnnotationKey {
+			patch[key] = val
+		}
+	}
+	if tp := trace.traceparent(); tp != "" {
+		patch[traceparentAnnotationKey] = tp
+	}
+	return m.patchAnnotations(peer, patch)
+}
+
+// releasePeer removes the capture that mirrorPeer requested on the peer of
+// cap, so stopping either end of a pair stops both. The peer is looked up
+// and patched in the background, outside m.mu.
+func (m *CaptureManager) releasePeer(cap *CaptureProcess) {
+	if cap.spec.Peer == "" || m.cfg.Role == roleAgent {
+		return
+	}
+	go m.unmirrorPeer(cap)
+}
+
+func (m *CaptureManager) unmirrorPeer(cap *CaptureProcess) {
+	ns, name, _ := strings.Cut(cap.spec.Peer, "/")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	peer, err := m.clientset.CoreV1().Pods(ns).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return
+	}
+	if _, ok := peer.Annotations[annotationKey]; !ok || peer.Annotations[peerAnnotationKey] != cap.spec.Namespace+"/"+cap.spec.PodName {
+		return
+	}
+	patch := map[string]interface{}{annotationKey: nil, requesterAnnotationKey: nil, requesterGroupsAnnotationKey: nil}
+	for _, key := range podOptions {
+		patch[key] = nil
+	}
+	if err := m.patchAnnotations(peer, patch); err != nil {
+		cap.log.Warn("Failed to stop the capture of the peer pod", "peer", cap.spec.Peer, "err", err)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// addPeer adds a running Pod on another node to the clientset only, as
+// agents see the peers of pair captures.
+func (tm *testManager) addPeer(ns, name string) *corev1.Pod {
+	tm.t.Helper()
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Namespace: ns, Name: name},
+		Spec:       corev1.PodSpec{NodeName: "node-2"},
+		Status:     corev1.PodStatus{Phase: corev1.PodRunning, PodIP: "10.0.1.20"},
+	}
+	if _, err := tm.clientset.CoreV1().Pods(ns).Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		tm.t.Fatalf("create pod: %v", err)
+	}
+	return pod
+}
+
+func TestPairCaptureCarriesRequesterToPeer(t *testing.T) {
+	tm := newTestManager(t)
+	peer := tm.addPeer("shop", "payments")
+	pod := tm.addPod("client", map[string]string{
+		annotationKey:                "3",
+		peerAnnotationKey:            "shop/payments",
+		requesterAnnotationKey:       "alice",
+		requesterGroupsAnnotationKey: `["sre"]`,
+	})
+
+	tm.sync(pod)
+
+	if started := tm.backend.Started(); len(started) != 1 || started[0].Peer != "shop/payments" {
+		t.Fatalf("started %+v, want the pair capture", started)
+	}
+	var got *corev1.Pod
+	waitFor(t, "the peer to be annotated", func() bool {
+		got = tm.apiPod(peer)
+		return got.Annotations[annotationKey] != ""
+	})
+	if got.Annotations[peerAnnotationKey] != "default/client" || got.Annotations[requesterAnnotationKey] != "alice" ||
+		got.Annotations[requesterGroupsAnnotationKey] != `["sre"]` {
+		t.Errorf("peer has annotations %v, want the capture pointing back with alice as requester", got.Annotations)
+	}
+}
+
+func TestPairCaptureWithoutRequesterLeavesPeerAlone(t *testing.T) {
+	tm := newTestManager(t)
+	peer := tm.addPeer("shop", "payments")
+	pod := tm.addPod("client", map[string]string{annotationKey: "3", peerAnnotationKey: "shop/payments"})
+
+	tm.sync(pod)
+
+	if n := len(tm.backend.Started()); n != 1 {
+		t.Fatalf("started %d captures, want this end", n)
+	}
+	e := tm.expectEvent(corev1.EventTypeWarning, reasonCaptureDenied)
+	if !strings.Contains(e, "shop/payments") {
+		t.Errorf("Event %q does not name the peer", e)
+	}
+	if _, ok := tm.apiPod(peer).Annotations[annotationKey]; ok {
+		t.Error("peer was annotated without a requester")
+	}
+}
+
+func TestPairCaptureChecksPeerNamespace(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings map[string]string
+		want     string
+	}{
+		{"denied namespace", map[string]string{settingDeniedNamespaces: "shop"}, "not allowed in namespace shop"},
+		{"group not allowed", map[string]string{settingCaptureGroups: "sre: default"}, "not in a group allowed to capture in namespace shop"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManager(t)
+			s, err := parseSettings(tt.settings, tm.cfg.defaultSettings())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tm.currentSettings.Store(s)
+			peer := tm.addPeer("shop", "payments")
+			pod := tm.addPod("client", map[string]string{
+				annotationKey:                "3",
+				peerAnnotationKey:            "shop/payments",
+				requesterAnnotationKey:       "alice",
+				requesterGroupsAnnotationKey: `["sre"]`,
+			})
+
+			tm.sync(pod)
+
+			if n := len(tm.backend.Started()); n != 0 {
+				t.Errorf("started %d captures, want none", n)
+			}
+			if st := tm.status(pod); st.State != stateFailed || !strings.Contains(st.Message, tt.want) {
+				t.Errorf("status is %q (%s), want %q with %q", st.State, st.Message, stateFailed, tt.want)
+			}
+			if _, ok := tm.apiPod(peer).Annotations[annotationKey]; ok {
+				t.Error("peer was annotated")
+			}
+		})
+	}
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	"golang.org/x/net/bpf"
+)
+
+// captureApplication is recorded as the writing application in pcapng
+// section headers.
+const captureApplication = "antrea-packet-capture-controller"
+
+// ringWriter writes pcapng files that rotate every RotateMB like tcpdump -C,
+// or every RotateEvery like dumpcap -b duration, and cycles through MaxFiles
+// names like tcpdump -W. Every file starts with a
+// section header whose comment records where the capture came from, so a file
+// opened on its own still says which Pod, node and session it belongs to.
+type ringWriter struct {
+	spec    captureSpec
+	intf    pcapgo.NgInterface
+	options pcapgo.NgWriterOptions
+	next    int
+	// rotations is the last rotation request generation seen.
+	rotations uint64
+
+	manifest   *manifestWriter
+	anonymizer *anonymizer
+	// stream sends the packets to the collector when the capture streams.
+	stream *packetStream
+	// flows aggregates the packets of ipfix captures, and metaFlows the
+	// packets whose flows are exported as metadata.
+	flows     *flowTable
+	metaFlows *flowTable
+	// mirror tunnels packets to the remote end of mirror captures.
+	mirror *mirrorTunnel
+
+	f       *os.File
+	w       *pcapgo.NgWriter
+	written *hashingWriter
+	// window describes the packets in the current file.
+	window manifestEntry
+	// opened is when the current file was created, and files counts the
+	// files created, for the ring buffer and autostop conditions.
+	opened time.Time
+	files  int
+	// match finds the packets of the stop-on condition, for backends that
+	// inspect packets.
+	match *bpf.VM
+	// stats counts every packet written, also for the packet count.
+	stats *packetStats
+
+	// finished numbers files handed to compression or decoding;
+	// compressing is closed when the last one is done.
+	finished    int
+	compressing chan struct{}
+}
+
+// newRingWriter returns a ringWriter for packets of the given link type
+// read from the interface ifName.
+func newRingWriter(spec captureSpec, ifName string, linkType layers.LinkType, snaplen int) *ringWriter {
+	var anon *anonymizer
+	if spec.Anonymize.enabled() {
+		anon = newAnonymizer(spec.Anonymize, linkType)
+	}
+	// The metadata of the files must not give away what the packets hide.
+	meta := spec.fileMetadata(anon)
+	intf := pcapgo.DefaultNgInterface
+	intf.Name = ifName
+	intf.Description = meta.interfaceDescription(ifName)
+	intf.Filter = meta.Filter
+	intf.LinkType = linkType
+	intf.SnapLength = uint32(snaplen)
+
+	options := pcapgo.DefaultNgWriterOptions
+	options.SectionInfo.Application = captureApplication
+	options.SectionInfo.OS = runtime.GOOS
+	options.SectionInfo.Comment = meta.provenance()
+	r := &ringWriter{spec: spec, intf: intf, options: options, manifest: newManifestWriter(spec), stats: &packetStats{}, anonymizer: anon}
+	// Requests from before a restart are done.
+	spec.Rotate.pending(&r.rotations)
+	return r
+}
+
+// fileMetadata returns the spec as recorded in the files written with
+// anon, nil without anonymization. With IP pseudonymization the filter,
+// which names the Pods' IPs for pair and dual-stack captures, shows the
+// pseudonyms instead, and the peer is left out.
+func (s captureSpec) fileMetadata(anon *anonymizer) captureSpec {
+	if anon != nil && s.Anonymize.IPs {
+		s.Filter = anon.scrubText(s.Filter)
+		s.Peer = ""
+	}
+	return s
+}
+
+// provenance is the section comment of every file.
+func (s captureSpec) provenance() string {
+	var b strings.Builder
+	if s.PodName != "" {
+		fmt.Fprintf(&b, "Pod: %s/%s\n", s.Namespace, s.PodName)
+		fmt.Fprintf(&b, "Pod UID: %s\n", s.PodUID)
+	} else {
+		b.WriteString("Node capture\n")
+	}
+	fmt.Fprintf(&b, "Node: %s\n", s.Node)
+	fmt.Fprintf(&b, "Session: %s\n", s.SessionID)
+	if s.Service != "" {
+		fmt.Fprintf(&b, "Service: %s/%s\n", s.Namespace, s.Service)
+	}
+	if s.Container != "" {
+		fmt.Fprintf(&b, "Container: %s\n", s.Container)
+	}
+	if s.HostNetwork {
+		b.WriteString("Host network: narrowed to the Pod's ports\n")
+	}
+	if s.PodLoopback {
+		b.WriteString("Interface: Pod loopback\n")
+	}
+	if s.Traceflow != "" {
+		fmt.Fprintf(&b, "Traceflow: %s\n", s.Traceflow)
+	}
+	if s.PacketCapture != "" {
+		fmt.Fprintf(&b, "PacketCapture: %s\n", s.PacketCapture)
+	}
+	if !s.Run.IsZero() {
+		fmt.Fprintf(&b, "Scheduled run: %s\n", s.Run.Format(time.RFC3339))
+	}
+	if s.Ring {
+		b.WriteString("Ring buffer: always on\n")
+	}
+	if s.Trigger != "" {
+		fmt.Fprintf(&b, "Trigger: %s\n", s.Trigger)
+	}
+	if s.Requester != "" {
+		fmt.Fprintf(&b, "Requester: %s\n", s.Requester)
+	}
+	if s.Peer != "" {
+		fmt.Fprintf(&b, "Peer: %s\n", s.Peer)
+	}
+	if s.Filter != "" {
+		fmt.Fprintf(&b, "Filter: %s\n", s.Filter)
+	}
+	if s.Mode != "" {
+		fmt.Fprintf(&b, "Mode: %s (snaplen %d)\n", s.Mode, s.snaplen())
+	}
+	if s.Direction != "" {
+		fmt.Fprintf(&b, "Direction: %s\n", s.Direction)
+	}
+	if s.StopOn != nil {
+		fmt.Fprintf(&b, "Stop on: %s\n", s.StopOn)
+	}
+	if s.Budget != nil {
+		fmt.Fprintf(&b, "Budget: %s\n", s.Budget)
+	}
+	if s.SampleRate > 1 {
+		fmt.Fprintf(&b, "Sampling: 1 in %d packets\n", s.SampleRate)
+	}
+	if s.WriteRateMB > 0 {
+		fmt.Fprintf(&b, "Write rate limit: %g MB/s\n", s.WriteRateMB)
+	}
+	if s.Anonymize.enabled() {
+		fmt.Fprintf(&b, "Anonymized: %s\n", s.Anonymize)
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func (s captureSpec) interfaceDescription(ifName string) string {
+	if s.PodName == "" {
+		return fmt.Sprintf("%s on node %s", ifName, s.Node)
+	}
+	return fmt.Sprintf("%s on node %s, capturing pod %s/%s", ifName, s.Node, s.Namespace, s.PodName)
+}
+
+// WritePacket writes one packet, rotating first when the file is full. It
+// returns errCaptureComplete once the packet count has been written, and
+// errFilesComplete instead of moving past the last file autostop allows.
+func (r *ringWriter) WritePacket(ci gopacket.CaptureInfo, data []byte) error {
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.f != nil && (r.spec.Rotate.pending(&r.rotations) || r.full()) {
+		if r.spec.StopFiles > 0 && r.files >= r.spec.StopFiles {
+			return errFilesComplete
+		}
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+	if r.match != nil {
+		if n, _ := r.match.Run(data); n > 0 {
+			r.spec.StopOn.observe()
+		}
+	}
+	if r.anonymizer != nil {
+		data = r.anonymizer.apply(data)
+		ci.CaptureLength = len(data)
+	}
+	r.spec.Live.publish(ci, r.intf.LinkType, data)
+	if r.stream != nil {
+		if err := r.stream.send(ci, data); err != nil {
+			return err
+		}
+	}
+	if r.mirror != nil {
+		r.mirror.send(ci, data)
+	}
+	if r.flows != nil {
+		r.flows.add(ci, data)
+	}
+	if r.metaFlows != nil {
+		r.metaFlows.add(ci, data)
+	} else if r.spec.MetadataSink != nil {
+		r.spec.MetadataSink.packet(r.spec, r.intf.LinkType, ci, data)
+	}
+	if r.f != nil {
+		if !r.spec.WriteLimit.allow(len(data)) {
+			r.stats.rateLimited.Add(1)
+			return nil
+		}
+		if r.spec.Budget != nil {
+			if err := r.makeRoom(len(data)); err != nil {
+				return err
+			}
+		}
+		// Every file has a single interface.
+		ci.InterfaceIndex = 0
+		if err := r.w.WritePacket(ci, data); err != nil {
+			return err
+		}
+		if r.spec.Budget != nil {
+			r.spec.Budget.set(r.f.Name(), int64(r.written.n))
+		}
+		if r.window.Packets == 0 {
+			r.window.FirstPacket = ci.Timestamp.UTC()
+		}
+		r.window.LastPacket = ci.Timestamp.UTC()
+		r.window.Packets++
+		r.spec.Trace.packetWritten()
+	}
+	if n := r.stats.captured.Add(1); r.spec.PacketCount > 0 && n >= uint64(r.spec.PacketCount) {
+		return errCaptureComplete
+	}
+	return nil
+}
+
+// full reports whether the current file has met a ring buffer condition.
+// Files are only rotated as packets arrive, so a file that is due stays
+// open until the next packet.
+func (r *ringWriter) full() bool {
+	return int64(r.written.n) >= int64(r.spec.RotateMB)*bytesPerMB ||
+		r.spec.RotateEvery > 0 && time.Since(r.opened) >= r.spec.RotateEvery
+}
+
+// open creates the first file and connects to the collector as the
+// capture's output requires, so a capture that cannot write fails early.
+func (r *ringWriter) open() error {
+	if r.spec.Collector != nil && r.stream == nil {
+		stream, err := r.spec.Collector.open(r.spec, r.intf.Name, r.intf.LinkType, int(r.intf.SnapLength))
+		if err != nil {
+			return err
+		}
+		r.stream = stream
+	}
+	if r.spec.Mirror != nil && r.mirror == nil {
+		mirror, err := openMirror(r.spec, r.intf.LinkType)
+		if err != nil {
+			return err
+		}
+		r.mirror = mirror
+	}
+	if r.spec.Flows != nil && r.flows == nil {
+		r.flows = newFlowTable(r.spec.Flows, r.spec, r.intf.LinkType)
+	}
+	if r.spec.Metadata == metadataFlows && r.spec.MetadataSink != nil && r.metaFlows == nil {
+		r.metaFlows = newFlowTable(r.spec.MetadataSink, r.spec, r.intf.LinkType)
+	}
+	if r.spec.writesFiles() && r.f == nil {
+		return r.rotate()
+	}
+	return nil
+}
+
+// rotate closes the current file and truncates the next one in the ring.
+func (r *ringWriter) rotate() (err error) {
+	if r.f != nil {
+		rotation := r.spec.Trace.start("rotate", attr("file.name", filepath.Base(r.f.Name())), attr("file.size", int64(r.written.n)))
+		defer func() { rotation.end(err) }()
+	}
+	if err := r.closeFile(); err != nil {
+		return err
+	}
+	name := ringFileName(r.spec.Path, r.next, r.spec.MaxFiles)
+	r.spec.Guard.release(name)
+	removeCompressed(name)
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	r.spec.Guard.writing(f)
+	r.next = (r.next + 1) % r.spec.MaxFiles
+	r.opened, r.files = time.Now(), r.files+1
+	r.f, r.written, r.window = f, newHashingWriter(f), manifestEntry{}
+	r.written.total = &r.stats.written
+	r.w, err = pcapgo.NewNgWriterInterface(r.written, r.intf, r.options)
+	if r.spec.Budget != nil {
+		r.spec.Budget.set(name, int64(r.written.n))
+	}
+	return err
+}
+
+// Close closes the current file and the collector stream, and exports the
+// flows still tracked.
+func (r *ringWriter) Close() error {
+	err := r.closeFile()
+	if r.flows != nil {
+		r.flows.Close()
+		r.flows = nil
+	}
+	if r.metaFlows != nil {
+		r.metaFlows.Close()
+		r.metaFlows = nil
+	}
+	if r.stream != nil {
+		if serr := r.stream.Close(); err == nil {
+			err = serr
+		}
+		r.stream = nil
+	}
+	if r.mirror != nil {
+		r.mirror.Close()
+		r.mirror = nil
+	}
+	return err
+}
+
+// closeFile closes the current file and finishes it.
+func (r *ringWriter) closeFile() error {
+	if r.f == nil {
+		return nil
+	}
+	var err error
+	if r.w != nil {
+		err = r.w.Flush()
+	}
+	name := r.f.Name()
+	r.spec.Guard.closing(name)
+	open, _ := r.f.Stat()
+	if cerr := r.f.Close(); err == nil {
+		err = cerr
+	}
+	if info, serr := os.Stat(name); open != nil && (serr != nil || !os.SameFile(open, info)) {
+		// The file was deleted or replaced under the ring, so there is
+		// nothing of it left to finish.
+		slog.Warn("Capture file is gone, not recording it", "file", name)
+		if r.spec.Budget != nil {
+			r.spec.Budget.set(name, 0)
+		}
+	} else if err == nil {
+		entry := r.window
+		entry.SHA256, entry.Size = r.written.sum(), int64(r.written.n)
+		if r.spec.Budget != nil {
+			r.spec.Budget.set(name, entry.Size)
+		}
+		r.finish(name, entry)
+	}
+	r.f, r.w = nil, nil
+	return err
+}
+
+// finish records a file the ring is done with in the manifest. A file to
+// compress, encrypt or decode is renamed out of the way, so the ring can reuse its
+// name, and processed in the background. Files are processed one after the
+// other, so a newer file in the same slot always wins.
+func (r *ringWriter) finish(name string, entry manifestEntry) {
+	if r.spec.Compress == compressNone && r.spec.Decode == nil && r.spec.Encrypt == nil {
+		r.manifest.record(name, entry)
+		return
+	}
+	r.finished++
+	raw := fmt.Sprintf("%s.%d%s", name, r.finished, compressSuffix)
+	if err := os.Rename(name, raw); err != nil {
+		slog.Error("Failed to compress capture file", "file", name, "err", err)
+		r.manifest.record(name, entry)
+		return
+	}
+	prev, done := r.compressing, make(chan struct{})
+	r.compressing = done
+	go func() {
+		defer close(done)
+		if prev != nil {
+			<-prev
+		}
+		process := r.spec.Trace.start("process", attr("file.name", filepath.Base(name)), attr("file.compression", string(r.spec.Compress)),
+			attr("file.encrypted", r.spec.Encrypt != nil), attr("file.decoded", r.spec.Decode != nil))
+		defer process.end(nil)
+		if r.spec.Decode != nil {
+			if err := r.spec.Decode.decode(raw, name+decodeSuffix); err != nil {
+				slog.Error("Failed to decode capture file", "file", name, "err", err)
+			} else if r.spec.Encrypt != nil {
+				// The decode holds the payloads too.
+				decoded := name + decodeSuffix
+				if _, _, err := compressFile(compressNone, r.spec.Encrypt, decoded, decoded+encryptSuffix); err != nil {
+					slog.Error("Failed to encrypt decoded capture file", "file", decoded, "err", err)
+				}
+				os.Remove(decoded)
+			}
+		}
+		if r.spec.Compress == compressNone && r.spec.Encrypt == nil {
+			// Link fails if the ring already wrote a newer file
+			// under the name.
+			if err := os.Link(raw, name); err == nil {
+				r.manifest.record(name, entry)
+			}
+			os.Remove(raw)
+			return
+		}
+		final, sum, size := compressRaw(r.spec.Compress, r.spec.Encrypt, raw, name)
+		entry.SHA256, entry.Size = sum, size
+		r.manifest.record(final, entry)
+	}()
+}
+
+// isRingFile reports whether f is a file a ring writer writes packets to, as
+// opposed to the compressed copies and manifests derived from those files.
+func isRingFile(f string) bool {
+	for _, suffix := range []string{compressGzip.extension(), compressZstd.extension(), encryptSuffix, compressSuffix, manifestSuffix, decodeSuffix, reportHTMLSuffix, ".tmp"} {
+		if strings.HasSuffix(f, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// hashingWriter counts and checksums the bytes that reach the file. Rotation
+// uses the count, so it ignores what is still buffered. total, if set, adds
+// up the bytes of every file of the capture.
+type hashingWriter struct {
+	w     io.Writer
+	h     hash.Hash
+	n     int
+	total *atomic.Uint64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, h: sha256.New()}
+}
+
+func (c *hashingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.h.Write(p[:n])
+	c.n += n
+	if c.total != nil {
+		c.total.Add(uint64(n))
+	}
+	return n, err
+}
+
+func (c *hashingWriter) sum() string {
+	return hex.EncodeToString(c.h.Sum(nil))
+}
+
+// ringFileName names file i of a ring of n files the way tcpdump does: the
+// index is appended, zero-padded to the width of n-1.
+func ringFileName(path string, i, n int) string {
+	if n <= 1 {
+		return path
+	}
+	return fmt.Sprintf("%s%0*d", path, len(fmt.Sprint(n-1)), i)
+}
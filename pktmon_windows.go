@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/pcapgo"
+)
+
+const (
+	// pktmonFileMB is the size of the ETL files pktmon writes before it
+	// moves on to the next, and so how many packets the agent converts at
+	// a time.
+	pktmonFileMB = 1
+	// pktmonPollInterval is how often the agent looks for ETL files pktmon
+	// has finished.
+	pktmonPollInterval = 2 * time.Second
+)
+
+// pktmonBackend captures with pktmon, the packet monitor built into
+// Windows. pktmon logs to ETL files rather than to a pipe, so it writes a
+// chain of small files that the agent converts to pcapng with pktmon
+// etl2pcap as each one is finished, copying their packets into the
+// capture's ring. A node has a single pktmon session, so the backend runs
+// one capture at a time.
+type pktmonBackend struct {
+	path string
+
+	mu sync.Mutex
+	// running is the session ID of the capture holding pktmon.
+	running string
+}
+
+func (b *pktmonBackend) Name() string { return backendPktmon }
+
+func (b *pktmonBackend) Check() error {
+	_, err := exec.LookPath(b.path)
+	return err
+}
+
+// CheckFilter translates the filter into pktmon filters.
+func (b *pktmonBackend) CheckFilter(spec captureSpec) error {
+	_, err := pktmonFilters(spec.Filter)
+	return err
+}
+
+func (b *pktmonBackend) Start(ctx context.Context, spec captureSpec) (runningCapture, error) {
+	comp, err := pktmonComponent(spec.Interface)
+	if err != nil {
+		return nil, err
+	}
+	filters, err := pktmonFilters(spec.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("the pktmon backend cannot apply filter %q: %w", spec.Filter, err)
+	}
+	b.mu.Lock()
+	if b.running != "" {
+		b.mu.Unlock()
+		return nil, fmt.Errorf("pktmon runs one capture per node at a time and session %s holds it", b.running)
+	}
+	b.running = spec.SessionID
+	b.mu.Unlock()
+	dir, err := b.start(spec, comp, filters)
+	if err != nil {
+		b.release()
+		return nil, err
+	}
+	c := &pktmonCapture{done: make(chan struct{})}
+	go b.collect(ctx, c, dir, spec)
+	return c, nil
+}
+
+// start sets up the filters and starts pktmon writing into a scratch
+// directory next to the capture's files, which it returns.
+func (b *pktmonBackend) start(spec captureSpec, comp string, filters []pktmonFilter) (string, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(spec.Path), ".pktmon-")
+	if err != nil {
+		return "", err
+	}
+	// pktmon keeps its filters across sessions, so those of an earlier
+	// capture would narrow this one.
+	if err := b.run("filter", "remove"); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	for i, f := range filters {
+		if err := b.run(append([]string{"filter", "add", "capture" + strconv.Itoa(i+1)}, f.args()...)...); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	// A packet size of 0 logs whole packets.
+	args := []string{"start", "--capture", "--pkt-size", strconv.Itoa(spec.Snaplen),
+		"--file-name", filepath.Join(dir, "capture.etl"), "--log-mode", "multi-file", "--file-size", strconv.Itoa(pktmonFileMB)}
+	if comp != "" {
+		args = append(args, "--comp", comp)
+	}
+	if err := b.run(args...); err != nil {
+		// The session of an agent that crashed outlives it.
+		slog.Warn("Cannot start pktmon, stopping a leftover session", "err", err)
+		b.run("stop")
+		if err := b.run(args...); err != nil {
+			os.RemoveAll(dir)
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+// collect copies the packets of the ETL files in dir into the capture's
+// ring as pktmon finishes them, until ctx is cancelled or the packet count
+// is reached. It then stops pktmon and copies the rest.
+func (b *pktmonBackend) collect(ctx context.Context, c *pktmonCapture, dir string, spec captureSpec) {
+	defer close(c.done)
+	defer b.release()
+	defer os.RemoveAll(dir)
+	w := &pktmonWriter{backend: b, spec: spec, stats: &c.stats}
+	ticker := time.NewTicker(pktmonPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			c.err = w.finish(dir)
+			return
+		case <-ticker.C:
+			files, err := etlFiles(dir)
+			if err != nil {
+				c.err = errors.Join(err, w.finish(dir))
+				return
+			}
+			// pktmon still writes the newest file.
+			for _, f := range files[:max(len(files)-1, 0)] {
+				if err := w.copy(f); err != nil {
+					c.err = w.finish(dir)
+					if !errors.Is(err, errCaptureComplete) {
+						c.err = errors.Join(fmt.Errorf("cannot copy pktmon output: %w", err), c.err)
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// release lets the next capture use pktmon.
+func (b *pktmonBackend) release() {
+	b.mu.Lock()
+	b.running = ""
+	b.mu.Unlock()
+}
+
+// run runs pktmon with args, returning its output as the error if it fails.
+func (b *pktmonBackend) run(args ...string) error {
+	out, err := exec.Command(b.path, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("pktmon %s: %w: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// etlFiles returns the ETL files in dir in the order pktmon wrote them.
+func etlFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type etl struct {
+		path string
+		mod  time.Time
+	}
+	var files []etl
+	for _, e := range entries {
+		if filepath.Ext(e.Name()) != ".etl" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, etl{filepath.Join(dir, e.Name()), info.ModTime()})
+	}
+	slices.SortFunc(files, func(a, b etl) int {
+		if c := a.mod.Compare(b.mod); c != 0 {
+			return c
+		}
+		return strings.Compare(a.path, b.path)
+	})
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = f.path
+	}
+	return paths, nil
+}
+
+// pktmonWriter copies the packets of converted ETL files into one ring.
+type pktmonWriter struct {
+	backend *pktmonBackend
+	spec    captureSpec
+	stats   *packetStats
+	// ring is created with the link type of the first file.
+	ring *ringWriter
+	// seen counts the packets read, for sampling.
+	seen int
+	// complete is the autostop condition the ring met; nothing is copied
+	// after it.
+	complete error
+}
+
+// copy converts the ETL file path to pcapng and writes its packets, then
+// removes both files.
+func (w *pktmonWriter) copy(path string) error {
+	if w.complete != nil {
+		return nil
+	}
+	pcap := strings.TrimSuffix(path, ".etl") + ".pcapng"
+	defer os.Remove(path)
+	defer os.Remove(pcap)
+	if err := w.backend.run("etl2pcap", path, "--out", pcap); err != nil {
+		return err
+	}
+	f, err := os.Open(pcap)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r, err := pcapgo.NewNgReader(f, pcapgo.DefaultNgReaderOptions)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if w.ring == nil {
+		w.ring = newRingWriter(w.spec, w.spec.Interface, r.LinkType(), w.spec.snaplen())
+		w.ring.stats = w.stats
+	}
+	for ; ; w.seen++ {
+		data, ci, err := r.ReadPacketData()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if w.spec.SampleRate > 1 && w.seen%w.spec.SampleRate != 0 {
+			continue
+		}
+		if err := w.ring.WritePacket(ci, data); err != nil {
+			if errors.Is(err, errCaptureComplete) {
+				w.complete = err
+			}
+			return err
+		}
+	}
+}
+
+// finish stops pktmon, copies the files it has not finished yet and closes
+// the ring.
+func (w *pktmonWriter) finish(dir string) error {
+	err := w.backend.run("stop")
+	if files, ferr := etlFiles(dir); ferr == nil {
+		for _, f := range files {
+			if cerr := w.copy(f); cerr != nil && !errors.Is(cerr, errCaptureComplete) && err == nil {
+				err = cerr
+			}
+		}
+	}
+	if w.ring != nil {
+		if cerr := w.ring.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err == nil && w.complete != nil {
+		return w.complete
+	}
+	return err
+}
+
+type pktmonCapture struct {
+	done  chan struct{}
+	stats packetStats
+	// err is written before done is closed.
+	err error
+}
+
+func (c *pktmonCapture) PID() int            { return 0 }
+func (c *pktmonCapture) Args() []string      { return nil }
+func (c *pktmonCapture) Stats() captureStats { return c.stats.snapshot() }
+func (c *pktmonCapture) Cost() captureCost   { return c.stats.cost(0) }
+
+func (c *pktmonCapture) Wait() error {
+	<-c.done
+	return c.err
+}
+
+// pktmonComponent returns the --comp selector for a capture interface:
+// pktmon captures on its numbered components, as pktmon list shows them,
+// rather than on interface names.
+func pktmonComponent(iface string) (string, error) {
+	switch iface {
+	case "", "any":
+		return "", nil
+	case "nics":
+		return iface, nil
+	}
+	for _, id := range strings.Split(iface, ",") {
+		if _, err := strconv.Atoi(id); err != nil {
+			return "", fmt.Errorf("the pktmon backend captures on pktmon component IDs, nics or any, not %q", iface)
+		}
+	}
+	return strings.ReplaceAll(iface, ",", " "), nil
+}
+
+// pktmonFilter is one pktmon packet filter, matching packets that match
+// each of its fields that is set. Up to two IPs or ports match the traffic
+// between them.
+type pktmonFilter struct {
+	ips      []string
+	ports    []string
+	protocol string
+	dataLink string
+}
+
+func (f pktmonFilter) args() []string {
+	var args []string
+	if f.dataLink != "" {
+		args = append(args, "-d", f.dataLink)
+	}
+	if f.protocol != "" {
+		args = append(args, "-t", f.protocol)
+	}
+	if len(f.ips) > 0 {
+		args = append(append(args, "-i"), f.ips...)
+	}
+	if len(f.ports) > 0 {
+		args = append(append(args, "-p"), f.ports...)
+	}
+	return args
+}
+
+// and returns the filter matching packets that match both f and g, or
+// false if a pktmon filter cannot say so.
+func (f pktmonFilter) and(g pktmonFilter) (pktmonFilter, bool) {
+	both := func(a, b []string) ([]string, bool) {
+		out := slices.Clone(a)
+		for _, v := range b {
+			if !slices.Contains(out, v) {
+				out = append(out, v)
+			}
+		}
+		return out, len(out) <= 2
+	}
+	same := func(a, b string) (string, bool) {
+		if a == "" || a == b {
+			return b, true
+		}
+		return a, b == ""
+	}
+	var ok [4]bool
+	var r pktmonFilter
+	r.ips, ok[0] = both(f.ips, g.ips)
+	r.ports, ok[1] = both(f.ports, g.ports)
+	r.protocol, ok[2] = same(f.protocol, g.protocol)
+	r.dataLink, ok[3] = same(f.dataLink, g.dataLink)
+	return r, ok == [4]bool{true, true, true, true}
+}
+
+// pktmonFilters translates a filter expression into pktmon filters, of
+// which a packet has to match one. pktmon has no BPF, so only the subset
+// the agent builds itself is understood: host, port, the tcp, udp, icmp,
+// icmp6, ip and ip6 qualifiers, and, or and parentheses.
+func pktmonFilters(expr string) ([]pktmonFilter, error) {
+	if strings.TrimSpace(expr) == "" {
+		return nil, nil
+	}
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(expr)
+	p := &pktmonParser{tokens: strings.Fields(expr)}
+	filters, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, fmt.Errorf("unexpected %q", tok)
+	}
+	return filters, nil
+}
+
+// pktmonParser parses filter expressions into alternatives of pktmon
+// filters.
+type pktmonParser struct {
+	tokens []string
+}
+
+func (p *pktmonParser) peek() string {
+	if len(p.tokens) == 0 {
+		return ""
+	}
+	return p.tokens[0]
+}
+
+func (p *pktmonParser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.tokens = p.tokens[1:]
+	}
+	return tok
+}
+
+func (p *pktmonParser) or() ([]pktmonFilter, error) {
+	filters, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" || p.peek() == "||" {
+		p.next()
+		more, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, more...)
+	}
+	return filters, nil
+}
+
+func (p *pktmonParser) and() ([]pktmonFilter, error) {
+	filters, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" || p.peek() == "&&" {
+		p.next()
+		other, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		if filters, err = andFilters(filters, other); err != nil {
+			return nil, err
+		}
+	}
+	return filters, nil
+}
+
+// andFilters returns the filters matching packets that match one of a and
+// one of b.
+func andFilters(a, b []pktmonFilter) ([]pktmonFilter, error) {
+	var out []pktmonFilter
+	for _, f := range a {
+		for _, g := range b {
+			r, ok := f.and(g)
+			if !ok {
+				return nil, errors.New("pktmon filters match at most two IPs or ports and one protocol")
+			}
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (p *pktmonParser) term() ([]pktmonFilter, error) {
+	tok := p.next()
+	switch tok {
+	case "(":
+		filters, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing )")
+		}
+		return filters, nil
+	case "host":
+		ip := p.next()
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("host needs an IP address, got %q", ip)
+		}
+		return []pktmonFilter{{ips: []string{ip}}}, nil
+	case "port":
+		port := p.next()
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("port needs a port number, got %q", port)
+		}
+		return []pktmonFilter{{ports: []string{port}}}, nil
+	case "tcp", "udp", "icmp", "icmp6":
+		f := []pktmonFilter{{protocol: map[string]string{"tcp": "TCP", "udp": "UDP", "icmp": "ICMP", "icmp6": "ICMPv6"}[tok]}}
+		if p.peek() == "port" {
+			return p.qualified(f)
+		}
+		return f, nil
+	case "ip", "ip6":
+		f := []pktmonFilter{{dataLink: map[string]string{"ip": "IPv4", "ip6": "IPv6"}[tok]}}
+		if p.peek() == "host" {
+			return p.qualified(f)
+		}
+		return f, nil
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	}
+	return nil, fmt.Errorf("%q is not supported", tok)
+}
+
+// qualified returns the term that follows a qualifier such as tcp in tcp
+// port 80, narrowed to the qualifier's filters f.
+func (p *pktmonParser) qualified(f []pktmonFilter) ([]pktmonFilter, error) {
+	term, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	return andFilters(f, term)
+}
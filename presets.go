@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// filterAnnotationKey narrows a capture to one or more named protocol
+// presets, comma separated, for users who do not write BPF.
+const filterAnnotationKey = "filter." + annotationKey
+
+// filterPresets are the vetted BPF expressions behind the preset names.
+// tls-handshake reads the TLS record type behind the TCP header, which
+// libpcap can only index for IPv4.
+var filterPresets = map[string]string{
+	"dns":           "(udp port 53 or tcp port 53)",
+	"http":          "(tcp port 80 or tcp port 8080)",
+	"tls-handshake": "(tcp[((tcp[12:1] & 0xf0) >> 2):1] = 0x16 and tcp[((tcp[12:1] & 0xf0) >> 2) + 1:1] = 0x03)",
+	"icmp":          "(icmp or icmp6)",
+	"sctp":          "sctp",
+	"bgp":           "tcp port 179",
+}
+
+// presetFilter returns the expression matching any of the comma separated
+// presets in v.
+func presetFilter(v string) (string, error) {
+	var terms []string
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(v, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		expr, ok := filterPresets[name]
+		if !ok {
+			return "", fmt.Errorf("unknown filter preset %q, want one of %s", name, strings.Join(presetNames(), ", "))
+		}
+		seen[name] = true
+		terms = append(terms, expr)
+	}
+	switch len(terms) {
+	case 0:
+		return "", fmt.Errorf("no filter preset given")
+	case 1:
+		return terms[0], nil
+	}
+	return "(" + strings.Join(terms, " or ") + ")", nil
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(filterPresets))
+	for name := range filterPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+const (
+	pressureCheckInterval = 30 * time.Second
+	reasonCaptureEvicted  = "CaptureFilesEvicted"
+)
+
+// runPressureMonitor periodically checks the utilization of the filesystem
+// holding the capture directory and evicts retained files when it crosses
+// the disk pressure threshold.
+func (m *CaptureManager) runPressureMonitor(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(pressureCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if threshold := m.settings().DiskPressurePercent; threshold > 0 {
+				m.relievePressure(threshold)
+			}
+		}
+	}
+}
+
+// diskUtilization returns the used percentage of the capture filesystem.
+func (m *CaptureManager) diskUtilization() (float64, error) {
+	total, free, err := diskStats(m.cfg.CaptureDir)
+	if err != nil || total == 0 {
+		return 0, err
+	}
+	return float64(total-free) * 100 / float64(total), nil
+}
+
+// relievePressure deletes the oldest files of completed captures, one at a
+// time, until utilization drops below threshold. Files of running captures
+// are never evicted.
+func (m *CaptureManager) relievePressure(threshold int) {
+	util, err := m.diskUtilization()
+	if err != nil {
+		slog.Error("Failed to check disk utilization", "dir", m.cfg.CaptureDir, "err", err)
+		return
+	}
+	m.oncall.diskPressure(util, threshold)
+	if util < float64(threshold) {
+		return
+	}
+
+	m.mu.Lock()
+	candidates := m.evictionCandidates()
+	m.mu.Unlock()
+	slog.Warn("Capture disk under pressure, evicting completed captures",
+		"utilization", int(util), "threshold", threshold, "candidates", len(candidates))
+
+	evicted := make(map[string]int)
+	for _, f := range candidates {
+		if util < float64(threshold) {
+			break
+		}
+		m.auditFiles(auditDelete, "", "", "disk pressure", f.path)
+		if err := os.Remove(f.path); err != nil {
+			slog.Error("Failed to evict file", "file", f.path, "err", err)
+			continue
+		}
+		slog.Info("Evicted file", "file", f.path, "size", f.size)
+		filesDeleted.Inc()
+		filesEvicted.Inc()
+		bytesEvicted.Add(float64(f.size))
+		if cf, ok := parseCaptureFile(filepath.Base(f.path)); ok {
+			evicted[cf.Namespace+"/"+cf.Pod]++
+		}
+		if util, err = m.diskUtilization(); err != nil {
+			break
+		}
+	}
+	m.mu.Lock()
+	m.pruneSessionDirs()
+	m.mu.Unlock()
+	m.recordEvictions(evicted)
+}
+
+type evictionCandidate struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// evictionCandidates lists files not owned by a running capture, oldest
+// first. Callers must hold m.mu.
+func (m *CaptureManager) evictionCandidates() []evictionCandidate {
+	matches, _ := m.listCaptureFiles()
+	var out []evictionCandidate
+	for _, f := range matches {
+		// Files on storage targets take no space in the capture
+		// directory.
+		if m.isActiveFile(f) || onStorage(f) {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		out = append(out, evictionCandidate{path: f, size: info.Size(), modTime: info.ModTime()})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].modTime.Before(out[j].modTime) })
+	return out
+}
+
+// recordEvictions records an Event on each Pod on this node whose files
+// were evicted.
+func (m *CaptureManager) recordEvictions(evicted map[string]int) {
+	if len(evicted) == 0 || !m.synced.Load() {
+		return
+	}
+	pods, err := m.podLister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, pod := range pods {
+		// Files of earlier versions do not name the namespace.
+		if n := evicted[pod.Namespace+"/"+pod.Name] + evicted["/"+pod.Name]; n > 0 {
+			m.recorder.Eventf(pod, corev1.EventTypeWarning, reasonCaptureEvicted,
+				"Evicted %d capture file(s) because the capture disk on node %s is under pressure", n, m.nodeName)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// priorityAnnotationKey sets the priority class of a capture. When the
+// node runs out of capture slots or disk quota, a capture may preempt
+// running captures of a lower class.
+const priorityAnnotationKey = "priority." + annotationKey
+
+// Capture priority classes, lowest first.
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
+const reasonCapturePreempted = "CapturePreempted"
+
+// statePreempted is reported for a capture stopped to make room for one of
+// a higher priority class.
+const statePreempted = "preempted"
+
+// parsePriority parses the value of the priority annotation.
+func parsePriority(v string) (string, error) {
+	switch p := strings.TrimSpace(v); p {
+	case priorityLow, priorityNormal, priorityHigh:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown priority %q, expected %s, %s or %s", v, priorityLow, priorityNormal, priorityHigh)
+}
+
+// priorityRank orders priority classes; captures without one are normal.
+func priorityRank(p string) int {
+	switch p {
+	case priorityLow:
+		return 0
+	case priorityHigh:
+		return 2
+	}
+	return 1
+}
+
+// preempt stops the running capture of the lowest priority class below
+// that of spec, the longest running one among equals, to make room for
+// the capture of spec, named by. The preempted capture is stopped like any
+// other, so its files are finished and analyzed, and reports the capture
+// that preempted it in its status. It waits for a slot again while it is
+// still requested. preempt reports whether it stopped a capture. Callers
+// must hold m.mu.
+func (m *CaptureManager) preempt(spec captureSpec, by string) bool {
+	var victim string
+	var found *CaptureProcess
+	for key, cap := range m.captures {
+		if cap.completed.Load() || priorityRank(cap.spec.Priority) >= priorityRank(spec.Priority) {
+			continue
+		}
+		if found == nil || priorityRank(cap.spec.Priority) < priorityRank(found.spec.Priority) ||
+			(priorityRank(cap.spec.Priority) == priorityRank(found.spec.Priority) && cap.startTime.Before(found.startTime)) {
+			victim, found = key, cap
+		}
+	}
+	if found == nil {
+		return false
+	}
+	found.log.Info("Preempting capture", "priority", found.spec.Priority, "by", by, "byPriority", spec.Priority)
+	m.recorder.Event(found.ref, corev1.EventTypeWarning, reasonCapturePreempted, sessionEvent(found.spec,
+		fmt.Sprintf("Stopped to make room for the %s priority capture of %s", spec.Priority, by)))
+	found.preemptedBy = by
+	m.stopCapture(victim, false, true)
+	return true
+}
+
+// captureName names the capture of spec in Events and statuses of other
+// captures.
+func captureName(spec captureSpec) string {
+	if spec.PodName == "" {
+		return "node " + spec.Node
+	}
+	return sessionKey(spec.Namespace+"/"+spec.PodName, spec.Session)
+}
+
+// checkCaptureDisk is checkDisk for the capture of spec. While the node
+// quota is what refuses it, it preempts captures of a lower priority class,
+// whose files then only count with their actual size. Callers must hold
+// m.mu.
+func (m *CaptureManager) checkCaptureDisk(spec captureSpec, quotaMB int) (string, string) {
+	for {
+		reason, msg := m.checkDisk(m.storageRoot(spec.Storage), spec.budget(), quotaMB)
+		if reason != reasonDiskQuotaExceeded || !m.preempt(spec, captureName(spec)) {
+			return reason, msg
+		}
+	}
+}
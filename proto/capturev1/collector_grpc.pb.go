@@ -0,0 +1,147 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: collector.proto
+
+package capturev1
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Collector_StreamPackets_FullMethodName = "/antrea.capture.v1.Collector/StreamPackets"
+)
+
+// CollectorClient is the client API for Collector service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type CollectorClient interface {
+	// StreamPackets carries the packets of one capture run. The first
+	// message holds the header, every following one a packet.
+	StreamPackets(ctx context.Context, opts ...grpc.CallOption) (Collector_StreamPacketsClient, error)
+}
+
+type collectorClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewCollectorClient(cc grpc.ClientConnInterface) CollectorClient {
+	return &collectorClient{cc}
+}
+
+func (c *collectorClient) StreamPackets(ctx context.Context, opts ...grpc.CallOption) (Collector_StreamPacketsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Collector_ServiceDesc.Streams[0], Collector_StreamPackets_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &collectorStreamPacketsClient{stream}
+	return x, nil
+}
+
+type Collector_StreamPacketsClient interface {
+	Send(*StreamPacketsRequest) error
+	CloseAndRecv() (*StreamPacketsResponse, error)
+	grpc.ClientStream
+}
+
+type collectorStreamPacketsClient struct {
+	grpc.ClientStream
+}
+
+func (x *collectorStreamPacketsClient) Send(m *StreamPacketsRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *collectorStreamPacketsClient) CloseAndRecv() (*StreamPacketsResponse, error) {
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	m := new(StreamPacketsResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// CollectorServer is the server API for Collector service.
+// All implementations must embed UnimplementedCollectorServer
+// for forward compatibility
+type CollectorServer interface {
+	// StreamPackets carries the packets of one capture run. The first
+	// message holds the header, every following one a packet.
+	StreamPackets(Collector_StreamPacketsServer) error
+	mustEmbedUnimplementedCollectorServer()
+}
+
+// UnimplementedCollectorServer must be embedded to have forward compatible implementations.
+type UnimplementedCollectorServer struct {
+}
+
+func (UnimplementedCollectorServer) StreamPackets(Collector_StreamPacketsServer) error {
+	return status.Errorf(codes.Unimplemented, "method StreamPackets not implemented")
+}
+func (UnimplementedCollectorServer) mustEmbedUnimplementedCollectorServer() {}
+
+// UnsafeCollectorServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to CollectorServer will
+// result in compilation errors.
+type UnsafeCollectorServer interface {
+	mustEmbedUnimplementedCollectorServer()
+}
+
+func RegisterCollectorServer(s grpc.ServiceRegistrar, srv CollectorServer) {
+	s.RegisterService(&Collector_ServiceDesc, srv)
+}
+
+func _Collector_StreamPackets_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(CollectorServer).StreamPackets(&collectorStreamPacketsServer{stream})
+}
+
+type Collector_StreamPacketsServer interface {
+	SendAndClose(*StreamPacketsResponse) error
+	Recv() (*StreamPacketsRequest, error)
+	grpc.ServerStream
+}
+
+type collectorStreamPacketsServer struct {
+	grpc.ServerStream
+}
+
+func (x *collectorStreamPacketsServer) SendAndClose(m *StreamPacketsResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *collectorStreamPacketsServer) Recv() (*StreamPacketsRequest, error) {
+	m := new(StreamPacketsRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Collector_ServiceDesc is the grpc.ServiceDesc for Collector service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Collector_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "antrea.capture.v1.Collector",
+	HandlerType: (*CollectorServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "StreamPackets",
+			Handler:       _Collector_StreamPackets_Handler,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "collector.proto",
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// settingNamespaceQuotas holds the capture quotas of namespaces, one per
+// line: a namespace or pattern, a colon and its limits, e.g.
+//
+//	team-a: captures=2,diskMB=5000,duration=1h
+//	team-*: captures=1,diskMB=1000
+const settingNamespaceQuotas = "namespaceQuotas"
+
+// usageAnnotationKey holds the capture usage of a node by namespace, as
+// the agent of the node publishes it for the namespace quotas.
+const usageAnnotationKey = "usage." + annotationKey
+
+const reasonNamespaceQuotaExceeded = "NamespaceQuotaExceeded"
+
+const (
+	// quotaRetryInterval is how often a capture waiting for its namespace
+	// quota checks again, as captures on other nodes end unnoticed.
+	quotaRetryInterval = 30 * time.Second
+	// usageListTimeout bounds listing the Nodes for the usage of the
+	// cluster.
+	usageListTimeout = 5 * time.Second
+	// retainedSizeTTL is how long the sizes of retained files are reused.
+	// Files retention removes in the meantime still count, so the quota
+	// errs on the side of refusing captures.
+	retainedSizeTTL = statusReportInterval
+)
+
+// namespaceQuota limits the captures of the namespaces matching Pattern
+// across the cluster. A zero limit is no limit.
+type namespaceQuota struct {
+	Pattern string
+	// Captures caps the captures running at a time, DiskMB the disk
+	// their files and the worst case of running captures take, and
+	// Duration how long a capture runs.
+	Captures int
+	DiskMB   int
+	Duration time.Duration
+}
+
+// namespaceUsage is what the captures of a namespace use on a node.
+type namespaceUsage struct {
+	Captures int   `json:"captures"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// parseNamespaceQuotas parses the namespaceQuotas setting.
+func parseNamespaceQuotas(v string) ([]namespaceQuota, error) {
+	var quotas []namespaceQuota
+	for _, line := range strings.Split(v, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		pattern, limits, ok := strings.Cut(line, ":")
+		q := namespaceQuota{Pattern: strings.TrimSpace(pattern)}
+		if !ok || q.Pattern == "" {
+			return nil, fmt.Errorf("%s expects a namespace, a colon and its limits, got %q", settingNamespaceQuotas, line)
+		}
+		if _, err := path.Match(q.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s has an invalid pattern %q", settingNamespaceQuotas, q.Pattern)
+		}
+		for _, part := range strings.Split(limits, ",") {
+			key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+			if !ok || val == "" {
+				return nil, fmt.Errorf("%s of %s: expected key=value pairs, got %q", settingNamespaceQuotas, q.Pattern, part)
+			}
+			switch key {
+			case "captures", "diskMB":
+				n, err := strconv.Atoi(val)
+				if err != nil || n < 0 {
+					return nil, fmt.Errorf("%s of %s: %s must be a non-negative integer, got %q", settingNamespaceQuotas, q.Pattern, key, val)
+				}
+				if key == "captures" {
+					q.Captures = n
+				} else {
+					q.DiskMB = n
+				}
+			case "duration":
+				d, err := time.ParseDuration(val)
+				if err != nil || d < 0 {
+					return nil, fmt.Errorf("%s of %s: duration must be a duration, got %q", settingNamespaceQuotas, q.Pattern, val)
+				}
+				q.Duration = d
+			default:
+				return nil, fmt.Errorf("%s of %s: unknown key %q", settingNamespaceQuotas, q.Pattern, key)
+			}
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas, nil
+}
+
+// namespaceQuota returns the quota of ns: the one naming it, or else the
+// first whose pattern matches it. It returns nil if ns has none.
+func (s *Settings) namespaceQuota(ns string) *namespaceQuota {
+	for i, q := range s.NamespaceQuotas {
+		if q.Pattern == ns {
+			return &s.NamespaceQuotas[i]
+		}
+	}
+	for i, q := range s.NamespaceQuotas {
+		if ok, _ := path.Match(q.Pattern, ns); ok {
+			return &s.NamespaceQuotas[i]
+		}
+	}
+	return nil
+}
+
+// limited reports whether q limits the captures or disk of its namespace.
+func (q *namespaceQuota) limited() bool {
+	return q.Captures > 0 || q.DiskMB > 0
+}
+
+// limitDuration ends the capture of spec after the quota's duration at the
+// latest. Ring buffers are kept for as long as their Pod runs.
+func (q *namespaceQuota) limitDuration(spec *captureSpec) {
+	if q.Duration > 0 && !spec.Ring && (spec.StopAfter == 0 || spec.StopAfter > q.Duration) {
+		spec.StopAfter = q.Duration
+	}
+}
+
+// namespaceUsages returns what the captures of the node use by namespace:
+// the running captures, and like nodeUsage, the worst case of every
+// capture plus the size of retained files no capture owns, as
+// retainedUsage caches it. Callers must hold m.mu.
+func (m *CaptureManager) namespaceUsages() map[string]namespaceUsage {
+	usages := make(map[string]namespaceUsage)
+	for _, cap := range m.captures {
+		if cap.spec.Namespace == "" {
+			continue
+		}
+		u := usages[cap.spec.Namespace]
+		if !cap.completed.Load() {
+			u.Captures++
+		}
+		u.Bytes += cap.spec.budget()
+		usages[cap.spec.Namespace] = u
+	}
+	for ns, size := range m.retainedUsage() {
+		u := usages[ns]
+		u.Bytes += size
+		usages[ns] = u
+	}
+	return usages
+}
+
+// retainedUsage returns the bytes of retained files no capture owns by
+// namespace. Listing and sizing the files on every capture start would
+// hold m.mu for as long as the capture directory takes to walk, so the
+// sizes are summed again only after retainedSizeTTL or once stopped
+// captures leave files to retention. Callers must hold m.mu.
+func (m *CaptureManager) retainedUsage() map[string]int64 {
+	if m.retainedSizes != nil && time.Since(m.retainedAt) < retainedSizeTTL {
+		return m.retainedSizes
+	}
+	sizes := make(map[string]int64)
+	matches, _ := m.listCaptureFiles()
+	for _, f := range matches {
+		cf, ok := parseCaptureFile(filepath.Base(f))
+		if !ok || cf.Namespace == "" || m.isActiveFile(f) {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			sizes[cf.Namespace] += info.Size()
+		}
+	}
+	m.retainedSizes, m.retainedAt = sizes, time.Now()
+	return sizes
+}
+
+// remoteUsage returns what the captures of ns use on the other nodes, as
+// their agents published it. It reads the Nodes from the API server, so
+// callers must not hold m.mu.
+func (m *CaptureManager) remoteUsage(ns string) (namespaceUsage, error) {
+	var usage namespaceUsage
+	ctx, cancel := context.WithTimeout(context.Background(), usageListTimeout)
+	defer cancel()
+	// The watch cache of the API server is recent enough.
+	nodes, err := m.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{ResourceVersion: "0"})
+	if err != nil {
+		return usage, err
+	}
+	for _, node := range nodes.Items {
+		if node.Name == m.nodeName {
+			continue
+		}
+		var usages map[string]namespaceUsage
+		if json.Unmarshal([]byte(node.Annotations[usageAnnotationKey]), &usages) != nil {
+			continue
+		}
+		usage.Captures += usages[ns].Captures
+		usage.Bytes += usages[ns].Bytes
+	}
+	return usage, nil
+}
+
+// checkNamespaceQuota checks the capture of spec against the quota q of
+// its namespace, given what its captures use on the other nodes. It
+// returns the Event reason and a message when the capture must be refused,
+// and whether it has to wait for one of the namespace's captures to end
+// otherwise. Callers must hold m.mu.
+func (m *CaptureManager) checkNamespaceQuota(q *namespaceQuota, spec captureSpec, remote namespaceUsage) (string, string, bool) {
+	if !q.limited() {
+		return "", "", false
+	}
+	usage := m.namespaceUsages()[spec.Namespace]
+	usage.Captures += remote.Captures
+	usage.Bytes += remote.Bytes
+	if q.DiskMB > 0 && spec.writesFiles() {
+		quota, budget := int64(q.DiskMB)*bytesPerMB, spec.budget()
+		if usage.Bytes+budget > quota {
+			return reasonNamespaceQuotaExceeded, fmt.Sprintf("Capture needs up to %d MB but only %d MB of the %d MB quota of namespace %s remain",
+				budget/bytesPerMB, max(quota-usage.Bytes, 0)/bytesPerMB, q.DiskMB, spec.Namespace), false
+		}
+	}
+	return "", "", q.Captures > 0 && usage.Captures >= q.Captures
+}
+
+// reportQuotaPending records that a capture waits for its namespace quota,
+// as reportPending does for node slots, and checks again after
+// quotaRetryInterval. Callers must hold m.mu.
+func (m *CaptureManager) reportQuotaPending(pod *corev1.Pod, spec captureSpec, q *namespaceQuota) error {
+	m.queue.AddAfter(pod.Namespace+"/"+pod.Name, quotaRetryInterval)
+	current := annotatedStatus(pod, spec.Session)
+	msg := fmt.Sprintf("waiting for the quota of namespace %s; %d captures run in it at a time", spec.Namespace, q.Captures)
+	if current.State == statePending && current.Message == msg {
+		return nil
+	}
+	if current.State != statePending {
+		slog.Info("Capture waiting for its namespace quota", "namespace", spec.Namespace, "pod", spec.PodName, "name", spec.Session)
+		m.recorder.Event(podRef(pod), corev1.EventTypeNormal, reasonCapturePending, sessionEvent(spec,
+			fmt.Sprintf("Waiting for one of the %d captures of namespace %s to end", q.Captures, spec.Namespace)))
+	}
+	m.patchStatus(podRef(pod), captureStatus{State: statePending, Node: m.nodeName, Session: spec.Session, Priority: spec.Priority,
+		Requester: spec.Requester, Message: msg})
+	return nil
+}
+
+// runUsageReporter publishes the capture usage of the node on its Node
+// while namespace quotas are set: whenever captures start or end, and
+// every statusReportInterval for the files retention removes.
+func (m *CaptureManager) runUsageReporter(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(statusReportInterval)
+	defer ticker.Stop()
+	var published map[string]namespaceUsage
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-m.usageChanged:
+		}
+		if len(m.settings().NamespaceQuotas) == 0 {
+			continue
+		}
+		m.mu.Lock()
+		usages := m.namespaceUsages()
+		m.mu.Unlock()
+		if published != nil && maps.Equal(usages, published) {
+			continue
+		}
+		ref := &corev1.ObjectReference{Kind: "Node", APIVersion: "v1", Name: m.nodeName}
+		if m.patchAnnotation(ref, usageAnnotationKey, usages) == nil {
+			published = usages
+		}
+	}
+}
+
+// usageChange lets runUsageReporter publish the usage of the node after
+// captures started or ended.
+func (m *CaptureManager) usageChange() {
+	select {
+	case m.usageChanged <- struct{}{}:
+	default:
+	}
+}
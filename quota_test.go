@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseNamespaceQuotas(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    []namespaceQuota
+		wantErr string
+	}{
+		{name: "empty", value: ""},
+		{name: "blank lines", value: "\n  \n"},
+		{
+			name:  "limits",
+			value: "team-a: captures=2,diskMB=5000,duration=1h\n\n  team-* :captures=1, diskMB=1000 \n",
+			want: []namespaceQuota{
+				{Pattern: "team-a", Captures: 2, DiskMB: 5000, Duration: time.Hour},
+				{Pattern: "team-*", Captures: 1, DiskMB: 1000},
+			},
+		},
+		{name: "zero limits", value: "dev: captures=0,diskMB=0,duration=0s", want: []namespaceQuota{{Pattern: "dev"}}},
+		{name: "no colon", value: "team-a captures=2", wantErr: "expects a namespace, a colon"},
+		{name: "no pattern", value: ": captures=2", wantErr: "expects a namespace, a colon"},
+		{name: "invalid pattern", value: "team-[: captures=2", wantErr: "invalid pattern"},
+		{name: "no limits", value: "team-a:", wantErr: "expected key=value pairs"},
+		{name: "no value", value: "team-a: captures=", wantErr: "expected key=value pairs"},
+		{name: "negative captures", value: "team-a: captures=-1", wantErr: "captures must be a non-negative integer"},
+		{name: "fractional disk", value: "team-a: diskMB=1.5", wantErr: "diskMB must be a non-negative integer"},
+		{name: "invalid duration", value: "team-a: duration=1d", wantErr: "duration must be a duration"},
+		{name: "negative duration", value: "team-a: duration=-1m", wantErr: "duration must be a duration"},
+		{name: "unknown key", value: "team-a: cpus=2", wantErr: `unknown key "cpus"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNamespaceQuotas(tt.value)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseNamespaceQuotas: %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseNamespaceQuotas: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNamespaceQuotas = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaceQuotaPrecedence(t *testing.T) {
+	quotas, err := parseNamespaceQuotas("team-*: captures=1\nteam-a: captures=2\nteam-?: captures=3\n*-prod: captures=4")
+	if err != nil {
+		t.Fatalf("parseNamespaceQuotas: %v", err)
+	}
+	s := &Settings{NamespaceQuotas: quotas}
+	tests := []struct {
+		ns   string
+		want string
+	}{
+		// The line naming a namespace applies before an earlier pattern.
+		{ns: "team-a", want: "team-a"},
+		// Otherwise the first matching pattern applies.
+		{ns: "team-b", want: "team-*"},
+		{ns: "team-prod", want: "team-*"},
+		{ns: "shop-prod", want: "*-prod"},
+		{ns: "default"},
+	}
+	for _, tt := range tests {
+		q := s.namespaceQuota(tt.ns)
+		switch {
+		case q == nil && tt.want != "":
+			t.Errorf("namespaceQuota(%q) = nil, want %s", tt.ns, tt.want)
+		case q != nil && q.Pattern != tt.want:
+			t.Errorf("namespaceQuota(%q) = %s, want %q", tt.ns, q.Pattern, tt.want)
+		}
+	}
+}
+
+// addRetainedFile writes a retained capture file of size bytes for a
+// session of pod in ns and returns its path.
+func addRetainedFile(t *testing.T, tm *testManager, ns, pod, session string, size int) string {
+	t.Helper()
+	dir := filepath.Join(tm.podDir(ns, pod), session)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("capture-%s_%s-uid%s-20260101T000000Z-%s.pcap", ns, pod, pod, session))
+	if err := os.WriteFile(path, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// addQuotaCapture adds a capture of ns with a budget of budgetMB, owning
+// the files starting with path if it is set.
+func addQuotaCapture(t *testing.T, tm *testManager, key, ns string, budgetMB int, completed bool, path string) {
+	t.Helper()
+	cap := &CaptureProcess{spec: captureSpec{Namespace: ns, PodName: key, MaxFiles: 1, RotateMB: budgetMB}}
+	cap.completed.Store(completed)
+	if path != "" {
+		cap.files = []string{path}
+	}
+	tm.mu.Lock()
+	tm.captures[key] = cap
+	tm.mu.Unlock()
+	// The captures have nothing to stop.
+	t.Cleanup(func() {
+		tm.mu.Lock()
+		delete(tm.captures, key)
+		tm.mu.Unlock()
+	})
+}
+
+func TestCheckNamespaceQuota(t *testing.T) {
+	tests := []struct {
+		name     string
+		quota    namespaceQuota
+		spec     captureSpec
+		remote   namespaceUsage
+		wantMsg  string
+		wantWait bool
+	}{
+		{name: "no limits", quota: namespaceQuota{Duration: time.Hour}, spec: captureSpec{MaxFiles: 100, RotateMB: 100}},
+		// team-a runs one capture and has a completed one; team-b's
+		// captures do not count.
+		{name: "capture slot free", quota: namespaceQuota{Captures: 2}, spec: captureSpec{MaxFiles: 1, RotateMB: 1}},
+		{name: "captures full", quota: namespaceQuota{Captures: 1}, spec: captureSpec{MaxFiles: 1, RotateMB: 1}, wantWait: true},
+		{
+			name:     "captures full with other nodes",
+			quota:    namespaceQuota{Captures: 3},
+			spec:     captureSpec{MaxFiles: 1, RotateMB: 1},
+			remote:   namespaceUsage{Captures: 2},
+			wantWait: true,
+		},
+		// Budgets of 10 and 20 MB plus 5 MB retained, of which the file
+		// of the running capture does not count.
+		{name: "disk fits", quota: namespaceQuota{DiskMB: 40}, spec: captureSpec{MaxFiles: 1, RotateMB: 5}},
+		{
+			name:    "disk exceeded",
+			quota:   namespaceQuota{DiskMB: 40},
+			spec:    captureSpec{MaxFiles: 2, RotateMB: 3},
+			wantMsg: "Capture needs up to 6 MB but only 5 MB of the 40 MB quota of namespace team-a remain",
+		},
+		{
+			name:    "disk exceeded with other nodes",
+			quota:   namespaceQuota{DiskMB: 40},
+			spec:    captureSpec{MaxFiles: 1, RotateMB: 5},
+			remote:  namespaceUsage{Bytes: 1},
+			wantMsg: "only 4 MB of the 40 MB quota",
+		},
+		{
+			name:    "disk exhausted",
+			quota:   namespaceQuota{DiskMB: 30},
+			spec:    captureSpec{MaxFiles: 1, RotateMB: 1},
+			wantMsg: "only 0 MB of the 30 MB quota",
+		},
+		{name: "streams take no disk", quota: namespaceQuota{DiskMB: 30}, spec: captureSpec{MaxFiles: 1, RotateMB: 1, Output: outputStream}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManager(t)
+			running := addRetainedFile(t, tm, "team-a", "web", "s1", 7*int(bytesPerMB))
+			addRetainedFile(t, tm, "team-a", "web", "s0", 5*int(bytesPerMB))
+			addRetainedFile(t, tm, "team-b", "db", "s0", 50*int(bytesPerMB))
+			addQuotaCapture(t, tm, "team-a/web", "team-a", 10, false, running)
+			addQuotaCapture(t, tm, "team-a/api", "team-a", 20, true, "")
+			addQuotaCapture(t, tm, "team-b/db", "team-b", 30, false, "")
+
+			spec := tt.spec
+			spec.Namespace = "team-a"
+			tm.mu.Lock()
+			reason, msg, wait := tm.checkNamespaceQuota(&tt.quota, spec, tt.remote)
+			tm.mu.Unlock()
+			if tt.wantMsg != "" {
+				if reason != reasonNamespaceQuotaExceeded || !strings.Contains(msg, tt.wantMsg) {
+					t.Errorf("checkNamespaceQuota = %q, %q, want %s and %q", reason, msg, reasonNamespaceQuotaExceeded, tt.wantMsg)
+				}
+			} else if reason != "" {
+				t.Errorf("checkNamespaceQuota refused the capture: %s", msg)
+			}
+			if wait != tt.wantWait {
+				t.Errorf("checkNamespaceQuota wait = %v, want %v", wait, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestNamespaceUsagesCachesRetainedFiles(t *testing.T) {
+	tm := newTestManager(t)
+	addRetainedFile(t, tm, "team-a", "web", "s0", 1000)
+	usages := func() map[string]namespaceUsage {
+		tm.mu.Lock()
+		defer tm.mu.Unlock()
+		return tm.namespaceUsages()
+	}
+	if got, want := usages()["team-a"], (namespaceUsage{Bytes: 1000}); got != want {
+		t.Fatalf("usage = %+v, want %+v", got, want)
+	}
+
+	// Files are sized again only once the cache expires.
+	addRetainedFile(t, tm, "team-a", "web", "s1", 500)
+	addQuotaCapture(t, tm, "team-a/web", "team-a", 1, false, "")
+	if got, want := usages()["team-a"], (namespaceUsage{Captures: 1, Bytes: 1000 + bytesPerMB}); got != want {
+		t.Fatalf("usage = %+v, want %+v from the cached file sizes", got, want)
+	}
+	tm.mu.Lock()
+	tm.retainedAt = time.Now().Add(-retainedSizeTTL)
+	tm.mu.Unlock()
+	if got, want := usages()["team-a"], (namespaceUsage{Captures: 1, Bytes: 1500 + bytesPerMB}); got != want {
+		t.Fatalf("usage after the cache expired = %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// writeRateAnnotationKey caps the bytes per second a capture writes to
+// disk, in MB.
+const writeRateAnnotationKey = "write-rate." + annotationKey
+
+// minWriteBurst lets a rate limiter admit the largest packet a capture can
+// keep, however low its rate.
+const minWriteBurst = 262144
+
+// parseWriteRate parses a write rate in MB per second.
+func parseWriteRate(v string) (float64, error) {
+	mb, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+	if err != nil || mb <= 0 {
+		return 0, fmt.Errorf("write rate must be a positive number of MB per second, got %q", v)
+	}
+	return mb, nil
+}
+
+// limitWriteRate lowers the write rate of the capture to max, the
+// maxWriteRateMB setting, unless it is lower already; 0 is no limit.
+func (s *captureSpec) limitWriteRate(max float64) {
+	if max > 0 && (s.WriteRateMB == 0 || s.WriteRateMB > max) {
+		s.WriteRateMB = max
+	}
+}
+
+// writeLimiter is a token bucket shared by the ring writers of a capture,
+// so a capture of several interfaces stays within one rate. It holds a
+// second's worth of bytes, letting short bursts through whole. Its rate can
+// change while the capture runs.
+type writeLimiter struct {
+	limiter atomic.Pointer[rate.Limiter]
+}
+
+// newWriteLimiter returns a limiter for mb MB per second; 0 is no limit.
+func newWriteLimiter(mb float64) *writeLimiter {
+	l := &writeLimiter{}
+	l.set(mb)
+	return l
+}
+
+// set changes the rate to mb MB per second; 0 lifts the limit.
+func (l *writeLimiter) set(mb float64) {
+	if mb <= 0 {
+		l.limiter.Store(nil)
+		return
+	}
+	bytes := mb * bytesPerMB
+	l.limiter.Store(rate.NewLimiter(rate.Limit(bytes), max(int(bytes), minWriteBurst)))
+}
+
+// allow reports whether a packet of n bytes may be written now. Packets
+// over the rate are dropped rather than delayed: holding them back would
+// only move the drops into the kernel, where they cannot be told apart
+// from packets the capture was too slow for.
+func (l *writeLimiter) allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	limiter := l.limiter.Load()
+	return limiter == nil || limiter.AllowN(time.Now(), n)
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// replayAnnotationKey asks for a stored capture file to be sent out of an
+// interface of the Pod, or of the Node, as comma separated key=value
+// pairs, e.g. "file=capture-web.pcap0,speed=2,loop=3". "stop" ends a
+// running replay. The agent removes it once seen.
+const replayAnnotationKey = "replay." + annotationKey
+
+// replayStop is the replay annotation value that ends a running replay.
+const replayStop = "stop"
+
+// Event reasons of replays.
+const (
+	reasonReplayStarted  = "ReplayStarted"
+	reasonReplayFinished = "ReplayFinished"
+	reasonReplayFailed   = "ReplayFailed"
+)
+
+// replaySpec is a parsed replay annotation.
+type replaySpec struct {
+	// File is relative to the capture directory, e.g. a capture file or
+	// snapshots/<name>/<file>.
+	File      string
+	Interface string
+	// Speed scales the recorded gaps between packets, 0 sends as fast as
+	// possible; PPS and Mbps send at a fixed rate instead.
+	Speed float64
+	PPS   int
+	Mbps  float64
+	Loop  int
+	// DstMAC addresses packets recorded without an Ethernet header.
+	DstMAC net.HardwareAddr
+}
+
+// parseReplay parses the replay annotation value v. defaultIface is used
+// when it names no interface.
+func parseReplay(v, defaultIface string) (*replaySpec, error) {
+	r := &replaySpec{Interface: defaultIface, Speed: 1, Loop: 1}
+	for _, part := range strings.Split(v, ",") {
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("expected key=value pairs, got %q", part)
+		}
+		var err error
+		switch key {
+		case "file":
+			if !filepath.IsLocal(val) {
+				return nil, fmt.Errorf("file %q must be relative to the capture directory", val)
+			}
+			r.File = val
+		case "interface":
+			r.Interface = val
+		case "speed":
+			if val == "max" {
+				r.Speed = 0
+			} else if r.Speed, err = strconv.ParseFloat(val, 64); err != nil || r.Speed <= 0 {
+				return nil, fmt.Errorf(`speed must be a positive multiplier or "max", got %q`, val)
+			}
+		case "pps":
+			if r.PPS, err = strconv.Atoi(val); err != nil || r.PPS <= 0 {
+				return nil, fmt.Errorf("pps must be a positive integer, got %q", val)
+			}
+		case "mbps":
+			if r.Mbps, err = strconv.ParseFloat(val, 64); err != nil || r.Mbps <= 0 {
+				return nil, fmt.Errorf("mbps must be positive, got %q", val)
+			}
+		case "loop":
+			if r.Loop, err = strconv.Atoi(val); err != nil || r.Loop <= 0 {
+				return nil, fmt.Errorf("loop must be a positive integer, got %q", val)
+			}
+		case "dmac":
+			if r.DstMAC, err = net.ParseMAC(val); err != nil {
+				return nil, fmt.Errorf("invalid dmac %q", val)
+			}
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	switch {
+	case r.File == "":
+		return nil, errors.New("no file given")
+	case r.Interface == "":
+		return nil, errors.New("no interface given")
+	case r.PPS > 0 && r.Mbps > 0:
+		return nil, errors.New("pps and mbps cannot be combined")
+	}
+	return r, nil
+}
+
+// requestReplay handles the replay annotation v of the Pod or Node ref. pid
+// is a process in the target network namespace, 0 for the node's own. The
+// annotation is removed first, so resyncs do not replay again; the replay
+// runs in the background.
+func (m *CaptureManager) requestReplay(ref *corev1.ObjectReference, key, v, defaultIface string, pid func() (int, error)) {
+	if err := m.removeAnnotation(ref, replayAnnotationKey); err != nil {
+		slog.Error("Failed to remove replay annotation", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name, "err", err)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if strings.TrimSpace(v) == replayStop {
+		if cancel, ok := m.replays[key]; ok {
+			cancel()
+		}
+		return
+	}
+	if _, running := m.replays[key]; running {
+		m.recorder.Event(ref, corev1.EventTypeWarning, reasonReplayFailed, "A replay is already running; stop it first")
+		return
+	}
+	spec, err := parseReplay(v, defaultIface)
+	if err != nil {
+		m.recorder.Eventf(ref, corev1.EventTypeWarning, reasonReplayFailed, "Invalid %s annotation value %q: %v", replayAnnotationKey, v, err)
+		return
+	}
+	target, err := pid()
+	if err != nil {
+		m.recorder.Eventf(ref, corev1.EventTypeWarning, reasonReplayFailed, "Cannot replay: %v", err)
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m.replays[key] = cancel
+	log := slog.With("kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name, "file", spec.File, "interface", spec.Interface)
+	log.Info("Starting replay")
+	m.recorder.Eventf(ref, corev1.EventTypeNormal, reasonReplayStarted, "Replaying %s on %s", spec.File, spec.Interface)
+	go func() {
+		defer func() {
+			m.mu.Lock()
+			delete(m.replays, key)
+			m.mu.Unlock()
+			cancel()
+		}()
+		start := time.Now()
+		stats, err := m.replay(ctx, spec, target)
+		replayedPackets.Add(float64(stats.packets))
+		if err != nil && !errors.Is(err, context.Canceled) {
+			log.Warn("Replay failed", "packets", stats.packets, "err", err)
+			m.recorder.Eventf(ref, corev1.EventTypeWarning, reasonReplayFailed, "Replay of %s failed after %d packets: %v", spec.File, stats.packets, err)
+			return
+		}
+		how := "finished"
+		if err != nil {
+			how = "stopped"
+		}
+		log.Info("Replay "+how, "packets", stats.packets, "bytes", stats.bytes, "skipped", stats.skipped)
+		m.recorder.Eventf(ref, corev1.EventTypeNormal, reasonReplayFinished, "Replay of %s %s: %d packets, %d bytes in %s, %d skipped",
+			spec.File, how, stats.packets, stats.bytes, time.Since(start).Round(time.Millisecond), stats.skipped)
+	}()
+}
+
+// stopReplays ends every running replay. Callers must hold m.mu.
+func (m *CaptureManager) stopReplays() {
+	for _, cancel := range m.replays {
+		cancel()
+	}
+}
+
+type replayStats struct {
+	packets, bytes, skipped int
+}
+
+// replay sends the packets of spec.File out of spec.Interface in the
+// network namespace of pid, or of the node for 0, spec.Loop times.
+func (m *CaptureManager) replay(ctx context.Context, spec *replaySpec, pid int) (replayStats, error) {
+	var stats replayStats
+	path := filepath.Join(m.cfg.CaptureDir, spec.File)
+	if p, _, ok := m.captureFilePath(spec.File); ok {
+		// A Pod capture file given by name, as the status lists it.
+		path = p
+	}
+	if _, err := os.Stat(path); err != nil {
+		return stats, err
+	}
+	sock, iface, err := openInjectionSocket(pid, spec.Interface)
+	if err != nil {
+		return stats, err
+	}
+	defer sock.Close()
+	dst := spec.DstMAC
+	start := time.Now()
+	for i := 0; i < spec.Loop; i++ {
+		err := readCaptureFile(path, m.fileKey, func(ci gopacket.CaptureInfo, linkType layers.LinkType, data []byte, first time.Time) error {
+			if linkType != layers.LinkTypeEthernet {
+				if dst == nil {
+					mac, err := gatewayMAC(pid, spec.Interface)
+					if err != nil {
+						return fmt.Errorf("packets have no Ethernet header and %w; set dmac", err)
+					}
+					dst = mac
+				}
+				if data = toEthernet(linkType, data, iface.HardwareAddr, dst); data == nil {
+					stats.skipped++
+					return nil
+				}
+			}
+			var at time.Duration
+			switch {
+			case spec.PPS > 0:
+				at = time.Duration(stats.packets) * time.Second / time.Duration(spec.PPS)
+			case spec.Mbps > 0:
+				at = time.Duration(float64(stats.bytes*8) / (spec.Mbps * 1e6) * float64(time.Second))
+			case spec.Speed > 0:
+				at = time.Duration(float64(ci.Timestamp.Sub(first)) / spec.Speed)
+			}
+			if wait := time.Until(start.Add(at)); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(wait):
+				}
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			sent, err := sock.send(data)
+			if err != nil {
+				return err
+			}
+			if !sent {
+				stats.skipped++
+				return nil
+			}
+			stats.packets++
+			stats.bytes += len(data)
+			return nil
+		})
+		if err != nil {
+			return stats, err
+		}
+		// The next loop continues after the last packet sent.
+		if spec.Speed > 0 && spec.PPS == 0 && spec.Mbps == 0 {
+			start = time.Now()
+		}
+	}
+	return stats, nil
+}
+
+// readCaptureFile calls fn with every packet of the pcapng or pcap file
+// path, compressed or encrypted with key or not, and the time of its first
+// packet.
+func readCaptureFile(path string, key *fileKey, fn func(ci gopacket.CaptureInfo, linkType layers.LinkType, data []byte, first time.Time) error) error {
+	in, err := openCaptureFile(path, key)
+	if err != nil {
+		return err
+	}
+	defer func() { in.Close() }()
+	br := bufio.NewReader(in)
+	type packetReader interface {
+		ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	}
+	var r packetReader
+	var linkType layers.LinkType
+	if ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions); err == nil {
+		r, linkType = ng, ng.LinkType()
+	} else {
+		// NewNgReader consumed the header; start over for classic pcap.
+		in.Close()
+		if in, err = openCaptureFile(path, key); err != nil {
+			return err
+		}
+		pr, err := pcapgo.NewReader(in)
+		if err != nil {
+			return fmt.Errorf("%s is neither pcapng nor pcap", filepath.Base(path))
+		}
+		r, linkType = pr, pr.LinkType()
+	}
+	var first time.Time
+	for {
+		data, ci, err := r.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if first.IsZero() {
+			first = ci.Timestamp
+		}
+		if err := fn(ci, linkType, data, first); err != nil {
+			return err
+		}
+	}
+}
+
+// toEthernet replaces the Linux cooked header of data with an Ethernet
+// header from src to dst. It returns nil for other link types.
+func toEthernet(linkType layers.LinkType, data []byte, src, dst net.HardwareAddr) []byte {
+	const sllHeader = 16
+	if linkType != layers.LinkTypeLinuxSLL || len(data) < sllHeader {
+		return nil
+	}
+	frame := make([]byte, 0, 14+len(data)-sllHeader)
+	frame = append(frame, dst...)
+	frame = append(frame, src...)
+	// The protocol is the last field of the cooked header.
+	frame = append(frame, data[14:16]...)
+	return append(frame, data[sllHeader:]...)
+}
+
+// gatewayMAC returns the MAC address of the default gateway of ifName in
+// the network namespace of pid, or of the node for 0, from its route and
+// neighbor tables.
+func gatewayMAC(pid int, ifName string) (net.HardwareAddr, error) {
+	proc := "/proc/self"
+	if pid != 0 {
+		proc = filepath.Join("/proc", strconv.Itoa(pid))
+	}
+	routes, err := os.ReadFile(filepath.Join(proc, "net", "route"))
+	if err != nil {
+		return nil, err
+	}
+	var gateway net.IP
+	for _, line := range strings.Split(string(routes), "\n")[1:] {
+		// Iface Destination Gateway ...
+		f := strings.Fields(line)
+		if len(f) < 3 || f[0] != ifName || f[1] != "00000000" {
+			continue
+		}
+		if gw, err := strconv.ParseUint(f[2], 16, 32); err == nil {
+			gateway = make(net.IP, 4)
+			binary.LittleEndian.PutUint32(gateway, uint32(gw))
+		}
+	}
+	if gateway == nil {
+		return nil, fmt.Errorf("%s has no default gateway", ifName)
+	}
+	arp, err := os.ReadFile(filepath.Join(proc, "net", "arp"))
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(arp), "\n")[1:] {
+		// IP address HW type Flags HW address Mask Device
+		f := strings.Fields(line)
+		if len(f) >= 6 && f[5] == ifName && net.ParseIP(f[0]).Equal(gateway) {
+			return net.ParseMAC(f[3])
+		}
+	}
+	return nil, fmt.Errorf("the MAC address of gateway %s is not resolved", gateway)
+}
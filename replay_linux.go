@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// injectionSocket is an AF_PACKET socket replays send frames through.
+type injectionSocket struct {
+	fd int
+}
+
+// send sends frame. It reports false for frames too large for the
+// interface, which are skipped rather than failing the replay.
+func (s *injectionSocket) send(frame []byte) (bool, error) {
+	if _, err := unix.Write(s.fd, frame); err != nil {
+		// Packets recorded after GRO or GSO may exceed the MTU.
+		if errors.Is(err, unix.EMSGSIZE) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *injectionSocket) Close() error { return unix.Close(s.fd) }
+
+// openInjectionSocket opens an AF_PACKET socket bound to ifName in the
+// network namespace of pid, or of the node for 0. A socket stays in the
+// namespace it was created in, so only its creation needs the namespace.
+func openInjectionSocket(pid int, ifName string) (*injectionSocket, *net.Interface, error) {
+	type result struct {
+		fd    int
+		iface *net.Interface
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		if pid != 0 {
+			// The thread is never unlocked, so it exits with the
+			// goroutine instead of going back to the scheduler in the
+			// Pod's namespace.
+			runtime.LockOSThread()
+			ns, err := os.Open(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"))
+			if err != nil {
+				ch <- result{err: err}
+				return
+			}
+			defer ns.Close()
+			if err := unix.Setns(int(ns.Fd()), unix.CLONE_NEWNET); err != nil {
+				ch <- result{err: fmt.Errorf("cannot enter network namespace of pid %d: %w", pid, err)}
+				return
+			}
+		}
+		iface, err := net.InterfaceByName(ifName)
+		if err != nil {
+			ch <- result{err: err}
+			return
+		}
+		fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+		if err != nil {
+			ch <- result{err: fmt.Errorf("cannot open packet socket: %w", err)}
+			return
+		}
+		if err := unix.Bind(fd, &unix.SockaddrLinklayer{Ifindex: iface.Index}); err != nil {
+			unix.Close(fd)
+			ch <- result{err: fmt.Errorf("cannot bind packet socket: %w", err)}
+			return
+		}
+		ch <- result{fd: fd, iface: iface}
+	}()
+	r := <-ch
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	return &injectionSocket{fd: r.fd}, r.iface, nil
+}
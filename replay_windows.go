@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// injectionSocket is not available on Windows, which has no packet
+// sockets to send frames through.
+type injectionSocket struct{}
+
+func (s *injectionSocket) send(frame []byte) (bool, error) { return false, errNoReplay }
+
+func (s *injectionSocket) Close() error { return nil }
+
+var errNoReplay = errors.New("replays are not supported on Windows nodes")
+
+func openInjectionSocket(pid int, ifName string) (*injectionSocket, *net.Interface, error) {
+	return nil, nil, errNoReplay
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	// reportSuffix and reportHTMLSuffix name the analysis report of a
+	// stopped capture after its base file name.
+	reportSuffix     = ".report.json"
+	reportHTMLSuffix = ".report.html"
+	// reportTop is how many entries the ranked lists of a report keep.
+	reportTop = 10
+	// reportMaxFlows bounds the TCP flows a report tracks, so a scan or
+	// flood cannot exhaust the agent's memory.
+	reportMaxFlows = 100000
+	// reportSettle is how long the report waits for compressions of the
+	// last files to finish.
+	reportSettle = 30 * time.Second
+)
+
+// captureReport summarizes a stopped capture, so many investigations can
+// end without opening the files in Wireshark.
+type captureReport struct {
+	Namespace   string          `json:"namespace,omitempty"`
+	Pod         string          `json:"pod,omitempty"`
+	Node        string          `json:"node"`
+	SessionID   string          `json:"sessionID"`
+	GeneratedAt time.Time       `json:"generatedAt"`
+	Files       []string        `json:"files"`
+	Packets     int             `json:"packets"`
+	Bytes       int64           `json:"bytes"`
+	FirstPacket *time.Time      `json:"firstPacket,omitempty"`
+	LastPacket  *time.Time      `json:"lastPacket,omitempty"`
+	Protocols   []protocolCount `json:"protocols"`
+	TopTalkers  []conversation  `json:"topTalkers"`
+	TCP         tcpReport       `json:"tcp"`
+	DNS         dnsReport       `json:"dns"`
+	Errors      []string        `json:"errors,omitempty"`
+}
+
+type protocolCount struct {
+	Name    string `json:"name"`
+	Packets int    `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// conversation counts the traffic between two addresses in both
+// directions.
+type conversation struct {
+	A       string `json:"a"`
+	B       string `json:"b"`
+	Packets int    `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type tcpReport struct {
+	// Connections counts connection attempts, i.e. SYNs without ACK.
+	Connections     int         `json:"connections"`
+	Retransmissions int         `json:"retransmissions"`
+	Resets          int         `json:"resets"`
+	TopRetransmits  []flowCount `json:"topRetransmissions,omitempty"`
+	TopResets       []flowCount `json:"topResets,omitempty"`
+}
+
+// flowCount counts events of one direction of a TCP connection.
+type flowCount struct {
+	Flow  string `json:"flow"`
+	Count int    `json:"count"`
+}
+
+type dnsReport struct {
+	Queries   int        `json:"queries"`
+	Responses int        `json:"responses"`
+	Failures  int        `json:"failures"`
+	TopFailed []dnsError `json:"topFailures,omitempty"`
+}
+
+// dnsError counts failed answers for a name with one response code.
+type dnsError struct {
+	Name  string `json:"name"`
+	Code  string `json:"code"`
+	Count int    `json:"count"`
+}
+
+type flowKey struct {
+	src, dst     string
+	sport, dport uint16
+}
+
+func (k flowKey) String() string {
+	return net.JoinHostPort(k.src, fmt.Sprint(k.sport)) + " > " + net.JoinHostPort(k.dst, fmt.Sprint(k.dport))
+}
+
+// flow tracks one direction of a TCP connection.
+type flow struct {
+	// end is the highest sequence number sent so far, plus one.
+	end             uint32
+	seen            bool
+	retransmissions int
+	resets          int
+}
+
+// reportBuilder accumulates a report packet by packet.
+type reportBuilder struct {
+	report        *captureReport
+	protocols     map[string]*protocolCount
+	conversations map[[2]string]*conversation
+	flows         map[flowKey]*flow
+	dnsFailures   map[[2]string]int
+	// key decrypts encrypted files.
+	key *fileKey
+}
+
+func newReportBuilder(spec captureSpec) *reportBuilder {
+	return &reportBuilder{
+		key: spec.Encrypt,
+		report: &captureReport{
+			Namespace: spec.Namespace,
+			Pod:       spec.PodName,
+			Node:      spec.Node,
+			SessionID: spec.SessionID,
+		},
+		protocols:     make(map[string]*protocolCount),
+		conversations: make(map[[2]string]*conversation),
+		flows:         make(map[flowKey]*flow),
+		dnsFailures:   make(map[[2]string]int),
+	}
+}
+
+// addFile reads the pcapng file f, compressed or encrypted or not, into the
+// report.
+func (b *reportBuilder) addFile(f string) error {
+	in, err := openCaptureFile(f, b.key)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	ng, err := pcapgo.NewNgReader(in, pcapgo.DefaultNgReaderOptions)
+	if err != nil {
+		return err
+	}
+	b.report.Files = append(b.report.Files, filepath.Base(f))
+	for {
+		data, ci, err := ng.ReadPacketData()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		b.addPacket(ci, gopacket.NewPacket(data, ng.LinkType(), gopacket.DecodeOptions{Lazy: true, NoCopy: true}))
+	}
+}
+
+func (b *reportBuilder) addPacket(ci gopacket.CaptureInfo, pkt gopacket.Packet) {
+	r := b.report
+	size := int64(ci.Length)
+	r.Packets++
+	r.Bytes += size
+	ts := ci.Timestamp.UTC()
+	if r.FirstPacket == nil || ts.Before(*r.FirstPacket) {
+		r.FirstPacket = &ts
+	}
+	if r.LastPacket == nil || ts.After(*r.LastPacket) {
+		r.LastPacket = &ts
+	}
+
+	name := "Other"
+	var src, dst string
+	switch l := pkt.NetworkLayer().(type) {
+	case *layers.IPv4:
+		name, src, dst = "IPv4", l.SrcIP.String(), l.DstIP.String()
+	case *layers.IPv6:
+		name, src, dst = "IPv6", l.SrcIP.String(), l.DstIP.String()
+	default:
+		if pkt.Layer(layers.LayerTypeARP) != nil {
+			name = "ARP"
+		}
+	}
+	switch l := pkt.TransportLayer().(type) {
+	case *layers.TCP:
+		name = "TCP"
+		b.addTCP(flowKey{src, dst, uint16(l.SrcPort), uint16(l.DstPort)}, l)
+	case *layers.UDP:
+		name = "UDP"
+	case *layers.SCTP:
+		name = "SCTP"
+	}
+	switch {
+	case pkt.Layer(layers.LayerTypeICMPv4) != nil:
+		name = "ICMP"
+	case pkt.Layer(layers.LayerTypeICMPv6) != nil:
+		name = "ICMPv6"
+	}
+	if dns, ok := pkt.Layer(layers.LayerTypeDNS).(*layers.DNS); ok {
+		name = "DNS"
+		b.addDNS(dns)
+	} else if pkt.Layer(layers.LayerTypeTLS) != nil {
+		name = "TLS"
+	}
+
+	p := b.protocols[name]
+	if p == nil {
+		p = &protocolCount{Name: name}
+		b.protocols[name] = p
+	}
+	p.Packets++
+	p.Bytes += size
+
+	if src != "" {
+		pair := [2]string{src, dst}
+		if dst < src {
+			pair = [2]string{dst, src}
+		}
+		c := b.conversations[pair]
+		if c == nil {
+			c = &conversation{A: pair[0], B: pair[1]}
+			b.conversations[pair] = c
+		}
+		c.Packets++
+		c.Bytes += size
+	}
+}
+
+// addTCP counts connection attempts, resets and retransmissions. A segment
+// is a retransmission when it carries no sequence number beyond the
+// highest one the direction has sent.
+func (b *reportBuilder) addTCP(k flowKey, t *layers.TCP) {
+	tcp := &b.report.TCP
+	if t.SYN && !t.ACK {
+		tcp.Connections++
+	}
+	f := b.flows[k]
+	if f == nil {
+		if len(b.flows) >= reportMaxFlows {
+			return
+		}
+		f = &flow{}
+		b.flows[k] = f
+	}
+	if t.RST {
+		tcp.Resets++
+		f.resets++
+		return
+	}
+	n := uint32(len(t.Payload))
+	if t.SYN || t.FIN {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	end := t.Seq + n
+	if f.seen && int32(end-f.end) <= 0 {
+		tcp.Retransmissions++
+		f.retransmissions++
+		return
+	}
+	f.end, f.seen = end, true
+}
+
+func (b *reportBuilder) addDNS(d *layers.DNS) {
+	dns := &b.report.DNS
+	if !d.QR {
+		dns.Queries++
+		return
+	}
+	dns.Responses++
+	if d.ResponseCode == layers.DNSResponseCodeNoErr {
+		return
+	}
+	dns.Failures++
+	name := ""
+	if len(d.Questions) > 0 {
+		name = string(d.Questions[0].Name)
+	}
+	b.dnsFailures[[2]string{name, d.ResponseCode.String()}]++
+}
+
+// finish ranks the counters into the report.
+func (b *reportBuilder) finish() *captureReport {
+	r := b.report
+	r.GeneratedAt = time.Now().UTC()
+	r.Protocols = make([]protocolCount, 0, len(b.protocols))
+	for _, p := range b.protocols {
+		r.Protocols = append(r.Protocols, *p)
+	}
+	sort.Slice(r.Protocols, func(i, j int) bool { return r.Protocols[i].Bytes > r.Protocols[j].Bytes })
+	r.TopTalkers = make([]conversation, 0, len(b.conversations))
+	for _, c := range b.conversations {
+		r.TopTalkers = append(r.TopTalkers, *c)
+	}
+	sort.Slice(r.TopTalkers, func(i, j int) bool { return r.TopTalkers[i].Bytes > r.TopTalkers[j].Bytes })
+	r.TopTalkers = r.TopTalkers[:min(len(r.TopTalkers), reportTop)]
+
+	var retransmits, resets []flowCount
+	for k, f := range b.flows {
+		if f.retransmissions > 0 {
+			retransmits = append(retransmits, flowCount{Flow: k.String(), Count: f.retransmissions})
+		}
+		if f.resets > 0 {
+			resets = append(resets, flowCount{Flow: k.String(), Count: f.resets})
+		}
+	}
+	r.TCP.TopRetransmits = topFlows(retransmits)
+	r.TCP.TopResets = topFlows(resets)
+
+	for k, n := range b.dnsFailures {
+		r.DNS.TopFailed = append(r.DNS.TopFailed, dnsError{Name: k[0], Code: k[1], Count: n})
+	}
+	sort.Slice(r.DNS.TopFailed, func(i, j int) bool {
+		a, b := r.DNS.TopFailed[i], r.DNS.TopFailed[j]
+		return a.Count > b.Count || a.Count == b.Count && a.Name < b.Name
+	})
+	r.DNS.TopFailed = r.DNS.TopFailed[:min(len(r.DNS.TopFailed), reportTop)]
+	return r
+}
+
+func topFlows(flows []flowCount) []flowCount {
+	sort.Slice(flows, func(i, j int) bool {
+		return flows[i].Count > flows[j].Count || flows[i].Count == flows[j].Count && flows[i].Flow < flows[j].Flow
+	})
+	return flows[:min(len(flows), reportTop)]
+}
+
+// reportFiles returns the files the session of cap wrote, in order, once
+// their compression has finished or reportSettle has passed.
+func reportFiles(cap *CaptureProcess) []string {
+	for deadline := time.Now().Add(reportSettle); time.Now().Before(deadline); time.Sleep(time.Second) {
+		pending := false
+		for _, pattern := range cap.files {
+			if raw, _ := filepath.Glob(pattern + "*" + compressSuffix); len(raw) > 0 {
+				pending = true
+			}
+		}
+		if !pending {
+			break
+		}
+	}
+	type entry struct {
+		name  string
+		first time.Time
+	}
+	var files []entry
+	for name, e := range packetWindows(cap) {
+		for _, pattern := range cap.files {
+			f := filepath.Join(filepath.Dir(pattern), name)
+			if _, err := os.Stat(f); err == nil {
+				files = append(files, entry{f, e.FirstPacket})
+				break
+			}
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].first.Before(files[j].first) })
+	out := make([]string, len(files))
+	for i, f := range files {
+		out[i] = f.name
+	}
+	return out
+}
+
+// postProcess runs the analyses of the stopped capture cap over its files:
+// the analysis report and the IDS analyzer, as configured. The status st
+// the capture stopped with is written again with their results, unless
+// the capture has started again in the meantime, and returned. Captures
+// are processed one at a time.
+func (m *CaptureManager) postProcess(key string, cap *CaptureProcess, st captureStatus) captureStatus {
+	m.postProcessMu.Lock()
+	defer m.postProcessMu.Unlock()
+
+	files := reportFiles(cap)
+	if len(files) == 0 {
+		return st
+	}
+	var report *captureReport
+	if m.cfg.AnalysisReports {
+		report = writeReport(cap, files)
+	}
+	var alerts *alertSummary
+	if m.cfg.Analyzer != "" {
+		alerts = m.analyze(cap, files)
+	}
+	if report != nil {
+		m.exporter.add(cap.files[0] + reportSuffix)
+		m.exporter.add(cap.files[0] + reportHTMLSuffix)
+	}
+	if alerts != nil {
+		m.exporter.add(cap.files[0] + alertsSuffix)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if c, ok := m.captures[key]; ok && c != cap {
+		return st
+	}
+	if report != nil {
+		st.Report = filepath.Base(cap.files[0] + reportSuffix)
+		m.recorder.Eventf(cap.ref, corev1.EventTypeNormal, reasonReportReady,
+			"Analysis report %s: %d packets, %d retransmissions, %d resets, %d DNS failures",
+			st.Report, report.Packets, report.TCP.Retransmissions, report.TCP.Resets, report.DNS.Failures)
+	}
+	if alerts != nil {
+		st.Alerts = alerts
+		if alerts.Count > 0 {
+			m.recorder.Eventf(cap.ref, corev1.EventTypeWarning, reasonIDSAlerts,
+				"%s raised %d alerts, see %s", alerts.Analyzer, alerts.Count, alerts.File)
+		}
+	}
+	if report != nil || alerts != nil {
+		m.patchStatus(cap.ref, st)
+	}
+	return st
+}
+
+// postProcessing reports whether stopped captures are analyzed at all.
+func (m *CaptureManager) postProcessing() bool {
+	return m.cfg.AnalysisReports || m.cfg.Analyzer != ""
+}
+
+// writeReport summarizes files of the stopped capture cap into the report
+// next to them. It returns nil if the report could not be written.
+func writeReport(cap *CaptureProcess, files []string) *captureReport {
+	b := newReportBuilder(cap.spec)
+	for _, f := range files {
+		if err := b.addFile(f); err != nil {
+			b.report.Errors = append(b.report.Errors, fmt.Sprintf("%s: %v", filepath.Base(f), err))
+		}
+	}
+	report := b.finish()
+	base := cap.files[0]
+	if err := writeFileAtomic(base+reportSuffix, report); err != nil {
+		cap.log.Error("Failed to write analysis report", "err", err)
+		return nil
+	}
+	if err := writeReportHTML(base+reportHTMLSuffix, report); err != nil {
+		cap.log.Error("Failed to write analysis report", "err", err)
+	}
+	cap.log.Info("Analysis report written", "report", filepath.Base(base+reportSuffix), "packets", report.Packets)
+	return report
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Capture report {{.SessionID}}</title>
+<style>body{font-family:sans-serif;margin:2em}table{border-collapse:collapse;margin-bottom:1.5em}td,th{border:1px solid #ccc;padding:4px 8px;text-align:left}</style>
+</head><body>
+<h1>{{if .Pod}}{{.Namespace}}/{{.Pod}}{{else}}Node {{.Node}}{{end}}</h1>
+<p>Session {{.SessionID}} on {{.Node}}: {{.Packets}} packets, {{.Bytes}} bytes{{if .FirstPacket}}, {{.FirstPacket.Format "2006-01-02 15:04:05"}} to {{.LastPacket.Format "2006-01-02 15:04:05"}} UTC{{end}}.</p>
+<h2>Protocols</h2>
+<table><tr><th>Protocol</th><th>Packets</th><th>Bytes</th></tr>
+{{range .Protocols}}<tr><td>{{.Name}}</td><td>{{.Packets}}</td><td>{{.Bytes}}</td></tr>
+{{end}}</table>
+<h2>Top talkers</h2>
+<table><tr><th>Address</th><th>Address</th><th>Packets</th><th>Bytes</th></tr>
+{{range .TopTalkers}}<tr><td>{{.A}}</td><td>{{.B}}</td><td>{{.Packets}}</td><td>{{.Bytes}}</td></tr>
+{{end}}</table>
+<h2>TCP</h2>
+<p>{{.TCP.Connections}} connection attempts, {{.TCP.Retransmissions}} retransmissions, {{.TCP.Resets}} resets.</p>
+{{if .TCP.TopRetransmits}}<table><tr><th>Flow</th><th>Retransmissions</th></tr>
+{{range .TCP.TopRetransmits}}<tr><td>{{.Flow}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>{{end}}
+{{if .TCP.TopResets}}<table><tr><th>Flow</th><th>Resets</th></tr>
+{{range .TCP.TopResets}}<tr><td>{{.Flow}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>{{end}}
+<h2>DNS</h2>
+<p>{{.DNS.Queries}} queries, {{.DNS.Responses}} responses, {{.DNS.Failures}} failures.</p>
+{{if .DNS.TopFailed}}<table><tr><th>Name</th><th>Response code</th><th>Count</th></tr>
+{{range .DNS.TopFailed}}<tr><td>{{.Name}}</td><td>{{.Code}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>{{end}}
+{{if .Errors}}<h2>Errors</h2><ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<p>Files: {{range $i, $f := .Files}}{{if $i}}, {{end}}{{$f}}{{end}}. Generated {{.GeneratedAt.Format "2006-01-02 15:04:05"}} UTC.</p>
+</body></html>
+`))
+
+// writeReportHTML renders report to path through a temporary file.
+func writeReportHTML(path string, report *captureReport) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	if err := reportTemplate.Execute(f, report); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// requesterAnnotationKey names the user who requested a capture. The
+// admission webhook sets it, next to the capture annotation or on a
+// CaptureTarget, whenever the request changes, and keeps anyone else from
+// setting it.
+const requesterAnnotationKey = "requester." + annotationKey
+
+// requesterGroupsAnnotationKey holds the groups of the user in
+// requesterAnnotationKey as a JSON list. The webhook sets and guards it
+// together with the requester.
+const requesterGroupsAnnotationKey = "requester-groups." + annotationKey
+
+// fieldManagerPrefix marks requesters only known by the field manager that
+// wrote the request, e.g. fieldManager:kubectl-annotate.
+const fieldManagerPrefix = "fieldManager:"
+
+// captureRequester returns who requested the capture of session through
+// obj: the user recorded by the admission webhook or, without it, the field
+// manager that last wrote the capture annotation or, for custom resources,
+// the spec. It returns an empty string for captures the agent started on
+// its own.
+func captureRequester(obj metav1.Object, session string) string {
+	if v := obj.GetAnnotations()[sessionAnnotationKey(requesterAnnotationKey, session)]; v != "" {
+		return v
+	}
+	manager, _ := lastRequest(obj, session)
+	if manager == "" {
+		return ""
+	}
+	return fieldManagerPrefix + manager
+}
+
+// requesterAnnotations returns the requester annotations of session on obj,
+// keyed without the session, or nil if the webhook recorded no requester.
+func requesterAnnotations(obj metav1.Object, session string) map[string]string {
+	user := obj.GetAnnotations()[sessionAnnotationKey(requesterAnnotationKey, session)]
+	if user == "" {
+		return nil
+	}
+	return map[string]string{
+		requesterAnnotationKey:       user,
+		requesterGroupsAnnotationKey: obj.GetAnnotations()[sessionAnnotationKey(requesterGroupsAnnotationKey, session)],
+	}
+}
+
+// attributedSource reports whether captures requested through source are
+// attributed by the admission webhook, and so fall under the captureGroups
+// setting. Captures the agent starts on its own and Traceflows and
+// PacketCaptures, which Antrea authorizes, are not.
+func attributedSource(source metav1.Object) bool {
+	switch s := source.(type) {
+	case *triggeredCapture, *ringBuffer, *traceflow, *packetCapture:
+		return false
+	case *captureAssignment:
+		return s.Attributed
+	}
+	return true
+}
+
+// authorizeRequest checks the captureGroups setting for the capture of
+// session requested through source in ns, empty for the node. Once the
+// setting is in effect, a capture needs a requester recorded by the
+// webhook, so requests admitted while it was bypassed are refused, and one
+// of the requester's groups must be allowed ns.
+func (s *Settings) authorizeRequest(source metav1.Object, session, ns string) error {
+	if len(s.CaptureGroups) == 0 || !attributedSource(source) {
+		return nil
+	}
+	requester := requesterAnnotations(source, session)
+	if requester == nil {
+		return errors.New("the request has no requester recorded by the admission webhook, which the captureGroups setting requires")
+	}
+	var groups []string
+	if err := json.Unmarshal([]byte(requester[requesterGroupsAnnotationKey]), &groups); err != nil {
+		return fmt.Errorf("the groups of requester %s are not recorded", requester[requesterAnnotationKey])
+	}
+	if s.groupsAllowed(groups, ns) {
+		return nil
+	}
+	if ns == "" {
+		return fmt.Errorf("user %s is not in a group allowed to capture nodes", requester[requesterAnnotationKey])
+	}
+	return fmt.Errorf("user %s is not in a group allowed to capture in namespace %s", requester[requesterAnnotationKey], ns)
+}
+
+// captureRequestTime returns when the capture of session was last
+// requested through obj, or the zero time if the managed fields do not
+// tell.
+func captureRequestTime(obj metav1.Object, session string) time.Time {
+	_, at := lastRequest(obj, session)
+	return at
+}
+
+// lastRequest returns the field manager that last wrote the capture
+// annotation of session or, for custom resources, the spec of obj, and
+// when it did.
+func lastRequest(obj metav1.Object, session string) (string, time.Time) {
+	key := "f:" + sessionAnnotationKey(annotationKey, session)
+	var manager string
+	var latest metav1.Time
+	for _, e := range obj.GetManagedFields() {
+		if e.FieldsV1 == nil || (e.Time != nil && e.Time.Before(&latest)) {
+			continue
+		}
+		var fields map[string]map[string]json.RawMessage
+		if json.Unmarshal(e.FieldsV1.Raw, &fields) != nil {
+			continue
+		}
+		var annotations map[string]json.RawMessage
+		json.Unmarshal(fields["f:metadata"]["f:annotations"], &annotations)
+		_, spec := fields["f:spec"]
+		if _, ok := annotations[key]; ok || spec {
+			manager = e.Manager
+			if e.Time != nil {
+				latest = *e.Time
+			}
+		}
+	}
+	return manager, latest.Time
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestParseCaptureGroups(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    map[string]map[string]bool
+		wantErr bool
+	}{
+		{name: "empty", in: ""},
+		{name: "blank lines", in: "\n  \n"},
+		{
+			name: "groups and patterns",
+			in:   "sre: *\nteam-a-oncall: team-a-*, shared\nsystem:serviceaccounts:ops: ops\n",
+			want: map[string]map[string]bool{
+				"sre":                        {"*": true},
+				"team-a-oncall":              {"team-a-*": true, "shared": true},
+				"system:serviceaccounts:ops": {"ops": true},
+			},
+		},
+		{name: "repeated group", in: "sre: a\nsre: b", want: map[string]map[string]bool{"sre": {"a": true, "b": true}}},
+		{name: "no colon", in: "sre", wantErr: true},
+		{name: "no group", in: ": default", wantErr: true},
+		{name: "invalid pattern", in: "sre: [", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCaptureGroups(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseCaptureGroups(%q) error = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseCaptureGroups(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthorizeRequest(t *testing.T) {
+	groups, err := parseCaptureGroups("sre: *\nteam-a: team-a-*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Settings{CaptureGroups: groups}
+	pod := func(annotations map[string]string) *corev1.Pod {
+		return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a-web", Name: "web", Annotations: annotations}}
+	}
+	requested := func(groups string) map[string]string {
+		return map[string]string{annotationKey: "3", requesterAnnotationKey: "alice", requesterGroupsAnnotationKey: groups}
+	}
+	tests := []struct {
+		name     string
+		settings *Settings
+		source   metav1.Object
+		session  string
+		ns       string
+		want     string
+	}{
+		{"no policy", &Settings{}, pod(nil), "", "team-a-web", ""},
+		{"allowed group", s, pod(requested(`["team-a"]`)), "", "team-a-web", ""},
+		{"other namespace", s, pod(requested(`["team-a"]`)), "", "default", "not in a group allowed to capture in namespace default"},
+		{"no requester", s, pod(map[string]string{annotationKey: "3"}), "", "team-a-web", "no requester recorded"},
+		{"no groups", s, pod(map[string]string{annotationKey: "3", requesterAnnotationKey: "alice"}), "", "team-a-web", "groups of requester alice"},
+		{"requester of another session", s, pod(requested(`["sre"]`)), "debug", "team-a-web", "no requester recorded"},
+		{"named session", s, pod(map[string]string{
+			requesterAnnotationKey + "/debug":       "alice",
+			requesterGroupsAnnotationKey + "/debug": `["sre"]`,
+		}), "debug", "team-a-web", ""},
+		{"node", s, &corev1.Node{ObjectMeta: metav1.ObjectMeta{Annotations: requested(`["team-a"]`)}}, "", "", "not in a group allowed to capture nodes"},
+		{"agent's own capture", s, &triggeredCapture{}, "", "team-a-web", ""},
+		{"assignment", s, &captureAssignment{Attributed: true, ObjectMeta: metav1.ObjectMeta{Annotations: requested(`["sre"]`)}}, "", "team-a-web", ""},
+		{"unattributed assignment", s, &captureAssignment{}, "", "team-a-web", ""},
+		{"assignment without requester", s, &captureAssignment{Attributed: true}, "", "team-a-web", "no requester recorded"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.settings.authorizeRequest(tt.source, tt.session, tt.ns)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("authorizeRequest: %v", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Errorf("authorizeRequest: %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSyncPodRefusesUnattributedCapture(t *testing.T) {
+	tm := newTestManager(t)
+	s, err := parseSettings(map[string]string{settingCaptureGroups: "sre: *"}, tm.cfg.defaultSettings())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tm.currentSettings.Store(s)
+	bypassed := tm.addPod("bypassed", map[string]string{annotationKey: "3"})
+	admitted := tm.addPod("admitted", map[string]string{
+		annotationKey:                "3",
+		requesterAnnotationKey:       "alice",
+		requesterGroupsAnnotationKey: `["sre"]`,
+	})
+
+	tm.sync(bypassed)
+	tm.sync(admitted)
+
+	started := tm.backend.Started()
+	if len(started) != 1 || started[0].PodName != "admitted" || started[0].Requester != "alice" {
+		t.Fatalf("started %+v, want only the capture requested by alice", started)
+	}
+	if st := tm.status(bypassed); st.State != stateFailed || st.Reason != reasonCaptureDenied {
+		t.Errorf("status is %q with reason %q, want %q with %q", st.State, st.Reason, stateFailed, reasonCaptureDenied)
+	}
+	tm.expectEvent(corev1.EventTypeWarning, reasonCaptureDenied)
+}
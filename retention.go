@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RetentionMode controls what happens to pcap files once a capture stops.
+type RetentionMode string
+
+const (
+	// RetentionDelete removes files as soon as the capture stops.
+	RetentionDelete RetentionMode = "delete"
+	// RetentionKeep never removes files; cleanup is left to the operator.
+	RetentionKeep RetentionMode = "keep"
+	// RetentionTTL keeps files until they are older than the configured TTL.
+	RetentionTTL RetentionMode = "ttl"
+	// RetentionPodDelete keeps files until the captured Pod is deleted.
+	RetentionPodDelete RetentionMode = "pod-delete"
+)
+
+const (
+	defaultRetentionMode = RetentionPodDelete
+	defaultRetentionTTL  = 24 * time.Hour
+	janitorInterval      = time.Minute
+)
+
+// RetentionPolicy describes how long pcap files outlive their capture.
+type RetentionPolicy struct {
+	Mode RetentionMode
+	TTL  time.Duration
+}
+
+// runJanitor periodically removes expired pcap files when the TTL retention
+// mode is active. Files belonging to a running capture are never touched.
+func (m *CaptureManager) runJanitor(stopCh <-chan struct{}) {
+	if m.cfg.Retention.Mode != RetentionTTL {
+		return
+	}
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			m.expireFiles(time.Now().Add(-m.cfg.Retention.TTL))
+		}
+	}
+}
+
+// expireFiles deletes inactive capture files last modified before cutoff
+// and returns how many it deleted.
+func (m *CaptureManager) expireFiles(cutoff time.Time) int {
+	matches, err := m.listCaptureFiles()
+	if err != nil {
+		slog.Error("Janitor failed to list capture files", "dir", m.cfg.CaptureDir, "err", err)
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	removed := 0
+	for _, f := range matches {
+		if m.isActiveFile(f) {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		m.removeFile(f, "expired")
+		removed++
+	}
+	m.pruneSessionDirs()
+	return removed
+}
+
+// isActiveFile reports whether f was written by a running capture, or one
+// still stopping. Callers must hold m.mu.
+func (m *CaptureManager) isActiveFile(f string) bool {
+	for _, cap := range m.fileOwners() {
+		for _, pattern := range cap.files {
+			if strings.HasPrefix(f, pattern) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// deleteFiles removes every file written for the given pcap path, including
+// rotated ones like capture-pod.pcap0, .pcap1, etc., auditing them with
+// reason.
+func (m *CaptureManager) deleteFiles(pcapPath, reason string) {
+	matches, _ := filepath.Glob(pcapPath + "*")
+	for _, f := range matches {
+		m.removeFile(f, reason)
+	}
+}
+
+// removeFile removes the capture file f, auditing it with reason.
+func (m *CaptureManager) removeFile(f, reason string) {
+	m.auditFiles(auditDelete, "", "", reason, f)
+	if err := os.Remove(f); err != nil {
+		slog.Error("Failed to delete file", "file", f, "err", err)
+	} else {
+		slog.Info("Deleted file", "file", f)
+		filesDeleted.Inc()
+	}
+}
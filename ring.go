@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strconv"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// ringBuffer is the capture source of a Pod matching --ring-selector. Its
+// capture runs for as long as the Pod does, in headers mode with small
+// files, so the recent traffic can be snapshotted after an incident.
+type ringBuffer struct {
+	metav1.ObjectMeta
+}
+
+// podRingBuffer returns the always-on capture source of pod, or nil.
+func (m *CaptureManager) podRingBuffer(pod *corev1.Pod) *ringBuffer {
+	if m.ringSelector == nil || pod.Spec.HostNetwork || !m.ringSelector.Matches(labels.Set(pod.Labels)) {
+		return nil
+	}
+	return &ringBuffer{ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name}}
+}
+
+// ringAnnotations returns the capture and option annotations of the ring.
+func (m *CaptureManager) ringAnnotations() map[string]string {
+	return map[string]string{
+		annotationKey:     strconv.Itoa(m.cfg.RingFiles),
+		modeAnnotationKey: captureModeHeaders,
+	}
+}
+
+// rotateRequest asks the ring writers of a capture to finish their current
+// file with the next packet, e.g. so a snapshot includes the packets the
+// writer still buffers. Each request bumps the generation; every writer
+// rotates once per generation it sees.
+type rotateRequest struct {
+	gen atomic.Uint64
+}
+
+func (r *rotateRequest) request() { r.gen.Add(1) }
+
+// pending reports whether a rotation was requested since seen, and
+// updates seen.
+func (r *rotateRequest) pending(seen *uint64) bool {
+	if r == nil {
+		return false
+	}
+	g := r.gen.Load()
+	if g == *seen {
+		return false
+	}
+	*seen = g
+	return true
+}
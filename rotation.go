@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const rotationPollInterval = 5 * time.Second
+
+// watchRotation polls a capture's files and records a FileRotated Event on
+// the Pod whenever tcpdump switches to a different output file.
+func (m *CaptureManager) watchRotation(ctx context.Context, ref *corev1.ObjectReference, pattern string) {
+	ticker := time.NewTicker(rotationPollInterval)
+	defer ticker.Stop()
+
+	current := newestFile(pattern)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			f := newestFile(pattern)
+			if f == "" || f == current {
+				continue
+			}
+			if current != "" {
+				m.recorder.Eventf(ref, corev1.EventTypeNormal, reasonFileRotated,
+					"Rotated from %s to %s", filepath.Base(current), filepath.Base(f))
+			}
+			current = f
+		}
+	}
+}
+
+// newestFile returns the most recently modified ring file matching
+// pattern*.
+func newestFile(pattern string) string {
+	matches, _ := filepath.Glob(pattern + "*")
+	var newest string
+	var newestTime time.Time
+	for _, f := range matches {
+		if !isRingFile(f) {
+			continue
+		}
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		if newest == "" || info.ModTime().After(newestTime) {
+			newest, newestTime = f, info.ModTime()
+		}
+	}
+	return newest
+}
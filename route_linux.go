@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// rtfUp marks the routes in use in /proc/net/route and ipv6_route.
+const rtfUp = 0x1
+
+// nodeRoutes reads the IPv4 and IPv6 routes of the main routing table from
+// /proc/net/route and /proc/net/ipv6_route.
+func nodeRoutes() ([]route, error) {
+	var routes []route
+	// Iface Destination Gateway Flags RefCnt Use Metric Mask ..., with
+	// addresses in host byte order.
+	err := readProcTable("/proc/net/route", true, func(f []string) {
+		if len(f) < 8 {
+			return
+		}
+		dst, err1 := strconv.ParseUint(f[1], 16, 32)
+		mask, err2 := strconv.ParseUint(f[7], 16, 32)
+		flags, err3 := strconv.ParseUint(f[3], 16, 32)
+		metric, err4 := strconv.Atoi(f[6])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || flags&rtfUp == 0 {
+			return
+		}
+		var d, m [4]byte
+		binary.NativeEndian.PutUint32(d[:], uint32(dst))
+		binary.NativeEndian.PutUint32(m[:], uint32(mask))
+		bits := 0
+		for _, b := range m {
+			for ; b&0x80 != 0; b <<= 1 {
+				bits++
+			}
+		}
+		routes = append(routes, route{dst: netip.PrefixFrom(netip.AddrFrom4(d), bits).Masked(), iface: f[0], metric: metric})
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Destination PrefixLen Source SourcePrefixLen NextHop Metric RefCnt
+	// Use Flags Iface, in hex.
+	err = readProcTable("/proc/net/ipv6_route", false, func(f []string) {
+		if len(f) < 10 {
+			return
+		}
+		raw, err1 := hex.DecodeString(f[0])
+		bits, err2 := strconv.ParseUint(f[1], 16, 8)
+		metric, err3 := strconv.ParseUint(f[5], 16, 32)
+		flags, err4 := strconv.ParseUint(f[8], 16, 32)
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || len(raw) != 16 || flags&rtfUp == 0 || f[9] == "lo" {
+			return
+		}
+		routes = append(routes, route{dst: netip.PrefixFrom(netip.AddrFrom16([16]byte(raw)), int(bits)).Masked(), iface: f[9], metric: int(metric)})
+	})
+	if os.IsNotExist(err) {
+		// IPv6 is disabled.
+		err = nil
+	}
+	return routes, err
+}
+
+// readProcTable calls row with the fields of every line of the table at
+// path, skipping its header line if it has one.
+func readProcTable(path string, header bool, row func([]string)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for first := true; sc.Scan(); first = false {
+		if first && header {
+			continue
+		}
+		row(strings.Fields(sc.Text()))
+	}
+	return sc.Err()
+}
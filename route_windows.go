@@ -0,0 +1,7 @@
+package main
+
+// nodeRoutes is not implemented on Windows, so Node captures of addresses
+// use the default interface there.
+func nodeRoutes() ([]route, error) {
+	return nil, nil
+}
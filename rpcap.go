@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/bpf"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+)
+
+// rpcap message types. A reply has the type of its request with
+// rpcapReply set.
+const (
+	rpcapMsgError           = 1
+	rpcapMsgFindAllIfReq    = 2
+	rpcapMsgOpenReq         = 3
+	rpcapMsgStartCapReq     = 4
+	rpcapMsgUpdateFilterReq = 5
+	rpcapMsgClose           = 6
+	rpcapMsgPacket          = 7
+	rpcapMsgAuthReq         = 8
+	rpcapMsgStatsReq        = 9
+	rpcapMsgEndCapReq       = 10
+	rpcapMsgSetSamplingReq  = 11
+	rpcapReply              = 0x80
+)
+
+// rpcap error codes, which libpcap turns into its error messages.
+const (
+	rpcapErrAuth           = 3
+	rpcapErrOpen           = 6
+	rpcapErrUpdateFilter   = 7
+	rpcapErrStartCapture   = 12
+	rpcapErrSetSampling    = 15
+	rpcapErrWrongMsg       = 16
+	rpcapErrWrongVer       = 17
+	rpcapErrAuthTypeNotSup = 20
+)
+
+const (
+	// rpcapVersion is the protocol version spoken, the only one libpcap
+	// has defined.
+	rpcapVersion      = 0
+	rpcapAuthPassword = 1
+	rpcapFilterBPF    = 0
+	// Start capture flags for a data connection over UDP and for one the
+	// agent opens to the client. Only the default, a TCP connection the
+	// client opens to the agent, is supported.
+	rpcapFlagDatagram   = 2
+	rpcapFlagServerOpen = 4
+	// rpcapIfUpRunning are the flags of listed interfaces.
+	rpcapIfUpRunning = 0x6
+	// rpcapByteOrderMagic tells clients the byte order of the agent.
+	rpcapByteOrderMagic = 0xa1b2c3d4
+	// rpcapMaxMessage bounds message payloads, which are read before they
+	// are looked at. The largest is a filter of 4096 BPF instructions.
+	rpcapMaxMessage = 64 << 10
+	// rpcapBufferSize is the receive buffer clients allocate, which has to
+	// hold the largest packet message.
+	rpcapBufferSize = 1 << 20
+	// rpcapTimeout bounds the wait for a client to authenticate, for the
+	// Kubernetes API to review it, and for it to open the data connection.
+	rpcapTimeout = 30 * time.Second
+	// captureSubresource is the Pod subresource users need get on to
+	// capture a Pod remotely, and the Node subresource they need access
+	// to for the agent API. It exists only for authorization.
+	captureSubresource = "capture"
+)
+
+// rpcapMessage is one message of the rpcap protocol.
+type rpcapMessage struct {
+	version uint8
+	typ     uint8
+	value   uint16
+	payload []byte
+}
+
+// serveRPCAP serves the Pod captures running on the node to Wireshark and
+// other libpcap clients over the rpcap protocol of rpcapd until ctx is
+// cancelled. Every running capture is an interface named by its key.
+func (m *CaptureManager) serveRPCAP(ctx context.Context) {
+	var tlsConfig *tls.Config
+	// Without a certificate of its own the endpoint uses that of the HTTP
+	// server. Clients authenticate inside the protocol, and with a client
+	// CA also present a client certificate, as on every other endpoint.
+	certFile, keyFile := m.cfg.RPCAPCert, m.cfg.RPCAPKey
+	if certFile == "" {
+		certFile, keyFile = m.cfg.TLSCert, m.cfg.TLSKey
+	}
+	if certFile != "" {
+		certs, err := newServingCerts("rpcap", certFile, keyFile, m.cfg.TLSClientCA)
+		if err != nil {
+			slog.Error("Cannot load the rpcap certificate", "err", err)
+			return
+		}
+		tlsConfig = certs.tlsConfig()
+	}
+	ln, err := net.Listen("tcp", m.cfg.RPCAPAddr)
+	if err != nil {
+		slog.Error("rpcap endpoint failed", "err", err)
+		return
+	}
+	if tlsConfig != nil {
+		ln = tls.NewListener(ln, tlsConfig)
+	}
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+
+	slog.Info("rpcap endpoint listening", "addr", m.cfg.RPCAPAddr, "tls", tlsConfig != nil)
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("Cannot accept rpcap connection", "err", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		s := &rpcapSession{
+			m:       m,
+			conn:    conn,
+			tls:     tlsConfig,
+			allowed: make(map[string]bool),
+			log:     slog.With("remote", conn.RemoteAddr().String()),
+		}
+		go s.serve(ctx)
+	}
+}
+
+// liveCaptures returns the keys of the running Pod captures, sorted.
+func (m *CaptureManager) liveCaptures() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for key, cap := range m.captures {
+		if _, _, _, ok := splitCaptureKey(key); ok && cap.spec.Live != nil {
+			keys = append(keys, key)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// captureFeed returns the live feed of the running capture with key, or nil.
+func (m *CaptureManager) captureFeed(key string) *liveFeed {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cap, ok := m.captures[key]; ok {
+		return cap.spec.Live
+	}
+	return nil
+}
+
+// rpcapSession is the control connection of one rpcap client.
+type rpcapSession struct {
+	m    *CaptureManager
+	conn net.Conn
+	tls  *tls.Config
+	log  *slog.Logger
+	// user is who the client authenticated as; nil for the API token,
+	// which may capture every Pod.
+	user *authenticationv1.UserInfo
+	// allowed caches the access reviews of the user by Pod key.
+	allowed map[string]bool
+
+	// key is the capture the client opened, capture its data connection
+	// once started.
+	key     string
+	capture *rpcapCapture
+}
+
+// rpcapCapture streams a capture to the data connection of a client.
+type rpcapCapture struct {
+	feed    *liveFeed
+	ch      chan livePacket
+	snaplen int
+	// filter is the client's capture filter, nil for none.
+	filter   atomic.Pointer[bpf.VM]
+	received atomic.Uint32
+	sent     atomic.Uint32
+	done     chan struct{}
+}
+
+func (s *rpcapSession) serve(ctx context.Context) {
+	defer s.conn.Close()
+	defer s.endCapture()
+
+	s.conn.SetDeadline(time.Now().Add(rpcapTimeout))
+	if err := s.verifyClient(ctx); err != nil {
+		s.log.Info("Rejected rpcap connection", "err", err)
+		return
+	}
+	if !s.authenticate(ctx) {
+		return
+	}
+	s.conn.SetDeadline(time.Time{})
+	for {
+		msg, err := s.read()
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				s.log.Debug("rpcap connection failed", "err", err)
+			}
+			return
+		}
+		if msg.version != rpcapVersion {
+			err = s.fail(rpcapErrWrongVer, "rpcap version %d is not supported", msg.version)
+		} else {
+			switch msg.typ {
+			case rpcapMsgFindAllIfReq:
+				err = s.findAllIf(ctx)
+			case rpcapMsgOpenReq:
+				err = s.open(ctx, string(msg.payload))
+			case rpcapMsgStartCapReq:
+				err = s.startCapture(msg.payload)
+			case rpcapMsgUpdateFilterReq:
+				err = s.updateFilter(msg.payload)
+			case rpcapMsgStatsReq:
+				err = s.stats()
+			case rpcapMsgEndCapReq:
+				s.endCapture()
+				err = s.reply(rpcapMsgEndCapReq, 0, nil)
+			case rpcapMsgSetSamplingReq:
+				if len(msg.payload) > 0 && msg.payload[0] != 0 {
+					err = s.fail(rpcapErrSetSampling, "sampling is not supported")
+				} else {
+					err = s.reply(rpcapMsgSetSamplingReq, 0, nil)
+				}
+			case rpcapMsgClose:
+				return
+			default:
+				err = s.fail(rpcapErrWrongMsg, "unexpected message type %d", msg.typ)
+			}
+		}
+		if err != nil {
+			s.log.Debug("rpcap connection failed", "err", err)
+			return
+		}
+	}
+}
+
+// verifyClient completes the TLS handshake and, with a client CA, checks
+// the client's certificate before anything is read from the connection.
+func (s *rpcapSession) verifyClient(ctx context.Context) error {
+	conn, ok := s.conn.(*tls.Conn)
+	if !ok || s.m.cfg.TLSClientCA == "" {
+		return nil
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return err
+	}
+	state := conn.ConnectionState()
+	_, err := verifiedClient(&state)
+	return err
+}
+
+// authenticate waits for the client to log in. The password is either the
+// API token or a Kubernetes token, which the API server reviews; the user
+// name is ignored. Clients asking for another protocol version are told
+// the one spoken, and libpcap then tries again with it.
+func (s *rpcapSession) authenticate(ctx context.Context) bool {
+	for {
+		msg, err := s.read()
+		if err != nil {
+			return false
+		}
+		if msg.version != rpcapVersion {
+			if s.fail(rpcapErrWrongVer, "rpcap version %d is not supported", msg.version) != nil {
+				return false
+			}
+			continue
+		}
+		if msg.typ != rpcapMsgAuthReq {
+			s.fail(rpcapErrWrongMsg, "authentication required")
+			return false
+		}
+		p := msg.payload
+		if len(p) < 8 {
+			s.fail(rpcapErrWrongMsg, "short authentication request")
+			return false
+		}
+		userLen, passwordLen := int(binary.BigEndian.Uint16(p[4:])), int(binary.BigEndian.Uint16(p[6:]))
+		if binary.BigEndian.Uint16(p) != rpcapAuthPassword || len(p) < 8+userLen+passwordLen {
+			s.fail(rpcapErrAuthTypeNotSup, "log in with a Kubernetes token as password")
+			return false
+		}
+		if err := s.login(ctx, string(p[8+userLen:8+userLen+passwordLen])); err != nil {
+			s.log.Info("rpcap authentication failed", "err", err)
+			s.fail(rpcapErrAuth, "authentication failed")
+			return false
+		}
+		// The supported versions, then the byte order of the agent.
+		reply := binary.NativeEndian.AppendUint32([]byte{rpcapVersion, rpcapVersion, 0, 0}, rpcapByteOrderMagic)
+		return s.reply(rpcapMsgAuthReq, 0, reply) == nil
+	}
+}
+
+func (s *rpcapSession) login(ctx context.Context, token string) error {
+	if token == "" {
+		return errors.New("no token given")
+	}
+	if s.m.cfg.APIToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.m.cfg.APIToken)) == 1 {
+		s.log = s.log.With("user", "API token")
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, rpcapTimeout)
+	defer cancel()
+	user, err := s.m.reviewToken(ctx, token)
+	if err != nil {
+		return err
+	}
+	s.user = user
+	s.log = s.log.With("user", s.user.Username)
+	return nil
+}
+
+// authorized reports whether the client may capture the Pod, which takes
+// get on its capture subresource.
+func (s *rpcapSession) authorized(ctx context.Context, namespace, pod string) bool {
+	if s.user == nil {
+		return true
+	}
+	podKey := namespace + "/" + pod
+	if allowed, ok := s.allowed[podKey]; ok {
+		return allowed
+	}
+	ctx, cancel := context.WithTimeout(ctx, rpcapTimeout)
+	defer cancel()
+	allowed, err := s.m.reviewAccess(ctx, s.user, &authorizationv1.ResourceAttributes{
+		Namespace:   namespace,
+		Verb:        "get",
+		Resource:    "pods",
+		Subresource: captureSubresource,
+		Name:        pod,
+	})
+	if err != nil {
+		// Not cached, the next request asks again.
+		s.log.Warn("Cannot review access to a remote capture", "pod", podKey, "err", err)
+		return false
+	}
+	s.allowed[podKey] = allowed
+	return allowed
+}
+
+// findAllIf lists the running captures of the Pods the client may capture.
+func (s *rpcapSession) findAllIf(ctx context.Context) error {
+	var b []byte
+	n := 0
+	for _, key := range s.m.liveCaptures() {
+		ns, pod, session, _ := splitCaptureKey(key)
+		if !s.authorized(ctx, ns, pod) {
+			continue
+		}
+		desc := fmt.Sprintf("Capture of Pod %s/%s on node %s", ns, pod, s.m.nodeName)
+		if session != "" {
+			desc += ", session " + session
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(len(key)))
+		b = binary.BigEndian.AppendUint16(b, uint16(len(desc)))
+		b = binary.BigEndian.AppendUint32(b, rpcapIfUpRunning)
+		// No addresses.
+		b = binary.BigEndian.AppendUint32(b, 0)
+		b = append(append(b, key...), desc...)
+		n++
+	}
+	return s.reply(rpcapMsgFindAllIfReq, uint16(n), b)
+}
+
+// open opens the running capture with key. Every capture is opened as
+// Ethernet, packets of other link types get an Ethernet header like for
+// mirrors.
+func (s *rpcapSession) open(ctx context.Context, key string) error {
+	if s.capture != nil {
+		return s.fail(rpcapErrOpen, "a capture is already running")
+	}
+	ns, pod, _, ok := splitCaptureKey(key)
+	if !ok || !s.authorized(ctx, ns, pod) || s.m.captureFeed(key) == nil {
+		return s.fail(rpcapErrOpen, "no running capture %s you may capture", key)
+	}
+	s.key = key
+	// The link type, then the time zone offset.
+	return s.reply(rpcapMsgOpenReq, 0, []byte{0, 0, 0, 1, 0, 0, 0, 0})
+}
+
+// startCapture subscribes to the opened capture and listens for the data
+// connection on a port of its own, which the client connects to right
+// after the reply.
+func (s *rpcapSession) startCapture(p []byte) error {
+	switch {
+	case s.key == "":
+		return s.fail(rpcapErrStartCapture, "no capture opened")
+	case s.capture != nil:
+		return s.fail(rpcapErrStartCapture, "the capture is already running")
+	case len(p) < 12:
+		return s.fail(rpcapErrWrongMsg, "short start capture request")
+	case binary.BigEndian.Uint16(p[8:])&(rpcapFlagDatagram|rpcapFlagServerOpen) != 0:
+		return s.fail(rpcapErrStartCapture, "only TCP data connections opened by the client are supported")
+	}
+	snaplen := int(binary.BigEndian.Uint32(p))
+	if snaplen <= 0 || snaplen > defaultSnaplen {
+		snaplen = defaultSnaplen
+	}
+	filter, err := parseRPCAPFilter(p[12:])
+	if err != nil {
+		return s.fail(rpcapErrStartCapture, "invalid filter: %v", err)
+	}
+	feed := s.m.captureFeed(s.key)
+	if feed == nil {
+		return s.fail(rpcapErrStartCapture, "the capture of %s has stopped", s.key)
+	}
+	host, _, _ := net.SplitHostPort(s.conn.LocalAddr().String())
+	ln, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return s.fail(rpcapErrStartCapture, "cannot listen for the data connection: %v", err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	if s.tls != nil {
+		ln = tls.NewListener(ln, s.tls)
+	}
+	ch, ok := feed.subscribe(true)
+	if !ok {
+		ln.Close()
+		return s.fail(rpcapErrStartCapture, "the capture of %s has stopped", s.key)
+	}
+	c := &rpcapCapture{feed: feed, ch: ch, snaplen: snaplen, done: make(chan struct{})}
+	c.filter.Store(filter)
+	s.capture = c
+	remoteCaptures.Inc()
+	s.log.Info("Remote capture started", "capture", s.key)
+	peer, _, _ := net.SplitHostPort(s.conn.RemoteAddr().String())
+	go c.run(ln, peer, s.log)
+
+	// The buffer size, then the data port.
+	b := binary.BigEndian.AppendUint32(nil, rpcapBufferSize)
+	b = binary.BigEndian.AppendUint16(b, uint16(port))
+	b = binary.BigEndian.AppendUint16(b, 0)
+	return s.reply(rpcapMsgStartCapReq, 0, b)
+}
+
+func (s *rpcapSession) updateFilter(p []byte) error {
+	if s.capture == nil {
+		return s.fail(rpcapErrUpdateFilter, "no capture running")
+	}
+	filter, err := parseRPCAPFilter(p)
+	if err != nil {
+		return s.fail(rpcapErrUpdateFilter, "invalid filter: %v", err)
+	}
+	s.capture.filter.Store(filter)
+	return s.reply(rpcapMsgUpdateFilterReq, 0, nil)
+}
+
+// stats reports the packets the capture handed to the client as received
+// and those that passed its filter as captured. Packets the client fell
+// behind on are not counted anywhere.
+func (s *rpcapSession) stats() error {
+	var received, sent uint32
+	if s.capture != nil {
+		received, sent = s.capture.received.Load(), s.capture.sent.Load()
+	}
+	b := binary.BigEndian.AppendUint32(nil, received)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, sent)
+	return s.reply(rpcapMsgStatsReq, 0, b)
+}
+
+// endCapture stops the running capture, if any, and closes its data
+// connection.
+func (s *rpcapSession) endCapture() {
+	if s.capture == nil {
+		return
+	}
+	close(s.capture.done)
+	s.capture.feed.unsubscribe(s.capture.ch)
+	remoteCaptures.Dec()
+	s.log.Info("Remote capture stopped", "capture", s.key, "packets", s.capture.sent.Load())
+	s.capture = nil
+}
+
+func (s *rpcapSession) read() (rpcapMessage, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+		return rpcapMessage{}, err
+	}
+	n := binary.BigEndian.Uint32(h[4:])
+	if n > rpcapMaxMessage {
+		return rpcapMessage{}, fmt.Errorf("message of %d bytes is too large", n)
+	}
+	msg := rpcapMessage{version: h[0], typ: h[1], value: binary.BigEndian.Uint16(h[2:]), payload: make([]byte, n)}
+	if _, err := io.ReadFull(s.conn, msg.payload); err != nil {
+		return rpcapMessage{}, err
+	}
+	return msg, nil
+}
+
+func (s *rpcapSession) reply(req uint8, value uint16, payload []byte) error {
+	_, err := s.conn.Write(append(rpcapHeader(req|rpcapReply, value, len(payload)), payload...))
+	return err
+}
+
+// fail sends an error message. It only returns an error if it cannot be
+// sent, after which the connection is of no more use.
+func (s *rpcapSession) fail(code uint16, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	s.log.Debug("rpcap request failed", "err", msg)
+	_, err := s.conn.Write(append(rpcapHeader(rpcapMsgError, code, len(msg)), msg...))
+	return err
+}
+
+func rpcapHeader(typ uint8, value uint16, n int) []byte {
+	b := binary.BigEndian.AppendUint16([]byte{rpcapVersion, typ}, value)
+	return binary.BigEndian.AppendUint32(b, uint32(n))
+}
+
+// parseRPCAPFilter loads a BPF program the client compiled for Ethernet
+// into a VM. It returns nil for an empty program.
+func parseRPCAPFilter(p []byte) (*bpf.VM, error) {
+	if len(p) < 8 {
+		return nil, errors.New("short filter")
+	}
+	if typ := binary.BigEndian.Uint16(p); typ != rpcapFilterBPF {
+		return nil, fmt.Errorf("unsupported filter type %d", typ)
+	}
+	n := binary.BigEndian.Uint32(p[4:])
+	if n == 0 {
+		return nil, nil
+	}
+	p = p[8:]
+	if uint64(len(p)) < 8*uint64(n) {
+		return nil, errors.New("short filter")
+	}
+	insns := make([]bpf.Instruction, n)
+	for i := range insns {
+		q := p[8*i:]
+		insns[i] = bpf.RawInstruction{
+			Op: binary.BigEndian.Uint16(q),
+			Jt: q[2],
+			Jf: q[3],
+			K:  binary.BigEndian.Uint32(q[4:]),
+		}.Disassemble()
+	}
+	return bpf.NewVM(insns)
+}
+
+// run waits for the client to connect the data connection from peer, the
+// address of its control connection, and writes the packets of the capture
+// to it until the capture or the client stops.
+func (c *rpcapCapture) run(ln net.Listener, peer string, log *slog.Logger) {
+	go func() {
+		select {
+		case <-c.done:
+		case <-time.After(rpcapTimeout):
+		}
+		ln.Close()
+	}()
+	conn, err := acceptFrom(ln, peer, log)
+	ln.Close()
+	if err != nil {
+		log.Warn("Remote capture client did not open the data connection", "err", err)
+		return
+	}
+	defer conn.Close()
+	go func() {
+		<-c.done
+		conn.Close()
+	}()
+
+	w := bufio.NewWriterSize(conn, 64<<10)
+	var hdr []byte
+	for p := range c.ch {
+		c.received.Add(1)
+		frame := ethernetFrame(p.linkType, p.data)
+		if frame == nil {
+			continue
+		}
+		caplen := min(len(frame), c.snaplen)
+		if vm := c.filter.Load(); vm != nil {
+			n, err := vm.Run(frame)
+			if err != nil || n == 0 {
+				continue
+			}
+			caplen = min(caplen, n)
+		}
+		npkt := c.sent.Add(1)
+		ts := p.ci.Timestamp
+		hdr = append(hdr[:0], rpcapHeader(rpcapMsgPacket, 0, 20+caplen)...)
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(ts.Unix()))
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(ts.Nanosecond()/1000))
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(caplen))
+		hdr = binary.BigEndian.AppendUint32(hdr, uint32(p.ci.Length+len(frame)-len(p.data)))
+		hdr = binary.BigEndian.AppendUint32(hdr, npkt)
+		w.Write(hdr)
+		w.Write(frame[:caplen])
+		// Flush once caught up, so a quiet capture is not held back.
+		if len(c.ch) == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+	w.Flush()
+}
+
+// acceptFrom accepts the first connection from the host peer. The data port
+// is open to anyone who finds it, so connections from other hosts are
+// closed rather than sent the capture.
+func acceptFrom(ln net.Listener, peer string, log *slog.Logger) (net.Conn, error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil, err
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if host == peer {
+			return conn, nil
+		}
+		log.Warn("Rejected a data connection from another host", "from", conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
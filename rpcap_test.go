@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+// rpcapFilter encodes a filter message part of typ claiming count
+// instructions.
+func rpcapFilter(t *testing.T, typ uint16, count uint32, insns ...bpf.Instruction) []byte {
+	t.Helper()
+	raw, err := bpf.Assemble(insns)
+	if err != nil {
+		t.Fatalf("Assemble: %v", err)
+	}
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint32(b, count)
+	for _, ins := range raw {
+		b = binary.BigEndian.AppendUint16(b, ins.Op)
+		b = append(b, ins.Jt, ins.Jf)
+		b = binary.BigEndian.AppendUint32(b, ins.K)
+	}
+	return b
+}
+
+// rpcapAuth encodes an authentication request payload.
+func rpcapAuth(typ uint16, user, password string) []byte {
+	b := binary.BigEndian.AppendUint16(nil, typ)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(user)))
+	b = binary.BigEndian.AppendUint16(b, uint16(len(password)))
+	return append(append(b, user...), password...)
+}
+
+// rpcapStart encodes a start capture request payload.
+func rpcapStart(snaplen uint32, flags uint16, filter []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, snaplen)
+	// The read timeout, which the agent ignores.
+	b = binary.BigEndian.AppendUint32(b, 1000)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, 0)
+	return append(b, filter...)
+}
+
+// rpcapRequest encodes a message of version.
+func rpcapRequest(version, typ uint8, payload []byte) []byte {
+	h := rpcapHeader(typ, 0, len(payload))
+	h[0] = version
+	return append(h, payload...)
+}
+
+// newRPCAPSession returns a session of tm on one end of a pipe and the
+// client's end.
+func newRPCAPSession(t *testing.T, tm *testManager) (*rpcapSession, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return &rpcapSession{m: tm.CaptureManager, conn: server, log: slog.Default(), allowed: make(map[string]bool)}, client
+}
+
+// readRPCAP reads a message from the client's end of the pipe.
+func readRPCAP(conn net.Conn) (rpcapMessage, error) {
+	var h [8]byte
+	if _, err := io.ReadFull(conn, h[:]); err != nil {
+		return rpcapMessage{}, err
+	}
+	msg := rpcapMessage{version: h[0], typ: h[1], value: binary.BigEndian.Uint16(h[2:]), payload: make([]byte, binary.BigEndian.Uint32(h[4:]))}
+	_, err := io.ReadFull(conn, msg.payload)
+	return msg, err
+}
+
+func TestParseRPCAPFilter(t *testing.T) {
+	accept := bpf.RetConstant{Val: 65535}
+	tests := []struct {
+		name    string
+		payload []byte
+		// wantVM is whether a program is returned, which then accepts
+		// every packet.
+		wantVM  bool
+		wantErr string
+	}{
+		{name: "empty", payload: nil, wantErr: "short filter"},
+		{name: "short header", payload: make([]byte, 7), wantErr: "short filter"},
+		{name: "no instructions", payload: rpcapFilter(t, rpcapFilterBPF, 0)},
+		{name: "program", payload: rpcapFilter(t, rpcapFilterBPF, 1, accept), wantVM: true},
+		{name: "unsupported type", payload: rpcapFilter(t, 1, 1, accept), wantErr: "unsupported filter type 1"},
+		{name: "count larger than payload", payload: rpcapFilter(t, rpcapFilterBPF, 2, accept), wantErr: "short filter"},
+		{name: "count overflowing", payload: rpcapFilter(t, rpcapFilterBPF, 1<<31, accept), wantErr: "short filter"},
+		{name: "partial instruction", payload: rpcapFilter(t, rpcapFilterBPF, 1, accept)[:12], wantErr: "short filter"},
+		{name: "no return", payload: rpcapFilter(t, rpcapFilterBPF, 1, bpf.LoadAbsolute{Off: 0, Size: 1}), wantErr: "must end with"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vm, err := parseRPCAPFilter(tt.payload)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseRPCAPFilter: %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRPCAPFilter: %v", err)
+			}
+			if (vm != nil) != tt.wantVM {
+				t.Fatalf("parseRPCAPFilter returned a program: %v, want one: %v", vm != nil, tt.wantVM)
+			}
+			if vm != nil {
+				if n, err := vm.Run(make([]byte, 64)); err != nil || n != 65535 {
+					t.Errorf("program returned %d, %v, want 65535", n, err)
+				}
+			}
+		})
+	}
+}
+
+func TestRPCAPAuthenticate(t *testing.T) {
+	oversized := rpcapHeader(rpcapMsgAuthReq, 0, rpcapMaxMessage+1)
+	tests := []struct {
+		name     string
+		requests [][]byte
+		// replies are the error codes of the replies, 0 for the
+		// authentication reply.
+		replies []uint16
+		want    bool
+	}{
+		{name: "api token", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "", "secret"))}, replies: []uint16{0}, want: true},
+		{name: "user name ignored", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "alice", "secret"))}, replies: []uint16{0}, want: true},
+		{
+			name: "other version retried",
+			requests: [][]byte{
+				rpcapRequest(1, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "", "secret")),
+				rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "", "secret")),
+			},
+			replies: []uint16{rpcapErrWrongVer, 0},
+			want:    true,
+		},
+		{name: "not an authentication request", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgFindAllIfReq, nil)}, replies: []uint16{rpcapErrWrongMsg}},
+		{name: "empty payload", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, nil)}, replies: []uint16{rpcapErrWrongMsg}},
+		{name: "short payload", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "", "")[:7])}, replies: []uint16{rpcapErrWrongMsg}},
+		{name: "null authentication", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(0, "", ""))}, replies: []uint16{rpcapErrAuthTypeNotSup}},
+		{name: "unknown authentication type", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(7, "", "secret"))}, replies: []uint16{rpcapErrAuthTypeNotSup}},
+		{
+			name:     "lengths beyond the payload",
+			requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "alice", "secret")[:12])},
+			replies:  []uint16{rpcapErrAuthTypeNotSup},
+		},
+		{name: "no password", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "alice", ""))}, replies: []uint16{rpcapErrAuth}},
+		{name: "rejected token", requests: [][]byte{rpcapRequest(rpcapVersion, rpcapMsgAuthReq, rpcapAuth(rpcapAuthPassword, "", "wrong"))}, replies: []uint16{rpcapErrAuth}},
+		// The payload is refused before it is read, and nothing is sent.
+		{name: "oversized payload", requests: [][]byte{oversized}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManager(t)
+			tm.cfg.APIToken = "secret"
+			s, client := newRPCAPSession(t, tm)
+			done := make(chan bool, 1)
+			go func() {
+				ok := s.authenticate(t.Context())
+				s.conn.Close()
+				done <- ok
+			}()
+			go func() {
+				for _, req := range tt.requests {
+					if _, err := client.Write(req); err != nil {
+						return
+					}
+				}
+			}()
+			for i, code := range tt.replies {
+				msg, err := readRPCAP(client)
+				if err != nil {
+					t.Fatalf("reply %d: %v", i, err)
+				}
+				switch {
+				case code == 0 && (msg.typ != rpcapMsgAuthReq|rpcapReply || len(msg.payload) != 8 || msg.payload[0] != rpcapVersion):
+					t.Errorf("reply %d is type %d with %x, want the authentication reply", i, msg.typ, msg.payload)
+				case code != 0 && (msg.typ != rpcapMsgError || msg.value != code):
+					t.Errorf("reply %d is type %d code %d (%s), want error %d", i, msg.typ, msg.value, msg.payload, code)
+				}
+			}
+			if got := <-done; got != tt.want {
+				t.Errorf("authenticate = %v, want %v", got, tt.want)
+			}
+			if msg, err := readRPCAP(client); err == nil {
+				t.Errorf("unexpected reply type %d code %d (%s)", msg.typ, msg.value, msg.payload)
+			}
+		})
+	}
+}
+
+func TestRPCAPStartCapture(t *testing.T) {
+	const key = "default/web"
+	accept := bpf.RetConstant{Val: 65535}
+	tests := []struct {
+		name    string
+		opened  bool
+		running bool
+		payload []byte
+		// wantCode and wantErr describe the error reply; without them
+		// the capture starts with wantSnaplen.
+		wantCode    uint16
+		wantErr     string
+		wantSnaplen int
+		wantFilter  bool
+	}{
+		{name: "not opened", running: true, payload: rpcapStart(0, 0, rpcapFilter(t, rpcapFilterBPF, 0)), wantCode: rpcapErrStartCapture, wantErr: "no capture opened"},
+		{name: "empty payload", opened: true, running: true, wantCode: rpcapErrWrongMsg, wantErr: "short start capture request"},
+		{name: "short payload", opened: true, running: true, payload: rpcapStart(0, 0, nil)[:11], wantCode: rpcapErrWrongMsg, wantErr: "short start capture request"},
+		{
+			name: "datagram", opened: true, running: true, payload: rpcapStart(0, rpcapFlagDatagram, rpcapFilter(t, rpcapFilterBPF, 0)),
+			wantCode: rpcapErrStartCapture, wantErr: "only TCP data connections",
+		},
+		{
+			name: "server opens", opened: true, running: true, payload: rpcapStart(0, rpcapFlagServerOpen, rpcapFilter(t, rpcapFilterBPF, 0)),
+			wantCode: rpcapErrStartCapture, wantErr: "only TCP data connections",
+		},
+		{name: "no filter", opened: true, running: true, payload: rpcapStart(0, 0, nil), wantCode: rpcapErrStartCapture, wantErr: "invalid filter: short filter"},
+		{
+			name: "filter count larger than payload", opened: true, running: true, payload: rpcapStart(0, 0, rpcapFilter(t, rpcapFilterBPF, 100, accept)),
+			wantCode: rpcapErrStartCapture, wantErr: "invalid filter: short filter",
+		},
+		{
+			name: "filter count overflowing", opened: true, running: true, payload: rpcapStart(0, 0, rpcapFilter(t, rpcapFilterBPF, 0xffffffff, accept)),
+			wantCode: rpcapErrStartCapture, wantErr: "invalid filter: short filter",
+		},
+		{
+			name: "unsupported filter type", opened: true, running: true, payload: rpcapStart(0, 0, rpcapFilter(t, 2, 1, accept)),
+			wantCode: rpcapErrStartCapture, wantErr: "unsupported filter type 2",
+		},
+		{name: "capture stopped", opened: true, payload: rpcapStart(0, 0, rpcapFilter(t, rpcapFilterBPF, 0)), wantCode: rpcapErrStartCapture, wantErr: "has stopped"},
+		{name: "default snaplen", opened: true, running: true, payload: rpcapStart(0, 0, rpcapFilter(t, rpcapFilterBPF, 0)), wantSnaplen: defaultSnaplen},
+		{name: "snaplen", opened: true, running: true, payload: rpcapStart(128, 0, rpcapFilter(t, rpcapFilterBPF, 0)), wantSnaplen: 128},
+		{name: "snaplen too large", opened: true, running: true, payload: rpcapStart(defaultSnaplen+1, 0, rpcapFilter(t, rpcapFilterBPF, 0)), wantSnaplen: defaultSnaplen},
+		{
+			name: "filter", opened: true, running: true, payload: rpcapStart(96, 0, rpcapFilter(t, rpcapFilterBPF, 1, accept)),
+			wantSnaplen: 96, wantFilter: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManager(t)
+			if tt.running {
+				tm.mu.Lock()
+				tm.captures[key] = &CaptureProcess{spec: captureSpec{Live: newLiveFeed()}}
+				tm.mu.Unlock()
+				// The capture has nothing to stop.
+				t.Cleanup(func() {
+					tm.mu.Lock()
+					delete(tm.captures, key)
+					tm.mu.Unlock()
+				})
+			}
+			s, client := newRPCAPSession(t, tm)
+			if tt.opened {
+				s.key = key
+			}
+			errc := make(chan error, 1)
+			go func() { errc <- s.startCapture(tt.payload) }()
+			msg, err := readRPCAP(client)
+			if err != nil {
+				t.Fatalf("read reply: %v", err)
+			}
+			if err := <-errc; err != nil {
+				t.Fatalf("startCapture: %v", err)
+			}
+			defer s.endCapture()
+			if tt.wantCode != 0 {
+				if msg.typ != rpcapMsgError || msg.value != tt.wantCode || !strings.Contains(string(msg.payload), tt.wantErr) {
+					t.Errorf("reply is type %d code %d (%s), want error %d %q", msg.typ, msg.value, msg.payload, tt.wantCode, tt.wantErr)
+				}
+				if s.capture != nil {
+					t.Error("capture started after an error")
+				}
+				return
+			}
+			if msg.typ != rpcapMsgStartCapReq|rpcapReply || len(msg.payload) != 8 {
+				t.Fatalf("reply is type %d with %q, want the start capture reply", msg.typ, msg.payload)
+			}
+			if got := binary.BigEndian.Uint32(msg.payload); got != rpcapBufferSize {
+				t.Errorf("buffer size = %d, want %d", got, rpcapBufferSize)
+			}
+			if port := binary.BigEndian.Uint16(msg.payload[4:]); port == 0 {
+				t.Error("no data port")
+			}
+			if s.capture == nil {
+				t.Fatal("no capture started")
+			}
+			if s.capture.snaplen != tt.wantSnaplen {
+				t.Errorf("snaplen = %d, want %d", s.capture.snaplen, tt.wantSnaplen)
+			}
+			if got := s.capture.filter.Load() != nil; got != tt.wantFilter {
+				t.Errorf("filter set: %v, want %v", got, tt.wantFilter)
+			}
+		})
+	}
+}
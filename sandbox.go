@@ -0,0 +1,85 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reasonSandboxChanged is recorded when a capture follows its Pod into a
+// recreated sandbox.
+const reasonSandboxChanged = "SandboxChanged"
+
+// netnsScoped reports whether cap captures through the Pod's own network
+// namespace or veth, which a recreated sandbox replaces. Captures on node
+// interfaces keep working across sandboxes.
+func netnsScoped(cap *CaptureProcess) bool {
+	s := cap.spec
+	if s.PodUID == "" {
+		return false
+	}
+	return s.PodLoopback || podPortBackend(cap.backend) || s.Interface == podInterface || slices.Contains(s.Interfaces, podInterface)
+}
+
+// podNetns identifies the network namespace of the Pod's processes by its
+// inode, e.g. "net:[4026532890]".
+func podNetns(podUID string) (string, error) {
+	pid, err := podProcess(podUID)
+	if err != nil {
+		return "", err
+	}
+	return os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "ns", "net"))
+}
+
+// containerIDs returns the IDs of the running containers of pod, sorted
+// and joined, so it changes whenever a container is replaced.
+func containerIDs(pod *corev1.Pod) string {
+	var ids []string
+	for _, cs := range append(append([]corev1.ContainerStatus{}, pod.Status.InitContainerStatuses...), pod.Status.ContainerStatuses...) {
+		if cs.State.Running != nil && cs.ContainerID != "" {
+			ids = append(ids, cs.ContainerID)
+		}
+	}
+	sort.Strings(ids)
+	return strings.Join(ids, ",")
+}
+
+// sandboxChanged reports whether the network namespace a netns-scoped
+// capture started in was replaced. Containers restart inside the sandbox
+// far more often than it is recreated, so the namespace is only looked up
+// again when the Pod status shows new container IDs. Callers must hold
+// m.mu.
+func (m *CaptureManager) sandboxChanged(pod *corev1.Pod, cap *CaptureProcess) bool {
+	if cap.netns == "" {
+		return false
+	}
+	ids := containerIDs(pod)
+	if ids == cap.containers {
+		return false
+	}
+	cap.containers = ids
+	netns, err := podNetns(cap.spec.PodUID)
+	// Without a process the new sandbox has no containers yet; they
+	// change the Pod status again once they start.
+	return err == nil && netns != cap.netns
+}
+
+// restartInSandbox replaces the capture of a Pod whose sandbox was
+// recreated with one in the new network namespace, in the same session.
+// The capture is set up from scratch, so filters on the Pod's IPs and
+// container ports follow the new sandbox as well. Callers must hold m.mu.
+func (m *CaptureManager) restartInSandbox(pod *corev1.Pod, key, val string, cap *CaptureProcess) error {
+	cap.log.Info("Pod sandbox changed, restarting capture", "netns", cap.netns)
+	m.recorder.Event(cap.ref, corev1.EventTypeNormal, reasonSandboxChanged,
+		"The Pod's network namespace was recreated, restarting the capture in the new one")
+	m.stopCapture(key, false, false)
+	// The new capture resumes the session when the key is synced again
+	// once the old one has stopped.
+	m.resumedSessions[key] = resumedSession{ID: cap.sessionID, Start: cap.spec.Started}
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// scheduleAnnotationKey limits a capture to recurring windows, given as a
+// five-field cron expression in UTC followed by the window length, e.g.
+// "0 2 * * * 15m" for 02:00 to 02:15 every night.
+const scheduleAnnotationKey = "schedule." + annotationKey
+
+// runNameLayout names the files of a scheduled run after its start.
+const runNameLayout = "20060102T1504Z"
+
+// captureSchedule is a parsed schedule annotation.
+type captureSchedule struct {
+	cron     *cronSchedule
+	duration time.Duration
+}
+
+func parseSchedule(v string) (*captureSchedule, error) {
+	fields := strings.Fields(v)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("%s annotation must be a cron expression and a duration, got %q", scheduleAnnotationKey, v)
+	}
+	cron, err := parseCron(fields[:5])
+	if err != nil {
+		return nil, fmt.Errorf("%s annotation: %w", scheduleAnnotationKey, err)
+	}
+	d, err := time.ParseDuration(fields[5])
+	if err != nil || d < time.Minute {
+		return nil, fmt.Errorf("%s annotation must end with a duration of at least 1m, got %q", scheduleAnnotationKey, fields[5])
+	}
+	return &captureSchedule{cron: cron, duration: d}, nil
+}
+
+// window returns the start of the window now falls into, if any.
+func (s *captureSchedule) window(now time.Time) (time.Time, bool) {
+	for t := now.Truncate(time.Minute); now.Sub(t) < s.duration; t = t.Add(-time.Minute) {
+		if s.cron.matches(t) {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// inSchedule reports whether the scheduled capture of pod should run now,
+// and enqueues the Pod again for the next start or end of a run. A run
+// ends when its window does, even if the next window has started; windows
+// starting while a run is still going are skipped, so runs never overlap.
+// Callers must hold m.mu.
+func (m *CaptureManager) inSchedule(pod *corev1.Pod, key, v string, cap *CaptureProcess) bool {
+	s, err := parseSchedule(v)
+	if err != nil {
+		m.reportFailure(pod, "", reasonCaptureFailed, fmt.Sprintf("Cannot start capture: %v", err))
+		return false
+	}
+	now := time.Now().UTC()
+	if cap != nil && !cap.spec.Run.IsZero() {
+		if end := cap.spec.Run.Add(s.duration); now.Before(end) {
+			m.queue.AddAfter(key, end.Sub(now))
+			return true
+		}
+	}
+	if start, ok := s.window(now); ok {
+		last, ran := m.scheduleRuns[key]
+		if !ran || start.Equal(last) || !start.Before(last.Add(s.duration)) {
+			m.scheduleRuns[key] = start
+			m.queue.AddAfter(key, start.Add(s.duration).Sub(now))
+			return true
+		}
+	}
+	if next := s.cron.next(now); !next.IsZero() {
+		m.queue.AddAfter(key, next.Sub(now))
+	}
+	return false
+}
+
+// cronSchedule is a five-field cron expression: minute, hour, day of
+// month, month and day of week, each a set of allowed values.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// A day matches either day field when both are restricted, as in cron.
+	domStar, dowStar bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7},
+}
+
+func parseCron(fields []string) (*cronSchedule, error) {
+	var sets [5]uint64
+	for i, f := range fields {
+		set, err := parseCronField(f, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %w", cronFields[i].name, f, err)
+		}
+		sets[i] = set
+	}
+	// Sunday is both 0 and 7.
+	if sets[4]&(1<<7) != 0 {
+		sets[4] |= 1
+	}
+	return &cronSchedule{
+		minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4],
+		domStar: fields[2] == "*", dowStar: fields[4] == "*",
+	}, nil
+}
+
+// parseCronField parses a comma separated list of *, values, ranges and
+// steps such as */15 or 1-5/2.
+func parseCronField(f string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(f, ",") {
+		rng, step := part, 1
+		if r, s, ok := strings.Cut(part, "/"); ok {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", s)
+			}
+			rng, step = r, n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = strconv.Atoi(a); err != nil {
+				return 0, fmt.Errorf("invalid value %q", a)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(b); err != nil {
+					return 0, fmt.Errorf("invalid value %q", b)
+				}
+			} else if step > 1 {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << v
+		}
+	}
+	return set, nil
+}
+
+func (c *cronSchedule) matches(t time.Time) bool {
+	return c.minute&(1<<t.Minute()) != 0 && c.hour&(1<<t.Hour()) != 0 &&
+		c.month&(1<<int(t.Month())) != 0 && c.dayMatches(t)
+}
+
+func (c *cronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<t.Day()) != 0
+	dow := c.dow&(1<<int(t.Weekday())) != 0
+	switch {
+	case c.domStar && c.dowStar:
+		return true
+	case c.domStar:
+		return dow
+	case c.dowStar:
+		return dom
+	}
+	return dom || dow
+}
+
+// next returns the first minute after t the schedule fires at, or the
+// zero time if it never does within five years, e.g. for February 30.
+func (c *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<int(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<t.Hour()) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case c.minute&(1<<t.Minute()) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// bits returns the set of cron values vs.
+func bits(vs ...int) uint64 {
+	var set uint64
+	for _, v := range vs {
+		set |= 1 << v
+	}
+	return set
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		name     string
+		field    string
+		min, max int
+		want     uint64
+		wantErr  string
+	}{
+		{name: "star", field: "*", min: 0, max: 23, want: 1<<24 - 1},
+		{name: "value", field: "7", min: 0, max: 59, want: bits(7)},
+		{name: "list", field: "1,3,10-12", min: 0, max: 59, want: bits(1, 3, 10, 11, 12)},
+		{name: "star step", field: "*/15", min: 0, max: 59, want: bits(0, 15, 30, 45)},
+		{name: "range step", field: "1-5/2", min: 0, max: 59, want: bits(1, 3, 5)},
+		{name: "value step runs to the end", field: "5/20", min: 0, max: 59, want: bits(5, 25, 45)},
+		{name: "star step from min", field: "*/10", min: 1, max: 31, want: bits(1, 11, 21, 31)},
+		{name: "zero step", field: "*/0", min: 0, max: 59, wantErr: "invalid step"},
+		{name: "bad step", field: "*/x", min: 0, max: 59, wantErr: "invalid step"},
+		{name: "bad value", field: "a", min: 0, max: 59, wantErr: "invalid value"},
+		{name: "bad range end", field: "1-b", min: 0, max: 59, wantErr: "invalid value"},
+		{name: "above max", field: "60", min: 0, max: 59, wantErr: "out of range"},
+		{name: "below min", field: "0", min: 1, max: 12, wantErr: "out of range"},
+		{name: "reversed range", field: "5-3", min: 0, max: 59, wantErr: "out of range"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCronField(tt.field, tt.min, tt.max)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseCronField(%q): %v, want %q", tt.field, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCronField(%q): %v", tt.field, err)
+			}
+			if got != tt.want {
+				t.Errorf("parseCronField(%q) = %b, want %b", tt.field, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		name    string
+		expr    string
+		want    cronSchedule
+		wantErr string
+	}{
+		{
+			name: "nightly",
+			expr: "0 2 * * *",
+			want: cronSchedule{minute: bits(0), hour: bits(2), dom: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+				17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31), month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12),
+				dow: bits(0, 1, 2, 3, 4, 5, 6, 7), domStar: true, dowStar: true},
+		},
+		{
+			name: "sunday as 0",
+			expr: "0 0 1 1 0",
+			want: cronSchedule{minute: bits(0), hour: bits(0), dom: bits(1), month: bits(1), dow: bits(0)},
+		},
+		{
+			name: "sunday as 7",
+			expr: "0 0 1 1 7",
+			want: cronSchedule{minute: bits(0), hour: bits(0), dom: bits(1), month: bits(1), dow: bits(0, 7)},
+		},
+		{
+			name: "weekdays",
+			expr: "30 9 * * 1-5",
+			want: cronSchedule{minute: bits(30), hour: bits(9), dom: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16,
+				17, 18, 19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31), month: bits(1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12),
+				dow: bits(1, 2, 3, 4, 5), domStar: true},
+		},
+		{name: "bad minute", expr: "60 * * * *", wantErr: "invalid minute"},
+		{name: "bad hour", expr: "* 24 * * *", wantErr: "invalid hour"},
+		{name: "bad day of month", expr: "* * 0 * *", wantErr: "invalid day of month"},
+		{name: "bad month", expr: "* * * 13 *", wantErr: "invalid month"},
+		{name: "bad day of week", expr: "* * * * 8", wantErr: "invalid day of week"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseCron(strings.Fields(tt.expr))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseCron(%q): %v, want %q", tt.expr, err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			if *got != tt.want {
+				t.Errorf("parseCron(%q) = %+v, want %+v", tt.expr, *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	// A Thursday.
+	from := time.Date(2026, 10, 15, 10, 7, 30, 0, time.UTC)
+	at := func(year int, month time.Month, day, hour, min int) time.Time {
+		return time.Date(year, month, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		expr string
+		want time.Time
+	}{
+		{name: "every minute", expr: "* * * * *", want: at(2026, 10, 15, 10, 8)},
+		{name: "minute step", expr: "*/15 * * * *", want: at(2026, 10, 15, 10, 15)},
+		{name: "hour range", expr: "0 12-14 * * *", want: at(2026, 10, 15, 12, 0)},
+		{name: "tomorrow", expr: "0 2 * * *", want: at(2026, 10, 16, 2, 0)},
+		{name: "next month", expr: "0 0 1 * *", want: at(2026, 11, 1, 0, 0)},
+		{name: "next year", expr: "0 0 1 3 *", want: at(2027, 3, 1, 0, 0)},
+		{name: "sunday as 0", expr: "0 0 * * 0", want: at(2026, 10, 18, 0, 0)},
+		{name: "sunday as 7", expr: "0 0 * * 7", want: at(2026, 10, 18, 0, 0)},
+		{name: "day of week only", expr: "0 0 * * 1", want: at(2026, 10, 19, 0, 0)},
+		{name: "day of month or week, week first", expr: "0 0 13 * 5", want: at(2026, 10, 16, 0, 0)},
+		{name: "day of month or week, month first", expr: "0 0 17 * 1", want: at(2026, 10, 17, 0, 0)},
+		{name: "leap day", expr: "0 0 29 2 *", want: at(2028, 2, 29, 0, 0)},
+		{name: "february 30", expr: "0 0 30 2 *"},
+		{name: "february 31 on a star weekday", expr: "0 0 31 2 *"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseCron(strings.Fields(tt.expr))
+			if err != nil {
+				t.Fatalf("parseCron(%q): %v", tt.expr, err)
+			}
+			if got := c.next(from); !got.Equal(tt.want) {
+				t.Errorf("next(%q) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInSchedule(t *testing.T) {
+	const key = "default/web"
+	// The tests run now, so the runs are placed relative to the minute
+	// they start in; an hour-long window keeps them apart from the next.
+	minute := func(off int) time.Time {
+		return time.Now().UTC().Truncate(time.Minute).Add(time.Duration(off) * time.Minute)
+	}
+	tests := []struct {
+		name     string
+		schedule string
+		// lastRun is the window start of the last run and running the
+		// start of the run still going, in minutes before the current
+		// one, or -1 for none.
+		lastRun, running int
+		want             bool
+		wantRun          bool
+	}{
+		{name: "window open", schedule: "* * * * * 1h", lastRun: -1, running: -1, want: true, wantRun: true},
+		{name: "never open", schedule: "0 0 30 2 * 1h", lastRun: -1, running: -1},
+		{name: "overlapping window skipped", schedule: "* * * * * 1h", lastRun: 2, running: -1},
+		{name: "same window continues", schedule: "* * * * * 1h", lastRun: 0, running: -1, want: true, wantRun: true},
+		{name: "window after the last run ended", schedule: "* * * * * 1h", lastRun: 61, running: -1, want: true, wantRun: true},
+		{name: "running capture keeps its window", schedule: "* * * * * 1h", lastRun: 2, running: 2, want: true},
+		{name: "running capture ends with its window", schedule: "0 0 30 2 * 1h", lastRun: 61, running: 61},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tm := newTestManager(t)
+			pod := tm.addPod("web", nil)
+			var lastRun time.Time
+			if tt.lastRun >= 0 {
+				lastRun = minute(-tt.lastRun)
+				tm.scheduleRuns[key] = lastRun
+			}
+			var cap *CaptureProcess
+			if tt.running >= 0 {
+				cap = &CaptureProcess{spec: captureSpec{Run: minute(-tt.running)}}
+			}
+			before := minute(0)
+			got := tm.inSchedule(pod, key, tt.schedule, cap)
+			if got != tt.want {
+				t.Fatalf("inSchedule = %v, want %v", got, tt.want)
+			}
+			if tt.wantRun {
+				if run := tm.scheduleRuns[key]; run.Before(before) {
+					t.Errorf("run starts at %v, want the current window", run)
+				}
+			} else if !tm.scheduleRuns[key].Equal(lastRun) {
+				t.Errorf("run moved to %v, want %v", tm.scheduleRuns[key], lastRun)
+			}
+		})
+	}
+}
+
+func TestInScheduleReportsInvalidSchedule(t *testing.T) {
+	tm := newTestManager(t)
+	pod := tm.addPod("web", nil)
+	if tm.inSchedule(pod, "default/web", "0 2 * * *", nil) {
+		t.Fatal("inSchedule = true for a schedule without a duration")
+	}
+	if e := tm.expectEvent(corev1.EventTypeWarning, reasonCaptureFailed); !strings.Contains(e, "cron expression and a duration") {
+		t.Errorf("Event %q does not explain the schedule", e)
+	}
+}
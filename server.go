@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const defaultHTTPAddr = ":8090"
+
+// fileInfo describes a single pcap file on disk.
+type fileInfo struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// sessionInfo groups the files written for one Pod, or for the node
+// capture, which has Node set instead of Pod.
+type sessionInfo struct {
+	Pod       string     `json:"pod,omitempty"`
+	Node      string     `json:"node,omitempty"`
+	Namespace string     `json:"namespace,omitempty"`
+	Active    bool       `json:"active"`
+	Files     []fileInfo `json:"files"`
+}
+
+// serveHTTP runs the agent HTTP server until ctx is cancelled. Capture
+// endpoints are only registered when the API token or Kubernetes
+// authorization is configured, since pcaps contain raw traffic. With a
+// serving certificate the server speaks HTTPS, and with a client CA every
+// endpoint but the health probes needs a client certificate.
+func (m *CaptureManager) serveHTTP(ctx context.Context, addr string) {
+	guard := func(h http.Handler) http.Handler { return h }
+	if m.cfg.TLSClientCA != "" {
+		guard = requireClientCert
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", guard(promhttp.Handler()))
+	mux.Handle("/healthz", healthHandler(m.livenessChecks))
+	mux.Handle("/readyz", healthHandler(m.readinessChecks))
+	if auth := newAPIAuth(m); auth != nil {
+		for path, h := range map[string]http.HandlerFunc{
+			"/captures":     m.handleListCaptures,
+			"/captures/":    m.handleDownload,
+			"/live/":        m.handleLive,
+			"/pods":         m.handlePods,
+			"/pods/":        m.handlePodAction,
+			"/v1/captures":  m.handleCaptures,
+			"/v1/captures/": m.handleCapture,
+			"/snapshots":    m.handleSnapshots,
+			"/snapshots/":   m.handleSnapshots,
+		} {
+			mux.Handle(path, guard(auth.wrap(h)))
+		}
+		if m.cfg.Profiling {
+			mux.Handle("/debug/pprof/", guard(auth.wrap(profilingHandler())))
+			mux.Handle("/debug/runtime", guard(auth.wrap(http.HandlerFunc(m.handleRuntime))))
+		}
+	} else {
+		slog.Warn("CAPTURE_API_TOKEN not set, capture download endpoints are disabled")
+		if m.cfg.Profiling {
+			slog.Warn("Profiling endpoints are disabled too, they need the same authentication")
+		}
+	}
+	if m.cfg.WebUI {
+		mux.Handle("/ui/", guard(webHandler()))
+	}
+
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	if m.cfg.TLSCert != "" {
+		certs, err := newServingCerts("api", m.cfg.TLSCert, m.cfg.TLSKey, m.cfg.TLSClientCA)
+		if err != nil {
+			slog.Error("HTTP server failed", "err", err)
+			return
+		}
+		srv.TLSConfig = certs.tlsConfig()
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	slog.Info("HTTP server listening", "addr", addr, "tls", srv.TLSConfig != nil)
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("HTTP server failed", "err", err)
+	}
+}
+
+// handleListCaptures returns active and completed sessions as JSON.
+func (m *CaptureManager) handleListCaptures(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sessions, err := m.listSessions()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(sessions)
+}
+
+// handleDownload serves /captures/<pod>/<file>, and the node capture's files
+// as /captures/<node>/<file>.
+func (m *CaptureManager) handleDownload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	pod, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/captures/"), "/")
+	if !ok || pod == "" || name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	// Only serve files that belong to the requested Pod or node. Pod
+	// files are found in their session directory by name.
+	path, cf, owned := m.captureFilePath(name)
+	owned = owned && cf.Pod == pod
+	if !owned && pod == m.nodeName && strings.HasPrefix(name, filepath.Base(m.nodePcapPath())) {
+		path, owned = filepath.Join(m.cfg.CaptureDir, name), true
+	}
+	if filepath.Base(name) != name || !owned {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	m.auditFiles(auditDownload, apiUser(r), r.RemoteAddr, "", path)
+	w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// listSessions groups the files in the capture directory by Pod and marks
+// the ones that belong to a running capture.
+func (m *CaptureManager) listSessions() ([]sessionInfo, error) {
+	matches, err := m.listCaptureFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	byPod := make(map[string]*sessionInfo)
+	m.mu.Lock()
+	_, nodeActive := m.captures[m.nodeName]
+	for key := range m.captures {
+		if ns, name, _, ok := splitCaptureKey(key); ok {
+			byPod[ns+"/"+name] = &sessionInfo{Pod: name, Namespace: ns, Active: true}
+		}
+	}
+	m.mu.Unlock()
+
+	for _, f := range matches {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		cf, _ := parseCaptureFile(filepath.Base(f))
+		s, ok := byPod[cf.Namespace+"/"+cf.Pod]
+		if !ok {
+			s = &sessionInfo{Pod: cf.Pod, Namespace: cf.Namespace}
+			byPod[cf.Namespace+"/"+cf.Pod] = s
+		}
+		s.Files = append(s.Files, fileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+	}
+
+	sessions := make([]sessionInfo, 0, len(byPod)+1)
+	for _, s := range byPod {
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].Pod != sessions[j].Pod {
+			return sessions[i].Pod < sessions[j].Pod
+		}
+		return sessions[i].Namespace < sessions[j].Namespace
+	})
+
+	node := sessionInfo{Node: m.nodeName, Active: nodeActive}
+	nodeFiles, _ := filepath.Glob(m.nodePcapPath() + "*")
+	for _, f := range nodeFiles {
+		if info, err := os.Stat(f); err == nil {
+			node.Files = append(node.Files, fileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+		}
+	}
+	if node.Active || len(node.Files) > 0 {
+		sessions = append(sessions, node)
+	}
+	return sessions, nil
+}
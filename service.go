@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"maps"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	discoverylisters "k8s.io/client-go/listers/discovery/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// serviceListers resolve the Services a Pod backs through their
+// EndpointSlices.
+type serviceListers struct {
+	services corelisters.ServiceLister
+	slices   discoverylisters.EndpointSliceLister
+}
+
+// watchServices sets up the informers for Services whose capture annotation
+// applies to their backing Pods, and returns their sync functions. Pods are
+// enqueued when a Service's annotations change and whenever its endpoints
+// churn, so new backends are captured and removed ones stopped.
+func (m *CaptureManager) watchServices(factory informers.SharedInformerFactory) []cache.InformerSynced {
+	svc := factory.Core().V1().Services()
+	slices := factory.Discovery().V1().EndpointSlices()
+	m.services = &serviceListers{services: svc.Lister(), slices: slices.Lister()}
+
+	svc.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: m.enqueueServicePods,
+		UpdateFunc: func(old, obj interface{}) {
+			if !maps.Equal(old.(*corev1.Service).Annotations, obj.(*corev1.Service).Annotations) {
+				m.enqueueServicePods(obj)
+			}
+		},
+		DeleteFunc: m.enqueueServicePods,
+	})
+	slices.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.enqueueSlicePods,
+		UpdateFunc: func(old, obj interface{}) { m.enqueueSlicePods(old); m.enqueueSlicePods(obj) },
+		DeleteFunc: m.enqueueSlicePods,
+	})
+	return []cache.InformerSynced{svc.Informer().HasSynced, slices.Informer().HasSynced}
+}
+
+func (m *CaptureManager) enqueueServicePods(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	svc, ok := obj.(*corev1.Service)
+	if !ok {
+		return
+	}
+	selector := labels.SelectorFromSet(labels.Set{discoveryv1.LabelServiceName: svc.Name})
+	slices, err := m.services.slices.EndpointSlices(svc.Namespace).List(selector)
+	if err != nil {
+		slog.Error("Failed to list endpoint slices of service", "namespace", svc.Namespace, "service", svc.Name, "err", err)
+		return
+	}
+	for _, slice := range slices {
+		m.enqueueEndpoints(slice)
+	}
+}
+
+// enqueueSlicePods enqueues the Pods of an EndpointSlice unless its Service
+// exists and is not annotated, which keeps endpoint churn of uncaptured
+// Services from reaching the workqueue.
+func (m *CaptureManager) enqueueSlicePods(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	slice, ok := obj.(*discoveryv1.EndpointSlice)
+	if !ok {
+		return
+	}
+	svc, err := m.services.services.Services(slice.Namespace).Get(slice.Labels[discoveryv1.LabelServiceName])
+	if err == nil {
+		if _, ok := svc.Annotations[annotationKey]; !ok {
+			return
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return
+	}
+	m.enqueueEndpoints(slice)
+}
+
+// enqueueEndpoints enqueues the Pods of slice that run on this node.
+func (m *CaptureManager) enqueueEndpoints(slice *discoveryv1.EndpointSlice) {
+	for _, ep := range slice.Endpoints {
+		if ep.NodeName == nil || *ep.NodeName != m.nodeName || ep.TargetRef == nil || ep.TargetRef.Kind != "Pod" {
+			continue
+		}
+		m.queue.Add(ep.TargetRef.Namespace + "/" + ep.TargetRef.Name)
+	}
+}
+
+// podService returns the annotated Service backed by pod, with the ports
+// its endpoints serve on the Pod. If several annotated Services select the
+// Pod, the first by name is used.
+func (m *CaptureManager) podService(pod *corev1.Pod) (*corev1.Service, []discoveryv1.EndpointPort) {
+	if m.services == nil {
+		return nil, nil
+	}
+	slices, err := m.services.slices.EndpointSlices(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil, nil
+	}
+	sort.Slice(slices, func(i, j int) bool { return slices[i].Name < slices[j].Name })
+	var found *corev1.Service
+	var ports []discoveryv1.EndpointPort
+	for _, slice := range slices {
+		if !sliceHasPod(slice, pod) {
+			continue
+		}
+		svc, err := m.services.services.Services(pod.Namespace).Get(slice.Labels[discoveryv1.LabelServiceName])
+		if err != nil {
+			continue
+		}
+		if _, ok := svc.Annotations[annotationKey]; !ok {
+			continue
+		}
+		if found == nil || svc.Name < found.Name {
+			found, ports = svc, nil
+		}
+		if svc.Name == found.Name {
+			ports = append(ports, slice.Ports...)
+		}
+	}
+	return found, ports
+}
+
+// sliceHasPod reports whether pod is an endpoint of slice, ready or not, so
+// captures survive failing readiness probes.
+func sliceHasPod(slice *discoveryv1.EndpointSlice, pod *corev1.Pod) bool {
+	for _, ep := range slice.Endpoints {
+		ref := ep.TargetRef
+		if ref != nil && ref.Kind == "Pod" && ref.Name == pod.Name && (ref.UID == "" || ref.UID == pod.UID) {
+			return true
+		}
+	}
+	return false
+}
+
+// servicePortFilter returns a BPF expression that matches the Service's
+// ports on the Pod, e.g. "(tcp port 8080 or udp port 53)".
+func servicePortFilter(ports []discoveryv1.EndpointPort) string {
+	seen := make(map[string]bool)
+	var terms []string
+	for _, p := range ports {
+		if p.Port == nil {
+			continue
+		}
+		proto := corev1.ProtocolTCP
+		if p.Protocol != nil {
+			proto = *p.Protocol
+		}
+		term := fmt.Sprintf("%s port %d", strings.ToLower(string(proto)), *p.Port)
+		if !seen[term] {
+			seen[term] = true
+			terms = append(terms, term)
+		}
+	}
+	sort.Strings(terms)
+	return portsFilter(terms)
+}
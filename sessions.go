@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Named sessions run next to a Pod's capture, each with its own filter,
+// files, status and lifecycle. tcpdump.antrea.io/<name> requests one with
+// its file count, and the option annotations with the same suffix, e.g.
+// filter.tcpdump.antrea.io/<name>, set its options. Named sessions are only
+// read from the Pod itself.
+
+// sessionNamePattern keeps session names usable in file names and label
+// values.
+var sessionNamePattern = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,30}[a-z0-9])?$`)
+
+// validSessionName reports whether name can name a session.
+func validSessionName(name string) error {
+	if !sessionNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid session name %q: must be up to 32 lowercase letters, digits and dashes", name)
+	}
+	return nil
+}
+
+// sessionKey returns the key of a capture of the Pod with key podKey; the
+// Pod's own capture has no session name.
+func sessionKey(podKey, session string) string {
+	if session == "" {
+		return podKey
+	}
+	return podKey + "/" + session
+}
+
+// splitCaptureKey splits the key of a Pod capture into the Pod's namespace,
+// name and session. It returns false for the node capture.
+func splitCaptureKey(key string) (namespace, pod, session string, ok bool) {
+	namespace, rest, ok := strings.Cut(key, "/")
+	if !ok {
+		return "", "", "", false
+	}
+	pod, session, _ = strings.Cut(rest, "/")
+	return namespace, pod, session, true
+}
+
+// sessionAnnotationKey returns the annotation key for session of one of the
+// capture's annotation keys.
+func sessionAnnotationKey(key, session string) string {
+	if session == "" {
+		return key
+	}
+	return key + "/" + session
+}
+
+// sessionNames returns the sessions named in annotations, whether requested
+// or only reported in a status annotation, sorted.
+func sessionNames(annotations map[string]string) []string {
+	var names []string
+	for k := range annotations {
+		for _, prefix := range []string{annotationKey + "/", statusAnnotationKey + "/"} {
+			if name, ok := strings.CutPrefix(k, prefix); ok && name != "" && !strings.Contains(name, "/") {
+				names = append(names, name)
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// sessionAnnotations returns the annotations of session without their
+// suffix, so they read like those of the Pod's own capture.
+func sessionAnnotations(annotations map[string]string, session string) (map[string]string, error) {
+	out := make(map[string]string)
+	if v, ok := annotations[sessionAnnotationKey(annotationKey, session)]; ok {
+		out[annotationKey] = v
+	}
+	for _, key := range podOptions {
+		v, ok := annotations[sessionAnnotationKey(key, session)]
+		if !ok {
+			continue
+		}
+		if key == peerAnnotationKey || key == scheduleAnnotationKey {
+			return nil, fmt.Errorf("%s is not supported for named sessions", key)
+		}
+		out[key] = v
+	}
+	return out, nil
+}
+
+// sessionEvent prefixes the message of an Event about a named session with
+// its name, since every session of a Pod records Events on the Pod.
+func sessionEvent(spec captureSpec, msg string) string {
+	if spec.Session == "" {
+		return msg
+	}
+	return fmt.Sprintf("Session %s: %s", spec.Session, msg)
+}
+
+// syncSessions starts and stops the named sessions of pod. Callers must
+// hold m.mu.
+func (m *CaptureManager) syncSessions(pod *corev1.Pod, allowed bool, reads *startReads) error {
+	podKey := pod.Namespace + "/" + pod.Name
+	names := sessionNames(pod.Annotations)
+	for key := range m.captures {
+		if ns, name, session, ok := splitCaptureKey(key); ok && session != "" && ns+"/"+name == podKey {
+			names = append(names, session)
+		}
+	}
+	slices.Sort(names)
+	var errs []error
+	for _, session := range slices.Compact(names) {
+		val, annotated := pod.Annotations[sessionAnnotationKey(annotationKey, session)]
+		errs = append(errs, m.syncSession(pod, session, val, annotated, allowed, reads))
+	}
+	return errors.Join(errs...)
+}
+
+// stopSessions stops every named session of the Pod with key podKey.
+// Callers must hold m.mu.
+func (m *CaptureManager) stopSessions(podKey string, purge, podExists bool) {
+	for key := range m.captures {
+		if ns, name, session, ok := splitCaptureKey(key); ok && session != "" && ns+"/"+name == podKey {
+			m.stopCapture(key, purge, podExists)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConfigMap keys understood by the agent.
+const (
+	settingDefaultFilter      = "defaultFilter"
+	settingRotateSizeMB       = "rotateSizeMB"
+	settingMaxFiles           = "maxFiles"
+	settingAllowedNamespaces  = "allowedNamespaces"
+	settingDeniedNamespaces   = "deniedNamespaces"
+	settingNodeQuotaMB        = "nodeQuotaMB"
+	settingDiskPressure       = "diskPressurePercent"
+	settingMaxCaptures        = "maxCaptures"
+	settingMaxWriteRateMB     = "maxWriteRateMB"
+	settingMaxClusterCaptures = "maxClusterCaptures"
+	settingMirrorDestinations = "mirrorDestinations"
+	settingCaptureGroups      = "captureGroups"
+)
+
+// Settings are the cluster-wide defaults operators can change at runtime
+// through the agent ConfigMap. They apply to captures started after the
+// change; namespace restrictions also stop running captures.
+type Settings struct {
+	// DefaultFilter is a BPF expression applied to every capture.
+	DefaultFilter string
+	// RotateSizeMB is the file size before tcpdump rotates.
+	RotateSizeMB int
+	// MaxFiles caps the file count a capture may request; 0 means no cap.
+	MaxFiles int
+	// AllowedNamespaces restricts captures to namespaces matching these
+	// patterns when set.
+	AllowedNamespaces map[string]bool
+	// DeniedNamespaces forbids captures in namespaces matching these
+	// patterns, even if they are allowed.
+	DeniedNamespaces map[string]bool
+	// NodeQuotaMB caps the disk all captures on a node may use; 0 means no
+	// quota.
+	NodeQuotaMB int
+	// DiskPressurePercent is the capture filesystem utilization above
+	// which completed captures are evicted; 0 disables eviction.
+	DiskPressurePercent int
+	// MaxCaptures caps the captures running on a node at a time; further
+	// requests wait for a slot. 0 means no limit.
+	MaxCaptures int
+	// MaxWriteRateMB caps the MB per second every capture writes to
+	// disk; 0 means no cap.
+	MaxWriteRateMB float64
+	// MaxClusterCaptures caps the Pod captures the cluster controller
+	// assigns at a time; further ones wait for a slot. 0 means no limit.
+	MaxClusterCaptures int
+	// MirrorDestinations are the networks mirror captures may send
+	// packets to; none disables mirroring.
+	MirrorDestinations []*net.IPNet
+	// NamespaceQuotas limit the captures of namespaces across the
+	// cluster.
+	NamespaceQuotas []namespaceQuota
+	// CaptureGroups maps each group allowed to request captures to the
+	// namespace patterns it may capture in; empty lets everyone capture.
+	CaptureGroups map[string]map[string]bool
+}
+
+// defaultSettings are used while the ConfigMap does not exist.
+func (c *Config) defaultSettings() *Settings {
+	return &Settings{RotateSizeMB: c.RotateSizeMB, NodeQuotaMB: c.NodeQuotaMB, DiskPressurePercent: c.DiskPressurePercent, MaxCaptures: c.MaxCaptures}
+}
+
+// namespaceAllowed reports whether captures may run in ns.
+func (s *Settings) namespaceAllowed(ns string) bool {
+	if matchNamespace(s.DeniedNamespaces, ns) {
+		return false
+	}
+	return len(s.AllowedNamespaces) == 0 || matchNamespace(s.AllowedNamespaces, ns)
+}
+
+// matchNamespace reports whether ns matches one of patterns, namespace names
+// or shell patterns such as team-*.
+func matchNamespace(patterns map[string]bool, ns string) bool {
+	if patterns[ns] {
+		return true
+	}
+	for p := range patterns {
+		if ok, _ := path.Match(p, ns); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNamespacePatterns parses the namespace list of key.
+func parseNamespacePatterns(key, v string) (map[string]bool, error) {
+	patterns := splitList(v)
+	for p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("%s has an invalid pattern %q", key, p)
+		}
+	}
+	return patterns, nil
+}
+
+// parseSettings builds Settings from ConfigMap data on top of defaults.
+func parseSettings(data map[string]string, defaults *Settings) (*Settings, error) {
+	s := *defaults
+	s.DefaultFilter = strings.TrimSpace(data[settingDefaultFilter])
+
+	if v := strings.TrimSpace(data[settingRotateSizeMB]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("%s must be a positive integer, got %q", settingRotateSizeMB, v)
+		}
+		s.RotateSizeMB = n
+	}
+	if v := strings.TrimSpace(data[settingMaxFiles]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer, got %q", settingMaxFiles, v)
+		}
+		s.MaxFiles = n
+	}
+	if v := strings.TrimSpace(data[settingNodeQuotaMB]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer, got %q", settingNodeQuotaMB, v)
+		}
+		s.NodeQuotaMB = n
+	}
+	if v := strings.TrimSpace(data[settingDiskPressure]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 100 {
+			return nil, fmt.Errorf("%s must be a percentage, got %q", settingDiskPressure, v)
+		}
+		s.DiskPressurePercent = n
+	}
+	if v := strings.TrimSpace(data[settingMaxClusterCaptures]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer, got %q", settingMaxClusterCaptures, v)
+		}
+		s.MaxClusterCaptures = n
+	}
+	if v := strings.TrimSpace(data[settingMaxWriteRateMB]); v != "" {
+		mb, err := strconv.ParseFloat(v, 64)
+		if err != nil || mb < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative number, got %q", settingMaxWriteRateMB, v)
+		}
+		s.MaxWriteRateMB = mb
+	}
+	if v := strings.TrimSpace(data[settingMaxCaptures]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s must be a non-negative integer, got %q", settingMaxCaptures, v)
+		}
+		s.MaxCaptures = n
+	}
+	for v := range splitList(data[settingMirrorDestinations]) {
+		if !strings.Contains(v, "/") {
+			if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+				v += "/32"
+			} else {
+				v += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s has an invalid network %q", settingMirrorDestinations, v)
+		}
+		s.MirrorDestinations = append(s.MirrorDestinations, n)
+	}
+	var err error
+	if s.NamespaceQuotas, err = parseNamespaceQuotas(data[settingNamespaceQuotas]); err != nil {
+		return nil, err
+	}
+	if s.AllowedNamespaces, err = parseNamespacePatterns(settingAllowedNamespaces, data[settingAllowedNamespaces]); err != nil {
+		return nil, err
+	}
+	if s.DeniedNamespaces, err = parseNamespacePatterns(settingDeniedNamespaces, data[settingDeniedNamespaces]); err != nil {
+		return nil, err
+	}
+	if s.CaptureGroups, err = parseCaptureGroups(data[settingCaptureGroups]); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// parseCaptureGroups parses the captureGroups setting, one group per line
+// followed by a colon and its namespace patterns:
+//
+//	sre: *
+//	team-a-oncall: team-a-*, shared
+//
+// Group names may contain colons themselves, namespaces cannot.
+func parseCaptureGroups(v string) (map[string]map[string]bool, error) {
+	var groups map[string]map[string]bool
+	for _, line := range strings.Split(v, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		i := strings.LastIndex(line, ":")
+		group := ""
+		if i >= 0 {
+			group = strings.TrimSpace(line[:i])
+		}
+		if group == "" {
+			return nil, fmt.Errorf("%s line %q must be <group>: <namespaces>", settingCaptureGroups, strings.TrimSpace(line))
+		}
+		patterns, err := parseNamespacePatterns(settingCaptureGroups, line[i+1:])
+		if err != nil {
+			return nil, err
+		}
+		if groups == nil {
+			groups = make(map[string]map[string]bool)
+		}
+		if groups[group] == nil {
+			groups[group] = make(map[string]bool)
+		}
+		maps.Copy(groups[group], patterns)
+	}
+	return groups, nil
+}
+
+// groupsAllowed reports whether one of groups may capture in ns. Node
+// captures, with an empty ns, need a group allowed every namespace.
+func (s *Settings) groupsAllowed(groups []string, ns string) bool {
+	for _, g := range groups {
+		if matchNamespace(s.CaptureGroups[g], ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList parses a comma or newline separated list into a set.
+func splitList(v string) map[string]bool {
+	set := make(map[string]bool)
+	for _, f := range strings.FieldsFunc(v, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if f = strings.TrimSpace(f); f != "" {
+			set[f] = true
+		}
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return set
+}
+
+// settings returns the settings currently in effect.
+func (m *CaptureManager) settings() *Settings {
+	return m.currentSettings.Load()
+}
+
+// watchSettings keeps m.currentSettings in sync with the agent ConfigMap.
+// An invalid ConfigMap is logged and ignored so the last good settings stay
+// in effect.
+func (m *CaptureManager) watchSettings(ctx context.Context) {
+	m.currentSettings.Store(m.cfg.defaultSettings())
+	if m.cfg.ConfigMap == "" {
+		return
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(m.clientset, 0,
+		informers.WithNamespace(m.cfg.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.FieldSelector = fields.OneTermEqualSelector("metadata.name", m.cfg.ConfigMap).String()
+		}),
+	)
+	inf := factory.Core().V1().ConfigMaps().Informer()
+	inf.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    func(obj interface{}) { m.applySettings(obj.(*corev1.ConfigMap).Data) },
+		UpdateFunc: func(_, obj interface{}) { m.applySettings(obj.(*corev1.ConfigMap).Data) },
+		DeleteFunc: func(interface{}) { m.applySettings(nil) },
+	})
+	factory.Start(ctx.Done())
+	if !cache.WaitForCacheSync(ctx.Done(), inf.HasSynced) {
+		slog.Error("Failed to sync ConfigMap informer", "configMap", m.cfg.ConfigMap)
+	}
+}
+
+func (m *CaptureManager) applySettings(data map[string]string) {
+	s, err := parseSettings(data, m.cfg.defaultSettings())
+	if err != nil {
+		slog.Error("Ignoring invalid settings", "configMap", m.cfg.ConfigMap, "err", err)
+		return
+	}
+	m.currentSettings.Store(s)
+	slog.Info("Settings reloaded", "configMap", m.cfg.ConfigMap, "defaultFilter", s.DefaultFilter,
+		"rotateSizeMB", s.RotateSizeMB, "maxFiles", s.MaxFiles, "nodeQuotaMB", s.NodeQuotaMB,
+		"diskPressurePercent", s.DiskPressurePercent, "maxCaptures", s.MaxCaptures,
+		"maxWriteRateMB", s.MaxWriteRateMB, "maxClusterCaptures", s.MaxClusterCaptures,
+		"mirrorDestinations", len(s.MirrorDestinations), "namespaceQuotas", len(s.NamespaceQuotas),
+		"allowedNamespaces", len(s.AllowedNamespaces), "deniedNamespaces", len(s.DeniedNamespaces),
+		"captureGroups", len(s.CaptureGroups))
+	m.enqueueAll()
+}
+
+// enqueueAll re-evaluates every Pod on the node, e.g. after a settings
+// change.
+func (m *CaptureManager) enqueueAll() {
+	if !m.synced.Load() {
+		return
+	}
+	pods, err := m.podLister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, pod := range pods {
+		m.enqueuePod(pod)
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/sets"
+)
+
+// statePending is reported while a capture waits for a free slot under the
+// limit on concurrent captures.
+const statePending = "pending"
+
+const reasonCapturePending = "CapturePending"
+
+// runningCaptures counts the captures holding a slot. Completed captures
+// have stopped capturing; exited ones keep their slot until they restart.
+// Callers must hold m.mu.
+func (m *CaptureManager) runningCaptures() int {
+	n := 0
+	for _, cap := range m.captures {
+		if !cap.completed.Load() {
+			n++
+		}
+	}
+	return n
+}
+
+// pendingCapture is a capture waiting for a slot.
+type pendingCapture struct {
+	since    time.Time
+	priority string
+}
+
+// waitForSlot reports whether the capture of spec with key has to wait for
+// a slot, and its position in the queue if so. Captures of a higher
+// priority class start first, and within a class in the order they were
+// first requested, so a new request cannot overtake waiting ones. A
+// capture that would have to wait preempts running captures of a lower
+// class instead. Callers must hold m.mu.
+func (m *CaptureManager) waitForSlot(key string, spec captureSpec) (int, bool) {
+	limit := m.settings().MaxCaptures
+	if limit <= 0 {
+		m.leaveQueue(key)
+		return 0, false
+	}
+	m.enterQueue(key, spec.Priority)
+	pos := slices.Index(m.pendingQueue(), key)
+	for pos >= limit-m.runningCaptures() {
+		if !m.preempt(spec, captureName(spec)) {
+			return pos + 1, true
+		}
+	}
+	m.leaveQueue(key)
+	return 0, false
+}
+
+// enterQueue adds key to the captures waiting for a slot, or updates its
+// priority class if it waits already. Callers must hold m.mu.
+func (m *CaptureManager) enterQueue(key, priority string) {
+	if p, ok := m.pending[key]; !ok || p.priority != priority {
+		if !ok {
+			p.since = time.Now()
+		}
+		m.pending[key] = pendingCapture{since: p.since, priority: priority}
+		pendingCaptures.Set(float64(len(m.pending)))
+	}
+}
+
+// pendingQueue returns the keys of the waiting captures in the order they
+// get a slot. Callers must hold m.mu.
+func (m *CaptureManager) pendingQueue() []string {
+	queue := make([]string, 0, len(m.pending))
+	for k := range m.pending {
+		queue = append(queue, k)
+	}
+	slices.SortFunc(queue, func(a, b string) int {
+		pa, pb := m.pending[a], m.pending[b]
+		if c := cmp.Compare(priorityRank(pb.priority), priorityRank(pa.priority)); c != 0 {
+			return c
+		}
+		if c := pa.since.Compare(pb.since); c != 0 {
+			return c
+		}
+		return cmp.Compare(a, b)
+	})
+	return queue
+}
+
+// leaveQueue removes key from the captures waiting for a slot, moving up
+// those behind it. Callers must hold m.mu.
+func (m *CaptureManager) leaveQueue(key string) {
+	if _, ok := m.pending[key]; !ok {
+		return
+	}
+	delete(m.pending, key)
+	pendingCaptures.Set(float64(len(m.pending)))
+	m.requeuePending()
+}
+
+// leavePodQueue removes the Pod with key podKey and its named sessions from
+// the captures waiting for a slot, e.g. when the Pod stops running. Callers
+// must hold m.mu.
+func (m *CaptureManager) leavePodQueue(podKey string) {
+	for key := range m.pending {
+		if ns, name, _, ok := splitCaptureKey(key); ok && ns+"/"+name == podKey {
+			m.leaveQueue(key)
+		}
+	}
+}
+
+// requeuePending lets the waiting captures try again, e.g. once a capture
+// stopped or completed. Callers must hold m.mu.
+func (m *CaptureManager) requeuePending() {
+	queued := sets.New[string]()
+	for key := range m.pending {
+		// Named sessions are synced with their Pod.
+		if ns, name, _, ok := splitCaptureKey(key); ok {
+			key = ns + "/" + name
+		}
+		if !queued.Has(key) {
+			queued.Insert(key)
+			m.queue.Add(key)
+		}
+	}
+}
+
+// reportPending records that a capture waits for a slot: a
+// CapturePending Event when it starts waiting, and its position in the
+// status annotation whenever that changes. Callers must hold m.mu.
+func (m *CaptureManager) reportPending(ref *corev1.ObjectReference, current captureStatus, spec captureSpec, pos int) error {
+	limit := m.settings().MaxCaptures
+	msg := fmt.Sprintf("waiting for a capture slot, position %d in the queue; %d captures run on this node at a time", pos, limit)
+	if current.State == statePending && current.Message == msg && current.Priority == spec.Priority {
+		return nil
+	}
+	if current.State != statePending {
+		slog.Info("Capture waiting for a slot", "namespace", spec.Namespace, "pod", spec.PodName, "name", spec.Session, "position", pos)
+		m.recorder.Event(ref, corev1.EventTypeNormal, reasonCapturePending, sessionEvent(spec,
+			fmt.Sprintf("Waiting for one of the %d capture slots of node %s", limit, m.nodeName)))
+	}
+	m.patchStatus(ref, captureStatus{State: statePending, Node: m.nodeName, Session: spec.Session, Priority: spec.Priority,
+		PreemptedBy: current.PreemptedBy, Message: msg})
+	return nil
+}
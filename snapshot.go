@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// snapshotAnnotationKey asks for a snapshot of the last given duration
+	// of a running capture. The agent removes it once seen.
+	snapshotAnnotationKey = "snapshot." + annotationKey
+	// snapshotDirName is the directory under --capture-dir snapshots are
+	// saved in. Retention, the janitor and garbage collection ignore it.
+	snapshotDirName = "snapshots"
+	// snapshotManifestName is the manifest in every snapshot directory.
+	snapshotManifestName = "manifest.json"
+	// snapshotSettle is how long a snapshot waits for the capture to finish
+	// its current file.
+	snapshotSettle = time.Second
+)
+
+// snapshotManifest describes a snapshot: the capture it was taken of, the
+// window it covers and the checksums of the copied files.
+type snapshotManifest struct {
+	Name      string         `json:"name"`
+	Namespace string         `json:"namespace"`
+	Pod       string         `json:"pod"`
+	Node      string         `json:"node"`
+	SessionID string         `json:"sessionID"`
+	From      time.Time      `json:"from"`
+	To        time.Time      `json:"to"`
+	Files     []snapshotFile `json:"files"`
+}
+
+type snapshotFile struct {
+	Name    string    `json:"name"`
+	SHA256  string    `json:"sha256"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	// Packets, FirstPacket and LastPacket are copied from the capture's
+	// manifest for files the capture had finished.
+	Packets     int        `json:"packets,omitempty"`
+	FirstPacket *time.Time `json:"firstPacket,omitempty"`
+	LastPacket  *time.Time `json:"lastPacket,omitempty"`
+}
+
+// snapshotRequest is the body of POST /v1/captures/<id>/snapshot.
+type snapshotRequest struct {
+	Last string `json:"last"`
+}
+
+func (m *CaptureManager) snapshotDir() string {
+	return filepath.Join(m.cfg.CaptureDir, snapshotDirName)
+}
+
+// requestSnapshot handles the snapshot annotation of the Pod or Node ref,
+// whose capture has key. The annotation is removed first, so resyncs do
+// not take the snapshot again; the copy runs in the background.
+func (m *CaptureManager) requestSnapshot(ref *corev1.ObjectReference, key, v string) {
+	if err := m.removeAnnotation(ref, snapshotAnnotationKey); err != nil {
+		slog.Error("Failed to remove snapshot annotation", "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name, "err", err)
+		return
+	}
+	m.mu.Lock()
+	cap := m.captures[key]
+	m.mu.Unlock()
+	last, err := time.ParseDuration(strings.TrimSpace(v))
+	if err != nil || last <= 0 {
+		m.recorder.Eventf(ref, corev1.EventTypeWarning, reasonSnapshotFailed, "Invalid %s annotation value %q: must be a duration", snapshotAnnotationKey, v)
+		return
+	}
+	if cap == nil {
+		m.recorder.Event(ref, corev1.EventTypeWarning, reasonSnapshotFailed, "No capture is running to take a snapshot of")
+		return
+	}
+	go func() {
+		if _, err := m.takeSnapshot(cap, last); err != nil {
+			cap.log.Warn("Snapshot failed", "err", err)
+			m.recorder.Eventf(cap.ref, corev1.EventTypeWarning, reasonSnapshotFailed, "Snapshot failed: %v", err)
+		}
+	}()
+}
+
+// takeSnapshot copies the files of cap holding packets of the last
+// duration into a new snapshot directory. The capture keeps running and
+// rotating; it is asked to start a new file first, so the copies include
+// the packets it buffered. Finished files are picked by the packet window
+// the capture's manifest records for them, the file in progress by its
+// modification time.
+func (m *CaptureManager) takeSnapshot(cap *CaptureProcess, last time.Duration) (*snapshotManifest, error) {
+	if cap.spec.Rotate != nil {
+		cap.spec.Rotate.request()
+		time.Sleep(snapshotSettle)
+	}
+	to := time.Now().UTC()
+	from := to.Add(-last)
+	windows := packetWindows(cap)
+	var sources []string
+	for _, pattern := range cap.files {
+		matches, _ := filepath.Glob(pattern + "*")
+		for _, f := range matches {
+			info, err := os.Stat(f)
+			if err != nil || !snapshotSource(f) {
+				continue
+			}
+			if e, ok := windows[filepath.Base(f)]; ok {
+				if !e.LastPacket.Before(from) {
+					sources = append(sources, f)
+				}
+			} else if !info.ModTime().Before(from) {
+				sources = append(sources, f)
+			}
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no packets were written in the last %s", last)
+	}
+
+	name := fmt.Sprintf("%s_%s", cap.spec.Namespace, cap.spec.PodName)
+	if cap.spec.PodName == "" {
+		name = "node-" + cap.spec.Node
+	}
+	snap := &snapshotManifest{
+		Name:      name + "-" + to.Format("20060102T150405Z"),
+		Namespace: cap.spec.Namespace,
+		Pod:       cap.spec.PodName,
+		Node:      cap.spec.Node,
+		SessionID: cap.sessionID,
+		From:      from,
+		To:        to,
+	}
+	dir := filepath.Join(m.snapshotDir(), snap.Name)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	for _, src := range sources {
+		f, err := copySnapshotFile(src, filepath.Join(dir, filepath.Base(src)))
+		if err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+		if e, ok := windows[f.Name]; ok {
+			f.Packets, f.FirstPacket, f.LastPacket = e.Packets, &e.FirstPacket, &e.LastPacket
+		}
+		snap.Files = append(snap.Files, f)
+	}
+	sort.Slice(snap.Files, func(i, j int) bool { return snap.Files[i].ModTime.Before(snap.Files[j].ModTime) })
+	if err := writeFileAtomic(filepath.Join(dir, snapshotManifestName), snap); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	cap.log.Info("Snapshot saved", "snapshot", snap.Name, "files", len(snap.Files), "last", last)
+	m.recorder.Eventf(cap.ref, corev1.EventTypeNormal, reasonSnapshotSaved,
+		"Saved %d files covering the last %s as snapshot %s", len(snap.Files), last, snap.Name)
+	return snap, nil
+}
+
+// removeAnnotation removes the annotation key from the Pod or Node ref.
+func (m *CaptureManager) removeAnnotation(ref *corev1.ObjectReference, key string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"annotations": map[string]interface{}{key: nil}},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if ref.Kind == "Node" {
+		_, err = m.clientset.CoreV1().Nodes().Patch(ctx, ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = m.clientset.CoreV1().Pods(ref.Namespace).Patch(ctx, ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	return err
+}
+
+// packetWindows returns the manifest entries of the files cap finished in
+// its session, by file name.
+func packetWindows(cap *CaptureProcess) map[string]manifestEntry {
+	windows := make(map[string]manifestEntry)
+	for _, pattern := range cap.files {
+		matches, _ := filepath.Glob(pattern + "*" + manifestSuffix)
+		for _, f := range matches {
+			var manifest sessionManifest
+			data, err := os.ReadFile(f)
+			if err != nil || json.Unmarshal(data, &manifest) != nil || manifest.SessionID != cap.sessionID {
+				continue
+			}
+			for _, e := range manifest.Files {
+				windows[e.Name] = e
+			}
+		}
+	}
+	return windows
+}
+
+// snapshotSource reports whether f holds packets worth copying: a ring
+// file or its compressed copy, but not a file still being compressed.
+func snapshotSource(f string) bool {
+	return !strings.HasSuffix(f, compressSuffix) && !strings.HasSuffix(f, manifestSuffix) && !strings.HasSuffix(f, reportSuffix) && !strings.HasSuffix(f, reportHTMLSuffix) && !strings.HasSuffix(f, alertsSuffix) && !strings.HasSuffix(f, ".tmp")
+}
+
+// copySnapshotFile copies src to dst, keeping its modification time, and
+// returns the copy's checksum.
+func copySnapshotFile(src, dst string) (snapshotFile, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return snapshotFile{}, err
+	}
+	w := newHashingWriter(out)
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		return snapshotFile{}, err
+	}
+	if err := out.Close(); err != nil {
+		return snapshotFile{}, err
+	}
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
+	return snapshotFile{Name: filepath.Base(dst), SHA256: w.sum(), Size: int64(w.n), ModTime: info.ModTime().UTC()}, nil
+}
+
+// listSnapshots returns the manifests of all snapshots on the node.
+func (m *CaptureManager) listSnapshots() []snapshotManifest {
+	matches, _ := filepath.Glob(filepath.Join(m.snapshotDir(), "*", snapshotManifestName))
+	out := make([]snapshotManifest, 0, len(matches))
+	for _, f := range matches {
+		var snap snapshotManifest
+		if data, err := os.ReadFile(f); err == nil && json.Unmarshal(data, &snap) == nil {
+			out = append(out, snap)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].To.Before(out[j].To) })
+	return out
+}
+
+// snapshotUsage returns the bytes all snapshots take up.
+func (m *CaptureManager) snapshotUsage() int64 {
+	var used int64
+	filepath.WalkDir(m.snapshotDir(), func(_ string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				used += info.Size()
+			}
+		}
+		return nil
+	})
+	return used
+}
+
+// handleSnapshots serves GET /snapshots, GET /snapshots/<name>/<file> and
+// DELETE /snapshots/<name>.
+func (m *CaptureManager) handleSnapshots(w http.ResponseWriter, r *http.Request) {
+	name, file, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/snapshots"), "/"), "/")
+	if name != "" && (filepath.Base(name) != name || name == "..") || file != "" && filepath.Base(file) != file {
+		http.NotFound(w, r)
+		return
+	}
+	dir := filepath.Join(m.snapshotDir(), name)
+	switch {
+	case r.Method == http.MethodGet && name == "":
+		writeJSON(w, http.StatusOK, m.listSnapshots())
+	case r.Method == http.MethodGet && file != "":
+		f, err := os.Open(filepath.Join(dir, file))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+		m.auditFiles(auditDownload, apiUser(r), r.RemoteAddr, "snapshot "+name, filepath.Join(dir, file))
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", file))
+		http.ServeContent(w, r, file, info.ModTime(), f)
+	case r.Method == http.MethodDelete && name != "" && file == "":
+		if _, err := os.Stat(filepath.Join(dir, snapshotManifestName)); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		m.auditFiles(auditDelete, apiUser(r), r.RemoteAddr, "snapshot "+name, files...)
+		if err := os.RemoveAll(dir); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		slog.Info("Deleted snapshot", "snapshot", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// snapshotCapture serves POST /v1/captures/<id>/snapshot.
+func (m *CaptureManager) snapshotCapture(w http.ResponseWriter, r *http.Request, id string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req snapshotRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	last, err := time.ParseDuration(req.Last)
+	if err != nil || last <= 0 {
+		http.Error(w, "last must be a positive duration", http.StatusBadRequest)
+		return
+	}
+	var cap *CaptureProcess
+	m.mu.Lock()
+	for key, c := range m.captures {
+		if c.sessionID == id && strings.Contains(key, "/") {
+			cap = c
+		}
+	}
+	m.mu.Unlock()
+	if cap == nil {
+		http.Error(w, "capture not found", http.StatusNotFound)
+		return
+	}
+	snap, err := m.takeSnapshot(cap, last)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	writeJSON(w, http.StatusCreated, snap)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stateFileName      = ".capture-state.json"
+	leakedProcessGrace = 5 * time.Second
+	leakedProcessPoll  = 100 * time.Millisecond
+)
+
+// persistedSession is the on-disk record of a running capture, enough to
+// find its tcpdump process and files after the agent restarts.
+type persistedSession struct {
+	Key       string    `json:"key"`
+	SessionID string    `json:"sessionID"`
+	PID       int       `json:"pid"`
+	Args      []string  `json:"args"`
+	Files     []string  `json:"files"`
+	StartTime time.Time `json:"startTime"`
+	// Processes lists every process of a capture of several interfaces.
+	Processes []persistedProcess `json:"processes,omitempty"`
+	// Started is when the session started, which its file names carry.
+	Started time.Time `json:"started,omitempty"`
+}
+
+// resumedSession is a session recovered from the state file or kept
+// across a restart, so the replacement capture continues it.
+type resumedSession struct {
+	ID    string
+	Start time.Time
+}
+
+type persistedProcess struct {
+	PID  int      `json:"pid"`
+	Args []string `json:"args"`
+}
+
+func (m *CaptureManager) stateFilePath() string {
+	return filepath.Join(m.cfg.CaptureDir, stateFileName)
+}
+
+// saveState writes the running captures to the state file. It is written to
+// a temporary file first so a crash never leaves a truncated state behind.
+// Callers must hold m.mu.
+func (m *CaptureManager) saveState() {
+	sessions := make([]persistedSession, 0, len(m.captures))
+	for key, cap := range m.captures {
+		if cap.proc == nil || cap.exited.Load() || cap.completed.Load() {
+			continue
+		}
+		s := persistedSession{
+			Key:       key,
+			SessionID: cap.sessionID,
+			PID:       cap.proc.PID(),
+			Args:      cap.proc.Args(),
+			Files:     cap.files,
+			StartTime: cap.startTime,
+			Started:   cap.spec.Started,
+		}
+		if mc, ok := cap.proc.(*multiCapture); ok {
+			s.Processes = mc.Processes()
+		}
+		sessions = append(sessions, s)
+	}
+	data, err := json.Marshal(sessions)
+	if err != nil {
+		return
+	}
+	tmp := m.stateFilePath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		slog.Error("Failed to write capture state", "err", err)
+		return
+	}
+	if err := os.Rename(tmp, m.stateFilePath()); err != nil {
+		slog.Error("Failed to write capture state", "err", err)
+	}
+}
+
+// recoverState loads the state left by a previous agent instance. tcpdump
+// processes that outlived it are terminated so the workqueue can start
+// fresh ones without double-capturing, and their session IDs are kept so
+// the replacement captures continue the same session.
+func (m *CaptureManager) recoverState() {
+	data, err := os.ReadFile(m.stateFilePath())
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to read capture state", "err", err)
+		return
+	}
+	var sessions []persistedSession
+	if err := json.Unmarshal(data, &sessions); err != nil {
+		slog.Error("Ignoring corrupt capture state", "err", err)
+		return
+	}
+
+	for _, s := range sessions {
+		m.resumedSessions[s.Key] = resumedSession{ID: s.SessionID, Start: s.Started}
+		procs := s.Processes
+		if len(procs) == 0 {
+			procs = []persistedProcess{{PID: s.PID, Args: s.Args}}
+		}
+		for _, p := range procs {
+			if !processMatches(p.PID, p.Args) {
+				continue
+			}
+			logger := slog.With("key", s.Key, "session", s.SessionID, "pid", p.PID)
+			logger.Info("Terminating tcpdump left by previous agent instance")
+			if err := terminateProcess(p.PID); err != nil {
+				logger.Error("Failed to terminate leaked tcpdump", "err", err)
+			}
+		}
+	}
+}
+
+// processMatches reports whether pid is alive and runs exactly args, so a
+// recycled PID is never signalled.
+func processMatches(pid int, args []string) bool {
+	cmdline, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return false
+	}
+	got := strings.Split(string(bytes.TrimRight(cmdline, "\x00")), "\x00")
+	if len(got) != len(args) {
+		return false
+	}
+	for i := range args {
+		// The first argument may be a resolved path rather than the name.
+		if i == 0 && filepath.Base(got[0]) == filepath.Base(args[0]) {
+			continue
+		}
+		if got[i] != args[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+)
+
+// terminateProcess sends SIGTERM, waits for the process to go away and
+// escalates to SIGKILL after a grace period.
+func terminateProcess(pid int) error {
+	if err := syscall.Kill(pid, syscall.SIGTERM); err != nil {
+		return err
+	}
+	deadline := time.Now().Add(leakedProcessGrace)
+	for time.Now().Before(deadline) {
+		// Reap the process in case it was reparented to us.
+		var ws syscall.WaitStatus
+		syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+		if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+			return nil
+		}
+		time.Sleep(leakedProcessPoll)
+	}
+	return syscall.Kill(pid, syscall.SIGKILL)
+}
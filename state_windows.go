@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+// terminateProcess kills the process and waits for it to go away. Windows
+// has no signal a program could flush its buffers on.
+func terminateProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	defer p.Release()
+	if err := p.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		p.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-time.After(leakedProcessGrace):
+		return errors.New("process did not exit")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// statsInterval is how often running captures refresh their kernel
+// counters.
+const statsInterval = 10 * time.Second
+
+// captureStats counts the packets of a capture run. It is reported in the
+// status annotation and the metrics.
+type captureStats struct {
+	// Captured counts the packets written to the files.
+	Captured uint64 `json:"captured"`
+	// Received counts the packets the kernel handed to the capture.
+	Received uint64 `json:"received"`
+	// Dropped counts the packets the kernel dropped because the capture
+	// did not read them in time.
+	Dropped uint64 `json:"dropped"`
+	// RateLimited counts the packets left out of the files because the
+	// capture was over its write rate.
+	RateLimited uint64 `json:"rateLimited,omitempty"`
+}
+
+// packetStats is updated by the capture while it runs and read by the
+// status reporter.
+type packetStats struct {
+	captured    atomic.Uint64
+	received    atomic.Uint64
+	dropped     atomic.Uint64
+	rateLimited atomic.Uint64
+	// written counts the bytes written to the files, and meter the
+	// resources the capture uses, for its cost.
+	written atomic.Uint64
+	meter   costMeter
+}
+
+func (s *packetStats) snapshot() captureStats {
+	return captureStats{Captured: s.captured.Load(), Received: s.received.Load(), Dropped: s.dropped.Load(), RateLimited: s.rateLimited.Load()}
+}
+
+// tcpdumpStatsPattern matches the counters tcpdump prints on SIGUSR1 and
+// when it exits, either on one line or one per line.
+var tcpdumpStatsPattern = regexp.MustCompile(`(\d+) packets? (received by filter|dropped by kernel)`)
+
+// dumpcapStatsPattern matches the counters dumpcap prints when it exits.
+var dumpcapStatsPattern = regexp.MustCompile(`Packets received/dropped on interface .*: (\d+)/(\d+)`)
+
+// tcpdumpStderr reads the standard error of tcpdump or dumpcap. Statistics update stats;
+// everything else is logged.
+type tcpdumpStderr struct {
+	stats *packetStats
+	log   *slog.Logger
+
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *tcpdumpStderr) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		line, rest, ok := bytes.Cut(w.buf, []byte("\n"))
+		if !ok {
+			break
+		}
+		w.line(string(line))
+		w.buf = rest
+	}
+	return len(p), nil
+}
+
+func (w *tcpdumpStderr) line(line string) {
+	if m := dumpcapStatsPattern.FindStringSubmatch(line); m != nil {
+		if n, err := strconv.ParseUint(m[1], 10, 64); err == nil {
+			w.stats.received.Store(n)
+		}
+		if n, err := strconv.ParseUint(m[2], 10, 64); err == nil {
+			w.stats.dropped.Store(n)
+		}
+		return
+	}
+	matches := tcpdumpStatsPattern.FindAllStringSubmatch(line, -1)
+	if matches == nil {
+		if line != "" {
+			w.log.Debug("tcpdump", "output", line)
+		}
+		return
+	}
+	// tcpdump reports totals since it started.
+	for _, m := range matches {
+		n, err := strconv.ParseUint(m[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch m[2] {
+		case "received by filter":
+			w.stats.received.Store(n)
+		case "dropped by kernel":
+			w.stats.dropped.Store(n)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	statusAnnotationKey  = "status." + annotationKey
+	statusReportInterval = 30 * time.Second
+	// resultAnnotationKey holds the captureResult of the last capture
+	// that stopped or completed.
+	resultAnnotationKey = "result." + annotationKey
+)
+
+// Capture states reported in the status annotation.
+const (
+	stateRunning   = "running"
+	stateFailed    = "failed"
+	stateStopped   = "stopped"
+	stateCompleted = "completed"
+)
+
+// captureStatus is the JSON written to the status annotation on the Pod.
+type captureStatus struct {
+	State         string        `json:"state"`
+	Node          string        `json:"node"`
+	Session       string        `json:"session,omitempty"`
+	SessionID     string        `json:"sessionID,omitempty"`
+	PID           int           `json:"pid,omitempty"`
+	Backend       string        `json:"backend,omitempty"`
+	Mode          string        `json:"mode,omitempty"`
+	Direction     string        `json:"direction,omitempty"`
+	Snaplen       int           `json:"snaplen,omitempty"`
+	SampleRate    int           `json:"sampleRate,omitempty"`
+	WriteRateMB   float64       `json:"writeRateMB,omitempty"`
+	Count         int           `json:"count,omitempty"`
+	Output        string        `json:"output,omitempty"`
+	Mirror        string        `json:"mirror,omitempty"`
+	Peer          string        `json:"peer,omitempty"`
+	Service       string        `json:"service,omitempty"`
+	Container     string        `json:"container,omitempty"`
+	HostNetwork   bool          `json:"hostNetwork,omitempty"`
+	Traceflow     string        `json:"traceflow,omitempty"`
+	PacketCapture string        `json:"packetCapture,omitempty"`
+	Trigger       string        `json:"trigger,omitempty"`
+	Requester     string        `json:"requester,omitempty"`
+	Priority      string        `json:"priority,omitempty"`
+	PreemptedBy   string        `json:"preemptedBy,omitempty"`
+	Run           *time.Time    `json:"run,omitempty"`
+	Ring          bool          `json:"ring,omitempty"`
+	Packets       *captureStats `json:"packets,omitempty"`
+	Cost          *captureCost  `json:"cost,omitempty"`
+	Budget        *budgetStatus `json:"budget,omitempty"`
+	StartTime     *time.Time    `json:"startTime,omitempty"`
+	Files         []string      `json:"files,omitempty"`
+	Bytes         int64         `json:"bytes"`
+	Restarts      int           `json:"restarts,omitempty"`
+	Report        string        `json:"report,omitempty"`
+	Alerts        *alertSummary `json:"alerts,omitempty"`
+	Degraded      bool          `json:"degraded,omitempty"`
+	Tampered      []string      `json:"tampered,omitempty"`
+	Reason        string        `json:"reason,omitempty"`
+	Message       string        `json:"message,omitempty"`
+	UpdatedAt     time.Time     `json:"updatedAt"`
+}
+
+// status builds the current status of a running capture.
+func (m *CaptureManager) status(cap *CaptureProcess) captureStatus {
+	files, total := captureFiles(cap)
+	st := captureStatus{
+		State:         stateRunning,
+		Node:          m.nodeName,
+		Session:       cap.spec.Session,
+		SessionID:     cap.sessionID,
+		Backend:       cap.backend.Name(),
+		StartTime:     &cap.startTime,
+		Bytes:         total,
+		Restarts:      cap.restarts,
+		Mode:          cap.spec.Mode,
+		Direction:     cap.spec.Direction,
+		Snaplen:       cap.spec.Snaplen,
+		SampleRate:    cap.spec.SampleRate,
+		WriteRateMB:   cap.spec.WriteRateMB,
+		Count:         cap.spec.PacketCount,
+		Output:        cap.spec.Output,
+		Peer:          cap.spec.Peer,
+		Service:       cap.spec.Service,
+		Container:     cap.spec.Container,
+		HostNetwork:   cap.spec.HostNetwork,
+		Traceflow:     cap.spec.Traceflow,
+		PacketCapture: cap.spec.PacketCapture,
+		Trigger:       cap.spec.Trigger,
+		Requester:     cap.spec.Requester,
+		Priority:      cap.spec.Priority,
+		Ring:          cap.spec.Ring,
+		Budget:        cap.spec.Budget.status(),
+		Tampered:      cap.spec.Guard.degraded(),
+	}
+	st.Degraded = len(st.Tampered) > 0
+	if !cap.spec.Run.IsZero() {
+		st.Run = &cap.spec.Run
+	}
+	if cap.spec.Mirror != nil {
+		st.Mirror = cap.spec.Mirror.String()
+	}
+	if cap.proc != nil {
+		st.PID = cap.proc.PID()
+		stats, cost := cap.proc.Stats(), cap.proc.Cost()
+		st.Packets, st.Cost = &stats, &cost
+	}
+	for _, f := range files {
+		st.Files = append(st.Files, f.Name)
+	}
+	return st
+}
+
+// captureResult is the JSON written to the result annotation once a
+// capture stopped or completed, telling the requester where its files
+// ended up. It is kept until the next capture of the Pod or session ends.
+type captureResult struct {
+	State     string `json:"state"`
+	Node      string `json:"node"`
+	Session   string `json:"session,omitempty"`
+	SessionID string `json:"sessionID,omitempty"`
+	// Directory holds the files on the node.
+	Directory string   `json:"directory"`
+	Files     []string `json:"files"`
+	Bytes     int64    `json:"bytes"`
+	Packets   uint64   `json:"packets"`
+	// Bundle is the archive the files were packed into, if requested.
+	Bundle string `json:"bundle,omitempty"`
+	// Export is the directory on the export server the files are
+	// uploaded to, if exports are configured.
+	Export string `json:"export,omitempty"`
+	// Exported is when every file of the session was on the export
+	// server.
+	Exported  *time.Time `json:"exported,omitempty"`
+	StartTime *time.Time `json:"startTime,omitempty"`
+	EndTime   time.Time  `json:"endTime"`
+}
+
+// patchResult writes the result of cap, which ended in state, to the result
+// annotation of the captured Pod or Node.
+func (m *CaptureManager) patchResult(cap *CaptureProcess, state string) error {
+	files, total := captureFiles(cap)
+	res := captureResult{
+		State:     state,
+		Node:      m.nodeName,
+		Session:   cap.spec.Session,
+		SessionID: cap.sessionID,
+		Directory: filepath.Dir(cap.files[0]),
+		Files:     []string{},
+		Bytes:     total,
+		EndTime:   time.Now().UTC(),
+	}
+	if !cap.startTime.IsZero() {
+		res.StartTime = &cap.startTime
+	}
+	if cap.proc != nil {
+		res.Packets = cap.proc.Stats().Captured
+	}
+	for _, f := range files {
+		res.Files = append(res.Files, f.Name)
+		if cap.spec.Bundle != "" && strings.HasSuffix(f.Name, "."+cap.spec.Bundle) {
+			res.Bundle = f.Name
+		}
+	}
+	if len(files) > 0 {
+		res.Export = m.exporter.dirLocation(files[0].Name)
+	}
+	return m.patchAnnotation(cap.ref, sessionAnnotationKey(resultAnnotationKey, cap.spec.Session), res)
+}
+
+// patchStatus queues st to be written to the status annotation of the
+// captured Pod or Node, or to that of its named session. It never waits for
+// the API server, so it is safe to call with m.mu held.
+func (m *CaptureManager) patchStatus(ref *corev1.ObjectReference, st captureStatus) {
+	st.UpdatedAt = time.Now().UTC()
+	m.statuses.set(ref, st)
+}
+
+// writeStatus writes st to its status annotation.
+func (m *CaptureManager) writeStatus(ref *corev1.ObjectReference, st captureStatus) error {
+	return m.patchAnnotation(ref, sessionAnnotationKey(statusAnnotationKey, st.Session), st)
+}
+
+// statusWriter writes the statuses patchStatus queues in the background.
+// Only the latest status of each annotation is written, and failed writes
+// are retried with backoff, until the Pod or Node is gone.
+type statusWriter struct {
+	write func(*corev1.ObjectReference, captureStatus) error
+	queue workqueue.RateLimitingInterface
+
+	mu sync.Mutex
+	// pending maps the annotations to write to their latest status; seq
+	// tells a status apart from one queued while it was written.
+	pending map[string]pendingStatus
+	seq     uint64
+}
+
+type pendingStatus struct {
+	ref *corev1.ObjectReference
+	st  captureStatus
+	seq uint64
+}
+
+func newStatusWriter(write func(*corev1.ObjectReference, captureStatus) error) *statusWriter {
+	return &statusWriter{
+		write:   write,
+		queue:   workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter()),
+		pending: make(map[string]pendingStatus),
+	}
+}
+
+// set queues st as the latest status of its annotation on ref.
+func (w *statusWriter) set(ref *corev1.ObjectReference, st captureStatus) {
+	key := strings.Join([]string{ref.Kind, ref.Namespace, ref.Name, st.Session}, "/")
+	w.mu.Lock()
+	w.seq++
+	w.pending[key] = pendingStatus{ref: ref, st: st, seq: w.seq}
+	w.mu.Unlock()
+	w.queue.Add(key)
+}
+
+// run writes the queued statuses with workers goroutines until stopCh is
+// closed.
+func (w *statusWriter) run(workers int, stopCh <-chan struct{}) {
+	for i := 0; i < workers; i++ {
+		go func() {
+			for w.writeNext() {
+			}
+		}()
+	}
+	<-stopCh
+	w.queue.ShutDown()
+}
+
+func (w *statusWriter) writeNext() bool {
+	item, shutdown := w.queue.Get()
+	if shutdown {
+		return false
+	}
+	key := item.(string)
+	defer w.queue.Done(key)
+	w.mu.Lock()
+	p, ok := w.pending[key]
+	w.mu.Unlock()
+	if !ok {
+		w.queue.Forget(key)
+		return true
+	}
+	err := w.write(p.ref, p.st)
+	retry := err != nil && !apierrors.IsNotFound(err) && w.queue.NumRequeues(key) < maxRetries
+	w.mu.Lock()
+	if w.pending[key].seq == p.seq && !retry {
+		delete(w.pending, key)
+	}
+	w.mu.Unlock()
+	if retry {
+		w.queue.AddRateLimited(key)
+	} else {
+		w.queue.Forget(key)
+	}
+	return true
+}
+
+// flush waits up to timeout for the queued statuses to be written, e.g.
+// those of the captures stopped on shutdown.
+func (w *statusWriter) flush(timeout time.Duration) {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		w.mu.Lock()
+		n := len(w.pending)
+		w.mu.Unlock()
+		if n == 0 {
+			return
+		}
+	}
+}
+
+// patchAnnotation writes v as JSON to the annotation key of the captured
+// Pod or Node.
+func (m *CaptureManager) patchAnnotation(ref *corev1.ObjectReference, key string, v any) error {
+	val, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"annotations": map[string]string{key: string(val)},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if ref.Kind == "Node" {
+		_, err = m.clientset.CoreV1().Nodes().Patch(ctx, ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	} else {
+		_, err = m.clientset.CoreV1().Pods(ref.Namespace).Patch(ctx, ref.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+	}
+	if err != nil {
+		slog.Error("Failed to update capture annotation", "annotation", key, "kind", ref.Kind, "namespace", ref.Namespace, "name", ref.Name, "err", err)
+	}
+	return err
+}
+
+// runStatusReporter periodically refreshes the status annotation of every
+// running capture so file lists and byte counts stay current.
+func (m *CaptureManager) runStatusReporter(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(statusReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			type update struct {
+				ref *corev1.ObjectReference
+				st  captureStatus
+			}
+			var updates []update
+			m.mu.Lock()
+			for _, cap := range m.captures {
+				if cap.exited.Load() || cap.completed.Load() {
+					continue
+				}
+				updates = append(updates, update{cap.ref, m.status(cap)})
+			}
+			m.mu.Unlock()
+			for _, u := range updates {
+				m.patchStatus(u.ref, u.st)
+			}
+		}
+	}
+}
+
+// captureFiles lists the files a capture has written, oldest first, along
+// with their total size.
+func captureFiles(cap *CaptureProcess) ([]fileInfo, int64) {
+	var files []fileInfo
+	var total int64
+	for _, pattern := range cap.files {
+		matches, _ := filepath.Glob(pattern + "*")
+		for _, f := range matches {
+			info, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			files = append(files, fileInfo{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()})
+			total += info.Size()
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime.Before(files[j].ModTime) })
+	return files, total
+}
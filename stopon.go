@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/bpf"
+)
+
+// stopOnAnnotationKey ends a capture once it has seen the packets it waits
+// for, e.g. "after=60s,match=tcp[tcpflags] & tcp-rst != 0" stops a minute
+// after the first TCP reset, so the capture of a rare event finishes once
+// the evidence is in its files.
+const stopOnAnnotationKey = "stop-on." + annotationKey
+
+// errMatchComplete completes a capture whose stop-on condition was met.
+const errMatchComplete autostopCondition = "stop-on match reached"
+
+// stopCondition is the stop-on condition of a capture. The matching packets
+// count across the interfaces and restarts of the session.
+type stopCondition struct {
+	// Match is the filter expression packets are matched against.
+	Match string
+	// Packets is how many matching packets meet the condition, and After
+	// how long the capture goes on once they have been seen.
+	Packets int
+	After   time.Duration
+
+	mu      sync.Mutex
+	matches int
+	// metAt is when the condition was met; met is closed then.
+	metAt time.Time
+	met   chan struct{}
+}
+
+// parseStopOn parses the stop-on condition. match takes the rest of the
+// value, since an expression may hold anything, so it comes last.
+func parseStopOn(v string) (*stopCondition, error) {
+	c := &stopCondition{Packets: 1, met: make(chan struct{})}
+	rest := strings.TrimSpace(v)
+	for rest != "" {
+		if expr, ok := strings.CutPrefix(rest, "match="); ok {
+			c.Match = strings.TrimSpace(expr)
+			break
+		}
+		var part string
+		part, rest, _ = strings.Cut(rest, ",")
+		rest = strings.TrimSpace(rest)
+		key, val, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || val == "" {
+			return nil, fmt.Errorf("expected key=value pairs, got %q", part)
+		}
+		switch key {
+		case "packets":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("packets must be a positive packet count, got %q", val)
+			}
+			c.Packets = n
+		case "after":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("after must be a duration, got %q", val)
+			}
+			c.After = d
+		default:
+			return nil, fmt.Errorf("unknown key %q", key)
+		}
+	}
+	if c.Match == "" {
+		return nil, errors.New("no match expression given")
+	}
+	return c, nil
+}
+
+// observe counts a matching packet, meeting the condition once Packets have
+// been seen.
+func (c *stopCondition) observe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.matches++
+	if c.matches == c.Packets {
+		c.metAt = time.Now()
+		close(c.met)
+	}
+}
+
+// deadline returns when a capture whose condition was met stops.
+func (c *stopCondition) deadline() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.metAt.Add(c.After)
+}
+
+// String describes the condition for the section comment and Events.
+func (c *stopCondition) String() string {
+	packets := "packets"
+	if c.Packets == 1 {
+		packets = "packet"
+	}
+	s := fmt.Sprintf("after %d %s matching %s", c.Packets, packets, c.Match)
+	if c.After > 0 {
+		s = c.After.String() + " " + s
+	}
+	return s
+}
+
+// matchChecker is implemented by backends that inspect packets for the
+// stop-on condition themselves.
+type matchChecker interface {
+	// CheckMatch reports why the backend cannot match packets against
+	// the stop-on expression of spec on its interface.
+	CheckMatch(spec captureSpec) error
+}
+
+// checkStopOn checks the stop-on condition of spec with the backend, like
+// checkFilter checks the filter.
+func checkStopOn(backend CaptureBackend, spec captureSpec) error {
+	if spec.StopOn == nil {
+		return nil
+	}
+	c, ok := backend.(matchChecker)
+	if !ok {
+		return fmt.Errorf("the %s backend cannot inspect packets for the stop-on condition, use the %s backend", backend.Name(), backendNative)
+	}
+	if len(spec.Interfaces) > 0 {
+		spec.Interface = spec.Interfaces[0]
+	}
+	ifName, err := resolveInterface(spec.Interface, spec)
+	if err != nil {
+		return nil
+	}
+	spec.Interface = ifName
+	if err := c.CheckMatch(spec); err != nil {
+		return fmt.Errorf("invalid stop-on match %q: %w", spec.StopOn.Match, err)
+	}
+	return nil
+}
+
+// compileMatch compiles expr for the link type of ifName into a VM.
+func compileMatch(tcpdump, ifName, expr string) (*bpf.VM, error) {
+	insns, err := compileBPF(tcpdump, ifName, expr)
+	if err != nil {
+		return nil, err
+	}
+	return bpf.NewVM(insns)
+}
+
+// compileBPF compiles expr for the link type of ifName into a classic BPF
+// program with tcpdump -ddd, which prints it as decimal numbers: their
+// count, then opcode, jumps and constant of every instruction.
+func compileBPF(tcpdump, ifName, expr string) ([]bpf.Instruction, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), filterCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, tcpdump, "-ddd", "-i", ifName, expr).Output()
+	if err != nil {
+		var exit *exec.ExitError
+		if errors.As(err, &exit) {
+			lines := strings.Split(strings.TrimSpace(string(exit.Stderr)), "\n")
+			if msg := strings.TrimSpace(lines[len(lines)-1]); msg != "" {
+				return nil, errors.New(msg)
+			}
+		}
+		return nil, fmt.Errorf("cannot compile with tcpdump: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	n, err := strconv.Atoi(lines[0])
+	if err != nil || n != len(lines)-1 {
+		return nil, fmt.Errorf("unexpected tcpdump output %q", lines[0])
+	}
+	insns := make([]bpf.Instruction, n)
+	for i, line := range lines[1:] {
+		var raw bpf.RawInstruction
+		if _, err := fmt.Sscan(line, &raw.Op, &raw.Jt, &raw.Jf, &raw.K); err != nil {
+			return nil, fmt.Errorf("unexpected tcpdump output %q", line)
+		}
+		insns[i] = raw.Disassemble()
+	}
+	return insns, nil
+}
+
+// stopOnMatch completes cap After its stop-on condition was met, unless the
+// capture stops or completes before. A condition met before a restart
+// keeps its deadline.
+func (m *CaptureManager) stopOnMatch(ctx context.Context, key string, cap *CaptureProcess) {
+	select {
+	case <-ctx.Done():
+		return
+	case <-cap.spec.StopOn.met:
+	}
+	timer := time.NewTimer(time.Until(cap.spec.StopOn.deadline()))
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return
+	case <-timer.C:
+	}
+	m.mu.Lock()
+	current := m.captures[key] == cap && !cap.completed.Load()
+	m.mu.Unlock()
+	if current {
+		m.completeCapture(key, cap, errMatchComplete)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// storageAnnotationKey names the storage target, one of --storage, a
+// capture writes its files to instead of the capture directory.
+const storageAnnotationKey = "storage." + annotationKey
+
+// parseStorage parses the --storage value v, comma separated name=directory
+// pairs, into directories by name.
+func parseStorage(v string) (map[string]string, error) {
+	targets := make(map[string]string)
+	if strings.TrimSpace(v) == "" {
+		return targets, nil
+	}
+	for _, part := range strings.Split(v, ",") {
+		name, dir, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || name == "" || strings.ContainsAny(name, "/=") {
+			return nil, fmt.Errorf("expected name=directory pairs, got %q", part)
+		}
+		if !filepath.IsAbs(dir) {
+			return nil, fmt.Errorf("directory of storage %q must be absolute, got %q", name, dir)
+		}
+		if _, ok := targets[name]; ok {
+			return nil, fmt.Errorf("storage %q is given twice", name)
+		}
+		targets[name] = filepath.Clean(dir)
+	}
+	return targets, nil
+}
+
+// storageNames lists the configured storage targets for messages.
+func (m *CaptureManager) storageNames() string {
+	names := make([]string, 0, len(m.cfg.Storage))
+	for name := range m.cfg.Storage {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// storageDir returns the directory of the storage target name, once it has
+// made sure a volume is mounted there. Without a volume the files would land
+// on the agent's own filesystem, which the capture asked to avoid.
+func (m *CaptureManager) storageDir(name string) (string, error) {
+	dir, ok := m.cfg.Storage[name]
+	if !ok {
+		return "", fmt.Errorf("unknown storage %q, configured are: %s", name, m.storageNames())
+	}
+	mounted, err := isMountPoint(dir)
+	if err != nil {
+		return "", fmt.Errorf("cannot check storage %q: %w", name, err)
+	}
+	if !mounted {
+		return "", fmt.Errorf("no volume is mounted at %s for storage %q", dir, name)
+	}
+	return dir, nil
+}
+
+// storageRoot returns the directory the files of captures on storage are
+// written under: that of the storage target, or the capture directory.
+func (m *CaptureManager) storageRoot(storage string) string {
+	if dir, ok := m.cfg.Storage[storage]; ok {
+		return dir
+	}
+	return m.cfg.CaptureDir
+}
+
+// makeSessionDir creates the session directory dir in the capture
+// directory. With a storage target the session directory is created at the
+// same place on the target and dir links to it, so listing, downloads and
+// retention find the files where they always are.
+func (m *CaptureManager) makeSessionDir(dir, storage string) error {
+	if storage == "" {
+		return os.MkdirAll(dir, 0o755)
+	}
+	root, err := m.storageDir(storage)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(m.cfg.CaptureDir, dir)
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(root, rel)
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return err
+	}
+	// A resumed session keeps its link, or its directory if it started
+	// before the storage target was configured.
+	if _, err := os.Lstat(dir); !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Symlink(target, dir)
+}
+
+// onStorage reports whether the capture file f lives on a storage target.
+func onStorage(f string) bool {
+	info, err := os.Lstat(filepath.Dir(f))
+	return err == nil && info.Mode()&os.ModeSymlink != 0
+}
+
+// sessionLinks lists the session directories in the Pod directory dir that
+// link to a storage target.
+func sessionLinks(dir string) []string {
+	entries, _ := os.ReadDir(dir)
+	var out []string
+	for _, e := range entries {
+		if e.Type()&os.ModeSymlink != 0 {
+			out = append(out, filepath.Join(dir, e.Name()))
+		}
+	}
+	return out
+}
+
+// removeStorageSession removes the session directory link session and the
+// directory it links to, along with the Pod and namespace directories on
+// the storage target it leaves empty. The directory must be empty but for
+// its metadata.
+func removeStorageSession(session string) {
+	target, err := os.Readlink(session)
+	if err != nil {
+		return
+	}
+	if entries, _ := os.ReadDir(target); len(entries) == 1 && entries[0].Name() == sessionMetadataFile {
+		os.Remove(filepath.Join(target, sessionMetadataFile))
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	os.Remove(session)
+	// The Pod and namespace directories, if nothing else is in them.
+	os.Remove(filepath.Dir(target))
+	os.Remove(filepath.Dir(filepath.Dir(target)))
+}
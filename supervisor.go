@@ -0,0 +1,76 @@
+package main
+
+import (
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	restartInitialBackoff = 2 * time.Second
+	restartMaxBackoff     = 5 * time.Minute
+	// restartResetAfter is how long tcpdump must run before an exit is no
+	// longer considered part of a crash loop.
+	restartResetAfter = 10 * time.Minute
+	// crashLoopThreshold is the number of consecutive restarts after which
+	// a Warning Event is recorded.
+	crashLoopThreshold = 3
+)
+
+const (
+	reasonCaptureRestarted    = "CaptureRestarted"
+	reasonCaptureCrashLooping = "CaptureCrashLooping"
+)
+
+// restartBackoff returns how long to wait after an unexpected exit before
+// tcpdump is started again, doubling with each consecutive restart.
+func (cap *CaptureProcess) restartBackoff() time.Duration {
+	backoff := restartInitialBackoff
+	for i := 0; i < cap.restarts && backoff < restartMaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, restartMaxBackoff)
+}
+
+// restartDelay returns the time left until an exited capture may restart.
+func (cap *CaptureProcess) restartDelay() time.Duration {
+	return time.Until(cap.exitTime.Add(cap.restartBackoff()))
+}
+
+// restartCapture replaces an exited capture with a new tcpdump process in
+// the same session. Callers must hold m.mu.
+func (m *CaptureManager) restartCapture(key string, prev *CaptureProcess) error {
+	if wait := prev.restartDelay(); wait > 0 {
+		m.queue.AddAfter(key, wait)
+		return nil
+	}
+
+	restarts := prev.restarts + 1
+	next := &CaptureProcess{
+		backend:   prev.backend,
+		spec:      prev.spec,
+		files:     prev.files,
+		ref:       prev.ref,
+		sessionID: prev.sessionID,
+		log:       prev.log,
+		restarts:  restarts,
+		retention: prev.retention,
+	}
+
+	next.log.Info("Restarting tcpdump", "attempt", restarts)
+	captureRestarts.Inc()
+	if err := m.launch(key, next); err != nil {
+		return err
+	}
+	m.recorder.Eventf(next.ref, corev1.EventTypeNormal, reasonCaptureRestarted,
+		"Restarted tcpdump after unexpected exit (attempt %d)", restarts)
+	if restarts >= crashLoopThreshold {
+		m.recorder.Eventf(next.ref, corev1.EventTypeWarning, reasonCaptureCrashLooping,
+			"tcpdump has exited %d times in a row", restarts)
+		if restarts == crashLoopThreshold {
+			m.oncall.captureCrashLooping(next.spec, restarts)
+		}
+	}
+	m.patchStatus(next.ref, m.status(next))
+	return nil
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// fileCheckInterval is how often every guarded file is checked, in case
+// the watcher missed an event, and directories no capture writes to any
+// more are no longer watched.
+const fileCheckInterval = time.Minute
+
+// fileGuard knows the files of a capture as its ring left them, so files
+// deleted, truncated or replaced by anything but the agent are noticed
+// instead of leaving silently corrupted evidence behind. The ring reports
+// the file it writes, the files it finished and the ones it removes or
+// reuses itself.
+type fileGuard struct {
+	mu sync.Mutex
+	// current maps the file each ring writes to to the open file.
+	current map[string]*os.File
+	// finished maps the files recorded in the manifest to their size.
+	finished map[string]int64
+	// tampered describes what happened to the files, oldest first. A
+	// capture with tampered files is degraded.
+	tampered []string
+}
+
+func newFileGuard() *fileGuard {
+	return &fileGuard{current: make(map[string]*os.File), finished: make(map[string]int64)}
+}
+
+// writing records that a ring writes to f.
+func (g *fileGuard) writing(f *os.File) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.current[f.Name()] = f
+}
+
+// closing records that a ring is done writing to the file at path.
+func (g *fileGuard) closing(path string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.current, path)
+}
+
+// finish records that the file at path was finished with size bytes.
+func (g *fileGuard) finish(path string, size int64) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.finished[path] = size
+}
+
+// release forgets the finished files in the ring slot of path, which the
+// ring is about to remove or overwrite.
+func (g *fileGuard) release(path string) {
+	if g == nil {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for f := range g.finished {
+		if filepath.Dir(f) == filepath.Dir(path) && ringSlot(filepath.Base(f)) == filepath.Base(path) {
+			delete(g.finished, f)
+		}
+	}
+}
+
+// degraded returns what happened to the tampered files of the capture.
+func (g *fileGuard) degraded() []string {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]string(nil), g.tampered...)
+}
+
+// tamperFinding is a guarded file found tampered with. lost is set when it
+// was the file a ring writes to, which then writes into nothing.
+type tamperFinding struct {
+	message string
+	lost    bool
+}
+
+// check checks the file at path if it is guarded, and all of them if path
+// is empty. Each tampered file is reported once.
+func (g *fileGuard) check(path string) []tamperFinding {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var paths []string
+	if path != "" {
+		paths = []string{path}
+	} else {
+		for p := range g.current {
+			paths = append(paths, p)
+		}
+		for p := range g.finished {
+			paths = append(paths, p)
+		}
+		sort.Strings(paths)
+	}
+	var findings []tamperFinding
+	for _, p := range paths {
+		var msg string
+		f, writing := g.current[p]
+		if writing {
+			msg = checkCurrentFile(p, f)
+		} else if size, ok := g.finished[p]; ok {
+			msg = checkFinishedFile(p, size)
+		}
+		if msg == "" {
+			continue
+		}
+		delete(g.current, p)
+		delete(g.finished, p)
+		g.tampered = append(g.tampered, msg)
+		findings = append(findings, tamperFinding{message: msg, lost: writing})
+	}
+	return findings
+}
+
+// checkCurrentFile describes how the file at path that a ring writes to
+// through f was tampered with, or returns "". Bytes the ring wrote past the
+// end of the file mean it was truncated under the ring.
+func checkCurrentFile(path string, f *os.File) string {
+	open, err := f.Stat()
+	if err != nil {
+		// The ring closed it meanwhile.
+		return ""
+	}
+	name := filepath.Base(path)
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Sprintf("%s was deleted while it was written", name)
+	case err != nil:
+		return ""
+	case !os.SameFile(open, info):
+		return fmt.Sprintf("%s was replaced while it was written", name)
+	}
+	written, err := f.Seek(0, io.SeekCurrent)
+	if err != nil || info.Size() >= written {
+		return ""
+	}
+	return fmt.Sprintf("%s was truncated from %d to %d bytes while it was written", name, written, info.Size())
+}
+
+// checkFinishedFile describes how the finished file at path of size bytes
+// was tampered with, or returns "".
+func checkFinishedFile(path string, size int64) string {
+	name := filepath.Base(path)
+	info, err := os.Stat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Sprintf("%s was deleted", name)
+	case err != nil:
+		return ""
+	case info.Size() < size:
+		return fmt.Sprintf("%s was truncated from %d to %d bytes", name, size, info.Size())
+	case info.Size() > size:
+		return fmt.Sprintf("%s was modified, it grew from %d to %d bytes", name, size, info.Size())
+	}
+	return ""
+}
+
+// watchFiles starts watching the files of the running captures for
+// tampering. A single watcher serves all captures, since inotify instances
+// are limited per user on the node.
+func (m *CaptureManager) watchFiles(ctx context.Context) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		slog.Warn("Cannot watch capture files, tampering with them goes unnoticed", "err", err)
+		return
+	}
+	m.fileWatcher = w
+	go func() {
+		defer w.Close()
+		ticker := time.NewTicker(fileCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				m.checkFiles(ev.Name)
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				// Events were lost, e.g. the queue overflowed.
+				slog.Warn("Capture file watch failed", "err", err)
+				m.checkFiles("")
+			case <-ticker.C:
+				m.checkFiles("")
+				m.unwatchIdleDirs()
+			}
+		}
+	}()
+}
+
+// guardFiles watches the directories cap writes to.
+func (m *CaptureManager) guardFiles(cap *CaptureProcess) {
+	if m.fileWatcher == nil {
+		return
+	}
+	for _, pattern := range cap.files {
+		if err := m.fileWatcher.Add(filepath.Dir(pattern)); err != nil {
+			cap.log.Warn("Cannot watch capture files, tampering with them goes unnoticed", "err", err)
+		}
+	}
+}
+
+// unwatchIdleDirs stops watching the directories no capture writes to.
+func (m *CaptureManager) unwatchIdleDirs() {
+	active := make(map[string]bool)
+	m.mu.Lock()
+	for _, cap := range m.fileOwners() {
+		for _, pattern := range cap.files {
+			active[filepath.Dir(pattern)] = true
+		}
+	}
+	m.mu.Unlock()
+	for _, dir := range m.fileWatcher.WatchList() {
+		if !active[dir] {
+			m.fileWatcher.Remove(dir)
+		}
+	}
+}
+
+// checkFiles checks the guarded file at path, or all guarded files if path
+// is empty, of the captures that still write files. Completed captures are
+// left alone, as disk pressure may evict their files.
+func (m *CaptureManager) checkFiles(path string) {
+	type tampered struct {
+		key string
+		cap *CaptureProcess
+		tamperFinding
+	}
+	var found []tampered
+	m.mu.Lock()
+	for key, cap := range m.captures {
+		if cap.completed.Load() {
+			continue
+		}
+		for _, f := range cap.spec.Guard.check(path) {
+			found = append(found, tampered{key, cap, f})
+		}
+	}
+	m.mu.Unlock()
+	for _, t := range found {
+		m.fileTampered(t.key, t.cap, t.tamperFinding)
+	}
+}
+
+// fileTampered reports a tampered file of cap and marks the capture
+// degraded. A ring whose file is gone is restarted into a new file, so the
+// packets that follow are kept.
+func (m *CaptureManager) fileTampered(key string, cap *CaptureProcess, f tamperFinding) {
+	cap.log.Warn("Capture file was tampered with", "finding", f.message)
+	filesTampered.Inc()
+	m.recorder.Event(cap.ref, corev1.EventTypeWarning, reasonFileTampered, sessionEvent(cap.spec, "Capture file "+f.message))
+	m.auditCapture(cap, auditTamper, "", f.message)
+	if f.lost {
+		cap.spec.Rotate.request()
+	}
+	m.mu.Lock()
+	current := m.captures[key] == cap && !cap.completed.Load()
+	var st captureStatus
+	if current {
+		st = m.status(cap)
+	}
+	m.mu.Unlock()
+	if current && !cap.exited.Load() {
+		m.patchStatus(cap.ref, st)
+	}
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/retry"
+)
+
+// captureTargetResource is the CaptureTarget custom resource defined in
+// manifests/crd.yaml.
+var captureTargetResource = schema.GroupVersionResource{Group: annotationKey, Version: "v1alpha1", Resource: "capturetargets"}
+
+const (
+	// targetReleaseInterval is how often the agent checks whether the
+	// files of a stopped CaptureTarget capture are exported.
+	targetReleaseInterval = 2 * time.Second
+	// targetSweepInterval is how often the agent removes the finalizers
+	// it no longer needs, e.g. those left over from before a restart.
+	targetSweepInterval = time.Minute
+)
+
+// captureTarget selects Pods to capture by label instead of annotating each
+// of them.
+type captureTarget struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              captureTargetSpec `json:"spec"`
+	// Status is written by the cluster controller of the two-tier
+	// deployment.
+	Status captureTargetStatus `json:"status,omitempty"`
+}
+
+type captureTargetSpec struct {
+	// Selector picks Pods in the CaptureTarget's namespace.
+	Selector metav1.LabelSelector `json:"selector"`
+	MaxFiles int                  `json:"maxFiles"`
+	// Duration ends the captures that long after the CaptureTarget was
+	// created; zero captures until it is deleted.
+	Duration metav1.Duration `json:"duration,omitempty"`
+	// Options holds per-capture options by name, as in the REST API.
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// expiry returns when the target stops applying, or the zero time.
+func (t *captureTarget) expiry() time.Time {
+	if t.Spec.Duration.Duration <= 0 {
+		return time.Time{}
+	}
+	return t.CreationTimestamp.Add(t.Spec.Duration.Duration)
+}
+
+// annotations returns the capture and option annotations equivalent to the
+// target.
+func (t *captureTarget) annotations() map[string]string {
+	a := map[string]string{annotationKey: strconv.Itoa(t.Spec.MaxFiles)}
+	for name, val := range t.Spec.Options {
+		if key, ok := podOptions[name]; ok {
+			a[key] = val
+		}
+	}
+	return a
+}
+
+// matches reports whether the target currently applies to pod.
+func (t *captureTarget) matches(pod *corev1.Pod, now time.Time) bool {
+	if pod.Namespace != t.Namespace || t.DeletionTimestamp != nil {
+		return false
+	}
+	if exp := t.expiry(); !exp.IsZero() && !now.Before(exp) {
+		return false
+	}
+	return t.selects(pod)
+}
+
+// selects reports whether the selector of t picks pod, whether or not t
+// still applies.
+func (t *captureTarget) selects(pod *corev1.Pod) bool {
+	if pod.Namespace != t.Namespace {
+		return false
+	}
+	sel, err := metav1.LabelSelectorAsSelector(&t.Spec.Selector)
+	return err == nil && sel.Matches(labels.Set(pod.Labels))
+}
+
+// watchCaptureTargets sets up the CaptureTarget informer if the CRD is
+// installed, and returns its sync function.
+func (m *CaptureManager) watchCaptureTargets(ctx context.Context) []cache.InformerSynced {
+	_, err := m.clientset.Discovery().ServerResourcesForGroupVersion(captureTargetResource.GroupVersion().String())
+	if err != nil {
+		slog.Info("CaptureTarget CRD not installed, label selector captures are disabled", "err", err)
+		return nil
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(m.dynamic, m.cfg.ResyncInterval)
+	informer := factory.ForResource(captureTargetResource)
+	m.targetLister = informer.Lister()
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.enqueueTargetPods,
+		UpdateFunc: func(old, obj interface{}) { m.enqueueTargetPods(old); m.enqueueTargetPods(obj) },
+		DeleteFunc: m.enqueueTargetPods,
+	})
+	factory.Start(ctx.Done())
+	return []cache.InformerSynced{informer.Informer().HasSynced}
+}
+
+// enqueueTargetPods enqueues the Pods on this node a CaptureTarget selects,
+// and enqueues them again when it expires so their captures stop.
+func (m *CaptureManager) enqueueTargetPods(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	t, err := toCaptureTarget(obj)
+	if err != nil {
+		slog.Error("Invalid CaptureTarget", "err", err)
+		return
+	}
+	sel, err := metav1.LabelSelectorAsSelector(&t.Spec.Selector)
+	if err != nil {
+		slog.Error("Invalid CaptureTarget selector", "namespace", t.Namespace, "name", t.Name, "err", err)
+		return
+	}
+	pods, err := m.podLister.Pods(t.Namespace).List(sel)
+	if err != nil {
+		return
+	}
+	exp := t.expiry()
+	for _, pod := range pods {
+		m.enqueuePod(pod)
+		if wait := time.Until(exp); wait > 0 {
+			key, _ := cache.MetaNamespaceKeyFunc(pod)
+			m.queue.AddAfter(key, wait)
+		}
+	}
+}
+
+// podCaptureTarget returns the oldest CaptureTarget that applies to pod.
+func (m *CaptureManager) podCaptureTarget(pod *corev1.Pod) *captureTarget {
+	if m.targetLister == nil {
+		return nil
+	}
+	objs, err := m.targetLister.ByNamespace(pod.Namespace).List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	var found []*captureTarget
+	for _, obj := range objs {
+		t, err := toCaptureTarget(obj)
+		if err == nil && t.matches(pod, now) {
+			found = append(found, t)
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].CreationTimestamp.Equal(&found[j].CreationTimestamp) {
+			return found[i].CreationTimestamp.Before(&found[j].CreationTimestamp)
+		}
+		return found[i].Name < found[j].Name
+	})
+	return found[0]
+}
+
+func toCaptureTarget(obj interface{}) (*captureTarget, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	var t captureTarget
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// targetFinalizer is the finalizer the agent on node holds on the
+// CaptureTargets it captures for. Deleting a CaptureTarget waits until every
+// agent has stopped its captures and exported their files, and removed its
+// finalizer.
+func targetFinalizer(node string) string {
+	name := "node-" + node
+	if len(name) > 63 {
+		// Finalizer names are qualified names of at most 63 characters.
+		sum := sha256.Sum256([]byte(node))
+		name = "node-" + hex.EncodeToString(sum[:8])
+	}
+	return annotationKey + "/" + name
+}
+
+// sourceTarget returns the CaptureTarget, as <namespace>/<name>, a capture
+// is requested through, or "".
+func sourceTarget(source metav1.Object) string {
+	switch s := source.(type) {
+	case *captureTarget:
+		return s.Namespace + "/" + s.Name
+	case *captureAssignment:
+		if target, ok := strings.CutPrefix(s.Source, "CaptureTarget "); ok {
+			return target
+		}
+	}
+	return ""
+}
+
+// ensureTarget adds the agent's finalizer to the CaptureTarget target, as
+// <namespace>/<name>, before a capture for it starts. It calls the API
+// server, so callers must not hold m.mu.
+func (m *CaptureManager) ensureTarget(target string) error {
+	m.targetMu.Lock()
+	defer m.targetMu.Unlock()
+	m.mu.Lock()
+	held := m.targetHeld[target]
+	m.mu.Unlock()
+	if held {
+		return nil
+	}
+	if err := m.setTargetFinalizer(target, targetFinalizer(m.nodeName), true); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.targetHeld[target] = true
+	m.mu.Unlock()
+	return nil
+}
+
+// holdTarget counts a hold on the CaptureTarget target for a capture about
+// to start, whose finalizer ensureTarget added. Every hold is given back
+// with releaseTarget. Callers must hold m.mu.
+func (m *CaptureManager) holdTarget(target string) error {
+	if !m.targetHeld[target] {
+		// The finalizer was removed since ensureTarget added it.
+		return fmt.Errorf("the finalizer of CaptureTarget %s was removed, adding it again", target)
+	}
+	m.targetRefs[target]++
+	return nil
+}
+
+// releaseTarget gives back a hold on the CaptureTarget target once the files
+// of the stopped capture with sessionID are exported, and removes the
+// agent's finalizer with the last hold.
+func (m *CaptureManager) releaseTarget(target, sessionID string) {
+	ns, _, _ := strings.Cut(target, "/")
+	if sessionID != "" {
+		// The last files are finished in the background after the
+		// capture stopped.
+		time.Sleep(targetReleaseInterval)
+		for m.exporter.waiting(ns, sessionID) {
+			time.Sleep(targetReleaseInterval)
+		}
+	}
+	m.targetMu.Lock()
+	defer m.targetMu.Unlock()
+	m.mu.Lock()
+	if m.targetRefs[target]--; m.targetRefs[target] > 0 {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.targetRefs, target)
+	delete(m.targetHeld, target)
+	m.mu.Unlock()
+	if err := m.setTargetFinalizer(target, targetFinalizer(m.nodeName), false); err != nil {
+		// The sweeper tries again.
+		slog.Warn("Failed to remove CaptureTarget finalizer", "target", target, "err", err)
+	}
+}
+
+// setTargetFinalizer adds or removes finalizer, the agent's own or that of
+// a node that is gone, on the CaptureTarget target.
+func (m *CaptureManager) setTargetFinalizer(target, finalizer string, add bool) error {
+	ns, name, _ := strings.Cut(target, "/")
+	client := m.dynamic.Resource(captureTargetResource).Namespace(ns)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		u, err := client.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) && !add {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		finalizers := u.GetFinalizers()
+		if slices.Contains(finalizers, finalizer) == add {
+			return nil
+		}
+		if add {
+			finalizers = append(finalizers, finalizer)
+		} else {
+			finalizers = slices.DeleteFunc(finalizers, func(f string) bool { return f == finalizer })
+		}
+		u.SetFinalizers(finalizers)
+		_, err = client.Update(ctx, u, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+// runTargetSweeper removes the agent's finalizer every targetSweepInterval
+// from the CaptureTargets it holds no captures or exports for, which are
+// left behind when the agent restarts or the captures moved elsewhere.
+func (m *CaptureManager) runTargetSweeper(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(targetSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			if m.synced.Load() {
+				m.sweepTargets()
+			}
+		}
+	}
+}
+
+func (m *CaptureManager) sweepTargets() {
+	var objs []runtime.Object
+	if m.targetLister != nil {
+		objs, _ = m.targetLister.List(labels.Everything())
+	} else {
+		// Agents of the two-tier deployment do not watch CaptureTargets.
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		list, err := m.dynamic.Resource(captureTargetResource).List(ctx, metav1.ListOptions{})
+		cancel()
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				slog.Warn("Failed to list CaptureTargets", "err", err)
+			}
+			return
+		}
+		for i := range list.Items {
+			objs = append(objs, &list.Items[i])
+		}
+	}
+	finalizer := targetFinalizer(m.nodeName)
+	var targets []*captureTarget
+	for _, obj := range objs {
+		t, err := toCaptureTarget(obj)
+		if err != nil {
+			continue
+		}
+		targets = append(targets, t)
+		if !slices.Contains(t.Finalizers, finalizer) || m.exporter.waiting(t.Namespace, "") {
+			continue
+		}
+		m.sweepTarget(t.Namespace+"/"+t.Name, finalizer)
+	}
+	m.sweepNodeFinalizers(targets)
+}
+
+// sweepTarget removes the agent's finalizer from the CaptureTarget target
+// if no capture holds it.
+func (m *CaptureManager) sweepTarget(target, finalizer string) {
+	m.targetMu.Lock()
+	defer m.targetMu.Unlock()
+	m.mu.Lock()
+	used := m.targetRefs[target] > 0
+	if !used {
+		delete(m.targetHeld, target)
+	}
+	m.mu.Unlock()
+	if used {
+		return
+	}
+	slog.Info("Removing unused CaptureTarget finalizer", "target", target)
+	if err := m.setTargetFinalizer(target, finalizer, false); err != nil {
+		slog.Warn("Failed to remove CaptureTarget finalizer", "target", target, "err", err)
+	}
+}
+
+// sweepNodeFinalizers removes the finalizers of nodes that no longer exist
+// from the CaptureTargets being deleted, whose deletion would otherwise wait
+// for an agent that never comes back. Any agent removes them; the Nodes are
+// only listed while such a CaptureTarget has a finalizer of another node.
+func (m *CaptureManager) sweepNodeFinalizers(targets []*captureTarget) {
+	own := targetFinalizer(m.nodeName)
+	var deleting []*captureTarget
+	for _, t := range targets {
+		if t.DeletionTimestamp == nil {
+			continue
+		}
+		if slices.ContainsFunc(t.Finalizers, func(f string) bool { return isNodeFinalizer(f) && f != own }) {
+			deleting = append(deleting, t)
+		}
+	}
+	if len(deleting) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	nodes, err := m.clientset.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	cancel()
+	if err != nil {
+		slog.Warn("Failed to list nodes for CaptureTarget finalizers", "err", err)
+		return
+	}
+	existing := make(map[string]bool, len(nodes.Items))
+	for _, node := range nodes.Items {
+		existing[targetFinalizer(node.Name)] = true
+	}
+	for _, t := range deleting {
+		target := t.Namespace + "/" + t.Name
+		for _, f := range t.Finalizers {
+			if !isNodeFinalizer(f) || existing[f] {
+				continue
+			}
+			slog.Info("Removing CaptureTarget finalizer of a node that is gone", "target", target, "finalizer", f)
+			if err := m.setTargetFinalizer(target, f, false); err != nil {
+				slog.Warn("Failed to remove CaptureTarget finalizer", "target", target, "finalizer", f, "err", err)
+			}
+		}
+	}
+}
+
+// isNodeFinalizer reports whether f is the finalizer of an agent.
+func isNodeFinalizer(f string) bool {
+	return strings.HasPrefix(f, annotationKey+"/node-")
+}
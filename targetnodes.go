@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Conditions of each node in the status of a CaptureTarget.
+const (
+	// targetScheduled is true once every selected Pod on the node was
+	// assigned its capture.
+	targetScheduled = "Scheduled"
+	// targetRunning is true while a capture runs on the node.
+	targetRunning = "Running"
+	// targetFilesRotated is true once a capture on the node wrote more
+	// than one file.
+	targetFilesRotated = "FilesRotated"
+	// targetUploaded is true once the files of every capture that ended
+	// on the node are on the export server.
+	targetUploaded = "Uploaded"
+	// targetFailed is true while a capture on the node failed.
+	targetFailed = "Failed"
+)
+
+// exportCheckInterval is how often a session that ended checks whether its
+// files are exported.
+const exportCheckInterval = 2 * time.Second
+
+// targetNodeStatus is the progress of the captures of a CaptureTarget on one
+// node, so a user can tell which nodes delivered data and which failed.
+type targetNodeStatus struct {
+	Node string `json:"node"`
+	Pods int    `json:"pods"`
+	// Bytes is what the captures of the node have written, as their status
+	// annotations report it.
+	Bytes      int64              `json:"bytes"`
+	Conditions []metav1.Condition `json:"conditions"`
+}
+
+// nodeTally counts the captures of the Pods a CaptureTarget selects on one
+// node.
+type nodeTally struct {
+	pods, assigned, pending, running, completed int
+	files, rotated                              int
+	ended, exporting, exported                  int
+	bytes                                       int64
+	// failure is the status of the first failed capture, of failedPod.
+	failure   captureStatus
+	failedPod string
+	failures  int
+}
+
+// add counts pod, whose capture has the status st.
+func (n *nodeTally) add(pod *corev1.Pod, st captureStatus) {
+	n.pods++
+	if podAssignment(pod) != nil {
+		n.assigned++
+	}
+	switch st.State {
+	case statePending:
+		n.pending++
+	case stateRunning:
+		n.running++
+	case stateCompleted:
+		n.completed++
+	case stateFailed:
+		if n.failures == 0 {
+			n.failure, n.failedPod = st, pod.Name
+		}
+		n.failures++
+	}
+	n.bytes += st.Bytes
+	files := packetFiles(st.Files)
+	n.files += files
+	if files > 1 {
+		n.rotated++
+	}
+	var res captureResult
+	if json.Unmarshal([]byte(pod.Annotations[resultAnnotationKey]), &res) == nil {
+		n.ended++
+		if res.Export != "" {
+			n.exporting++
+			if res.Exported != nil {
+				n.exported++
+			}
+		}
+	}
+}
+
+// packetFiles counts the files holding packets among names, leaving out
+// manifests, reports and decodes.
+func packetFiles(names []string) int {
+	n := 0
+	for _, name := range names {
+		if !strings.HasSuffix(name, decodeSuffix) && !strings.HasSuffix(name, reportHTMLSuffix) && !strings.HasSuffix(name, ".tmp") {
+			n++
+		}
+	}
+	return n
+}
+
+// targetNodes returns the status of every node the selected pods run on,
+// sorted by node. Conditions keep their transition times from previous, the
+// nodes of the current status.
+func targetNodes(pods []*corev1.Pod, generation int64, previous []targetNodeStatus) []targetNodeStatus {
+	tallies := make(map[string]*nodeTally)
+	for _, pod := range pods {
+		if pod.Spec.NodeName == "" {
+			continue
+		}
+		n := tallies[pod.Spec.NodeName]
+		if n == nil {
+			n = &nodeTally{}
+			tallies[pod.Spec.NodeName] = n
+		}
+		n.add(pod, annotatedStatus(pod, ""))
+	}
+	var nodes []targetNodeStatus
+	for node, n := range tallies {
+		ns := targetNodeStatus{Node: node, Pods: n.pods, Bytes: n.bytes}
+		if i := slices.IndexFunc(previous, func(p targetNodeStatus) bool { return p.Node == node }); i >= 0 {
+			ns.Conditions = slices.Clone(previous[i].Conditions)
+		}
+		for _, c := range n.conditions() {
+			c.ObservedGeneration = generation
+			meta.SetStatusCondition(&ns.Conditions, c)
+		}
+		nodes = append(nodes, ns)
+	}
+	slices.SortFunc(nodes, func(a, b targetNodeStatus) int { return strings.Compare(a.Node, b.Node) })
+	return nodes
+}
+
+// conditions returns the conditions of the node n counts.
+func (n *nodeTally) conditions() []metav1.Condition {
+	cond := func(typ string, ok bool, reason, msg string, args ...any) metav1.Condition {
+		status := metav1.ConditionFalse
+		if ok {
+			status = metav1.ConditionTrue
+		}
+		return metav1.Condition{Type: typ, Status: status, Reason: reason, Message: fmt.Sprintf(msg, args...)}
+	}
+	var conds []metav1.Condition
+
+	switch {
+	case n.assigned == n.pods:
+		conds = append(conds, cond(targetScheduled, true, "Assigned", "%d of %d Pods assigned a capture", n.assigned, n.pods))
+	case n.pending > 0:
+		conds = append(conds, cond(targetScheduled, false, "WaitingForSlot", "%d Pods wait for a capture slot", n.pending))
+	default:
+		conds = append(conds, cond(targetScheduled, false, "NotAssigned", "%d of %d Pods assigned a capture", n.assigned, n.pods))
+	}
+
+	switch {
+	case n.running > 0:
+		conds = append(conds, cond(targetRunning, true, "Capturing", "%d of %d captures running", n.running, n.pods))
+	case n.completed > 0:
+		conds = append(conds, cond(targetRunning, false, "Completed", "%d captures completed", n.completed))
+	default:
+		conds = append(conds, cond(targetRunning, false, "NotRunning", "no capture running"))
+	}
+
+	switch {
+	case n.rotated > 0:
+		conds = append(conds, cond(targetFilesRotated, true, "Rotated", "%d files written, %d captures rotated", n.files, n.rotated))
+	case n.files > 0:
+		conds = append(conds, cond(targetFilesRotated, false, "SingleFile", "%d files written", n.files))
+	default:
+		conds = append(conds, cond(targetFilesRotated, false, "NoFiles", "no files written"))
+	}
+
+	switch {
+	case n.ended == 0:
+		conds = append(conds, cond(targetUploaded, false, "NotEnded", "no capture ended"))
+	case n.exporting == 0:
+		conds = append(conds, cond(targetUploaded, false, "ExportDisabled", "files are not exported"))
+	case n.exported == n.exporting:
+		conds = append(conds, cond(targetUploaded, true, "Exported", "the files of %d of %d ended captures exported", n.exported, n.exporting))
+	default:
+		conds = append(conds, cond(targetUploaded, false, "Exporting", "the files of %d of %d ended captures exported", n.exported, n.exporting))
+	}
+
+	if n.failures > 0 {
+		reason := n.failure.Reason
+		if reason == "" {
+			reason = reasonCaptureFailed
+		}
+		msg := n.failedPod + ": " + n.failure.Message
+		if n.failures > 1 {
+			msg += fmt.Sprintf(" (and %d more)", n.failures-1)
+		}
+		conds = append(conds, cond(targetFailed, true, reason, "%s", msg))
+	} else {
+		conds = append(conds, cond(targetFailed, false, "NoFailures", "no capture failed"))
+	}
+	return conds
+}
+
+// reportExported records in the result of the ended session of cap when its
+// files are all on the export server, once they are.
+func (m *CaptureManager) reportExported(cap *CaptureProcess) {
+	// The last files are handed to the exporter after the result is
+	// written.
+	time.Sleep(exportCheckInterval)
+	for m.exporter.waiting(cap.spec.Namespace, cap.sessionID) {
+		time.Sleep(exportCheckInterval)
+	}
+	pod, err := m.podLister.Pods(cap.ref.Namespace).Get(cap.ref.Name)
+	if err != nil {
+		return
+	}
+	key := sessionAnnotationKey(resultAnnotationKey, cap.spec.Session)
+	var res captureResult
+	if json.Unmarshal([]byte(pod.Annotations[key]), &res) != nil || res.SessionID != cap.sessionID || res.Exported != nil {
+		return
+	}
+	now := time.Now().UTC()
+	res.Exported = &now
+	m.patchAnnotation(cap.ref, key, res)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// traceflowResource is Antrea's cluster-scoped Traceflow resource.
+var traceflowResource = schema.GroupVersionResource{Group: "crd.antrea.io", Version: "v1beta1", Resource: "traceflows"}
+
+// defaultTraceflowTimeout is Antrea's timeout of Traceflows that set none.
+const defaultTraceflowTimeout = 20 * time.Second
+
+// traceflow holds the fields of an Antrea Traceflow the agent uses.
+type traceflow struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata"`
+	Spec              traceflowSpec `json:"spec"`
+}
+
+type traceflowSpec struct {
+	Source      traceflowEndpoint `json:"source"`
+	Destination traceflowEndpoint `json:"destination"`
+	// Timeout is in seconds.
+	Timeout int `json:"timeout,omitempty"`
+}
+
+type traceflowEndpoint struct {
+	Namespace string `json:"namespace,omitempty"`
+	Pod       string `json:"pod,omitempty"`
+}
+
+// expiry returns when the Traceflow times out, which ends its captures.
+func (t *traceflow) expiry() time.Time {
+	timeout := defaultTraceflowTimeout
+	if t.Spec.Timeout > 0 {
+		timeout = time.Duration(t.Spec.Timeout) * time.Second
+	}
+	return t.CreationTimestamp.Add(timeout)
+}
+
+// pods returns the keys of the Pods the Traceflow is sent from or to.
+func (t *traceflow) pods() []string {
+	var keys []string
+	for _, ep := range []traceflowEndpoint{t.Spec.Source, t.Spec.Destination} {
+		if ep.Namespace != "" && ep.Pod != "" {
+			keys = append(keys, ep.Namespace+"/"+ep.Pod)
+		}
+	}
+	return keys
+}
+
+// annotations returns the capture and option annotations equivalent to the
+// Traceflow: its own capture annotation, or a single file when every
+// Traceflow is captured, and the option annotations it carries.
+func (t *traceflow) annotations() map[string]string {
+	a := map[string]string{annotationKey: "1"}
+	if v, ok := t.Annotations[annotationKey]; ok {
+		a[annotationKey] = v
+	}
+	for _, key := range podOptions {
+		if v, ok := t.Annotations[key]; ok {
+			a[key] = v
+		}
+	}
+	return a
+}
+
+// watchTraceflows sets up the Traceflow informer if Antrea's CRD is
+// installed, and returns its sync function.
+func (m *CaptureManager) watchTraceflows(ctx context.Context) []cache.InformerSynced {
+	_, err := m.clientset.Discovery().ServerResourcesForGroupVersion(traceflowResource.GroupVersion().String())
+	if err != nil {
+		slog.Info("Traceflow CRD not installed, Traceflow captures are disabled", "err", err)
+		return nil
+	}
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(m.dynamic, m.cfg.ResyncInterval)
+	informer := factory.ForResource(traceflowResource)
+	m.traceflowLister = informer.Lister()
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    m.enqueueTraceflowPods,
+		UpdateFunc: func(_, obj interface{}) { m.enqueueTraceflowPods(obj) },
+		DeleteFunc: m.enqueueTraceflowPods,
+	})
+	factory.Start(ctx.Done())
+	return []cache.InformerSynced{informer.Informer().HasSynced}
+}
+
+// enqueueTraceflowPods enqueues the Pods of a Traceflow that run on this
+// node, and enqueues them again when it times out so their captures stop.
+func (m *CaptureManager) enqueueTraceflowPods(obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	t, err := toTraceflow(obj)
+	if err != nil {
+		slog.Error("Invalid Traceflow", "err", err)
+		return
+	}
+	for _, key := range t.pods() {
+		ns, name, _ := cache.SplitMetaNamespaceKey(key)
+		if _, err := m.podLister.Pods(ns).Get(name); err != nil {
+			continue
+		}
+		m.queue.Add(key)
+		if wait := time.Until(t.expiry()); wait > 0 {
+			m.queue.AddAfter(key, wait)
+		}
+	}
+}
+
+// podTraceflow returns the oldest Traceflow from or to pod that has not
+// timed out and asks for a capture, either with its own capture annotation
+// or because every Traceflow is captured.
+func (m *CaptureManager) podTraceflow(pod *corev1.Pod) *traceflow {
+	if m.traceflowLister == nil {
+		return nil
+	}
+	objs, err := m.traceflowLister.List(labels.Everything())
+	if err != nil {
+		return nil
+	}
+	key := pod.Namespace + "/" + pod.Name
+	now := time.Now()
+	var found []*traceflow
+	for _, obj := range objs {
+		t, err := toTraceflow(obj)
+		if err != nil || !now.Before(t.expiry()) {
+			continue
+		}
+		if _, ok := t.Annotations[annotationKey]; !ok && !m.cfg.TraceflowCaptures {
+			continue
+		}
+		for _, k := range t.pods() {
+			if k == key {
+				found = append(found, t)
+				break
+			}
+		}
+	}
+	if len(found) == 0 {
+		return nil
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].CreationTimestamp.Equal(&found[j].CreationTimestamp) {
+			return found[i].CreationTimestamp.Before(&found[j].CreationTimestamp)
+		}
+		return found[i].Name < found[j].Name
+	})
+	return found[0]
+}
+
+func toTraceflow(obj interface{}) (*traceflow, error) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return nil, fmt.Errorf("unexpected object %T", obj)
+	}
+	var t traceflow
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.Object, &t); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
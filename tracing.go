@@ -0,0 +1,443 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// traceparentAnnotationKey holds a W3C traceparent the trace of a capture
+// joins, so the captures of one operation, or both ends of a pair, share a
+// trace.
+const traceparentAnnotationKey = "traceparent." + annotationKey
+
+const (
+	// traceQueue is the number of finished spans waiting to be exported;
+	// more are dropped. traceBatch is the most spans posted at once.
+	traceQueue = 2048
+	traceBatch = 512
+	// traceFlushInterval is how long finished spans wait for a batch to
+	// fill up.
+	traceFlushInterval = 5 * time.Second
+	// traceTimeout is how long each post of a batch may take. The
+	// exporter tries again with a backoff before it drops the batch.
+	traceTimeout = 10 * time.Second
+	// traceSessionTTL is how long the trace of a capture is remembered
+	// after it ends, so the uploads of its files join it.
+	traceSessionTTL = 24 * time.Hour
+	// traceScope names the instrumentation in exported spans.
+	traceScope = "github.com/antrea-capture/controller"
+)
+
+// traceparentHeader is the W3C header, and annotation value, that carries
+// a span context.
+const traceparentHeader = "traceparent"
+
+// sourceTraceparent returns the traceparent of the captures requested
+// through a CaptureTarget or Traceflow, derived from its UID, so every
+// agent capturing one of its Pods joins the same trace. Other sources
+// return an empty string: their annotations are requested again and again.
+func sourceTraceparent(source metav1.Object) string {
+	switch source.(type) {
+	case *captureTarget, *traceflow:
+	default:
+		return ""
+	}
+	sum := sha256.Sum256([]byte(source.GetUID()))
+	var traceID trace.TraceID
+	var spanID trace.SpanID
+	copy(traceID[:], sum[:])
+	copy(spanID[:], sum[len(traceID):])
+	sc := trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled, Remote: true})
+	return formatTraceparent(sc)
+}
+
+// formatTraceparent formats sc as a traceparent with the standard
+// propagator.
+func formatTraceparent(sc trace.SpanContext) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(trace.ContextWithSpanContext(context.Background(), sc), carrier)
+	return carrier.Get(traceparentHeader)
+}
+
+// spanAttr is an attribute of a span: a string, int, int64 or bool.
+type spanAttr struct {
+	key   string
+	value any
+}
+
+func attr(key string, value any) spanAttr {
+	return spanAttr{key: key, value: value}
+}
+
+func otelAttrs(attrs []spanAttr) []attribute.KeyValue {
+	kvs := make([]attribute.KeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		switch v := a.value.(type) {
+		case bool:
+			kvs = append(kvs, attribute.Bool(a.key, v))
+		case int:
+			kvs = append(kvs, attribute.Int(a.key, v))
+		case int64:
+			kvs = append(kvs, attribute.Int64(a.key, v))
+		default:
+			kvs = append(kvs, attribute.String(a.key, fmt.Sprint(v)))
+		}
+	}
+	return kvs
+}
+
+// span is a step of a capture. It is exported once it ends. A nil span
+// records nothing, so callers need not check whether tracing is on.
+type span struct {
+	t *tracer
+	s trace.Span
+}
+
+// child starts a span under s.
+func (s *span) child(name string, attrs ...spanAttr) *span {
+	if s == nil {
+		return nil
+	}
+	return s.t.start(trace.ContextWithSpan(context.Background(), s.s), name, time.Now(), attrs)
+}
+
+// set adds attributes to s.
+func (s *span) set(attrs ...spanAttr) {
+	if s == nil {
+		return
+	}
+	s.s.SetAttributes(otelAttrs(attrs)...)
+}
+
+// event records that something happened during s.
+func (s *span) event(name string, attrs ...spanAttr) {
+	if s == nil {
+		return
+	}
+	s.s.AddEvent(name, trace.WithAttributes(otelAttrs(attrs)...))
+}
+
+// fail marks s as failed with msg.
+func (s *span) fail(msg string) {
+	if s == nil {
+		return
+	}
+	s.s.SetStatus(codes.Error, msg)
+}
+
+// end ends s, failed if err is set, and queues it for export. Only the
+// first call counts.
+func (s *span) end(err error) {
+	if s == nil {
+		return
+	}
+	if err != nil {
+		s.fail(err.Error())
+	}
+	s.s.End()
+}
+
+// captureTrace is the trace of a capture: a span from the request to the
+// end of the capture, with the steps in between as its children.
+type captureTrace struct {
+	root *span
+	// requested is when the capture was requested, the start of the
+	// trace.
+	requested time.Time
+	first     sync.Once
+}
+
+// startCapture starts the trace of a capture requested at start. It joins
+// the trace of parent, a traceparent, if it is valid.
+func (t *tracer) startCapture(start time.Time, parent string, attrs ...spanAttr) *captureTrace {
+	if t == nil {
+		return nil
+	}
+	ctx := propagation.TraceContext{}.Extract(context.Background(), propagation.MapCarrier{traceparentHeader: strings.TrimSpace(parent)})
+	return &captureTrace{root: t.start(ctx, "capture", start, attrs), requested: start}
+}
+
+// set adds attributes to the capture.
+func (c *captureTrace) set(attrs ...spanAttr) {
+	if c == nil {
+		return
+	}
+	c.root.set(attrs...)
+}
+
+// start starts a step of the capture.
+func (c *captureTrace) start(name string, attrs ...spanAttr) *span {
+	if c == nil {
+		return nil
+	}
+	return c.root.child(name, attrs...)
+}
+
+// setSession records the session ID of the capture, by which the uploads
+// of its files find the trace.
+func (c *captureTrace) setSession(sessionID string) {
+	if c == nil {
+		return
+	}
+	c.root.set(attr("capture.session_id", sessionID))
+	c.root.t.register(sessionID, c.root.s.SpanContext())
+}
+
+// packetWritten records the first packet of the capture as a span from
+// the request, the latency operators wait for.
+func (c *captureTrace) packetWritten() {
+	if c == nil {
+		return
+	}
+	c.first.Do(func() {
+		ctx := trace.ContextWithSpan(context.Background(), c.root.s)
+		c.root.t.start(ctx, "first-packet", c.requested, nil).end(nil)
+	})
+}
+
+// event records that something happened to the capture.
+func (c *captureTrace) event(name string, attrs ...spanAttr) {
+	if c == nil {
+		return
+	}
+	c.root.event(name, attrs...)
+}
+
+// fail marks the capture as failed with msg.
+func (c *captureTrace) fail(msg string) {
+	if c == nil {
+		return
+	}
+	c.root.fail(msg)
+}
+
+// end ends the trace of the capture.
+func (c *captureTrace) end(err error) {
+	if c == nil {
+		return
+	}
+	c.root.end(err)
+	c.root.t.release(c.root.s.SpanContext())
+}
+
+// traceparent returns the traceparent of the capture, for the captures it
+// requests, or an empty string without tracing.
+func (c *captureTrace) traceparent() string {
+	if c == nil {
+		return ""
+	}
+	return formatTraceparent(c.root.s.SpanContext())
+}
+
+// traceCapture starts the trace of the capture of pod under key, requested
+// with annotations through source. It starts when the capture was requested,
+// so it shows how long the request took to be served, except for resumed
+// sessions, which start now, and scheduled runs, which start with their
+// window.
+func (m *CaptureManager) traceCapture(pod *corev1.Pod, session, key string, annotations map[string]string, source metav1.Object) *captureTrace {
+	if m.tracer == nil {
+		return nil
+	}
+	requested := captureRequestTime(source, session)
+	if _, ok := annotations[scheduleAnnotationKey]; ok {
+		requested = m.scheduleRuns[key]
+	}
+	_, resumed := m.resumedSessions[key]
+	parent := annotations[traceparentAnnotationKey]
+	if parent == "" {
+		parent = sourceTraceparent(source)
+	}
+	return m.tracer.startCapture(traceStart(requested, resumed), parent,
+		attr("k8s.namespace.name", pod.Namespace),
+		attr("k8s.pod.name", pod.Name),
+		attr("capture.session", session),
+		attr("capture.source", sourceName(source)))
+}
+
+// traceStart returns when the trace of a capture requested at requested
+// starts: then, unless the time is unknown or the capture resumes a
+// session, whose trace starts now.
+func traceStart(requested time.Time, resumed bool) time.Time {
+	if now := time.Now(); resumed || requested.IsZero() || requested.After(now) {
+		return now
+	}
+	return requested
+}
+
+// tracer exports the spans of captures to an OpenTelemetry collector over
+// OTLP/HTTP. It is shared by every capture and never holds up the capture
+// it traces: the batch processor drops spans when the collector falls
+// behind. A nil tracer traces nothing.
+type tracer struct {
+	provider *sdktrace.TracerProvider
+	tracer   trace.Tracer
+
+	mu sync.Mutex
+	// sessions maps session IDs to the root span of their capture, and
+	// when it ended, if it did.
+	sessions map[string]tracedSession
+}
+
+type tracedSession struct {
+	ctx   trace.SpanContext
+	ended time.Time
+}
+
+// newTracer returns the tracer of --otel-endpoint, or nil if none is
+// configured.
+func newTracer(cfg *Config, node string) (*tracer, error) {
+	if cfg.OTelEndpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(cfg.OTelEndpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("OTel endpoint must be an http:// or https:// URL, got %q", cfg.OTelEndpoint)
+	}
+	headers, err := parseOTelHeaders(cfg.OTelHeaders)
+	if err != nil {
+		return nil, err
+	}
+	opts := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(u.Host),
+		otlptracehttp.WithURLPath(strings.TrimSuffix(u.Path, "/") + "/v1/traces"),
+		otlptracehttp.WithHeaders(headers),
+		otlptracehttp.WithTimeout(traceTimeout),
+	}
+	if u.Scheme == "http" {
+		opts = append(opts, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(context.Background(), opts...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot set up the OTLP exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(&countingExporter{SpanExporter: exporter, endpoint: cfg.OTelEndpoint},
+			sdktrace.WithMaxQueueSize(traceQueue),
+			sdktrace.WithMaxExportBatchSize(traceBatch),
+			sdktrace.WithBatchTimeout(traceFlushInterval)),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", cfg.OTelServiceName),
+			attribute.String("k8s.node.name", node))),
+		// Every capture is traced, including those joining the trace of
+		// a request that was not sampled.
+		sdktrace.WithSampler(sdktrace.AlwaysSample()),
+	)
+	return &tracer{
+		provider: provider,
+		tracer:   provider.Tracer(traceScope),
+		sessions: make(map[string]tracedSession),
+	}, nil
+}
+
+// shutdown exports the spans still queued, waiting at most until ctx is
+// done.
+func (t *tracer) shutdown(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	if err := t.provider.Shutdown(ctx); err != nil {
+		slog.Warn("Cannot export the remaining spans", "err", err)
+	}
+}
+
+// countingExporter counts the spans exporter posts to the collector, and
+// those it drops after its retries failed.
+type countingExporter struct {
+	sdktrace.SpanExporter
+	endpoint string
+}
+
+func (e *countingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	err := e.SpanExporter.ExportSpans(ctx, spans)
+	if err != nil {
+		spansDropped.Add(float64(len(spans)))
+		slog.Warn("Cannot export spans", "collector", e.endpoint, "spans", len(spans), "err", err)
+		return err
+	}
+	spansExported.Add(float64(len(spans)))
+	return nil
+}
+
+// parseOTelHeaders parses the OTEL_EXPORTER_OTLP_HEADERS format, comma
+// separated key=value pairs with URL-encoded values.
+func parseOTelHeaders(s string) (map[string]string, error) {
+	headers := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("OTel headers must be key=value pairs, got %q", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTel header %q: %w", key, err)
+		}
+		headers[strings.TrimSpace(key)] = value
+	}
+	return headers, nil
+}
+
+// start starts a span under the span in ctx, or a new trace without one.
+func (t *tracer) start(ctx context.Context, name string, start time.Time, attrs []spanAttr) *span {
+	_, s := t.tracer.Start(ctx, name, trace.WithTimestamp(start), trace.WithAttributes(otelAttrs(attrs)...))
+	return &span{t: t, s: s}
+}
+
+// span starts a span outside of any capture, joining the trace of the
+// capture with sessionID if it is still known.
+func (t *tracer) span(name, sessionID string, attrs ...spanAttr) *span {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	ts, ok := t.sessions[sessionID]
+	t.mu.Unlock()
+	ctx := context.Background()
+	if ok {
+		ctx = trace.ContextWithSpanContext(ctx, ts.ctx)
+	}
+	return t.start(ctx, name, time.Now(), attrs)
+}
+
+// register remembers the root span of the capture with sessionID, and
+// forgets those that ended long ago.
+func (t *tracer) register(sessionID string, ctx trace.SpanContext) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, ts := range t.sessions {
+		if !ts.ended.IsZero() && time.Since(ts.ended) > traceSessionTTL {
+			delete(t.sessions, id)
+		}
+	}
+	t.sessions[sessionID] = tracedSession{ctx: ctx}
+}
+
+// release records that the capture with the root span ctx ended.
+func (t *tracer) release(ctx trace.SpanContext) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for id, ts := range t.sessions {
+		if ts.ctx.Equal(ctx) && ts.ended.IsZero() {
+			ts.ended = time.Now()
+			t.sessions[id] = ts
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// collector is an OTLP/HTTP endpoint that keeps the spans posted to it.
+type collector struct {
+	mu      sync.Mutex
+	spans   []*tracepb.Span
+	headers http.Header
+}
+
+func newCollector(t *testing.T) (*collector, string) {
+	c := &collector{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/otel/v1/traces" {
+			http.NotFound(w, r)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		var req coltracepb.ExportTraceServiceRequest
+		if err := proto.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		c.headers = r.Header.Clone()
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				c.spans = append(c.spans, ss.Spans...)
+			}
+		}
+		c.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return c, srv.URL + "/otel"
+}
+
+func (c *collector) byName() map[string]*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	spans := make(map[string]*tracepb.Span)
+	for _, s := range c.spans {
+		spans[s.Name] = s
+	}
+	return spans
+}
+
+func TestTracerExportsCaptureTrace(t *testing.T) {
+	c, endpoint := newCollector(t)
+	tr, err := newTracer(&Config{OTelEndpoint: endpoint, OTelServiceName: "test", OTelHeaders: "x-api-key=secret"}, testNode)
+	if err != nil {
+		t.Fatalf("newTracer: %v", err)
+	}
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	requested := time.Now().Add(-time.Second)
+
+	trace := tr.startCapture(requested, parent, attr("k8s.pod.name", "web"))
+	trace.setSession("s1")
+	trace.start("reconcile").end(nil)
+	trace.packetWritten()
+	upload := tr.span("upload", "s1", attr("file.size", int64(42)))
+	upload.end(nil)
+	trace.end(nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	tr.shutdown(ctx)
+
+	spans := c.byName()
+	root := spans["capture"]
+	if root == nil {
+		t.Fatalf("no capture span was exported, got %v", spans)
+	}
+	if got := hex.EncodeToString(root.TraceId); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("capture has trace %s, want the one of its traceparent", got)
+	}
+	if got := hex.EncodeToString(root.ParentSpanId); got != "00f067aa0ba902b7" {
+		t.Errorf("capture has parent %s, want the span of its traceparent", got)
+	}
+	if root.StartTimeUnixNano != uint64(requested.UnixNano()) {
+		t.Error("capture does not start when it was requested")
+	}
+	for _, name := range []string{"reconcile", "first-packet", "upload"} {
+		s := spans[name]
+		if s == nil {
+			t.Errorf("no %s span was exported", name)
+			continue
+		}
+		if string(s.ParentSpanId) != string(root.SpanId) {
+			t.Errorf("%s is not a child of the capture", name)
+		}
+	}
+	if got := c.headers.Get("X-Api-Key"); got != "secret" {
+		t.Errorf("collector got API key %q, want the configured one", got)
+	}
+	if want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + hex.EncodeToString(root.SpanId) + "-01"; trace.traceparent() != want {
+		t.Errorf("traceparent is %s, want %s", trace.traceparent(), want)
+	}
+}
+
+func TestTracerStartsNewTraceForInvalidParent(t *testing.T) {
+	c, endpoint := newCollector(t)
+	tr, err := newTracer(&Config{OTelEndpoint: endpoint}, testNode)
+	if err != nil {
+		t.Fatalf("newTracer: %v", err)
+	}
+
+	trace := tr.startCapture(time.Now(), "00-not-a-trace-01")
+	trace.fail("no slot")
+	trace.end(nil)
+	tr.shutdown(context.Background())
+
+	root := c.byName()["capture"]
+	if root == nil {
+		t.Fatal("no capture span was exported")
+	}
+	if len(root.ParentSpanId) != 0 {
+		t.Error("capture joined an invalid traceparent")
+	}
+	if root.Status.GetCode() != tracepb.Status_STATUS_CODE_ERROR || root.Status.GetMessage() != "no slot" {
+		t.Errorf("capture status is %v, want the failure", root.Status)
+	}
+}
+
+func TestSourceTraceparentIsStablePerSource(t *testing.T) {
+	target := &captureTarget{}
+	target.UID = types.UID("2f9a1c3e-7d1b-4c55-9f0a-1c2b3d4e5f60")
+	tp := sourceTraceparent(target)
+	if !strings.HasPrefix(tp, "00-") || !strings.HasSuffix(tp, "-01") || len(tp) != 55 {
+		t.Fatalf("traceparent %q is not a sampled W3C traceparent", tp)
+	}
+	if again := sourceTraceparent(target); again != tp {
+		t.Errorf("traceparent changed from %s to %s", tp, again)
+	}
+	if tp := sourceTraceparent(&captureAssignment{}); tp != "" {
+		t.Errorf("assignment has traceparent %s, want none", tp)
+	}
+}
+
+func TestNilTracerTracesNothing(t *testing.T) {
+	var tr *tracer
+	trace := tr.startCapture(time.Now(), "")
+	trace.start("reconcile").end(nil)
+	trace.packetWritten()
+	trace.end(nil)
+	tr.span("upload", "s1").end(nil)
+	tr.shutdown(context.Background())
+	if trace.traceparent() != "" {
+		t.Error("nil trace has a traceparent")
+	}
+}
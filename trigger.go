@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// triggerCaptureFiles is the file count of captures the agent starts on
+// its own.
+const triggerCaptureFiles = "3"
+
+// triggeredCapture is the capture source of a Pod the agent decided to
+// capture on its own, such as after policy drops or a health incident. It
+// only lives in the agent.
+type triggeredCapture struct {
+	metav1.ObjectMeta
+	// Reason says what started the capture.
+	Reason string
+	Until  time.Time
+}
+
+// annotations returns the capture annotation of a triggered capture.
+func (t *triggeredCapture) annotations() map[string]string {
+	return map[string]string{annotationKey: triggerCaptureFiles}
+}
+
+// triggerSet holds the triggered captures of the Pods on the node. A Pod
+// has at most one at a time; triggers firing while it runs do not extend
+// it.
+type triggerSet struct {
+	mu     sync.Mutex
+	active map[string]*triggeredCapture
+}
+
+func newTriggerSet() *triggerSet {
+	return &triggerSet{active: make(map[string]*triggeredCapture)}
+}
+
+// start records a triggered capture of pod lasting d, unless one is
+// already running. It returns nil in that case.
+func (s *triggerSet) start(pod *corev1.Pod, reason string, d time.Duration) *triggeredCapture {
+	key := pod.Namespace + "/" + pod.Name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if t, ok := s.active[key]; ok && now.Before(t.Until) {
+		return nil
+	}
+	t := &triggeredCapture{
+		ObjectMeta: metav1.ObjectMeta{Namespace: pod.Namespace, Name: pod.Name},
+		Reason:     reason,
+		Until:      now.Add(d),
+	}
+	s.active[key] = t
+	return t
+}
+
+// get returns the triggered capture of pod while it lasts.
+func (s *triggerSet) get(pod *corev1.Pod) *triggeredCapture {
+	key := pod.Namespace + "/" + pod.Name
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.active[key]
+	if !ok {
+		return nil
+	}
+	if !time.Now().Before(t.Until) {
+		delete(s.active, key)
+		return nil
+	}
+	return t
+}
+
+// triggerCapture starts a capture of pod for d unless a triggered capture
+// already runs. The Event explains why; the workqueue starts the capture,
+// and stops it once d has passed.
+func (m *CaptureManager) triggerCapture(pod *corev1.Pod, eventReason, reason string, d time.Duration) {
+	t := m.triggers.start(pod, reason, d)
+	if t == nil {
+		return
+	}
+	m.recorder.Eventf(pod, corev1.EventTypeWarning, eventReason, "%s, capturing for %s", reason, d)
+	key := pod.Namespace + "/" + pod.Name
+	m.queue.Add(key)
+	m.queue.AddAfter(key, time.Until(t.Until))
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// reasonCaptureUpdated is recorded when a running capture picks up a
+// changed request.
+const reasonCaptureUpdated = "CaptureUpdated"
+
+// liveOptions are the options a running capture takes over without a
+// restart. A traceparent only links the capture to the trace of whoever
+// requested it, so a new one is ignored.
+var liveOptions = []string{priorityAnnotationKey, writeRateAnnotationKey, traceparentAnnotationKey}
+
+// requestedOptions returns the file count val and the per-capture options
+// in annotations, by annotation.
+func requestedOptions(val string, annotations map[string]string) map[string]string {
+	opts := map[string]string{annotationKey: strings.TrimSpace(val)}
+	for _, key := range podOptions {
+		if v, ok := annotations[key]; ok {
+			opts[key] = strings.TrimSpace(v)
+		}
+	}
+	return opts
+}
+
+// changedOptions returns the annotations whose values differ between the
+// options a capture was started with and those requested now, sorted.
+func changedOptions(started, requested map[string]string) []string {
+	changed := make(map[string]bool)
+	for key, v := range started {
+		if w, ok := requested[key]; !ok || w != v {
+			changed[key] = true
+		}
+	}
+	for key := range requested {
+		if _, ok := started[key]; !ok {
+			changed[key] = true
+		}
+	}
+	return slices.Sorted(maps.Keys(changed))
+}
+
+// requestChanged returns the options the Pod's annotations, or the object
+// the capture was requested through, ask for now, and those of them that
+// differ from what the running capture cap was started with. A request that cannot be read counts as unchanged: the
+// capture keeps running as it was started rather than being torn down over
+// an annotation that would fail to start it again.
+func (m *CaptureManager) requestChanged(pod *corev1.Pod, val string, cap *CaptureProcess) (map[string]string, []string) {
+	if cap.spec.Options == nil {
+		return nil, nil
+	}
+	annotations, _ := m.captureSource(pod)
+	if cap.spec.Session != "" {
+		var err error
+		if annotations, err = sessionAnnotations(pod.Annotations, cap.spec.Session); err != nil {
+			return nil, nil
+		}
+	}
+	requested := requestedOptions(val, annotations)
+	return requested, changedOptions(cap.spec.Options, requested)
+}
+
+// updateCapture brings the running capture cap in line with its changed
+// request. Priority and write rate are applied in place; any other change,
+// e.g. to the file count or the filter, restarts the capture as a new
+// session, since its files were set up for the old request. Callers must
+// hold m.mu.
+func (m *CaptureManager) updateCapture(pod *corev1.Pod, key, val string, cap *CaptureProcess, requested map[string]string, changed []string) error {
+	options := strings.Join(changed, ", ")
+	if liveChange(changed) {
+		err := m.applyLiveOptions(cap, requested)
+		// Either way the capture now stands for this request, so an
+		// invalid value is reported once rather than on every sync.
+		cap.spec.Options = requested
+		if err != nil {
+			cap.log.Warn("Cannot apply the changed options, keeping the previous ones", "options", changed, "err", err)
+			m.recorder.Event(cap.ref, corev1.EventTypeWarning, reasonCaptureFailed,
+				sessionEvent(cap.spec, fmt.Sprintf("Cannot apply the changed %s, keeping the previous settings: %v", options, err)))
+			return nil
+		}
+		cap.log.Info("Capture request changed, applied the new options", "options", changed)
+		m.recorder.Event(cap.ref, corev1.EventTypeNormal, reasonCaptureUpdated,
+			sessionEvent(cap.spec, fmt.Sprintf("Applied the changed annotations %s to the running capture", options)))
+		m.saveState()
+		return nil
+	}
+	cap.log.Info("Capture request changed, restarting capture", "options", changed)
+	m.recorder.Event(cap.ref, corev1.EventTypeNormal, reasonCaptureUpdated,
+		sessionEvent(cap.spec, fmt.Sprintf("Annotations %s changed, restarting the capture with the new request", options)))
+	if cap.spec.Options[peerAnnotationKey] != requested[peerAnnotationKey] {
+		m.releasePeer(cap)
+	}
+	// The new capture starts when the key is synced again once the old
+	// one has stopped.
+	m.stopCapture(key, false, true)
+	return nil
+}
+
+// liveChange reports whether all changed options are liveOptions.
+func liveChange(changed []string) bool {
+	for _, key := range changed {
+		if !slices.Contains(liveOptions, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// applyLiveOptions sets the priority and write rate of cap to those of the
+// requested options, as startCapture would have.
+func (m *CaptureManager) applyLiveOptions(cap *CaptureProcess, requested map[string]string) error {
+	opts := make(map[string]string)
+	for _, key := range []string{priorityAnnotationKey, writeRateAnnotationKey} {
+		if v, ok := requested[key]; ok {
+			opts[key] = v
+		}
+	}
+	var next captureSpec
+	if err := applyPodOptions(opts, &next); err != nil {
+		return err
+	}
+	next.limitWriteRate(m.settings().MaxWriteRateMB)
+	if cap.spec.Trigger != "" && next.Priority == "" {
+		next.Priority = priorityHigh
+	}
+	cap.spec.Priority, cap.spec.WriteRateMB = next.Priority, next.WriteRateMB
+	cap.spec.WriteLimit.set(next.WriteRateMB)
+	return nil
+}
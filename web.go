@@ -0,0 +1,114 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+//go:embed web
+var webFiles embed.FS
+
+// podCaptureInfo describes a Pod on this node for the web UI.
+type podCaptureInfo struct {
+	Namespace string `json:"namespace"`
+	Pod       string `json:"pod"`
+	// MaxFiles is the value of the capture annotation, if set.
+	MaxFiles string         `json:"maxFiles,omitempty"`
+	Status   *captureStatus `json:"status,omitempty"`
+}
+
+// webHandler serves the dashboard. The page itself holds no data; it calls
+// the token protected endpoints with the token the user enters.
+func webHandler() http.Handler {
+	sub, _ := fs.Sub(webFiles, "web")
+	return http.StripPrefix("/ui/", http.FileServer(http.FS(sub)))
+}
+
+// handlePods lists the running Pods on this node with their capture state.
+func (m *CaptureManager) handlePods(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !m.synced.Load() {
+		http.Error(w, "pod cache not synced", http.StatusServiceUnavailable)
+		return
+	}
+	pods, err := m.podLister.List(labels.Everything())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out := make([]podCaptureInfo, 0, len(pods))
+	for _, pod := range pods {
+		if pod.Status.Phase != corev1.PodRunning {
+			continue
+		}
+		info := podCaptureInfo{Namespace: pod.Namespace, Pod: pod.Name, MaxFiles: m.captureAnnotations(pod)[annotationKey]}
+		var st captureStatus
+		if json.Unmarshal([]byte(pod.Annotations[statusAnnotationKey]), &st) == nil {
+			info.Status = &st
+		}
+		out = append(out, info)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Namespace != out[j].Namespace {
+			return out[i].Namespace < out[j].Namespace
+		}
+		return out[i].Pod < out[j].Pod
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"node": m.nodeName, "pods": out})
+}
+
+// handlePodAction serves POST /pods/<namespace>/<pod>/start?files=N and
+// POST /pods/<namespace>/<pod>/stop by setting or removing the capture
+// annotation, exactly like kubectl annotate would.
+func (m *CaptureManager) handlePodAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/pods/"), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	ns, name, action := parts[0], parts[1], parts[2]
+	pod, err := m.podLister.Pods(ns).Get(name)
+	if err != nil {
+		// Only Pods on this node can be managed through its agent.
+		http.NotFound(w, r)
+		return
+	}
+
+	var val interface{}
+	switch action {
+	case "start":
+		files, err := strconv.Atoi(r.URL.Query().Get("files"))
+		if err != nil || files <= 0 {
+			http.Error(w, "files must be a positive file count", http.StatusBadRequest)
+			return
+		}
+		val = strconv.Itoa(files)
+	case "stop":
+		// A null value removes the annotation in a merge patch.
+		val = nil
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err := m.patchAnnotations(pod, map[string]interface{}{annotationKey: val}); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
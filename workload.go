@@ -0,0 +1,82 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// workloadListers resolve the workload controlling a Pod.
+type workloadListers struct {
+	replicaSets  appslisters.ReplicaSetLister
+	deployments  appslisters.DeploymentLister
+	statefulSets appslisters.StatefulSetLister
+	daemonSets   appslisters.DaemonSetLister
+}
+
+// watchWorkloads sets up the informers for workloads whose capture
+// annotation applies to their Pods, and returns their sync functions.
+// ReplicaSets are only needed to find the Deployment of a Pod, so their
+// events are ignored; new ReplicaSets of a rollout bring new Pods, which
+// are enqueued anyway.
+func (m *CaptureManager) watchWorkloads(factory informers.SharedInformerFactory) []cache.InformerSynced {
+	apps := factory.Apps().V1()
+	handler := m.annotationHandler(metav1.Object.GetNamespace)
+	rs, deploy, sts, ds := apps.ReplicaSets(), apps.Deployments(), apps.StatefulSets(), apps.DaemonSets()
+	deploy.Informer().AddEventHandler(handler)
+	sts.Informer().AddEventHandler(handler)
+	ds.Informer().AddEventHandler(handler)
+	m.workloads = &workloadListers{
+		replicaSets:  rs.Lister(),
+		deployments:  deploy.Lister(),
+		statefulSets: sts.Lister(),
+		daemonSets:   ds.Lister(),
+	}
+	return []cache.InformerSynced{
+		rs.Informer().HasSynced, deploy.Informer().HasSynced,
+		sts.Informer().HasSynced, ds.Informer().HasSynced,
+	}
+}
+
+// podWorkload returns the Deployment, StatefulSet or DaemonSet controlling
+// pod, or nil.
+func (m *CaptureManager) podWorkload(pod *corev1.Pod) metav1.Object {
+	if m.workloads == nil {
+		return nil
+	}
+	ref := metav1.GetControllerOf(pod)
+	if ref == nil {
+		return nil
+	}
+	switch ref.Kind {
+	case "ReplicaSet":
+		rs, err := m.workloads.replicaSets.ReplicaSets(pod.Namespace).Get(ref.Name)
+		if err != nil || rs.UID != ref.UID {
+			return nil
+		}
+		owner := metav1.GetControllerOf(rs)
+		if owner == nil || owner.Kind != "Deployment" {
+			return nil
+		}
+		d, err := m.workloads.deployments.Deployments(pod.Namespace).Get(owner.Name)
+		if err != nil || d.UID != owner.UID {
+			return nil
+		}
+		return d
+	case "StatefulSet":
+		sts, err := m.workloads.statefulSets.StatefulSets(pod.Namespace).Get(ref.Name)
+		if err != nil || sts.UID != ref.UID {
+			return nil
+		}
+		return sts
+	case "DaemonSet":
+		ds, err := m.workloads.daemonSets.DaemonSets(pod.Namespace).Get(ref.Name)
+		if err != nil || ds.UID != ref.UID {
+			return nil
+		}
+		return ds
+	}
+	return nil
+}